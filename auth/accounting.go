@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+// AccountingDayFormat 对账按本地日期统计
+const AccountingDayFormat = "2006-01-02"
+
+// AccountingFigures 单个账号某一天的估算token与观测到的额度消耗
+type AccountingFigures struct {
+	Requests        int64   `json:"requests"`
+	InputTokens     int64   `json:"input_tokens"`
+	OutputTokens    int64   `json:"output_tokens"`
+	ObservedCredits float64 `json:"observed_credits"` // 相邻两次用量检查之间已用额度的增量之和
+}
+
+// accountingLedger 按天、按账号（ConfigID）累计估算token和用量刷新观测到的额度消耗
+// 用量刷新在后台进行，不持有TokenManager的锁，因此使用独立的锁
+type accountingLedger struct {
+	mutex    sync.Mutex
+	days     map[string]map[string]*AccountingFigures // 日期 -> ConfigID -> 统计
+	lastUsed map[string]float64                       // ConfigID -> 上一次检查时的已用额度
+}
+
+func newAccountingLedger() *accountingLedger {
+	return &accountingLedger{
+		days:     make(map[string]map[string]*AccountingFigures),
+		lastUsed: make(map[string]float64),
+	}
+}
+
+// figuresLocked 返回某天某账号的统计，不存在时创建；创建新的一天时淘汰超出保留期的数据
+func (l *accountingLedger) figuresLocked(day, id string) *AccountingFigures {
+	accounts, exists := l.days[day]
+	if !exists {
+		accounts = make(map[string]*AccountingFigures)
+		l.days[day] = accounts
+		l.pruneLocked()
+	}
+	figures, exists := accounts[id]
+	if !exists {
+		figures = &AccountingFigures{}
+		accounts[id] = figures
+	}
+	return figures
+}
+
+func (l *accountingLedger) pruneLocked() {
+	if len(l.days) <= config.AccountingRetentionDays {
+		return
+	}
+	days := make([]string, 0, len(l.days))
+	for day := range l.days {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	for _, day := range days[:len(days)-config.AccountingRetentionDays] {
+		delete(l.days, day)
+	}
+}
+
+func (l *accountingLedger) recordTokens(at time.Time, id string, inputTokens, outputTokens int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	figures := l.figuresLocked(at.Format(AccountingDayFormat), id)
+	figures.Requests++
+	figures.InputTokens += int64(inputTokens)
+	figures.OutputTokens += int64(outputTokens)
+}
+
+// observeUsage 记录一次用量检查的已用额度，与上一次检查的差值计入当天消耗
+// 第一次检查只作为基准；已用额度变小说明额度周期已重置，此时新的已用额度即重置后的消耗
+func (l *accountingLedger) observeUsage(at time.Time, id string, used float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	last, exists := l.lastUsed[id]
+	l.lastUsed[id] = used
+	if !exists {
+		return
+	}
+	delta := used - last
+	if delta < 0 {
+		delta = used
+	}
+	if delta > 0 {
+		l.figuresLocked(at.Format(AccountingDayFormat), id).ObservedCredits += delta
+	}
+}
+
+func (l *accountingLedger) day(day string) map[string]AccountingFigures {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	result := make(map[string]AccountingFigures, len(l.days[day]))
+	for id, figures := range l.days[day] {
+		result[id] = *figures
+	}
+	return result
+}
+
+// UsedCredits 计算已用额度（CREDIT资源类型的基础额度与有效免费试用额度之和）
+func UsedCredits(usage *types.UsageLimits) float64 {
+	for _, breakdown := range usage.UsageBreakdownList {
+		if breakdown.ResourceType != "CREDIT" {
+			continue
+		}
+		used := breakdown.CurrentUsageWithPrecision
+		if breakdown.FreeTrialInfo != nil && breakdown.FreeTrialInfo.FreeTrialStatus == "ACTIVE" {
+			used += breakdown.FreeTrialInfo.CurrentUsageWithPrecision
+		}
+		return used
+	}
+	return 0
+}
+
+// AccountID 返回access token所属账号的ConfigID，未找到时返回空字符串
+func (tm *TokenManager) AccountID(accessToken string) string {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	return tm.configIDs[tm.cacheKeyByAccessTokenUnlocked(accessToken)]
+}
+
+// RecordEstimatedTokens 把一次请求的估算token计入所用账号当天的统计
+func (tm *TokenManager) RecordEstimatedTokens(accessToken string, inputTokens, outputTokens int) {
+	id := tm.AccountID(accessToken)
+	if id == "" {
+		return
+	}
+	tm.accounting.recordTokens(tm.now(), id, inputTokens, outputTokens)
+}
+
+// AccountingDay 返回某天（AccountingDayFormat）各账号的估算token与观测额度消耗
+func (tm *TokenManager) AccountingDay(day string) map[string]AccountingFigures {
+	return tm.accounting.day(day)
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountingLedger_ObserveUsageDeltas(t *testing.T) {
+	ledger := newAccountingLedger()
+	day := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+
+	ledger.observeUsage(day, "a", 100) // 第一次检查只作为基准
+	ledger.observeUsage(day.Add(time.Minute), "a", 112.5)
+	ledger.observeUsage(day.Add(2*time.Minute), "a", 112.5) // 没有变化
+	ledger.observeUsage(day.Add(3*time.Minute), "a", 4)     // 额度周期重置
+	ledger.observeUsage(day.AddDate(0, 0, 1), "a", 10)      // 次日的增量计入次日
+
+	assert.Equal(t, 16.5, ledger.day("2026-10-17")["a"].ObservedCredits)
+	assert.Equal(t, 6.0, ledger.day("2026-10-18")["a"].ObservedCredits)
+}
+
+func TestAccountingLedger_PrunesOldDays(t *testing.T) {
+	ledger := newAccountingLedger()
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.Local)
+	for i := range config.AccountingRetentionDays + 2 {
+		ledger.recordTokens(start.AddDate(0, 0, i), "a", 10, 5)
+	}
+	assert.Len(t, ledger.days, config.AccountingRetentionDays)
+	assert.Empty(t, ledger.day("2026-10-01"))
+	assert.Equal(t, AccountingFigures{Requests: 1, InputTokens: 10, OutputTokens: 5}, ledger.day("2026-10-10")["a"])
+}
+
+func TestTokenManager_RecordEstimatedTokens(t *testing.T) {
+	tm, _ := newHealthTestManager(2)
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	tm.now = func() time.Time { return now }
+
+	tm.RecordEstimatedTokens("access_1", 100, 20)
+	tm.RecordEstimatedTokens("access_1", 50, 10)
+	tm.RecordEstimatedTokens("unknown", 50, 10) // 不属于任何账号，忽略
+
+	id := tm.configIDs[fmt.Sprintf(config.TokenCacheKeyFormat, 1)]
+	assert.Equal(t, id, tm.AccountID("access_1"))
+	assert.Equal(t, map[string]AccountingFigures{
+		id: {Requests: 2, InputTokens: 150, OutputTokens: 30},
+	}, tm.AccountingDay("2026-10-17"))
+}
+
+func TestUsedCredits(t *testing.T) {
+	usage := &types.UsageLimits{UsageBreakdownList: []types.UsageBreakdown{
+		{ResourceType: "OTHER", CurrentUsageWithPrecision: 99},
+		{
+			ResourceType:              "CREDIT",
+			CurrentUsageWithPrecision: 12.5,
+			FreeTrialInfo:             &types.FreeTrialInfo{FreeTrialStatus: "ACTIVE", CurrentUsageWithPrecision: 3},
+		},
+	}}
+	assert.Equal(t, 15.5, UsedCredits(usage))
+
+	usage.UsageBreakdownList[1].FreeTrialInfo.FreeTrialStatus = "EXPIRED"
+	assert.Equal(t, 12.5, UsedCredits(usage))
+	assert.Zero(t, UsedCredits(&types.UsageLimits{}))
+}
@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"kiro2api/logger"
 	"kiro2api/types"
+	"sync"
 )
 
 // AuthService 认证服务（推荐使用依赖注入方式）
 type AuthService struct {
 	tokenManager *TokenManager
 	configs      []AuthConfig
+	mutex        sync.RWMutex // 保护configs（ReloadConfigs会替换）
 }
 
 // NewAuthService 创建新的认证服务（推荐使用此方法而不是全局函数）
@@ -22,17 +24,34 @@ func NewAuthService() (*AuthService, error) {
 		return nil, fmt.Errorf("加载配置失败: %w", err)
 	}
 
+	// 配置文件存在但没有可用配置时以空池启动，请求会返回"没有可用的token"
 	if len(configs) == 0 {
-		return nil, fmt.Errorf("未找到有效的token配置")
+		logger.Warn("token池为空，请通过Web界面添加或启用配置后重启服务",
+			logger.String("config_file", ConfigFilePath()))
 	}
 
+	// 用量检查结果的复用时长（USAGE_CACHE_TTL）
+	usageCache.SetTTL(UsageCacheTTL())
+
+	// 恢复持久化的封禁状态（BAN_STATE_FILE）
+	banStore = NewBanStoreFromEnv()
+
+	// 恢复持久化的token错误记录（TOKEN_ERROR_HISTORY_FILE）
+	tokenErrorStore = NewTokenErrorStoreFromEnv()
+
 	// 创建token管理器
 	tokenManager := NewTokenManager(configs)
 
+	// 多副本共享token池状态（CLUSTER_REDIS_URL）
+	tokenManager.cluster = NewClusterStateFromEnv()
+
 	// 预热第一个可用token
-	_, warmupErr := tokenManager.getBestToken()
-	if warmupErr != nil {
-		logger.Warn("token预热失败", logger.Err(warmupErr))
+	if len(configs) > 0 {
+		if token, warmupErr := tokenManager.getBestToken(); warmupErr != nil {
+			logger.Warn("token预热失败", logger.Err(warmupErr))
+		} else {
+			tokenManager.ReleaseToken(token.AccessToken)
+		}
 	}
 
 	logger.Info("AuthService创建完成", logger.Int("config_count", len(configs)))
@@ -59,6 +78,22 @@ func (as *AuthService) GetTokenWithUsage() (*types.TokenWithUsage, error) {
 	return as.tokenManager.GetBestTokenWithUsage()
 }
 
+// GetProbeToken 获取用于管理探测请求的token，不扣减客户端请求使用的可用次数
+func (as *AuthService) GetProbeToken() (types.TokenInfo, error) {
+	if as.tokenManager == nil {
+		return types.TokenInfo{}, fmt.Errorf("token管理器未初始化")
+	}
+	return as.tokenManager.PeekBestToken()
+}
+
+// GetNextToken 获取当前token之外的可用token，用于同一请求换token重试；没有其他可选token时可能返回当前token
+func (as *AuthService) GetNextToken(current types.TokenInfo) (*types.TokenWithUsage, error) {
+	if as.tokenManager == nil {
+		return nil, fmt.Errorf("token管理器未初始化")
+	}
+	return as.tokenManager.GetBestTokenExcluding(current.AccessToken)
+}
+
 // GetTokenManager 获取底层的TokenManager（用于高级操作）
 func (as *AuthService) GetTokenManager() *TokenManager {
 	return as.tokenManager
@@ -66,5 +101,7 @@ func (as *AuthService) GetTokenManager() *TokenManager {
 
 // GetConfigs 获取认证配置
 func (as *AuthService) GetConfigs() []AuthConfig {
+	as.mutex.RLock()
+	defer as.mutex.RUnlock()
 	return as.configs
 }
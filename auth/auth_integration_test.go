@@ -8,6 +8,7 @@ import (
 )
 
 func TestNewAuthService_FromEnv(t *testing.T) {
+	withRefreshRetryConfig(t, 0, 0)
 	// 保存原始环境变量
 	originalToken := os.Getenv("KIRO_AUTH_TOKEN")
 	defer os.Setenv("KIRO_AUTH_TOKEN", originalToken)
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/types"
+)
+
+// 认证相关上游调用的操作类型
+const (
+	AuthOpRefresh    = "refresh"     // 刷新access token
+	AuthOpUsageCheck = "usage_check" // 查询使用限制
+)
+
+// 刷新结果分类
+const (
+	RefreshOutcomeSuccess        = "success"
+	RefreshOutcomeAuthFailure    = "auth_failure"    // 身份提供方拒绝（4xx），通常是refresh token失效或配置错误
+	RefreshOutcomeNetworkFailure = "network_failure" // 网络错误、5xx或响应无法解析
+	RefreshOutcomeThrottled      = "throttled"       // 身份提供方限流，或ClientID组仍在退避期
+)
+
+// unknownAuthType 用量检查的token尚未经过刷新时使用的认证类型标签
+const unknownAuthType = "unknown"
+
+// authDurationBuckets 刷新和用量检查耗时直方图的桶上界（秒）
+var authDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// refreshStatusError 身份提供方返回的非200响应
+type refreshStatusError struct {
+	prefix     string
+	statusCode int
+	body       string
+}
+
+func (e *refreshStatusError) Error() string {
+	return fmt.Sprintf("%s: 状态码 %d, 响应: %s", e.prefix, e.statusCode, e.body)
+}
+
+// ConfigID 配置的稳定标识（refresh token摘要），不随配置顺序变化，也不暴露token
+func ConfigID(cfg AuthConfig) string {
+	return refreshTokenID(cfg.RefreshToken)
+}
+
+func refreshTokenID(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:6])
+}
+
+// AuthMetrics 按认证类型和配置统计刷新、用量检查的耗时分布及刷新结果
+type AuthMetrics struct {
+	mutex       sync.Mutex
+	durations   map[authMetricKey]*authDurationHistogram
+	outcomes    map[refreshOutcomeKey]int64
+	lastRefresh map[string]time.Duration // key: ConfigID
+	authTypes   map[string]string        // ConfigID -> 认证类型，供用量检查打标签
+}
+
+// authMetricKey 耗时直方图的标签组合
+type authMetricKey struct {
+	Operation string
+	AuthType  string
+	ConfigID  string
+}
+
+// refreshOutcomeKey 刷新结果计数的标签组合
+type refreshOutcomeKey struct {
+	AuthType string
+	Outcome  string
+}
+
+// authDurationHistogram 累积直方图，counts[i]为耗时不超过authDurationBuckets[i]的次数
+type authDurationHistogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// AuthDurationSnapshot 单个标签组合的耗时快照，Buckets的键为桶上界（秒）
+type AuthDurationSnapshot struct {
+	Operation  string           `json:"operation"`
+	AuthType   string           `json:"auth_type"`
+	ConfigID   string           `json:"config_id"`
+	Count      int64            `json:"count"`
+	SumSeconds float64          `json:"sum_seconds"`
+	Buckets    map[string]int64 `json:"buckets"`
+}
+
+// RefreshOutcomeSnapshot 刷新结果计数快照
+type RefreshOutcomeSnapshot struct {
+	AuthType string `json:"auth_type"`
+	Outcome  string `json:"outcome"`
+	Count    int64  `json:"count"`
+}
+
+// AuthMetricsSnapshot 认证统计快照（/api/stats）
+type AuthMetricsSnapshot struct {
+	Durations []AuthDurationSnapshot   `json:"durations"`
+	Refreshes []RefreshOutcomeSnapshot `json:"refreshes"`
+}
+
+// NewAuthMetrics 创建认证统计
+func NewAuthMetrics() *AuthMetrics {
+	return &AuthMetrics{
+		durations:   make(map[authMetricKey]*authDurationHistogram),
+		outcomes:    make(map[refreshOutcomeKey]int64),
+		lastRefresh: make(map[string]time.Duration),
+		authTypes:   make(map[string]string),
+	}
+}
+
+// authMetrics 全局认证统计（测试可替换）
+var authMetrics = NewAuthMetrics()
+
+// Metrics 返回全局认证统计
+func Metrics() *AuthMetrics {
+	return authMetrics
+}
+
+// ObserveRefresh 记录一次刷新的耗时和结果
+func (m *AuthMetrics) ObserveRefresh(authType, configID string, duration time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.observeLocked(authMetricKey{Operation: AuthOpRefresh, AuthType: authType, ConfigID: configID}, duration)
+	m.outcomes[refreshOutcomeKey{AuthType: authType, Outcome: classifyRefreshError(err)}]++
+	m.lastRefresh[configID] = duration
+	m.authTypes[configID] = authType
+}
+
+// ObserveUsageCheck 记录一次用量检查的耗时，认证类型取自该配置最近一次刷新
+func (m *AuthMetrics) ObserveUsageCheck(configID string, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	authType, exists := m.authTypes[configID]
+	if !exists {
+		authType = unknownAuthType
+	}
+	m.observeLocked(authMetricKey{Operation: AuthOpUsageCheck, AuthType: authType, ConfigID: configID}, duration)
+}
+
+func (m *AuthMetrics) observeLocked(key authMetricKey, duration time.Duration) {
+	histogram, exists := m.durations[key]
+	if !exists {
+		histogram = &authDurationHistogram{counts: make([]int64, len(authDurationBuckets))}
+		m.durations[key] = histogram
+	}
+	seconds := duration.Seconds()
+	histogram.count++
+	histogram.sum += seconds
+	for i, bound := range authDurationBuckets {
+		if seconds <= bound {
+			histogram.counts[i]++
+		}
+	}
+}
+
+// LastRefreshDuration 配置最近一次刷新的耗时
+func (m *AuthMetrics) LastRefreshDuration(cfg AuthConfig) (time.Duration, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	duration, exists := m.lastRefresh[ConfigID(cfg)]
+	return duration, exists
+}
+
+// Snapshot 返回按标签排序的统计快照
+func (m *AuthMetrics) Snapshot() AuthMetricsSnapshot {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	snapshot := AuthMetricsSnapshot{
+		Durations: make([]AuthDurationSnapshot, 0, len(m.durations)),
+		Refreshes: make([]RefreshOutcomeSnapshot, 0, len(m.outcomes)),
+	}
+	for key, histogram := range m.durations {
+		buckets := make(map[string]int64, len(authDurationBuckets))
+		for i, bound := range authDurationBuckets {
+			buckets[formatAuthBucketBound(bound)] = histogram.counts[i]
+		}
+		snapshot.Durations = append(snapshot.Durations, AuthDurationSnapshot{
+			Operation:  key.Operation,
+			AuthType:   key.AuthType,
+			ConfigID:   key.ConfigID,
+			Count:      histogram.count,
+			SumSeconds: histogram.sum,
+			Buckets:    buckets,
+		})
+	}
+	for key, count := range m.outcomes {
+		snapshot.Refreshes = append(snapshot.Refreshes, RefreshOutcomeSnapshot{
+			AuthType: key.AuthType,
+			Outcome:  key.Outcome,
+			Count:    count,
+		})
+	}
+
+	sort.Slice(snapshot.Durations, func(i, j int) bool {
+		a, b := snapshot.Durations[i], snapshot.Durations[j]
+		if a.Operation != b.Operation {
+			return a.Operation < b.Operation
+		}
+		if a.AuthType != b.AuthType {
+			return a.AuthType < b.AuthType
+		}
+		return a.ConfigID < b.ConfigID
+	})
+	sort.Slice(snapshot.Refreshes, func(i, j int) bool {
+		a, b := snapshot.Refreshes[i], snapshot.Refreshes[j]
+		if a.AuthType != b.AuthType {
+			return a.AuthType < b.AuthType
+		}
+		return a.Outcome < b.Outcome
+	})
+	return snapshot
+}
+
+// WritePrometheus 以Prometheus文本格式输出统计
+func (m *AuthMetrics) WritePrometheus(b *strings.Builder) {
+	snapshot := m.Snapshot()
+
+	b.WriteString("# HELP kiro2api_auth_duration_seconds Token refresh and usage-check duration, by auth type and config.\n")
+	b.WriteString("# TYPE kiro2api_auth_duration_seconds histogram\n")
+	for _, s := range snapshot.Durations {
+		labels := fmt.Sprintf("operation=%q,auth_type=%q,config_id=%q", s.Operation, s.AuthType, s.ConfigID)
+		for _, bound := range authDurationBuckets {
+			le := formatAuthBucketBound(bound)
+			fmt.Fprintf(b, "kiro2api_auth_duration_seconds_bucket{%s,le=%q} %d\n", labels, le, s.Buckets[le])
+		}
+		fmt.Fprintf(b, "kiro2api_auth_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, s.Count)
+		fmt.Fprintf(b, "kiro2api_auth_duration_seconds_sum{%s} %g\n", labels, s.SumSeconds)
+		fmt.Fprintf(b, "kiro2api_auth_duration_seconds_count{%s} %d\n", labels, s.Count)
+	}
+
+	b.WriteString("# HELP kiro2api_token_refreshes_total Token refreshes, by auth type and outcome.\n")
+	b.WriteString("# TYPE kiro2api_token_refreshes_total counter\n")
+	for _, s := range snapshot.Refreshes {
+		fmt.Fprintf(b, "kiro2api_token_refreshes_total{auth_type=%q,outcome=%q} %d\n", s.AuthType, s.Outcome, s.Count)
+	}
+}
+
+// formatAuthBucketBound 格式化直方图桶上界
+func formatAuthBucketBound(bound float64) string {
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+// classifyRefreshError 将刷新错误归类为结果标签
+func classifyRefreshError(err error) string {
+	if err == nil {
+		return RefreshOutcomeSuccess
+	}
+	var throttleResp *idcThrottleResponseError
+	if errors.Is(err, ErrRefreshThrottled) || errors.As(err, &throttleResp) {
+		return RefreshOutcomeThrottled
+	}
+	var statusErr *refreshStatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.statusCode == http.StatusTooManyRequests:
+			return RefreshOutcomeThrottled
+		case statusErr.statusCode >= http.StatusBadRequest && statusErr.statusCode < http.StatusInternalServerError:
+			return RefreshOutcomeAuthFailure
+		}
+		return RefreshOutcomeNetworkFailure
+	}
+	return RefreshOutcomeNetworkFailure
+}
+
+// RefreshToken 按配置的认证类型刷新token，所有刷新都经由此处统计耗时和结果
+func RefreshToken(cfg AuthConfig) (types.TokenInfo, error) {
+	var refresh func() (types.TokenInfo, error)
+	switch cfg.AuthType {
+	case AuthMethodSocial:
+		refresh = func() (types.TokenInfo, error) { return refreshSocialToken(cfg.RefreshToken) }
+	case AuthMethodIdC:
+		refresh = func() (types.TokenInfo, error) { return refreshIdCToken(cfg) }
+	default:
+		return types.TokenInfo{}, fmt.Errorf("不支持的认证类型: %s", cfg.AuthType)
+	}
+
+	startedAt := time.Now()
+	token, err := refresh()
+	authMetrics.ObserveRefresh(cfg.AuthType, ConfigID(cfg), time.Since(startedAt), err)
+	tokenErrorStore.observeRefreshError(cfg, err)
+	return token, err
+}
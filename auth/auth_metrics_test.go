@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withAuthMetrics 替换全局认证统计，测试结束后恢复
+func withAuthMetrics(t *testing.T) *AuthMetrics {
+	t.Helper()
+	original := authMetrics
+	authMetrics = NewAuthMetrics()
+	t.Cleanup(func() { authMetrics = original })
+	return authMetrics
+}
+
+// newFakeAuthProvider 模拟身份提供方和用量接口：status非200时刷新返回该状态码
+func newFakeAuthProvider(t *testing.T, status int, body string) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/getUsageLimits" {
+			_, _ = w.Write([]byte(`{"usageBreakdownList": [{"resourceType": "CREDIT", "usageLimitWithPrecision": 50, "currentUsageWithPrecision": 20}]}`))
+			return
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("SOCIAL_REFRESH_URL", upstream.URL+"/refreshToken")
+	t.Setenv("IDC_REFRESH_URL", upstream.URL+"/token")
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+}
+
+func durationFor(snapshot AuthMetricsSnapshot, operation, authType, configID string) (AuthDurationSnapshot, bool) {
+	for _, s := range snapshot.Durations {
+		if s.Operation == operation && s.AuthType == authType && s.ConfigID == configID {
+			return s, true
+		}
+	}
+	return AuthDurationSnapshot{}, false
+}
+
+func TestAuthMetrics_RecordsRefreshAndUsageCheckPerProvider(t *testing.T) {
+	metrics := withAuthMetrics(t)
+	withIdCRefreshLimiter(t, NewIdCRefreshLimiter(0, time.Minute, 5*time.Minute))
+	withUsageCache(t, NewUsageCache(0)) // 每次检查都访问上游
+	newFakeAuthProvider(t, http.StatusOK, `{"accessToken":"access","expiresIn":3600}`)
+
+	social := AuthConfig{AuthType: AuthMethodSocial, RefreshToken: "social-refresh"}
+	idc := AuthConfig{AuthType: AuthMethodIdC, RefreshToken: "idc-refresh", ClientID: "client", ClientSecret: "secret"}
+
+	for _, cfg := range []AuthConfig{social, social, idc} {
+		token, err := RefreshToken(cfg)
+		require.NoError(t, err)
+		result := NewUsageLimitsChecker().CheckUsageLimitsWithStatus(token)
+		require.NoError(t, result.Error)
+	}
+	// 公开的按类型刷新函数同样计入统计
+	_, err := RefreshIdCToken(idc)
+	require.NoError(t, err)
+
+	snapshot := metrics.Snapshot()
+	socialRefresh, ok := durationFor(snapshot, AuthOpRefresh, AuthMethodSocial, ConfigID(social))
+	require.True(t, ok)
+	assert.Equal(t, int64(2), socialRefresh.Count)
+	assert.Equal(t, int64(2), socialRefresh.Buckets["30"])
+
+	idcRefresh, ok := durationFor(snapshot, AuthOpRefresh, AuthMethodIdC, ConfigID(idc))
+	require.True(t, ok)
+	assert.Equal(t, int64(2), idcRefresh.Count)
+
+	// 用量检查按刷新时记录的认证类型打标签
+	socialUsage, ok := durationFor(snapshot, AuthOpUsageCheck, AuthMethodSocial, ConfigID(social))
+	require.True(t, ok)
+	assert.Equal(t, int64(2), socialUsage.Count)
+	idcUsage, ok := durationFor(snapshot, AuthOpUsageCheck, AuthMethodIdC, ConfigID(idc))
+	require.True(t, ok)
+	assert.Equal(t, int64(1), idcUsage.Count)
+
+	assert.Equal(t, []RefreshOutcomeSnapshot{
+		{AuthType: AuthMethodIdC, Outcome: RefreshOutcomeSuccess, Count: 2},
+		{AuthType: AuthMethodSocial, Outcome: RefreshOutcomeSuccess, Count: 2},
+	}, snapshot.Refreshes)
+
+	_, exists := metrics.LastRefreshDuration(social)
+	assert.True(t, exists)
+	_, exists = metrics.LastRefreshDuration(AuthConfig{RefreshToken: "never-refreshed"})
+	assert.False(t, exists)
+
+	var b strings.Builder
+	metrics.WritePrometheus(&b)
+	body := b.String()
+	labels := fmt.Sprintf(`operation="refresh",auth_type="Social",config_id=%q`, ConfigID(social))
+	assert.Contains(t, body, "kiro2api_auth_duration_seconds_count{"+labels+"} 2")
+	assert.Contains(t, body, "kiro2api_auth_duration_seconds_bucket{"+labels+`,le="+Inf"} 2`)
+	assert.Contains(t, body, `kiro2api_token_refreshes_total{auth_type="IdC",outcome="success"} 2`)
+	assert.NotContains(t, body, "social-refresh", "标签不应暴露refresh token")
+}
+
+func TestAuthMetrics_RefreshOutcomes(t *testing.T) {
+	// 重试不影响结果分类，关闭以免等待
+	withRefreshRetryConfig(t, 0, 0)
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		outcome string
+	}{
+		{"refresh token失效", http.StatusUnauthorized, `{"message":"invalid"}`, RefreshOutcomeAuthFailure},
+		{"限流", http.StatusTooManyRequests, `{"message":"slow down"}`, RefreshOutcomeThrottled},
+		{"服务端错误", http.StatusBadGateway, `bad gateway`, RefreshOutcomeNetworkFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := withAuthMetrics(t)
+			newFakeAuthProvider(t, tt.status, tt.body)
+
+			_, err := RefreshToken(AuthConfig{AuthType: AuthMethodSocial, RefreshToken: "refresh"})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), fmt.Sprintf("状态码 %d", tt.status))
+			assert.Equal(t, []RefreshOutcomeSnapshot{{AuthType: AuthMethodSocial, Outcome: tt.outcome, Count: 1}}, metrics.Snapshot().Refreshes)
+		})
+	}
+
+	t.Run("网络错误", func(t *testing.T) {
+		metrics := withAuthMetrics(t)
+		t.Setenv("SOCIAL_REFRESH_URL", "http://127.0.0.1:1/refreshToken")
+
+		_, err := RefreshToken(AuthConfig{AuthType: AuthMethodSocial, RefreshToken: "refresh"})
+		require.Error(t, err)
+		assert.Equal(t, RefreshOutcomeNetworkFailure, metrics.Snapshot().Refreshes[0].Outcome)
+	})
+}
+
+func TestClassifyRefreshError(t *testing.T) {
+	assert.Equal(t, RefreshOutcomeSuccess, classifyRefreshError(nil))
+	assert.Equal(t, RefreshOutcomeThrottled, classifyRefreshError(&RefreshThrottledError{ClientID: "c", RetryAt: time.Now()}))
+	assert.Equal(t, RefreshOutcomeThrottled, classifyRefreshError(&idcThrottleResponseError{statusCode: http.StatusBadRequest, body: "SlowDownException"}))
+	assert.Equal(t, RefreshOutcomeAuthFailure, classifyRefreshError(&refreshStatusError{prefix: "IdC刷新失败", statusCode: http.StatusBadRequest}))
+	assert.Equal(t, RefreshOutcomeNetworkFailure, classifyRefreshError(errors.New("连接被重置")))
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// BanRecord 账号被检测为封禁的记录
+type BanRecord struct {
+	Reason     string    `json:"reason"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// BanStore 按配置（ConfigID）记录封禁状态，配置了文件路径时持久化，重启后恢复
+// 封禁记录在重新检查间隔内有效：期间TokenManager不再刷新该账号，也不参与选择
+type BanStore struct {
+	mutex   sync.Mutex
+	path    string               // 为空时只保存在内存中
+	records map[string]BanRecord // key: ConfigID
+}
+
+// banStore 全局封禁状态（测试可替换）
+var banStore = NewBanStore("")
+
+// NewBanStore 创建封禁状态存储，path为空时不持久化
+func NewBanStore(path string) *BanStore {
+	return &BanStore{path: path, records: make(map[string]BanRecord)}
+}
+
+// NewBanStoreFromEnv BAN_STATE_FILE: 封禁状态文件路径（默认不持久化），文件存在时加载已有记录
+func NewBanStoreFromEnv() *BanStore {
+	store := NewBanStore(strings.TrimSpace(os.Getenv("BAN_STATE_FILE")))
+	if err := store.load(); err != nil {
+		logger.Warn("加载封禁状态失败，忽略已有记录", logger.String("path", store.path), logger.Err(err))
+	} else if len(store.records) > 0 {
+		logger.Info("已恢复封禁状态", logger.String("path", store.path), logger.Int("count", len(store.records)))
+	}
+	return store
+}
+
+// BanRecheckInterval 读取 BAN_RECHECK_INTERVAL（Go duration格式，如 6h），无效或未设置时使用默认值
+func BanRecheckInterval() time.Duration {
+	value := strings.TrimSpace(os.Getenv("BAN_RECHECK_INTERVAL"))
+	if value == "" {
+		return config.BanRecheckInterval
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		logger.Warn("BAN_RECHECK_INTERVAL无效，使用默认值",
+			logger.String("value", value),
+			logger.Duration("default", config.BanRecheckInterval))
+		return config.BanRecheckInterval
+	}
+	return interval
+}
+
+func (s *BanStore) load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	records := make(map[string]BanRecord)
+	if err := utils.SafeUnmarshal(data, &records); err != nil {
+		return err
+	}
+	s.records = records
+	return nil
+}
+
+// saveLocked 先写临时文件再重命名，避免进程中断时留下不完整的文件
+// 内部方法：调用者必须持有 s.mutex
+func (s *BanStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	data, err := utils.SafeMarshal(s.records)
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.MkdirAll(filepath.Dir(s.path), 0o755); err == nil {
+			if err = os.WriteFile(tmp, data, 0o600); err == nil {
+				err = os.Rename(tmp, s.path)
+			}
+		}
+	}
+	if err != nil {
+		logger.Warn("保存封禁状态失败", logger.String("path", s.path), logger.Err(err))
+	}
+}
+
+// Get 返回配置的封禁记录
+func (s *BanStore) Get(configID string) (BanRecord, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, exists := s.records[configID]
+	return record, exists
+}
+
+// Record 记录封禁，重新检查仍为封禁时更新检测时间
+func (s *BanStore) Record(configID, reason string, detectedAt time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records[configID] = BanRecord{Reason: reason, DetectedAt: detectedAt}
+	s.saveLocked()
+}
+
+// Clear 删除封禁记录（重新检查确认账号可用时）
+func (s *BanStore) Clear(configID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.records[configID]; !exists {
+		return
+	}
+	delete(s.records, configID)
+	s.saveLocked()
+}
+
+// observeUsageResult 按用量检查结果更新封禁状态：封禁时记录，上游确认可用（或额度耗尽）时清除
+// 网络错误等无法判断的结果不改变已有记录
+func (s *BanStore) observeUsageResult(token types.TokenInfo, result *UsageCheckResult) {
+	if token.RefreshToken == "" || result == nil {
+		return
+	}
+	configID := refreshTokenID(token.RefreshToken)
+	switch result.Status {
+	case types.AccountStatusBanned:
+		s.Record(configID, result.BanReason, time.Now())
+	case types.AccountStatusError:
+		// 无法判断，保留已有记录
+	default:
+		s.Clear(configID)
+	}
+}
+
+// banRecheckDue 封禁记录是否已超过重新检查间隔
+func banRecheckDue(record BanRecord, now time.Time, interval time.Duration) bool {
+	return now.Sub(record.DetectedAt) >= interval
+}
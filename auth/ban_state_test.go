@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withBanStore 替换全局封禁状态，测试结束后恢复
+func withBanStore(t *testing.T, store *BanStore) *BanStore {
+	t.Helper()
+	original := banStore
+	banStore = store
+	t.Cleanup(func() { banStore = original })
+	return store
+}
+
+// newBanTestUpstream 模拟刷新和用量接口，banned为true时用量接口返回封禁；返回上游调用次数
+func newBanTestUpstream(t *testing.T, banned *atomic.Bool) *atomic.Int64 {
+	t.Helper()
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch {
+		case r.URL.Path != "/getUsageLimits":
+			_, _ = w.Write([]byte(`{"accessToken":"access","expiresIn":3600}`))
+		case banned.Load():
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"reason":"TEMPORARILY_SUSPENDED"}`))
+		default:
+			_, _ = w.Write([]byte(`{"usageBreakdownList": [{"resourceType": "CREDIT", "usageLimitWithPrecision": 50, "currentUsageWithPrecision": 20}]}`))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("SOCIAL_REFRESH_URL", upstream.URL+"/refreshToken")
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	t.Setenv("USAGE_FALLBACK_REGIONS", "")
+	return &calls
+}
+
+func TestBanState_SurvivesRestartAndIsRecheckedAfterInterval(t *testing.T) {
+	withUsageCache(t, NewUsageCache(0))
+	path := filepath.Join(t.TempDir(), "ban_state.json")
+	t.Setenv("BAN_STATE_FILE", path)
+	var banned atomic.Bool
+	banned.Store(true)
+	calls := newBanTestUpstream(t, &banned)
+	configs := []AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "banned-refresh"}}
+
+	// 首次检查发现封禁并写入文件
+	withBanStore(t, NewBanStoreFromEnv())
+	tm := NewTokenManager(configs)
+	entries := tm.fetchTokens(configs)
+	require.Len(t, entries, 1)
+	assert.False(t, entries["token_0"].IsUsable())
+	assert.Equal(t, int64(2), calls.Load(), "刷新一次、查询用量一次")
+	record, exists := banStore.Get(ConfigID(configs[0]))
+	require.True(t, exists)
+	assert.Equal(t, "TEMPORARILY_SUSPENDED", record.Reason)
+	assert.FileExists(t, path)
+
+	// 模拟重启：从文件恢复封禁状态，重新检查间隔内不访问上游
+	withBanStore(t, NewBanStoreFromEnv())
+	restored, exists := banStore.Get(ConfigID(configs[0]))
+	require.True(t, exists)
+	assert.Equal(t, "TEMPORARILY_SUSPENDED", restored.Reason)
+	assert.True(t, record.DetectedAt.Equal(restored.DetectedAt))
+
+	tm = NewTokenManager(configs)
+	assert.Empty(t, tm.fetchTokens(configs))
+	assert.Equal(t, int64(2), calls.Load())
+
+	// 超过间隔后重新检查；账号已解封时清除记录并恢复选择
+	banned.Store(false)
+	tm.now = func() time.Time { return restored.DetectedAt.Add(tm.banRecheck) }
+	entries = tm.fetchTokens(configs)
+	require.Len(t, entries, 1)
+	assert.True(t, entries["token_0"].IsUsable())
+	assert.Equal(t, int64(4), calls.Load())
+	_, exists = banStore.Get(ConfigID(configs[0]))
+	assert.False(t, exists)
+
+	_, exists = NewBanStoreFromEnv().Get(ConfigID(configs[0]))
+	assert.False(t, exists, "清除的记录同样持久化")
+}
+
+func TestBanState_StillBannedUpdatesDetectionTime(t *testing.T) {
+	withUsageCache(t, NewUsageCache(0))
+	store := withBanStore(t, NewBanStore(""))
+	var banned atomic.Bool
+	banned.Store(true)
+	newBanTestUpstream(t, &banned)
+	configs := []AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "banned-refresh"}}
+	old := time.Now().Add(-7 * time.Hour)
+	store.Record(ConfigID(configs[0]), "OLD", old)
+
+	tm := NewTokenManager(configs)
+	tm.banRecheck = 6 * time.Hour
+	tm.fetchTokens(configs)
+
+	record, exists := store.Get(ConfigID(configs[0]))
+	require.True(t, exists)
+	assert.Equal(t, "TEMPORARILY_SUSPENDED", record.Reason)
+	assert.True(t, record.DetectedAt.After(old))
+}
+
+func TestBanState_ErrorsKeepExistingRecord(t *testing.T) {
+	store := NewBanStore("")
+	store.Record("id", "SUSPENDED", time.Now())
+
+	store.observeUsageResult(tokenWithRefresh("other"), &UsageCheckResult{Status: "active"})
+	_, exists := store.Get("id")
+	assert.True(t, exists)
+
+	store.observeUsageResult(tokenWithRefresh("banned"), &UsageCheckResult{Status: "error"})
+	store.observeUsageResult(tokenWithRefresh("banned"), &UsageCheckResult{Status: "banned", BanReason: "X"})
+	store.observeUsageResult(tokenWithRefresh("banned"), &UsageCheckResult{Status: "error"})
+	record, exists := store.Get(refreshTokenID("banned"))
+	require.True(t, exists)
+	assert.Equal(t, "X", record.Reason)
+}
+
+func TestBanRecheckInterval(t *testing.T) {
+	t.Setenv("BAN_RECHECK_INTERVAL", "")
+	assert.Equal(t, 6*time.Hour, BanRecheckInterval())
+
+	t.Setenv("BAN_RECHECK_INTERVAL", "30m")
+	assert.Equal(t, 30*time.Minute, BanRecheckInterval())
+
+	t.Setenv("BAN_RECHECK_INTERVAL", "-1h")
+	assert.Equal(t, 6*time.Hour, BanRecheckInterval())
+}
+
+func tokenWithRefresh(refreshToken string) types.TokenInfo {
+	return types.TokenInfo{AccessToken: "access", RefreshToken: refreshToken}
+}
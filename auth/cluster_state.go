@@ -0,0 +1,316 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ClusterState 多副本共享的token池热状态，保存在Redis中
+// 各副本独立统计用量时可能同时选中同一个接近耗尽的账号，共享以下状态后选择时能看到其他副本的情况：
+// 进行中的请求数、出错禁选、最近一次用量快照及快照之后各副本的已用次数。
+// 所有键都有较短的TTL并使用原子增减；Redis不可用时降级为本地状态，间隔ClusterRetryInterval后重试
+type ClusterState struct {
+	client *redis.Client
+	prefix string
+	now    func() time.Time
+
+	degraded atomic.Bool
+	mutex    sync.Mutex
+	retryAt  time.Time // 降级期间的下次重试时间
+}
+
+// SharedTokenState 单个账号的共享状态快照
+type SharedTokenState struct {
+	InFlight     int64     // 各副本进行中的请求数
+	BenchedUntil time.Time // 任一副本记录的出错禁选截止时间
+	HasUsage     bool      // 是否有副本发布过用量快照
+	Available    float64   // 用量快照中的剩余次数
+	CheckedAt    time.Time // 用量快照的检查时间
+	Used         int64     // 快照之后各副本选中的次数
+}
+
+// EffectiveAvailable 扣除快照之后各副本已用次数的剩余次数
+func (s SharedTokenState) EffectiveAvailable() float64 {
+	return max(s.Available-float64(s.Used), 0)
+}
+
+// releaseScript 进行中计数减一，减到0及以下时删除，避免出现负数
+var releaseScript = redis.NewScript(`
+local value = redis.call('DECR', KEYS[1])
+if value <= 0 then
+	redis.call('DEL', KEYS[1])
+end
+return value`)
+
+// publishUsageScript 只接受比已有快照更新的用量数据，写入时清零已用次数
+var publishUsageScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'checked_at')
+if current and tonumber(current) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'available', ARGV[1], 'checked_at', ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('DEL', KEYS[2])
+return 1`)
+
+// NewClusterStateFromEnv 根据环境变量创建共享状态，未配置时返回nil（只使用本地状态）
+// CLUSTER_REDIS_URL: Redis地址（redis://[:password@]host:port/db）
+// CLUSTER_REDIS_PREFIX: 键前缀（默认 kiro2api:pool:），同一Redis上的不同集群需使用不同前缀
+func NewClusterStateFromEnv() *ClusterState {
+	url := strings.TrimSpace(os.Getenv("CLUSTER_REDIS_URL"))
+	if url == "" {
+		return nil
+	}
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		logger.Warn("CLUSTER_REDIS_URL无效，只使用本地token池状态", logger.Err(err))
+		return nil
+	}
+	prefix := strings.TrimSpace(os.Getenv("CLUSTER_REDIS_PREFIX"))
+	if prefix == "" {
+		prefix = "kiro2api:pool:"
+	}
+	logger.Info("已启用多副本共享token池状态",
+		logger.String("redis_addr", options.Addr),
+		logger.String("prefix", prefix))
+	return NewClusterState(options, prefix)
+}
+
+// NewClusterState 创建共享状态；连接失败不影响创建，操作时按降级处理
+func NewClusterState(options *redis.Options, prefix string) *ClusterState {
+	// 快速失败：Redis卡顿时宁可降级也不拖慢请求
+	options.DialTimeout = config.ClusterRedisTimeout
+	options.ReadTimeout = config.ClusterRedisTimeout
+	options.WriteTimeout = config.ClusterRedisTimeout
+	options.MaxRetries = -1
+	return &ClusterState{
+		client: redis.NewClient(options),
+		prefix: prefix,
+		now:    time.Now,
+	}
+}
+
+func (s *ClusterState) key(kind, id string) string {
+	return s.prefix + kind + ":" + id
+}
+
+// Snapshot 读取各账号的共享状态；未启用或Redis不可用时返回nil
+func (s *ClusterState) Snapshot(ids []string) map[string]SharedTokenState {
+	if s == nil || len(ids) == 0 || !s.ready() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.ClusterRedisTimeout)
+	defer cancel()
+
+	type pending struct {
+		inflight, benched, used *redis.StringCmd
+		usage                   *redis.MapStringStringCmd
+	}
+	cmds := make(map[string]pending, len(ids))
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			cmds[id] = pending{
+				inflight: pipe.Get(ctx, s.key("inflight", id)),
+				benched:  pipe.Get(ctx, s.key("benched", id)),
+				used:     pipe.Get(ctx, s.key("used", id)),
+				usage:    pipe.HGetAll(ctx, s.key("usage", id)),
+			}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		s.fail("读取共享token池状态失败", err)
+		return nil
+	}
+	s.succeed()
+
+	snapshot := make(map[string]SharedTokenState, len(ids))
+	for id, cmd := range cmds {
+		var state SharedTokenState
+		state.InFlight, _ = cmd.inflight.Int64()
+		state.Used, _ = cmd.used.Int64()
+		if until, err := cmd.benched.Int64(); err == nil {
+			state.BenchedUntil = time.UnixMilli(until)
+		}
+		if usage := cmd.usage.Val(); len(usage) > 0 {
+			available, availableErr := strconv.ParseFloat(usage["available"], 64)
+			checkedAt, checkedErr := strconv.ParseInt(usage["checked_at"], 10, 64)
+			if availableErr == nil && checkedErr == nil {
+				state.HasUsage = true
+				state.Available = available
+				state.CheckedAt = time.UnixMilli(checkedAt)
+			}
+		}
+		snapshot[id] = state
+	}
+	return snapshot
+}
+
+// Acquire 记录一次选中：进行中请求数和快照之后的已用次数各加一
+func (s *ClusterState) Acquire(id string) {
+	if s == nil || id == "" || !s.ready() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.ClusterRedisTimeout)
+	defer cancel()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, s.key("inflight", id))
+		pipe.PExpire(ctx, s.key("inflight", id), config.ClusterInFlightTTL)
+		pipe.Incr(ctx, s.key("used", id))
+		pipe.PExpire(ctx, s.key("used", id), config.ClusterUsageTTL)
+		return nil
+	})
+	s.record("记录共享token选择失败", err)
+}
+
+// Release 请求结束，进行中请求数减一
+func (s *ClusterState) Release(id string) {
+	if s == nil || id == "" || !s.ready() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.ClusterRedisTimeout)
+	defer cancel()
+	err := releaseScript.Run(ctx, s.client, []string{s.key("inflight", id)}).Err()
+	s.record("释放共享token计数失败", err)
+}
+
+// Bench 记录出错禁选，其他副本在截止时间前同样不优先选择该账号
+func (s *ClusterState) Bench(id string, penalty time.Duration) {
+	if s == nil || id == "" || penalty <= 0 || !s.ready() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.ClusterRedisTimeout)
+	defer cancel()
+	until := s.now().Add(penalty).UnixMilli()
+	err := s.client.Set(ctx, s.key("benched", id), until, penalty).Err()
+	s.record("记录共享出错禁选失败", err)
+}
+
+// PublishUsage 发布用量检查结果；比已有快照旧的结果会被忽略
+func (s *ClusterState) PublishUsage(id string, available float64, checkedAt time.Time) {
+	if s == nil || id == "" || !s.ready() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.ClusterRedisTimeout)
+	defer cancel()
+	err := publishUsageScript.Run(ctx, s.client,
+		[]string{s.key("usage", id), s.key("used", id)},
+		strconv.FormatFloat(available, 'f', -1, 64),
+		checkedAt.UnixMilli(),
+		config.ClusterUsageTTL.Milliseconds()).Err()
+	s.record("发布共享用量快照失败", err)
+}
+
+// Close 关闭Redis连接
+func (s *ClusterState) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.client.Close()
+}
+
+// ready 降级期间未到重试时间时跳过Redis，避免每个请求都等待超时
+func (s *ClusterState) ready() bool {
+	if !s.degraded.Load() {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.now().Before(s.retryAt)
+}
+
+func (s *ClusterState) record(message string, err error) {
+	if err != nil && err != redis.Nil {
+		s.fail(message, err)
+		return
+	}
+	s.succeed()
+}
+
+func (s *ClusterState) fail(message string, err error) {
+	s.mutex.Lock()
+	s.retryAt = s.now().Add(config.ClusterRetryInterval)
+	s.mutex.Unlock()
+	if s.degraded.CompareAndSwap(false, true) {
+		logger.Warn(message+"，降级为本地token池状态",
+			logger.Err(err),
+			logger.Duration("retry_interval", config.ClusterRetryInterval))
+	}
+}
+
+func (s *ClusterState) succeed() {
+	if s.degraded.CompareAndSwap(true, false) {
+		logger.Info("共享token池状态已恢复")
+	}
+}
+
+// configIDsByKey 各配置的ConfigID（共享状态与对账统计使用），key与generateConfigOrder一致
+func configIDsByKey(configs []AuthConfig) map[string]string {
+	ids := make(map[string]string, len(configs))
+	for i, cfg := range configs {
+		ids[fmt.Sprintf(config.TokenCacheKeyFormat, i)] = ConfigID(cfg)
+	}
+	return ids
+}
+
+// clusterIDList 需要读取共享状态的配置ID，未启用共享状态时为空
+func (tm *TokenManager) clusterIDList() []string {
+	if tm.cluster == nil {
+		return nil
+	}
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	ids := make([]string, 0, len(tm.configIDs))
+	for _, id := range tm.configIDs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// availableUnlocked 选择时使用的剩余次数
+// 共享用量快照不比本地数据旧时，使用快照扣除各副本已用次数后的值；否则使用本地值
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) availableUnlocked(key string, cached *CachedToken) float64 {
+	shared, exists := tm.shared[tm.configIDs[key]]
+	if !exists || !shared.HasUsage || shared.CheckedAt.Before(cached.CachedAt.Truncate(time.Millisecond)) {
+		return cached.Available
+	}
+	return shared.EffectiveAvailable()
+}
+
+// sharedInFlightUnlocked 各副本上进行中的请求数
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) sharedInFlightUnlocked(key string) int64 {
+	return max(tm.shared[tm.configIDs[key]].InFlight, 0)
+}
+
+// sharedSaturatedUnlocked 按共享状态剩余次数已被各副本用完
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) sharedSaturatedUnlocked(key string, cached *CachedToken) bool {
+	shared, exists := tm.shared[tm.configIDs[key]]
+	return exists && shared.HasUsage && tm.availableUnlocked(key, cached) < 1
+}
+
+// ReleaseToken 请求结束时释放选择token时记录的共享进行中计数，每次选择调用一次
+func (tm *TokenManager) ReleaseToken(accessToken string) {
+	if tm.cluster == nil {
+		return
+	}
+	tm.mutex.RLock()
+	id := tm.configIDs[tm.cacheKeyByAccessTokenUnlocked(accessToken)]
+	tm.mutex.RUnlock()
+	if id != "" {
+		tm.cluster.Release(id)
+	}
+}
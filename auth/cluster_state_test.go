@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newClusterReplica 模拟一个副本：独立的TokenManager和Redis连接，共享同一个Redis
+// token_0 只剩1次可用，token_1 额度充足；random固定为0，只要token_0是候选就会被选中
+func newClusterReplica(t *testing.T, server *miniredis.Miniredis) *TokenManager {
+	t.Helper()
+	tm, _ := newHealthTestManager(2)
+	tm.random = func() float64 { return 0 }
+	tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 0)].Available = 1
+	tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 1)].Available = 1000
+
+	if server != nil {
+		tm.cluster = NewClusterState(&redis.Options{Addr: server.Addr()}, "test:")
+		t.Cleanup(func() { _ = tm.cluster.Close() })
+		// 各副本刷新时发布同一次用量检查的结果
+		for key, cached := range tm.cache.tokens {
+			tm.cluster.PublishUsage(tm.configIDs[key], cached.Available, cached.CachedAt)
+		}
+	}
+	return tm
+}
+
+func selectAccessToken(t *testing.T, tm *TokenManager) string {
+	t.Helper()
+	token, err := tm.GetBestTokenWithUsage()
+	require.NoError(t, err)
+	return token.AccessToken
+}
+
+func TestClusterState_ReplicasDoNotOvershootNearlyExhaustedToken(t *testing.T) {
+	// 只使用本地状态时，两个副本各自认为token_0还剩1次，都会选中它
+	local1, local2 := newClusterReplica(t, nil), newClusterReplica(t, nil)
+	assert.Equal(t, "access_0", selectAccessToken(t, local1))
+	assert.Equal(t, "access_0", selectAccessToken(t, local2))
+
+	server := miniredis.RunT(t)
+	replica1, replica2 := newClusterReplica(t, server), newClusterReplica(t, server)
+
+	selections := map[string]int{}
+	for range 10 {
+		selections[selectAccessToken(t, replica1)]++
+		selections[selectAccessToken(t, replica2)]++
+	}
+	assert.Equal(t, 1, selections["access_0"], "token_0只剩1次，两个副本合计只应选中一次")
+	assert.Equal(t, 19, selections["access_1"])
+
+	// 共享视图中token_0已用完，健康评分展示同样的剩余次数
+	assert.Zero(t, replica2.HealthScores()[fmt.Sprintf(config.TokenCacheKeyFormat, 0)].Available)
+}
+
+func TestClusterState_SaturatedTokenStillUsedWithoutAlternatives(t *testing.T) {
+	server := miniredis.RunT(t)
+	replica1, replica2 := newClusterReplica(t, server), newClusterReplica(t, server)
+	replica2.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 1)].Available = 0
+
+	assert.Equal(t, "access_0", selectAccessToken(t, replica1))
+	// 没有其他可选token时，共享视图的估算不应导致请求失败
+	assert.Equal(t, "access_0", selectAccessToken(t, replica2))
+}
+
+func TestClusterState_InFlightAndBenchShared(t *testing.T) {
+	server := miniredis.RunT(t)
+	replica1, replica2 := newClusterReplica(t, server), newClusterReplica(t, server)
+	replica1.errorPenalty = time.Minute
+	for _, cached := range replica1.cache.tokens {
+		cached.Available = 1000
+	}
+	id0 := replica1.configIDs[fmt.Sprintf(config.TokenCacheKeyFormat, 0)]
+	replica1.cluster.PublishUsage(id0, 1000, time.Now())
+
+	token := selectAccessToken(t, replica1)
+	require.Equal(t, "access_0", token)
+	assert.Equal(t, int64(1), replica2.cluster.Snapshot([]string{id0})[id0].InFlight)
+
+	// 失败结果把禁选同步给其他副本，进行中计数保留到请求结束
+	replica1.RecordResult(token, time.Second, true)
+	shared := replica2.cluster.Snapshot([]string{id0})[id0]
+	assert.Equal(t, int64(1), shared.InFlight)
+	assert.True(t, shared.BenchedUntil.After(time.Now()))
+	assert.Equal(t, "access_1", selectAccessToken(t, replica2), "其他副本也不优先选择禁选中的token")
+
+	replica1.ReleaseToken(token)
+	assert.Zero(t, replica2.cluster.Snapshot([]string{id0})[id0].InFlight)
+
+	// 释放不会使计数变为负数
+	replica1.ReleaseToken(token)
+	assert.Zero(t, replica2.cluster.Snapshot([]string{id0})[id0].InFlight)
+}
+
+func TestClusterState_ReloadDuringSelectionReleasesCapturedAccount(t *testing.T) {
+	server := miniredis.RunT(t)
+	tm := newClusterReplica(t, server)
+	for _, cached := range tm.cache.tokens {
+		cached.Available = 1000
+	}
+	configs := slices.Clone(tm.configs)
+	reversed := slices.Clone(configs)
+	slices.Reverse(reversed)
+	ids := tm.clusterIDList()
+
+	// 选择和释放的同时反复调换配置顺序：cache key对应的账号随之变化，进行中计数必须按选择时的账号释放
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 200 {
+			if i%2 == 0 {
+				tm.ReplaceConfigs(reversed)
+			} else {
+				tm.ReplaceConfigs(configs)
+			}
+		}
+	}()
+	for worker := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				token, err := tm.GetBestTokenWithUsage()
+				if !assert.NoError(t, err) {
+					return
+				}
+				if worker%2 == 0 {
+					tm.RecordResult(token.AccessToken, time.Millisecond, false)
+				}
+				tm.ReleaseToken(token.AccessToken)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for id, state := range tm.cluster.Snapshot(ids) {
+		assert.Zero(t, state.InFlight, "账号%s的进行中计数应全部释放", id)
+	}
+}
+
+func TestClusterState_PublishUsageKeepsNewestSnapshot(t *testing.T) {
+	server := miniredis.RunT(t)
+	state := NewClusterState(&redis.Options{Addr: server.Addr()}, "test:")
+	defer state.Close()
+
+	checkedAt := time.Now().Truncate(time.Millisecond)
+	state.PublishUsage("a", 50, checkedAt)
+	state.Acquire("a")
+	state.Acquire("a")
+	assert.Equal(t, 48.0, state.Snapshot([]string{"a"})["a"].EffectiveAvailable())
+
+	// 更旧的快照被忽略
+	state.PublishUsage("a", 10, checkedAt.Add(-time.Minute))
+	snapshot := state.Snapshot([]string{"a"})["a"]
+	assert.Equal(t, 50.0, snapshot.Available)
+	assert.Equal(t, int64(2), snapshot.Used)
+
+	// 更新的快照替换旧值并清零已用次数
+	state.PublishUsage("a", 30, checkedAt.Add(time.Minute))
+	snapshot = state.Snapshot([]string{"a"})["a"]
+	assert.Equal(t, 30.0, snapshot.Available)
+	assert.Zero(t, snapshot.Used)
+	assert.True(t, checkedAt.Add(time.Minute).Equal(snapshot.CheckedAt))
+}
+
+func TestClusterState_DegradesToLocalWhenRedisUnavailable(t *testing.T) {
+	server := miniredis.RunT(t)
+	replica := newClusterReplica(t, server)
+	clock := time.Now()
+	replica.cluster.now = func() time.Time { return clock }
+
+	server.Close()
+	assert.Equal(t, "access_0", selectAccessToken(t, replica), "Redis不可用时按本地状态选择")
+	assert.True(t, replica.cluster.degraded.Load())
+	assert.False(t, replica.cluster.ready(), "重试间隔内不再访问Redis")
+
+	require.NoError(t, server.Restart())
+	clock = clock.Add(config.ClusterRetryInterval)
+	assert.Equal(t, "access_1", selectAccessToken(t, replica))
+	assert.False(t, replica.cluster.degraded.Load(), "Redis恢复后重新使用共享状态")
+}
+
+func TestNewClusterStateFromEnv(t *testing.T) {
+	t.Setenv("CLUSTER_REDIS_URL", "")
+	assert.Nil(t, NewClusterStateFromEnv())
+
+	t.Setenv("CLUSTER_REDIS_URL", "not a url")
+	assert.Nil(t, NewClusterStateFromEnv())
+
+	t.Setenv("CLUSTER_REDIS_URL", "redis://localhost:6379/2")
+	t.Setenv("CLUSTER_REDIS_PREFIX", "")
+	state := NewClusterStateFromEnv()
+	require.NotNil(t, state)
+	defer state.Close()
+	assert.Equal(t, "kiro2api:pool:", state.prefix)
+}
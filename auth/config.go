@@ -4,17 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"kiro2api/logger"
 )
 
 // AuthConfig 简化的认证配置
 type AuthConfig struct {
-	AuthType     string `json:"auth"`
-	RefreshToken string `json:"refreshToken"`
-	ClientID     string `json:"clientId,omitempty"`
-	ClientSecret string `json:"clientSecret,omitempty"`
-	Disabled     bool   `json:"disabled,omitempty"`
+	AuthType     string   `json:"auth"`
+	RefreshToken string   `json:"refreshToken"`
+	ClientID     string   `json:"clientId,omitempty"`
+	ClientSecret string   `json:"clientSecret,omitempty"`
+	Disabled     bool     `json:"disabled,omitempty"`
+	DisplayName  string   `json:"displayName,omitempty"` // 账号别名，Dashboard中优先于邮箱显示
+	ProfileArn   string   `json:"profileArn,omitempty"`  // CodeWhisperer profile ARN，不同AWS组织的IdC账号需分别指定
+	Schedule     Schedule `json:"schedule,omitempty"`    // 计划停用时段（如与人共用的账号避开工作时间），期间不参与选择
 }
 
 // 认证方法常量
@@ -23,7 +27,43 @@ const (
 	AuthMethodIdC    = "IdC"
 )
 
-// loadConfigs 从环境变量加载配置
+// 配置来源
+const (
+	ConfigSourceFile = "file" // AUTH_CONFIG_FILE（默认 ./auth_config.json）
+	ConfigSourceEnv  = "env"  // KIRO_AUTH_TOKEN
+	ConfigSourceNone = "none" // 两者都不存在
+)
+
+// defaultConfigFilePath 未设置AUTH_CONFIG_FILE时使用的配置文件路径
+const defaultConfigFilePath = "./auth_config.json"
+
+// ConfigSourceReport 认证配置来源的诊断信息
+// 优先级：配置文件存在时为唯一来源（即使没有可用配置也不回退），仅在文件不存在时使用KIRO_AUTH_TOKEN
+type ConfigSourceReport struct {
+	ActiveSource   string `json:"active_source"`
+	FilePath       string `json:"file_path"`
+	FileExists     bool   `json:"file_exists"`
+	FileEntries    int    `json:"file_entries"`
+	FileUsable     int    `json:"file_usable"`
+	FileError      string `json:"file_error,omitempty"`
+	EnvSet         bool   `json:"env_set"`
+	EnvEntries     int    `json:"env_entries"`
+	EnvUsable      int    `json:"env_usable"`
+	EnvError       string `json:"env_error,omitempty"`
+	PoolEmpty      bool   `json:"pool_empty"`
+	FallbackReason string `json:"fallback_reason"`
+}
+
+// ConfigFilePath 返回认证配置文件路径
+func ConfigFilePath() string {
+	if path := os.Getenv("AUTH_CONFIG_FILE"); path != "" {
+		return path
+	}
+	return defaultConfigFilePath
+}
+
+// loadConfigs 按来源优先级加载配置
+// 配置文件存在但没有可用配置时返回空列表（token池为空），而不是回退到环境变量
 func loadConfigs() ([]AuthConfig, error) {
 	// 检测并警告弃用的环境变量
 	deprecatedVars := []string{
@@ -43,78 +83,179 @@ func loadConfigs() ([]AuthConfig, error) {
 		}
 	}
 
-	// 优先从配置文件加载（支持Web管理界面）
-	configFilePath := os.Getenv("AUTH_CONFIG_FILE")
-	if configFilePath == "" {
-		configFilePath = "./auth_config.json"
-	}
-
-	if fileInfo, err := os.Stat(configFilePath); err == nil && !fileInfo.IsDir() {
-		content, err := os.ReadFile(configFilePath)
-		if err == nil && len(content) > 2 { // 至少包含 "[]"
-			configs, err := parseJSONConfig(string(content))
-			if err == nil && len(configs) > 0 {
-				validConfigs := processConfigs(configs)
-				if len(validConfigs) > 0 {
-					logger.Info("从配置文件加载认证配置",
-						logger.String("文件路径", configFilePath),
-						logger.Int("有效配置数", len(validConfigs)))
-					return validConfigs, nil
-				}
-			}
+	configs, report, err := resolveConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case report.PoolEmpty:
+		logger.Warn("配置文件中没有可用的认证配置，token池为空",
+			logger.String("文件路径", report.FilePath),
+			logger.Int("总配置数", report.FileEntries),
+			logger.Bool("忽略KIRO_AUTH_TOKEN", report.EnvSet))
+	case report.ActiveSource == ConfigSourceFile:
+		logger.Info("从配置文件加载认证配置",
+			logger.String("文件路径", report.FilePath),
+			logger.Int("有效配置数", len(configs)))
+	default:
+		logger.Info("成功加载认证配置",
+			logger.Int("总配置数", report.EnvEntries),
+			logger.Int("有效配置数", len(configs)))
+	}
+
+	return configs, nil
+}
+
+// GetConfigSource 返回当前生效的配置来源及各来源的统计信息
+func GetConfigSource() ConfigSourceReport {
+	_, report, _ := resolveConfigs()
+	return report
+}
+
+// configFileProvider 提供配置文件内容的配置存储（Web管理界面的ConfigStore），由server在初始化存储时注入
+// ok为false表示存储未初始化或管理的不是path（读取文件）；exists为false表示配置文件不存在（按原有规则回退到KIRO_AUTH_TOKEN）
+var configFileProvider func(path string) (configs []AuthConfig, exists, ok bool)
+
+// SetConfigFileProvider 让配置读取以配置存储为唯一来源，而不是每次重新读取文件，避免两份配置不一致
+func SetConfigFileProvider(provider func(path string) (configs []AuthConfig, exists, ok bool)) {
+	configFileProvider = provider
+}
+
+// readConfigSource 读取配置文件来源：配置存储已初始化时使用存储中的配置，否则读取文件
+func readConfigSource(path string) (bool, []AuthConfig, error) {
+	if configFileProvider != nil {
+		if configs, exists, ok := configFileProvider(path); ok {
+			return exists, configs, nil
 		}
 	}
+	return readConfigFile(path)
+}
 
-	// 回退到KIRO_AUTH_TOKEN环境变量
-	jsonData := os.Getenv("KIRO_AUTH_TOKEN")
-	if jsonData == "" {
-		return nil, fmt.Errorf("未找到有效的认证配置\n" +
+// resolveConfigs 读取两个配置来源并按优先级决定使用哪一个
+// 两个来源都会被读取，以便诊断信息能反映被忽略一方的情况
+func resolveConfigs() ([]AuthConfig, ConfigSourceReport, error) {
+	report := ConfigSourceReport{FilePath: ConfigFilePath()}
+
+	fileExists, fileConfigs, fileErr := readConfigSource(report.FilePath)
+	report.FileExists = fileExists
+	report.FileEntries = len(fileConfigs)
+	fileValid := processConfigs(fileConfigs)
+	report.FileUsable = len(fileValid)
+	if fileErr != nil {
+		report.FileError = fileErr.Error()
+	}
+
+	envSet, envConfigs, envErr := readEnvConfig()
+	report.EnvSet = envSet
+	report.EnvEntries = len(envConfigs)
+	envValid := processConfigs(envConfigs)
+	report.EnvUsable = len(envValid)
+	if envErr != nil {
+		report.EnvError = envErr.Error()
+	}
+
+	// 配置文件存在：作为唯一来源
+	if fileExists {
+		report.ActiveSource = ConfigSourceFile
+		report.FallbackReason = "配置文件存在，作为唯一配置来源"
+		if envSet {
+			report.FallbackReason += "，已忽略KIRO_AUTH_TOKEN"
+		}
+		if fileErr != nil {
+			return nil, report, fmt.Errorf("解析配置文件失败: %w\n配置文件路径: %s", fileErr, report.FilePath)
+		}
+		if len(fileValid) == 0 {
+			report.PoolEmpty = true
+			report.FallbackReason += "；文件中没有可用配置，token池为空"
+			return []AuthConfig{}, report, nil
+		}
+		return fileValid, report, nil
+	}
+
+	// 配置文件不存在：回退到KIRO_AUTH_TOKEN
+	if !envSet {
+		report.ActiveSource = ConfigSourceNone
+		report.FallbackReason = "配置文件不存在且未设置KIRO_AUTH_TOKEN"
+		return nil, report, fmt.Errorf("未找到有效的认证配置\n" +
 			"请通过Web界面添加配置: http://localhost:8080/config\n" +
 			"或设置环境变量: KIRO_AUTH_TOKEN='[{\"auth\":\"Social\",\"refreshToken\":\"your_token\"}]'\n" +
 			"支持的认证方式: Social, IdC")
 	}
 
-	// 优先尝试从文件加载，失败后再作为JSON字符串处理
+	report.ActiveSource = ConfigSourceEnv
+	report.FallbackReason = "配置文件不存在，使用KIRO_AUTH_TOKEN"
+
+	if envErr != nil {
+		return nil, report, envErr
+	}
+
+	if len(envConfigs) == 0 {
+		return nil, report, fmt.Errorf("KIRO_AUTH_TOKEN配置为空，请至少提供一个有效的认证配置")
+	}
+
+	if len(envValid) == 0 {
+		return nil, report, fmt.Errorf("没有有效的认证配置\n" +
+			"请检查: \n" +
+			"1. Social认证需要refreshToken字段\n" +
+			"2. IdC认证需要refreshToken、clientId、clientSecret字段")
+	}
+
+	return envValid, report, nil
+}
+
+// readConfigFile 读取配置文件，文件不存在（或是目录）时exists为false
+// 空文件视为没有配置项
+func readConfigFile(path string) (bool, []AuthConfig, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil || fileInfo.IsDir() {
+		return false, nil, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return true, nil, fmt.Errorf("读取配置文件失败: %w", err)
+	}
+	if strings.TrimSpace(string(content)) == "" {
+		return true, nil, nil
+	}
+
+	configs, err := parseJSONConfig(string(content))
+	if err != nil {
+		return true, nil, err
+	}
+	return true, configs, nil
+}
+
+// readEnvConfig 读取KIRO_AUTH_TOKEN，优先视为文件路径，否则作为JSON字符串处理
+func readEnvConfig() (bool, []AuthConfig, error) {
+	jsonData := os.Getenv("KIRO_AUTH_TOKEN")
+	if jsonData == "" {
+		return false, nil, nil
+	}
+
 	var configData string
 	if fileInfo, err := os.Stat(jsonData); err == nil && !fileInfo.IsDir() {
 		// 是文件，读取文件内容
 		content, err := os.ReadFile(jsonData)
 		if err != nil {
-			return nil, fmt.Errorf("读取配置文件失败: %w\n配置文件路径: %s", err, jsonData)
+			return true, nil, fmt.Errorf("读取配置文件失败: %w\n配置文件路径: %s", err, jsonData)
 		}
 		configData = string(content)
-		logger.Info("从文件加载认证配置", logger.String("文件路径", jsonData))
+		logger.Debug("从文件加载认证配置", logger.String("文件路径", jsonData))
 	} else {
 		// 不是文件或文件不存在，作为JSON字符串处理
 		configData = jsonData
 		logger.Debug("从环境变量加载JSON配置")
 	}
 
-	// 解析JSON配置
 	configs, err := parseJSONConfig(configData)
 	if err != nil {
-		return nil, fmt.Errorf("解析KIRO_AUTH_TOKEN失败: %w\n"+
+		return true, nil, fmt.Errorf("解析KIRO_AUTH_TOKEN失败: %w\n"+
 			"请检查JSON格式是否正确\n"+
 			"示例: KIRO_AUTH_TOKEN='[{\"auth\":\"Social\",\"refreshToken\":\"token1\"}]'", err)
 	}
-
-	if len(configs) == 0 {
-		return nil, fmt.Errorf("KIRO_AUTH_TOKEN配置为空，请至少提供一个有效的认证配置")
-	}
-
-	validConfigs := processConfigs(configs)
-	if len(validConfigs) == 0 {
-		return nil, fmt.Errorf("没有有效的认证配置\n" +
-			"请检查: \n" +
-			"1. Social认证需要refreshToken字段\n" +
-			"2. IdC认证需要refreshToken、clientId、clientSecret字段")
-	}
-
-	logger.Info("成功加载认证配置",
-		logger.Int("总配置数", len(configs)),
-		logger.Int("有效配置数", len(validConfigs)))
-
-	return validConfigs, nil
+	return true, configs, nil
 }
 
 // GetConfigs 公开的配置获取函数，供其他包调用
@@ -166,8 +307,15 @@ func processConfigs(configs []AuthConfig) []AuthConfig {
 			continue
 		}
 
+		// 停用时段无效时跳过该配置，避免在本应避开的时间使用账号
+		if err := config.Schedule.Validate(); err != nil {
+			logger.Warn("计划停用时段无效，跳过该配置",
+				logger.Int("config_index", i),
+				logger.Err(err))
+			continue
+		}
+
 		validConfigs = append(validConfigs, config)
-		_ = i // 避免未使用变量警告
 	}
 
 	return validConfigs
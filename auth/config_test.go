@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveConfigs_SourceMatrix(t *testing.T) {
+	const envValid = `[{"auth":"Social","refreshToken":"env_token_1"},{"auth":"Social","refreshToken":"env_token_2"}]`
+
+	tests := []struct {
+		name        string
+		file        *string // nil表示文件不存在
+		env         string
+		wantSource  string
+		wantTokens  []string
+		wantEmpty   bool
+		wantErr     bool
+		fileEntries int
+		envEntries  int
+	}{
+		{
+			name:       "文件和环境变量都不存在",
+			wantSource: ConfigSourceNone,
+			wantErr:    true,
+		},
+		{
+			name:       "仅环境变量",
+			env:        envValid,
+			wantSource: ConfigSourceEnv,
+			wantTokens: []string{"env_token_1", "env_token_2"},
+			envEntries: 2,
+		},
+		{
+			name:        "仅配置文件",
+			file:        ptr(`[{"auth":"Social","refreshToken":"file_token"}]`),
+			wantSource:  ConfigSourceFile,
+			wantTokens:  []string{"file_token"},
+			fileEntries: 1,
+		},
+		{
+			name:        "文件和环境变量都存在时使用文件",
+			file:        ptr(`[{"auth":"Social","refreshToken":"file_token"}]`),
+			env:         envValid,
+			wantSource:  ConfigSourceFile,
+			wantTokens:  []string{"file_token"},
+			fileEntries: 1,
+			envEntries:  2,
+		},
+		{
+			name:        "文件中配置全部禁用时不回退到环境变量",
+			file:        ptr(`[{"auth":"Social","refreshToken":"file_token","disabled":true}]`),
+			env:         envValid,
+			wantSource:  ConfigSourceFile,
+			wantEmpty:   true,
+			fileEntries: 1,
+			envEntries:  2,
+		},
+		{
+			name:        "文件中配置全部无效",
+			file:        ptr(`[{"auth":"IdC","refreshToken":"file_token"}]`),
+			wantSource:  ConfigSourceFile,
+			wantEmpty:   true,
+			fileEntries: 1,
+		},
+		{
+			name:       "空数组文件",
+			file:       ptr(`[]`),
+			env:        envValid,
+			wantSource: ConfigSourceFile,
+			wantEmpty:  true,
+			envEntries: 2,
+		},
+		{
+			name:       "空文件",
+			file:       ptr(""),
+			wantSource: ConfigSourceFile,
+			wantEmpty:  true,
+		},
+		{
+			name:       "文件JSON无效时报错而不回退",
+			file:       ptr(`{not json`),
+			env:        envValid,
+			wantSource: ConfigSourceFile,
+			wantErr:    true,
+			envEntries: 2,
+		},
+		{
+			name:       "环境变量中没有有效配置",
+			env:        `[{"auth":"Social"}]`,
+			wantSource: ConfigSourceEnv,
+			wantErr:    true,
+			envEntries: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "auth_config.json")
+			if tt.file != nil {
+				require.NoError(t, os.WriteFile(path, []byte(*tt.file), 0600))
+			}
+			t.Setenv("AUTH_CONFIG_FILE", path)
+			t.Setenv("KIRO_AUTH_TOKEN", tt.env)
+
+			configs, report, err := resolveConfigs()
+
+			assert.Equal(t, tt.wantSource, report.ActiveSource)
+			assert.Equal(t, tt.file != nil, report.FileExists)
+			assert.Equal(t, tt.env != "", report.EnvSet)
+			assert.Equal(t, tt.fileEntries, report.FileEntries)
+			assert.Equal(t, tt.envEntries, report.EnvEntries)
+			assert.Equal(t, tt.wantEmpty, report.PoolEmpty)
+			assert.NotEmpty(t, report.FallbackReason)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var tokens []string
+			for _, cfg := range configs {
+				tokens = append(tokens, cfg.RefreshToken)
+			}
+			assert.Equal(t, tt.wantTokens, tokens)
+		})
+	}
+}
+
+func TestNewAuthService_EmptyPoolFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth_config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"auth":"Social","refreshToken":"t","disabled":true}]`), 0600))
+	t.Setenv("AUTH_CONFIG_FILE", path)
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"env_token"}]`)
+
+	service, err := NewAuthService()
+	require.NoError(t, err)
+	assert.Empty(t, service.GetConfigs())
+
+	_, err = service.GetToken()
+	assert.Error(t, err)
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+// ErrRefreshThrottled 刷新被身份提供方限流，或所在ClientID组仍处于退避期
+var ErrRefreshThrottled = errors.New("refresh_throttled")
+
+// RefreshThrottledError 带退避截止时间的限流错误，errors.Is(err, ErrRefreshThrottled) 为true
+type RefreshThrottledError struct {
+	ClientID string
+	RetryAt  time.Time
+	Cause    error // 触发退避的上游响应；退避期内直接拒绝时为nil
+}
+
+func (e *RefreshThrottledError) Error() string {
+	msg := fmt.Sprintf("IdC刷新被限流，ClientID组退避至 %s", e.RetryAt.Format(time.RFC3339))
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+func (e *RefreshThrottledError) Is(target error) bool { return target == ErrRefreshThrottled }
+
+func (e *RefreshThrottledError) Unwrap() error { return e.Cause }
+
+// idcThrottleResponseError 身份提供方返回的限流响应
+type idcThrottleResponseError struct {
+	statusCode int
+	body       string
+}
+
+func (e *idcThrottleResponseError) Error() string {
+	return fmt.Sprintf("IdC刷新失败: 状态码 %d, 响应: %s", e.statusCode, e.body)
+}
+
+// isIdCThrottleResponse 判断刷新响应是否为限流：429，或错误码为SlowDown/Throttling类
+func isIdCThrottleResponse(statusCode int, body string) bool {
+	if statusCode == http.StatusTooManyRequests {
+		return true
+	}
+	for _, code := range []string{"SlowDown", "Throttling", "TooManyRequests"} {
+		if strings.Contains(body, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// idcRefreshGroup 共享同一ClientID的配置组
+type idcRefreshGroup struct {
+	inflight sync.Mutex // 同一时间只允许一个刷新请求
+
+	mutex         sync.Mutex // 保护以下状态
+	lastRefresh   time.Time
+	backoff       time.Duration
+	backoffUntil  time.Time
+	throttleCount int
+}
+
+// IdCRefreshGroupState ClientID组的退避状态快照（供tokens API展示）
+type IdCRefreshGroupState struct {
+	ClientID      string `json:"client_id"` // 已脱敏
+	BackingOff    bool   `json:"backing_off"`
+	BackoffUntil  string `json:"backoff_until,omitempty"` // RFC3339，仅退避中时有值
+	ThrottleCount int    `json:"throttle_count"`          // 连续限流次数，成功刷新后清零
+}
+
+// IdCRefreshLimiter 按ClientID串行化IdC刷新，保持最小间隔，并在限流时对整组退避
+// 多个配置共用同一组ClientID/ClientSecret时，避免同时刷新触发身份提供方限流
+type IdCRefreshLimiter struct {
+	MinInterval time.Duration
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+
+	mutex  sync.Mutex
+	groups map[string]*idcRefreshGroup
+}
+
+// NewIdCRefreshLimiter 创建IdC刷新限制器
+func NewIdCRefreshLimiter(minInterval, backoffBase, backoffMax time.Duration) *IdCRefreshLimiter {
+	return &IdCRefreshLimiter{
+		MinInterval: minInterval,
+		BackoffBase: backoffBase,
+		BackoffMax:  backoffMax,
+		groups:      make(map[string]*idcRefreshGroup),
+	}
+}
+
+// idcRefreshLimiter 全局IdC刷新限制器（测试中可替换）
+var idcRefreshLimiter = NewIdCRefreshLimiter(config.IdCRefreshMinInterval, config.IdCRefreshBackoffBase, config.IdCRefreshBackoffMax)
+
+func (l *IdCRefreshLimiter) group(clientID string) *idcRefreshGroup {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	g, exists := l.groups[clientID]
+	if !exists {
+		g = &idcRefreshGroup{}
+		l.groups[clientID] = g
+	}
+	return g
+}
+
+// Do 在ClientID组内串行执行刷新
+// 组处于退避期时不发起请求，直接返回RefreshThrottledError
+func (l *IdCRefreshLimiter) Do(clientID string, refresh func() (types.TokenInfo, error)) (types.TokenInfo, error) {
+	g := l.group(clientID)
+	g.inflight.Lock()
+	defer g.inflight.Unlock()
+
+	g.mutex.Lock()
+	if retryAt := g.backoffUntil; time.Now().Before(retryAt) {
+		g.mutex.Unlock()
+		return types.TokenInfo{}, &RefreshThrottledError{ClientID: maskClientID(clientID), RetryAt: retryAt}
+	}
+	wait := time.Until(g.lastRefresh.Add(l.MinInterval))
+	g.mutex.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	token, err := refresh()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.lastRefresh = time.Now()
+
+	var throttled *idcThrottleResponseError
+	if errors.As(err, &throttled) {
+		g.throttleCount++
+		g.backoff = min(max(g.backoff*2, l.BackoffBase), l.BackoffMax)
+		g.backoffUntil = g.lastRefresh.Add(g.backoff)
+		return token, &RefreshThrottledError{ClientID: maskClientID(clientID), RetryAt: g.backoffUntil, Cause: err}
+	}
+	if err == nil {
+		g.throttleCount = 0
+		g.backoff = 0
+	}
+	return token, err
+}
+
+// States 返回所有ClientID组的退避状态，按ClientID排序
+func (l *IdCRefreshLimiter) States() []IdCRefreshGroupState {
+	l.mutex.Lock()
+	clientIDs := make([]string, 0, len(l.groups))
+	for clientID := range l.groups {
+		clientIDs = append(clientIDs, clientID)
+	}
+	l.mutex.Unlock()
+	sort.Strings(clientIDs)
+
+	now := time.Now()
+	states := make([]IdCRefreshGroupState, 0, len(clientIDs))
+	for _, clientID := range clientIDs {
+		g := l.group(clientID)
+		g.mutex.Lock()
+		state := IdCRefreshGroupState{
+			ClientID:      maskClientID(clientID),
+			BackingOff:    now.Before(g.backoffUntil),
+			ThrottleCount: g.throttleCount,
+		}
+		if state.BackingOff {
+			state.BackoffUntil = g.backoffUntil.Format(time.RFC3339)
+		}
+		g.mutex.Unlock()
+		states = append(states, state)
+	}
+	return states
+}
+
+// IdCRefreshGroupStates 返回全局IdC刷新限制器中各ClientID组的退避状态
+func IdCRefreshGroupStates() []IdCRefreshGroupState {
+	return idcRefreshLimiter.States()
+}
+
+// maskClientID 脱敏ClientID，保留前5位和后3位
+func maskClientID(clientID string) string {
+	if len(clientID) > 10 {
+		return clientID[:5] + "***" + clientID[len(clientID)-3:]
+	}
+	return clientID
+}
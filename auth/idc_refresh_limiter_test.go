@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sharedClientID = "shared-client-id-123456"
+
+// withIdCRefreshLimiter 在测试期间替换全局IdC刷新限制器
+func withIdCRefreshLimiter(t *testing.T, limiter *IdCRefreshLimiter) {
+	original := idcRefreshLimiter
+	idcRefreshLimiter = limiter
+	t.Cleanup(func() { idcRefreshLimiter = original })
+}
+
+// newIdCRefreshServer 模拟IdC刷新端点：记录并发数和请求时间，throttle为true时返回限流响应
+func newIdCRefreshServer(t *testing.T, throttle bool) (maxInFlight *int32, requestTimes func() []time.Time) {
+	var inFlight, peak int32
+	var mu sync.Mutex
+	var times []time.Time
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			old := atomic.LoadInt32(&peak)
+			if current <= old || atomic.CompareAndSwapInt32(&peak, old, current) {
+				break
+			}
+		}
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond) // 放大并发窗口
+		w.Header().Set("Content-Type", "application/json")
+		if throttle {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"SlowDown","error_description":"Rate exceeded"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"accessToken":"access","expiresIn":3600}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("IDC_REFRESH_URL", upstream.URL)
+
+	return &peak, func() []time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]time.Time(nil), times...)
+	}
+}
+
+// refreshSharedClientConfigs 并发刷新五个共享同一ClientID的配置
+func refreshSharedClientConfigs() []error {
+	errs := make([]error, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = RefreshIdCToken(AuthConfig{
+				AuthType:     AuthMethodIdC,
+				RefreshToken: fmt.Sprintf("refresh-%d", i),
+				ClientID:     sharedClientID,
+				ClientSecret: "secret",
+			})
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestIdCRefreshLimiter_SerializesSharedClientID(t *testing.T) {
+	const spacing = 20 * time.Millisecond
+	withIdCRefreshLimiter(t, NewIdCRefreshLimiter(spacing, time.Minute, 5*time.Minute))
+	maxInFlight, requestTimes := newIdCRefreshServer(t, false)
+
+	for _, err := range refreshSharedClientConfigs() {
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(maxInFlight), "同一ClientID同时只能有一个刷新请求")
+	times := requestTimes()
+	require.Len(t, times, 5)
+	for i := 1; i < len(times); i++ {
+		assert.GreaterOrEqual(t, times[i].Sub(times[i-1]), spacing, "相邻刷新应保持最小间隔")
+	}
+}
+
+func TestIdCRefreshLimiter_GroupBackoffOnThrottle(t *testing.T) {
+	withIdCRefreshLimiter(t, NewIdCRefreshLimiter(time.Millisecond, time.Minute, 5*time.Minute))
+	_, requestTimes := newIdCRefreshServer(t, true)
+
+	for _, err := range refreshSharedClientConfigs() {
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrRefreshThrottled), "限流应标记为refresh_throttled而不是普通错误: %v", err)
+	}
+	assert.Len(t, requestTimes(), 1, "首次限流后整组退避，其余配置不再请求上游")
+
+	states := IdCRefreshGroupStates()
+	require.Len(t, states, 1)
+	assert.Equal(t, maskClientID(sharedClientID), states[0].ClientID)
+	assert.True(t, states[0].BackingOff)
+	assert.Equal(t, 1, states[0].ThrottleCount)
+	retryAt, err := time.Parse(time.RFC3339, states[0].BackoffUntil)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), retryAt, 5*time.Second)
+
+	// 其他ClientID不受该组退避影响，仍会请求上游
+	_, _ = RefreshIdCToken(AuthConfig{AuthType: AuthMethodIdC, RefreshToken: "other", ClientID: "other-client", ClientSecret: "secret"})
+	assert.Len(t, requestTimes(), 2)
+}
+
+func TestIdCRefreshLimiter_BackoffGrowsAndResets(t *testing.T) {
+	limiter := NewIdCRefreshLimiter(0, 10*time.Millisecond, 25*time.Millisecond)
+	throttled := &idcThrottleResponseError{statusCode: http.StatusTooManyRequests}
+	fail := func() error {
+		_, err := limiter.Do("client", func() (types.TokenInfo, error) { return types.TokenInfo{}, throttled })
+		return err
+	}
+
+	require.ErrorIs(t, fail(), ErrRefreshThrottled)
+	assert.Equal(t, 10*time.Millisecond, limiter.group("client").backoff)
+
+	time.Sleep(15 * time.Millisecond)
+	require.ErrorIs(t, fail(), ErrRefreshThrottled)
+	assert.Equal(t, 20*time.Millisecond, limiter.group("client").backoff)
+
+	time.Sleep(25 * time.Millisecond)
+	require.ErrorIs(t, fail(), ErrRefreshThrottled)
+	assert.Equal(t, 25*time.Millisecond, limiter.group("client").backoff, "退避时间不超过上限")
+
+	time.Sleep(30 * time.Millisecond)
+	_, err := limiter.Do("client", func() (types.TokenInfo, error) { return types.TokenInfo{AccessToken: "ok"}, nil })
+	require.NoError(t, err)
+	assert.Equal(t, 0, limiter.States()[0].ThrottleCount, "成功刷新后清零")
+}
+
+func TestIsIdCThrottleResponse(t *testing.T) {
+	assert.True(t, isIdCThrottleResponse(http.StatusTooManyRequests, ""))
+	assert.True(t, isIdCThrottleResponse(http.StatusBadRequest, `{"error":"SlowDown"}`))
+	assert.True(t, isIdCThrottleResponse(http.StatusBadRequest, `{"__type":"ThrottlingException"}`))
+	assert.False(t, isIdCThrottleResponse(http.StatusBadRequest, `{"error":"invalid_grant"}`))
+}
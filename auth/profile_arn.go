@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// profileArnPattern CodeWhisperer profile ARN格式：
+// arn:<partition>:codewhisperer:<region>:<12位账号ID>:profile/<profileId>
+var profileArnPattern = regexp.MustCompile(`^arn:aws[a-z-]*:codewhisperer:[a-z]{2}(-[a-z]+)+-\d+:\d{12}:profile/[A-Za-z0-9_-]+$`)
+
+// ValidateProfileArn 校验profile ARN格式，空字符串表示未配置（使用全局默认值）
+func ValidateProfileArn(arn string) error {
+	if arn == "" {
+		return nil
+	}
+	if !profileArnPattern.MatchString(arn) {
+		return fmt.Errorf("profileArn格式无效，应为 arn:aws:codewhisperer:<region>:<账号ID>:profile/<ID>")
+	}
+	return nil
+}
+
+// ShortenProfileArn 返回便于核对的ARN简写：<region>:<账号ID>:<profileId末8位>
+// 格式无法识别时原样返回
+func ShortenProfileArn(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) != 6 {
+		return arn
+	}
+	profileID := strings.TrimPrefix(parts[5], "profile/")
+	if len(profileID) > 8 {
+		profileID = "..." + profileID[len(profileID)-8:]
+	}
+	return parts[3] + ":" + parts[4] + ":" + profileID
+}
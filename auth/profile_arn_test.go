@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testProfileArnA = "arn:aws:codewhisperer:us-east-1:111111111111:profile/AAAAAAAAAAAA"
+	testProfileArnB = "arn:aws:codewhisperer:eu-central-1:222222222222:profile/BBBBBBBBBBBB"
+)
+
+func TestValidateProfileArn(t *testing.T) {
+	for _, valid := range []string{"", testProfileArnA, testProfileArnB,
+		"arn:aws-us-gov:codewhisperer:us-gov-west-1:123456789012:profile/abc_DEF-123"} {
+		assert.NoError(t, ValidateProfileArn(valid), valid)
+	}
+
+	for _, invalid := range []string{
+		"profile/AAAAAAAAAAAA",
+		"arn:aws:codewhisperer:us-east-1:1111:profile/AAAA",           // 账号ID不是12位
+		"arn:aws:s3:us-east-1:111111111111:profile/AAAA",              // 服务不对
+		"arn:aws:codewhisperer:useast1:111111111111:profile/AAAA",     // region格式错误
+		"arn:aws:codewhisperer:us-east-1:111111111111:profile/",       // 缺少profile ID
+		"arn:aws:codewhisperer:us-east-1:111111111111:workspace/AAAA", // 资源类型不对
+		" " + testProfileArnA,
+	} {
+		assert.Error(t, ValidateProfileArn(invalid), invalid)
+	}
+}
+
+func TestShortenProfileArn(t *testing.T) {
+	assert.Equal(t, "us-east-1:111111111111:...AAAAAAAA", ShortenProfileArn(testProfileArnA))
+	assert.Equal(t, "us-east-1:111111111111:SHORT",
+		ShortenProfileArn("arn:aws:codewhisperer:us-east-1:111111111111:profile/SHORT"))
+	assert.Equal(t, "not-an-arn", ShortenProfileArn("not-an-arn"))
+}
+
+func TestTokenManager_SelectsConfiguredProfileArn(t *testing.T) {
+	// 刷新响应按refreshToken返回对应的access token，并附带账号默认的profileArn
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/refreshToken", "/token":
+			var body map[string]any
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			_, _ = w.Write([]byte(`{"accessToken":"access_` + body["refreshToken"].(string) +
+				`","expiresIn":3600,"profileArn":"arn:aws:codewhisperer:us-east-1:999999999999:profile/FROMREFRESH"}`))
+		case "/getUsageLimits":
+			_, _ = w.Write([]byte(`{"usageBreakdownList": [{"resourceType": "CREDIT", "usageLimitWithPrecision": 1000, "currentUsageWithPrecision": 0}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+	t.Setenv("SOCIAL_REFRESH_URL", upstream.URL+"/refreshToken")
+	t.Setenv("IDC_REFRESH_URL", upstream.URL+"/token")
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+
+	tm := NewTokenManager([]AuthConfig{
+		{AuthType: AuthMethodIdC, RefreshToken: "org_a", ClientID: "id", ClientSecret: "secret", ProfileArn: testProfileArnA},
+		{AuthType: AuthMethodIdC, RefreshToken: "org_b", ClientID: "id", ClientSecret: "secret", ProfileArn: testProfileArnB},
+		{AuthType: AuthMethodSocial, RefreshToken: "social"},
+	})
+
+	expected := map[string]string{
+		"access_org_a":  testProfileArnA,
+		"access_org_b":  testProfileArnB,
+		"access_social": "arn:aws:codewhisperer:us-east-1:999999999999:profile/FROMREFRESH",
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		token, err := tm.GetBestTokenWithUsage()
+		require.NoError(t, err)
+		require.Contains(t, expected, token.TokenInfo.AccessToken)
+		assert.Equal(t, expected[token.TokenInfo.AccessToken], token.TokenInfo.ProfileArn)
+		seen[token.TokenInfo.AccessToken] = true
+	}
+	assert.Len(t, seen, 3, "所有配置都应被选中过")
+}
@@ -2,29 +2,65 @@ package auth
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"kiro2api/config"
+	"kiro2api/logger"
 	"kiro2api/types"
 	"kiro2api/utils"
 	"net/http"
+	"net/url"
 	"time"
 )
 
+// refreshRetrySleep 刷新重试前的等待（测试可替换）
+var refreshRetrySleep = time.Sleep
+
+// withRefreshRetry 执行一次刷新请求，遇到网络错误或5xx时按config.TokenRefreshRetries重试，等待时长从
+// config.TokenRefreshRetryDelay开始每次翻倍；4xx（如refresh token失效）和限流响应立即返回
+func withRefreshRetry(authType string, request func() (types.TokenInfo, error)) (types.TokenInfo, error) {
+	delay := config.TokenRefreshRetryDelay
+	for attempt := 0; ; attempt++ {
+		token, err := request()
+		if err == nil || attempt >= config.TokenRefreshRetries || !isRetryableRefreshError(err) {
+			return token, err
+		}
+		logger.Warn("token刷新遇到临时错误，稍后重试",
+			logger.String("auth_type", authType),
+			logger.Int("attempt", attempt+1),
+			logger.Int("max_retries", config.TokenRefreshRetries),
+			logger.Duration("delay", delay),
+			logger.Err(err))
+		refreshRetrySleep(delay)
+		delay = min(delay*2, config.MaxTokenRefreshRetryDelay)
+	}
+}
+
+// isRetryableRefreshError 网络错误和身份提供方的5xx可重试
+func isRetryableRefreshError(err error) bool {
+	var statusErr *refreshStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode >= http.StatusInternalServerError
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
 // refreshSingleToken 刷新单个token
 func (tm *TokenManager) refreshSingleToken(authConfig AuthConfig) (types.TokenInfo, error) {
-	switch authConfig.AuthType {
-	case AuthMethodSocial:
-		return refreshSocialToken(authConfig.RefreshToken)
-	case AuthMethodIdC:
-		return refreshIdCToken(authConfig)
-	default:
-		return types.TokenInfo{}, fmt.Errorf("不支持的认证类型: %s", authConfig.AuthType)
-	}
+	return RefreshToken(authConfig)
 }
 
 // refreshSocialToken 刷新Social认证token
 func refreshSocialToken(refreshToken string) (types.TokenInfo, error) {
+	return withRefreshRetry(AuthMethodSocial, func() (types.TokenInfo, error) {
+		return requestSocialToken(refreshToken)
+	})
+}
+
+// requestSocialToken 向身份提供方发起Social刷新请求
+func requestSocialToken(refreshToken string) (types.TokenInfo, error) {
 	refreshReq := types.RefreshRequest{
 		RefreshToken: refreshToken,
 	}
@@ -34,7 +70,7 @@ func refreshSocialToken(refreshToken string) (types.TokenInfo, error) {
 		return types.TokenInfo{}, fmt.Errorf("序列化请求失败: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", config.RefreshTokenURL, bytes.NewBuffer(reqBody))
+	req, err := http.NewRequest("POST", config.SocialRefreshURL(), bytes.NewBuffer(reqBody))
 	if err != nil {
 		return types.TokenInfo{}, fmt.Errorf("创建请求失败: %v", err)
 	}
@@ -44,13 +80,13 @@ func refreshSocialToken(refreshToken string) (types.TokenInfo, error) {
 	client := utils.SharedHTTPClient
 	resp, err := client.Do(req)
 	if err != nil {
-		return types.TokenInfo{}, fmt.Errorf("请求失败: %v", err)
+		return types.TokenInfo{}, fmt.Errorf("请求失败: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return types.TokenInfo{}, fmt.Errorf("刷新失败: 状态码 %d, 响应: %s", resp.StatusCode, string(body))
+		return types.TokenInfo{}, &refreshStatusError{prefix: "刷新失败", statusCode: resp.StatusCode, body: string(body)}
 	}
 
 	var refreshResp types.RefreshResponse
@@ -65,12 +101,23 @@ func refreshSocialToken(refreshToken string) (types.TokenInfo, error) {
 
 	var token types.Token
 	token.FromRefreshResponse(refreshResp, refreshToken)
+	warnIfRefreshedTokenExpired(AuthMethodSocial, token, time.Now())
 
 	return token, nil
 }
 
 // refreshIdCToken 刷新IdC认证token
+// 共享同一ClientID的配置经idcRefreshLimiter串行刷新，限流时整组退避；临时错误在占用组内名额期间重试
 func refreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
+	return idcRefreshLimiter.Do(authConfig.ClientID, func() (types.TokenInfo, error) {
+		return withRefreshRetry(AuthMethodIdC, func() (types.TokenInfo, error) {
+			return requestIdCToken(authConfig)
+		})
+	})
+}
+
+// requestIdCToken 向身份提供方发起IdC刷新请求
+func requestIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
 	refreshReq := types.IdcRefreshRequest{
 		ClientId:     authConfig.ClientID,
 		ClientSecret: authConfig.ClientSecret,
@@ -83,7 +130,7 @@ func refreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
 		return types.TokenInfo{}, fmt.Errorf("序列化IdC请求失败: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", config.IdcRefreshTokenURL, bytes.NewBuffer(reqBody))
+	req, err := http.NewRequest("POST", config.IdcRefreshURL(), bytes.NewBuffer(reqBody))
 	if err != nil {
 		return types.TokenInfo{}, fmt.Errorf("创建IdC请求失败: %v", err)
 	}
@@ -102,13 +149,16 @@ func refreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
 	client := utils.SharedHTTPClient
 	resp, err := client.Do(req)
 	if err != nil {
-		return types.TokenInfo{}, fmt.Errorf("IdC请求失败: %v", err)
+		return types.TokenInfo{}, fmt.Errorf("IdC请求失败: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return types.TokenInfo{}, fmt.Errorf("IdC刷新失败: 状态码 %d, 响应: %s", resp.StatusCode, string(body))
+		if isIdCThrottleResponse(resp.StatusCode, string(body)) {
+			return types.TokenInfo{}, &idcThrottleResponseError{statusCode: resp.StatusCode, body: string(body)}
+		}
+		return types.TokenInfo{}, &refreshStatusError{prefix: "IdC刷新失败", statusCode: resp.StatusCode, body: string(body)}
 	}
 
 	var refreshResp types.RefreshResponse
@@ -126,16 +176,33 @@ func refreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
 	token.RefreshToken = authConfig.RefreshToken
 	token.ExpiresIn = refreshResp.ExpiresIn
 	token.ExpiresAt = time.Now().Add(time.Duration(refreshResp.ExpiresIn) * time.Second)
+	warnIfRefreshedTokenExpired(AuthMethodIdC, token, time.Now())
 
 	return token, nil
 }
 
+// warnIfRefreshedTokenExpired 刚刷新的token已处于过期状态时记录警告并返回true
+// 这通常说明本机时钟与身份提供方存在明显偏差，或EXPIRY_SKEW大于token的有效期
+func warnIfRefreshedTokenExpired(authType string, token types.TokenInfo, now time.Time) bool {
+	if !token.IsExpiredAt(now) {
+		return false
+	}
+	logger.Warn("刷新得到的token已过期，可能存在时钟偏差或EXPIRY_SKEW过大",
+		logger.String("auth_type", authType),
+		logger.Int("expires_in", token.ExpiresIn),
+		logger.String("expires_at", token.ExpiresAt.Format(time.RFC3339)),
+		logger.String("now", now.Format(time.RFC3339)),
+		logger.Duration("expiry_skew", config.ClampExpirySkew(config.ExpirySkew)))
+	return true
+}
+
 // RefreshSocialToken 公开的Social token刷新函数
 func RefreshSocialToken(refreshToken string) (types.TokenInfo, error) {
-	return refreshSocialToken(refreshToken)
+	return RefreshToken(AuthConfig{AuthType: AuthMethodSocial, RefreshToken: refreshToken})
 }
 
 // RefreshIdCToken 公开的IdC token刷新函数
 func RefreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
-	return refreshIdCToken(authConfig)
+	authConfig.AuthType = AuthMethodIdC
+	return RefreshToken(authConfig)
 }
@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withExpirySkew 临时设置过期提前量，测试结束后恢复
+func withExpirySkew(t *testing.T, skew time.Duration) {
+	t.Helper()
+	original := config.ExpirySkew
+	config.ExpirySkew = skew
+	t.Cleanup(func() { config.ExpirySkew = original })
+}
+
+func TestTokenIsExpiredAt_SkewBuffer(t *testing.T) {
+	withExpirySkew(t, time.Minute)
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	token := types.Token{ExpiresAt: base.Add(time.Hour)}
+
+	// 本机时钟相对真实时间的偏移：正数表示本机偏快，负数表示偏慢
+	tests := []struct {
+		name    string
+		offset  time.Duration
+		expired bool
+	}{
+		{"时钟准确", 0, false},
+		{"本机偏快但仍在提前量之外", 58 * time.Minute, false},
+		{"进入提前量窗口", 59*time.Minute + time.Second, true},
+		{"本机偏快超过有效期", 2 * time.Hour, true},
+		{"本机偏慢", -10 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expired, token.IsExpiredAt(base.Add(tt.offset)))
+		})
+	}
+}
+
+func TestTokenIsExpiredAt_NoSkew(t *testing.T) {
+	withExpirySkew(t, 0)
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	token := types.Token{ExpiresAt: base}
+
+	assert.False(t, token.IsExpiredAt(base.Add(-time.Second)))
+	assert.False(t, token.IsExpiredAt(base))
+	assert.True(t, token.IsExpiredAt(base.Add(time.Second)))
+}
+
+func TestTokenIsExpiredAt_SkewIsClamped(t *testing.T) {
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	token := types.Token{ExpiresAt: base.Add(time.Hour)}
+
+	// 过大的提前量截断到MaxExpirySkew，一小时有效期的token不会立即过期
+	withExpirySkew(t, 24*time.Hour)
+	assert.False(t, token.IsExpiredAt(base))
+	assert.True(t, token.IsExpiredAt(base.Add(time.Hour-config.MaxExpirySkew+time.Second)))
+
+	// 负数按0处理
+	withExpirySkew(t, -time.Hour)
+	assert.False(t, token.IsExpiredAt(base.Add(time.Hour)))
+}
+
+func TestWarnIfRefreshedTokenExpired(t *testing.T) {
+	withExpirySkew(t, time.Minute)
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.False(t, warnIfRefreshedTokenExpired(AuthMethodSocial,
+		types.Token{ExpiresIn: 3600, ExpiresAt: now.Add(time.Hour)}, now))
+	assert.True(t, warnIfRefreshedTokenExpired(AuthMethodSocial,
+		types.Token{ExpiresIn: 30, ExpiresAt: now.Add(30 * time.Second)}, now), "有效期短于提前量")
+	assert.True(t, warnIfRefreshedTokenExpired(AuthMethodIdC,
+		types.Token{ExpiresAt: now.Add(-time.Minute)}, now), "刷新结果已过期")
+}
+
+func TestRefreshSocialToken_ShortLivedTokenTreatedAsExpired(t *testing.T) {
+	withExpirySkew(t, time.Minute)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"accessToken":"short-lived","expiresIn":30}`))
+	}))
+	defer upstream.Close()
+	t.Setenv("SOCIAL_REFRESH_URL", upstream.URL+"/refreshToken")
+
+	token, err := refreshSocialToken("refresh")
+	require.NoError(t, err)
+	assert.Equal(t, "short-lived", token.AccessToken)
+	assert.True(t, token.IsExpired(), "剩余有效期不足EXPIRY_SKEW时应视为过期")
+	assert.False(t, (&CachedToken{Token: token, Available: 10}).IsUsable())
+}
+
+// withRefreshRetryConfig 临时设置刷新重试次数并记录重试等待时长（不实际等待）
+func withRefreshRetryConfig(t *testing.T, retries int, delay time.Duration) *[]time.Duration {
+	t.Helper()
+	originalRetries, originalDelay, originalSleep := config.TokenRefreshRetries, config.TokenRefreshRetryDelay, refreshRetrySleep
+	var sleeps []time.Duration
+	config.TokenRefreshRetries = retries
+	config.TokenRefreshRetryDelay = delay
+	refreshRetrySleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	t.Cleanup(func() {
+		config.TokenRefreshRetries, config.TokenRefreshRetryDelay, refreshRetrySleep = originalRetries, originalDelay, originalSleep
+	})
+	return &sleeps
+}
+
+// newFlakyRefreshEndpoint 前failures次返回status，之后返回成功的刷新响应
+func newFlakyRefreshEndpoint(t *testing.T, failures int, status int) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(calls.Add(1)) <= failures {
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"error":"flaky"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"accessToken":"access","expiresIn":3600}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("SOCIAL_REFRESH_URL", upstream.URL+"/refreshToken")
+	t.Setenv("IDC_REFRESH_URL", upstream.URL+"/token")
+	return &calls
+}
+
+func TestRefreshToken_RetriesTransientErrors(t *testing.T) {
+	withIdCRefreshLimiter(t, NewIdCRefreshLimiter(0, time.Minute, 5*time.Minute))
+	configs := []AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "social-refresh"},
+		{AuthType: AuthMethodIdC, RefreshToken: "idc-refresh", ClientID: "client", ClientSecret: "secret"},
+	}
+	for _, cfg := range configs {
+		t.Run(cfg.AuthType, func(t *testing.T) {
+			sleeps := withRefreshRetryConfig(t, 2, 100*time.Millisecond)
+			calls := newFlakyRefreshEndpoint(t, 2, http.StatusBadGateway)
+
+			token, err := RefreshToken(cfg)
+			require.NoError(t, err)
+			assert.Equal(t, "access", token.AccessToken)
+			assert.Equal(t, int32(3), calls.Load())
+			assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}, *sleeps, "等待时长逐次翻倍")
+		})
+	}
+}
+
+func TestRefreshToken_GivesUpAfterMaxRetries(t *testing.T) {
+	sleeps := withRefreshRetryConfig(t, 1, 100*time.Millisecond)
+	calls := newFlakyRefreshEndpoint(t, 5, http.StatusServiceUnavailable)
+
+	_, err := RefreshToken(AuthConfig{AuthType: AuthMethodSocial, RefreshToken: "refresh"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "状态码 503")
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Len(t, *sleeps, 1)
+}
+
+func TestRefreshToken_DoesNotRetryClientErrors(t *testing.T) {
+	withIdCRefreshLimiter(t, NewIdCRefreshLimiter(0, time.Minute, 5*time.Minute))
+	tests := []struct {
+		name   string
+		cfg    AuthConfig
+		status int
+	}{
+		{"Social refresh token失效", AuthConfig{AuthType: AuthMethodSocial, RefreshToken: "revoked"}, http.StatusBadRequest},
+		{"IdC refresh token失效", AuthConfig{AuthType: AuthMethodIdC, RefreshToken: "revoked", ClientID: "client-400", ClientSecret: "secret"}, http.StatusBadRequest},
+		{"IdC限流", AuthConfig{AuthType: AuthMethodIdC, RefreshToken: "throttled", ClientID: "client-429", ClientSecret: "secret"}, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sleeps := withRefreshRetryConfig(t, 3, 100*time.Millisecond)
+			calls := newFlakyRefreshEndpoint(t, 5, tt.status)
+
+			_, err := RefreshToken(tt.cfg)
+			require.Error(t, err)
+			assert.Equal(t, int32(1), calls.Load(), "不应重试")
+			assert.Empty(t, *sleeps)
+		})
+	}
+}
+
+func TestRefreshToken_RetriesNetworkErrors(t *testing.T) {
+	sleeps := withRefreshRetryConfig(t, 2, 10*time.Millisecond)
+	t.Setenv("SOCIAL_REFRESH_URL", "http://127.0.0.1:1/refreshToken")
+
+	_, err := RefreshToken(AuthConfig{AuthType: AuthMethodSocial, RefreshToken: "refresh"})
+	require.Error(t, err)
+	assert.Len(t, *sleeps, 2)
+}
+
+func TestRefreshToken_RetryDisabled(t *testing.T) {
+	sleeps := withRefreshRetryConfig(t, 0, 100*time.Millisecond)
+	calls := newFlakyRefreshEndpoint(t, 1, http.StatusInternalServerError)
+
+	_, err := RefreshToken(AuthConfig{AuthType: AuthMethodSocial, RefreshToken: "refresh"})
+	require.Error(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Empty(t, *sleeps)
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"fmt"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+)
+
+// ReloadConfigs 重新加载认证配置并应用到token管理器，配置变更后无需重启服务
+func (as *AuthService) ReloadConfigs() error {
+	configs, err := loadConfigs()
+	if err != nil {
+		return fmt.Errorf("加载配置失败: %w", err)
+	}
+	if as.tokenManager != nil {
+		as.tokenManager.ReplaceConfigs(configs)
+	}
+
+	as.mutex.Lock()
+	as.configs = configs
+	as.mutex.Unlock()
+	logger.Info("认证配置已重新加载", logger.Int("config_count", len(configs)))
+	return nil
+}
+
+// ReplaceConfigs 替换token管理器的配置
+// cache key按配置索引生成，这里按ConfigID把仍存在账号的缓存token、健康统计迁移到新索引下；
+// 认证相关字段变化或新增的账号没有可用缓存，在后台刷新后参与选择
+func (tm *TokenManager) ReplaceConfigs(configs []AuthConfig) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	type previousEntry struct {
+		key string
+		cfg AuthConfig
+	}
+	previous := make(map[string]previousEntry, len(tm.configs))
+	for i, cfg := range tm.configs {
+		previous[ConfigID(cfg)] = previousEntry{key: fmt.Sprintf(config.TokenCacheKeyFormat, i), cfg: cfg}
+	}
+
+	tokens := make(map[string]*CachedToken, len(configs))
+	health := make(map[string]*tokenHealth, len(configs))
+	exhausted := make(map[string]bool)
+	needsRefresh := false
+	for i, cfg := range configs {
+		key := fmt.Sprintf(config.TokenCacheKeyFormat, i)
+		old, exists := previous[ConfigID(cfg)]
+		if exists {
+			if stats, ok := tm.health[old.key]; ok {
+				health[key] = stats
+			}
+		}
+		if cfg.Disabled {
+			continue
+		}
+		cached, ok := tm.cache.tokens[old.key]
+		if !exists || !ok || !sameCredentials(old.cfg, cfg) {
+			needsRefresh = true
+			continue
+		}
+		tokens[key] = cached
+		if tm.exhausted[old.key] {
+			exhausted[key] = true
+		}
+	}
+
+	tm.configs = configs
+	tm.configOrder = generateConfigOrder(configs)
+	tm.schedules = configSchedules(configs)
+	tm.configIDs = configIDsByKey(configs)
+	tm.cache.tokens = tokens
+	tm.health = health
+	tm.exhausted = exhausted
+	tm.generation++
+
+	if needsRefresh {
+		// 新账号不受最小刷新间隔限制
+		tm.startRefreshUnlocked()
+	}
+}
+
+// sameCredentials 两个配置刷新得到的token是否可以互相替代
+func sameCredentials(a, b AuthConfig) bool {
+	return a.AuthType == b.AuthType &&
+		a.RefreshToken == b.RefreshToken &&
+		a.ClientID == b.ClientID &&
+		a.ClientSecret == b.ClientSecret &&
+		a.ProfileArn == b.ProfileArn
+}
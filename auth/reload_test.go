@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// configLoader 替换token加载函数：按传入配置生成 loaded_<refreshToken> 的token，release关闭前阻塞
+func configLoader(tm *TokenManager, release <-chan struct{}) *atomic.Int32 {
+	calls := &atomic.Int32{}
+	tm.loadTokens = func(configs []AuthConfig) map[string]*CachedToken {
+		calls.Add(1)
+		if release != nil {
+			<-release
+		}
+		entries := make(map[string]*CachedToken, len(configs))
+		for i, cfg := range configs {
+			entries[fmt.Sprintf(config.TokenCacheKeyFormat, i)] = &CachedToken{
+				Token:     types.TokenInfo{AccessToken: "loaded_" + cfg.RefreshToken, ExpiresAt: time.Now().Add(time.Hour)},
+				CachedAt:  time.Now(),
+				Available: 100,
+			}
+		}
+		return entries
+	}
+	return calls
+}
+
+func cachedAccessTokens(tm *TokenManager) map[string]string {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	tokens := make(map[string]string, len(tm.cache.tokens))
+	for key, cached := range tm.cache.tokens {
+		tokens[key] = cached.Token.AccessToken
+	}
+	return tokens
+}
+
+func TestTokenManager_ReplaceConfigsKeepsCacheByConfigID(t *testing.T) {
+	tm, _ := newHealthTestManager(3)
+	tm.health["token_2"] = &tokenHealth{requests: 7}
+	release := make(chan struct{})
+	calls := configLoader(tm, release)
+
+	// token2移到最前，token0的凭据变化，token1删除，新增token3
+	tm.ReplaceConfigs([]AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "token2"},
+		{AuthType: AuthMethodSocial, RefreshToken: "token0", ProfileArn: "arn:aws:codewhisperer:us-east-1:123456789012:profile/NEW"},
+		{AuthType: AuthMethodSocial, RefreshToken: "token3"},
+	})
+
+	assert.Equal(t, map[string]string{"token_0": "access_2"}, cachedAccessTokens(tm), "只保留凭据未变的账号的缓存，并迁移到新索引")
+	tm.mutex.RLock()
+	assert.Equal(t, int64(7), tm.health["token_0"].requests, "健康统计随账号迁移")
+	assert.Equal(t, ConfigID(AuthConfig{RefreshToken: "token3"}), tm.configIDs["token_2"])
+	assert.Equal(t, []string{"token_0", "token_1", "token_2"}, tm.configOrder)
+	tm.mutex.RUnlock()
+
+	token, err := tm.getBestToken()
+	require.NoError(t, err)
+	assert.Equal(t, "access_2", token.AccessToken, "刷新完成前使用保留的缓存")
+
+	close(release)
+	waitIdle(t, tm)
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, map[string]string{
+		"token_0": "loaded_token2",
+		"token_1": "loaded_token0",
+		"token_2": "loaded_token3",
+	}, cachedAccessTokens(tm))
+}
+
+func TestTokenManager_ReplaceConfigsWithoutNewAccountsSkipsRefresh(t *testing.T) {
+	tm, _ := newHealthTestManager(2)
+	calls := configLoader(tm, nil)
+
+	tm.ReplaceConfigs([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "token1", DisplayName: "renamed"}})
+
+	waitIdle(t, tm)
+	assert.Zero(t, calls.Load(), "只删除或修改别名时不需要刷新")
+	assert.Equal(t, map[string]string{"token_0": "access_1"}, cachedAccessTokens(tm))
+}
+
+func TestTokenManager_ReplaceConfigsDiscardsInFlightRefresh(t *testing.T) {
+	tm, clock := newHealthTestManager(2)
+	tm.lastRefresh = clock.Add(-time.Hour)
+	release := make(chan struct{})
+	calls := configLoader(tm, release)
+
+	// 按旧配置的刷新进行中时重新加载配置
+	tm.mutex.Lock()
+	tm.triggerRefreshUnlocked()
+	tm.mutex.Unlock()
+	tm.ReplaceConfigs([]AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "token1"},
+		{AuthType: AuthMethodSocial, RefreshToken: "token9"},
+	})
+	close(release)
+
+	require.Eventually(t, func() bool { return calls.Load() == 2 }, time.Second, 5*time.Millisecond, "旧刷新结果丢弃后按新配置重新刷新")
+	waitIdle(t, tm)
+	assert.Equal(t, map[string]string{
+		"token_0": "loaded_token1",
+		"token_1": "loaded_token9",
+	}, cachedAccessTokens(tm))
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxScheduleSteps 计算下次可用时间时最多跨越的相邻停用时段数
+const maxScheduleSteps = 64
+
+// ScheduleWindow 计划停用时段：在days中各天的[startHour, endHour)内不参与选择
+// startHour大于endHour时跨越午夜（如22-6表示当晚22:00到次日06:00，days指开始的那一天）；
+// 两者相等时表示全天；days为空表示每天；tz为IANA时区名，为空时使用服务器本地时区
+type ScheduleWindow struct {
+	Days      []string `json:"days,omitempty"` // mon、tue ... sun（也接受完整英文名）
+	StartHour int      `json:"startHour"`
+	EndHour   int      `json:"endHour"`
+	TZ        string   `json:"tz,omitempty"`
+}
+
+// Schedule 账号的计划停用时段，任一时段生效即停用
+type Schedule []ScheduleWindow
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// Validate 检查时段配置是否有效
+func (s Schedule) Validate() error {
+	for i, w := range s {
+		if w.StartHour < 0 || w.StartHour > 23 {
+			return fmt.Errorf("schedule[%d]: startHour必须在0-23之间: %d", i, w.StartHour)
+		}
+		if w.EndHour < 0 || w.EndHour > 24 {
+			return fmt.Errorf("schedule[%d]: endHour必须在0-24之间: %d", i, w.EndHour)
+		}
+		for _, day := range w.Days {
+			if _, ok := weekdayNames[strings.ToLower(strings.TrimSpace(day))]; !ok {
+				return fmt.Errorf("schedule[%d]: 无效的星期: %q", i, day)
+			}
+		}
+		if _, err := w.location(); err != nil {
+			return fmt.Errorf("schedule[%d]: 无效的时区 %q: %w", i, w.TZ, err)
+		}
+	}
+	return nil
+}
+
+// Off 返回t时刻是否处于停用时段，以及之后最早的可用时间（相邻或重叠的时段连续跳过）
+func (s Schedule) Off(t time.Time) (bool, time.Time) {
+	next := t
+	for range maxScheduleSteps {
+		end, inWindow := s.windowEnd(next)
+		if !inWindow {
+			return !next.Equal(t), next
+		}
+		next = end
+	}
+	// 时段覆盖整周（如days为空的全天时段），不会再变为可用
+	return true, time.Time{}
+}
+
+// windowEnd 返回包含t的停用时段中最晚的结束时间
+func (s Schedule) windowEnd(t time.Time) (time.Time, bool) {
+	var latest time.Time
+	found := false
+	for _, w := range s {
+		if end, ok := w.windowEnd(t); ok && (!found || end.After(latest)) {
+			latest, found = end, true
+		}
+	}
+	return latest, found
+}
+
+// windowEnd 返回包含t的本时段结束时间；检查当天和前一天开始的时段（跨午夜）
+func (w ScheduleWindow) windowEnd(t time.Time) (time.Time, bool) {
+	loc, err := w.location()
+	if err != nil {
+		return time.Time{}, false
+	}
+	local := t.In(loc)
+	for offset := 0; offset >= -1; offset-- {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, loc)
+		if !w.appliesOn(day.Weekday()) {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), w.StartHour, 0, 0, 0, loc)
+		end := time.Date(day.Year(), day.Month(), day.Day(), w.EndHour, 0, 0, 0, loc)
+		if w.EndHour <= w.StartHour {
+			end = time.Date(day.Year(), day.Month(), day.Day()+1, w.EndHour, 0, 0, 0, loc)
+		}
+		if !t.Before(start) && t.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (w ScheduleWindow) appliesOn(weekday time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, day := range w.Days {
+		if d, ok := weekdayNames[strings.ToLower(strings.TrimSpace(day))]; ok && d == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleLocations 已加载的时区（选择token时频繁计算，避免每次读取时区数据库）
+var scheduleLocations sync.Map
+
+func (w ScheduleWindow) location() (*time.Location, error) {
+	if w.TZ == "" {
+		return time.Local, nil
+	}
+	if loc, ok := scheduleLocations.Load(w.TZ); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(w.TZ)
+	if err != nil {
+		return nil, err
+	}
+	scheduleLocations.Store(w.TZ, loc)
+	return loc, nil
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 2026-10-19 是周一
+func scheduleTime(t *testing.T, tz, value string) time.Time {
+	t.Helper()
+	loc, err := time.LoadLocation(tz)
+	require.NoError(t, err)
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, loc)
+	require.NoError(t, err)
+	return parsed
+}
+
+func TestSchedule_WorkingHoursBoundaries(t *testing.T) {
+	schedule := Schedule{{Days: []string{"mon", "tue", "wed", "thu", "fri"}, StartHour: 9, EndHour: 18, TZ: "UTC"}}
+	at := func(value string) time.Time { return scheduleTime(t, "UTC", value) }
+
+	cases := []struct {
+		now       string
+		off       bool
+		available string
+	}{
+		{"2026-10-19 08:59", false, "2026-10-19 08:59"},
+		{"2026-10-19 09:00", true, "2026-10-19 18:00"}, // 开始时刻包含在内
+		{"2026-10-19 17:59", true, "2026-10-19 18:00"},
+		{"2026-10-19 18:00", false, "2026-10-19 18:00"}, // 结束时刻不包含
+		{"2026-10-24 12:00", false, "2026-10-24 12:00"}, // 周六
+	}
+	for _, tc := range cases {
+		off, availableAt := schedule.Off(at(tc.now))
+		assert.Equal(t, tc.off, off, tc.now)
+		assert.True(t, at(tc.available).Equal(availableAt), "%s: %s", tc.now, availableAt)
+	}
+}
+
+func TestSchedule_TimezoneHandling(t *testing.T) {
+	schedule := Schedule{{StartHour: 9, EndHour: 18, TZ: "Asia/Shanghai"}}
+
+	// UTC 02:00 是上海 10:00
+	off, availableAt := schedule.Off(scheduleTime(t, "UTC", "2026-10-19 02:00"))
+	assert.True(t, off)
+	assert.True(t, scheduleTime(t, "UTC", "2026-10-19 10:00").Equal(availableAt), availableAt.String())
+
+	// UTC 12:00 是上海 20:00
+	off, _ = schedule.Off(scheduleTime(t, "UTC", "2026-10-19 12:00"))
+	assert.False(t, off)
+
+	// 跨夏令时切换：纽约 2026-11-01 凌晨回拨，窗口仍按当地时间结束
+	ny := Schedule{{StartHour: 0, EndHour: 6, TZ: "America/New_York"}}
+	off, availableAt = ny.Off(scheduleTime(t, "America/New_York", "2026-11-01 03:00"))
+	assert.True(t, off)
+	assert.True(t, scheduleTime(t, "UTC", "2026-11-01 11:00").Equal(availableAt), availableAt.String())
+}
+
+func TestSchedule_OvernightWindow(t *testing.T) {
+	schedule := Schedule{{Days: []string{"Friday"}, StartHour: 22, EndHour: 6, TZ: "UTC"}}
+	at := func(value string) time.Time { return scheduleTime(t, "UTC", value) }
+
+	cases := []struct {
+		now       string
+		off       bool
+		available string
+	}{
+		{"2026-10-23 21:59", false, "2026-10-23 21:59"},
+		{"2026-10-23 22:00", true, "2026-10-24 06:00"},
+		{"2026-10-24 03:00", true, "2026-10-24 06:00"}, // 周五开始的时段延续到周六早上
+		{"2026-10-24 06:00", false, "2026-10-24 06:00"},
+		{"2026-10-24 23:00", false, "2026-10-24 23:00"}, // 周六晚上不在days中
+		{"2026-10-23 03:00", false, "2026-10-23 03:00"}, // 周四开始的时段不存在
+	}
+	for _, tc := range cases {
+		off, availableAt := schedule.Off(at(tc.now))
+		assert.Equal(t, tc.off, off, tc.now)
+		assert.True(t, at(tc.available).Equal(availableAt), "%s: %s", tc.now, availableAt)
+	}
+}
+
+func TestSchedule_AdjacentWindowsAndFullDay(t *testing.T) {
+	at := func(value string) time.Time { return scheduleTime(t, "UTC", value) }
+
+	// 相邻时段连续跳过
+	chained := Schedule{
+		{StartHour: 9, EndHour: 12, TZ: "UTC"},
+		{StartHour: 12, EndHour: 18, TZ: "UTC"},
+	}
+	off, availableAt := chained.Off(at("2026-10-19 10:00"))
+	assert.True(t, off)
+	assert.True(t, at("2026-10-19 18:00").Equal(availableAt), availableAt.String())
+
+	// 开始等于结束表示全天，周末整天停用时下次可用为周一0点
+	weekend := Schedule{{Days: []string{"sat", "sun"}, StartHour: 0, EndHour: 0, TZ: "UTC"}}
+	off, availableAt = weekend.Off(at("2026-10-24 15:00"))
+	assert.True(t, off)
+	assert.True(t, at("2026-10-26 00:00").Equal(availableAt), availableAt.String())
+
+	// 每天全天停用：不会变为可用
+	always := Schedule{{StartHour: 0, EndHour: 0, TZ: "UTC"}}
+	off, availableAt = always.Off(at("2026-10-19 10:00"))
+	assert.True(t, off)
+	assert.True(t, availableAt.IsZero())
+
+	var none Schedule
+	off, _ = none.Off(at("2026-10-19 10:00"))
+	assert.False(t, off)
+}
+
+func TestSchedule_Validate(t *testing.T) {
+	assert.NoError(t, Schedule{{Days: []string{"Mon", "sunday"}, StartHour: 22, EndHour: 24, TZ: "Europe/Berlin"}}.Validate())
+	assert.ErrorContains(t, Schedule{{StartHour: 24, EndHour: 6}}.Validate(), "startHour")
+	assert.ErrorContains(t, Schedule{{StartHour: 9, EndHour: 25}}.Validate(), "endHour")
+	assert.ErrorContains(t, Schedule{{Days: []string{"funday"}, StartHour: 9, EndHour: 18}}.Validate(), "funday")
+	assert.ErrorContains(t, Schedule{{StartHour: 9, EndHour: 18, TZ: "Mars/Olympus"}}.Validate(), "时区")
+}
+
+func TestSchedule_JSONConfig(t *testing.T) {
+	configs, err := parseJSONConfig(`[{"auth":"Social","refreshToken":"a",
+		"schedule":[{"days":["mon","tue"],"startHour":9,"endHour":18,"tz":"Asia/Shanghai"}]},
+		{"auth":"Social","refreshToken":"b","schedule":[{"startHour":30,"endHour":6}]}]`)
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+	assert.Equal(t, Schedule{{Days: []string{"mon", "tue"}, StartHour: 9, EndHour: 18, TZ: "Asia/Shanghai"}}, configs[0].Schedule)
+
+	// 时段无效的配置被跳过
+	valid := processConfigs(configs)
+	require.Len(t, valid, 1)
+	assert.Equal(t, "a", valid[0].RefreshToken)
+
+	data, err := json.Marshal(AuthConfig{RefreshToken: "c"})
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "schedule")
+}
+
+func TestTokenManager_ScheduledOffTokenExcluded(t *testing.T) {
+	tm, _ := newHealthTestManager(2)
+	clock := scheduleTime(t, "UTC", "2026-10-19 10:00")
+	tm.now = func() time.Time { return clock }
+	tm.lastRefresh = clock
+	for _, cached := range tm.cache.tokens {
+		cached.CachedAt = clock
+	}
+	tm.schedules = configSchedules([]AuthConfig{
+		{Schedule: Schedule{{StartHour: 9, EndHour: 18, TZ: "UTC"}}},
+		{},
+	})
+	require.Contains(t, tm.schedules, fmt.Sprintf(config.TokenCacheKeyFormat, 0))
+
+	counts := selectionCounts(t, tm, 200)
+	assert.Zero(t, counts["access_0"], "停用时段内不参与选择")
+	assert.Equal(t, 200, counts["access_1"])
+
+	// 只剩停用中的token时没有可用token
+	tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 1)].Available = 0
+	_, err := tm.getBestToken()
+	assert.Error(t, err)
+
+	// 时段结束后恢复
+	clock = scheduleTime(t, "UTC", "2026-10-19 18:00")
+	tm.lastRefresh = clock
+	for _, cached := range tm.cache.tokens {
+		cached.CachedAt = clock
+	}
+	token, err := tm.getBestToken()
+	require.NoError(t, err)
+	assert.Equal(t, "access_0", token.AccessToken)
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"kiro2api/types"
+)
+
+// token选择策略
+const (
+	SelectionStrategyHealth    = "health"     // 按健康评分加权随机选择（默认）
+	SelectionStrategyLeastUsed = "least-used" // 选择已处理请求数最少的token
+)
+
+// IsSelectionStrategy 判断是否为已知的选择策略
+func IsSelectionStrategy(name string) bool {
+	switch name {
+	case SelectionStrategyHealth, SelectionStrategyLeastUsed:
+		return true
+	}
+	return false
+}
+
+// ParseSelectionStrategy 解析选择策略名称（忽略大小写和首尾空白），未知策略返回错误
+func ParseSelectionStrategy(name string) (string, error) {
+	strategy := strings.ToLower(strings.TrimSpace(name))
+	if !IsSelectionStrategy(strategy) {
+		return "", fmt.Errorf("未知的选择策略: %s", name)
+	}
+	return strategy, nil
+}
+
+// GetTokenWithStrategy 按指定的选择策略获取可用token（包含使用信息），用于单个请求覆盖默认策略
+func (as *AuthService) GetTokenWithStrategy(strategy string) (*types.TokenWithUsage, error) {
+	if as.tokenManager == nil {
+		return nil, fmt.Errorf("token管理器未初始化")
+	}
+	return as.tokenManager.GetBestTokenWithStrategy(strategy)
+}
+
+// leastUsedUnlocked 从候选中选择已处理请求数最少的token，请求数相同时选择剩余次数较多的
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) leastUsedUnlocked(candidates []string) string {
+	selected := candidates[0]
+	for _, key := range candidates[1:] {
+		requests, selectedRequests := tm.requestCountUnlocked(key), tm.requestCountUnlocked(selected)
+		if requests < selectedRequests ||
+			(requests == selectedRequests && tm.availableUnlocked(key, tm.cache.tokens[key]) > tm.availableUnlocked(selected, tm.cache.tokens[selected])) {
+			selected = key
+		}
+	}
+	return selected
+}
+
+// requestCountUnlocked token已处理的请求数
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) requestCountUnlocked(key string) int64 {
+	if stats, exists := tm.health[key]; exists {
+		return stats.requests
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSelectionStrategy(t *testing.T) {
+	for value, want := range map[string]string{
+		"health":       SelectionStrategyHealth,
+		" Least-Used ": SelectionStrategyLeastUsed,
+	} {
+		strategy, err := ParseSelectionStrategy(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, want, strategy)
+	}
+	for _, value := range []string{"", "random", "least_used"} {
+		_, err := ParseSelectionStrategy(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestGetBestTokenWithStrategy_LeastUsed(t *testing.T) {
+	tm, _ := newHealthTestManager(3)
+	tm.health["token_0"] = &tokenHealth{requests: 5}
+	tm.health["token_1"] = &tokenHealth{requests: 2}
+	tm.health["token_2"] = &tokenHealth{requests: 2}
+	tm.cache.tokens["token_2"].Available = 200000
+
+	for i := 0; i < 10; i++ {
+		token, err := tm.GetBestTokenWithStrategy(SelectionStrategyLeastUsed)
+		require.NoError(t, err)
+		assert.Equal(t, "access_2", token.TokenInfo.AccessToken, "请求数最少，相同时剩余次数较多")
+	}
+
+	// 默认策略按健康评分随机选择，不固定选择同一个token
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		token, err := tm.GetBestTokenWithStrategy("")
+		require.NoError(t, err)
+		seen[token.TokenInfo.AccessToken] = true
+	}
+	assert.Greater(t, len(seen), 1)
+}
+
+func TestGetBestTokenExcluding(t *testing.T) {
+	tm, _ := newHealthTestManager(3)
+
+	for i := 0; i < 100; i++ {
+		token, err := tm.GetBestTokenExcluding("access_0")
+		require.NoError(t, err)
+		assert.NotEqual(t, "access_0", token.TokenInfo.AccessToken)
+	}
+
+	// 只有被排除的token可用时仍然返回它，而不是让重试失败
+	tm.cache.tokens["token_1"].Available = 0
+	tm.cache.tokens["token_2"].Available = 0
+	token, err := tm.GetBestTokenExcluding("access_0")
+	require.NoError(t, err)
+	assert.Equal(t, "access_0", token.TokenInfo.AccessToken)
+}
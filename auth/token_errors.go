@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// 错误发生的阶段
+const (
+	TokenErrorPhaseRefresh  = "refresh"  // 刷新access token
+	TokenErrorPhaseUsage    = "usage"    // 查询使用限制
+	TokenErrorPhaseGenerate = "generate" // 转发生成请求
+)
+
+// 错误分类（刷新阶段沿用RefreshOutcome*的取值）
+const (
+	TokenErrorAuthFailure     = RefreshOutcomeAuthFailure    // 401/403等鉴权失败
+	TokenErrorNetworkFailure  = RefreshOutcomeNetworkFailure // 网络错误
+	TokenErrorThrottled       = RefreshOutcomeThrottled      // 限流
+	TokenErrorBanned          = "banned"                     // 账号被封禁
+	TokenErrorUpstream        = "upstream_error"             // 上游5xx
+	TokenErrorRequest         = "request_error"              // 其他4xx，通常是请求本身的问题
+	TokenErrorInvalidResponse = "invalid_response"           // 200但响应无法解析
+)
+
+// TokenErrorRecord 账号的一次失败记录
+type TokenErrorRecord struct {
+	Time    time.Time `json:"time"`
+	Phase   string    `json:"phase"`
+	Status  int       `json:"status,omitempty"` // HTTP状态码，网络错误时为0
+	Type    string    `json:"type"`
+	Message string    `json:"message"` // 截断到TokenErrorMessageMaxLength
+}
+
+// ClassifyTokenError 按HTTP状态码对失败分类，statusCode为0表示请求未得到响应
+func ClassifyTokenError(statusCode int) string {
+	switch {
+	case statusCode == 0:
+		return TokenErrorNetworkFailure
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden:
+		return TokenErrorAuthFailure
+	case statusCode == http.StatusTooManyRequests:
+		return TokenErrorThrottled
+	case statusCode >= http.StatusInternalServerError:
+		return TokenErrorUpstream
+	case statusCode >= http.StatusBadRequest:
+		return TokenErrorRequest
+	default:
+		return TokenErrorInvalidResponse
+	}
+}
+
+// TokenErrorStore 按配置（ConfigID）保存最近的失败记录，每个配置最多TokenErrorHistorySize条
+// 配置了文件路径时持久化，重启后恢复；写入按TokenErrorSaveDelay合并
+type TokenErrorStore struct {
+	mutex       sync.Mutex
+	path        string                        // 为空时只保存在内存中
+	records     map[string][]TokenErrorRecord // key: ConfigID，从旧到新
+	savePending bool
+}
+
+// tokenErrorStore 全局错误记录（测试可替换）
+var tokenErrorStore = NewTokenErrorStore("")
+
+// NewTokenErrorStore 创建错误记录存储，path为空时不持久化
+func NewTokenErrorStore(path string) *TokenErrorStore {
+	return &TokenErrorStore{path: path, records: make(map[string][]TokenErrorRecord)}
+}
+
+// NewTokenErrorStoreFromEnv TOKEN_ERROR_HISTORY_FILE: 错误记录文件路径（默认不持久化），文件存在时加载已有记录
+func NewTokenErrorStoreFromEnv() *TokenErrorStore {
+	store := NewTokenErrorStore(strings.TrimSpace(os.Getenv("TOKEN_ERROR_HISTORY_FILE")))
+	if err := store.load(); err != nil {
+		logger.Warn("加载token错误记录失败，忽略已有记录", logger.String("path", store.path), logger.Err(err))
+	} else if len(store.records) > 0 {
+		logger.Info("已恢复token错误记录", logger.String("path", store.path), logger.Int("accounts", len(store.records)))
+	}
+	return store
+}
+
+func (s *TokenErrorStore) load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	records := make(map[string][]TokenErrorRecord)
+	if err := utils.SafeUnmarshal(data, &records); err != nil {
+		return err
+	}
+	for id, history := range records {
+		if len(history) > config.TokenErrorHistorySize {
+			records[id] = history[len(history)-config.TokenErrorHistorySize:]
+		}
+	}
+	s.records = records
+	return nil
+}
+
+// Record 追加一条失败记录，超出容量时丢弃最早的记录
+func (s *TokenErrorStore) Record(configID string, record TokenErrorRecord) {
+	if configID == "" {
+		return
+	}
+	record.Message = truncateErrorMessage(record.Message)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	history := append(s.records[configID], record)
+	if len(history) > config.TokenErrorHistorySize {
+		// 复制到新切片，避免底层数组随淘汰不断增长
+		history = append([]TokenErrorRecord(nil), history[len(history)-config.TokenErrorHistorySize:]...)
+	}
+	s.records[configID] = history
+	s.scheduleSaveLocked()
+}
+
+// Recent 返回配置的失败记录，从新到旧
+func (s *TokenErrorStore) Recent(configID string) []TokenErrorRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	history := s.records[configID]
+	recent := make([]TokenErrorRecord, len(history))
+	for i, record := range history {
+		recent[len(history)-1-i] = record
+	}
+	return recent
+}
+
+// Latest 返回配置最近一次失败记录
+func (s *TokenErrorStore) Latest(configID string) (TokenErrorRecord, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	history := s.records[configID]
+	if len(history) == 0 {
+		return TokenErrorRecord{}, false
+	}
+	return history[len(history)-1], true
+}
+
+// scheduleSaveLocked 在TokenErrorSaveDelay后保存，期间的其他记录合并为一次写入
+// 内部方法：调用者必须持有 s.mutex
+func (s *TokenErrorStore) scheduleSaveLocked() {
+	if s.path == "" || s.savePending {
+		return
+	}
+	s.savePending = true
+	time.AfterFunc(config.TokenErrorSaveDelay, s.Flush)
+}
+
+// Flush 立即把记录写入文件（先写临时文件再重命名）
+func (s *TokenErrorStore) Flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.savePending = false
+	if s.path == "" {
+		return
+	}
+	data, err := utils.SafeMarshal(s.records)
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.MkdirAll(filepath.Dir(s.path), 0o755); err == nil {
+			if err = os.WriteFile(tmp, data, 0o600); err == nil {
+				err = os.Rename(tmp, s.path)
+			}
+		}
+	}
+	if err != nil {
+		logger.Warn("保存token错误记录失败", logger.String("path", s.path), logger.Err(err))
+	}
+}
+
+// observeRefreshError 记录刷新失败
+func (s *TokenErrorStore) observeRefreshError(cfg AuthConfig, err error) {
+	if err == nil {
+		return
+	}
+	status := 0
+	var statusErr *refreshStatusError
+	var throttleResp *idcThrottleResponseError
+	switch {
+	case errors.As(err, &statusErr):
+		status = statusErr.statusCode
+	case errors.As(err, &throttleResp):
+		status = throttleResp.statusCode
+	}
+	s.Record(ConfigID(cfg), TokenErrorRecord{
+		Time:    time.Now(),
+		Phase:   TokenErrorPhaseRefresh,
+		Status:  status,
+		Type:    classifyRefreshError(err),
+		Message: err.Error(),
+	})
+}
+
+// observeUsageResult 记录失败的用量检查（封禁或错误）
+func (s *TokenErrorStore) observeUsageResult(token types.TokenInfo, result *UsageCheckResult) {
+	if token.RefreshToken == "" || result == nil || result.Error == nil {
+		return
+	}
+	errorType := ClassifyTokenError(result.StatusCode)
+	if result.Status == types.AccountStatusBanned {
+		errorType = TokenErrorBanned
+	}
+	s.Record(refreshTokenID(token.RefreshToken), TokenErrorRecord{
+		Time:    time.Now(),
+		Phase:   TokenErrorPhaseUsage,
+		Status:  result.StatusCode,
+		Type:    errorType,
+		Message: result.Error.Error(),
+	})
+}
+
+// truncateErrorMessage 按字节截断消息，不切断UTF-8字符
+func truncateErrorMessage(message string) string {
+	if len(message) <= config.TokenErrorMessageMaxLength {
+		return message
+	}
+	cut := config.TokenErrorMessageMaxLength
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+	return message[:cut] + "..."
+}
+
+// TokenErrors 返回配置最近的失败记录，从新到旧
+func TokenErrors(configID string) []TokenErrorRecord {
+	return tokenErrorStore.Recent(configID)
+}
+
+// LatestTokenError 返回配置最近一次失败记录
+func LatestTokenError(configID string) (TokenErrorRecord, bool) {
+	return tokenErrorStore.Latest(configID)
+}
+
+// RecordGenerateError 记录使用指定access token转发生成请求的失败
+// statusCode为0表示网络错误
+func (tm *TokenManager) RecordGenerateError(accessToken string, statusCode int, message string) {
+	tokenErrorStore.Record(tm.AccountID(accessToken), TokenErrorRecord{
+		Time:    tm.now(),
+		Phase:   TokenErrorPhaseGenerate,
+		Status:  statusCode,
+		Type:    ClassifyTokenError(statusCode),
+		Message: message,
+	})
+}
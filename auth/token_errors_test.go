@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withTokenErrorStore(t *testing.T, store *TokenErrorStore) {
+	original := tokenErrorStore
+	tokenErrorStore = store
+	t.Cleanup(func() { tokenErrorStore = original })
+}
+
+func TestTokenErrorStore_RingKeepsNewest(t *testing.T) {
+	store := NewTokenErrorStore("")
+	start := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+	phases := []string{TokenErrorPhaseRefresh, TokenErrorPhaseUsage, TokenErrorPhaseGenerate}
+	statuses := []int{0, http.StatusForbidden, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusBadRequest}
+
+	total := config.TokenErrorHistorySize + 5
+	for i := range total {
+		status := statuses[i%len(statuses)]
+		store.Record("a", TokenErrorRecord{
+			Time:    start.Add(time.Duration(i) * time.Second),
+			Phase:   phases[i%len(phases)],
+			Status:  status,
+			Type:    ClassifyTokenError(status),
+			Message: fmt.Sprintf("failure %d", i),
+		})
+	}
+	store.Record("b", TokenErrorRecord{Phase: TokenErrorPhaseUsage, Type: TokenErrorBanned, Message: "banned"})
+	store.Record("", TokenErrorRecord{Message: "未知账号不记录"})
+
+	recent := store.Recent("a")
+	require.Len(t, recent, config.TokenErrorHistorySize)
+	assert.Equal(t, fmt.Sprintf("failure %d", total-1), recent[0].Message, "从新到旧")
+	assert.Equal(t, "failure 5", recent[len(recent)-1].Message, "超出容量时丢弃最早的记录")
+	for i := 1; i < len(recent); i++ {
+		assert.True(t, recent[i-1].Time.After(recent[i].Time))
+	}
+
+	latest, exists := store.Latest("a")
+	require.True(t, exists)
+	assert.Equal(t, recent[0], latest)
+	assert.Equal(t, TokenErrorPhaseRefresh, latest.Phase)
+	assert.Equal(t, http.StatusBadRequest, latest.Status)
+	assert.Equal(t, TokenErrorRequest, latest.Type)
+
+	assert.Len(t, store.Recent("b"), 1, "各账号的记录互不影响")
+	_, exists = store.Latest("missing")
+	assert.False(t, exists)
+	assert.Empty(t, store.Recent(""))
+}
+
+func TestTokenErrorStore_TruncatesMessage(t *testing.T) {
+	store := NewTokenErrorStore("")
+	store.Record("a", TokenErrorRecord{Message: strings.Repeat("错", config.TokenErrorMessageMaxLength)})
+
+	latest, _ := store.Latest("a")
+	assert.LessOrEqual(t, len(latest.Message), config.TokenErrorMessageMaxLength+len("..."))
+	assert.True(t, strings.HasSuffix(latest.Message, "..."))
+	assert.Equal(t, strings.Repeat("错", config.TokenErrorMessageMaxLength/3)+"...", latest.Message, "不切断多字节字符")
+}
+
+func TestTokenErrorStore_PersistsAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "token_errors.json")
+	t.Setenv("TOKEN_ERROR_HISTORY_FILE", path)
+
+	store := NewTokenErrorStoreFromEnv()
+	checkedAt := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+	store.Record("a", TokenErrorRecord{Time: checkedAt, Phase: TokenErrorPhaseRefresh, Status: 401, Type: TokenErrorAuthFailure, Message: "invalid_grant"})
+	store.Flush()
+
+	restored := NewTokenErrorStoreFromEnv()
+	assert.Equal(t, store.Recent("a"), restored.Recent("a"))
+	latest, exists := restored.Latest("a")
+	require.True(t, exists)
+	assert.True(t, checkedAt.Equal(latest.Time))
+}
+
+func TestClassifyTokenError(t *testing.T) {
+	for status, want := range map[int]string{
+		0:                              TokenErrorNetworkFailure,
+		http.StatusUnauthorized:        TokenErrorAuthFailure,
+		http.StatusForbidden:           TokenErrorAuthFailure,
+		http.StatusTooManyRequests:     TokenErrorThrottled,
+		http.StatusInternalServerError: TokenErrorUpstream,
+		http.StatusBadRequest:          TokenErrorRequest,
+		http.StatusOK:                  TokenErrorInvalidResponse,
+	} {
+		assert.Equal(t, want, ClassifyTokenError(status), status)
+	}
+}
+
+func TestTokenErrorStore_FailurePaths(t *testing.T) {
+	store := NewTokenErrorStore("")
+	withTokenErrorStore(t, store)
+	cfg := AuthConfig{AuthType: AuthMethodSocial, RefreshToken: "refresh-errors"}
+	id := ConfigID(cfg)
+
+	store.observeRefreshError(cfg, nil)
+	assert.Empty(t, store.Recent(id), "成功不记录")
+
+	store.observeRefreshError(cfg, &refreshStatusError{prefix: "刷新token失败", statusCode: http.StatusUnauthorized, body: "invalid_grant"})
+	store.observeRefreshError(cfg, &idcThrottleResponseError{statusCode: http.StatusBadRequest, body: "SlowDown"})
+	store.observeRefreshError(cfg, errors.New("dial tcp: connection refused"))
+
+	token := types.TokenInfo{RefreshToken: cfg.RefreshToken}
+	store.observeUsageResult(token, &UsageCheckResult{Status: types.AccountStatusActive})
+	store.observeUsageResult(token, &UsageCheckResult{
+		Status: types.AccountStatusBanned, StatusCode: http.StatusForbidden, Error: errors.New("账号被封禁: TEMPORARILY_SUSPENDED"),
+	})
+	store.observeUsageResult(token, &UsageCheckResult{
+		Status: types.AccountStatusError, StatusCode: http.StatusOK, Error: errors.New("解析响应失败"),
+	})
+
+	recent := store.Recent(id)
+	require.Len(t, recent, 5)
+	summary := make([]string, 0, len(recent))
+	for _, record := range recent {
+		summary = append(summary, fmt.Sprintf("%s/%d/%s", record.Phase, record.Status, record.Type))
+	}
+	assert.Equal(t, []string{
+		"usage/200/invalid_response",
+		"usage/403/banned",
+		"refresh/0/network_failure",
+		"refresh/400/throttled",
+		"refresh/401/auth_failure",
+	}, summary)
+	assert.Contains(t, recent[4].Message, "invalid_grant")
+}
+
+func TestTokenManager_RecordGenerateError(t *testing.T) {
+	store := NewTokenErrorStore("")
+	withTokenErrorStore(t, store)
+	tm, _ := newHealthTestManager(2)
+
+	tm.RecordGenerateError("access_1", http.StatusTooManyRequests, "Too many requests")
+	tm.RecordGenerateError("unknown", http.StatusBadGateway, "不属于任何账号，忽略")
+
+	id := tm.configIDs[fmt.Sprintf(config.TokenCacheKeyFormat, 1)]
+	assert.Equal(t, []TokenErrorRecord{{
+		Time:    tm.now(),
+		Phase:   TokenErrorPhaseGenerate,
+		Status:  http.StatusTooManyRequests,
+		Type:    TokenErrorThrottled,
+		Message: "Too many requests",
+	}}, store.Recent(id))
+	assert.Equal(t, store.Recent(id), TokenErrors(id))
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"math"
+	"time"
+
+	"kiro2api/config"
+)
+
+// tokenHealth 单个token的近期请求统计
+// 错误率和延迟均为指数加权移动平均（EWMA），错误率随时间衰减，使降级的token能自然恢复
+type tokenHealth struct {
+	errorRate   float64 // 最近请求的错误率（0~1）
+	latencyMs   float64 // 最近成功请求的平均延迟（毫秒）
+	requests    int64
+	errors      int64
+	lastUpdated time.Time
+
+	benchedUntil time.Time // 出错后禁选的截止时间（TOKEN_ERROR_PENALTY）
+}
+
+// TokenHealthScore token健康评分快照（供tokens API展示）
+type TokenHealthScore struct {
+	Score     float64 `json:"score"`      // 综合评分（0~1），越高越优先被选择
+	ErrorRate float64 `json:"error_rate"` // 衰减后的近期错误率
+	LatencyMs float64 `json:"latency_ms"` // 近期平均延迟（毫秒），无样本时为0
+	Available float64 `json:"available"`  // 剩余可用次数
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+
+	UsageAgeSeconds int64          `json:"usage_age_seconds"` // 距上次用量检查的秒数
+	UsageStaleness  UsageStaleness `json:"usage_staleness"`   // 选择器眼中的用量数据新鲜程度
+
+	PenaltyUntil string `json:"penalty_until,omitempty"` // 出错禁选截止时间（RFC3339），仅禁选期内有值
+}
+
+// RecordResult 记录一次使用指定access token的上游请求结果
+// failed 表示网络错误、限流、鉴权失败或上游5xx等与账号健康相关的失败
+// 失败时把禁选同步给其他副本；进行中计数在请求结束时由 ReleaseToken 释放
+func (tm *TokenManager) RecordResult(accessToken string, latency time.Duration, failed bool) {
+	tm.mutex.Lock()
+	key := tm.recordResultUnlocked(accessToken, latency, failed)
+	id := tm.configIDs[key]
+	tm.mutex.Unlock()
+
+	if key != "" && failed {
+		tm.cluster.Bench(id, tm.errorPenalty)
+	}
+}
+
+// recordResultUnlocked 更新本地健康统计，返回token的cache key（未找到时为空）
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) recordResultUnlocked(accessToken string, latency time.Duration, failed bool) string {
+	key := tm.cacheKeyByAccessTokenUnlocked(accessToken)
+	if key == "" {
+		return ""
+	}
+
+	health, exists := tm.health[key]
+	if !exists {
+		health = &tokenHealth{}
+		tm.health[key] = health
+	}
+
+	now := tm.now()
+	alpha := config.TokenHealthEWMAAlpha
+	sample := 0.0
+	if failed {
+		sample = 1.0
+		health.errors++
+		if tm.errorPenalty > 0 {
+			health.benchedUntil = now.Add(tm.errorPenalty)
+		}
+	} else {
+		latencyMs := float64(latency.Milliseconds())
+		if health.latencyMs == 0 {
+			health.latencyMs = latencyMs
+		} else {
+			health.latencyMs = alpha*latencyMs + (1-alpha)*health.latencyMs
+		}
+	}
+	health.errorRate = alpha*sample + (1-alpha)*health.decayedErrorRate(now)
+	health.requests++
+	health.lastUpdated = now
+	return key
+}
+
+// HealthScores 返回所有已缓存token的健康评分，key为token缓存key
+func (tm *TokenManager) HealthScores() map[string]TokenHealthScore {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+
+	scores := make(map[string]TokenHealthScore, len(tm.cache.tokens))
+	for key, cached := range tm.cache.tokens {
+		staleness, age := tm.usageStalenessUnlocked(cached)
+		score := TokenHealthScore{
+			Score:           tm.scoreUnlocked(key, cached),
+			Available:       tm.availableUnlocked(key, cached),
+			UsageAgeSeconds: int64(age.Seconds()),
+			UsageStaleness:  staleness,
+		}
+		if health, exists := tm.health[key]; exists {
+			score.ErrorRate = health.decayedErrorRate(tm.now())
+			score.LatencyMs = health.latencyMs
+			score.Requests = health.requests
+			score.Errors = health.errors
+		}
+		if tm.benchedUnlocked(key, tm.now()) {
+			score.PenaltyUntil = tm.benchedUntilUnlocked(key).Format(time.RFC3339)
+		}
+		scores[key] = score
+	}
+	return scores
+}
+
+// benchedUnlocked token是否处于出错禁选期
+// 禁选与健康评分互相独立：评分降权随错误率缓慢恢复，禁选只在最近一次失败后的短时间内生效
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) benchedUnlocked(key string, now time.Time) bool {
+	return now.Before(tm.benchedUntilUnlocked(key))
+}
+
+// benchedUntilUnlocked 本地与共享状态中较晚的禁选截止时间
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) benchedUntilUnlocked(key string) time.Time {
+	var until time.Time
+	if health, exists := tm.health[key]; exists {
+		until = health.benchedUntil
+	}
+	if shared, exists := tm.shared[tm.configIDs[key]]; exists && shared.BenchedUntil.After(until) {
+		until = shared.BenchedUntil
+	}
+	return until
+}
+
+// scoreUnlocked 计算token的综合健康评分
+// 评分 = 成功率 ×（延迟得分与剩余额度得分的加权和），持续失败的token评分趋近于0；
+// 无请求样本时成功率和延迟视为满分
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) scoreUnlocked(key string, cached *CachedToken) float64 {
+	errorScore, latencyScore := 1.0, 1.0
+	if health, exists := tm.health[key]; exists {
+		errorScore = 1 - health.decayedErrorRate(tm.now())
+		if health.latencyMs > 0 {
+			reference := float64(config.TokenHealthReferenceLatency.Milliseconds())
+			latencyScore = reference / (reference + health.latencyMs)
+		}
+	}
+
+	creditScore := 0.0
+	if available := tm.availableUnlocked(key, cached); available > 0 {
+		creditScore = available / (available + config.TokenHealthReferenceCredits)
+	}
+
+	return errorScore * (config.TokenHealthLatencyWeight*latencyScore +
+		config.TokenHealthCreditWeight*creditScore)
+}
+
+// decayedErrorRate 按半衰期衰减后的错误率，长时间没有新失败的token会逐渐恢复
+func (h *tokenHealth) decayedErrorRate(now time.Time) float64 {
+	if h.lastUpdated.IsZero() {
+		return h.errorRate
+	}
+	elapsed := now.Sub(h.lastUpdated)
+	if elapsed <= 0 {
+		return h.errorRate
+	}
+	return h.errorRate * math.Pow(0.5, float64(elapsed)/float64(config.TokenHealthDecayHalfLife))
+}
+
+// cacheKeyByAccessTokenUnlocked 按access token查找缓存key
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) cacheKeyByAccessTokenUnlocked(accessToken string) string {
+	if accessToken == "" {
+		return ""
+	}
+	for key, cached := range tm.cache.tokens {
+		if cached.Token.AccessToken == accessToken {
+			return key
+		}
+	}
+	return ""
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHealthTestManager 创建预填充n个token的管理器，使用可控时钟和固定种子的随机数
+func newHealthTestManager(n int) (*TokenManager, *time.Time) {
+	configs := make([]AuthConfig, n)
+	for i := range configs {
+		configs[i] = AuthConfig{AuthType: AuthMethodSocial, RefreshToken: fmt.Sprintf("token%d", i)}
+	}
+	tm := NewTokenManager(configs)
+
+	clock := time.Now()
+	tm.now = func() time.Time { return clock }
+	tm.random = rand.New(rand.NewSource(1)).Float64
+
+	for i := range configs {
+		tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, i)] = &CachedToken{
+			Token: types.TokenInfo{
+				AccessToken: fmt.Sprintf("access_%d", i),
+				ExpiresAt:   time.Now().Add(time.Hour),
+			},
+			CachedAt:  time.Now(),
+			Available: 100000,
+		}
+	}
+	tm.lastRefresh = time.Now()
+	return tm, &clock
+}
+
+// selectionCounts 统计n次选择中各token被选中的次数
+func selectionCounts(t *testing.T, tm *TokenManager, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		token, err := tm.getBestToken()
+		require.NoError(t, err)
+		counts[token.AccessToken]++
+	}
+	return counts
+}
+
+func TestTokenManager_DegradedTokenLosesPriorityAndRecovers(t *testing.T) {
+	tm, clock := newHealthTestManager(2)
+
+	// 健康状况相同时两个token都有流量
+	counts := selectionCounts(t, tm, 1000)
+	assert.InDelta(t, 500, counts["access_0"], 100)
+
+	// access_0连续失败后评分下降，绝大部分流量转向access_1
+	for i := 0; i < 10; i++ {
+		tm.RecordResult("access_0", time.Second, true)
+		tm.RecordResult("access_1", time.Second, false)
+	}
+	scores := tm.HealthScores()
+	assert.Less(t, scores["token_0"].Score, scores["token_1"].Score)
+	assert.Equal(t, int64(10), scores["token_0"].Errors)
+	assert.Greater(t, scores["token_0"].ErrorRate, 0.9)
+
+	counts = selectionCounts(t, tm, 1000)
+	assert.Greater(t, counts["access_1"], 800)
+	assert.Greater(t, counts["access_0"], 0, "降级的token仍应保留少量流量以便恢复")
+
+	// 一段时间没有新失败后错误率衰减，再加上成功请求，access_0恢复优先级
+	*clock = clock.Add(30 * time.Minute)
+	for i := 0; i < 5; i++ {
+		tm.RecordResult("access_0", time.Second, false)
+	}
+	scores = tm.HealthScores()
+	assert.InDelta(t, scores["token_1"].Score, scores["token_0"].Score, 0.01)
+
+	counts = selectionCounts(t, tm, 1000)
+	assert.InDelta(t, 500, counts["access_0"], 100)
+}
+
+func TestTokenManager_HealthScoreFactors(t *testing.T) {
+	tm, _ := newHealthTestManager(3)
+
+	// 延迟更高的token得分更低
+	tm.RecordResult("access_0", 500*time.Millisecond, false)
+	tm.RecordResult("access_1", 20*time.Second, false)
+
+	// 剩余额度更少的token得分更低
+	tm.cache.tokens["token_2"].Available = 5
+
+	scores := tm.HealthScores()
+	assert.Greater(t, scores["token_0"].Score, scores["token_1"].Score)
+	assert.Greater(t, scores["token_0"].Score, scores["token_2"].Score)
+	assert.Equal(t, float64(500), scores["token_0"].LatencyMs)
+	assert.Equal(t, float64(5), scores["token_2"].Available)
+	assert.Equal(t, int64(0), scores["token_2"].Requests)
+
+	// 未知token的结果被忽略
+	tm.RecordResult("access_unknown", time.Second, true)
+	assert.Len(t, tm.health, 2)
+}
+
+func TestTokenManager_SelectionSkipsUnusableTokens(t *testing.T) {
+	tm, _ := newHealthTestManager(2)
+	tm.cache.tokens["token_0"].Available = 0
+
+	counts := selectionCounts(t, tm, 50)
+	assert.Equal(t, map[string]int{"access_1": 50}, counts)
+	assert.True(t, tm.exhausted["token_0"])
+
+	tm.cache.tokens["token_1"].Token.ExpiresAt = time.Now().Add(-time.Minute)
+	_, err := tm.getBestToken()
+	assert.Error(t, err)
+}
+
+func TestTokenManager_PeekBestTokenDoesNotConsume(t *testing.T) {
+	tm, _ := newHealthTestManager(1)
+	tm.cache.tokens["token_0"].Available = 1
+
+	for i := 0; i < 3; i++ {
+		token, err := tm.PeekBestToken()
+		require.NoError(t, err)
+		assert.Equal(t, "access_0", token.AccessToken)
+	}
+	assert.Equal(t, float64(1), tm.cache.tokens["token_0"].Available, "探测选择不扣减可用次数")
+	assert.True(t, tm.cache.tokens["token_0"].LastUsed.IsZero())
+
+	tm.cache.tokens["token_0"].Available = 0
+	_, err := tm.PeekBestToken()
+	assert.Error(t, err)
+}
+
+func TestTokenManager_ErrorPenaltyBenchesTokenBriefly(t *testing.T) {
+	tm, clock := newHealthTestManager(3)
+	tm.errorPenalty = 10 * time.Second
+
+	tm.RecordResult("access_0", time.Second, true)
+	assert.NotEmpty(t, tm.HealthScores()[fmt.Sprintf(config.TokenCacheKeyFormat, 0)].PenaltyUntil)
+
+	// 禁选期内不会被选中
+	counts := selectionCounts(t, tm, 500)
+	assert.Zero(t, counts["access_0"])
+	assert.Equal(t, 500, counts["access_1"]+counts["access_2"])
+
+	// 禁选期结束后重新参与选择（仍受健康评分降权）
+	*clock = clock.Add(11 * time.Second)
+	assert.Empty(t, tm.HealthScores()[fmt.Sprintf(config.TokenCacheKeyFormat, 0)].PenaltyUntil)
+	counts = selectionCounts(t, tm, 1000)
+	assert.Greater(t, counts["access_0"], 0)
+
+	// 再次出错重新计时
+	tm.RecordResult("access_0", time.Second, true)
+	*clock = clock.Add(5 * time.Second)
+	assert.Zero(t, selectionCounts(t, tm, 200)["access_0"])
+}
+
+func TestTokenManager_ErrorPenaltyFallsBackWhenAllBenched(t *testing.T) {
+	tm, _ := newHealthTestManager(2)
+	tm.errorPenalty = 10 * time.Second
+
+	tm.RecordResult("access_0", time.Second, true)
+	tm.RecordResult("access_1", time.Second, true)
+
+	// 所有token都在禁选期时仍然返回token，而不是让请求失败
+	counts := selectionCounts(t, tm, 200)
+	assert.Equal(t, 200, counts["access_0"]+counts["access_1"])
+}
+
+func TestTokenManager_ErrorPenaltyDisabled(t *testing.T) {
+	tm, _ := newHealthTestManager(2)
+	tm.errorPenalty = 0
+
+	tm.RecordResult("access_0", time.Second, true)
+	assert.Empty(t, tm.HealthScores()[fmt.Sprintf(config.TokenCacheKeyFormat, 0)].PenaltyUntil)
+	assert.Greater(t, selectionCounts(t, tm, 1000)["access_0"], 0)
+}
@@ -5,19 +5,39 @@ import (
 	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/types"
+	"math"
+	"math/rand"
 	"sync"
 	"time"
 )
 
 // TokenManager 简化的token管理器
 type TokenManager struct {
-	cache        *SimpleTokenCache
-	configs      []AuthConfig
-	mutex        sync.RWMutex
-	lastRefresh  time.Time
-	configOrder  []string        // 配置顺序
-	currentIndex int             // 当前使用的token索引
-	exhausted    map[string]bool // 已耗尽的token记录
+	cache       *SimpleTokenCache
+	configs     []AuthConfig
+	mutex       sync.RWMutex
+	lastRefresh time.Time
+	configOrder []string                // 配置顺序
+	schedules   map[string]Schedule     // 设置了计划停用时段的配置（按cache key）
+	exhausted   map[string]bool         // 已耗尽的token记录
+	health      map[string]*tokenHealth // 各token近期请求的健康统计
+	now         func() time.Time        // 时钟（可在测试中替换）
+	random      func() float64          // [0,1)随机数源（可在测试中替换）
+
+	cluster    *ClusterState               // 多副本共享状态（CLUSTER_REDIS_URL），nil表示只使用本地状态
+	configIDs  map[string]string           // cache key -> ConfigID，共享状态和对账统计按ConfigID存储
+	shared     map[string]SharedTokenState // 最近一次读取的共享状态（按ConfigID），选择token时使用
+	accounting *accountingLedger           // 按账号累计的估算token与额度消耗（对账用）
+
+	hardTTL      time.Duration                                      // 用量数据硬TTL（USAGE_HARD_TTL）
+	errorPenalty time.Duration                                      // 出错后短暂禁选的时长（TOKEN_ERROR_PENALTY），0表示不启用
+	staleWait    time.Duration                                      // 仅剩硬过期token时等待刷新的最长时间
+	banRecheck   time.Duration                                      // 封禁账号重新检查的间隔（BAN_RECHECK_INTERVAL）
+	failOpen     bool                                               // 用量检查因上游不可达失败时乐观使用（USAGE_CHECK_FAILURE_MODE=open）
+	failOpenTTL  time.Duration                                      // fail-open时乐观使用的时长（USAGE_CHECK_FAIL_OPEN_TTL）
+	refreshing   chan struct{}                                      // 进行中的后台刷新，完成时关闭；nil表示空闲
+	generation   uint64                                             // 配置重新加载的次数，用于丢弃按旧配置进行的刷新结果
+	loadTokens   func(configs []AuthConfig) map[string]*CachedToken // 刷新并检查用量（可在测试中替换）
 }
 
 // SimpleTokenCache 简化的token缓存（纯数据结构，无锁）
@@ -31,9 +51,12 @@ type SimpleTokenCache struct {
 type CachedToken struct {
 	Token     types.TokenInfo
 	UsageInfo *types.UsageLimits
-	CachedAt  time.Time
+	CachedAt  time.Time // 刷新并检查用量的时间，用于判断用量数据是否过期
 	LastUsed  time.Time
 	Available float64
+
+	// OptimisticUntil fail-open：用量检查因上游不可达失败、乐观使用的截止时间，零值表示用量已确认
+	OptimisticUntil time.Time
 }
 
 // NewSimpleTokenCache 创建简单的token缓存
@@ -49,69 +72,111 @@ func NewTokenManager(configs []AuthConfig) *TokenManager {
 	// 生成配置顺序
 	configOrder := generateConfigOrder(configs)
 
-	logger.Info("TokenManager初始化（顺序选择策略）",
+	logger.Info("TokenManager初始化（健康评分选择策略）",
 		logger.Int("config_count", len(configs)),
 		logger.Int("config_order_count", len(configOrder)))
 
-	return &TokenManager{
+	tm := &TokenManager{
 		cache:        NewSimpleTokenCache(config.TokenCacheTTL),
 		configs:      configs,
 		configOrder:  configOrder,
-		currentIndex: 0,
+		schedules:    configSchedules(configs),
+		configIDs:    configIDsByKey(configs),
+		accounting:   newAccountingLedger(),
 		exhausted:    make(map[string]bool),
+		health:       make(map[string]*tokenHealth),
+		now:          time.Now,
+		random:       rand.Float64,
+		hardTTL:      UsageHardTTL(),
+		errorPenalty: config.TokenErrorPenalty,
+		staleWait:    config.UsageHardStaleWait,
+		banRecheck:   BanRecheckInterval(),
+		failOpen:     UsageCheckFailureMode() == UsageCheckFailOpen,
+		failOpenTTL:  UsageCheckFailOpenTTL(),
 	}
+	tm.loadTokens = tm.fetchTokens
+	return tm
 }
 
 // getBestToken 获取最优可用token
-// 统一锁管理：所有操作在单一锁保护下完成，避免多次加锁/解锁
 func (tm *TokenManager) getBestToken() (types.TokenInfo, error) {
-	tm.mutex.Lock()
-	defer tm.mutex.Unlock()
-
-	// 检查是否需要刷新缓存（在锁内）
-	if time.Since(tm.lastRefresh) > config.TokenCacheTTL {
-		if err := tm.refreshCacheUnlocked(); err != nil {
-			logger.Warn("刷新token缓存失败", logger.Err(err))
-		}
+	tokenWithUsage, err := tm.GetBestTokenWithUsage()
+	if err != nil {
+		return types.TokenInfo{}, err
 	}
+	return tokenWithUsage.TokenInfo, nil
+}
 
-	// 选择最优token（内部方法，不加锁）
-	bestToken := tm.selectBestTokenUnlocked()
-	if bestToken == nil {
-		return types.TokenInfo{}, fmt.Errorf("没有可用的token")
+// GetBestTokenWithUsage 获取最优可用token（包含使用信息）
+func (tm *TokenManager) GetBestTokenWithUsage() (*types.TokenWithUsage, error) {
+	return tm.GetBestTokenWithStrategy(SelectionStrategyHealth)
+}
+
+// GetBestTokenWithStrategy 按指定的选择策略获取可用token（包含使用信息），strategy为空时使用默认策略
+// 启用共享状态时，在加锁前读取其他副本的状态，选中后再记录本次选择，Redis访问不阻塞其他请求
+func (tm *TokenManager) GetBestTokenWithStrategy(strategy string) (*types.TokenWithUsage, error) {
+	shared := tm.cluster.Snapshot(tm.clusterIDList())
+
+	tokenWithUsage, id, err := tm.reserveBestToken(shared, strategy, "")
+	if err != nil {
+		return nil, err
 	}
+	tm.cluster.Acquire(id)
+	return tokenWithUsage, nil
+}
 
-	// 更新最后使用时间（在锁内，安全）
-	bestToken.LastUsed = time.Now()
-	if bestToken.Available > 0 {
-		bestToken.Available--
+// GetBestTokenExcluding 按默认策略获取可用token，excludeAccessToken（通常是刚用过的token）只在没有其他可选token时使用
+func (tm *TokenManager) GetBestTokenExcluding(excludeAccessToken string) (*types.TokenWithUsage, error) {
+	shared := tm.cluster.Snapshot(tm.clusterIDList())
+
+	tokenWithUsage, id, err := tm.reserveBestToken(shared, SelectionStrategyHealth, excludeAccessToken)
+	if err != nil {
+		return nil, err
 	}
+	tm.cluster.Acquire(id)
+	return tokenWithUsage, nil
+}
 
+// PeekBestToken 按默认策略选择token，但不记录本次使用：不扣减可用次数、不更新最后使用时间、不计入共享进行中计数
+// 用于模型映射校验等管理操作，不占用客户端请求的额度预算
+func (tm *TokenManager) PeekBestToken() (types.TokenInfo, error) {
+	shared := tm.cluster.Snapshot(tm.clusterIDList())
+
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	tm.shared = shared
+	bestToken := tm.selectTokenForRequestUnlocked(SelectionStrategyHealth, "")
+	if bestToken == nil {
+		return types.TokenInfo{}, fmt.Errorf("没有可用的token")
+	}
 	return bestToken.Token, nil
 }
 
-// GetBestTokenWithUsage 获取最优可用token（包含使用信息）
+// reserveBestToken 选择最优token并扣减本地可用次数，返回token的ConfigID
+// ConfigID在同一把锁内读取，配置重新加载后cache key可能对应其他账号
+// excludeAccessToken非空时该token只在没有其他可选token时使用
 // 统一锁管理：所有操作在单一锁保护下完成
-func (tm *TokenManager) GetBestTokenWithUsage() (*types.TokenWithUsage, error) {
+func (tm *TokenManager) reserveBestToken(shared map[string]SharedTokenState, strategy, excludeAccessToken string) (*types.TokenWithUsage, string, error) {
 	tm.mutex.Lock()
 	defer tm.mutex.Unlock()
 
-	// 检查是否需要刷新缓存（在锁内）
-	if time.Since(tm.lastRefresh) > config.TokenCacheTTL {
-		if err := tm.refreshCacheUnlocked(); err != nil {
-			logger.Warn("刷新token缓存失败", logger.Err(err))
-		}
-	}
+	tm.shared = shared
 
-	// 选择最优token（内部方法，不加锁）
-	bestToken := tm.selectBestTokenUnlocked()
+	// 选择最优token（缓存过期时在后台刷新，内部方法，不加锁）
+	exclude := ""
+	if excludeAccessToken != "" {
+		exclude = tm.cacheKeyByAccessTokenUnlocked(excludeAccessToken)
+	}
+	bestToken := tm.selectTokenForRequestUnlocked(strategy, exclude)
 	if bestToken == nil {
-		return nil, fmt.Errorf("没有可用的token")
+		return nil, "", fmt.Errorf("没有可用的token")
 	}
+	key := tm.cacheKeyByAccessTokenUnlocked(bestToken.Token.AccessToken)
 
 	// 更新最后使用时间（在锁内，安全）
-	bestToken.LastUsed = time.Now()
-	available := bestToken.Available
+	bestToken.LastUsed = tm.now()
+	available := tm.availableUnlocked(key, bestToken)
 	if bestToken.Available > 0 {
 		bestToken.Available--
 	}
@@ -121,7 +186,7 @@ func (tm *TokenManager) GetBestTokenWithUsage() (*types.TokenWithUsage, error) {
 		TokenInfo:       bestToken.Token,
 		UsageLimits:     bestToken.UsageInfo,
 		AvailableCount:  available, // 使用精确计算的可用次数
-		LastUsageCheck:  bestToken.LastUsed,
+		LastUsageCheck:  bestToken.CachedAt,
 		IsUsageExceeded: available <= 0,
 	}
 
@@ -129,78 +194,179 @@ func (tm *TokenManager) GetBestTokenWithUsage() (*types.TokenWithUsage, error) {
 		logger.Float64("available_count", available),
 		logger.Bool("is_exceeded", tokenWithUsage.IsUsageExceeded))
 
-	return tokenWithUsage, nil
+	return tokenWithUsage, tm.configIDs[key], nil
 }
 
-// selectBestTokenUnlocked 按配置顺序选择下一个可用token
+// selectTokenForRequestUnlocked 请求热路径上的token选择
+// 首次使用时同步加载缓存；之后缓存超过TokenCacheTTL只在后台刷新，不阻塞请求。
+// 仅剩用量数据超过硬TTL的token时不信任其剩余额度，短暂等待后台刷新后重新选择
+// 内部方法：调用者必须持有 tm.mutex（等待刷新期间会临时释放）
+func (tm *TokenManager) selectTokenForRequestUnlocked(strategy, exclude string) *CachedToken {
+	if tm.lastRefresh.IsZero() {
+		if err := tm.refreshCacheUnlocked(); err != nil {
+			logger.Warn("刷新token缓存失败", logger.Err(err))
+		}
+	} else if tm.now().Sub(tm.lastRefresh) > config.TokenCacheTTL {
+		tm.triggerRefreshUnlocked()
+	}
+
+	bestToken, hardStale := tm.selectBestTokenUnlocked(strategy, exclude)
+	if bestToken != nil || hardStale == 0 {
+		return bestToken
+	}
+
+	logger.Warn("可用token的用量数据均已超过硬TTL，等待刷新",
+		logger.Int("hard_stale_count", hardStale),
+		logger.Duration("hard_ttl", tm.hardTTL))
+	tm.waitForRefreshUnlocked(tm.triggerRefreshUnlocked())
+	bestToken, _ = tm.selectBestTokenUnlocked(strategy, exclude)
+	return bestToken
+}
+
+// selectBestTokenUnlocked 按选择策略选择可用token，同时返回因用量数据超过硬TTL而跳过的token数
+// 默认策略以健康评分的平方为权重随机选择：高分token明显更优先，但不会让所有请求同时涌向同一个token；
+// 用量数据超过TokenCacheTTL的token降权，并触发后台刷新；exclude（cache key）与禁选期token一样只作后备
 // 内部方法：调用者必须持有 tm.mutex
-// 重构说明：从selectBestToken改为Unlocked后缀，明确锁约定
-func (tm *TokenManager) selectBestTokenUnlocked() *CachedToken {
+func (tm *TokenManager) selectBestTokenUnlocked(strategy, exclude string) (*CachedToken, int) {
 	// 调用者已持有 tm.mutex，无需额外加锁
 
 	// 如果没有配置顺序，降级到按map遍历顺序
-	if len(tm.configOrder) == 0 {
-		for key, cached := range tm.cache.tokens {
-			if time.Since(cached.CachedAt) <= tm.cache.ttl && cached.IsUsable() {
-				logger.Debug("顺序策略选择token（无顺序配置）",
-					logger.String("selected_key", key),
-					logger.Float64("available_count", cached.Available))
-				return cached
-			}
+	keys := tm.configOrder
+	if len(keys) == 0 {
+		for key := range tm.cache.tokens {
+			keys = append(keys, key)
 		}
-		return nil
 	}
 
-	// 从当前索引开始，找到第一个可用的token
-	for attempts := 0; attempts < len(tm.configOrder); attempts++ {
-		currentKey := tm.configOrder[tm.currentIndex]
-
-		// 检查这个token是否存在且可用
-		if cached, exists := tm.cache.tokens[currentKey]; exists {
-			// 检查token是否过期
-			if time.Since(cached.CachedAt) > tm.cache.ttl {
-				tm.exhausted[currentKey] = true
-				tm.currentIndex = (tm.currentIndex + 1) % len(tm.configOrder)
-				continue
-			}
+	var candidates []string
+	var weights []float64
+	totalWeight := 0.0
+	hardStale, softStale, scheduledOff := 0, 0, 0
+
+	// 处于出错禁选期的token单独收集，只在没有其他可选token时使用
+	var benched []string
+	var benchedWeights []float64
+	benchedWeight := 0.0
+	now := tm.now()
+	for _, key := range keys {
+		cached, exists := tm.cache.tokens[key]
+		if !exists || !cached.IsUsable() {
+			tm.exhausted[key] = true
+			continue
+		}
 
-			// 检查token是否可用
-			if cached.IsUsable() {
-				logger.Debug("顺序策略选择token",
-					logger.String("selected_key", currentKey),
-					logger.Int("index", tm.currentIndex),
-					logger.Float64("available_count", cached.Available))
-				return cached
-			}
+		// 计划停用时段内不参与选择（后台刷新照常进行）
+		if off, _ := tm.schedules[key].Off(now); off {
+			scheduledOff++
+			continue
+		}
+
+		staleness, _ := tm.usageStalenessUnlocked(cached)
+		if staleness == UsageHardStale {
+			hardStale++
+			continue
 		}
+		delete(tm.exhausted, key)
 
-		// 标记当前token为已耗尽，移动到下一个
-		tm.exhausted[currentKey] = true
-		tm.currentIndex = (tm.currentIndex + 1) % len(tm.configOrder)
+		score := tm.scoreUnlocked(key, cached)
+		weight := math.Max(score*score, config.TokenHealthMinWeight)
+		if staleness == UsageSoftStale {
+			weight *= config.TokenUsageStaleWeight
+			softStale++
+		}
+		// 其他副本上进行中的请求越多权重越低；剩余次数已被各副本用完的token与禁选期token一样只作后备
+		weight /= float64(1 + tm.sharedInFlightUnlocked(key))
+		if key == exclude || tm.benchedUnlocked(key, now) || tm.sharedSaturatedUnlocked(key, cached) {
+			benched = append(benched, key)
+			benchedWeights = append(benchedWeights, weight)
+			benchedWeight += weight
+			continue
+		}
+		candidates = append(candidates, key)
+		weights = append(weights, weight)
+		totalWeight += weight
+	}
 
-		logger.Debug("token不可用，切换到下一个",
-			logger.String("exhausted_key", currentKey),
-			logger.Int("next_index", tm.currentIndex))
+	if hardStale > 0 || softStale > 0 {
+		tm.triggerRefreshUnlocked()
 	}
 
-	// 所有token都不可用
-	logger.Warn("所有token都不可用",
-		logger.Int("total_count", len(tm.configOrder)),
-		logger.Int("exhausted_count", len(tm.exhausted)))
+	if len(candidates) == 0 && len(benched) > 0 {
+		// 所有可用token都在禁选期，禁选只是平滑手段，不应导致请求失败
+		logger.Debug("可用token均处于出错禁选期，忽略禁选",
+			logger.Int("benched_count", len(benched)))
+		candidates, weights, totalWeight = benched, benchedWeights, benchedWeight
+	}
 
-	return nil
+	if len(candidates) == 0 {
+		// 所有token都不可用
+		logger.Warn("所有token都不可用",
+			logger.Int("total_count", len(keys)),
+			logger.Int("exhausted_count", len(tm.exhausted)),
+			logger.Int("hard_stale_count", hardStale),
+			logger.Int("scheduled_off_count", scheduledOff))
+		return nil, hardStale
+	}
+
+	selected := candidates[len(candidates)-1]
+	if strategy == SelectionStrategyLeastUsed {
+		selected = tm.leastUsedUnlocked(candidates)
+	} else {
+		target := tm.random() * totalWeight
+		for i, key := range candidates {
+			if target < weights[i] {
+				selected = key
+				break
+			}
+			target -= weights[i]
+		}
+	}
+
+	cached := tm.cache.tokens[selected]
+	logger.Debug("选择token",
+		logger.String("strategy", strategy),
+		logger.String("selected_key", selected),
+		logger.Float64("score", tm.scoreUnlocked(selected, cached)),
+		logger.Int("candidates", len(candidates)),
+		logger.Float64("available_count", cached.Available))
+	return cached, hardStale
 }
 
-// refreshCacheUnlocked 刷新token缓存
+// refreshCacheUnlocked 同步刷新token缓存（首次加载时使用）
 // 内部方法：调用者必须持有 tm.mutex
 func (tm *TokenManager) refreshCacheUnlocked() error {
+	tm.applyTokensUnlocked(tm.loadTokens(tm.configs))
+	return nil
+}
+
+// applyTokensUnlocked 写入刷新结果；刷新失败的token保留旧缓存，其用量数据会随时间过期
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) applyTokensUnlocked(entries map[string]*CachedToken) {
+	for key, cached := range entries {
+		tm.cache.tokens[key] = cached
+	}
+	tm.lastRefresh = tm.now()
+}
+
+// fetchTokens 刷新所有启用的token并检查用量，不访问TokenManager的共享状态（无需持锁）
+func (tm *TokenManager) fetchTokens(configs []AuthConfig) map[string]*CachedToken {
 	logger.Debug("开始刷新token缓存")
 
-	for i, cfg := range tm.configs {
+	entries := make(map[string]*CachedToken, len(configs))
+	for i, cfg := range configs {
 		if cfg.Disabled {
 			continue
 		}
 
+		// 已封禁的账号在重新检查间隔内不刷新、不参与选择（封禁状态可跨重启保留）
+		if record, banned := banStore.Get(ConfigID(cfg)); banned && !banRecheckDue(record, tm.now(), tm.banRecheck) {
+			logger.Debug("跳过已封禁的账号",
+				logger.Int("config_index", i),
+				logger.String("reason", record.Reason),
+				logger.String("detected_at", record.DetectedAt.Format(time.RFC3339)))
+			continue
+		}
+
 		// 刷新token
 		token, err := tm.refreshSingleToken(cfg)
 		if err != nil {
@@ -210,41 +376,55 @@ func (tm *TokenManager) refreshCacheUnlocked() error {
 				logger.Err(err))
 			continue
 		}
+		if cfg.ProfileArn != "" {
+			token.ProfileArn = cfg.ProfileArn // 配置中指定的ARN优先于刷新响应返回的ARN
+		}
 
 		// 检查使用限制
 		var usageInfo *types.UsageLimits
 		var available float64
-
-		checker := NewUsageLimitsChecker()
-		if usage, checkErr := checker.CheckUsageLimits(token); checkErr == nil {
-			usageInfo = usage
-			available = CalculateAvailableCount(usage)
+		var optimisticUntil time.Time
+
+		result := NewUsageLimitsChecker().CheckUsageLimitsWithStatus(token)
+		if result.Error == nil {
+			usageInfo = result.UsageLimits
+			available = CalculateAvailableCount(usageInfo)
+		} else if optimisticUntil = tm.failOpenUntil(result); !optimisticUntil.IsZero() {
+			// fail-open：上游不可达时在短时间内按少量剩余次数乐观使用
+			available = config.UsageCheckFailOpenAvailable
+			logger.Warn("检查使用限制失败，暂时乐观使用",
+				logger.Int("config_index", i),
+				logger.Int("status_code", result.StatusCode),
+				logger.String("until", optimisticUntil.Format(time.RFC3339)),
+				logger.Err(result.Error))
 		} else {
-			logger.Warn("检查使用限制失败", logger.Err(checkErr))
+			logger.Warn("检查使用限制失败", logger.Err(result.Error))
 		}
 
-		// 更新缓存（直接访问，已在tm.mutex保护下）
 		cacheKey := fmt.Sprintf(config.TokenCacheKeyFormat, i)
-		tm.cache.tokens[cacheKey] = &CachedToken{
-			Token:     token,
-			UsageInfo: usageInfo,
-			CachedAt:  time.Now(),
-			Available: available,
+		entries[cacheKey] = &CachedToken{
+			Token:           token,
+			UsageInfo:       usageInfo,
+			CachedAt:        tm.now(),
+			Available:       available,
+			OptimisticUntil: optimisticUntil,
+		}
+		if usageInfo != nil {
+			tm.cluster.PublishUsage(ConfigID(cfg), available, entries[cacheKey].CachedAt)
+			tm.accounting.observeUsage(entries[cacheKey].CachedAt, ConfigID(cfg), UsedCredits(usageInfo))
 		}
 
 		logger.Debug("token缓存更新",
 			logger.String("cache_key", cacheKey),
 			logger.Float64("available", available))
 	}
-
-	tm.lastRefresh = time.Now()
-	return nil
+	return entries
 }
 
 // IsUsable 检查缓存的token是否可用
 func (ct *CachedToken) IsUsable() bool {
-	// 检查token是否过期
-	if time.Now().After(ct.Token.ExpiresAt) {
+	// 检查token是否过期（含EXPIRY_SKEW提前量）
+	if ct.Token.IsExpired() {
 		return false
 	}
 
@@ -282,6 +462,17 @@ func CalculateAvailableCount(usage *types.UsageLimits) float64 {
 	return 0.0
 }
 
+// configSchedules 收集设置了计划停用时段的配置，key与generateConfigOrder一致
+func configSchedules(configs []AuthConfig) map[string]Schedule {
+	schedules := make(map[string]Schedule)
+	for i, cfg := range configs {
+		if len(cfg.Schedule) > 0 {
+			schedules[fmt.Sprintf(config.TokenCacheKeyFormat, i)] = cfg.Schedule
+		}
+	}
+	return schedules
+}
+
 // generateConfigOrder 生成token配置的顺序
 func generateConfigOrder(configs []AuthConfig) []string {
 	var order []string
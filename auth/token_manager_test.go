@@ -188,7 +188,7 @@ func TestTokenManager_RaceCondition(t *testing.T) {
 	t.Log("Race condition测试完成，使用 go test -race 运行以检测数据竞争")
 }
 
-// TestTokenManager_SequentialSelection 测试顺序选择逻辑（粘性策略）
+// TestTokenManager_SequentialSelection 测试额度用尽的token不再被选择，所有额度最终都被用完
 func TestTokenManager_SequentialSelection(t *testing.T) {
 	configs := []AuthConfig{
 		{AuthType: AuthMethodSocial, RefreshToken: "token1"},
@@ -214,7 +214,7 @@ func TestTokenManager_SequentialSelection(t *testing.T) {
 	tm.lastRefresh = time.Now()
 	tm.mutex.Unlock()
 
-	// 验证顺序选择：使用getBestToken会递减Available
+	// 使用getBestToken会递减Available
 	selectedTokens := make(map[string]int)
 	for i := 0; i < 15; i++ { // 15次调用会用完所有token (5+5+5)
 		token, err := tm.getBestToken()
@@ -225,7 +225,7 @@ func TestTokenManager_SequentialSelection(t *testing.T) {
 
 	t.Logf("Token选择分布: %v", selectedTokens)
 
-	// 验证粘性策略：应该先用完第一个token，然后是第二个，最后是第三个
+	// 每个token都应恰好用完自己的5次额度
 	if selectedTokens["access_0"] != 5 {
 		t.Errorf("期望access_0使用5次，实际使用%d次", selectedTokens["access_0"])
 	}
@@ -241,5 +241,5 @@ func TestTokenManager_SequentialSelection(t *testing.T) {
 		t.Errorf("期望使用 %d 个token，实际使用 %d 个", len(configs), len(selectedTokens))
 	}
 
-	t.Logf("✅ 顺序选择策略验证通过：粘性策略正确工作")
+	t.Logf("✅ 选择策略验证通过：额度用尽的token被正确跳过")
 }
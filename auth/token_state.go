@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+// CachedTokenState 配置在token管理器中的缓存状态，由后台刷新写入
+type CachedTokenState struct {
+	Token    types.TokenInfo
+	Usage    *UsageCheckResult
+	CachedAt time.Time // 刷新并检查用量的时间；封禁记录为检测到封禁的时间
+}
+
+// CachedState 返回配置最近一次后台刷新得到的token和用量，不刷新token、不检查用量
+// 可用次数为本地扣减后的值；封禁期内不刷新的账号返回封禁记录；尚未刷新成功的配置返回false
+func (tm *TokenManager) CachedState(cfg AuthConfig) (CachedTokenState, bool) {
+	id := ConfigID(cfg)
+
+	tm.mutex.RLock()
+	var cached *CachedToken
+	for i, candidate := range tm.configs {
+		if ConfigID(candidate) == id {
+			cached = tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, i)]
+			break
+		}
+	}
+	var state CachedTokenState
+	if cached != nil {
+		state = CachedTokenState{Token: cached.Token, CachedAt: cached.CachedAt, Usage: cachedUsageResult(cached)}
+	}
+	tm.mutex.RUnlock()
+
+	if cached != nil {
+		return state, true
+	}
+	if record, banned := banStore.Get(id); banned {
+		return CachedTokenState{
+			Token:    types.TokenInfo{RefreshToken: cfg.RefreshToken},
+			Usage:    &UsageCheckResult{Status: types.AccountStatusBanned, BanReason: record.Reason},
+			CachedAt: record.DetectedAt,
+		}, true
+	}
+	return CachedTokenState{}, false
+}
+
+// cachedUsageResult 按缓存的用量数据构造检查结果；用量检查失败时返回error状态
+func cachedUsageResult(cached *CachedToken) *UsageCheckResult {
+	if cached.UsageInfo == nil {
+		result := &UsageCheckResult{Status: types.AccountStatusError, Available: cached.Available, Error: fmt.Errorf("用量检查失败，暂无用量数据")}
+		if !cached.OptimisticUntil.IsZero() {
+			result.Error = fmt.Errorf("用量检查失败，乐观使用至 %s", cached.OptimisticUntil.Format(time.RFC3339))
+		}
+		return result
+	}
+	result := &UsageCheckResult{UsageLimits: cached.UsageInfo, Available: cached.Available, Status: types.AccountStatusExhausted}
+	result.TotalLimit, result.TotalUsed = usageTotals(cached.UsageInfo)
+	if cached.Available > 0 {
+		result.Status = types.AccountStatusActive
+	}
+	return result
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenManager_CachedState(t *testing.T) {
+	store := withBanStore(t, NewBanStore(""))
+	tm, _ := newHealthTestManager(3)
+	tm.cache.tokens["token_0"].UsageInfo = &types.UsageLimits{UsageBreakdownList: []types.UsageBreakdown{
+		{ResourceType: "CREDIT", UsageLimitWithPrecision: 50, CurrentUsageWithPrecision: 20},
+	}}
+	tm.cache.tokens["token_0"].Available = 25 // 本地已扣减
+	delete(tm.cache.tokens, fmt.Sprintf(config.TokenCacheKeyFormat, 2))
+
+	state, exists := tm.CachedState(tm.configs[0])
+	require.True(t, exists)
+	assert.Equal(t, "access_0", state.Token.AccessToken)
+	assert.Equal(t, types.AccountStatusActive, state.Usage.Status)
+	assert.Equal(t, float64(25), state.Usage.Available)
+	assert.Equal(t, float64(50), state.Usage.TotalLimit)
+	assert.Equal(t, float64(20), state.Usage.TotalUsed)
+
+	// 用量检查失败的token没有用量数据
+	state, exists = tm.CachedState(tm.configs[1])
+	require.True(t, exists)
+	assert.Equal(t, types.AccountStatusError, state.Usage.Status)
+	assert.Error(t, state.Usage.Error)
+
+	// 尚未刷新成功的配置
+	_, exists = tm.CachedState(tm.configs[2])
+	assert.False(t, exists)
+
+	// 封禁期内不刷新的配置返回封禁记录
+	detectedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	store.Record(ConfigID(tm.configs[2]), "TEMPORARILY_SUSPENDED", detectedAt)
+	state, exists = tm.CachedState(tm.configs[2])
+	require.True(t, exists)
+	assert.Equal(t, types.AccountStatusBanned, state.Usage.Status)
+	assert.Equal(t, "TEMPORARILY_SUSPENDED", state.Usage.BanReason)
+	assert.Equal(t, detectedAt, state.CachedAt)
+}
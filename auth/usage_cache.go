@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+)
+
+// UsageCacheTTL 读取 USAGE_CACHE_TTL（Go duration格式，如 30s，0表示不复用结果），无效或未设置时使用默认值
+func UsageCacheTTL() time.Duration {
+	value := strings.TrimSpace(os.Getenv("USAGE_CACHE_TTL"))
+	if value == "" {
+		return config.UsageCacheTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		logger.Warn("USAGE_CACHE_TTL无效，使用默认值",
+			logger.String("value", value),
+			logger.Duration("default", config.UsageCacheTTL))
+		return config.UsageCacheTTL
+	}
+	return ttl
+}
+
+// UsageCache 按token缓存用量检查结果，并合并同一token的并发检查
+// 选择、导入、探测等路径可能在几秒内各自检查同一个token，缓存让它们共享一次上游调用
+// 只缓存上游给出明确结论的结果（含封禁），网络错误和5xx不缓存
+type UsageCache struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	entries  map[string]usageCacheEntry
+	inflight map[string]*usageCall
+	hits     int64 // 命中缓存或共享进行中的检查
+	misses   int64 // 发起了上游调用
+	now      func() time.Time
+}
+
+type usageCacheEntry struct {
+	result   *UsageCheckResult
+	cachedAt time.Time
+}
+
+// usageCall 进行中的上游检查，done关闭后result可读
+type usageCall struct {
+	done   chan struct{}
+	result *UsageCheckResult
+}
+
+// UsageCacheStats 用量缓存统计（/api/stats）
+type UsageCacheStats struct {
+	TTLSeconds float64 `json:"ttl_seconds"`
+	Entries    int     `json:"entries"`
+	Hits       int64   `json:"hits"`
+	Misses     int64   `json:"misses"`
+}
+
+// usageCache 全局用量缓存（测试可替换）
+var usageCache = NewUsageCache(config.UsageCacheTTL)
+
+// NewUsageCache 创建用量缓存，ttl<=0时不复用已完成的结果，只合并并发检查
+func NewUsageCache(ttl time.Duration) *UsageCache {
+	return &UsageCache{
+		ttl:      ttl,
+		entries:  make(map[string]usageCacheEntry),
+		inflight: make(map[string]*usageCall),
+		now:      time.Now,
+	}
+}
+
+// SetTTL 调整结果的复用时长
+func (c *UsageCache) SetTTL(ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ttl = ttl
+}
+
+// Do 返回token的用量检查结果：未过期的缓存直接返回，同一token进行中的检查被共享，否则调用check
+// force为true时忽略缓存的结果（仍会共享进行中的检查，其结果不早于本次调用）
+func (c *UsageCache) Do(token types.TokenInfo, force bool, check func() *UsageCheckResult) *UsageCheckResult {
+	key := usageCacheKey(token)
+
+	c.mutex.Lock()
+	if entry, exists := c.entries[key]; exists {
+		if !force && c.now().Sub(entry.cachedAt) < c.ttl {
+			c.hits++
+			c.mutex.Unlock()
+			return entry.result
+		}
+		if c.now().Sub(entry.cachedAt) >= c.ttl {
+			delete(c.entries, key)
+		}
+	}
+	if call, exists := c.inflight[key]; exists {
+		c.hits++
+		c.mutex.Unlock()
+		<-call.done
+		return call.result
+	}
+	call := &usageCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.misses++
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.inflight, key)
+		if call.result != nil && call.result.Status != types.AccountStatusError && c.ttl > 0 {
+			c.entries[key] = usageCacheEntry{result: call.result, cachedAt: c.now()}
+		}
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+	call.result = check()
+	return call.result
+}
+
+// Stats 返回缓存统计
+func (c *UsageCache) Stats() UsageCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return UsageCacheStats{
+		TTLSeconds: c.ttl.Seconds(),
+		Entries:    len(c.entries),
+		Hits:       c.hits,
+		Misses:     c.misses,
+	}
+}
+
+// WritePrometheus 以Prometheus文本格式输出统计
+func (c *UsageCache) WritePrometheus(b *strings.Builder) {
+	stats := c.Stats()
+	b.WriteString("# HELP kiro2api_usage_cache_lookups_total Usage-check lookups served from cache (hit) or upstream (miss).\n")
+	b.WriteString("# TYPE kiro2api_usage_cache_lookups_total counter\n")
+	fmt.Fprintf(b, "kiro2api_usage_cache_lookups_total{result=\"hit\"} %d\n", stats.Hits)
+	fmt.Fprintf(b, "kiro2api_usage_cache_lookups_total{result=\"miss\"} %d\n", stats.Misses)
+}
+
+// usageCacheKey 同一账号刷新后access token会变化，优先按refresh token归并
+func usageCacheKey(token types.TokenInfo) string {
+	if token.RefreshToken != "" {
+		return refreshTokenID(token.RefreshToken)
+	}
+	return "access:" + refreshTokenID(token.AccessToken)
+}
+
+// SharedUsageCache 返回全局用量缓存
+func SharedUsageCache() *UsageCache {
+	return usageCache
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withUsageCache 替换全局用量缓存，测试结束后恢复
+func withUsageCache(t *testing.T, cache *UsageCache) *UsageCache {
+	t.Helper()
+	original := usageCache
+	usageCache = cache
+	t.Cleanup(func() { usageCache = original })
+	return cache
+}
+
+// newCountingUsageUpstream 返回固定用量的假上游，release关闭前阻塞所有请求
+func newCountingUsageUpstream(t *testing.T, release <-chan struct{}) *atomic.Int64 {
+	t.Helper()
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if release != nil {
+			<-release
+		}
+		_, _ = w.Write([]byte(`{"usageBreakdownList": [{"resourceType": "CREDIT", "usageLimitWithPrecision": 50, "currentUsageWithPrecision": 20}]}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	t.Setenv("USAGE_FALLBACK_REGIONS", "")
+	return &calls
+}
+
+func TestUsageCache_ConcurrentChecksShareOneCall(t *testing.T) {
+	cache := withUsageCache(t, NewUsageCache(time.Minute))
+	release := make(chan struct{})
+	calls := newCountingUsageUpstream(t, release)
+	token := types.TokenInfo{AccessToken: "access", RefreshToken: "refresh"}
+
+	const callers = 20
+	var wg sync.WaitGroup
+	results := make([]*UsageCheckResult, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = NewUsageLimitsChecker().CheckUsageLimitsWithStatus(token)
+		}()
+	}
+	// 等所有调用者都在等待同一个上游调用后再放行
+	require.Eventually(t, func() bool {
+		stats := cache.Stats()
+		return stats.Hits+stats.Misses == callers
+	}, 2*time.Second, 5*time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), calls.Load())
+	for _, result := range results {
+		require.NoError(t, result.Error)
+		assert.Equal(t, 30.0, result.Available)
+	}
+	stats := cache.Stats()
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(callers-1), stats.Hits)
+
+	// TTL内的后续检查直接命中缓存
+	NewUsageLimitsChecker().CheckUsageLimitsWithStatus(token)
+	assert.Equal(t, int64(1), calls.Load())
+}
+
+func TestUsageCache_ForceBypassesCache(t *testing.T) {
+	cache := withUsageCache(t, NewUsageCache(time.Minute))
+	calls := newCountingUsageUpstream(t, nil)
+	token := types.TokenInfo{AccessToken: "access", RefreshToken: "refresh"}
+	checker := NewUsageLimitsChecker()
+
+	checker.CheckUsageLimitsWithStatus(token)
+	checker.ForceCheckUsageLimitsWithStatus(token)
+	assert.Equal(t, int64(2), calls.Load())
+
+	// 强制检查的结果写回缓存
+	checker.CheckUsageLimitsWithStatus(token)
+	assert.Equal(t, int64(2), calls.Load())
+	assert.Equal(t, int64(1), cache.Stats().Hits)
+}
+
+func TestUsageCache_ExpiresAfterTTL(t *testing.T) {
+	cache := withUsageCache(t, NewUsageCache(30*time.Second))
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	calls := newCountingUsageUpstream(t, nil)
+
+	// 同一账号刷新后access token变化，仍按refresh token命中
+	NewUsageLimitsChecker().CheckUsageLimitsWithStatus(types.TokenInfo{AccessToken: "a1", RefreshToken: "refresh"})
+	NewUsageLimitsChecker().CheckUsageLimitsWithStatus(types.TokenInfo{AccessToken: "a2", RefreshToken: "refresh"})
+	assert.Equal(t, int64(1), calls.Load())
+
+	now = now.Add(31 * time.Second)
+	NewUsageLimitsChecker().CheckUsageLimitsWithStatus(types.TokenInfo{AccessToken: "a2", RefreshToken: "refresh"})
+	assert.Equal(t, int64(2), calls.Load())
+}
+
+func TestUsageCache_DoesNotCacheErrors(t *testing.T) {
+	withUsageCache(t, NewUsageCache(time.Minute))
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	t.Setenv("USAGE_FALLBACK_REGIONS", "")
+
+	token := types.TokenInfo{AccessToken: "x"}
+	for range 2 {
+		result := NewUsageLimitsChecker().CheckUsageLimitsWithStatus(token)
+		assert.Equal(t, types.AccountStatusError, result.Status)
+	}
+	assert.Equal(t, int64(2), calls.Load())
+}
+
+func TestUsageCache_WritePrometheus(t *testing.T) {
+	cache := NewUsageCache(time.Minute)
+	check := func() *UsageCheckResult { return &UsageCheckResult{Status: types.AccountStatusActive} }
+	cache.Do(types.TokenInfo{RefreshToken: "r"}, false, check)
+	cache.Do(types.TokenInfo{RefreshToken: "r"}, false, check)
+
+	var b strings.Builder
+	cache.WritePrometheus(&b)
+	assert.Contains(t, b.String(), `kiro2api_usage_cache_lookups_total{result="hit"} 1`)
+	assert.Contains(t, b.String(), `kiro2api_usage_cache_lookups_total{result="miss"} 1`)
+}
+
+func TestUsageCacheTTL(t *testing.T) {
+	t.Setenv("USAGE_CACHE_TTL", "")
+	assert.Equal(t, 30*time.Second, UsageCacheTTL())
+
+	t.Setenv("USAGE_CACHE_TTL", "5s")
+	assert.Equal(t, 5*time.Second, UsageCacheTTL())
+
+	t.Setenv("USAGE_CACHE_TTL", "0")
+	assert.Equal(t, time.Duration(0), UsageCacheTTL())
+
+	t.Setenv("USAGE_CACHE_TTL", "bogus")
+	assert.Equal(t, 30*time.Second, UsageCacheTTL())
+}
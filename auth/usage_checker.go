@@ -3,6 +3,7 @@ package auth
 import (
 	"fmt"
 	"io"
+	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/types"
 	"kiro2api/utils"
@@ -21,6 +22,7 @@ type UsageCheckResult struct {
 	TotalLimit  float64 // 总配额
 	TotalUsed   float64 // 已使用
 	Error       error   // 错误信息
+	StatusCode  int     // 上游HTTP状态码，请求未得到响应时为0
 }
 
 // UsageLimitsChecker 使用限制检查器 (遵循SRP原则)
@@ -36,53 +38,43 @@ func NewUsageLimitsChecker() *UsageLimitsChecker {
 }
 
 // CheckUsageLimitsWithStatus 检查token的使用限制并返回详细状态
+// 结果经usageCache复用：USAGE_CACHE_TTL内的重复检查和并发检查只发起一次上游调用，耗时计入认证统计
 func (c *UsageLimitsChecker) CheckUsageLimitsWithStatus(token types.TokenInfo) *UsageCheckResult {
-	result := &UsageCheckResult{
-		Status: types.AccountStatusError,
-	}
-
-	// 构建请求URL
-	baseURL := "https://codewhisperer.us-east-1.amazonaws.com/getUsageLimits"
-	params := url.Values{}
-	params.Add("isEmailRequired", "true")
-	params.Add("origin", "AI_EDITOR")
-	params.Add("resourceType", "AGENTIC_REQUEST")
+	return c.checkCached(token, false)
+}
 
-	requestURL := fmt.Sprintf("%s?%s", baseURL, params.Encode())
+// ForceCheckUsageLimitsWithStatus 忽略缓存的结果重新检查（如显式的刷新请求），新结果写回缓存
+func (c *UsageLimitsChecker) ForceCheckUsageLimitsWithStatus(token types.TokenInfo) *UsageCheckResult {
+	return c.checkCached(token, true)
+}
 
-	// 创建HTTP请求
-	req, err := http.NewRequest("GET", requestURL, nil)
-	if err != nil {
-		result.Error = fmt.Errorf("创建请求失败: %v", err)
+func (c *UsageLimitsChecker) checkCached(token types.TokenInfo, force bool) *UsageCheckResult {
+	return usageCache.Do(token, force, func() *UsageCheckResult {
+		startedAt := time.Now()
+		result := c.checkUsageLimitsWithStatus(token)
+		authMetrics.ObserveUsageCheck(refreshTokenID(token.RefreshToken), time.Since(startedAt))
+		banStore.observeUsageResult(token, result)
+		tokenErrorStore.observeUsageResult(token, result)
 		return result
-	}
-
-	// 设置请求头
-	req.Header.Set("x-amz-user-agent", "aws-sdk-js/1.0.0 KiroIDE-0.6.18-66c23a8c5d15afabec89ef9954ef52a119f10d369df04d548fc6c1eac694b0d1")
-	req.Header.Set("user-agent", "aws-sdk-js/1.0.0 ua/2.1 os/windows lang/js md/nodejs#20.16.0 api/codewhispererruntime#1.0.0 m/E KiroIDE-0.6.18-66c23a8c5d15afabec89ef9954ef52a119f10d369df04d548fc6c1eac694b0d1")
-	req.Header.Set("host", "codewhisperer.us-east-1.amazonaws.com")
-	req.Header.Set("amz-sdk-invocation-id", generateInvocationID())
-	req.Header.Set("amz-sdk-request", "attempt=1; max=1")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
-	req.Header.Set("Connection", "close")
+	})
+}
 
-	// 发送请求
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		result.Error = fmt.Errorf("请求失败: %v", err)
-		return result
+// checkUsageLimitsWithStatus 向上游查询使用限制
+func (c *UsageLimitsChecker) checkUsageLimitsWithStatus(token types.TokenInfo) *UsageCheckResult {
+	result := &UsageCheckResult{
+		Status: types.AccountStatusError,
 	}
-	defer resp.Body.Close()
 
-	// 读取响应
-	body, err := io.ReadAll(resp.Body)
+	resp, err := c.fetchUsageLimits(token)
 	if err != nil {
-		result.Error = fmt.Errorf("读取响应失败: %v", err)
+		result.Error = err
 		return result
 	}
+	result.StatusCode = resp.statusCode
+	body := resp.body
 
 	// 处理非200响应
-	if resp.StatusCode != http.StatusOK {
+	if resp.statusCode != http.StatusOK {
 		// 尝试解析错误响应，检查是否被封禁
 		var errorResp map[string]any
 		if err := utils.SafeUnmarshal(body, &errorResp); err == nil {
@@ -92,11 +84,11 @@ func (c *UsageLimitsChecker) CheckUsageLimitsWithStatus(token types.TokenInfo) *
 				result.Error = fmt.Errorf("账号被封禁: %s", reason)
 				logger.Warn("账号被封禁",
 					logger.String("reason", reason),
-					logger.Int("status_code", resp.StatusCode))
+					logger.Int("status_code", resp.statusCode))
 				return result
 			}
 		}
-		result.Error = fmt.Errorf("请求失败: 状态码 %d, 响应: %s", resp.StatusCode, string(body))
+		result.Error = usageRequestError(resp, nil)
 		return result
 	}
 
@@ -110,31 +102,8 @@ func (c *UsageLimitsChecker) CheckUsageLimitsWithStatus(token types.TokenInfo) *
 	result.UsageLimits = &usageLimits
 
 	// 计算用量
-	for _, breakdown := range usageLimits.UsageBreakdownList {
-		if breakdown.ResourceType == "CREDIT" {
-			// 基础额度
-			result.TotalLimit = breakdown.UsageLimitWithPrecision
-			result.TotalUsed = breakdown.CurrentUsageWithPrecision
-
-			// 免费试用额度
-			if breakdown.FreeTrialInfo != nil && breakdown.FreeTrialInfo.FreeTrialStatus == "ACTIVE" {
-				result.TotalLimit += breakdown.FreeTrialInfo.UsageLimitWithPrecision
-				result.TotalUsed += breakdown.FreeTrialInfo.CurrentUsageWithPrecision
-			}
-
-			// 奖励额度
-			for _, bonus := range breakdown.Bonuses {
-				result.TotalLimit += bonus.UsageLimit
-				result.TotalUsed += bonus.CurrentUsage
-			}
-
-			result.Available = result.TotalLimit - result.TotalUsed
-			if result.Available < 0 {
-				result.Available = 0
-			}
-			break
-		}
-	}
+	result.TotalLimit, result.TotalUsed = usageTotals(&usageLimits)
+	result.Available = max(result.TotalLimit-result.TotalUsed, 0)
 
 	// 确定状态
 	if result.Available > 0 {
@@ -154,6 +123,126 @@ func (c *UsageLimitsChecker) CheckUsageLimitsWithStatus(token types.TokenInfo) *
 	return result
 }
 
+// usageTotals 汇总CREDIT资源的总配额和已使用量（基础额度、免费试用额度和奖励额度）
+func usageTotals(usageLimits *types.UsageLimits) (limit, used float64) {
+	for _, breakdown := range usageLimits.UsageBreakdownList {
+		if breakdown.ResourceType != "CREDIT" {
+			continue
+		}
+		// 基础额度
+		limit = breakdown.UsageLimitWithPrecision
+		used = breakdown.CurrentUsageWithPrecision
+
+		// 免费试用额度
+		if breakdown.FreeTrialInfo != nil && breakdown.FreeTrialInfo.FreeTrialStatus == "ACTIVE" {
+			limit += breakdown.FreeTrialInfo.UsageLimitWithPrecision
+			used += breakdown.FreeTrialInfo.CurrentUsageWithPrecision
+		}
+
+		// 奖励额度
+		for _, bonus := range breakdown.Bonuses {
+			limit += bonus.UsageLimit
+			used += bonus.CurrentUsage
+		}
+		return limit, used
+	}
+	return 0, 0
+}
+
+// usageLimitsResponse getUsageLimits的原始响应
+type usageLimitsResponse struct {
+	endpoint   string
+	statusCode int
+	body       []byte
+}
+
+// RawUsageLimits getUsageLimits未经解析的响应，用于排查解析器忽略的字段
+type RawUsageLimits struct {
+	Endpoint   string
+	StatusCode int
+	Body       []byte
+}
+
+// FetchRawUsageLimits 查询用量并返回原始响应体
+// 不经过usageCache，也不更新封禁状态和认证统计
+func (c *UsageLimitsChecker) FetchRawUsageLimits(token types.TokenInfo) (*RawUsageLimits, error) {
+	resp, err := c.fetchUsageLimits(token)
+	if err != nil {
+		return nil, err
+	}
+	return &RawUsageLimits{Endpoint: resp.endpoint, StatusCode: resp.statusCode, Body: resp.body}, nil
+}
+
+// fetchUsageLimits 查询用量，主区域不可达或返回5xx时依次尝试备用区域（USAGE_FALLBACK_REGIONS）
+func (c *UsageLimitsChecker) fetchUsageLimits(token types.TokenInfo) (*usageLimitsResponse, error) {
+	var resp *usageLimitsResponse
+	var err error
+	endpoints := config.UsageLimitsURLs()
+	for i, endpoint := range endpoints {
+		resp, err = c.requestUsageLimits(endpoint, token)
+		if err == nil && resp.statusCode < http.StatusInternalServerError {
+			if i > 0 {
+				logger.Info("主区域用量查询失败，已使用备用区域", logger.String("endpoint", endpoint))
+			}
+			break
+		}
+		if i < len(endpoints)-1 {
+			logger.Warn("用量查询失败，尝试下一个区域",
+				logger.String("endpoint", endpoint),
+				logger.String("next_endpoint", endpoints[i+1]),
+				logger.Err(usageRequestError(resp, err)))
+		}
+	}
+	return resp, err
+}
+
+// requestUsageLimits 向指定端点查询使用限制
+func (c *UsageLimitsChecker) requestUsageLimits(endpoint string, token types.TokenInfo) (*usageLimitsResponse, error) {
+	params := url.Values{}
+	params.Add("isEmailRequired", "true")
+	params.Add("origin", "AI_EDITOR")
+	params.Add("resourceType", "AGENTIC_REQUEST")
+
+	requestURL := fmt.Sprintf("%s?%s", endpoint, params.Encode())
+
+	// 创建HTTP请求
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+
+	// 设置请求头
+	req.Header.Set("x-amz-user-agent", "aws-sdk-js/1.0.0 KiroIDE-0.6.18-66c23a8c5d15afabec89ef9954ef52a119f10d369df04d548fc6c1eac694b0d1")
+	req.Header.Set("user-agent", "aws-sdk-js/1.0.0 ua/2.1 os/windows lang/js md/nodejs#20.16.0 api/codewhispererruntime#1.0.0 m/E KiroIDE-0.6.18-66c23a8c5d15afabec89ef9954ef52a119f10d369df04d548fc6c1eac694b0d1")
+	req.Header.Set("host", req.URL.Host)
+	req.Header.Set("amz-sdk-invocation-id", generateInvocationID())
+	req.Header.Set("amz-sdk-request", "attempt=1; max=1")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+	req.Header.Set("Connection", "close")
+
+	// 发送请求
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// 读取响应
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取响应失败: %v", err)
+	}
+	return &usageLimitsResponse{endpoint: endpoint, statusCode: resp.StatusCode, body: body}, nil
+}
+
+// usageRequestError 描述一次失败的用量查询
+func usageRequestError(resp *usageLimitsResponse, err error) error {
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("请求失败: 状态码 %d, 响应: %s", resp.statusCode, string(resp.body))
+}
+
 // CheckUsageLimits 检查token的使用限制 (保持向后兼容)
 func (c *UsageLimitsChecker) CheckUsageLimits(token types.TokenInfo) (*types.UsageLimits, error) {
 	result := c.CheckUsageLimitsWithStatus(token)
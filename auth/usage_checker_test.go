@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckUsageLimitsWithStatus_HonorsBaseURLOverride(t *testing.T) {
+	withUsageCache(t, NewUsageCache(time.Minute))
+	var gotPath, gotAuth, gotResourceType string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		gotResourceType = r.URL.Query().Get("resourceType")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{
+			"usageBreakdownList": [{"resourceType": "CREDIT", "usageLimitWithPrecision": 50, "currentUsageWithPrecision": 20}],
+			"userInfo": {"email": "mock@example.com"}
+		}`))
+	}))
+	defer upstream.Close()
+
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+
+	checker := NewUsageLimitsChecker()
+	result := checker.CheckUsageLimitsWithStatus(types.TokenInfo{
+		AccessToken: "mock-access-token",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, "/getUsageLimits", gotPath)
+	assert.Equal(t, "Bearer mock-access-token", gotAuth)
+	assert.Equal(t, "AGENTIC_REQUEST", gotResourceType)
+	assert.Equal(t, types.AccountStatusActive, result.Status)
+	assert.Equal(t, 30.0, result.Available)
+	assert.Equal(t, "mock@example.com", result.UsageLimits.UserInfo.Email)
+}
+
+func TestCheckUsageLimitsWithStatus_BannedViaOverride(t *testing.T) {
+	withUsageCache(t, NewUsageCache(time.Minute))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"reason": "TEMPORARILY_SUSPENDED"}`))
+	}))
+	defer upstream.Close()
+
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+
+	result := NewUsageLimitsChecker().CheckUsageLimitsWithStatus(types.TokenInfo{AccessToken: "x"})
+
+	assert.Equal(t, types.AccountStatusBanned, result.Status)
+	assert.Equal(t, "TEMPORARILY_SUSPENDED", result.BanReason)
+}
+
+func TestCheckUsageLimitsWithStatus_FallsBackWhenPrimaryFails(t *testing.T) {
+	withUsageCache(t, NewUsageCache(time.Minute))
+	var primaryCalls, fallbackCalls int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackCalls++
+		_, _ = w.Write([]byte(`{"usageBreakdownList": [{"resourceType": "CREDIT", "usageLimitWithPrecision": 50, "currentUsageWithPrecision": 10}]}`))
+	}))
+	defer fallback.Close()
+
+	t.Setenv("CODEWHISPERER_BASE_URL", primary.URL)
+	t.Setenv("USAGE_FALLBACK_REGIONS", fallback.URL)
+
+	result := NewUsageLimitsChecker().CheckUsageLimitsWithStatus(types.TokenInfo{AccessToken: "x"})
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, 1, primaryCalls)
+	assert.Equal(t, 1, fallbackCalls)
+	assert.Equal(t, types.AccountStatusActive, result.Status)
+	assert.Equal(t, 40.0, result.Available)
+}
+
+func TestCheckUsageLimitsWithStatus_FallsBackWhenPrimaryUnreachable(t *testing.T) {
+	withUsageCache(t, NewUsageCache(time.Minute))
+	primary := httptest.NewServer(http.NotFoundHandler())
+	primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"usageBreakdownList": [{"resourceType": "CREDIT", "usageLimitWithPrecision": 50, "currentUsageWithPrecision": 10}]}`))
+	}))
+	defer fallback.Close()
+
+	t.Setenv("CODEWHISPERER_BASE_URL", primary.URL)
+	t.Setenv("USAGE_FALLBACK_REGIONS", "  ,"+fallback.URL+"/")
+
+	result := NewUsageLimitsChecker().CheckUsageLimitsWithStatus(types.TokenInfo{AccessToken: "x"})
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, types.AccountStatusActive, result.Status)
+}
+
+func TestCheckUsageLimitsWithStatus_ClientErrorDoesNotFallBack(t *testing.T) {
+	withUsageCache(t, NewUsageCache(time.Minute))
+	// 4xx是账号本身的问题（如封禁），换区域不会改变结果
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"reason": "TEMPORARILY_SUSPENDED"}`))
+	}))
+	defer primary.Close()
+	fallbackCalls := 0
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackCalls++
+	}))
+	defer fallback.Close()
+
+	t.Setenv("CODEWHISPERER_BASE_URL", primary.URL)
+	t.Setenv("USAGE_FALLBACK_REGIONS", fallback.URL)
+
+	result := NewUsageLimitsChecker().CheckUsageLimitsWithStatus(types.TokenInfo{AccessToken: "x"})
+
+	assert.Equal(t, types.AccountStatusBanned, result.Status)
+	assert.Zero(t, fallbackCalls)
+}
+
+func TestCheckUsageLimitsWithStatus_AllRegionsFail(t *testing.T) {
+	withUsageCache(t, NewUsageCache(time.Minute))
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	t.Setenv("CODEWHISPERER_BASE_URL", unreachable.URL)
+	t.Setenv("USAGE_FALLBACK_REGIONS", failing.URL)
+
+	result := NewUsageLimitsChecker().CheckUsageLimitsWithStatus(types.TokenInfo{AccessToken: "x"})
+
+	require.Error(t, result.Error)
+	assert.Contains(t, result.Error.Error(), "502")
+	assert.Equal(t, types.AccountStatusError, result.Status)
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+)
+
+// 用量检查因上游不可达失败时的处理方式
+const (
+	UsageCheckFailClosed = "closed" // 视为不可用，直到重新检查成功（默认）
+	UsageCheckFailOpen   = "open"   // 在短时间内乐观使用，避免上游抖动时整个token池不可用
+)
+
+// UsageCheckFailureMode 读取 USAGE_CHECK_FAILURE_MODE（open|closed），无效或未设置时为closed
+func UsageCheckFailureMode() string {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("USAGE_CHECK_FAILURE_MODE")))
+	switch value {
+	case "":
+		return UsageCheckFailClosed
+	case UsageCheckFailClosed, UsageCheckFailOpen:
+		return value
+	default:
+		logger.Warn("USAGE_CHECK_FAILURE_MODE无效（需为open或closed），使用closed",
+			logger.String("value", value))
+		return UsageCheckFailClosed
+	}
+}
+
+// UsageCheckFailOpenTTL 读取 USAGE_CHECK_FAIL_OPEN_TTL（Go duration格式，如 2m），无效或未设置时使用默认值
+func UsageCheckFailOpenTTL() time.Duration {
+	value := strings.TrimSpace(os.Getenv("USAGE_CHECK_FAIL_OPEN_TTL"))
+	if value == "" {
+		return config.UsageCheckFailOpenTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		logger.Warn("USAGE_CHECK_FAIL_OPEN_TTL无效（需为正的时长），使用默认值",
+			logger.String("value", value),
+			logger.Duration("default", config.UsageCheckFailOpenTTL))
+		return config.UsageCheckFailOpenTTL
+	}
+	return ttl
+}
+
+// usageCheckUnreachable 判断用量检查失败是否源于上游不可达（网络错误、限流或5xx）
+// 封禁、鉴权失败等账号本身的问题不在此列，任何模式下都视为不可用
+func usageCheckUnreachable(result *UsageCheckResult) bool {
+	if result == nil || result.Error == nil || result.Status != types.AccountStatusError {
+		return false
+	}
+	return result.StatusCode == 0 ||
+		result.StatusCode == http.StatusTooManyRequests ||
+		result.StatusCode >= http.StatusInternalServerError
+}
+
+// failOpenUntil 返回用量检查失败的token可被乐观使用的截止时间，不适用fail-open时返回零值
+func (tm *TokenManager) failOpenUntil(result *UsageCheckResult) time.Time {
+	if !tm.failOpen || !usageCheckUnreachable(result) {
+		return time.Time{}
+	}
+	return tm.now().Add(tm.failOpenTTL)
+}
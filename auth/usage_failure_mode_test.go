@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUsageFailureUpstream 刷新总是成功，用量接口返回usageStatus（200时返回正常用量）
+func newUsageFailureUpstream(t *testing.T, usageStatus *atomic.Int32) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch status := int(usageStatus.Load()); {
+		case r.URL.Path != "/getUsageLimits":
+			_, _ = w.Write([]byte(`{"accessToken":"access","expiresIn":3600}`))
+		case status == http.StatusOK:
+			_, _ = w.Write([]byte(`{"usageBreakdownList": [{"resourceType": "CREDIT", "usageLimitWithPrecision": 50, "currentUsageWithPrecision": 20}]}`))
+		case status == http.StatusForbidden:
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"reason":"TEMPORARILY_SUSPENDED"}`))
+		default:
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"message":"Service Unavailable"}`))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("SOCIAL_REFRESH_URL", upstream.URL+"/refreshToken")
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	t.Setenv("USAGE_FALLBACK_REGIONS", "")
+}
+
+func newUsageFailureTestManager(t *testing.T, mode string, usageStatus int) (*TokenManager, *time.Time) {
+	t.Helper()
+	withUsageCache(t, NewUsageCache(0))
+	withBanStore(t, NewBanStore(""))
+	withTokenErrorStore(t, NewTokenErrorStore(""))
+	t.Setenv("USAGE_CHECK_FAILURE_MODE", mode)
+	var status atomic.Int32
+	status.Store(int32(usageStatus))
+	newUsageFailureUpstream(t, &status)
+
+	tm := NewTokenManager([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "refresh-usage-failure"}})
+	clock := time.Now()
+	tm.now = func() time.Time { return clock }
+	tm.staleWait = 0
+	tm.applyTokensUnlocked(tm.fetchTokens(tm.configs))
+	stubLoader(tm, nil) // 之后的刷新不再访问上游
+	return tm, &clock
+}
+
+func TestUsageCheckFailClosed_ErroredTokenNotUsed(t *testing.T) {
+	tm, _ := newUsageFailureTestManager(t, "", http.StatusServiceUnavailable)
+
+	cached := tm.cache.tokens["token_0"]
+	assert.False(t, cached.IsUsable(), "默认fail-closed：用量检查失败的token不可用")
+	assert.True(t, cached.OptimisticUntil.IsZero())
+
+	tm.mutex.Lock()
+	selected, _ := tm.selectBestTokenUnlocked(SelectionStrategyHealth, "")
+	tm.mutex.Unlock()
+	assert.Nil(t, selected)
+}
+
+func TestUsageCheckFailOpen_OptimisticUseExpires(t *testing.T) {
+	tm, clock := newUsageFailureTestManager(t, "open", http.StatusServiceUnavailable)
+
+	cached := tm.cache.tokens["token_0"]
+	require.True(t, cached.IsUsable(), "fail-open：上游不可达时乐观使用")
+	assert.Equal(t, config.UsageCheckFailOpenAvailable, cached.Available)
+	assert.Equal(t, clock.Add(config.UsageCheckFailOpenTTL), cached.OptimisticUntil)
+	assert.Nil(t, cached.UsageInfo)
+
+	tm.mutex.Lock()
+	staleness, _ := tm.usageStalenessUnlocked(cached)
+	selected, _ := tm.selectBestTokenUnlocked(SelectionStrategyHealth, "")
+	tm.mutex.Unlock()
+	assert.Equal(t, UsageSoftStale, staleness, "乐观使用期间降权并在后台重新检查")
+	require.NotNil(t, selected)
+	assert.Equal(t, "access", selected.Token.AccessToken)
+
+	// 超过TTL后不再乐观使用
+	*clock = clock.Add(config.UsageCheckFailOpenTTL + time.Second)
+	tm.mutex.Lock()
+	staleness, _ = tm.usageStalenessUnlocked(cached)
+	selected, _ = tm.selectBestTokenUnlocked(SelectionStrategyHealth, "")
+	tm.mutex.Unlock()
+	assert.Equal(t, UsageHardStale, staleness)
+	assert.Nil(t, selected)
+}
+
+func TestUsageCheckFailOpen_AccountProblemsStayClosed(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusUnauthorized, http.StatusBadRequest} {
+		tm, _ := newUsageFailureTestManager(t, "open", status)
+		assert.False(t, tm.cache.tokens["token_0"].IsUsable(), "账号本身的问题不乐观使用: %d", status)
+	}
+
+	tm, _ := newUsageFailureTestManager(t, "open", http.StatusOK)
+	cached := tm.cache.tokens["token_0"]
+	assert.Equal(t, 30.0, cached.Available)
+	assert.True(t, cached.OptimisticUntil.IsZero(), "检查成功时不标记为乐观使用")
+}
+
+func TestUsageCheckFailureModeFromEnv(t *testing.T) {
+	for value, want := range map[string]string{
+		"":        UsageCheckFailClosed,
+		"closed":  UsageCheckFailClosed,
+		" OPEN ":  UsageCheckFailOpen,
+		"invalid": UsageCheckFailClosed,
+	} {
+		t.Setenv("USAGE_CHECK_FAILURE_MODE", value)
+		assert.Equal(t, want, UsageCheckFailureMode(), value)
+	}
+
+	t.Setenv("USAGE_CHECK_FAIL_OPEN_TTL", "")
+	assert.Equal(t, config.UsageCheckFailOpenTTL, UsageCheckFailOpenTTL())
+	t.Setenv("USAGE_CHECK_FAIL_OPEN_TTL", "30s")
+	assert.Equal(t, 30*time.Second, UsageCheckFailOpenTTL())
+	t.Setenv("USAGE_CHECK_FAIL_OPEN_TTL", "-1m")
+	assert.Equal(t, config.UsageCheckFailOpenTTL, UsageCheckFailOpenTTL())
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+)
+
+// UsageStaleness 缓存用量数据的新鲜程度
+type UsageStaleness string
+
+const (
+	UsageFresh     UsageStaleness = "fresh"      // 未超过TokenCacheTTL
+	UsageSoftStale UsageStaleness = "soft_stale" // 超过TokenCacheTTL：降权使用并在后台刷新
+	UsageHardStale UsageStaleness = "hard_stale" // 超过硬TTL：不再信任剩余额度，不参与选择
+)
+
+// UsageHardTTL 读取 USAGE_HARD_TTL（Go duration格式，如 30m），无效或未设置时使用默认值
+func UsageHardTTL() time.Duration {
+	value := strings.TrimSpace(os.Getenv("USAGE_HARD_TTL"))
+	if value == "" {
+		return config.UsageHardTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < config.TokenCacheTTL {
+		logger.Warn("USAGE_HARD_TTL无效（需为不小于TokenCacheTTL的时长），使用默认值",
+			logger.String("value", value),
+			logger.Duration("default", config.UsageHardTTL))
+		return config.UsageHardTTL
+	}
+	return ttl
+}
+
+// usageStalenessUnlocked 按上次用量检查（即缓存时间）判断用量数据的新鲜程度
+// fail-open乐观使用的token在截止时间前视为软过期（降权并在后台重新检查），之后视为硬过期
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) usageStalenessUnlocked(cached *CachedToken) (UsageStaleness, time.Duration) {
+	age := max(tm.now().Sub(cached.CachedAt), 0)
+	switch {
+	case !cached.OptimisticUntil.IsZero() && tm.now().After(cached.OptimisticUntil):
+		return UsageHardStale, age
+	case !cached.OptimisticUntil.IsZero():
+		return UsageSoftStale, age
+	case age > tm.hardTTL:
+		return UsageHardStale, age
+	case age > tm.cache.ttl:
+		return UsageSoftStale, age
+	default:
+		return UsageFresh, age
+	}
+}
+
+// triggerRefreshUnlocked 在后台刷新token缓存（同一时间最多一个刷新），返回刷新完成信号
+// 距上次刷新不足TokenStaleRefreshMinInterval且没有进行中的刷新时不启动，返回nil
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) triggerRefreshUnlocked() <-chan struct{} {
+	if tm.refreshing != nil {
+		return tm.refreshing
+	}
+	if !tm.lastRefresh.IsZero() && tm.now().Sub(tm.lastRefresh) < config.TokenStaleRefreshMinInterval {
+		return nil
+	}
+	return tm.startRefreshUnlocked()
+}
+
+// startRefreshUnlocked 启动后台刷新，不受最小刷新间隔限制；已有进行中的刷新时返回其完成信号
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) startRefreshUnlocked() <-chan struct{} {
+	if tm.refreshing != nil {
+		return tm.refreshing
+	}
+
+	done := make(chan struct{})
+	tm.refreshing = done
+	configs := tm.configs
+	generation := tm.generation
+	go func() {
+		// 网络请求在锁外进行，刷新期间请求继续使用现有缓存
+		entries := tm.loadTokens(configs)
+
+		tm.mutex.Lock()
+		tm.refreshing = nil
+		if generation == tm.generation {
+			tm.applyTokensUnlocked(entries)
+		} else {
+			// 刷新期间配置已重新加载，结果的cache key按旧配置的索引生成，丢弃后按新配置重新刷新
+			tm.startRefreshUnlocked()
+		}
+		tm.mutex.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// waitForRefreshUnlocked 临时释放锁，等待后台刷新完成或超时
+// 内部方法：调用者必须持有 tm.mutex，返回时重新持有
+func (tm *TokenManager) waitForRefreshUnlocked(done <-chan struct{}) {
+	if done == nil {
+		return
+	}
+	tm.mutex.Unlock()
+	defer tm.mutex.Lock()
+
+	timer := time.NewTimer(tm.staleWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		logger.Warn("等待token用量刷新超时", logger.Duration("wait", tm.staleWait))
+	}
+}
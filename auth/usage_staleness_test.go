@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubLoader 替换token加载函数：返回以当前时钟为缓存时间的新token，release关闭前阻塞
+func stubLoader(tm *TokenManager, release <-chan struct{}) *atomic.Int32 {
+	calls := &atomic.Int32{}
+	tm.loadTokens = func(configs []AuthConfig) map[string]*CachedToken {
+		calls.Add(1)
+		if release != nil {
+			<-release
+		}
+		tm.mutex.RLock()
+		now := tm.now()
+		tm.mutex.RUnlock()
+		return map[string]*CachedToken{
+			"token_0": {
+				Token:     types.TokenInfo{AccessToken: "refreshed_0", ExpiresAt: now.Add(time.Hour)},
+				CachedAt:  now,
+				Available: 100000,
+			},
+		}
+	}
+	return calls
+}
+
+// waitIdle 等待后台刷新结束
+func waitIdle(t *testing.T, tm *TokenManager) {
+	require.Eventually(t, func() bool {
+		tm.mutex.RLock()
+		defer tm.mutex.RUnlock()
+		return tm.refreshing == nil
+	}, time.Second, time.Millisecond)
+}
+
+func TestUsageStaleness_Tiers(t *testing.T) {
+	tm, clock := newHealthTestManager(1)
+	cached := tm.cache.tokens["token_0"]
+	cached.CachedAt = *clock
+
+	staleness, _ := tm.usageStalenessUnlocked(cached)
+	assert.Equal(t, UsageFresh, staleness)
+
+	*clock = clock.Add(config.TokenCacheTTL + time.Second)
+	staleness, _ = tm.usageStalenessUnlocked(cached)
+	assert.Equal(t, UsageSoftStale, staleness)
+
+	*clock = cached.CachedAt.Add(tm.hardTTL + time.Second)
+	staleness, age := tm.usageStalenessUnlocked(cached)
+	assert.Equal(t, UsageHardStale, staleness)
+	assert.Equal(t, tm.hardTTL+time.Second, age)
+}
+
+func TestTokenManager_FreshTokensDoNotRefresh(t *testing.T) {
+	tm, clock := newHealthTestManager(2)
+	tm.lastRefresh = *clock
+	calls := stubLoader(tm, nil)
+
+	counts := selectionCounts(t, tm, 200)
+	assert.InDelta(t, 100, counts["access_0"], 40)
+	assert.Zero(t, calls.Load())
+}
+
+func TestTokenManager_SoftStaleDeprioritizedAndRefreshedAsync(t *testing.T) {
+	tm, clock := newHealthTestManager(2)
+	tm.lastRefresh = clock.Add(-time.Minute)
+	tm.cache.tokens["token_0"].CachedAt = clock.Add(-config.TokenCacheTTL - time.Minute)
+	tm.cache.tokens["token_1"].CachedAt = *clock
+
+	release := make(chan struct{})
+	calls := stubLoader(tm, release)
+
+	// 刷新阻塞期间请求不等待，过期token仍可用但明显降权
+	counts := selectionCounts(t, tm, 1000)
+	assert.Greater(t, counts["access_1"], 850)
+	assert.Greater(t, counts["access_0"], 0)
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), calls.Load(), "同一时间只应有一个后台刷新")
+
+	close(release)
+	waitIdle(t, tm)
+	assert.Equal(t, "refreshed_0", tm.cache.tokens["token_0"].Token.AccessToken)
+	staleness, _ := tm.usageStalenessUnlocked(tm.cache.tokens["token_0"])
+	assert.Equal(t, UsageFresh, staleness)
+}
+
+func TestTokenManager_HardStaleExcluded(t *testing.T) {
+	tm, clock := newHealthTestManager(2)
+	tm.lastRefresh = clock.Add(-time.Minute)
+	tm.cache.tokens["token_0"].CachedAt = clock.Add(-tm.hardTTL - time.Minute)
+	tm.cache.tokens["token_1"].CachedAt = *clock
+
+	release := make(chan struct{})
+	defer close(release)
+	stubLoader(tm, release)
+
+	counts := selectionCounts(t, tm, 200)
+	assert.Equal(t, map[string]int{"access_1": 200}, counts, "刷新完成前不应使用用量数据超过硬TTL的token")
+	assert.False(t, tm.exhausted["token_0"], "用量未知的token不应标记为耗尽")
+
+	scores := tm.HealthScores()
+	assert.Equal(t, UsageHardStale, scores["token_0"].UsageStaleness)
+	assert.Equal(t, int64((tm.hardTTL + time.Minute).Seconds()), scores["token_0"].UsageAgeSeconds)
+	assert.Equal(t, UsageFresh, scores["token_1"].UsageStaleness)
+}
+
+func TestTokenManager_OnlyHardStaleWaitsForRefresh(t *testing.T) {
+	tm, clock := newHealthTestManager(1)
+	tm.lastRefresh = clock.Add(-time.Minute)
+	tm.cache.tokens["token_0"].CachedAt = clock.Add(-tm.hardTTL - time.Minute)
+	calls := stubLoader(tm, nil)
+
+	token, err := tm.GetBestTokenWithUsage()
+	require.NoError(t, err)
+	assert.Equal(t, "refreshed_0", token.AccessToken)
+	assert.Equal(t, *clock, token.LastUsageCheck)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestTokenManager_OnlyHardStaleRefreshTimesOut(t *testing.T) {
+	tm, clock := newHealthTestManager(1)
+	tm.lastRefresh = clock.Add(-time.Minute)
+	tm.cache.tokens["token_0"].CachedAt = clock.Add(-tm.hardTTL - time.Minute)
+	tm.staleWait = 20 * time.Millisecond
+
+	release := make(chan struct{})
+	stubLoader(tm, release)
+
+	start := time.Now()
+	_, err := tm.getBestToken()
+	assert.Error(t, err, "不应使用用量数据超过硬TTL的token")
+	assert.GreaterOrEqual(t, time.Since(start), tm.staleWait)
+
+	close(release)
+	waitIdle(t, tm)
+	token, err := tm.getBestToken()
+	require.NoError(t, err)
+	assert.Equal(t, "refreshed_0", token.AccessToken)
+}
+
+func TestTokenManager_ExpiredCacheRefreshesInBackground(t *testing.T) {
+	tm, clock := newHealthTestManager(1)
+	tm.cache.tokens["token_0"].CachedAt = *clock
+	tm.lastRefresh = clock.Add(-config.TokenCacheTTL - time.Second)
+
+	release := make(chan struct{})
+	calls := stubLoader(tm, release)
+
+	// 缓存过期不阻塞请求，继续使用现有token
+	token, err := tm.getBestToken()
+	require.NoError(t, err)
+	assert.Equal(t, "access_0", token.AccessToken)
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+
+	close(release)
+	waitIdle(t, tm)
+	assert.Equal(t, *clock, tm.lastRefresh)
+}
+
+func TestUsageHardTTL(t *testing.T) {
+	t.Setenv("USAGE_HARD_TTL", "")
+	assert.Equal(t, config.UsageHardTTL, UsageHardTTL())
+
+	t.Setenv("USAGE_HARD_TTL", "1h")
+	assert.Equal(t, time.Hour, UsageHardTTL())
+
+	t.Setenv("USAGE_HARD_TTL", "abc")
+	assert.Equal(t, config.UsageHardTTL, UsageHardTTL())
+
+	t.Setenv("USAGE_HARD_TTL", "1m") // 小于TokenCacheTTL
+	assert.Equal(t, config.UsageHardTTL, UsageHardTTL())
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // ModelMap 模型映射表
@@ -21,13 +23,152 @@ const RefreshTokenURL = "https://prod.us-east-1.auth.desktop.kiro.dev/refreshTok
 // IdcRefreshTokenURL IdC认证方式的刷新token URL
 const IdcRefreshTokenURL = "https://oidc.us-east-1.amazonaws.com/token"
 
-// CodeWhispererURL CodeWhisperer API的URL
-const CodeWhispererURL = "https://codewhisperer.us-east-1.amazonaws.com/generateAssistantResponse"
+// SocialRefreshURL 返回Social方式刷新token的URL
+// 可通过环境变量 SOCIAL_REFRESH_URL 覆盖（例如指向测试用的mock服务）
+func SocialRefreshURL() string {
+	if value := strings.TrimSpace(os.Getenv("SOCIAL_REFRESH_URL")); value != "" {
+		return value
+	}
+	return RefreshTokenURL
+}
+
+// IdcRefreshURL 返回IdC方式刷新token的URL
+// 可通过环境变量 IDC_REFRESH_URL 覆盖
+func IdcRefreshURL() string {
+	if value := strings.TrimSpace(os.Getenv("IDC_REFRESH_URL")); value != "" {
+		return value
+	}
+	return IdcRefreshTokenURL
+}
+
+// DefaultCodeWhispererBaseURL CodeWhisperer API的默认基础URL
+const DefaultCodeWhispererBaseURL = "https://codewhisperer.us-east-1.amazonaws.com"
+
+// CodeWhispererBaseURL 返回CodeWhisperer API的基础URL
+// 可通过环境变量 CODEWHISPERER_BASE_URL 覆盖（例如指向测试用的mock服务）
+func CodeWhispererBaseURL() string {
+	if value := strings.TrimSpace(os.Getenv("CODEWHISPERER_BASE_URL")); value != "" {
+		return strings.TrimRight(value, "/")
+	}
+	return DefaultCodeWhispererBaseURL
+}
+
+// CodeWhispererURL 返回generateAssistantResponse端点的完整URL
+func CodeWhispererURL() string {
+	return CodeWhispererBaseURL() + "/generateAssistantResponse"
+}
+
+// CodeWhispererProfileArn 返回全局默认的CodeWhisperer profile ARN
+// 通过环境变量 CODEWHISPERER_PROFILE_ARN 设置；认证配置中的profileArn优先，均未设置时请求不携带ARN
+func CodeWhispererProfileArn() string {
+	return strings.TrimSpace(os.Getenv("CODEWHISPERER_PROFILE_ARN"))
+}
+
+// UsageLimitsURL 返回getUsageLimits端点的完整URL（不含查询参数）
+func UsageLimitsURL() string {
+	return CodeWhispererBaseURL() + "/getUsageLimits"
+}
+
+// UsageFallbackBaseURLs 返回用量查询的备用基础URL，按配置顺序排列
+// 通过环境变量 USAGE_FALLBACK_REGIONS 设置（逗号分隔），每项为区域名（如 eu-central-1）或完整URL
+func UsageFallbackBaseURLs() []string {
+	var urls []string
+	for _, item := range strings.Split(os.Getenv("USAGE_FALLBACK_REGIONS"), ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+			continue
+		case strings.HasPrefix(item, "http://") || strings.HasPrefix(item, "https://"):
+			urls = append(urls, strings.TrimRight(item, "/"))
+		default:
+			urls = append(urls, "https://codewhisperer."+item+".amazonaws.com")
+		}
+	}
+	return urls
+}
+
+// UsageLimitsURLs 返回依次尝试的getUsageLimits端点：主区域在前，之后是USAGE_FALLBACK_REGIONS
+func UsageLimitsURLs() []string {
+	urls := []string{UsageLimitsURL()}
+	for _, baseURL := range UsageFallbackBaseURLs() {
+		if endpoint := baseURL + "/getUsageLimits"; endpoint != urls[0] {
+			urls = append(urls, endpoint)
+		}
+	}
+	return urls
+}
 
 // MaxToolDescriptionLength 工具描述的最大长度（字符数）
 // 可通过环境变量 MAX_TOOL_DESCRIPTION_LENGTH 配置，默认 10000
 var MaxToolDescriptionLength = getEnvIntWithDefault("MAX_TOOL_DESCRIPTION_LENGTH", 10000)
 
+// Token预览后缀长度的默认值与取值范围
+const (
+	DefaultTokenPreviewSuffixLen = 10
+	MinTokenPreviewSuffixLen     = 0
+	MaxTokenPreviewSuffixLen     = 32
+)
+
+// TokenPreviewSuffixLen token预览（***+后N位）中保留的明文后缀长度
+// 可通过环境变量 TOKEN_PREVIEW_SUFFIX_LEN 配置，默认 10，超出范围时截断到 [0, 32]
+var TokenPreviewSuffixLen = ClampTokenPreviewSuffixLen(getEnvIntWithDefault("TOKEN_PREVIEW_SUFFIX_LEN", DefaultTokenPreviewSuffixLen))
+
+// ClampTokenPreviewSuffixLen 将预览后缀长度限制在允许范围内
+func ClampTokenPreviewSuffixLen(n int) int {
+	return min(max(n, MinTokenPreviewSuffixLen), MaxTokenPreviewSuffixLen)
+}
+
+// ExpirySkew token过期判断的提前量，ExpiresAt减去该值后即视为过期
+// 可通过环境变量 EXPIRY_SKEW 配置（如 "90s"、"2m"，纯数字按秒），默认 1m，超出范围时截断到 [0, 30m]
+var ExpirySkew = ClampExpirySkew(getEnvDurationWithDefault("EXPIRY_SKEW", DefaultExpirySkew))
+
+// ClampExpirySkew 将过期提前量限制在允许范围内
+func ClampExpirySkew(skew time.Duration) time.Duration {
+	return min(max(skew, 0), MaxExpirySkew)
+}
+
+// TokenErrorPenalty token上游请求出错后短暂不参与选择的时长，避免重试立即选中同一个不稳定的账号
+// 可通过环境变量 TOKEN_ERROR_PENALTY 配置（如 "10s"，纯数字按秒），默认 0 不启用，超出范围时截断到 [0, 5m]
+var TokenErrorPenalty = ClampTokenErrorPenalty(getEnvDurationWithDefault("TOKEN_ERROR_PENALTY", 0))
+
+// ClampTokenErrorPenalty 将出错禁选时长限制在允许范围内
+func ClampTokenErrorPenalty(penalty time.Duration) time.Duration {
+	return min(max(penalty, 0), MaxTokenErrorPenalty)
+}
+
+// TokenRefreshRetries token刷新遇到网络错误或5xx时的重试次数，身份提供方的4xx（如refresh token失效）不重试
+// 可通过环境变量 TOKEN_REFRESH_RETRIES 配置，默认 2，超出范围时截断到 [0, 5]，0 表示不重试
+var TokenRefreshRetries = ClampTokenRefreshRetries(getEnvIntWithDefault("TOKEN_REFRESH_RETRIES", DefaultTokenRefreshRetries))
+
+// TokenRefreshRetryDelay token刷新首次重试前的等待时长，之后每次翻倍
+// 可通过环境变量 TOKEN_REFRESH_RETRY_DELAY 配置（如 "500ms"，纯数字按秒），默认 500ms，超出范围时截断到 [0, 5s]
+var TokenRefreshRetryDelay = ClampTokenRefreshRetryDelay(getEnvDurationWithDefault("TOKEN_REFRESH_RETRY_DELAY", DefaultTokenRefreshRetryDelay))
+
+// ClampTokenRefreshRetries 将刷新重试次数限制在允许范围内
+func ClampTokenRefreshRetries(n int) int {
+	return min(max(n, 0), MaxTokenRefreshRetries)
+}
+
+// ClampTokenRefreshRetryDelay 将刷新重试等待时长限制在允许范围内
+func ClampTokenRefreshRetryDelay(delay time.Duration) time.Duration {
+	return min(max(delay, 0), MaxTokenRefreshRetryDelay)
+}
+
+// getEnvDurationWithDefault 获取时长类型环境变量（带默认值），纯数字按秒解析
+func getEnvDurationWithDefault(key string, defaultValue time.Duration) time.Duration {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return defaultValue
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration
+	}
+	return defaultValue
+}
+
 // getEnvIntWithDefault 获取整数类型环境变量（带默认值）
 func getEnvIntWithDefault(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeWhispererBaseURL_Default(t *testing.T) {
+	t.Setenv("CODEWHISPERER_BASE_URL", "")
+
+	assert.Equal(t, DefaultCodeWhispererBaseURL, CodeWhispererBaseURL())
+	assert.Equal(t, "https://codewhisperer.us-east-1.amazonaws.com/generateAssistantResponse", CodeWhispererURL())
+	assert.Equal(t, "https://codewhisperer.us-east-1.amazonaws.com/getUsageLimits", UsageLimitsURL())
+}
+
+func TestCodeWhispererBaseURL_Override(t *testing.T) {
+	t.Setenv("CODEWHISPERER_BASE_URL", "http://127.0.0.1:9999/")
+
+	assert.Equal(t, "http://127.0.0.1:9999", CodeWhispererBaseURL(), "末尾斜杠应被去除")
+	assert.Equal(t, "http://127.0.0.1:9999/generateAssistantResponse", CodeWhispererURL())
+	assert.Equal(t, "http://127.0.0.1:9999/getUsageLimits", UsageLimitsURL())
+}
+
+func TestUsageLimitsURLs_FallbackRegions(t *testing.T) {
+	t.Setenv("CODEWHISPERER_BASE_URL", "")
+	t.Setenv("USAGE_FALLBACK_REGIONS", "")
+	assert.Equal(t, []string{UsageLimitsURL()}, UsageLimitsURLs())
+
+	t.Setenv("USAGE_FALLBACK_REGIONS", " eu-central-1 ,, http://127.0.0.1:9999/ ,us-east-1")
+	assert.Equal(t, []string{
+		"https://codewhisperer.us-east-1.amazonaws.com/getUsageLimits",
+		"https://codewhisperer.eu-central-1.amazonaws.com/getUsageLimits",
+		"http://127.0.0.1:9999/getUsageLimits",
+	}, UsageLimitsURLs(), "与主区域相同的备用区域应被跳过")
+}
+
+func TestResolveModelID_CustomAliases(t *testing.T) {
+	t.Setenv("MODEL_ALIASES", `{"gpt-4o": "claude-sonnet-4-5", "claude-3-7-sonnet-20250219": "claude-sonnet-4-20250514", "bad": "no-such-model"}`)
+
+	aliases, err := ModelAliases()
+	assert.ErrorContains(t, err, "bad->no-such-model")
+	assert.Equal(t, map[string]string{
+		"gpt-4o":                     "claude-sonnet-4-5",
+		"claude-3-7-sonnet-20250219": "claude-sonnet-4-20250514",
+	}, aliases)
+
+	assert.Equal(t, "CLAUDE_SONNET_4_5_20250929_V1_0", ResolveModelID("gpt-4o"))
+	assert.Equal(t, "CLAUDE_SONNET_4_20250514_V1_0", ResolveModelID("claude-3-7-sonnet-20250219"), "自定义别名优先于内置映射")
+	assert.Equal(t, "CLAUDE_SONNET_4_20250514_V1_0", ResolveModelID("claude-sonnet-4-20250514"))
+	assert.Empty(t, ResolveModelID("bad"))
+
+	t.Setenv("MODEL_ALIASES", `not json`)
+	aliases, err = ModelAliases()
+	assert.Error(t, err)
+	assert.Empty(t, aliases)
+	assert.Empty(t, ResolveModelID("gpt-4o"))
+
+	t.Setenv("MODEL_ALIASES", "")
+	aliases, err = ModelAliases()
+	assert.NoError(t, err)
+	assert.Empty(t, aliases)
+}
+
+func TestClampTokenPreviewSuffixLen(t *testing.T) {
+	assert.Equal(t, 10, ClampTokenPreviewSuffixLen(10))
+	assert.Equal(t, MinTokenPreviewSuffixLen, ClampTokenPreviewSuffixLen(-1))
+	assert.Equal(t, MaxTokenPreviewSuffixLen, ClampTokenPreviewSuffixLen(1000))
+}
+
+func TestExpirySkewFromEnv(t *testing.T) {
+	t.Setenv("EXPIRY_SKEW", "90s")
+	assert.Equal(t, 90*time.Second, getEnvDurationWithDefault("EXPIRY_SKEW", DefaultExpirySkew))
+
+	t.Setenv("EXPIRY_SKEW", "120")
+	assert.Equal(t, 2*time.Minute, getEnvDurationWithDefault("EXPIRY_SKEW", DefaultExpirySkew), "纯数字按秒解析")
+
+	t.Setenv("EXPIRY_SKEW", "soon")
+	assert.Equal(t, DefaultExpirySkew, getEnvDurationWithDefault("EXPIRY_SKEW", DefaultExpirySkew))
+
+	assert.Equal(t, time.Duration(0), ClampExpirySkew(-time.Minute))
+	assert.Equal(t, MaxExpirySkew, ClampExpirySkew(24*time.Hour))
+}
+
+func TestClampTokenErrorPenalty(t *testing.T) {
+	assert.Equal(t, time.Duration(0), ClampTokenErrorPenalty(-time.Second))
+	assert.Equal(t, 10*time.Second, ClampTokenErrorPenalty(10*time.Second))
+	assert.Equal(t, MaxTokenErrorPenalty, ClampTokenErrorPenalty(time.Hour))
+}
+
+func TestClampTokenRefreshRetry(t *testing.T) {
+	assert.Equal(t, 0, ClampTokenRefreshRetries(-1))
+	assert.Equal(t, 3, ClampTokenRefreshRetries(3))
+	assert.Equal(t, MaxTokenRefreshRetries, ClampTokenRefreshRetries(100))
+	assert.Equal(t, time.Duration(0), ClampTokenRefreshRetryDelay(-time.Second))
+	assert.Equal(t, MaxTokenRefreshRetryDelay, ClampTokenRefreshRetryDelay(time.Minute))
+}
+
+func TestResolveModel_Sources(t *testing.T) {
+	t.Setenv("MODEL_ALIASES", `{"gpt-4o-mini": "claude-haiku-4-5-20251001"}`)
+
+	assert.Equal(t, ModelResolution{
+		Canonical: "claude-haiku-4-5-20251001",
+		ModelID:   ModelMap["claude-haiku-4-5-20251001"],
+		Source:    ModelSourceAlias,
+	}, ResolveModel("gpt-4o-mini"))
+	assert.Equal(t, ModelSourceBuiltin, ResolveModel("claude-sonnet-4-5").Source)
+	assert.Equal(t, ModelSourceUnknown, ResolveModel("gpt-5").Source)
+	assert.Equal(t, "", ResolveModelID("gpt-5"))
+}
+
+func TestModelCapabilities_CoverModelMap(t *testing.T) {
+	for model := range ModelMap {
+		capability, exists := ModelCapabilities[model]
+		if assert.True(t, exists, "模型 %s 缺少能力元数据", model) {
+			assert.Positive(t, capability.MaxOutputTokens, model)
+			assert.GreaterOrEqual(t, capability.ContextWindow, capability.MaxOutputTokens, model)
+			assert.Positive(t, capability.DefaultMaxTokens, model)
+			assert.LessOrEqual(t, capability.DefaultMaxTokens, capability.MaxOutputTokens, model)
+		}
+	}
+	for model := range ModelCapabilities {
+		assert.Contains(t, ModelMap, model, "能力元数据中的 %s 不在ModelMap中", model)
+	}
+}
+
+func TestCapabilityOf(t *testing.T) {
+	t.Setenv("MODEL_ALIASES", `{"gpt-4o": "claude-3-5-haiku-20241022"}`)
+
+	assert.Equal(t, ModelCapabilities["claude-sonnet-4-5"], CapabilityOf("claude-sonnet-4-5"))
+	assert.Equal(t, ModelCapabilities["claude-3-5-haiku-20241022"], CapabilityOf("gpt-4o"), "别名取目标模型的能力")
+	assert.Equal(t, defaultModelCapability, CapabilityOf("no-such-model"))
+}
+
+func TestSuggestModel(t *testing.T) {
+	t.Setenv("MODEL_ALIASES", `{"gpt-4o": "claude-sonnet-4-5"}`)
+
+	assert.Equal(t, "claude-sonnet-4-20250514", SuggestModel("claude-sonet-4-20250514"))
+	assert.Equal(t, "claude-sonnet-4-5", SuggestModel("Claude-Sonnet-4.5"), "忽略大小写")
+	assert.Equal(t, "claude-haiku-4-5-20251001", SuggestModel("claude-haiku-4-5-2025100"))
+	assert.Equal(t, "gpt-4o", SuggestModel("gpt-4p"), "别名也参与推荐")
+	assert.Empty(t, SuggestModel("llama-3-70b"), "差异过大时不推荐")
+	assert.Empty(t, SuggestModel(""))
+}
+
+func TestDefaultMaxTokensOf(t *testing.T) {
+	t.Setenv("MODEL_ALIASES", `{"gpt-4o": "claude-sonnet-4-5"}`)
+	original := ModelDefaultMaxTokensOverrides
+	t.Cleanup(func() { ModelDefaultMaxTokensOverrides = original })
+	ModelDefaultMaxTokensOverrides = nil
+
+	assert.Equal(t, ModelCapabilities["claude-sonnet-4-5"].DefaultMaxTokens, DefaultMaxTokensOf("claude-sonnet-4-5"))
+	assert.Equal(t, ModelCapabilities["claude-sonnet-4-5"].DefaultMaxTokens, DefaultMaxTokensOf("gpt-4o"), "别名取目标模型的默认值")
+	assert.Equal(t, ModelCapabilities["claude-3-5-haiku-20241022"].DefaultMaxTokens, DefaultMaxTokensOf("claude-3-5-haiku-20241022"))
+	assert.Equal(t, defaultModelCapability.DefaultMaxTokens, DefaultMaxTokensOf("gpt-5"))
+	assert.Greater(t, DefaultMaxTokensOf("claude-sonnet-4-5"), DefaultMaxTokensOf("claude-3-5-haiku-20241022"), "长输出模型的默认值更高")
+
+	t.Setenv("MODEL_DEFAULT_MAX_TOKENS", `{"gpt-4o": 48000, "claude-3-5-haiku-20241022": 9000, "gpt-5": 1000}`)
+	overrides, err := ModelDefaultMaxTokensFromEnv()
+	assert.ErrorContains(t, err, "claude-3-5-haiku-20241022=9000")
+	assert.ErrorContains(t, err, "gpt-5")
+	assert.Equal(t, map[string]int{"claude-sonnet-4-5": 48000}, overrides, "别名键按目标模型登记")
+	assert.Equal(t, ModelCapabilities["claude-sonnet-4-5"].DefaultMaxTokens, DefaultMaxTokensOf("claude-sonnet-4-5"), "解析结果生效前不影响默认值")
+	ModelDefaultMaxTokensOverrides = overrides
+	assert.Equal(t, 48000, DefaultMaxTokensOf("claude-sonnet-4-5"))
+	assert.Equal(t, ModelCapabilities["claude-3-5-haiku-20241022"].DefaultMaxTokens, DefaultMaxTokensOf("claude-3-5-haiku-20241022"), "超过输出上限的配置被忽略")
+
+	t.Setenv("MODEL_DEFAULT_MAX_TOKENS", `not json`)
+	overrides, err = ModelDefaultMaxTokensFromEnv()
+	assert.Error(t, err)
+	assert.Empty(t, overrides)
+}
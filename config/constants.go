@@ -9,6 +9,15 @@ const (
 
 	// TokenRefreshCleanupDelay token刷新完成后的清理延迟
 	TokenRefreshCleanupDelay = 5 * time.Second
+
+	// IdCRefreshMinInterval 同一ClientID两次刷新请求之间的最小间隔
+	IdCRefreshMinInterval = 250 * time.Millisecond
+
+	// IdCRefreshBackoffBase 身份提供方限流后整个ClientID组的初始退避时间（每次连续限流翻倍）
+	IdCRefreshBackoffBase = 30 * time.Second
+
+	// IdCRefreshBackoffMax ClientID组退避时间上限
+	IdCRefreshBackoffMax = 5 * time.Minute
 )
 
 // 消息处理常量
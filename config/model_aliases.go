@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// modelAliasCache 按MODEL_ALIASES原始值缓存解析结果，环境变量变化时重新解析
+var modelAliasCache struct {
+	mutex   sync.Mutex
+	raw     string
+	aliases map[string]string
+	err     error
+}
+
+// ModelAliases 解析环境变量 MODEL_ALIASES 定义的自定义模型别名
+// 格式为JSON对象：{"别名": "ModelMap中的Claude模型名"}，例如 {"gpt-4o": "claude-sonnet-4-5"}
+// JSON无效时返回错误且不启用任何别名；目标模型不在ModelMap中的条目被忽略并在错误中列出
+func ModelAliases() (map[string]string, error) {
+	raw := strings.TrimSpace(os.Getenv("MODEL_ALIASES"))
+
+	modelAliasCache.mutex.Lock()
+	defer modelAliasCache.mutex.Unlock()
+	if modelAliasCache.aliases != nil && modelAliasCache.raw == raw {
+		return modelAliasCache.aliases, modelAliasCache.err
+	}
+
+	aliases, err := parseModelAliases(raw)
+	modelAliasCache.raw, modelAliasCache.aliases, modelAliasCache.err = raw, aliases, err
+	return aliases, err
+}
+
+// parseModelAliases 解析别名JSON并校验目标模型
+func parseModelAliases(raw string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	if raw == "" {
+		return aliases, nil
+	}
+
+	var parsed map[string]string
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return aliases, fmt.Errorf("MODEL_ALIASES不是有效的JSON对象: %w", err)
+	}
+
+	var invalid []string
+	for alias, target := range parsed {
+		alias, target = strings.TrimSpace(alias), strings.TrimSpace(target)
+		if alias == "" {
+			continue
+		}
+		if _, exists := ModelMap[target]; !exists {
+			invalid = append(invalid, alias+"->"+target)
+			continue
+		}
+		aliases[alias] = target
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return aliases, fmt.Errorf("MODEL_ALIASES中以下别名的目标模型不存在，已忽略: %s", strings.Join(invalid, ", "))
+	}
+	return aliases, nil
+}
+
+// 模型映射来源
+const (
+	ModelSourceBuiltin = "builtin" // 内置ModelMap
+	ModelSourceAlias   = "alias"   // MODEL_ALIASES自定义别名
+	ModelSourceUnknown = "unknown" // 未找到映射
+)
+
+// ModelResolution 模型名解析结果
+type ModelResolution struct {
+	Canonical string // 别名解析后的Claude模型名（未找到映射时为原模型名）
+	ModelID   string // 上游模型ID，未找到时为空
+	Source    string // 映射来源：builtin / alias / unknown
+}
+
+// ResolveModel 将请求中的模型名解析为上游模型ID并返回映射来源
+// 先查自定义别名，再查内置ModelMap
+func ResolveModel(model string) ModelResolution {
+	aliases, _ := ModelAliases()
+	if target, exists := aliases[model]; exists {
+		return ModelResolution{Canonical: target, ModelID: ModelMap[target], Source: ModelSourceAlias}
+	}
+	if modelID, exists := ModelMap[model]; exists {
+		return ModelResolution{Canonical: model, ModelID: modelID, Source: ModelSourceBuiltin}
+	}
+	return ModelResolution{Canonical: model, Source: ModelSourceUnknown}
+}
+
+// ResolveModelID 将请求中的模型名解析为上游模型ID
+// 先查自定义别名，再查内置ModelMap；未找到时返回空字符串
+func ResolveModelID(model string) string {
+	return ResolveModel(model).ModelID
+}
@@ -0,0 +1,58 @@
+package config
+
+// ModelCapability 模型能力元数据，随 /v1/models 返回，供客户端SDK按模型启用或禁用功能
+type ModelCapability struct {
+	SupportsTools    bool // 支持工具调用
+	SupportsVision   bool // 支持图片输入
+	SupportsThinking bool // 支持扩展思考（thinking）
+	MaxOutputTokens  int  // 单次响应的最大输出token数
+	DefaultMaxTokens int  // 客户端未指定max_tokens时使用的输出上限（可由MODEL_DEFAULT_MAX_TOKENS覆盖）
+	ContextWindow    int  // 上下文窗口大小（token）
+}
+
+// defaultContextWindow 所有已知模型的上下文窗口
+const defaultContextWindow = 200000
+
+// ModelCapabilities 按ModelMap中的模型名登记的能力元数据，新增ModelMap条目时需同步登记
+var ModelCapabilities = map[string]ModelCapability{
+	"claude-sonnet-4-5": {
+		SupportsTools: true, SupportsVision: true, SupportsThinking: true,
+		MaxOutputTokens: 64000, DefaultMaxTokens: 32000, ContextWindow: defaultContextWindow,
+	},
+	"claude-sonnet-4-5-20250929": {
+		SupportsTools: true, SupportsVision: true, SupportsThinking: true,
+		MaxOutputTokens: 64000, DefaultMaxTokens: 32000, ContextWindow: defaultContextWindow,
+	},
+	"claude-sonnet-4-20250514": {
+		SupportsTools: true, SupportsVision: true, SupportsThinking: true,
+		MaxOutputTokens: 64000, DefaultMaxTokens: 32000, ContextWindow: defaultContextWindow,
+	},
+	"claude-3-7-sonnet-20250219": {
+		SupportsTools: true, SupportsVision: true, SupportsThinking: true,
+		MaxOutputTokens: 64000, DefaultMaxTokens: 16384, ContextWindow: defaultContextWindow,
+	},
+	"claude-3-5-haiku-20241022": {
+		SupportsTools: true, SupportsVision: true, SupportsThinking: false,
+		MaxOutputTokens: 8192, DefaultMaxTokens: 8192, ContextWindow: defaultContextWindow,
+	},
+	"claude-haiku-4-5-20251001": {
+		SupportsTools: true, SupportsVision: true, SupportsThinking: true,
+		MaxOutputTokens: 64000, DefaultMaxTokens: 32000, ContextWindow: defaultContextWindow,
+	},
+}
+
+// defaultModelCapability 未登记能力的模型使用的保守默认值
+var defaultModelCapability = ModelCapability{
+	SupportsTools:    true,
+	MaxOutputTokens:  8192,
+	DefaultMaxTokens: 8192,
+	ContextWindow:    defaultContextWindow,
+}
+
+// CapabilityOf 返回模型的能力元数据，model为ModelMap中的模型名或MODEL_ALIASES别名
+func CapabilityOf(model string) ModelCapability {
+	if capability, exists := ModelCapabilities[ResolveModel(model).Canonical]; exists {
+		return capability
+	}
+	return defaultModelCapability
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ModelDefaultMaxTokensOverrides 各模型默认输出上限的覆盖值，键为别名解析后的模型名
+// 由 NewRouter 在启动时按 MODEL_DEFAULT_MAX_TOKENS 解析一次；为空时只使用能力元数据中的默认值
+var ModelDefaultMaxTokensOverrides map[string]int
+
+// ModelDefaultMaxTokensFromEnv 解析环境变量 MODEL_DEFAULT_MAX_TOKENS 定义的各模型默认输出上限
+// 格式为JSON对象：{"模型名或别名": 默认max_tokens}，例如 {"claude-sonnet-4-5": 48000}
+// JSON无效时返回错误且不覆盖任何默认值；模型不存在或取值不在1到模型输出上限之间的条目被忽略并在错误中列出
+func ModelDefaultMaxTokensFromEnv() (map[string]int, error) {
+	return parseModelDefaultMaxTokens(strings.TrimSpace(os.Getenv("MODEL_DEFAULT_MAX_TOKENS")))
+}
+
+// parseModelDefaultMaxTokens 解析默认输出上限JSON，键统一为别名解析后的模型名
+func parseModelDefaultMaxTokens(raw string) (map[string]int, error) {
+	overrides := make(map[string]int)
+	if raw == "" {
+		return overrides, nil
+	}
+
+	var parsed map[string]int
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return overrides, fmt.Errorf("MODEL_DEFAULT_MAX_TOKENS不是有效的JSON对象: %w", err)
+	}
+
+	var invalid []string
+	for model, maxTokens := range parsed {
+		resolution := ResolveModel(strings.TrimSpace(model))
+		if resolution.Source == ModelSourceUnknown {
+			invalid = append(invalid, fmt.Sprintf("%s（模型不存在）", model))
+			continue
+		}
+		if ceiling := CapabilityOf(resolution.Canonical).MaxOutputTokens; maxTokens < 1 || maxTokens > ceiling {
+			invalid = append(invalid, fmt.Sprintf("%s=%d（应在1到%d之间）", model, maxTokens, ceiling))
+			continue
+		}
+		overrides[resolution.Canonical] = maxTokens
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return overrides, fmt.Errorf("MODEL_DEFAULT_MAX_TOKENS中以下条目无效，已忽略: %s", strings.Join(invalid, ", "))
+	}
+	return overrides, nil
+}
+
+// DefaultMaxTokensOf 返回客户端未指定max_tokens时模型使用的输出上限
+// 先查MODEL_DEFAULT_MAX_TOKENS，再使用能力元数据中的默认值
+func DefaultMaxTokensOf(model string) int {
+	if maxTokens, exists := ModelDefaultMaxTokensOverrides[ResolveModel(model).Canonical]; exists {
+		return maxTokens
+	}
+	return CapabilityOf(model).DefaultMaxTokens
+}
@@ -0,0 +1,53 @@
+package config
+
+import "strings"
+
+// SuggestModel 为无法解析的模型名推荐最接近的已配置模型名（ModelMap和MODEL_ALIASES别名）
+// 按忽略大小写的编辑距离选择，距离超过模型名长度的1/3时认为不相近，返回空字符串
+func SuggestModel(model string) string {
+	target := strings.ToLower(strings.TrimSpace(model))
+	if target == "" {
+		return ""
+	}
+
+	candidates := make([]string, 0, len(ModelMap))
+	for name := range ModelMap {
+		candidates = append(candidates, name)
+	}
+	aliases, _ := ModelAliases()
+	for alias := range aliases {
+		candidates = append(candidates, alias)
+	}
+
+	best, bestDistance := "", len([]rune(target))/3+1
+	for _, candidate := range candidates {
+		distance := levenshtein(target, strings.ToLower(candidate))
+		// 距离相同时选择字典序较小的，保证结果稳定
+		if distance < bestDistance || (distance == bestDistance && best != "" && candidate < best) {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best
+}
+
+// levenshtein 计算两个字符串按字符（rune）的编辑距离
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
@@ -11,15 +11,264 @@ const (
 	// 用于所有解析器，防止死循环
 	ParserMaxErrors = 5
 
+	// NonStreamParseTimeout 非流式响应解析的超时时间
+	// 超时后若已解析出部分内容，则以 stop_reason "error" 返回部分结果
+	NonStreamParseTimeout = 10 * time.Second
+
+	// MaxOpenContentBlocks 一条流式消息中同时打开（已start未stop）的content_block上限
+	// 正常情况下同时打开的块不超过2个，超过上限说明上游事件异常，流以错误结束
+	MaxOpenContentBlocks = 64
+
+	// MaxActiveTools 一次解析中同时进行（已开始未结束）的工具调用上限
+	// 低于MaxOpenContentBlocks，超过上限说明上游只开始不结束工具调用，流以错误结束
+	MaxActiveTools = 32
+
+	// DefaultMaxClientTimeout 客户端通过X-Kiro-Timeout-Ms指定的超时上限（可通过MAX_CLIENT_TIMEOUT覆盖）
+	DefaultMaxClientTimeout = 10 * time.Minute
+
+	// DefaultSlowClientGrace 流式响应的下发队列持续写满超过该时长即判定为慢客户端并结束流（可通过SLOW_CLIENT_GRACE覆盖）
+	DefaultSlowClientGrace = 30 * time.Second
+
+	// DownstreamQueueSize 每个流式响应在上游读取与HTTP写出之间缓冲的最大写入块数
+	DownstreamQueueSize = 256
+
 	// ========== Token缓存配置 ==========
 
 	// TokenCacheTTL Token缓存的生存时间
 	// 过期后需要重新刷新
 	TokenCacheTTL = 5 * time.Minute
 
+	// DefaultExpirySkew token过期判断的默认提前量（可通过EXPIRY_SKEW覆盖）
+	// 在ExpiresAt之前这段时间即视为过期，提前刷新以容忍本机与身份提供方的时钟偏差
+	DefaultExpirySkew = 1 * time.Minute
+
+	// MaxExpirySkew 过期提前量的上限，避免配置过大导致token刚刷新就被视为过期
+	MaxExpirySkew = 30 * time.Minute
+
+	// MaxTokenErrorPenalty 出错token短暂禁选时长的上限（TOKEN_ERROR_PENALTY）
+	// 禁选只用于平滑瞬时错误，持续故障由健康评分降权处理
+	MaxTokenErrorPenalty = 5 * time.Minute
+
+	// DefaultTokenRefreshRetries 刷新遇到网络错误或5xx时的默认重试次数（可通过TOKEN_REFRESH_RETRIES覆盖）
+	DefaultTokenRefreshRetries = 2
+
+	// MaxTokenRefreshRetries 刷新重试次数的上限，避免刷新长时间阻塞请求
+	MaxTokenRefreshRetries = 5
+
+	// DefaultTokenRefreshRetryDelay 刷新首次重试前的等待时长，之后每次翻倍（可通过TOKEN_REFRESH_RETRY_DELAY覆盖）
+	DefaultTokenRefreshRetryDelay = 500 * time.Millisecond
+
+	// MaxTokenRefreshRetryDelay 刷新单次重试等待时长的上限
+	MaxTokenRefreshRetryDelay = 5 * time.Second
+
+	// UsageHardTTL 用量数据的硬TTL（可通过USAGE_HARD_TTL覆盖）
+	// 超过TokenCacheTTL的用量数据仍可使用但降低权重，超过硬TTL则不再信任其剩余额度
+	UsageHardTTL = 30 * time.Minute
+
+	// UsageCacheTTL 同一token用量检查结果的复用时长（可通过USAGE_CACHE_TTL覆盖）
+	UsageCacheTTL = 30 * time.Second
+
+	// UsageCheckFailOpenTTL USAGE_CHECK_FAILURE_MODE=open时，用量检查因上游不可达失败的token被乐观使用的时长
+	// 可通过USAGE_CHECK_FAIL_OPEN_TTL覆盖；超过后视为用量数据硬过期，直到重新检查成功
+	UsageCheckFailOpenTTL = 2 * time.Minute
+
+	// UsageCheckFailOpenAvailable 乐观使用期间假定的剩余次数，限制未经确认的请求数
+	UsageCheckFailOpenAvailable = 20.0
+
+	// BanRecheckInterval 已封禁账号在重新检查前跳过刷新和用量检查的时长（可通过BAN_RECHECK_INTERVAL覆盖）
+	BanRecheckInterval = 6 * time.Hour
+
+	// TokenUsageStaleWeight 用量数据过期（超过TokenCacheTTL）的token在选择时的权重系数
+	TokenUsageStaleWeight = 0.1
+
+	// UsageHardStaleWait 仅剩用量数据超过硬TTL的token时，等待后台刷新的最长时间
+	UsageHardStaleWait = 2 * time.Second
+
+	// TokenStaleRefreshMinInterval 因用量数据过期触发后台刷新的最小间隔，避免刷新失败时反复重试
+	TokenStaleRefreshMinInterval = 30 * time.Second
+
+	// TokenStatusSyncInterval Dashboard token状态从token管理器缓存同步的周期（只读本地缓存，不发起上游请求）
+	TokenStatusSyncInterval = 30 * time.Second
+
+	// TokenStatusQueueSize token状态显式检查队列容量
+	TokenStatusQueueSize = 256
+
+	// DefaultTokenStatusWorkers 并行检查token状态的默认协程数（可通过TOKEN_STATUS_WORKERS覆盖）
+	DefaultTokenStatusWorkers = 4
+
+	// MaxTokenStatusWorkers token状态检查协程数的上限，避免同时发起过多刷新请求
+	MaxTokenStatusWorkers = 16
+
 	// HTTPClientKeepAlive HTTP客户端Keep-Alive间隔
 	HTTPClientKeepAlive = 30 * time.Second
 
 	// HTTPClientTLSHandshakeTimeout HTTP客户端TLS握手超时
 	HTTPClientTLSHandshakeTimeout = 15 * time.Second
+
+	// ========== Token健康评分配置 ==========
+
+	// TokenHealthEWMAAlpha 错误率与延迟的指数加权移动平均系数，越大越偏重最近的请求
+	TokenHealthEWMAAlpha = 0.3
+
+	// TokenHealthDecayHalfLife 错误率的衰减半衰期，降级的token在没有新失败时逐渐恢复
+	TokenHealthDecayHalfLife = 5 * time.Minute
+
+	// TokenHealthReferenceLatency 延迟得分为0.5时对应的延迟
+	TokenHealthReferenceLatency = 5 * time.Second
+
+	// TokenHealthReferenceCredits 额度得分为0.5时对应的剩余可用次数
+	TokenHealthReferenceCredits = 50.0
+
+	// TokenHealthLatencyWeight / CreditWeight 延迟与剩余额度在评分中的权重（合计为1）
+	// 成功率作为乘数作用于两者之和
+	TokenHealthLatencyWeight = 0.4
+	TokenHealthCreditWeight  = 0.6
+
+	// TokenHealthMinWeight 随机选择时的最小权重，保证低分token仍有少量流量以便恢复
+	TokenHealthMinWeight = 0.01
+
+	// ========== 多副本共享状态配置 ==========
+
+	// ClusterRedisTimeout 单次共享状态读写的超时时间，超时视为Redis不可用
+	ClusterRedisTimeout = 200 * time.Millisecond
+
+	// ClusterRetryInterval Redis不可用后再次尝试的间隔，期间只使用本地状态
+	ClusterRetryInterval = 5 * time.Second
+
+	// ClusterInFlightTTL 进行中请求计数的过期时间，避免副本崩溃等原因未释放的计数长期残留
+	ClusterInFlightTTL = 10 * time.Minute
+
+	// ClusterUsageTTL 共享用量快照及其已用次数的过期时间，与用量数据的硬TTL一致
+	ClusterUsageTTL = UsageHardTTL
+
+	// ========== 模型映射校验配置 ==========
+
+	// ModelValidationCacheTTL 模型映射校验结果的缓存时间
+	// 每次校验都会向上游发送真实请求，缓存避免重复消耗额度
+	ModelValidationCacheTTL = 6 * time.Hour
+
+	// ModelValidationForceInterval 两次强制校验（?force=true）之间的最小间隔
+	ModelValidationForceInterval = time.Minute
+
+	// ========== 请求归属配置 ==========
+
+	// RequestIndexSize 内存中保留的最近请求归属记录数
+	// 供 GET /api/requests/:request_id 查询，超出后淘汰最旧的记录
+	RequestIndexSize = 1000
+
+	// ========== SSE续传配置 ==========
+
+	// SSEResumeWindow 流式响应最后一次活动后，客户端可携带Last-Event-ID续传的时长
+	// 可通过 SSE_RESUME_WINDOW_SECONDS 覆盖
+	SSEResumeWindow = 60 * time.Second
+
+	// SSEResumeMaxStreams 内存中保留的可续传流数量上限
+	SSEResumeMaxStreams = 1000
+
+	// SSEResumeMaxStreamBytes 单个流缓存的帧字节数上限，超过后该流被淘汰、不可续传
+	SSEResumeMaxStreamBytes = 4 << 20
+
+	// SSEResumeMaxTotalBytes 所有可续传流缓存的帧字节数上限，超过后依次淘汰最久未活动的流
+	SSEResumeMaxTotalBytes = 256 << 20
+
+	// ========== 内容审核配置 ==========
+
+	// ModerationWebhookTimeout 审核webhook的默认超时时间
+	// 可通过 MODERATION_WEBHOOK_TIMEOUT_MS 覆盖
+	ModerationWebhookTimeout = 3 * time.Second
+
+	// ========== 单请求额度预算配置 ==========
+
+	// DefaultCreditsPer1KInputTokens 估算请求额度时每1000个输入token计入的额度
+	// 可通过 CREDITS_PER_1K_INPUT_TOKENS 覆盖
+	DefaultCreditsPer1KInputTokens = 0.1
+
+	// DefaultCreditsPer1KOutputTokens 估算请求额度时每1000个输出token（按max_tokens）计入的额度
+	// 可通过 CREDITS_PER_1K_OUTPUT_TOKENS 覆盖
+	DefaultCreditsPer1KOutputTokens = 0.5
+
+	// DefaultCostGuardMaxTokens 请求未指定max_tokens时按此输出上限估算
+	DefaultCostGuardMaxTokens = 16384
+
+	// ========== token对账配置 ==========
+
+	// AccountingRetentionDays 按账号累计估算token与额度消耗的保留天数
+	AccountingRetentionDays = 8
+
+	// ReconciliationReportDays 保留的每日对账报告数
+	ReconciliationReportDays = 30
+
+	// ReconciliationAlertPercent 估算与实际额度消耗相差超过该百分比时告警
+	// 可通过 RECONCILIATION_ALERT_PERCENT 覆盖
+	ReconciliationAlertPercent = 25.0
+
+	// ReconciliationMinRequests 账号当天请求数少于该值时不告警（样本太少，偏差没有意义）
+	ReconciliationMinRequests = 20
+
+	// ReconciliationRunOffset 每天零点之后多久生成前一天的对账报告，留出时间完成最后一次用量刷新
+	ReconciliationRunOffset = 10 * time.Minute
+
+	// ReconciliationWebhookTimeout 对账告警webhook的超时时间
+	ReconciliationWebhookTimeout = 5 * time.Second
+
+	// ========== 账号池额度告警配置 ==========
+
+	// PoolBurnRateWindow 计算账号池额度消耗速率的时间窗口
+	PoolBurnRateWindow = time.Hour
+
+	// PoolAlertWebhookTimeout 账号池额度告警webhook的超时时间
+	PoolAlertWebhookTimeout = 5 * time.Second
+
+	// ========== token错误记录配置 ==========
+
+	// TokenErrorHistorySize 每个账号保留的最近错误条数
+	TokenErrorHistorySize = 20
+
+	// TokenErrorMessageMaxLength 错误记录中消息的最大长度（字节），超出部分截断
+	TokenErrorMessageMaxLength = 300
+
+	// TokenErrorSaveDelay 错误记录持久化的合并间隔，连续失败时不必每次都写文件
+	TokenErrorSaveDelay = 5 * time.Second
+
+	// ========== 导出配置 ==========
+
+	// ExportFlushRows 流式导出每写出多少行Flush一次，使客户端持续收到数据而不必等整份导出生成完
+	ExportFlushRows = 100
+
+	// ========== 提示词缓存估算配置 ==========
+
+	// PromptCacheTTL 估算的缓存前缀有效期，与Anthropic提示词缓存默认的5分钟一致，命中时刷新
+	PromptCacheTTL = 5 * time.Minute
+
+	// PromptCacheMinTokens 可缓存前缀的最小token数，更短的前缀Anthropic不会缓存
+	PromptCacheMinTokens = 1024
+
+	// PromptCacheMaxEntries 记录的缓存前缀数量上限，超出时先清理过期的前缀
+	PromptCacheMaxEntries = 10000
+
+	// ========== 估算准确度配置 ==========
+
+	// EstimationAccuracySamples 每个模型保留的最近估算样本数（估算token与上游报告的token）
+	// 供 GET /api/tokens/estimation-accuracy 统计误差，超出后覆盖最旧的样本
+	EstimationAccuracySamples = 1000
+
+	// ========== 公平排队配置 ==========
+
+	// DefaultFairQueueTimeout 请求在准入队列中等待的上限，超过后返回503（可通过FAIR_QUEUE_TIMEOUT覆盖）
+	DefaultFairQueueTimeout = 60 * time.Second
+
+	// FairQueueWaitSamples 每个客户端密钥保留的最近排队等待时间样本数，供 GET /api/keys/usage 统计分位数
+	FairQueueWaitSamples = 1000
+
+	// ========== HTTP服务器配置 ==========
+
+	// DefaultServerReadHeaderTimeout 读取请求头的超时时间，防止slowloris占用连接（可通过SERVER_READ_HEADER_TIMEOUT覆盖）
+	DefaultServerReadHeaderTimeout = 10 * time.Second
+
+	// DefaultServerWriteTimeout 非流式响应从读完请求头到写完响应的上限（可通过SERVER_WRITE_TIMEOUT覆盖）
+	// 需覆盖客户端超时上限和排队时间；流式响应开始下发时清除该期限
+	DefaultServerWriteTimeout = 15 * time.Minute
+
+	// DefaultServerIdleTimeout keep-alive连接的空闲回收时间（可通过SERVER_IDLE_TIMEOUT覆盖）
+	DefaultServerIdleTimeout = 120 * time.Second
 )
@@ -0,0 +1,8 @@
+package config
+
+// 构建信息，发布构建时通过ldflags注入：
+// go build -ldflags "-X kiro2api/config.Version=v1.2.3 -X kiro2api/config.Commit=abc1234"
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
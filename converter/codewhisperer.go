@@ -19,6 +19,15 @@ import (
 // normalizeReferences 标准化引用
 // CodeWhisperer格式转换器
 
+// DisableParallelToolUseInstruction tool_choice.disable_parallel_tool_use 为true时追加到系统提示的指令
+const DisableParallelToolUseInstruction = "Call at most one tool per response. Do not make parallel tool calls."
+
+// DeterministicSamplingInstruction temperature=0 时追加到系统提示的确定性提示（上游不接受采样参数）
+const DeterministicSamplingInstruction = "Be deterministic: for the same input, always give the same, most likely answer without creative variation."
+
+// JSONObjectInstruction response_format=json_object 时追加到系统提示的JSON输出要求（上游没有JSON模式）
+const JSONObjectInstruction = "Respond with a single valid JSON object only. Do not wrap it in markdown code fences and do not add any text before or after it."
+
 // determineChatTriggerType 智能确定聊天触发类型 (SOLID-SRP: 单一责任)
 func determineChatTriggerType(anthropicReq types.AnthropicRequest) string {
 	// 如果有工具调用，通常是自动触发的
@@ -280,8 +289,8 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 		}
 	}
 
-	// 检查模型映射是否存在，如果不存在则返回错误
-	modelId := config.ModelMap[anthropicReq.Model]
+	// 检查模型映射是否存在（含MODEL_ALIASES自定义别名），如果不存在则返回错误
+	modelId := config.ResolveModelID(anthropicReq.Model)
 	if modelId == "" {
 		logger.Warn("模型映射不存在",
 			logger.String("requested_model", anthropicReq.Model),
@@ -345,7 +354,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 	}
 
 	// 构建历史消息
-	if len(anthropicReq.System) > 0 || len(anthropicReq.Messages) > 1 || len(anthropicReq.Tools) > 0 {
+	if len(anthropicReq.System) > 0 || len(anthropicReq.Messages) > 1 || len(anthropicReq.Tools) > 0 || anthropicReq.DeterministicSampling() || anthropicReq.JSONObjectMode() {
 		var history []any
 
 		// 构建综合系统提示
@@ -362,6 +371,24 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			}
 		}
 
+		// 上游没有并行工具调用开关，以指令形式转发 disable_parallel_tool_use
+		if len(anthropicReq.Tools) > 0 && anthropicReq.ParallelToolUseDisabled() {
+			systemContentBuilder.WriteString(DisableParallelToolUseInstruction)
+			systemContentBuilder.WriteString("\n")
+		}
+
+		// 上游没有temperature参数，temperature=0 以确定性提示转发
+		if anthropicReq.DeterministicSampling() {
+			systemContentBuilder.WriteString(DeterministicSamplingInstruction)
+			systemContentBuilder.WriteString("\n")
+		}
+
+		// 上游没有JSON模式，response_format=json_object 以输出要求转发
+		if anthropicReq.JSONObjectMode() {
+			systemContentBuilder.WriteString(JSONObjectInstruction)
+			systemContentBuilder.WriteString("\n")
+		}
+
 		// 如果有系统内容，添加到历史记录 (恢复v0.4结构化类型)
 		if systemContentBuilder.Len() > 0 {
 			userMsg := types.HistoryUserMessage{}
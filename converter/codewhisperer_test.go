@@ -76,6 +76,37 @@ func TestBuildCodeWhispererRequest_WithSystemMessage(t *testing.T) {
 	assert.Greater(t, len(cwReq.ConversationState.History), 0)
 }
 
+func TestBuildCodeWhispererRequest_DeterministicSampling(t *testing.T) {
+	systemContent := func(temperature float64) string {
+		cwReq, err := BuildCodeWhispererRequest(types.AnthropicRequest{
+			Model:       "claude-sonnet-4-20250514",
+			MaxTokens:   1024,
+			Temperature: &temperature,
+			Messages:    []types.AnthropicRequestMessage{{Role: "user", Content: "Hello!"}},
+		}, nil)
+		require.NoError(t, err)
+		if len(cwReq.ConversationState.History) == 0 {
+			return ""
+		}
+		return cwReq.ConversationState.History[0].(types.HistoryUserMessage).UserInputMessage.Content
+	}
+
+	assert.Equal(t, DeterministicSamplingInstruction, systemContent(0))
+	assert.Empty(t, systemContent(0.7))
+}
+
+func TestBuildCodeWhispererRequest_JSONObjectMode(t *testing.T) {
+	cwReq, err := BuildCodeWhispererRequest(types.AnthropicRequest{
+		Model:          "claude-sonnet-4-20250514",
+		MaxTokens:      1024,
+		ResponseFormat: types.ResponseFormatJSONObject,
+		Messages:       []types.AnthropicRequestMessage{{Role: "user", Content: "Hello!"}},
+	}, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, cwReq.ConversationState.History)
+	assert.Equal(t, JSONObjectInstruction, cwReq.ConversationState.History[0].(types.HistoryUserMessage).UserInputMessage.Content)
+}
+
 func TestBuildCodeWhispererRequest_WithTools(t *testing.T) {
 	anthropicReq := types.AnthropicRequest{
 		Model:     "claude-sonnet-4-20250514",
@@ -145,7 +145,7 @@ func parseContentBlock(block map[string]any) (types.ContentBlock, error) {
 			contentBlock.Text = &text
 		} else {
 			logger.Warn("文本块缺少text字段或不是字符串",
-				logger.String("text_value", fmt.Sprintf("%v", block["text"])),
+				logger.Content("text_value", block["text"]),
 				logger.String("text_type", fmt.Sprintf("%T", block["text"])))
 		}
 
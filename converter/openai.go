@@ -4,6 +4,7 @@ import (
 	"strings"
 	"time"
 
+	"kiro2api/config"
 	"kiro2api/types"
 	"kiro2api/utils"
 )
@@ -30,10 +31,10 @@ func ConvertOpenAIToAnthropic(openaiReq types.OpenAIRequest) types.AnthropicRequ
 		anthropicMessages = append(anthropicMessages, anthropicMsg)
 	}
 
-	// 设置默认值
-	maxTokens := 16384
-	if openaiReq.MaxTokens != nil {
-		maxTokens = *openaiReq.MaxTokens
+	// 优先max_completion_tokens，都未指定时使用模型的默认值
+	maxTokens, explicit := openaiReq.RequestedMaxTokens()
+	if !explicit {
+		maxTokens = config.DefaultMaxTokensOf(openaiReq.Model)
 	}
 
 	// 为了增强兼容性，当stream未设置时默认为false（非流式响应）
@@ -53,6 +54,15 @@ func ConvertOpenAIToAnthropic(openaiReq types.OpenAIRequest) types.AnthropicRequ
 	if openaiReq.Temperature != nil {
 		anthropicReq.Temperature = openaiReq.Temperature
 	}
+	anthropicReq.TopP = openaiReq.TopP
+
+	if len(openaiReq.Stop) > 0 {
+		anthropicReq.StopSequences = []string(openaiReq.Stop)
+	}
+
+	if openaiReq.ResponseFormat != nil {
+		anthropicReq.ResponseFormat = openaiReq.ResponseFormat.Type
+	}
 
 	// 转换 tools
 	if len(openaiReq.Tools) > 0 {
@@ -70,6 +80,16 @@ func ConvertOpenAIToAnthropic(openaiReq types.OpenAIRequest) types.AnthropicRequ
 		anthropicReq.ToolChoice = convertOpenAIToolChoiceToAnthropic(openaiReq.ToolChoice)
 	}
 
+	// parallel_tool_calls=false 转换为 tool_choice.disable_parallel_tool_use
+	if openaiReq.ParallelToolCalls != nil && !*openaiReq.ParallelToolCalls && len(anthropicReq.Tools) > 0 {
+		toolChoice, ok := anthropicReq.ToolChoice.(*types.ToolChoice)
+		if !ok || toolChoice == nil {
+			toolChoice = &types.ToolChoice{Type: "auto"}
+		}
+		toolChoice.DisableParallelToolUse = true
+		anthropicReq.ToolChoice = toolChoice
+	}
+
 	return anthropicReq
 }
 
@@ -148,6 +168,11 @@ func ConvertAnthropicToOpenAI(anthropicResp map[string]any, model string, messag
 		content = strings.Join(textParts, "")
 	}
 
+	// 模型拒绝回答：映射为OpenAI的content_filter
+	if stopReason, _ := anthropicResp["stop_reason"].(string); stopReason == "refusal" {
+		finishReason = "content_filter"
+	}
+
 	// 计算token使用量
 	promptTokens := 0
 	completionTokens := len(content) / 4 // 简单估算
@@ -164,6 +189,9 @@ func ConvertAnthropicToOpenAI(anthropicResp map[string]any, model string, messag
 		Role:    "assistant",
 		Content: content,
 	}
+	if finishReason == "content_filter" {
+		message.Refusal, _ = anthropicResp["refusal"].(string)
+	}
 
 	// 只有当有tool_calls时才添加ToolCalls字段
 	if len(toolCalls) > 0 {
@@ -3,9 +3,12 @@ package converter
 import (
 	"testing"
 
+	"kiro2api/config"
 	"kiro2api/types"
+	"kiro2api/utils"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConvertOpenAIToAnthropic_BasicMessage(t *testing.T) {
@@ -102,8 +105,51 @@ func TestConvertOpenAIToAnthropic_DefaultMaxTokens(t *testing.T) {
 
 	anthropicReq := ConvertOpenAIToAnthropic(openaiReq)
 
-	// 应该使用默认值16384
-	assert.Equal(t, 16384, anthropicReq.MaxTokens)
+	// 未登记的模型使用保守默认值
+	assert.Equal(t, config.DefaultMaxTokensOf("gpt-4"), anthropicReq.MaxTokens)
+	assert.Equal(t, 8192, anthropicReq.MaxTokens)
+
+	// 长输出模型的默认值更高
+	openaiReq.Model = "claude-sonnet-4-20250514"
+	assert.Equal(t, config.ModelCapabilities["claude-sonnet-4-20250514"].DefaultMaxTokens, ConvertOpenAIToAnthropic(openaiReq).MaxTokens)
+}
+
+func TestConvertOpenAIToAnthropic_MaxCompletionTokens(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	tests := []struct {
+		name                string
+		maxTokens           *int
+		maxCompletionTokens *int
+		expected            int
+		conflict            bool
+	}{
+		{name: "只有max_tokens", maxTokens: intPtr(1000), expected: 1000},
+		{name: "只有max_completion_tokens", maxCompletionTokens: intPtr(2000), expected: 2000},
+		{name: "同时指定时优先max_completion_tokens", maxTokens: intPtr(1000), maxCompletionTokens: intPtr(2000), expected: 2000, conflict: true},
+		{name: "同时指定且取值相同不算冲突", maxTokens: intPtr(2000), maxCompletionTokens: intPtr(2000), expected: 2000},
+		{name: "都未指定时使用默认值", expected: config.ModelCapabilities["claude-sonnet-4-20250514"].DefaultMaxTokens},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openaiReq := types.OpenAIRequest{
+				Model:               "claude-sonnet-4-20250514",
+				Messages:            []types.OpenAIMessage{{Role: "user", Content: "Test"}},
+				MaxTokens:           tt.maxTokens,
+				MaxCompletionTokens: tt.maxCompletionTokens,
+			}
+			assert.Equal(t, tt.expected, ConvertOpenAIToAnthropic(openaiReq).MaxTokens)
+			assert.Equal(t, tt.conflict, openaiReq.MaxTokensConflict())
+		})
+	}
+}
+
+func TestOpenAIRequest_ReasoningParams(t *testing.T) {
+	var openaiReq types.OpenAIRequest
+	body := `{"model":"claude-sonnet-4-20250514","messages":[{"role":"user","content":"hi"}],"max_completion_tokens":4096,"reasoning_effort":"high"}`
+	require.NoError(t, utils.SafeUnmarshal([]byte(body), &openaiReq))
+
+	assert.Equal(t, "high", openaiReq.ReasoningEffort)
+	assert.Equal(t, 4096, ConvertOpenAIToAnthropic(openaiReq).MaxTokens)
 }
 
 func TestConvertOpenAIToAnthropic_StreamDefault(t *testing.T) {
@@ -123,6 +169,23 @@ func TestConvertOpenAIToAnthropic_StreamDefault(t *testing.T) {
 	assert.False(t, anthropicReq.Stream)
 }
 
+func TestConvertOpenAIToAnthropic_ResponseFormat(t *testing.T) {
+	openaiReq := types.OpenAIRequest{
+		Model:          "gpt-4",
+		Messages:       []types.OpenAIMessage{{Role: "user", Content: "Test"}},
+		ResponseFormat: &types.OpenAIResponseFormat{Type: "json_object"},
+	}
+
+	anthropicReq := ConvertOpenAIToAnthropic(openaiReq)
+	assert.True(t, anthropicReq.JSONObjectMode())
+
+	// 未指定或为text时不进入JSON模式
+	openaiReq.ResponseFormat = &types.OpenAIResponseFormat{Type: "text"}
+	assert.False(t, ConvertOpenAIToAnthropic(openaiReq).JSONObjectMode())
+	openaiReq.ResponseFormat = nil
+	assert.False(t, ConvertOpenAIToAnthropic(openaiReq).JSONObjectMode())
+}
+
 func TestConvertAnthropicToOpenAI_BasicResponse(t *testing.T) {
 	anthropicResp := map[string]any{
 		"id":   "msg_123",
@@ -189,6 +252,7 @@ func TestConvertAnthropicToOpenAI_StopReasonMapping(t *testing.T) {
 		{"end_turn映射为stop", "end_turn", "stop"},
 		{"max_tokens映射为stop", "max_tokens", "stop"},
 		{"stop_sequence映射为stop", "stop_sequence", "stop"},
+		{"refusal映射为content_filter", "refusal", "content_filter"},
 	}
 
 	for _, tt := range tests {
@@ -213,6 +277,20 @@ func TestConvertAnthropicToOpenAI_StopReasonMapping(t *testing.T) {
 	}
 }
 
+func TestConvertAnthropicToOpenAI_Refusal(t *testing.T) {
+	anthropicResp := map[string]any{
+		"content":     []map[string]any{},
+		"stop_reason": "refusal",
+		"refusal":     "Request blocked by content policy",
+	}
+
+	openaiResp := ConvertAnthropicToOpenAI(anthropicResp, "claude-sonnet-4-20250514", "chatcmpl-test")
+
+	require.Len(t, openaiResp.Choices, 1)
+	assert.Equal(t, "content_filter", openaiResp.Choices[0].FinishReason)
+	assert.Equal(t, "Request blocked by content policy", openaiResp.Choices[0].Message.Refusal)
+}
+
 func TestConvertOpenAIToAnthropic_EmptyMessages(t *testing.T) {
 	openaiReq := types.OpenAIRequest{
 		Model:    "gpt-4",
@@ -239,3 +317,86 @@ func TestConvertAnthropicToOpenAI_EmptyContent(t *testing.T) {
 	assert.Len(t, openaiResp.Choices, 1)
 	assert.Empty(t, openaiResp.Choices[0].Message.Content)
 }
+
+func TestConvertOpenAIToAnthropic_StopParameter(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []string
+	}{
+		{"字符串形式", `{"model":"gpt-4","messages":[],"stop":"END"}`, []string{"END"}},
+		{"数组形式", `{"model":"gpt-4","messages":[],"stop":["\n\n","END"]}`, []string{"\n\n", "END"}},
+		{"null", `{"model":"gpt-4","messages":[],"stop":null}`, nil},
+		{"未设置", `{"model":"gpt-4","messages":[]}`, nil},
+		{"忽略空字符串", `{"model":"gpt-4","messages":[],"stop":["","END"]}`, []string{"END"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var openaiReq types.OpenAIRequest
+			require.NoError(t, utils.SafeUnmarshal([]byte(tt.body), &openaiReq))
+
+			anthropicReq := ConvertOpenAIToAnthropic(openaiReq)
+			assert.Equal(t, tt.expected, anthropicReq.StopSequences)
+		})
+	}
+}
+
+func TestOpenAIRequest_InvalidStopParameter(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		errContains string
+	}{
+		{"超过4个", `{"model":"gpt-4","messages":[],"stop":["a","b","c","d","e"]}`, "最多支持4个"},
+		{"非字符串成员", `{"model":"gpt-4","messages":[],"stop":["a",1]}`, "必须是字符串"},
+		{"数字", `{"model":"gpt-4","messages":[],"stop":42}`, "字符串或字符串数组"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var openaiReq types.OpenAIRequest
+			err := utils.SafeUnmarshal([]byte(tt.body), &openaiReq)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errContains)
+		})
+	}
+}
+
+func TestConvertOpenAIToAnthropic_ParallelToolCalls(t *testing.T) {
+	const tools = `"tools":[{"type":"function","function":{"name":"get_weather","description":"d","parameters":{"type":"object","properties":{}}}}]`
+	tests := []struct {
+		name     string
+		body     string
+		disabled bool
+		choice   string
+	}{
+		{"关闭并行", `{"model":"gpt-4","messages":[],` + tools + `,"parallel_tool_calls":false}`, true, "auto"},
+		{"关闭并行且指定工具", `{"model":"gpt-4","messages":[],` + tools + `,"parallel_tool_calls":false,"tool_choice":"required"}`, true, "any"},
+		{"允许并行", `{"model":"gpt-4","messages":[],` + tools + `,"parallel_tool_calls":true}`, false, ""},
+		{"未设置", `{"model":"gpt-4","messages":[],` + tools + `}`, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var openaiReq types.OpenAIRequest
+			require.NoError(t, utils.SafeUnmarshal([]byte(tt.body), &openaiReq))
+
+			anthropicReq := ConvertOpenAIToAnthropic(openaiReq)
+			assert.Equal(t, tt.disabled, anthropicReq.ParallelToolUseDisabled())
+			if tt.choice != "" {
+				assert.Equal(t, tt.choice, anthropicReq.ToolChoice.(*types.ToolChoice).Type)
+			}
+		})
+	}
+}
+
+func TestConvertOpenAIToAnthropic_SamplingParams(t *testing.T) {
+	var openaiReq types.OpenAIRequest
+	require.NoError(t, utils.SafeUnmarshal([]byte(`{"model":"gpt-4","messages":[],"temperature":0,"top_p":0.5}`), &openaiReq))
+
+	anthropicReq := ConvertOpenAIToAnthropic(openaiReq)
+	assert.True(t, anthropicReq.DeterministicSampling())
+	require.NotNil(t, anthropicReq.TopP)
+	assert.Equal(t, 0.5, *anthropicReq.TopP)
+}
@@ -0,0 +1,269 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+)
+
+// MaxUpstreamToolNameLength 上游接受的工具名称最大长度
+const MaxUpstreamToolNameLength = 64
+
+// fallbackToolName 工具名称不含任何可用字符（如纯中文）时使用的名称
+const fallbackToolName = "tool"
+
+// isUpstreamToolNameChar 上游工具名称允许的字符：ASCII字母、数字、下划线和连字符
+func isUpstreamToolNameChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-'
+}
+
+// isUpstreamToolName 名称是否可以原样发送给上游
+func isUpstreamToolName(name string) bool {
+	if name == "" || len(name) > MaxUpstreamToolNameLength {
+		return false
+	}
+	for _, r := range name {
+		if !isUpstreamToolNameChar(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeToolName 将名称转换为上游可接受的形式：连续的非法字符替换为一个下划线，超长截断
+func sanitizeToolName(name string) string {
+	var b strings.Builder
+	replaced := false
+	hasAlnum := false
+	for _, r := range name {
+		if !isUpstreamToolNameChar(r) {
+			if !replaced {
+				b.WriteByte('_')
+			}
+			replaced = true
+			continue
+		}
+		replaced = false
+		if r != '_' && r != '-' {
+			hasAlnum = true
+		}
+		b.WriteRune(r)
+	}
+	if !hasAlnum {
+		return fallbackToolName
+	}
+	sanitized := b.String()
+	if len(sanitized) > MaxUpstreamToolNameLength {
+		sanitized = sanitized[:MaxUpstreamToolNameLength]
+	}
+	return sanitized
+}
+
+// toolNameMapping 单个请求内原始工具名与上游工具名的双向映射
+type toolNameMapping struct {
+	upstream map[string]string // 原始名称 -> 上游名称
+	used     map[string]bool   // 已占用的上游名称
+	original map[string]string // 上游名称 -> 原始名称（仅包含被改写的名称）
+}
+
+// newToolNameMapping 按出现顺序为名称分配上游名称
+// 合法名称原样保留并优先占用；需要改写的名称与已占用名称冲突时依次追加 _2、_3 …
+func newToolNameMapping(names []string) *toolNameMapping {
+	m := &toolNameMapping{
+		upstream: make(map[string]string),
+		used:     make(map[string]bool),
+		original: make(map[string]string),
+	}
+	for _, name := range names {
+		if isUpstreamToolName(name) {
+			m.upstream[name] = name
+			m.used[name] = true
+		}
+	}
+	for _, name := range names {
+		if _, exists := m.upstream[name]; exists {
+			continue
+		}
+		base := sanitizeToolName(name)
+		candidate := base
+		for n := 2; m.used[candidate]; n++ {
+			suffix := fmt.Sprintf("_%d", n)
+			candidate = base[:min(len(base), MaxUpstreamToolNameLength-len(suffix))] + suffix
+		}
+		m.upstream[name] = candidate
+		m.used[candidate] = true
+		m.original[candidate] = name
+	}
+	return m
+}
+
+// name 返回原始名称对应的上游名称
+func (m *toolNameMapping) name(original string) string {
+	if upstream, exists := m.upstream[original]; exists {
+		return upstream
+	}
+	return original
+}
+
+// SanitizeToolNames 将工具定义、历史tool_use和tool_choice中上游不接受的工具名称（非法字符、超长）改写为安全名称
+// 改写关系记录在返回请求的ToolNames中，下发给客户端的tool_use据此还原原始名称；tool_result按tool_use_id关联，无需改写
+// 所有名称都合法时原样返回，不修改传入的请求
+func SanitizeToolNames(req types.AnthropicRequest) types.AnthropicRequest {
+	names := collectToolNames(req)
+	needed := false
+	for _, name := range names {
+		if !isUpstreamToolName(name) {
+			needed = true
+			break
+		}
+	}
+	if !needed {
+		return req
+	}
+
+	mapping := newToolNameMapping(names)
+	sanitized := req
+
+	sanitized.Tools = make([]types.AnthropicTool, len(req.Tools))
+	for i, tool := range req.Tools {
+		tool.Name = mapping.name(tool.Name)
+		sanitized.Tools[i] = tool
+	}
+
+	sanitized.Messages = make([]types.AnthropicRequestMessage, len(req.Messages))
+	for i, msg := range req.Messages {
+		if msg.Role == "assistant" {
+			msg.Content = renameToolUseBlocks(msg.Content, mapping)
+		}
+		sanitized.Messages[i] = msg
+	}
+
+	sanitized.ToolChoice = renameToolChoice(req.ToolChoice, mapping)
+	sanitized.ToolNames = mapping.original
+
+	for upstream, original := range mapping.original {
+		logger.Debug("工具名称已改写为上游可接受的形式",
+			logger.String("original", original),
+			logger.String("upstream", upstream))
+	}
+	return sanitized
+}
+
+// collectToolNames 按工具定义、历史tool_use、tool_choice的顺序收集去重后的工具名称
+func collectToolNames(req types.AnthropicRequest) []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, tool := range req.Tools {
+		add(tool.Name)
+	}
+	for _, msg := range req.Messages {
+		if msg.Role != "assistant" {
+			continue
+		}
+		switch blocks := msg.Content.(type) {
+		case []any:
+			for _, block := range blocks {
+				if blockMap, ok := block.(map[string]any); ok && blockMap["type"] == "tool_use" {
+					name, _ := blockMap["name"].(string)
+					add(name)
+				}
+			}
+		case []types.ContentBlock:
+			for _, block := range blocks {
+				if block.Type == "tool_use" && block.Name != nil {
+					add(*block.Name)
+				}
+			}
+		}
+	}
+	add(toolChoiceName(req.ToolChoice))
+	return names
+}
+
+// renameToolUseBlocks 返回tool_use名称改写后的内容副本
+func renameToolUseBlocks(content any, mapping *toolNameMapping) any {
+	switch blocks := content.(type) {
+	case []any:
+		renamed := make([]any, len(blocks))
+		for i, block := range blocks {
+			renamed[i] = block
+			blockMap, ok := block.(map[string]any)
+			if !ok || blockMap["type"] != "tool_use" {
+				continue
+			}
+			name, _ := blockMap["name"].(string)
+			if upstream := mapping.name(name); upstream != name {
+				copied := make(map[string]any, len(blockMap))
+				for key, value := range blockMap {
+					copied[key] = value
+				}
+				copied["name"] = upstream
+				renamed[i] = copied
+			}
+		}
+		return renamed
+	case []types.ContentBlock:
+		renamed := make([]types.ContentBlock, len(blocks))
+		for i, block := range blocks {
+			if block.Type == "tool_use" && block.Name != nil {
+				if upstream := mapping.name(*block.Name); upstream != *block.Name {
+					block.Name = &upstream
+				}
+			}
+			renamed[i] = block
+		}
+		return renamed
+	}
+	return content
+}
+
+// toolChoiceName 返回tool_choice指定的工具名称
+func toolChoiceName(toolChoice any) string {
+	switch tc := toolChoice.(type) {
+	case *types.ToolChoice:
+		if tc != nil {
+			return tc.Name
+		}
+	case types.ToolChoice:
+		return tc.Name
+	case map[string]any:
+		name, _ := tc["name"].(string)
+		return name
+	}
+	return ""
+}
+
+// renameToolChoice 返回工具名称改写后的tool_choice副本
+func renameToolChoice(toolChoice any, mapping *toolNameMapping) any {
+	name := toolChoiceName(toolChoice)
+	upstream := mapping.name(name)
+	if upstream == name {
+		return toolChoice
+	}
+	switch tc := toolChoice.(type) {
+	case *types.ToolChoice:
+		copied := *tc
+		copied.Name = upstream
+		return &copied
+	case types.ToolChoice:
+		tc.Name = upstream
+		return tc
+	case map[string]any:
+		copied := make(map[string]any, len(tc))
+		for key, value := range tc {
+			copied[key] = value
+		}
+		copied["name"] = upstream
+		return copied
+	}
+	return toolChoice
+}
@@ -0,0 +1,124 @@
+package converter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func toolsNamed(names ...string) []types.AnthropicTool {
+	tools := make([]types.AnthropicTool, len(names))
+	for i, name := range names {
+		tools[i] = types.AnthropicTool{Name: name, InputSchema: map[string]any{"type": "object"}}
+	}
+	return tools
+}
+
+func TestSanitizeToolNames(t *testing.T) {
+	long := strings.Repeat("a", 100)
+	tests := []struct {
+		name     string
+		tools    []string
+		expected []string
+	}{
+		{"合法名称不变", []string{"get_weather", "read-file"}, []string{"get_weather", "read-file"}},
+		{"点号", []string{"github.create_issue"}, []string{"github_create_issue"}},
+		{"连续非法字符合并", []string{"mcp::fs..read"}, []string{"mcp_fs_read"}},
+		{"中文", []string{"搜索文档"}, []string{"tool"}},
+		{"中文与ASCII混合", []string{"查询weather"}, []string{"_weather"}},
+		{"emoji", []string{"🔍search"}, []string{"_search"}},
+		{"超长截断", []string{long}, []string{long[:MaxUpstreamToolNameLength]}},
+		{"改写后与合法名称冲突", []string{"fs.read", "fs_read"}, []string{"fs_read_2", "fs_read"}},
+		{"多个名称改写后相同", []string{"fs.read", "fs/read", "fs:read"}, []string{"fs_read", "fs_read_2", "fs_read_3"}},
+		{"多个纯中文名称", []string{"搜索", "查询"}, []string{"tool", "tool_2"}},
+		{"超长名称冲突时后缀不超长", []string{long + "x", long + "y"}, []string{long[:64], long[:62] + "_2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := types.AnthropicRequest{Tools: toolsNamed(tt.tools...)}
+			sanitized := SanitizeToolNames(req)
+
+			var got []string
+			for _, tool := range sanitized.Tools {
+				got = append(got, tool.Name)
+				assert.LessOrEqual(t, len(tool.Name), MaxUpstreamToolNameLength)
+				assert.True(t, isUpstreamToolName(tool.Name), tool.Name)
+				assert.Equal(t, tt.tools[len(got)-1], sanitized.OriginalToolName(tool.Name), "应能还原原始名称")
+			}
+			assert.Equal(t, tt.expected, got)
+			for i, tool := range req.Tools {
+				assert.Equal(t, tt.tools[i], tool.Name, "不修改原请求")
+			}
+		})
+	}
+}
+
+func TestSanitizeToolNames_Deterministic(t *testing.T) {
+	req := types.AnthropicRequest{Tools: toolsNamed("a.b", "a/b", "a_b", "工具", "🛠")}
+	first := SanitizeToolNames(req)
+	for range 5 {
+		assert.Equal(t, first.Tools, SanitizeToolNames(req).Tools)
+	}
+}
+
+func TestSanitizeToolNames_HistoryAndToolChoice(t *testing.T) {
+	name := "github.create_issue"
+	req := types.AnthropicRequest{
+		Model: "claude-sonnet-4-20250514",
+		Tools: toolsNamed(name),
+		Messages: []types.AnthropicRequestMessage{
+			{Role: "user", Content: "open an issue"},
+			{Role: "assistant", Content: []any{
+				map[string]any{"type": "text", "text": "ok"},
+				map[string]any{"type": "tool_use", "id": "tu_1", "name": name, "input": map[string]any{}},
+			}},
+			{Role: "user", Content: []any{
+				map[string]any{"type": "tool_result", "tool_use_id": "tu_1", "content": "created"},
+			}},
+			{Role: "assistant", Content: []types.ContentBlock{{Type: "tool_use", ID: strPtr("tu_2"), Name: strPtr("slack.post")}}},
+			{Role: "user", Content: []types.ContentBlock{{Type: "tool_result", ToolUseId: strPtr("tu_2")}}},
+		},
+		ToolChoice: &types.ToolChoice{Type: "tool", Name: name},
+	}
+
+	sanitized := SanitizeToolNames(req)
+	assert.Equal(t, "github_create_issue", sanitized.Tools[0].Name)
+	assert.Equal(t, "github_create_issue", sanitized.Messages[1].Content.([]any)[1].(map[string]any)["name"])
+	assert.Equal(t, "slack_post", *sanitized.Messages[3].Content.([]types.ContentBlock)[0].Name, "不在工具列表中的历史工具同样改写")
+	assert.Equal(t, "github_create_issue", sanitized.ToolChoice.(*types.ToolChoice).Name)
+	assert.Equal(t, map[string]string{"github_create_issue": name, "slack_post": "slack.post"}, sanitized.ToolNames)
+	// tool_result按ID关联，保持不变
+	assert.Equal(t, req.Messages[2], sanitized.Messages[2])
+
+	// 不修改原请求
+	assert.Equal(t, name, req.Tools[0].Name)
+	assert.Equal(t, name, req.Messages[1].Content.([]any)[1].(map[string]any)["name"])
+	assert.Equal(t, "slack.post", *req.Messages[3].Content.([]types.ContentBlock)[0].Name)
+	assert.Equal(t, name, req.ToolChoice.(*types.ToolChoice).Name)
+
+	// 改写后的名称在构建的上游请求中生效
+	cwReq, err := BuildCodeWhispererRequest(sanitized, nil)
+	require.NoError(t, err)
+	data, err := json.Marshal(cwReq)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), name)
+	assert.NotContains(t, string(data), "slack.post")
+}
+
+func TestSanitizeToolNames_NoChange(t *testing.T) {
+	req := types.AnthropicRequest{
+		Tools:      toolsNamed("get_weather"),
+		ToolChoice: map[string]any{"type": "tool", "name": "get_weather"},
+	}
+	sanitized := SanitizeToolNames(req)
+	assert.Nil(t, sanitized.ToolNames)
+	assert.Equal(t, req, sanitized)
+	assert.Equal(t, "unknown", sanitized.OriginalToolName("unknown"))
+}
+
+func strPtr(s string) *string { return &s }
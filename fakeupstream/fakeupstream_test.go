@@ -0,0 +1,136 @@
+package fakeupstream
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/parser"
+	"kiro2api/utils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fastScenario() *Scenario {
+	return &Scenario{Name: "test", ResponseTokens: 5, ChunkText: "hi ", ErrorStatus: 503, Seed: 1}
+}
+
+func generate(t *testing.T, transport *Transport) *http.Response {
+	req := httptest.NewRequest(http.MethodPost, "https://codewhisperer.us-east-1.amazonaws.com/generateAssistantResponse", strings.NewReader("{}"))
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestDefaultScenario(t *testing.T) {
+	scenario := DefaultScenario()
+	assert.Equal(t, "default", scenario.Name)
+	assert.Greater(t, scenario.ResponseTokens, 0)
+	assert.Greater(t, scenario.TokensPerSecond, 0.0)
+}
+
+func TestParseScenario_Validation(t *testing.T) {
+	_, err := parseScenario([]byte(`{"error_rate":1.5}`))
+	assert.Error(t, err)
+
+	_, err = parseScenario([]byte(`{"error_status":200}`))
+	assert.Error(t, err)
+
+	scenario, err := parseScenario([]byte(`{"response_tokens":3}`))
+	require.NoError(t, err)
+	assert.Equal(t, "lorem ", scenario.ChunkText)
+	assert.Equal(t, 500, scenario.ErrorStatus)
+}
+
+func TestTransport_StreamIsSpecCompliant(t *testing.T) {
+	scenario := fastScenario()
+	scenario.ToolCallRate = 1
+	resp := generate(t, NewTransport(scenario))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	result, err := parser.NewCompliantEventStreamParser().ParseResponse(data)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("hi ", 5), result.GetCompletionText())
+
+	tools := result.GetToolCalls()
+	require.Len(t, tools, 1)
+	assert.Equal(t, "fake_tool", tools[0].Name)
+	assert.Equal(t, "synthetic", tools[0].Arguments["query"])
+}
+
+func TestTransport_ErrorInjection(t *testing.T) {
+	scenario := fastScenario()
+	scenario.ErrorRate = 1
+	transport := NewTransport(scenario)
+
+	resp := generate(t, transport)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int64(1), transport.Requests())
+}
+
+func TestTransport_Pacing(t *testing.T) {
+	scenario := fastScenario()
+	scenario.FirstTokenDelayMs = 30
+	scenario.TokensPerSecond = 100 // 5个事件 ≈ 40ms间隔
+	start := time.Now()
+	resp := generate(t, NewTransport(scenario))
+	_, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+}
+
+func TestTransport_StopsOnCancel(t *testing.T) {
+	scenario := fastScenario()
+	scenario.FirstTokenDelayMs = 5000
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/generateAssistantResponse", nil).WithContext(ctx)
+	resp, err := NewTransport(scenario).RoundTrip(req)
+	require.NoError(t, err)
+
+	cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("取消后事件流未结束")
+	}
+}
+
+func TestTransport_TokenAndUsageEndpoints(t *testing.T) {
+	transport := NewTransport(fastScenario())
+	for _, url := range []string{
+		"https://prod.us-east-1.auth.desktop.kiro.dev/refreshToken",
+		"https://oidc.us-east-1.amazonaws.com/token",
+		"https://codewhisperer.us-east-1.amazonaws.com/getUsageLimits?isEmailRequired=true",
+	} {
+		resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodPost, url, nil))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, url)
+
+		var body map[string]any
+		data, _ := io.ReadAll(resp.Body)
+		require.NoError(t, utils.SafeUnmarshal(data, &body))
+		assert.NotEmpty(t, body, url)
+	}
+}
+
+func TestInstall_Restore(t *testing.T) {
+	original := utils.SharedHTTPClient.Transport
+	_, restore := Install(fastScenario())
+	assert.IsType(t, &Transport{}, utils.SharedHTTPClient.Transport)
+	restore()
+	assert.Equal(t, original, utils.SharedHTTPClient.Transport)
+}
@@ -0,0 +1,38 @@
+package fakeupstream
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// EncodeEvent 按AWS EventStream规范编码一个事件帧：
+// prelude(总长度、头部长度、prelude CRC) + 头部 + 载荷 + 整帧CRC，CRC均为CRC32(IEEE)
+func EncodeEvent(eventType string, payload []byte) []byte {
+	headers := encodeHeaders([][2]string{
+		{":message-type", "event"},
+		{":event-type", eventType},
+		{":content-type", "application/json"},
+	})
+
+	totalLength := 12 + len(headers) + len(payload) + 4
+	frame := make([]byte, 0, totalLength)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(totalLength))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(headers)))
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(frame))
+	frame = append(frame, headers...)
+	frame = append(frame, payload...)
+	return binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(frame))
+}
+
+// encodeHeaders 编码字符串类型(7)的头部
+func encodeHeaders(headers [][2]string) []byte {
+	var encoded []byte
+	for _, h := range headers {
+		encoded = append(encoded, byte(len(h[0])))
+		encoded = append(encoded, h[0]...)
+		encoded = append(encoded, 7)
+		encoded = binary.BigEndian.AppendUint16(encoded, uint16(len(h[1])))
+		encoded = append(encoded, h[1]...)
+	}
+	return encoded
+}
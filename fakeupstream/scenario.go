@@ -0,0 +1,88 @@
+package fakeupstream
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+//go:embed scenarios/default.json
+var defaultScenarioJSON []byte
+
+// Scenario 假上游的响应场景
+type Scenario struct {
+	Name              string  `json:"name"`
+	FirstTokenDelayMs int     `json:"first_token_delay_ms"` // 首个事件前的延迟
+	TokensPerSecond   float64 `json:"tokens_per_second"`    // 文本事件的发送速率，<=0表示不限速
+	ResponseTokens    int     `json:"response_tokens"`      // 每个响应的文本事件数
+	ChunkText         string  `json:"chunk_text"`           // 每个文本事件的内容
+	ToolCallRate      float64 `json:"tool_call_rate"`       // 响应以工具调用结束的概率（0~1）
+	ErrorRate         float64 `json:"error_rate"`           // 直接返回错误状态码的概率（0~1）
+	ErrorStatus       int     `json:"error_status"`         // 注入错误时的HTTP状态码
+	Seed              int64   `json:"seed,omitempty"`       // 随机种子，0表示按时间生成
+}
+
+// DefaultScenario 返回内置的默认场景（scenarios/default.json）
+func DefaultScenario() *Scenario {
+	scenario, err := parseScenario(defaultScenarioJSON)
+	if err != nil {
+		panic(fmt.Sprintf("内置场景无效: %v", err))
+	}
+	return scenario
+}
+
+// LoadScenario 从JSON文件加载场景，path为空时返回默认场景
+func LoadScenario(path string) (*Scenario, error) {
+	if path == "" {
+		return DefaultScenario(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取场景文件失败: %w", err)
+	}
+	return parseScenario(data)
+}
+
+func parseScenario(data []byte) (*Scenario, error) {
+	var scenario Scenario
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("解析场景文件失败: %w", err)
+	}
+	if err := scenario.validate(); err != nil {
+		return nil, err
+	}
+	return &scenario, nil
+}
+
+// validate 校验场景参数并补全默认值
+func (s *Scenario) validate() error {
+	if s.ToolCallRate < 0 || s.ToolCallRate > 1 {
+		return fmt.Errorf("tool_call_rate必须在0~1之间: %v", s.ToolCallRate)
+	}
+	if s.ErrorRate < 0 || s.ErrorRate > 1 {
+		return fmt.Errorf("error_rate必须在0~1之间: %v", s.ErrorRate)
+	}
+	if s.ResponseTokens < 0 || s.FirstTokenDelayMs < 0 {
+		return fmt.Errorf("response_tokens和first_token_delay_ms不能为负数")
+	}
+	if s.ChunkText == "" {
+		s.ChunkText = "lorem "
+	}
+	if s.ErrorStatus == 0 {
+		s.ErrorStatus = 500
+	}
+	if s.ErrorStatus < 400 || s.ErrorStatus > 599 {
+		return fmt.Errorf("error_status必须是4xx或5xx状态码: %d", s.ErrorStatus)
+	}
+	return nil
+}
+
+// tokenInterval 相邻文本事件之间的间隔
+func (s *Scenario) tokenInterval() time.Duration {
+	if s.TokensPerSecond <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / s.TokensPerSecond)
+}
@@ -0,0 +1,195 @@
+package fakeupstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kiro2api/logger"
+	"kiro2api/utils"
+)
+
+// Transport 进程内的假上游，替换共享HTTP客户端的Transport
+// 代理仍走真实的请求构建、token刷新、错误映射和事件流解析流程，只有网络另一端是假的
+type Transport struct {
+	scenario *Scenario
+
+	mutex  sync.Mutex
+	random *rand.Rand
+
+	requests atomic.Int64 // generateAssistantResponse请求数
+}
+
+// NewTransport 创建按场景响应的假上游
+func NewTransport(scenario *Scenario) *Transport {
+	seed := scenario.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Transport{scenario: scenario, random: rand.New(rand.NewSource(seed))}
+}
+
+// Requests 返回已处理的generateAssistantResponse请求数
+func (t *Transport) Requests() int64 {
+	return t.requests.Load()
+}
+
+// Install 用假上游替换共享HTTP客户端的Transport，返回恢复函数
+func Install(scenario *Scenario) (*Transport, func()) {
+	transport := NewTransport(scenario)
+	original := utils.SharedHTTPClient.Transport
+	utils.SharedHTTPClient.Transport = transport
+	return transport, func() { utils.SharedHTTPClient.Transport = original }
+}
+
+// InstallFromEnv 在 FAKE_UPSTREAM=true 时安装假上游
+// 场景文件由 FAKE_UPSTREAM_SCENARIO 指定（默认内置场景）；未配置KIRO_AUTH_TOKEN时注入一个合成账号
+func InstallFromEnv() (bool, error) {
+	if !utils.GetEnvBool("FAKE_UPSTREAM") {
+		return false, nil
+	}
+
+	scenario, err := LoadScenario(strings.TrimSpace(os.Getenv("FAKE_UPSTREAM_SCENARIO")))
+	if err != nil {
+		return false, err
+	}
+	if os.Getenv("KIRO_AUTH_TOKEN") == "" {
+		_ = os.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"fake-upstream-refresh-token"}]`)
+	}
+	Install(scenario)
+
+	logger.Warn("FAKE_UPSTREAM已启用，所有上游请求由内置假上游响应，仅用于压测和开发",
+		logger.String("scenario", scenario.Name),
+		logger.Float64("tokens_per_second", scenario.TokensPerSecond),
+		logger.Float64("tool_call_rate", scenario.ToolCallRate),
+		logger.Float64("error_rate", scenario.ErrorRate))
+	return true, nil
+}
+
+// RoundTrip 按请求路径模拟token刷新、用量查询和生成接口
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_, _ = io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/generateAssistantResponse"):
+		return t.generate(req), nil
+	case strings.HasSuffix(path, "/getUsageLimits"):
+		return jsonResponse(req, http.StatusOK, `{"usageBreakdownList":[{"resourceType":"CREDIT",`+
+			`"usageLimitWithPrecision":1000000,"currentUsageWithPrecision":0}],"userInfo":{"email":"fake-upstream@example.com"}}`), nil
+	case strings.HasSuffix(path, "/refreshToken"), strings.HasSuffix(path, "/token"):
+		return jsonResponse(req, http.StatusOK, `{"accessToken":"fake-upstream-access-token","expiresIn":3600}`), nil
+	default:
+		return jsonResponse(req, http.StatusNotFound, `{"message":"fake upstream: unknown endpoint"}`), nil
+	}
+}
+
+// chance 以概率p返回true
+func (t *Transport) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.random.Float64() < p
+}
+
+// generate 返回按场景节奏写出的事件流，或按错误率注入错误
+func (t *Transport) generate(req *http.Request) *http.Response {
+	n := t.requests.Add(1)
+	if t.chance(t.scenario.ErrorRate) {
+		return jsonResponse(req, t.scenario.ErrorStatus, `{"message":"fake upstream injected error"}`)
+	}
+	withTool := t.chance(t.scenario.ToolCallRate)
+
+	reader, writer := io.Pipe()
+	go t.writeEvents(req, writer, n, withTool)
+
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": []string{"application/vnd.amazon.eventstream"}},
+		Body:       reader,
+		Request:    req,
+	}
+}
+
+// writeEvents 写出文本事件（可选以一个工具调用结束），客户端取消时停止
+func (t *Transport) writeEvents(req *http.Request, writer *io.PipeWriter, n int64, withTool bool) {
+	ctx := req.Context()
+	wait := func(d time.Duration) bool {
+		if d <= 0 {
+			return ctx.Err() == nil
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	write := func(eventType string, payload any) bool {
+		data, _ := json.Marshal(payload)
+		_, err := writer.Write(EncodeEvent(eventType, data))
+		return err == nil
+	}
+
+	if !wait(time.Duration(t.scenario.FirstTokenDelayMs) * time.Millisecond) {
+		writer.CloseWithError(ctx.Err())
+		return
+	}
+
+	interval := t.scenario.tokenInterval()
+	for i := 0; i < t.scenario.ResponseTokens; i++ {
+		if i > 0 && !wait(interval) {
+			writer.CloseWithError(ctx.Err())
+			return
+		}
+		if !write("assistantResponseEvent", map[string]string{"content": t.scenario.ChunkText}) {
+			return
+		}
+	}
+
+	if withTool {
+		// 与真实上游一致：tooluse_ + 22位ID
+		toolUseID := fmt.Sprintf("tooluse_fake%018d", n)
+		input, _ := json.Marshal(map[string]any{"query": "synthetic", "request": n})
+		// 与真实上游一致：先注册工具，再发送input片段，最后以stop结束
+		if !write("toolUseEvent", map[string]any{"name": "fake_tool", "toolUseId": toolUseID}) ||
+			!write("toolUseEvent", map[string]any{"name": "fake_tool", "toolUseId": toolUseID, "input": string(input)}) ||
+			!write("toolUseEvent", map[string]any{"name": "fake_tool", "toolUseId": toolUseID, "stop": true}) {
+			return
+		}
+	}
+	writer.Close()
+}
+
+func jsonResponse(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader([]byte(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,306 @@
+// Package loadtest 对运行中的kiro2api发起并发请求，统计延迟分位数和吞吐量
+// 通常配合 FAKE_UPSTREAM=true 使用，以便在不消耗真实额度的情况下压测代理本身
+package loadtest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/utils"
+)
+
+// Options 压测参数
+type Options struct {
+	URL         string        // 代理地址，例如 http://127.0.0.1:8080
+	Token       string        // 客户端认证token
+	Model       string        // 请求的模型
+	Prompt      string        // 用户消息
+	Requests    int           // 总请求数
+	Concurrency int           // 并发数
+	Stream      bool          // 是否使用流式请求
+	API         string        // anthropic 或 openai
+	Timeout     time.Duration // 单个请求超时
+}
+
+// Percentiles 延迟分位数
+type Percentiles struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// Report 压测结果
+type Report struct {
+	Requests    int            `json:"requests"`
+	Succeeded   int            `json:"succeeded"`
+	Failed      int            `json:"failed"`
+	StatusCodes map[int]int    `json:"status_codes"`
+	Errors      map[string]int `json:"errors,omitempty"` // 传输层错误（无状态码）
+	Duration    time.Duration  `json:"duration"`
+	Throughput  float64        `json:"throughput"` // 每秒完成的请求数
+	BytesPerSec float64        `json:"bytes_per_sec"`
+	Latency     Percentiles    `json:"latency"` // 完整响应耗时（仅成功请求）
+	TTFB        Percentiles    `json:"ttfb"`    // 首字节耗时（仅成功请求）
+}
+
+type result struct {
+	status  int
+	err     error
+	latency time.Duration
+	ttfb    time.Duration
+	bytes   int64
+}
+
+// Execute 按Options发起请求并汇总结果
+func Execute(ctx context.Context, opts Options) (*Report, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	endpoint, body, err := opts.requestBody()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: opts.Timeout}
+	jobs := make(chan struct{})
+	results := make(chan result, opts.Requests)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				results <- doRequest(ctx, client, endpoint, opts.Token, body)
+			}
+		}()
+	}
+
+	start := time.Now()
+	go func() {
+		defer close(jobs)
+		for i := 0; i < opts.Requests; i++ {
+			select {
+			case jobs <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(results)
+
+	return summarize(results, time.Since(start)), nil
+}
+
+func (o *Options) normalize() error {
+	o.URL = strings.TrimRight(strings.TrimSpace(o.URL), "/")
+	if o.URL == "" {
+		return errors.New("url不能为空")
+	}
+	if o.Requests <= 0 {
+		return fmt.Errorf("requests必须大于0: %d", o.Requests)
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	o.Concurrency = min(o.Concurrency, o.Requests)
+	if o.Model == "" {
+		o.Model = "claude-sonnet-4-20250514"
+	}
+	if o.Prompt == "" {
+		o.Prompt = "Hello"
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 60 * time.Second
+	}
+	if o.API == "" {
+		o.API = "anthropic"
+	}
+	if o.API != "anthropic" && o.API != "openai" {
+		return fmt.Errorf("api必须是anthropic或openai: %s", o.API)
+	}
+	return nil
+}
+
+// requestBody 返回目标端点和请求体
+func (o *Options) requestBody() (string, []byte, error) {
+	payload := map[string]any{
+		"model":      o.Model,
+		"max_tokens": 1024,
+		"stream":     o.Stream,
+		"messages":   []map[string]any{{"role": "user", "content": o.Prompt}},
+	}
+	body, err := utils.SafeMarshal(payload)
+	if err != nil {
+		return "", nil, err
+	}
+	if o.API == "openai" {
+		return o.URL + "/v1/chat/completions", body, nil
+	}
+	return o.URL + "/v1/messages", body, nil
+}
+
+func doRequest(ctx context.Context, client *http.Client, endpoint, token string, body []byte) result {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return result{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{err: err, latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+
+	res := result{status: resp.StatusCode}
+	reader := bufio.NewReader(resp.Body)
+	if _, err := reader.Peek(1); err == nil {
+		res.ttfb = time.Since(start)
+	}
+	res.bytes, err = io.Copy(io.Discard, reader)
+	res.latency = time.Since(start)
+	if err != nil {
+		res.err = err
+	}
+	if res.ttfb == 0 {
+		res.ttfb = res.latency
+	}
+	return res
+}
+
+func summarize(results <-chan result, elapsed time.Duration) *Report {
+	report := &Report{
+		StatusCodes: make(map[int]int),
+		Errors:      make(map[string]int),
+		Duration:    elapsed,
+	}
+	var latencies, ttfbs []time.Duration
+	var totalBytes int64
+
+	for res := range results {
+		report.Requests++
+		if res.status != 0 {
+			report.StatusCodes[res.status]++
+		}
+		if res.err != nil {
+			report.Failed++
+			report.Errors[errorKind(res.err)]++
+			continue
+		}
+		if res.status < 200 || res.status >= 300 {
+			report.Failed++
+			continue
+		}
+		report.Succeeded++
+		totalBytes += res.bytes
+		latencies = append(latencies, res.latency)
+		ttfbs = append(ttfbs, res.ttfb)
+	}
+
+	if elapsed > 0 {
+		report.Throughput = float64(report.Requests) / elapsed.Seconds()
+		report.BytesPerSec = float64(totalBytes) / elapsed.Seconds()
+	}
+	report.Latency = percentiles(latencies)
+	report.TTFB = percentiles(ttfbs)
+	return report
+}
+
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "transport"
+	}
+}
+
+// percentiles 使用最近秩法计算分位数
+func percentiles(values []time.Duration) Percentiles {
+	if len(values) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	rank := func(p float64) time.Duration {
+		idx := int(p*float64(len(values))+0.999999) - 1
+		return values[max(0, min(idx, len(values)-1))]
+	}
+	return Percentiles{P50: rank(0.50), P90: rank(0.90), P99: rank(0.99), Max: values[len(values)-1]}
+}
+
+// Print 以文本表格输出结果
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "请求总数:   %d（成功 %d，失败 %d）\n", r.Requests, r.Succeeded, r.Failed)
+	fmt.Fprintf(w, "总耗时:     %s\n", r.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "吞吐量:     %.2f req/s，%.1f KB/s\n", r.Throughput, r.BytesPerSec/1024)
+	fmt.Fprintf(w, "延迟:       p50=%s p90=%s p99=%s max=%s\n",
+		round(r.Latency.P50), round(r.Latency.P90), round(r.Latency.P99), round(r.Latency.Max))
+	fmt.Fprintf(w, "首字节:     p50=%s p90=%s p99=%s max=%s\n",
+		round(r.TTFB.P50), round(r.TTFB.P90), round(r.TTFB.P99), round(r.TTFB.Max))
+
+	codes := make([]int, 0, len(r.StatusCodes))
+	for code := range r.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "状态码 %d:  %d\n", code, r.StatusCodes[code])
+	}
+	for kind, count := range r.Errors {
+		fmt.Fprintf(w, "错误 %s:  %d\n", kind, count)
+	}
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(100 * time.Microsecond)
+}
+
+// Run 解析 `kiro2api loadtest` 子命令参数并执行压测，有失败请求时返回错误
+func Run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	fs.SetOutput(out)
+
+	opts := Options{}
+	fs.StringVar(&opts.URL, "url", "http://127.0.0.1:8080", "代理地址")
+	fs.StringVar(&opts.Token, "token", os.Getenv("KIRO_CLIENT_TOKEN"), "客户端认证token（默认读取KIRO_CLIENT_TOKEN）")
+	fs.StringVar(&opts.Model, "model", "claude-sonnet-4-20250514", "请求的模型")
+	fs.StringVar(&opts.Prompt, "prompt", "Hello", "用户消息")
+	fs.IntVar(&opts.Requests, "n", 100, "总请求数")
+	fs.IntVar(&opts.Concurrency, "c", 10, "并发数")
+	fs.BoolVar(&opts.Stream, "stream", true, "使用流式请求")
+	fs.StringVar(&opts.API, "api", "anthropic", "接口类型：anthropic 或 openai")
+	fs.DurationVar(&opts.Timeout, "timeout", 60*time.Second, "单个请求超时")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := Execute(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	report.Print(out)
+	if report.Failed > 0 {
+		return fmt.Errorf("%d/%d 个请求失败", report.Failed, report.Requests)
+	}
+	return nil
+}
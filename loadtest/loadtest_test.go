@@ -0,0 +1,132 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/fakeupstream"
+	"kiro2api/server"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testClientToken = "loadtest-client-token"
+
+// startFakeStack 启动完整的代理（真实路由、认证、转换和解析），上游由假上游响应
+func startFakeStack(t *testing.T, scenario *fakeupstream.Scenario) (*httptest.Server, *fakeupstream.Transport) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("AUTH_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"fake-refresh-token"}]`)
+
+	transport, restore := fakeupstream.Install(scenario)
+	t.Cleanup(restore)
+
+	authService, err := auth.NewAuthService()
+	require.NoError(t, err)
+
+	server.ResetRouter()
+	t.Cleanup(server.ResetRouter)
+	router, err := server.NewRouter(testClientToken, authService)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return srv, transport
+}
+
+func TestExecute_FullStack(t *testing.T) {
+	scenario := &fakeupstream.Scenario{Name: "test", ResponseTokens: 10, ChunkText: "ok ", ToolCallRate: 0.5, ErrorStatus: 500, Seed: 7}
+	srv, transport := startFakeStack(t, scenario)
+
+	for _, tc := range []struct {
+		api    string
+		stream bool
+	}{
+		{"anthropic", true},
+		{"anthropic", false},
+		{"openai", true},
+		{"openai", false},
+	} {
+		before := transport.Requests()
+		report, err := Execute(context.Background(), Options{
+			URL:         srv.URL,
+			Token:       testClientToken,
+			Requests:    12,
+			Concurrency: 4,
+			Stream:      tc.stream,
+			API:         tc.api,
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, 12, report.Requests, tc.api)
+		assert.Equal(t, 12, report.Succeeded, "%s stream=%v: %v", tc.api, tc.stream, report.StatusCodes)
+		assert.Equal(t, 12, report.StatusCodes[http.StatusOK])
+		assert.Equal(t, int64(12), transport.Requests()-before)
+		assert.Greater(t, report.Throughput, 0.0)
+		assert.Positive(t, report.Latency.P50)
+		assert.LessOrEqual(t, report.Latency.P50, report.Latency.P99)
+		assert.LessOrEqual(t, report.TTFB.P50, report.Latency.Max)
+	}
+}
+
+func TestExecute_ErrorInjection(t *testing.T) {
+	scenario := &fakeupstream.Scenario{Name: "errors", ResponseTokens: 1, ErrorRate: 1, ErrorStatus: 500}
+	srv, _ := startFakeStack(t, scenario)
+
+	report, err := Execute(context.Background(), Options{URL: srv.URL, Token: testClientToken, Requests: 5, Concurrency: 2, Stream: false})
+	require.NoError(t, err)
+	assert.Equal(t, 5, report.Failed)
+	assert.Equal(t, 0, report.Succeeded)
+	assert.Zero(t, report.StatusCodes[http.StatusOK])
+}
+
+func TestExecute_Unauthorized(t *testing.T) {
+	srv, _ := startFakeStack(t, fakeupstream.DefaultScenario())
+
+	report, err := Execute(context.Background(), Options{URL: srv.URL, Token: "wrong", Requests: 3})
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.StatusCodes[http.StatusUnauthorized])
+	assert.Equal(t, 3, report.Failed)
+}
+
+func TestExecute_InvalidOptions(t *testing.T) {
+	_, err := Execute(context.Background(), Options{Requests: 1})
+	assert.Error(t, err)
+
+	_, err = Execute(context.Background(), Options{URL: "http://127.0.0.1:1", Requests: 0})
+	assert.Error(t, err)
+
+	_, err = Execute(context.Background(), Options{URL: "http://127.0.0.1:1", Requests: 1, API: "grpc"})
+	assert.Error(t, err)
+}
+
+func TestPercentiles(t *testing.T) {
+	values := make([]time.Duration, 0, 100)
+	for i := 100; i >= 1; i-- {
+		values = append(values, time.Duration(i)*time.Millisecond)
+	}
+	p := percentiles(values)
+	assert.Equal(t, 50*time.Millisecond, p.P50)
+	assert.Equal(t, 90*time.Millisecond, p.P90)
+	assert.Equal(t, 99*time.Millisecond, p.P99)
+	assert.Equal(t, 100*time.Millisecond, p.Max)
+	assert.Equal(t, Percentiles{}, percentiles(nil))
+}
+
+func TestRun_PrintsReport(t *testing.T) {
+	srv, _ := startFakeStack(t, &fakeupstream.Scenario{Name: "run", ResponseTokens: 2, ErrorStatus: 500})
+
+	var out bytes.Buffer
+	err := Run([]string{"-url", srv.URL, "-token", testClientToken, "-n", "3", "-c", "2"}, &out)
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "请求总数:   3（成功 3，失败 0）")
+	assert.Contains(t, out.String(), "p99=")
+}
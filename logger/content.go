@@ -0,0 +1,120 @@
+package logger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bytedance/sonic"
+)
+
+// 请求/响应内容（提示词、工具参数、上游负载等）写入日志的方式（LOG_CONTENT_POLICY）
+const (
+	ContentNone      = "none"      // 只记录长度
+	ContentTruncated = "truncated" // 默认，保留前N个字符（LOG_CONTENT_MAX_CHARS）
+	ContentHashed    = "hashed"    // 只记录sha256摘要和长度
+	ContentFull      = "full"      // 完整内容（旧行为），需显式设置
+)
+
+// DefaultContentMaxChars truncated策略默认保留的字符数
+const DefaultContentMaxChars = 200
+
+// contentDigest none/hashed策略下代替内容写入日志的摘要
+type contentDigest struct {
+	SHA256 string `json:"sha256,omitempty"`
+	Length int    `json:"length"`
+}
+
+// ParseContentPolicy 解析内容记录策略，无法识别时返回false
+func ParseContentPolicy(s string) (string, bool) {
+	switch policy := strings.ToLower(strings.TrimSpace(s)); policy {
+	case ContentNone, ContentTruncated, ContentHashed, ContentFull:
+		return policy, true
+	default:
+		return "", false
+	}
+}
+
+// contentPolicyFromEnv 读取 LOG_CONTENT_POLICY 和 LOG_CONTENT_MAX_CHARS
+func contentPolicyFromEnv() (string, int) {
+	policy := ContentTruncated
+	if raw := os.Getenv("LOG_CONTENT_POLICY"); strings.TrimSpace(raw) != "" {
+		if parsed, ok := ParseContentPolicy(raw); ok {
+			policy = parsed
+		} else {
+			fmt.Fprintf(os.Stderr, "LOG_CONTENT_POLICY无效 %q，使用truncated\n", raw)
+		}
+	}
+	maxChars := DefaultContentMaxChars
+	if n, ok := envInt("LOG_CONTENT_MAX_CHARS"); ok {
+		maxChars = n
+	}
+	return policy, maxChars
+}
+
+// ContentPolicy 返回当前全局的内容记录策略
+func ContentPolicy() string {
+	return defaultLogger.contentPolicy
+}
+
+// Content 按全局策略记录请求/响应内容
+// 所有可能包含用户内容的日志字段都必须通过该函数（或ContentAs）构造，不能直接使用String/Any
+func Content(key string, val any) Field {
+	return ContentAs(defaultLogger.contentPolicy, key, val)
+}
+
+// ContentAs 按指定策略记录内容，用于管理员对单个请求覆盖全局策略
+func ContentAs(policy, key string, val any) Field {
+	if policy == ContentFull {
+		if b, ok := val.([]byte); ok {
+			return Field{Key: key, Value: string(b)}
+		}
+		return Field{Key: key, Value: val}
+	}
+
+	text := contentText(val)
+	switch policy {
+	case ContentNone:
+		return Field{Key: key, Value: contentDigest{Length: len(text)}}
+	case ContentHashed:
+		sum := sha256.Sum256([]byte(text))
+		return Field{Key: key, Value: contentDigest{SHA256: hex.EncodeToString(sum[:]), Length: len(text)}}
+	default:
+		return Field{Key: key, Value: truncateContent(text, defaultLogger.contentMaxChars)}
+	}
+}
+
+// contentText 将内容统一转换为文本：字符串原样使用，其余类型序列化为JSON
+func contentText(val any) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	}
+	if text, err := sonic.MarshalString(val); err == nil {
+		return text
+	}
+	return fmt.Sprintf("%v", val)
+}
+
+// truncateContent 保留前maxChars个字符，不切断多字节字符
+func truncateContent(text string, maxChars int) string {
+	if utf8.RuneCountInString(text) <= maxChars {
+		return text
+	}
+	cut, count := 0, 0
+	for i := range text {
+		if count == maxChars {
+			cut = i
+			break
+		}
+		count++
+	}
+	return fmt.Sprintf("%s...(%d bytes)", text[:cut], len(text))
+}
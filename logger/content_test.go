@@ -0,0 +1,117 @@
+package logger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const secretPrompt = "my social security number is 078-05-1120"
+
+func TestContentAs_Policies(t *testing.T) {
+	sum := sha256.Sum256([]byte(secretPrompt))
+
+	assert.Equal(t, Field{Key: "body", Value: secretPrompt}, ContentAs(ContentFull, "body", []byte(secretPrompt)))
+	assert.Equal(t, Field{Key: "body", Value: contentDigest{Length: len(secretPrompt)}}, ContentAs(ContentNone, "body", secretPrompt))
+	assert.Equal(t, Field{Key: "body", Value: contentDigest{SHA256: hex.EncodeToString(sum[:]), Length: len(secretPrompt)}},
+		ContentAs(ContentHashed, "body", []byte(secretPrompt)))
+
+	// 非字符串内容序列化为JSON后再处理
+	hashed := ContentAs(ContentHashed, "contexts", []map[string]any{{"text": secretPrompt}}).Value.(contentDigest)
+	assert.Len(t, hashed.SHA256, 64)
+	assert.Equal(t, len(`[{"text":"`+secretPrompt+`"}]`), hashed.Length)
+	structured := []map[string]any{{"text": "hi"}}
+	assert.Equal(t, structured, ContentAs(ContentFull, "contexts", structured).Value, "full保持原有结构")
+}
+
+func TestTruncateContent(t *testing.T) {
+	assert.Equal(t, "short", truncateContent("short", 10))
+	assert.Equal(t, "my social...(40 bytes)", truncateContent(secretPrompt, 9))
+	assert.Equal(t, "你好...(12 bytes)", truncateContent("你好世界", 2), "不切断多字节字符")
+	assert.Equal(t, "...(3 bytes)", truncateContent("abc", 0))
+}
+
+func TestContentPolicyFromEnv(t *testing.T) {
+	t.Setenv("LOG_CONTENT_POLICY", "")
+	t.Setenv("LOG_CONTENT_MAX_CHARS", "")
+	policy, maxChars := contentPolicyFromEnv()
+	assert.Equal(t, ContentTruncated, policy, "默认截断，完整内容需显式设置full")
+	assert.Equal(t, DefaultContentMaxChars, maxChars)
+
+	t.Setenv("LOG_CONTENT_POLICY", " Hashed ")
+	t.Setenv("LOG_CONTENT_MAX_CHARS", "50")
+	policy, maxChars = contentPolicyFromEnv()
+	assert.Equal(t, ContentHashed, policy)
+	assert.Equal(t, 50, maxChars)
+
+	t.Setenv("LOG_CONTENT_POLICY", "everything")
+	policy, _ = contentPolicyFromEnv()
+	assert.Equal(t, ContentTruncated, policy)
+}
+
+func TestContent_HashedPolicyKeepsRawContentOutOfLogs(t *testing.T) {
+	t.Cleanup(Reinitialize) // 在恢复环境变量之后执行
+	path := filepath.Join(t.TempDir(), "kiro2api.log")
+	t.Setenv("LOG_FILE", path)
+	t.Setenv("LOG_CONSOLE", "false")
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("LOG_CONTENT_POLICY", "hashed")
+	Reinitialize()
+	require.Equal(t, ContentHashed, ContentPolicy())
+
+	Debug("收到请求",
+		Content("body", []byte(`{"messages":[{"role":"user","content":"`+secretPrompt+`"}]}`)),
+		Content("contexts", []map[string]any{{"type": "text", "text": secretPrompt}}),
+		Content("arguments", map[string]any{"query": secretPrompt}))
+
+	lines := readLogLines(t, path)
+	require.Len(t, lines, 1)
+	assert.NotContains(t, lines[0], "078-05-1120")
+	assert.NotContains(t, lines[0], "social security")
+	assert.Contains(t, lines[0], `"sha256":"`)
+}
+
+// contentKeyPattern 这些字段记录请求/响应内容，必须通过Content/ContentAs构造
+var contentKeyPattern = regexp.MustCompile(`logger\.(String|Any)\("(body|request_body|response_body|payload|payload_raw|payload_preview|contexts|raw_content|text_value|eventData|input|inputFragment|fullInput|arguments|json|fragment|fragment_end|current_fragment|combined_start|incomplete|buffer|result)"`)
+
+func TestContentFields_GoThroughContentHelper(t *testing.T) {
+	root, err := filepath.Abs("..")
+	require.NoError(t, err)
+
+	var violations []string
+	err = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (d.Name() == ".git" || d.Name() == "vendor") {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "//") {
+				continue
+			}
+			if contentKeyPattern.MatchString(line) {
+				rel, _ := filepath.Rel(root, path)
+				violations = append(violations, rel+":"+strconv.Itoa(i+1))
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Empty(t, violations, "内容字段应使用logger.Content，避免绕过LOG_CONTENT_POLICY")
+}
@@ -45,10 +45,13 @@ type Field struct {
 type Logger struct {
 	level        int64       // 使用原子操作的日志级别
 	logger       *log.Logger // log.Logger本身线程安全，移除mutex
-	logFile      *os.File
+	logFile      io.WriteCloser
 	writers      []io.Writer
 	enableCaller bool // 控制是否获取调用栈信息（包含文件与函数名）
 	callerSkip   int  // 调用栈深度
+
+	contentPolicy   string // 请求/响应内容的记录策略（LOG_CONTENT_POLICY）
+	contentMaxChars int    // truncated策略保留的字符数（LOG_CONTENT_MAX_CHARS）
 }
 
 var (
@@ -97,9 +100,12 @@ func createLogger() *Logger {
 		}
 	}
 
+	// 内容记录策略
+	logger.contentPolicy, logger.contentMaxChars = contentPolicyFromEnv()
+
 	// 设置文件输出
 	if logFile := os.Getenv("LOG_FILE"); logFile != "" {
-		if file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err == nil {
+		if file, err := openLogFile(logFile, rotateConfigFromEnv()); err == nil {
 			logger.logFile = file
 			// 检查是否禁用控制台输出
 			if os.Getenv("LOG_CONSOLE") == "false" {
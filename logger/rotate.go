@@ -0,0 +1,310 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志文件轮转的默认值
+const (
+	defaultLogMaxSizeMB  = 100
+	defaultLogMaxBackups = 5
+	backupTimeFormat     = "2006-01-02T15-04-05.000"
+	compressSuffix       = ".gz"
+)
+
+// RotateConfig 日志文件轮转配置
+type RotateConfig struct {
+	MaxSize    int64         // 单个文件的最大字节数，0表示不轮转
+	MaxBackups int           // 保留的历史文件数，0表示不按数量清理
+	MaxAge     time.Duration // 历史文件的最长保留时间，0表示不按时间清理
+	Compress   bool          // 历史文件是否gzip压缩
+}
+
+// rotateConfigFromEnv 读取 LOG_MAX_SIZE_MB（默认100，0不轮转）、LOG_MAX_BACKUPS（默认5）、
+// LOG_MAX_AGE_DAYS（默认0不按时间清理）、LOG_COMPRESS（"true"时压缩历史文件）
+func rotateConfigFromEnv() RotateConfig {
+	cfg := RotateConfig{
+		MaxSize:    defaultLogMaxSizeMB << 20,
+		MaxBackups: defaultLogMaxBackups,
+		Compress:   strings.EqualFold(strings.TrimSpace(os.Getenv("LOG_COMPRESS")), "true"),
+	}
+	if value, ok := envInt("LOG_MAX_SIZE_MB"); ok {
+		cfg.MaxSize = int64(value) << 20
+	}
+	if value, ok := envInt("LOG_MAX_BACKUPS"); ok {
+		cfg.MaxBackups = value
+	}
+	if value, ok := envInt("LOG_MAX_AGE_DAYS"); ok {
+		cfg.MaxAge = time.Duration(value) * 24 * time.Hour
+	}
+	return cfg
+}
+
+// envInt 读取非负整数环境变量，未设置或无效时返回false
+func envInt(name string) (int, bool) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return 0, false
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		fmt.Fprintf(os.Stderr, "忽略无效的%s: %s\n", name, raw)
+		return 0, false
+	}
+	return value, true
+}
+
+// rotatingFile 按大小轮转的日志文件
+// 写入和轮转在同一把锁内完成，请求goroutine并发写入时每行完整落在轮转前或轮转后的文件中，不会丢失；
+// 历史文件的压缩和清理在后台goroutine中进行，不阻塞写入
+type rotatingFile struct {
+	mutex  sync.Mutex
+	path   string
+	config RotateConfig
+	file   *os.File
+	size   int64
+
+	millCh   chan struct{}
+	millOnce sync.Once
+	millWG   sync.WaitGroup
+	now      func() time.Time
+}
+
+// openRotatingFile 以追加方式打开日志文件，已有内容计入当前大小
+func openRotatingFile(path string, config RotateConfig) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, config: config, now: time.Now}
+	if err := r.openUnlocked(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) openUnlocked() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+// Write 写入一条日志，写入后超过大小上限时先轮转
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.config.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.config.MaxSize {
+		if err := r.rotateUnlocked(); err != nil {
+			// 轮转失败时继续写入当前文件，不丢日志
+			fmt.Fprintf(os.Stderr, "日志文件轮转失败: %v\n", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close 关闭当前文件并等待后台压缩和清理完成
+func (r *rotatingFile) Close() error {
+	r.mutex.Lock()
+	var err error
+	if r.file != nil {
+		err = r.file.Close()
+		r.file = nil
+	}
+	if r.millCh != nil {
+		close(r.millCh)
+	}
+	r.mutex.Unlock()
+	r.millWG.Wait()
+	return err
+}
+
+// rotateUnlocked 把当前文件重命名为带时间戳的历史文件并重新创建
+func (r *rotatingFile) rotateUnlocked() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+	renameErr := os.Rename(r.path, r.backupName())
+	if err := r.openUnlocked(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	r.millUnlocked()
+	return nil
+}
+
+// backupName 历史文件名：<name>-<时间><ext>，同一毫秒内多次轮转时追加序号
+func (r *rotatingFile) backupName() string {
+	dir, ext := filepath.Dir(r.path), filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(filepath.Base(r.path), ext)
+	base := filepath.Join(dir, prefix+"-"+r.now().Format(backupTimeFormat))
+	name := base + ext
+	for i := 1; fileExists(name) || fileExists(name+compressSuffix); i++ {
+		name = fmt.Sprintf("%s.%d%s", base, i, ext)
+	}
+	return name
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// millUnlocked 通知后台goroutine压缩和清理历史文件（已有待处理的通知时合并）
+func (r *rotatingFile) millUnlocked() {
+	if r.config.MaxBackups == 0 && r.config.MaxAge == 0 && !r.config.Compress {
+		return
+	}
+	r.millOnce.Do(func() {
+		r.millCh = make(chan struct{}, 1)
+		r.millWG.Add(1)
+		go func() {
+			defer r.millWG.Done()
+			for range r.millCh {
+				if err := r.millRun(); err != nil {
+					fmt.Fprintf(os.Stderr, "日志历史文件处理失败: %v\n", err)
+				}
+			}
+		}()
+	})
+	select {
+	case r.millCh <- struct{}{}:
+	default:
+	}
+}
+
+// millRun 压缩未压缩的历史文件，删除超出数量或过期的历史文件
+func (r *rotatingFile) millRun() error {
+	backups, err := r.backups()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Time{}
+	if r.config.MaxAge > 0 {
+		cutoff = r.now().Add(-r.config.MaxAge)
+	}
+	var errs []string
+	for i, backup := range backups { // 从新到旧
+		expired := !cutoff.IsZero() && backup.rotatedAt.Before(cutoff)
+		if (r.config.MaxBackups > 0 && i >= r.config.MaxBackups) || expired {
+			if err := os.Remove(backup.path); err != nil {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+		if r.config.Compress && !strings.HasSuffix(backup.path, compressSuffix) {
+			if err := compressFile(backup.path); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+type logBackup struct {
+	path      string
+	rotatedAt time.Time
+	seq       int // 同一毫秒内的轮转序号
+}
+
+// backups 列出历史文件，按轮转时间从新到旧排序
+func (r *rotatingFile) backups() ([]logBackup, error) {
+	dir, ext := filepath.Dir(r.path), filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(filepath.Base(r.path), ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []logBackup
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimSuffix(name, compressSuffix), ext)
+		stamp = strings.TrimPrefix(stamp, prefix)
+		if len(stamp) < len(backupTimeFormat) {
+			continue
+		}
+		rotatedAt, err := time.ParseInLocation(backupTimeFormat, stamp[:len(backupTimeFormat)], time.Local)
+		if err != nil {
+			continue
+		}
+		seq, _ := strconv.Atoi(strings.TrimPrefix(stamp[len(backupTimeFormat):], "."))
+		backups = append(backups, logBackup{path: filepath.Join(dir, name), rotatedAt: rotatedAt, seq: seq})
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].rotatedAt.Equal(backups[j].rotatedAt) {
+			return backups[i].seq > backups[j].seq
+		}
+		return backups[i].rotatedAt.After(backups[j].rotatedAt)
+	})
+	return backups, nil
+}
+
+// compressFile 把文件gzip压缩为<path>.gz后删除原文件
+func compressFile(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+compressSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(path + compressSuffix)
+		}
+	}()
+
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
+
+// openLogFile 打开LOG_FILE：配置了大小上限时以追加方式打开并按大小轮转，否则保持原有的启动时清空
+func openLogFile(path string, config RotateConfig) (io.WriteCloser, error) {
+	if config.MaxSize <= 0 {
+		return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	}
+	return openRotatingFile(path, config)
+}
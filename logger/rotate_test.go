@@ -0,0 +1,169 @@
+package logger
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readLogLines 读取日志文件的所有行，.gz文件先解压
+func readLogLines(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, compressSuffix) {
+		gz, err := gzip.NewReader(file)
+		require.NoError(t, err)
+		defer gz.Close()
+		reader = gz
+	}
+	var lines []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	return lines
+}
+
+func TestRotatingFile_RotatesPastSizeLimit(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "kiro2api.log")
+			r, err := openRotatingFile(path, RotateConfig{MaxSize: 1024, Compress: compress})
+			require.NoError(t, err)
+
+			// 并发写入超过上限数倍的数据
+			const writers, linesPerWriter = 8, 50
+			var wg sync.WaitGroup
+			for w := range writers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range linesPerWriter {
+						_, err := fmt.Fprintf(r, "writer-%d line-%03d %s\n", w, i, strings.Repeat("x", 40))
+						assert.NoError(t, err)
+					}
+				}()
+			}
+			wg.Wait()
+			require.NoError(t, r.Close()) // 等待后台压缩完成
+
+			backups, err := r.backups()
+			require.NoError(t, err)
+			require.NotEmpty(t, backups, "超过上限后应产生历史文件")
+
+			active, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, active.Size(), int64(1024), "当前文件在轮转后重新开始")
+
+			seen := make(map[string]bool)
+			for _, line := range readLogLines(t, path) {
+				seen[line] = true
+			}
+			for _, backup := range backups {
+				assert.Equal(t, compress, strings.HasSuffix(backup.path, compressSuffix), backup.path)
+				info, err := os.Stat(strings.TrimSuffix(backup.path, compressSuffix))
+				if compress {
+					assert.True(t, os.IsNotExist(err), "压缩后删除未压缩的历史文件")
+				} else {
+					require.NoError(t, err)
+					assert.LessOrEqual(t, info.Size(), int64(1024))
+				}
+				for _, line := range readLogLines(t, backup.path) {
+					seen[line] = true
+				}
+			}
+			assert.Len(t, seen, writers*linesPerWriter, "轮转期间的写入不丢失")
+		})
+	}
+}
+
+func TestRotatingFile_PrunesBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	clock := time.Date(2026, 1, 10, 8, 0, 0, 0, time.Local)
+
+	// 过期的历史文件和无关文件
+	expired := filepath.Join(dir, "app-"+clock.Add(-48*time.Hour).Format(backupTimeFormat)+".log")
+	unrelated := filepath.Join(dir, "other.log")
+	require.NoError(t, os.WriteFile(expired, []byte("old\n"), 0644))
+	require.NoError(t, os.WriteFile(unrelated, []byte("keep\n"), 0644))
+
+	r, err := openRotatingFile(path, RotateConfig{MaxSize: 10, MaxBackups: 2, MaxAge: 24 * time.Hour})
+	require.NoError(t, err)
+	r.now = func() time.Time { return clock }
+	for i := range 4 {
+		_, err := fmt.Fprintf(r, "line-%05d\n", i) // 每行11字节，每次写入前都轮转
+		require.NoError(t, err)
+	}
+	require.NoError(t, r.Close())
+
+	backups, err := r.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 2, "只保留最近的历史文件")
+	assert.Equal(t, []string{"line-00002"}, readLogLines(t, backups[0].path))
+	assert.Equal(t, []string{"line-00001"}, readLogLines(t, backups[1].path))
+	assert.Equal(t, []string{"line-00003"}, readLogLines(t, path))
+	assert.NoFileExists(t, expired)
+	assert.FileExists(t, unrelated)
+}
+
+func TestRotateConfigFromEnv(t *testing.T) {
+	for _, name := range []string{"LOG_MAX_SIZE_MB", "LOG_MAX_BACKUPS", "LOG_MAX_AGE_DAYS", "LOG_COMPRESS"} {
+		t.Setenv(name, "")
+	}
+	assert.Equal(t, RotateConfig{MaxSize: defaultLogMaxSizeMB << 20, MaxBackups: defaultLogMaxBackups}, rotateConfigFromEnv())
+
+	t.Setenv("LOG_MAX_SIZE_MB", "10")
+	t.Setenv("LOG_MAX_BACKUPS", "0")
+	t.Setenv("LOG_MAX_AGE_DAYS", "7")
+	t.Setenv("LOG_COMPRESS", " TRUE ")
+	assert.Equal(t, RotateConfig{MaxSize: 10 << 20, MaxAge: 7 * 24 * time.Hour, Compress: true}, rotateConfigFromEnv())
+
+	t.Setenv("LOG_MAX_SIZE_MB", "-1")
+	assert.Equal(t, int64(defaultLogMaxSizeMB<<20), rotateConfigFromEnv().MaxSize, "无效值使用默认值")
+}
+
+func TestReinitialize_AppliesRotateSettings(t *testing.T) {
+	t.Cleanup(Reinitialize) // 在恢复环境变量之后执行
+	path := filepath.Join(t.TempDir(), "kiro2api.log")
+	t.Setenv("LOG_FILE", path)
+	t.Setenv("LOG_CONSOLE", "false")
+	t.Setenv("LOG_MAX_SIZE_MB", "1")
+	t.Setenv("LOG_COMPRESS", "")
+
+	Reinitialize()
+	r, ok := defaultLogger.logFile.(*rotatingFile)
+	require.True(t, ok)
+	assert.Equal(t, int64(1<<20), r.config.MaxSize)
+	assert.False(t, r.config.Compress)
+
+	t.Setenv("LOG_MAX_SIZE_MB", "2")
+	t.Setenv("LOG_COMPRESS", "true")
+	Reinitialize()
+	r, ok = defaultLogger.logFile.(*rotatingFile)
+	require.True(t, ok)
+	assert.Equal(t, int64(2<<20), r.config.MaxSize)
+	assert.True(t, r.config.Compress)
+
+	// 关闭轮转时保持原有的普通文件
+	t.Setenv("LOG_MAX_SIZE_MB", "0")
+	Reinitialize()
+	_, ok = defaultLogger.logFile.(*os.File)
+	assert.True(t, ok)
+}
@@ -4,7 +4,10 @@ import (
 	"os"
 
 	"kiro2api/auth"
+	"kiro2api/fakeupstream"
+	"kiro2api/loadtest"
 	"kiro2api/logger"
+	"kiro2api/replay"
 	"kiro2api/server"
 
 	"github.com/joho/godotenv"
@@ -25,15 +28,47 @@ func main() {
 		logger.String("config_level", os.Getenv("LOG_LEVEL")),
 		logger.String("config_file", os.Getenv("LOG_FILE")))
 
-	// 初始化配置存储（用于Web管理界面）
-	configFilePath := os.Getenv("AUTH_CONFIG_FILE")
-	if configFilePath == "" {
-		configFilePath = "./auth_config.json"
+	// 压测子命令：kiro2api loadtest [flags]，对运行中的代理发起并发请求
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		if err := loadtest.Run(os.Args[2:], os.Stdout); err != nil {
+			logger.Error("压测失败", logger.Err(err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 重放子命令：kiro2api replay [-update] <capture-dir>，离线重放抓取的上游响应并比对下游输出
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := replay.Run(os.Args[2:], os.Stdout); err != nil {
+			logger.Error("重放失败", logger.Err(err))
+			os.Exit(1)
+		}
+		return
 	}
-	if err := server.InitConfigStore(configFilePath); err != nil {
+
+	// 压测模式：FAKE_UPSTREAM=true 时由进程内假上游响应所有上游请求
+	if _, err := fakeupstream.InstallFromEnv(); err != nil {
+		logger.Error("假上游场景无效", logger.Err(err))
+		os.Exit(1)
+	}
+
+	// 初始化配置存储（用于Web管理界面）
+	if err := server.InitConfigStore(auth.ConfigFilePath()); err != nil {
 		logger.Warn("初始化配置存储失败，将使用环境变量配置", logger.Err(err))
 	}
 
+	// 初始化内容审核（MODERATION_BLOCKLIST / MODERATION_WEBHOOK_URL）
+	if err := server.InitModeration(); err != nil {
+		logger.Error("内容审核配置无效", logger.Err(err))
+		os.Exit(1)
+	}
+
+	// 加载服务端提示词配置（PROFILES_FILE）
+	if err := server.InitPromptProfiles(); err != nil {
+		logger.Error("提示词配置无效", logger.Err(err))
+		os.Exit(1)
+	}
+
 	// 🚀 创建AuthService实例（使用依赖注入）
 	logger.Info("正在创建AuthService...")
 	authService, err := auth.NewAuthService()
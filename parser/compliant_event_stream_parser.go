@@ -1,14 +1,20 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"kiro2api/logger"
+	"sync"
 )
 
 // CompliantEventStreamParser 符合AWS规范的完整事件流解析器
 type CompliantEventStreamParser struct {
 	robustParser     *RobustEventStreamParser
 	messageProcessor *CompliantMessageProcessor
+
+	// 解析进度快照，供超时等场景从其他goroutine读取已成功解析的部分
+	progressMutex sync.Mutex
+	progress      *ParseResult
 }
 
 // NewCompliantEventStreamParser 创建符合规范的事件流解析器
@@ -28,6 +34,10 @@ func (cesp *CompliantEventStreamParser) SetMaxErrors(maxErrors int) {
 func (cesp *CompliantEventStreamParser) Reset() {
 	cesp.robustParser.Reset()
 	cesp.messageProcessor.Reset()
+
+	cesp.progressMutex.Lock()
+	cesp.progress = nil
+	cesp.progressMutex.Unlock()
 }
 
 // ParseResponse 解析完整的 CodeWhisperer 响应
@@ -40,13 +50,19 @@ func (cesp *CompliantEventStreamParser) ParseResponse(streamData []byte) (*Parse
 
 	// 2. 处理消息
 	var allEvents []SSEEvent
-	var errors []error
-
+	var processErrors []error
+	var fatalErr error // 上游异常导致无法继续解析
 	for i, message := range messages {
 		events, processErr := cesp.messageProcessor.ProcessMessage(message)
+		if errors.Is(processErr, ErrTooManyActiveTools) {
+			// 上游异常，不再处理后续消息
+			allEvents = append(allEvents, events...)
+			fatalErr = processErr
+			break
+		}
 		if processErr != nil {
 			errMsg := fmt.Errorf("处理消息 %d 失败: %w", i, processErr)
-			errors = append(errors, errMsg)
+			processErrors = append(processErrors, errMsg)
 			logger.Warn("消息处理失败",
 				logger.Int("message_index", i),
 				logger.String("message_type", message.GetMessageType()),
@@ -56,9 +72,13 @@ func (cesp *CompliantEventStreamParser) ParseResponse(streamData []byte) (*Parse
 		}
 
 		allEvents = append(allEvents, events...)
+		cesp.recordProgress(allEvents)
 	}
 
-	// 3. 构建结果
+	// 3. 结束流结束时仍未结束的工具调用，保留已聚合的参数
+	allEvents = append(allEvents, cesp.messageProcessor.FinalizeTools()...)
+
+	// 4. 构建结果
 	result := &ParseResult{
 		Messages:       messages,
 		Events:         allEvents,
@@ -66,17 +86,39 @@ func (cesp *CompliantEventStreamParser) ParseResponse(streamData []byte) (*Parse
 		ActiveTools:    cesp.messageProcessor.toolManager.GetActiveTools(),
 		SessionInfo:    cesp.messageProcessor.sessionManager.GetSessionInfo(),
 		Summary:        cesp.generateSummary(messages, allEvents),
-		Errors:         errors,
+		Errors:         processErrors,
 	}
 
-	if len(errors) > 0 {
+	if len(processErrors) > 0 {
 		logger.Debug("解析完成，但有部分错误",
 			logger.Int("success_messages", len(messages)),
 			logger.Int("total_events", len(allEvents)),
-			logger.Int("error_count", len(errors)))
+			logger.Int("error_count", len(processErrors)))
 	}
 
-	return result, nil
+	return result, fatalErr
+}
+
+// recordProgress 记录已成功处理的事件和已完成的工具
+// 只保存切片视图（限定容量），后续append不会影响快照内容
+func (cesp *CompliantEventStreamParser) recordProgress(events []SSEEvent) {
+	snapshot := &ParseResult{
+		Events:         events[:len(events):len(events)],
+		ToolExecutions: cesp.messageProcessor.toolManager.GetCompletedTools(),
+	}
+
+	cesp.progressMutex.Lock()
+	cesp.progress = snapshot
+	cesp.progressMutex.Unlock()
+}
+
+// PartialResult 返回ParseResponse当前已成功解析的部分结果
+// 可在ParseResponse执行期间并发调用；尚无进度时返回nil
+// 部分结果只包含已完成的工具调用，进行中的工具参数可能不完整
+func (cesp *CompliantEventStreamParser) PartialResult() *ParseResult {
+	cesp.progressMutex.Lock()
+	defer cesp.progressMutex.Unlock()
+	return cesp.progress
 }
 
 // ParseStream 解析流式数据（增量解析）
@@ -92,6 +134,10 @@ func (cesp *CompliantEventStreamParser) ParseStream(data []byte) ([]SSEEvent, er
 	// 处理每个消息
 	for _, message := range messages {
 		events, processErr := cesp.messageProcessor.ProcessMessage(message)
+		if errors.Is(processErr, ErrTooManyActiveTools) {
+			// 上游异常，流无法继续，返回已生成的事件和错误
+			return append(allEvents, events...), processErr
+		}
 		if processErr != nil {
 			logger.Warn("流式处理消息失败", logger.Err(processErr))
 			continue
@@ -170,6 +216,12 @@ func (cesp *CompliantEventStreamParser) generateSummary(messages []*EventStreamM
 	return summary
 }
 
+// FinalizeTools 流结束时结束仍在进行的工具调用，返回需下发的content_block_stop事件（带truncated标记）
+// 流式解析在读完上游后调用；ParseResponse已自动调用
+func (cesp *CompliantEventStreamParser) FinalizeTools() []SSEEvent {
+	return cesp.messageProcessor.FinalizeTools()
+}
+
 // GetToolManager 获取工具管理器
 func (cesp *CompliantEventStreamParser) GetToolManager() *ToolLifecycleManager {
 	return cesp.messageProcessor.GetToolManager()
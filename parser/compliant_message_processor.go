@@ -17,6 +17,8 @@ type CompliantMessageProcessor struct {
 	// 运行时状态：跟踪已开始的工具与其内容块索引，用于按增量输出
 	startedTools   map[string]bool
 	toolBlockIndex map[string]int
+	// 当前assistant消息的messageId，变化时视为上游开始了新一轮消息
+	currentMessageID string
 }
 
 // EventHandler 事件处理器接口
@@ -55,17 +57,32 @@ func NewCompliantMessageProcessor() *CompliantMessageProcessor {
 	return processor
 }
 
-// Reset 重置处理器状态
+// Reset 重置处理器状态，包括未结束的工具调用和未完成的参数聚合，避免复用时带入上一个请求的工具
 func (cmp *CompliantMessageProcessor) Reset() {
 	cmp.sessionManager.Reset()
 	cmp.toolManager.Reset()
+	cmp.toolDataAggregator.Reset()
 	cmp.completionBuffer = cmp.completionBuffer[:0]
+	cmp.currentMessageID = ""
+	clear(cmp.startedTools)
+	clear(cmp.toolBlockIndex)
 	// 重置旧格式工具状态
 	if cmp.legacyToolState != nil {
 		cmp.legacyToolState.fullReset()
 	}
 }
 
+// FinalizeTools 流结束时结束仍在进行的工具调用
+// 未收到停止信号的参数片段若已构成完整JSON则用作工具参数，否则保留开始时的参数
+func (cmp *CompliantMessageProcessor) FinalizeTools() []SSEEvent {
+	for toolID := range cmp.toolManager.activeTools {
+		if arguments, ok := cmp.toolDataAggregator.Flush(toolID); ok {
+			cmp.toolManager.UpdateToolArguments(toolID, arguments)
+		}
+	}
+	return cmp.toolManager.FinalizeActiveTools()
+}
+
 // registerEventHandlers 注册所有事件处理器
 func (cmp *CompliantMessageProcessor) registerEventHandlers() {
 	// 标准事件处理器
@@ -96,7 +113,7 @@ func (cmp *CompliantMessageProcessor) ProcessMessage(message *EventStreamMessage
 		logger.String("message_type", messageType),
 		logger.String("event_type", eventType),
 		logger.Int("payload_len", len(message.Payload)),
-		logger.String("payload_preview", func() string {
+		logger.Content("payload_preview", func() string {
 			if len(message.Payload) > 100 {
 				return string(message.Payload[:100]) + "..."
 			}
@@ -117,6 +134,13 @@ func (cmp *CompliantMessageProcessor) ProcessMessage(message *EventStreamMessage
 	}
 }
 
+// metadataEventTypes 上游的元数据事件：计量、上下文用量等只描述请求本身，不作为未知内容块下发
+var metadataEventTypes = map[string]bool{
+	"meteringEvent":     true,
+	"contextUsageEvent": true,
+	"metadataEvent":     true,
+}
+
 // processEventMessage 处理事件消息
 func (cmp *CompliantMessageProcessor) processEventMessage(message *EventStreamMessage, eventType string) ([]SSEEvent, error) {
 	// 查找并处理事件
@@ -124,7 +148,20 @@ func (cmp *CompliantMessageProcessor) processEventMessage(message *EventStreamMe
 		return handler.Handle(message)
 	}
 
-	// 未知事件类型，记录日志但不报错
+	// 元数据事件交给下游读取其中报告的token数，不计为未知内容块
+	if metadataEventTypes[eventType] {
+		logger.Debug("上游元数据事件", logger.String("event_type", eventType))
+		return []SSEEvent{newMetadataEvent(eventType, message.Payload)}, nil
+	}
+
+	// 其他未知事件只有载荷形似内容块（JSON对象）时才以通用事件交给下游决定跳过或透传，否则记录日志后丢弃
+	raw := rawPayload(message.Payload)
+	if _, isObject := raw.(map[string]any); !isObject {
+		logger.Debug("跳过无法识别的非内容块事件",
+			logger.String("event_type", eventType),
+			logger.Int("payload_len", len(message.Payload)))
+		return []SSEEvent{}, nil
+	}
 	logger.Debug("未知事件类型",
 		logger.String("event_type", eventType),
 		logger.Any("available_handlers", func() []string {
@@ -134,7 +171,45 @@ func (cmp *CompliantMessageProcessor) processEventMessage(message *EventStreamMe
 			}
 			return keys
 		}()))
-	return []SSEEvent{}, nil
+	return []SSEEvent{newUnknownBlockEvent(eventType, message.Payload)}, nil
+}
+
+// rawPayload 解析原始载荷：能解析为JSON时为解析后的值，否则为原始字符串
+func rawPayload(payload []byte) any {
+	var raw any
+	if err := utils.FastUnmarshal(payload, &raw); err != nil {
+		return string(payload)
+	}
+	return raw
+}
+
+// newUnknownBlockEvent 把无法识别的事件/内容块包装为通用的unknown_block事件
+// raw保存原始载荷：能解析为JSON时为解析后的值，否则为原始字符串
+func newUnknownBlockEvent(blockType string, payload []byte) SSEEvent {
+	if blockType == "" {
+		blockType = "unknown"
+	}
+
+	return SSEEvent{
+		Event: EventTypes.UNKNOWN_BLOCK,
+		Data: map[string]any{
+			"type":       EventTypes.UNKNOWN_BLOCK,
+			"block_type": blockType,
+			"raw":        rawPayload(payload),
+		},
+	}
+}
+
+// newMetadataEvent 把上游元数据事件包装为upstream_metadata事件，raw同newUnknownBlockEvent
+func newMetadataEvent(eventType string, payload []byte) SSEEvent {
+	return SSEEvent{
+		Event: EventTypes.UPSTREAM_METADATA,
+		Data: map[string]any{
+			"type":       EventTypes.UPSTREAM_METADATA,
+			"event_type": eventType,
+			"raw":        rawPayload(payload),
+		},
+	}
 }
 
 // processErrorMessage 处理错误消息
@@ -211,6 +286,32 @@ func (cmp *CompliantMessageProcessor) processExceptionMessage(message *EventStre
 	}, nil
 }
 
+// trackMessageID 记录assistant消息的messageId
+// 同一响应中出现第二个不同的messageId时返回message_boundary事件
+func (cmp *CompliantMessageProcessor) trackMessageID(messageID string) []SSEEvent {
+	if messageID == "" {
+		return nil
+	}
+	previous := cmp.currentMessageID
+	cmp.currentMessageID = messageID
+	if previous == "" || previous == messageID {
+		return nil
+	}
+
+	logger.Warn("上游响应中出现新的assistant消息",
+		logger.String("previous_message_id", previous),
+		logger.String("message_id", messageID))
+
+	return []SSEEvent{{
+		Event: EventTypes.MESSAGE_BOUNDARY,
+		Data: map[string]any{
+			"type":                EventTypes.MESSAGE_BOUNDARY,
+			"previous_message_id": previous,
+			"message_id":          messageID,
+		},
+	}}
+}
+
 // GetSessionManager 获取会话管理器
 func (cmp *CompliantMessageProcessor) GetSessionManager() *SessionManager {
 	return cmp.sessionManager
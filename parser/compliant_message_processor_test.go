@@ -0,0 +1,101 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestEventMessage 构造带:event-type头的事件消息
+func newTestEventMessage(eventType, payload string) *EventStreamMessage {
+	return &EventStreamMessage{
+		Headers: map[string]HeaderValue{
+			":message-type": {Type: ValueType_STRING, Value: MessageTypes.EVENT},
+			":event-type":   {Type: ValueType_STRING, Value: eventType},
+		},
+		Payload: []byte(payload),
+	}
+}
+
+// TestCompliantMessageProcessor_UnknownBlocks 未知内容块混在正常流中时应被通用捕获，且不影响前后的文本
+func TestCompliantMessageProcessor_UnknownBlocks(t *testing.T) {
+	processor := NewCompliantMessageProcessor()
+
+	messages := []*EventStreamMessage{
+		newTestEventMessage(EventTypes.ASSISTANT_RESPONSE_EVENT, `{"content":"Hello"}`),
+		newTestEventMessage("citationEvent", `{"citations":[{"url":"https://example.com","title":"Example"}]}`),
+		newTestEventMessage(EventTypes.ASSISTANT_RESPONSE_EVENT, `{"type":"web_search_tool_result","name":"web_search","input":{"query":"go"}}`),
+		newTestEventMessage("annotationEvent", `not json`),
+		newTestEventMessage("meteringEvent", `{"unit":"credit","usage":0.02}`),
+		newTestEventMessage("contextUsageEvent", `{"contextUsagePercentage":12.5}`),
+		newTestEventMessage(EventTypes.ASSISTANT_RESPONSE_EVENT, `{"content":" world"}`),
+	}
+
+	var text string
+	var unknown, metadata []map[string]any
+	for _, message := range messages {
+		events, err := processor.ProcessMessage(message)
+		require.NoError(t, err)
+		for _, event := range events {
+			data := event.Data.(map[string]any)
+			switch event.Event {
+			case EventTypes.UNKNOWN_BLOCK:
+				unknown = append(unknown, data)
+			case EventTypes.UPSTREAM_METADATA:
+				metadata = append(metadata, data)
+			case "content_block_delta":
+				text += data["delta"].(map[string]any)["text"].(string)
+			}
+		}
+	}
+
+	assert.Equal(t, "Hello world", text)
+	// 非JSON载荷不像内容块，元数据事件单独交给下游，二者都不是未知内容块
+	require.Len(t, unknown, 2)
+
+	assert.Equal(t, "citationEvent", unknown[0]["block_type"])
+	raw := unknown[0]["raw"].(map[string]any)
+	assert.Contains(t, raw, "citations")
+
+	// 带name/input的未知块不能被当作工具调用
+	assert.Equal(t, "web_search_tool_result", unknown[1]["block_type"])
+	assert.Empty(t, processor.GetToolManager().GetActiveTools())
+
+	require.Len(t, metadata, 2)
+	assert.Equal(t, "meteringEvent", metadata[0]["event_type"])
+	assert.Equal(t, map[string]any{"unit": "credit", "usage": 0.02}, metadata[0]["raw"])
+	assert.Equal(t, "contextUsageEvent", metadata[1]["event_type"])
+}
+
+// FuzzCompliantMessageProcessor_UnknownEventType 任意未知事件类型和载荷都不应返回错误或panic
+// 只有JSON对象载荷作为未知内容块交给下游，其他载荷被丢弃
+func FuzzCompliantMessageProcessor_UnknownEventType(f *testing.F) {
+	f.Add("citationEvent", `{"citations":[]}`)
+	f.Add("searchResultEvent", `{"results":[{"url":"https://example.com"}]}`)
+	f.Add("", `{"type":"annotation"}`)
+	f.Add("metadataEvent", "\x00\xff")
+	f.Add("annotationEvent", `[1,2,3]`)
+
+	f.Fuzz(func(t *testing.T, eventType, payload string) {
+		if _, known := NewCompliantMessageProcessor().eventHandlers[eventType]; known {
+			t.Skip()
+		}
+
+		processor := NewCompliantMessageProcessor()
+		events, err := processor.ProcessMessage(newTestEventMessage(eventType, payload))
+		require.NoError(t, err)
+		if metadataEventTypes[eventType] {
+			require.Len(t, events, 1)
+			assert.Equal(t, EventTypes.UPSTREAM_METADATA, events[0].Event)
+			return
+		}
+		if _, isObject := rawPayload([]byte(payload)).(map[string]any); !isObject {
+			assert.Empty(t, events)
+			return
+		}
+		require.Len(t, events, 1)
+		assert.Equal(t, EventTypes.UNKNOWN_BLOCK, events[0].Event)
+		assert.NotEmpty(t, events[0].Data.(map[string]any)["block_type"])
+	})
+}
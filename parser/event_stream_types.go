@@ -100,6 +100,13 @@ var EventTypes = struct {
 	// 兼容旧格式
 	ASSISTANT_RESPONSE_EVENT string
 	TOOL_USE_EVENT           string
+
+	// 解析器合成事件：同一响应中开始了新的assistant消息
+	MESSAGE_BOUNDARY string
+	// 解析器合成事件：无法识别的事件/内容块类型（引用、搜索结果等）
+	UNKNOWN_BLOCK string
+	// 解析器合成事件：上游的元数据事件（计量、上下文用量等），不是内容块
+	UPSTREAM_METADATA string
 }{
 	COMPLETION:       "completion",
 	COMPLETION_CHUNK: "completion_chunk",
@@ -115,6 +122,10 @@ var EventTypes = struct {
 
 	ASSISTANT_RESPONSE_EVENT: "assistantResponseEvent",
 	TOOL_USE_EVENT:           "toolUseEvent",
+
+	MESSAGE_BOUNDARY:  "message_boundary",
+	UNKNOWN_BLOCK:     "unknown_block",
+	UPSTREAM_METADATA: "upstream_metadata",
 }
 
 // ToolExecution 工具执行状态
@@ -128,6 +139,7 @@ type ToolExecution struct {
 	Result     any                 `json:"result,omitempty"`
 	Error      string              `json:"error,omitempty"`
 	BlockIndex int                 `json:"block_index"`
+	Truncated  bool                `json:"truncated,omitempty"` // 流结束时仍未结束，参数为截至当时已聚合的部分
 }
 
 // ToolExecutionStatus 工具执行状态枚举
@@ -37,6 +37,33 @@ func isToolCallEvent(payload []byte) bool {
 		strings.Contains(payloadStr, "\"name\":") && strings.Contains(payloadStr, "\"input\":")
 }
 
+// knownBlockTypes assistantResponseEvent载荷中可识别的type取值
+var knownBlockTypes = map[string]bool{
+	"text":     true,
+	"tool_use": true,
+}
+
+// unknownBlockType 返回载荷中声明的未知内容块类型，可识别或未声明时返回空字符串
+func unknownBlockType(payload []byte) string {
+	if !strings.Contains(string(payload), "\"type\"") {
+		return ""
+	}
+
+	var data map[string]any
+	if err := utils.FastUnmarshal(payload, &data); err != nil {
+		return ""
+	}
+	if eventData, ok := data["assistantResponseEvent"].(map[string]any); ok {
+		data = eventData
+	}
+
+	blockType, _ := data["type"].(string)
+	if blockType == "" || knownBlockTypes[blockType] {
+		return ""
+	}
+	return blockType
+}
+
 // isStreamingResponse 检查是否为流式响应
 func isStreamingResponse(event *FullAssistantResponseEvent) bool {
 	// 检查是否包含部分内容或状态为进行中
@@ -216,9 +243,9 @@ func (h *ToolCallRequestHandler) Handle(message *EventStreamMessage) ([]SSEEvent
 	logger.Debug("标准工具调用请求处理",
 		logger.String("tool_id", toolCallID),
 		logger.String("tool_name", toolName),
-		logger.Any("input", input))
+		logger.Content("input", input))
 
-	return h.toolManager.HandleToolCallRequest(request), nil
+	return h.toolManager.HandleToolCallRequest(request)
 }
 
 // ToolCallErrorHandler 处理工具调用错误
@@ -302,6 +329,12 @@ type StandardAssistantResponseEventHandler struct {
 }
 
 func (h *StandardAssistantResponseEventHandler) Handle(message *EventStreamMessage) ([]SSEEvent, error) {
+	// 带有非文本type的载荷（如引用、搜索结果）不按文本或工具调用处理
+	if blockType := unknownBlockType(message.Payload); blockType != "" {
+		logger.Debug("assistantResponseEvent中包含未知内容块", logger.String("block_type", blockType))
+		return []SSEEvent{newUnknownBlockEvent(blockType, message.Payload)}, nil
+	}
+
 	// 首先检查是否是工具调用相关的事件
 	if isToolCallEvent(message.Payload) {
 		logger.Debug("检测到工具调用事件，使用聚合器处理")
@@ -310,14 +343,19 @@ func (h *StandardAssistantResponseEventHandler) Handle(message *EventStreamMessa
 
 	// 作为标准事件，优先尝试解析完整格式
 	if fullEvent, err := parseFullAssistantResponseEvent(message.Payload); err == nil {
+		// messageId变化说明上游开始了新的assistant消息，先输出边界事件
+		boundary := h.processor.trackMessageID(fullEvent.MessageID)
+
+		var events []SSEEvent
 		// 对于流式响应，放宽验证要求
 		if isStreamingResponse(fullEvent) {
 			// logger.Debug("检测到流式格式assistantResponseEvent，使用宽松验证")
-			return h.handleStreamingEvent(fullEvent)
+			events, err = h.handleStreamingEvent(fullEvent)
+		} else {
+			// logger.Debug("检测到完整格式assistantResponseEvent，使用标准处理器")
+			events, err = h.handleFullAssistantEvent(fullEvent)
 		}
-
-		// logger.Debug("检测到完整格式assistantResponseEvent，使用标准处理器")
-		return h.handleFullAssistantEvent(fullEvent)
+		return append(boundary, events...), err
 	}
 
 	// 如果完整格式解析失败，回退到legacy格式处理
@@ -348,7 +386,7 @@ func (h *StandardAssistantResponseEventHandler) handleToolCallEvent(message *Eve
 		ToolCalls: []ToolCall{toolCall},
 	}
 
-	return h.processor.toolManager.HandleToolCallRequest(request), nil
+	return h.processor.toolManager.HandleToolCallRequest(request)
 }
 
 // handleStreamingEvent 处理流式事件
@@ -476,7 +514,7 @@ func (h *LegacyToolUseEventHandler) handleToolCallEvent(message *EventStreamMess
 	if err := utils.FastUnmarshal(message.Payload, &evt); err != nil {
 		logger.Warn("解析工具调用事件失败",
 			logger.Err(err),
-			logger.String("payload", string(message.Payload)))
+			logger.Content("payload", message.Payload))
 		return []SSEEvent{}, nil
 	}
 
@@ -521,14 +559,17 @@ func (h *LegacyToolUseEventHandler) handleToolCallEvent(message *EventStreamMess
 		}
 
 		// 先注册工具到管理器
-		events := h.toolManager.HandleToolCallRequest(request)
+		events, err := h.toolManager.HandleToolCallRequest(request)
+		if err != nil {
+			return events, err
+		}
 
 		// 🔥 核心修复：如果是stop事件且是首次注册，说明这是一次性完整数据
 		// 已经在注册时使用了完整参数，无需再通过聚合器处理，直接返回
 		if evt.Stop {
 			logger.Debug("首次注册即收到stop信号，使用完整参数，跳过聚合器",
 				logger.String("toolUseId", evt.ToolUseId),
-				logger.String("arguments", inputStr))
+				logger.Content("arguments", inputStr))
 			return events, nil
 		}
 
@@ -560,7 +601,7 @@ func (h *LegacyToolUseEventHandler) handleToolCallEvent(message *EventStreamMess
 				if err := utils.FastUnmarshal([]byte(fullInput), &testArgs); err != nil {
 					logger.Warn("聚合后的工具调用参数JSON格式无效",
 						logger.String("toolUseId", evt.ToolUseId),
-						logger.String("fullInput", fullInput),
+						logger.Content("fullInput", fullInput),
 						logger.Err(err))
 				} else {
 					h.toolManager.UpdateToolArguments(evt.ToolUseId, testArgs)
@@ -591,7 +632,7 @@ func (h *LegacyToolUseEventHandler) handleToolCallEvent(message *EventStreamMess
 			// 边界情况检查：确保工具ID有效
 			if evt.ToolUseId == "" {
 				logger.Warn("工具调用片段缺少有效的toolUseId，跳过增量事件发送",
-					logger.String("inputFragment", inputStr))
+					logger.Content("inputFragment", inputStr))
 				return []SSEEvent{}, nil
 			}
 
@@ -614,7 +655,7 @@ func (h *LegacyToolUseEventHandler) handleToolCallEvent(message *EventStreamMess
 				logger.Warn("尝试发送增量事件但工具未注册，可能存在时序问题",
 					logger.String("toolUseId", evt.ToolUseId),
 					logger.String("name", evt.Name),
-					logger.String("inputFragment", inputStr))
+					logger.Content("inputFragment", inputStr))
 			}
 		}
 
@@ -337,3 +337,38 @@ func TestLegacyToolUseEventHandler_MemoryLeakPrevention(t *testing.T) {
 
 	t.Log("✅ 内存泄漏预防测试通过")
 }
+
+// TestStandardAssistantResponseEventHandler_MessageBoundary 测试messageId变化时输出边界事件
+func TestStandardAssistantResponseEventHandler_MessageBoundary(t *testing.T) {
+	processor := NewCompliantMessageProcessor()
+	handler := &StandardAssistantResponseEventHandler{processor: processor}
+
+	handle := func(payload string) []SSEEvent {
+		events, err := handler.Handle(&EventStreamMessage{Payload: []byte(payload)})
+		assert.NoError(t, err)
+		return events
+	}
+
+	events := handle(`{"messageId":"msg-1","content":"Hello"}`)
+	assert.Len(t, events, 1)
+	events = handle(`{"messageId":"msg-1","content":" world"}`)
+	assert.Len(t, events, 1)
+
+	// 第二条消息开始：先输出边界事件，再输出内容
+	events = handle(`{"messageId":"msg-2","content":"Hello"}`)
+	assert.Len(t, events, 2)
+	assert.Equal(t, EventTypes.MESSAGE_BOUNDARY, events[0].Event)
+	data := events[0].Data.(map[string]any)
+	assert.Equal(t, "msg-1", data["previous_message_id"])
+	assert.Equal(t, "msg-2", data["message_id"])
+	assert.Equal(t, "content_block_delta", events[1].Event)
+
+	// 没有messageId的增量不视为边界
+	events = handle(`{"content":"!"}`)
+	assert.Len(t, events, 1)
+
+	// Reset后重新开始计算
+	processor.Reset()
+	events = handle(`{"messageId":"msg-3","content":"again"}`)
+	assert.Len(t, events, 1)
+}
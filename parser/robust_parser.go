@@ -133,9 +133,7 @@ func (rp *RobustEventStreamParser) parseSingleMessageWithValidation(data []byte)
 		// 	}
 		// 	return fmt.Sprintf("%x", payloadData)
 		// }()),
-		logger.String("payload_raw", func() string {
-			return string(payloadData)
-		}()))
+		logger.Content("payload_raw", payloadData))
 
 	// CRC 校验（消息 CRC 覆盖整个消息除了最后4字节）
 	// expectedCRC := binary.BigEndian.Uint32(data[payloadEnd:totalLength])
@@ -74,7 +74,7 @@ func (ssja *SonicStreamingJSONAggregator) ProcessToolData(toolUseId, name, input
 		if err := streamer.appendFragment(input); err != nil {
 			logger.Warn("追加JSON片段到Sonic解析器失败",
 				logger.String("toolUseId", toolUseId),
-				logger.String("fragment", input),
+				logger.Content("fragment", input),
 				logger.Err(err))
 		}
 	}
@@ -119,7 +119,7 @@ func (ssja *SonicStreamingJSONAggregator) ProcessToolData(toolUseId, name, input
 			logger.Error("流式解析失败，无有效JSON结果",
 				logger.String("toolName", streamer.toolName),
 				logger.String("toolUseId", streamer.toolUseId),
-				logger.String("buffer", streamer.buffer.String()),
+				logger.Content("buffer", streamer.buffer.String()),
 				logger.Bool("hasValidJSON", streamer.state.hasValidJSON),
 				logger.Int("fragmentCount", streamer.fragmentCount),
 				logger.Int("totalBytes", streamer.totalBytes))
@@ -138,12 +138,7 @@ func (ssja *SonicStreamingJSONAggregator) ProcessToolData(toolUseId, name, input
 	logger.Debug("Sonic流式JSON聚合完成",
 		logger.String("toolUseId", toolUseId),
 		logger.String("toolName", name),
-		logger.String("result", func() string {
-			if len(fullInput) > 100 {
-				return fullInput[:100] + "..."
-			}
-			return fullInput
-		}()),
+		logger.Content("result", fullInput),
 		logger.Int("totalFragments", streamer.fragmentCount),
 		logger.Int("totalBytes", streamer.totalBytes))
 
@@ -204,7 +199,7 @@ func (sjs *SonicJSONStreamer) ensureUTF8Integrity(fragment string) string {
 				logger.Debug("检测到截断的UTF-8字符(2字节)",
 					logger.String("toolUseId", sjs.toolUseId),
 					logger.Int("position", i),
-					logger.String("fragment_end", fragment[utils.IntMax(0, len(fragment)-10):]))
+					logger.Content("fragment_end", fragment[utils.IntMax(0, len(fragment)-10):]))
 				// 保存截断的字符到下一个片段处理
 				sjs.incompleteUTF8 = string(bytes[i:])
 				return string(bytes[:i])
@@ -216,7 +211,7 @@ func (sjs *SonicJSONStreamer) ensureUTF8Integrity(fragment string) string {
 				logger.Debug("检测到截断的UTF-8字符(3字节)",
 					logger.String("toolUseId", sjs.toolUseId),
 					logger.Int("position", i),
-					logger.String("fragment_end", fragment[utils.IntMax(0, len(fragment)-10):]))
+					logger.Content("fragment_end", fragment[utils.IntMax(0, len(fragment)-10):]))
 				sjs.incompleteUTF8 = string(bytes[i:])
 				return string(bytes[:i])
 			}
@@ -227,7 +222,7 @@ func (sjs *SonicJSONStreamer) ensureUTF8Integrity(fragment string) string {
 				logger.Debug("检测到截断的UTF-8字符(4字节)",
 					logger.String("toolUseId", sjs.toolUseId),
 					logger.Int("position", i),
-					logger.String("fragment_end", fragment[utils.IntMax(0, len(fragment)-10):]))
+					logger.Content("fragment_end", fragment[utils.IntMax(0, len(fragment)-10):]))
 				sjs.incompleteUTF8 = string(bytes[i:])
 				return string(bytes[:i])
 			}
@@ -241,9 +236,9 @@ func (sjs *SonicJSONStreamer) ensureUTF8Integrity(fragment string) string {
 		combined := sjs.incompleteUTF8 + fragment
 		logger.Debug("恢复截断的UTF-8字符",
 			logger.String("toolUseId", sjs.toolUseId),
-			logger.String("incomplete", sjs.incompleteUTF8),
-			logger.String("current_fragment", fragment[:min(10, len(fragment))]),
-			logger.String("combined_start", combined[:min(20, len(combined))]))
+			logger.Content("incomplete", sjs.incompleteUTF8),
+			logger.Content("current_fragment", fragment[:min(10, len(fragment))]),
+			logger.Content("combined_start", combined[:min(20, len(combined))]))
 		sjs.incompleteUTF8 = ""                  // 清空
 		return sjs.ensureUTF8Integrity(combined) // 递归处理合并结果
 	}
@@ -305,3 +300,32 @@ func (ssja *SonicStreamingJSONAggregator) cleanupStreamer(streamer *SonicJSONStr
 	streamer.buffer = nil
 	streamer.result = nil
 }
+
+// Flush 流结束时取出未收到停止信号的工具已聚合的参数并释放其解析器，不触发回调
+// 缓冲区不是完整的JSON对象时返回false，调用方保留工具原有参数
+func (ssja *SonicStreamingJSONAggregator) Flush(toolUseId string) (map[string]any, bool) {
+	ssja.mu.Lock()
+	defer ssja.mu.Unlock()
+
+	streamer, exists := ssja.activeStreamers[toolUseId]
+	if !exists {
+		return nil, false
+	}
+	delete(ssja.activeStreamers, toolUseId)
+
+	streamer.tryParseWithSonic()
+	arguments, ok := streamer.result, streamer.state.hasValidJSON && streamer.result != nil
+	ssja.cleanupStreamer(streamer)
+	return arguments, ok
+}
+
+// Reset 释放所有未完成的解析器，解析器复用于下一个请求前必须调用
+func (ssja *SonicStreamingJSONAggregator) Reset() {
+	ssja.mu.Lock()
+	defer ssja.mu.Unlock()
+
+	for _, streamer := range ssja.activeStreamers {
+		ssja.cleanupStreamer(streamer)
+	}
+	ssja.activeStreamers = make(map[string]*SonicJSONStreamer)
+}
@@ -1,11 +1,18 @@
 package parser
 
 import (
+	"errors"
+	"fmt"
+	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/utils"
+	"sort"
 	"time"
 )
 
+// ErrTooManyActiveTools 同时进行的工具调用超过上限，流无法继续
+var ErrTooManyActiveTools = errors.New("同时进行的工具调用过多")
+
 // ToolLifecycleManager 工具调用生命周期管理器
 type ToolLifecycleManager struct {
 	activeTools        map[string]*ToolExecution
@@ -13,6 +20,7 @@ type ToolLifecycleManager struct {
 	blockIndexMap      map[string]int
 	nextBlockIndex     int
 	textIntroGenerated bool // 跟踪是否已生成文本介绍
+	maxActiveTools     int  // 同时进行的工具调用上限
 }
 
 // NewToolLifecycleManager 创建工具生命周期管理器
@@ -22,10 +30,11 @@ func NewToolLifecycleManager() *ToolLifecycleManager {
 		completedTools: make(map[string]*ToolExecution),
 		blockIndexMap:  make(map[string]int),
 		nextBlockIndex: 1, // 索引0预留给文本内容
+		maxActiveTools: config.MaxActiveTools,
 	}
 }
 
-// Reset 重置管理器状态
+// Reset 重置管理器状态，解析器复用于下一个请求前必须调用
 func (tlm *ToolLifecycleManager) Reset() {
 	tlm.activeTools = make(map[string]*ToolExecution)
 	tlm.completedTools = make(map[string]*ToolExecution)
@@ -34,9 +43,9 @@ func (tlm *ToolLifecycleManager) Reset() {
 	tlm.textIntroGenerated = false // 重置文本介绍生成状态
 }
 
-// HandleToolCallRequest 处理工具调用请求
 // HandleToolCallRequest 处理工具调用请求（增强参数验证）
-func (tlm *ToolLifecycleManager) HandleToolCallRequest(request ToolCallRequest) []SSEEvent {
+// 同时进行的工具调用超过上限时返回ErrTooManyActiveTools，已生成的事件仍一并返回
+func (tlm *ToolLifecycleManager) HandleToolCallRequest(request ToolCallRequest) ([]SSEEvent, error) {
 	events := make([]SSEEvent, 0, len(request.ToolCalls)*3) // 调整预分配容量，包含文本介绍
 
 	// *** 关键修复：根据Claude规范，在第一个工具调用前自动生成文本介绍（index:0） ***
@@ -76,6 +85,14 @@ func (tlm *ToolLifecycleManager) HandleToolCallRequest(request ToolCallRequest)
 			continue
 		}
 
+		// 上游异常时（如不断开始新工具却从不结束）中止，避免状态无限增长
+		if len(tlm.activeTools) >= tlm.maxActiveTools {
+			logger.Error("同时进行的工具调用超过上限",
+				logger.String("tool_id", toolCall.ID),
+				logger.Int("max_active_tools", tlm.maxActiveTools))
+			return events, fmt.Errorf("%w（上限%d）", ErrTooManyActiveTools, tlm.maxActiveTools)
+		}
+
 		// 解析工具调用参数
 		var arguments map[string]any
 		if err := utils.SafeUnmarshal([]byte(toolCall.Function.Arguments), &arguments); err != nil {
@@ -137,6 +154,49 @@ func (tlm *ToolLifecycleManager) HandleToolCallRequest(request ToolCallRequest)
 		execution.Status = ToolStatusRunning
 	}
 
+	return events, nil
+}
+
+// FinalizeActiveTools 流结束时结束所有仍在进行的工具调用
+// 按块索引顺序生成带truncated标记的content_block_stop，工具保留已聚合的参数并标记为Truncated
+func (tlm *ToolLifecycleManager) FinalizeActiveTools() []SSEEvent {
+	if len(tlm.activeTools) == 0 {
+		return nil
+	}
+
+	dangling := make([]*ToolExecution, 0, len(tlm.activeTools))
+	for _, execution := range tlm.activeTools {
+		dangling = append(dangling, execution)
+	}
+	sort.Slice(dangling, func(i, j int) bool { return dangling[i].BlockIndex < dangling[j].BlockIndex })
+
+	now := time.Now()
+	events := make([]SSEEvent, 0, len(dangling))
+	for _, execution := range dangling {
+		logger.Warn("流结束时工具调用仍未结束，以已聚合的参数结束",
+			logger.String("tool_id", execution.ID),
+			logger.String("tool_name", execution.Name),
+			logger.Int("block_index", execution.BlockIndex))
+
+		execution.EndTime = &now
+		execution.Status = ToolStatusCompleted
+		execution.Truncated = true
+		if execution.Arguments == nil {
+			execution.Arguments = make(map[string]any)
+		}
+
+		events = append(events, SSEEvent{
+			Event: "content_block_stop",
+			Data: map[string]any{
+				"type":      "content_block_stop",
+				"index":     execution.BlockIndex,
+				"truncated": true,
+			},
+		})
+
+		tlm.completedTools[execution.ID] = execution
+		delete(tlm.activeTools, execution.ID)
+	}
 	return events
 }
 
@@ -426,7 +486,7 @@ func (tlm *ToolLifecycleManager) UpdateToolArgumentsFromJSON(toolID string, json
 	if err := utils.SafeUnmarshal([]byte(jsonArgs), &arguments); err != nil {
 		logger.Warn("解析工具参数JSON失败",
 			logger.String("tool_id", toolID),
-			logger.String("json", jsonArgs),
+			logger.Content("json", jsonArgs),
 			logger.Err(err))
 		return
 	}
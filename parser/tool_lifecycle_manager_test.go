@@ -0,0 +1,164 @@
+package parser
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeTestFrame 构造AWS事件流帧，eventType为空时不带头部（默认视为assistantResponseEvent）
+func encodeTestFrame(eventType, payload string) []byte {
+	var headers []byte
+	if eventType != "" {
+		for _, h := range [][2]string{{":message-type", MessageTypes.EVENT}, {":event-type", eventType}} {
+			headers = append(headers, byte(len(h[0])))
+			headers = append(headers, h[0]...)
+			headers = append(headers, byte(ValueType_STRING))
+			headers = binary.BigEndian.AppendUint16(headers, uint16(len(h[1])))
+			headers = append(headers, h[1]...)
+		}
+	}
+
+	totalLength := 16 + len(headers) + len(payload)
+	frame := make([]byte, totalLength)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(totalLength))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(headers)))
+	copy(frame[12:], headers)
+	copy(frame[12+len(headers):], payload)
+	return frame
+}
+
+// toolUseStream 由toolUseEvent载荷组成的事件流
+func toolUseStream(payloads ...string) []byte {
+	var stream []byte
+	for _, payload := range payloads {
+		stream = append(stream, encodeTestFrame(EventTypes.TOOL_USE_EVENT, payload)...)
+	}
+	return stream
+}
+
+// danglingToolsStream 两个工具调用都没有收到stop：第一个的参数片段已构成完整JSON，第二个的片段被截断
+var danglingToolsStream = append(encodeTestFrame("", `{"content":"Reading."}`), toolUseStream(
+	`{"name":"read_file","toolUseId":"tooluse_read","input":""}`,
+	`{"name":"read_file","toolUseId":"tooluse_read","input":"{\"path\":\"a.go\"}"}`,
+	`{"name":"search","toolUseId":"tooluse_search","input":"{\"query\":\"go\"}"}`,
+	`{"name":"search","toolUseId":"tooluse_search","input":"{\"limit\":"}`,
+)...)
+
+// truncatedStops 提取带truncated标记的content_block_stop的索引
+func truncatedStops(events []SSEEvent) []int {
+	var indexes []int
+	for _, event := range events {
+		data, _ := event.Data.(map[string]any)
+		if event.Event == "content_block_stop" && data["truncated"] == true {
+			indexes = append(indexes, data["index"].(int))
+		}
+	}
+	return indexes
+}
+
+func TestParseResponse_FinalizesDanglingTools(t *testing.T) {
+	p := NewCompliantEventStreamParser()
+	result, err := p.ParseResponse(danglingToolsStream)
+	require.NoError(t, err)
+
+	assert.Empty(t, result.ActiveTools, "流结束后不应残留进行中的工具")
+	require.Len(t, result.ToolExecutions, 2)
+	assert.Equal(t, []int{1, 2}, truncatedStops(result.Events), "按块索引顺序补发结束事件")
+
+	read := result.ToolExecutions["tooluse_read"]
+	assert.True(t, read.Truncated)
+	assert.Equal(t, ToolStatusCompleted, read.Status)
+	assert.Equal(t, map[string]any{"path": "a.go"}, read.Arguments, "已聚合的完整JSON片段作为参数")
+
+	search := result.ToolExecutions["tooluse_search"]
+	assert.True(t, search.Truncated)
+	assert.Equal(t, map[string]any{"query": "go"}, search.Arguments, "不完整的片段不覆盖已有参数")
+
+	// 正常结束的工具不带truncated标记
+	result, err = NewCompliantEventStreamParser().ParseResponse(toolUseStream(
+		`{"name":"read_file","toolUseId":"tooluse_ok","input":""}`,
+		`{"name":"read_file","toolUseId":"tooluse_ok","input":"{\"path\":\"b.go\"}"}`,
+		`{"name":"read_file","toolUseId":"tooluse_ok","stop":true}`,
+	))
+	require.NoError(t, err)
+	require.Contains(t, result.ToolExecutions, "tooluse_ok")
+	assert.False(t, result.ToolExecutions["tooluse_ok"].Truncated)
+	assert.Equal(t, map[string]any{"path": "b.go"}, result.ToolExecutions["tooluse_ok"].Arguments)
+	assert.Empty(t, truncatedStops(result.Events))
+}
+
+func TestParseStream_FinalizeTools(t *testing.T) {
+	p := NewCompliantEventStreamParser()
+	_, err := p.ParseStream(danglingToolsStream)
+	require.NoError(t, err)
+	require.Len(t, p.GetToolManager().GetActiveTools(), 2)
+
+	assert.Equal(t, []int{1, 2}, truncatedStops(p.FinalizeTools()))
+	assert.Empty(t, p.GetToolManager().GetActiveTools())
+	assert.Empty(t, p.FinalizeTools(), "重复调用不再产生事件")
+}
+
+func TestReset_NoToolStateLeaksIntoNextParse(t *testing.T) {
+	p := NewCompliantEventStreamParser()
+
+	// 第一个请求在工具参数中途断开，未调用FinalizeTools
+	_, err := p.ParseStream(danglingToolsStream)
+	require.NoError(t, err)
+	require.NotEmpty(t, p.messageProcessor.toolDataAggregator.activeStreamers)
+
+	// 与StreamProcessorContext.Cleanup相同，复用前重置
+	p.Reset()
+	assert.Empty(t, p.GetToolManager().GetActiveTools())
+	assert.Empty(t, p.GetToolManager().GetCompletedTools())
+	assert.Empty(t, p.messageProcessor.toolDataAggregator.activeStreamers)
+
+	// 同一实例解析下一个请求：不出现上一个请求的工具，块索引从1重新开始
+	result, err := p.ParseResponse(toolUseStream(
+		`{"name":"read_file","toolUseId":"tooluse_read","input":""}`,
+		`{"name":"read_file","toolUseId":"tooluse_read","input":"{\"path\":\"c.go\"}"}`,
+		`{"name":"read_file","toolUseId":"tooluse_read","stop":true}`,
+	))
+	require.NoError(t, err)
+	require.Len(t, result.GetToolCalls(), 1)
+	tool := result.ToolExecutions["tooluse_read"]
+	assert.Equal(t, map[string]any{"path": "c.go"}, tool.Arguments, "不应拼接上一个请求残留的参数片段")
+	assert.Equal(t, 1, tool.BlockIndex)
+	assert.False(t, tool.Truncated)
+	assert.Empty(t, truncatedStops(result.Events))
+}
+
+func TestHandleToolCallRequest_ActiveToolLimit(t *testing.T) {
+	p := NewCompliantEventStreamParser()
+	p.GetToolManager().maxActiveTools = 2
+
+	events, err := p.ParseStream(toolUseStream(
+		`{"name":"a","toolUseId":"tooluse_1","input":""}`,
+		`{"name":"b","toolUseId":"tooluse_2","input":""}`,
+		`{"name":"c","toolUseId":"tooluse_3","input":""}`,
+	))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrTooManyActiveTools), err)
+	assert.Contains(t, err.Error(), "上限2")
+	assert.Len(t, p.GetToolManager().GetActiveTools(), 2, "超过上限的工具不再登记")
+
+	var started int
+	for _, event := range events {
+		if event.Event == "content_block_start" {
+			started++
+		}
+	}
+	assert.Equal(t, 2, started, "上限之前生成的事件仍返回")
+
+	// 非流式解析同样以错误结束
+	p = NewCompliantEventStreamParser()
+	p.GetToolManager().maxActiveTools = 1
+	_, err = p.ParseResponse(toolUseStream(
+		`{"name":"a","toolUseId":"tooluse_1","input":""}`,
+		`{"name":"b","toolUseId":"tooluse_2","input":""}`,
+	))
+	assert.True(t, errors.Is(err, ErrTooManyActiveTools), err)
+}
@@ -0,0 +1,308 @@
+// Package replay 离线重放抓取的上游响应：把抓取的入站请求和上游原始字节送入完整的转换和流式处理流程，
+// 比对重新生成的下游响应与当时实际返回的响应，用于确定性地复现转换问题，也可作为解析器和发送器的回归测试集
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"kiro2api/auth"
+	"kiro2api/fakeupstream"
+	"kiro2api/server"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 抓取目录中的文件
+const (
+	RequestFile  = "request.json"        // 入站请求体
+	MetaFile     = "meta.json"           // 请求路径、请求头和上游状态码（可选）
+	UpstreamFile = "upstream.bin"        // 上游原始响应字节（AWS EventStream）
+	ResponseFile = "response.txt"        // 当时返回给客户端的响应体（SSE或JSON）
+	ReplayFile   = "response.replay.txt" // 重放生成的响应体，写在原响应旁边
+)
+
+// replayClientToken 重放时路由使用的客户端认证token
+const replayClientToken = "replay-client-token"
+
+// Meta 抓取的请求元数据
+type Meta struct {
+	Path           string            `json:"path"`            // 入站路径，默认 /v1/messages
+	Headers        map[string]string `json:"headers"`         // 额外的入站请求头（不含认证）
+	UpstreamStatus int               `json:"upstream_status"` // 上游响应状态码，默认 200
+}
+
+// Capture 一次抓取
+type Capture struct {
+	Dir      string
+	Meta     Meta
+	Request  []byte
+	Upstream []byte
+	Response []byte // 原响应，不存在时为nil
+}
+
+// Result 单个抓取的重放结果
+type Result struct {
+	Dir       string
+	Status    int
+	Output    []byte
+	Matched   bool
+	Missing   bool   // 没有原响应可比对
+	FirstDiff string // 第一处差异的描述
+}
+
+// volatilePatterns 每次生成都会变化的字段（消息ID、SSE流ID、创建时间），比对前统一替换
+var volatilePatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`sse_[0-9a-f]{32}`), "sse_<id>"},
+	{regexp.MustCompile(`msg_\d{14}`), "msg_<id>"},
+	{regexp.MustCompile(`chatcmpl-\d{14}`), "chatcmpl-<id>"},
+	{regexp.MustCompile(`"created":\s*\d+`), `"created":0`},
+}
+
+// Normalize 替换响应中每次生成都会变化的字段
+func Normalize(data []byte) []byte {
+	for _, p := range volatilePatterns {
+		data = p.pattern.ReplaceAll(data, []byte(p.replacement))
+	}
+	return data
+}
+
+// LoadCapture 读取抓取目录
+func LoadCapture(dir string) (*Capture, error) {
+	capture := &Capture{Dir: dir, Meta: Meta{Path: "/v1/messages", UpstreamStatus: http.StatusOK}}
+
+	var err error
+	if capture.Request, err = os.ReadFile(filepath.Join(dir, RequestFile)); err != nil {
+		return nil, fmt.Errorf("读取入站请求失败: %w", err)
+	}
+	if capture.Upstream, err = os.ReadFile(filepath.Join(dir, UpstreamFile)); err != nil {
+		return nil, fmt.Errorf("读取上游响应失败: %w", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, MetaFile)); err == nil {
+		if err := utils.SafeUnmarshal(data, &capture.Meta); err != nil {
+			return nil, fmt.Errorf("解析%s失败: %w", MetaFile, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("读取%s失败: %w", MetaFile, err)
+	}
+	if capture.Response, err = os.ReadFile(filepath.Join(dir, ResponseFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("读取原响应失败: %w", err)
+	}
+	return capture, nil
+}
+
+// FindCaptures 返回dir下的所有抓取目录：dir本身是抓取时只返回dir，否则返回其下一级子目录中的抓取（按名称排序）
+func FindCaptures(dir string) ([]string, error) {
+	if isCaptureDir(dir) {
+		return []string{dir}, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() && isCaptureDir(path) {
+			dirs = append(dirs, path)
+		}
+	}
+	sort.Strings(dirs)
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("%s 下没有抓取（需要 %s 和 %s）", dir, RequestFile, UpstreamFile)
+	}
+	return dirs, nil
+}
+
+func isCaptureDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, RequestFile))
+	return err == nil
+}
+
+// Transport 重放用的上游：生成接口返回当前抓取的上游字节，token刷新和用量查询由假上游响应
+// 同一请求内的多次上游调用（如自动续写）都返回同一份抓取
+type Transport struct {
+	fallback http.RoundTripper
+	status   int
+	body     []byte
+}
+
+// RoundTrip 实现http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/generateAssistantResponse") {
+		return t.fallback.RoundTrip(req)
+	}
+	if req.Body != nil {
+		_, _ = io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	contentType := "application/vnd.amazon.eventstream"
+	if t.status != http.StatusOK {
+		contentType = "application/json"
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", t.status, http.StatusText(t.status)),
+		StatusCode:    t.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		Body:          io.NopCloser(bytes.NewReader(t.body)),
+		ContentLength: int64(len(t.body)),
+		Request:       req,
+	}, nil
+}
+
+// Replayer 在进程内的完整路由上重放抓取，不访问网络
+type Replayer struct {
+	router    *gin.Engine
+	transport *Transport
+}
+
+// NewReplayer 安装重放上游并创建路由，返回的恢复函数还原共享HTTP客户端，并允许再次创建路由
+// 使用合成账号，忽略本机的认证配置；影子请求等会访问外部服务的功能被关闭
+func NewReplayer() (*Replayer, func(), error) {
+	gin.SetMode(gin.TestMode)
+	_ = os.Setenv("AUTH_CONFIG_FILE", filepath.Join(os.TempDir(), "kiro2api-replay-missing.json"))
+	_ = os.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"replay-refresh-token"}]`)
+	_ = os.Unsetenv("SHADOW_URL")
+
+	transport := &Transport{fallback: fakeupstream.NewTransport(fakeupstream.DefaultScenario()), status: http.StatusOK}
+	original := utils.SharedHTTPClient.Transport
+	utils.SharedHTTPClient.Transport = transport
+	restore := func() {
+		utils.SharedHTTPClient.Transport = original
+		server.ResetRouter()
+	}
+
+	authService, err := auth.NewAuthService()
+	if err != nil {
+		restore()
+		return nil, nil, fmt.Errorf("创建认证服务失败: %w", err)
+	}
+	router, err := server.NewRouter(replayClientToken, authService)
+	if err != nil {
+		utils.SharedHTTPClient.Transport = original
+		return nil, nil, fmt.Errorf("创建路由失败: %w", err)
+	}
+	return &Replayer{router: router, transport: transport}, restore, nil
+}
+
+// Replay 重放一个抓取，返回重新生成的响应及与原响应的比对结果
+func (r *Replayer) Replay(capture *Capture) Result {
+	r.transport.status = capture.Meta.UpstreamStatus
+	r.transport.body = capture.Upstream
+
+	req := httptest.NewRequest(http.MethodPost, capture.Meta.Path, bytes.NewReader(capture.Request))
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range capture.Meta.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Authorization", "Bearer "+replayClientToken)
+
+	recorder := httptest.NewRecorder()
+	r.router.ServeHTTP(recorder, req)
+
+	result := Result{Dir: capture.Dir, Status: recorder.Code, Output: recorder.Body.Bytes()}
+	if capture.Response == nil {
+		result.Missing = true
+		return result
+	}
+	result.FirstDiff = firstDiff(Normalize(capture.Response), Normalize(result.Output))
+	result.Matched = result.FirstDiff == ""
+	return result
+}
+
+// firstDiff 描述两份响应的第一处不同的行，相同时返回空字符串
+func firstDiff(expected, actual []byte) string {
+	if bytes.Equal(expected, actual) {
+		return ""
+	}
+	expectedLines := strings.Split(string(expected), "\n")
+	actualLines := strings.Split(string(actual), "\n")
+	for i := 0; i < max(len(expectedLines), len(actualLines)); i++ {
+		var want, got string
+		if i < len(expectedLines) {
+			want = expectedLines[i]
+		}
+		if i < len(actualLines) {
+			got = actualLines[i]
+		}
+		if want != got {
+			return fmt.Sprintf("第%d行\n  原响应: %s\n  重放:   %s", i+1, want, got)
+		}
+	}
+	return "行尾换行不同"
+}
+
+// Run 解析 `kiro2api replay [flags] <capture-dir>` 子命令参数并重放，有不一致的抓取时返回错误
+// capture-dir 可以是单个抓取，也可以是包含多个抓取子目录的目录
+func Run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(out)
+	update := fs.Bool("update", false, "用重放结果覆盖原响应（更新回归基准）")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("用法: kiro2api replay [-update] <capture-dir>")
+	}
+
+	dirs, err := FindCaptures(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	replayer, restore, err := NewReplayer()
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	var mismatched int
+	for _, dir := range dirs {
+		capture, err := LoadCapture(dir)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+		result := replayer.Replay(capture)
+
+		outputFile := ReplayFile
+		if *update {
+			outputFile = ResponseFile
+		}
+		if err := os.WriteFile(filepath.Join(dir, outputFile), result.Output, 0o644); err != nil {
+			return fmt.Errorf("写入重放结果失败: %w", err)
+		}
+
+		switch {
+		case *update:
+			fmt.Fprintf(out, "UPDATE  %s (状态码 %d)\n", dir, result.Status)
+		case result.Missing:
+			fmt.Fprintf(out, "NEW     %s (状态码 %d，没有原响应可比对)\n", dir, result.Status)
+		case result.Matched:
+			fmt.Fprintf(out, "OK      %s\n", dir)
+		default:
+			mismatched++
+			fmt.Fprintf(out, "DIFF    %s: %s\n", dir, result.FirstDiff)
+		}
+	}
+
+	if mismatched > 0 {
+		return fmt.Errorf("%d/%d 个抓取的重放结果与原响应不一致", mismatched, len(dirs))
+	}
+	return nil
+}
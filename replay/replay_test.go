@@ -0,0 +1,128 @@
+package replay
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const capturesDir = "testdata/captures"
+
+// newTestReplayer 创建重放器，测试结束后恢复共享HTTP客户端
+func newTestReplayer(t *testing.T) *Replayer {
+	t.Helper()
+	isolateReplayEnv(t)
+	replayer, restore, err := NewReplayer()
+	require.NoError(t, err)
+	t.Cleanup(restore)
+	return replayer
+}
+
+// isolateReplayEnv 隔离认证相关环境变量，测试结束后还原
+func isolateReplayEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("AUTH_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("KIRO_AUTH_TOKEN", "")
+}
+
+// copyCapture 把抓取复制到临时目录，避免测试改写testdata
+func copyCapture(t *testing.T, name string) string {
+	t.Helper()
+	dst := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.MkdirAll(dst, 0o755))
+	entries, err := os.ReadDir(filepath.Join(capturesDir, name))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(capturesDir, name, entry.Name()))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dst, entry.Name()), data, 0o644))
+	}
+	return dst
+}
+
+// TestGoldenCaptures 重放testdata下的所有抓取，输出须与记录的响应一致
+// 转换逻辑有意变更时用 `kiro2api replay -update replay/testdata/captures` 更新基准
+func TestGoldenCaptures(t *testing.T) {
+	replayer := newTestReplayer(t)
+	dirs, err := FindCaptures(capturesDir)
+	require.NoError(t, err)
+	require.NotEmpty(t, dirs)
+
+	for _, dir := range dirs {
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			capture, err := LoadCapture(dir)
+			require.NoError(t, err)
+			require.NotNil(t, capture.Response, "缺少%s", ResponseFile)
+
+			result := replayer.Replay(capture)
+			assert.True(t, result.Matched, result.FirstDiff)
+		})
+	}
+}
+
+func TestReplay_DetectsDifference(t *testing.T) {
+	replayer := newTestReplayer(t)
+	dir := copyCapture(t, "anthropic_stream_text")
+	responsePath := filepath.Join(dir, ResponseFile)
+	original, err := os.ReadFile(responsePath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(responsePath, bytes.Replace(original, []byte(", world"), []byte(", there"), 1), 0o644))
+
+	capture, err := LoadCapture(dir)
+	require.NoError(t, err)
+	result := replayer.Replay(capture)
+	assert.False(t, result.Matched)
+	assert.Contains(t, result.FirstDiff, ", there")
+	assert.Contains(t, result.FirstDiff, ", world")
+}
+
+func TestRun_WritesReplayNextToCapture(t *testing.T) {
+	isolateReplayEnv(t) // Run自行创建路由，这里只隔离认证环境
+	dir := copyCapture(t, "openai_nonstream_text")
+
+	var out bytes.Buffer
+	require.NoError(t, Run([]string{dir}, &out))
+	assert.Contains(t, out.String(), "OK")
+	replayed, err := os.ReadFile(filepath.Join(dir, ReplayFile))
+	require.NoError(t, err)
+	assert.Contains(t, string(replayed), "Hello, world!")
+
+	// 原响应被改动后以错误返回
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ResponseFile), []byte(`{"unexpected":true}`), 0o644))
+	out.Reset()
+	err = Run([]string{dir}, &out)
+	require.Error(t, err)
+	assert.Contains(t, out.String(), "DIFF")
+}
+
+func TestRun_Usage(t *testing.T) {
+	var out bytes.Buffer
+	assert.Error(t, Run(nil, &out))
+	assert.Error(t, Run([]string{t.TempDir()}, &out), "目录下没有抓取")
+}
+
+func TestNormalize(t *testing.T) {
+	got := string(Normalize([]byte(`id: sse_0123456789abcdef0123456789abcdef:3
+data: {"id":"msg_20250101120000","created": 1735732800}
+{"id":"chatcmpl-20250101120000"}`)))
+	assert.Equal(t, `id: sse_<id>:3
+data: {"id":"msg_<id>","created":0}
+{"id":"chatcmpl-<id>"}`, got)
+	assert.False(t, strings.Contains(got, "2025"))
+}
+
+func TestReplay_OpenAIStopOverLimitRejected(t *testing.T) {
+	replayer := newTestReplayer(t)
+	capture, err := LoadCapture(filepath.Join(capturesDir, "openai_stop_over_limit"))
+	require.NoError(t, err)
+
+	result := replayer.Replay(capture)
+	assert.Equal(t, http.StatusBadRequest, result.Status)
+	assert.Contains(t, string(result.Output), "最多支持4个")
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 访问日志格式（ACCESS_LOG_FORMAT）
+const (
+	AccessLogFormatJSON = "json" // 每个请求一行结构化日志（默认）
+	AccessLogFormatText = "text" // gin默认的人类可读格式
+	AccessLogFormatOff  = "off"  // 关闭访问日志
+)
+
+// 访问日志使用的上下文键，由token选择和请求解析阶段写入
+const (
+	accessLogAccountKey = "access_log_account"
+	accessLogModelKey   = "access_log_model"
+)
+
+// accessLogSink 输出一条结构化访问日志（测试可替换）
+var accessLogSink = func(fields []logger.Field) {
+	logger.Info("access", fields...)
+}
+
+// AccessLogFormatFromEnv 读取 ACCESS_LOG_FORMAT，无效值回退为json
+func AccessLogFormatFromEnv() string {
+	format := strings.ToLower(strings.TrimSpace(os.Getenv("ACCESS_LOG_FORMAT")))
+	switch format {
+	case AccessLogFormatText, AccessLogFormatOff:
+		return format
+	case "", AccessLogFormatJSON:
+		return AccessLogFormatJSON
+	default:
+		logger.Warn("ACCESS_LOG_FORMAT无效，使用json", logger.String("value", format))
+		return AccessLogFormatJSON
+	}
+}
+
+// AccessLogMiddleware 按格式返回访问日志中间件，off时返回nil
+func AccessLogMiddleware(format string) gin.HandlerFunc {
+	switch format {
+	case AccessLogFormatOff:
+		return nil
+	case AccessLogFormatText:
+		return gin.Logger()
+	default:
+		return structuredAccessLog()
+	}
+}
+
+// structuredAccessLog 请求结束后输出一行JSON访问日志
+func structuredAccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+
+		c.Next()
+
+		fields := []logger.Field{
+			logger.Bool("access_log", true),
+			logger.String("method", c.Request.Method),
+			logger.String("path", path),
+			logger.Int("status", c.Writer.Status()),
+			logger.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			logger.Int("bytes", max(c.Writer.Size(), 0)),
+			logger.String("request_id", GetRequestID(c)),
+			logger.String("account", c.GetString(accessLogAccountKey)),
+			logger.String("model", c.GetString(accessLogModelKey)),
+			logger.String("profile", requestPromptProfile(c)),
+			logger.String("client_ip", c.ClientIP()),
+		}
+		if decision := c.GetString(accessLogDecisionKey); decision != "" {
+			fields = append(fields,
+				logger.Float64("cost_credits", c.GetFloat64(accessLogCostKey)),
+				logger.String("cost_decision", decision))
+		}
+		if len(c.Errors) > 0 {
+			fields = append(fields, logger.String("error", c.Errors.String()))
+		}
+		accessLogSink(fields)
+	}
+}
+
+// setAccessLogAccount 记录本次请求使用的账号（脱敏），有邮箱时使用脱敏邮箱，否则使用token指纹
+func setAccessLogAccount(c *gin.Context, token types.TokenInfo, email string) {
+	if email != "" {
+		c.Set(accessLogAccountKey, maskEmail(email))
+		return
+	}
+	if token.AccessToken != "" {
+		c.Set(accessLogAccountKey, tokenFingerprint(token.AccessToken))
+	}
+}
+
+// setAccessLogModel 记录本次请求的模型（模型覆盖之后的值）
+func setAccessLogModel(c *gin.Context, model string) {
+	c.Set(accessLogModelKey, model)
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureAccessLog 替换访问日志输出，返回已记录的日志字段
+func captureAccessLog(t *testing.T) func() []map[string]any {
+	var mutex sync.Mutex
+	var entries []map[string]any
+
+	original := accessLogSink
+	accessLogSink = func(fields []logger.Field) {
+		entry := make(map[string]any, len(fields))
+		for _, f := range fields {
+			entry[f.Key] = f.Value
+		}
+		mutex.Lock()
+		entries = append(entries, entry)
+		mutex.Unlock()
+	}
+	t.Cleanup(func() { accessLogSink = original })
+
+	return func() []map[string]any {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]map[string]any(nil), entries...)
+	}
+}
+
+func newAccessLogRouter(auth *MockAuthService) *gin.Engine {
+	r := gin.New()
+	r.Use(AccessLogMiddleware(AccessLogFormatJSON))
+	r.Use(RequestIDMiddleware())
+	r.POST("/v1/messages", func(c *gin.Context) {
+		reqCtx := &RequestContext{GinContext: c, AuthService: auth, RequestType: "Anthropic"}
+		setAccessLogModel(c, "claude-sonnet-4-5")
+		if _, err := reqCtx.GetTokenWithUsage(); err != nil {
+			return
+		}
+		c.String(http.StatusOK, "hello")
+	})
+	r.POST("/v1/chat/completions", func(c *gin.Context) {
+		reqCtx := &RequestContext{GinContext: c, AuthService: auth, RequestType: "OpenAI"}
+		if _, err := reqCtx.GetToken(); err != nil {
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	return r
+}
+
+func TestAccessLog_StructuredFields(t *testing.T) {
+	entries := captureAccessLog(t)
+	auth := &MockAuthService{tokenUsage: &types.TokenWithUsage{
+		TokenInfo: types.TokenInfo{AccessToken: "secret-access-token"},
+		UserEmail: "caidaoli@gmail.com",
+	}}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages?beta=true", strings.NewReader("{}"))
+	newAccessLogRouter(auth).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	logged := entries()
+	require.Len(t, logged, 1)
+	entry := logged[0]
+	assert.Equal(t, true, entry["access_log"])
+	assert.Equal(t, http.MethodPost, entry["method"])
+	assert.Equal(t, "/v1/messages", entry["path"])
+	assert.Equal(t, http.StatusOK, entry["status"])
+	assert.Equal(t, len("hello"), entry["bytes"])
+	assert.Equal(t, w.Header().Get("X-Request-ID"), entry["request_id"])
+	assert.NotEmpty(t, entry["request_id"])
+	assert.Equal(t, "ca****li@*****.com", entry["account"])
+	assert.Equal(t, "claude-sonnet-4-5", entry["model"])
+	assert.GreaterOrEqual(t, entry["duration_ms"], 0.0)
+	assert.Contains(t, entry, "client_ip")
+}
+
+func TestAccessLog_AccountFallsBackToTokenFingerprint(t *testing.T) {
+	entries := captureAccessLog(t)
+	auth := &MockAuthService{token: types.TokenInfo{AccessToken: "secret-access-token"}}
+
+	w := httptest.NewRecorder()
+	newAccessLogRouter(auth).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+
+	logged := entries()
+	require.Len(t, logged, 1)
+	assert.Equal(t, http.StatusNoContent, logged[0]["status"])
+	assert.Equal(t, 0, logged[0]["bytes"])
+	assert.Equal(t, tokenFingerprint("secret-access-token"), logged[0]["account"])
+	assert.NotContains(t, logged[0]["account"], "secret")
+	assert.Equal(t, "", logged[0]["model"])
+}
+
+func TestAccessLog_TokenFailureStillLogged(t *testing.T) {
+	entries := captureAccessLog(t)
+	auth := &MockAuthService{err: assert.AnError}
+
+	w := httptest.NewRecorder()
+	newAccessLogRouter(auth).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/messages", nil))
+
+	logged := entries()
+	require.Len(t, logged, 1)
+	assert.Equal(t, http.StatusInternalServerError, logged[0]["status"])
+	assert.Equal(t, "", logged[0]["account"])
+	assert.Positive(t, logged[0]["bytes"])
+}
+
+func TestAccessLogFormatFromEnv(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":       AccessLogFormatJSON,
+		"json":   AccessLogFormatJSON,
+		" TEXT ": AccessLogFormatText,
+		"off":    AccessLogFormatOff,
+		"xml":    AccessLogFormatJSON,
+	} {
+		t.Setenv("ACCESS_LOG_FORMAT", value)
+		assert.Equal(t, expected, AccessLogFormatFromEnv(), value)
+	}
+}
+
+func TestAccessLogMiddleware_Formats(t *testing.T) {
+	assert.Nil(t, AccessLogMiddleware(AccessLogFormatOff))
+	assert.NotNil(t, AccessLogMiddleware(AccessLogFormatText))
+
+	// text格式不经过结构化输出
+	entries := captureAccessLog(t)
+	r := gin.New()
+	r.Use(AccessLogMiddleware(AccessLogFormatText))
+	r.GET("/ping", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+	assert.Empty(t, entries())
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IPAllowlist 管理端点的客户端IP白名单
+// 只有直连地址属于可信代理时才采信X-Forwarded-For：从右向左跳过可信代理，第一个非代理地址即客户端
+type IPAllowlist struct {
+	allowed        []netip.Prefix
+	trustedProxies []netip.Prefix
+}
+
+// NewAdminIPAllowlistFromEnv 根据环境变量创建管理端点的IP白名单，未设置时返回nil（不限制）
+// ADMIN_IP_ALLOWLIST: 逗号分隔的CIDR或单个IP
+// TRUSTED_PROXIES: 逗号分隔的可信反向代理CIDR或IP，仅来自这些地址的请求采信X-Forwarded-For
+// 白名单已设置但没有有效条目时拒绝所有请求，避免配置错误导致放开
+func NewAdminIPAllowlistFromEnv() *IPAllowlist {
+	value := strings.TrimSpace(os.Getenv("ADMIN_IP_ALLOWLIST"))
+	if value == "" {
+		return nil
+	}
+	allowlist := &IPAllowlist{
+		allowed:        parsePrefixList("ADMIN_IP_ALLOWLIST", value),
+		trustedProxies: NewTrustedProxiesFromEnv(),
+	}
+	if len(allowlist.allowed) == 0 {
+		logger.Warn("ADMIN_IP_ALLOWLIST没有有效条目，管理端点将拒绝所有请求", logger.String("value", value))
+	}
+	logger.Info("已启用管理端点IP白名单",
+		logger.Int("allowed", len(allowlist.allowed)),
+		logger.Int("trusted_proxies", len(allowlist.trustedProxies)))
+	return allowlist
+}
+
+// parsePrefixList 解析逗号分隔的CIDR或IP列表，无效条目记录警告后忽略
+func parsePrefixList(name, value string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				logger.Warn("忽略无效的CIDR", logger.String("env", name), logger.String("value", item), logger.Err(err))
+				continue
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			logger.Warn("忽略无效的IP", logger.String("env", name), logger.String("value", item), logger.Err(err))
+			continue
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes
+}
+
+// Allows 请求的客户端IP是否在白名单中
+func (a *IPAllowlist) Allows(r *http.Request) bool {
+	addr, ok := a.clientIP(r)
+	return ok && containsAddr(a.allowed, addr)
+}
+
+// clientIP 确定请求的客户端IP；X-Forwarded-For中出现无法解析的地址时视为无法确定
+func (a *IPAllowlist) clientIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	client := remote.Unmap()
+	if !containsAddr(a.trustedProxies, client) {
+		return client, true
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		client = hop.Unmap()
+		if !containsAddr(a.trustedProxies, client) {
+			return client, true
+		}
+	}
+	// 整条链都是可信代理：最左侧的地址即客户端
+	return client, true
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminIPAllowlistMiddleware 限制管理端点的客户端IP，allowlist为nil时不限制
+func AdminIPAllowlistMiddleware(allowlist *IPAllowlist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if allowlist == nil || allowlist.Allows(c.Request) {
+			c.Next()
+			return
+		}
+		logger.Warn("管理端点拒绝非白名单IP",
+			addReqFields(c,
+				logger.String("remote_addr", c.Request.RemoteAddr),
+				logger.String("x_forwarded_for", c.GetHeader("X-Forwarded-For")),
+				logger.String("path", c.Request.URL.Path),
+				logger.String("method", c.Request.Method))...)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "客户端IP不在管理端点白名单中"})
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAdminIPTestRouter(t *testing.T, allowlist, trustedProxies string) *gin.Engine {
+	t.Helper()
+	t.Setenv("ADMIN_IP_ALLOWLIST", allowlist)
+	t.Setenv("TRUSTED_PROXIES", trustedProxies)
+
+	r := gin.New()
+	configAPI := r.Group("/api/config", AdminIPAllowlistMiddleware(NewAdminIPAllowlistFromEnv()))
+	configAPI.POST("", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	return r
+}
+
+func postConfigFrom(r *gin.Engine, remoteAddr string, forwardedFor ...string) int {
+	req := httptest.NewRequest(http.MethodPost, "/api/config", nil)
+	req.RemoteAddr = remoteAddr
+	for _, value := range forwardedFor {
+		req.Header.Add("X-Forwarded-For", value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestAdminIPAllowlist_DirectClients(t *testing.T) {
+	r := newAdminIPTestRouter(t, "10.0.0.0/8, 192.168.1.5, 2001:db8::/32", "")
+
+	assert.Equal(t, http.StatusNoContent, postConfigFrom(r, "10.1.2.3:5000"))
+	assert.Equal(t, http.StatusNoContent, postConfigFrom(r, "192.168.1.5:5000"))
+	assert.Equal(t, http.StatusNoContent, postConfigFrom(r, "[2001:db8::1]:5000"))
+	assert.Equal(t, http.StatusNoContent, postConfigFrom(r, "[::ffff:10.0.0.1]:5000"), "IPv4映射地址按IPv4匹配")
+
+	assert.Equal(t, http.StatusForbidden, postConfigFrom(r, "192.168.1.6:5000"))
+	assert.Equal(t, http.StatusForbidden, postConfigFrom(r, "[2001:db9::1]:5000"))
+}
+
+func TestAdminIPAllowlist_ForwardedForIgnoredWithoutTrustedProxy(t *testing.T) {
+	r := newAdminIPTestRouter(t, "10.0.0.0/8", "")
+
+	// 直连客户端伪造X-Forwarded-For不能绕过白名单
+	assert.Equal(t, http.StatusForbidden, postConfigFrom(r, "203.0.113.9:5000", "10.1.2.3"))
+	// 直连地址在白名单中时忽略X-Forwarded-For
+	assert.Equal(t, http.StatusNoContent, postConfigFrom(r, "10.1.2.3:5000", "203.0.113.9"))
+}
+
+func TestAdminIPAllowlist_BehindTrustedProxy(t *testing.T) {
+	r := newAdminIPTestRouter(t, "198.51.100.0/24", "172.16.0.0/12")
+
+	assert.Equal(t, http.StatusNoContent, postConfigFrom(r, "172.16.0.2:5000", "198.51.100.7"))
+	assert.Equal(t, http.StatusForbidden, postConfigFrom(r, "172.16.0.2:5000", "203.0.113.9"))
+
+	// 多级代理：从右向左跳过可信代理
+	assert.Equal(t, http.StatusNoContent, postConfigFrom(r, "172.16.0.2:5000", "198.51.100.7, 172.16.0.9"))
+	assert.Equal(t, http.StatusNoContent, postConfigFrom(r, "172.16.0.2:5000", "198.51.100.7", "172.16.0.9"))
+
+	// 客户端在最左侧伪造的地址不被采信
+	assert.Equal(t, http.StatusForbidden, postConfigFrom(r, "172.16.0.2:5000", "198.51.100.7, 203.0.113.9"))
+
+	// 无法解析的地址视为无法确定客户端
+	assert.Equal(t, http.StatusForbidden, postConfigFrom(r, "172.16.0.2:5000", "198.51.100.7, garbage"))
+
+	// 可信代理未携带X-Forwarded-For时按代理地址判断
+	assert.Equal(t, http.StatusForbidden, postConfigFrom(r, "172.16.0.2:5000"))
+}
+
+func TestAdminIPAllowlist_Disabled(t *testing.T) {
+	r := newAdminIPTestRouter(t, "", "")
+	assert.Equal(t, http.StatusNoContent, postConfigFrom(r, "203.0.113.9:5000"))
+}
+
+func TestAdminIPAllowlist_InvalidEntriesFailClosed(t *testing.T) {
+	t.Setenv("ADMIN_IP_ALLOWLIST", "not-an-ip, 10.0.0.0/33")
+	allowlist := NewAdminIPAllowlistFromEnv()
+	require.NotNil(t, allowlist)
+	assert.Empty(t, allowlist.allowed)
+
+	r := newAdminIPTestRouter(t, "not-an-ip, 10.0.0.0/33", "")
+	assert.Equal(t, http.StatusForbidden, postConfigFrom(r, "10.1.2.3:5000"))
+}
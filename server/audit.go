@@ -0,0 +1,31 @@
+package server
+
+import (
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditLog 记录审计日志
+// 统一附加 audit 标记、事件名、脱敏后的客户端密钥和请求ID，便于从日志中检索
+func auditLog(c *gin.Context, event string, fields ...logger.Field) {
+	out := make([]logger.Field, 0, len(fields)+3)
+	out = append(out,
+		logger.Bool("audit", true),
+		logger.String("event", event),
+		logger.String("client_key", maskClientKey(extractAPIKey(c))),
+	)
+	out = append(out, fields...)
+	logger.Info("审计事件", addReqFields(c, out...)...)
+}
+
+// maskClientKey 脱敏客户端API密钥，保留首尾少量字符用于区分不同调用方
+func maskClientKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	if len(key) <= 8 {
+		return "***"
+	}
+	return key[:4] + "***" + key[len(key)-4:]
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderAutoContinues 响应头：本次响应自动续写的次数（启用AUTO_CONTINUE时返回）
+const HeaderAutoContinues = "X-Kiro-Auto-Continues"
+
+// autoContinuePrompt 续写请求末尾追加的user消息
+// 上游不支持assistant预填充，以"已输出的部分作为assistant消息 + 继续指令"的形式转发
+const autoContinuePrompt = "Continue exactly where your previous response stopped. Do not repeat any text that was already written and do not add any preamble."
+
+const (
+	defaultMaxContinues = 2
+	maxMaxContinues     = 5
+
+	// stitchMinOverlap 续写开头与已输出文本的重叠至少达到该字节数才去重，避免误删巧合相同的字符
+	stitchMinOverlap = 8
+	// stitchMaxOverlap 拼接时检查的最大重叠字节数
+	stitchMaxOverlap = 512
+)
+
+// sentenceTerminators 视为完整结尾的字符
+const sentenceTerminators = ".!?。！？…)]}\"'`”’》」』*>"
+
+// AutoContinuePolicy 上游提前截断输出时的自动续写策略（仅非流式请求）
+type AutoContinuePolicy struct {
+	MaxContinues int // 单个请求最多续写次数
+}
+
+// autoContinue 全局自动续写策略，nil表示未启用（测试可替换）
+var autoContinue *AutoContinuePolicy
+
+// NewAutoContinuePolicyFromEnv AUTO_CONTINUE=true 时启用，否则返回nil
+// MAX_CONTINUES: 单个请求最多续写次数（默认2，范围1-5）
+func NewAutoContinuePolicyFromEnv() *AutoContinuePolicy {
+	if !utils.GetEnvBool("AUTO_CONTINUE") {
+		return nil
+	}
+
+	maxContinues := defaultMaxContinues
+	if value := strings.TrimSpace(os.Getenv("MAX_CONTINUES")); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			maxContinues = min(parsed, maxMaxContinues)
+		} else {
+			logger.Warn("MAX_CONTINUES无效，使用默认值",
+				logger.String("value", value),
+				logger.Int("default", defaultMaxContinues))
+		}
+	}
+
+	logger.Info("已启用非流式响应自动续写", logger.Int("max_continues", maxContinues))
+	return &AutoContinuePolicy{MaxContinues: maxContinues}
+}
+
+// autoContinueResult 自动续写的结果
+type autoContinueResult struct {
+	Text        string // 拼接后的完整文本
+	Continues   int    // 实际续写次数
+	InputTokens int    // 续写请求的输入token合计
+}
+
+// Continue 输出疑似被上游截断时发起续写请求并拼接结果
+// 只在上游自然结束（end_turn且没有工具调用、拒绝或解析超时）时由调用方触发；
+// 已达到客户端max_tokens、续写失败或续写返回工具调用时停止，保留已拼接的文本
+func (p *AutoContinuePolicy) Continue(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo, text string) autoContinueResult {
+	result := autoContinueResult{Text: text}
+	if p == nil {
+		return result
+	}
+
+	estimator := utils.NewTokenEstimator()
+	for result.Continues < p.MaxContinues && looksTruncated(result.Text) {
+		used := estimator.EstimateTextTokens(result.Text)
+		if anthropicReq.MaxTokens > 0 && used >= anthropicReq.MaxTokens {
+			// 达到客户端max_tokens，不属于上游截断
+			break
+		}
+
+		followUp := buildContinuationRequest(anthropicReq, result.Text, used)
+		continuation, err := fetchContinuation(c, followUp, token)
+		if err != nil {
+			logger.Warn("自动续写失败，返回已生成的内容",
+				addReqFields(c,
+					logger.Int("continues", result.Continues),
+					logger.Err(err))...)
+			break
+		}
+		if continuation == "" {
+			break
+		}
+
+		result.Text = stitchContinuation(result.Text, continuation)
+		result.Continues++
+		result.InputTokens += estimator.EstimateTokens(&types.CountTokensRequest{
+			Model:    followUp.Model,
+			System:   followUp.System,
+			Messages: followUp.Messages,
+			Tools:    filterSupportedTools(followUp.Tools),
+		})
+
+		logger.Info("上游输出疑似被截断，已自动续写",
+			addReqFields(c,
+				logger.Int("continues", result.Continues),
+				logger.Int("continuation_length", len(continuation)))...)
+	}
+	return result
+}
+
+// buildContinuationRequest 在原请求后追加已输出的assistant消息和继续指令
+func buildContinuationRequest(anthropicReq types.AnthropicRequest, partial string, usedTokens int) types.AnthropicRequest {
+	followUp := anthropicReq
+	followUp.Messages = make([]types.AnthropicRequestMessage, 0, len(anthropicReq.Messages)+2)
+	followUp.Messages = append(followUp.Messages, anthropicReq.Messages...)
+	followUp.Messages = append(followUp.Messages,
+		types.AnthropicRequestMessage{Role: "assistant", Content: partial},
+		types.AnthropicRequestMessage{Role: "user", Content: autoContinuePrompt},
+	)
+	if anthropicReq.MaxTokens > 0 {
+		followUp.MaxTokens = anthropicReq.MaxTokens - usedTokens
+	}
+	return followUp
+}
+
+// fetchContinuation 发送续写请求并返回续写文本
+// 与executeCodeWhispererRequest不同，失败时不向客户端写入错误，由调用方返回已有内容
+func fetchContinuation(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) (string, error) {
+	req, err := buildCodeWhispererRequest(c, anthropicReq, token, false)
+	if err != nil {
+		return "", err
+	}
+
+	startedAt := time.Now()
+	resp, err := utils.DoRequest(req)
+	if err != nil {
+		requestIndex.Complete(GetRequestID(c), 0, err)
+		recordTokenHealth(token, time.Since(startedAt), 0, err)
+		recordGenerateError(token, 0, err.Error())
+		return "", err
+	}
+	defer resp.Body.Close()
+	requestIndex.Complete(GetRequestID(c), resp.StatusCode, nil)
+	recordTokenHealth(token, time.Since(startedAt), resp.StatusCode, nil)
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		recordGenerateError(token, resp.StatusCode, string(body))
+		return "", fmt.Errorf("上游返回状态码 %d: %s", resp.StatusCode, string(body))
+	}
+
+	body, err := utils.ReadHTTPResponse(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	result, partial, err := parseNonStreamResponse(newNonStreamParser(), body, nonStreamParseTimeout)
+	if err != nil {
+		return "", err
+	}
+	if partial {
+		return "", fmt.Errorf("续写响应解析超时")
+	}
+	result = messageBoundaryPolicy.ApplyToResult(c, result)
+	if len(result.GetToolCalls()) > 0 {
+		return "", fmt.Errorf("续写响应包含工具调用")
+	}
+	if _, refused := findRefusal(result.Events); refused {
+		return "", fmt.Errorf("续写响应被上游拒绝")
+	}
+	return result.GetCompletionText(), nil
+}
+
+// stitchContinuation 拼接续写文本，去掉续写开头重复的已输出内容
+func stitchContinuation(partial, continuation string) string {
+	maxOverlap := min(len(partial), len(continuation), stitchMaxOverlap)
+	for k := maxOverlap; k >= stitchMinOverlap; k-- {
+		if strings.HasSuffix(partial, continuation[:k]) {
+			return partial + continuation[k:]
+		}
+	}
+	return partial + continuation
+}
+
+// looksTruncated 判断文本是否疑似在句子或JSON中间被截断
+func looksTruncated(text string) bool {
+	trimmed := strings.TrimRight(text, " \t")
+	if strings.TrimSpace(trimmed) == "" {
+		return false
+	}
+
+	// 未闭合的代码块
+	if strings.Count(text, "```")%2 == 1 {
+		return true
+	}
+	// 以JSON开头且括号或字符串未闭合
+	if start := strings.TrimSpace(text); strings.HasPrefix(start, "{") || strings.HasPrefix(start, "[") {
+		if jsonIncomplete(start) {
+			return true
+		}
+	}
+
+	// 以换行结尾视为段落完整
+	if strings.HasSuffix(trimmed, "\n") {
+		return false
+	}
+	last, _ := utf8.DecodeLastRuneInString(trimmed)
+	return !strings.ContainsRune(sentenceTerminators, last)
+}
+
+// jsonIncomplete 检查JSON文本的括号和字符串是否未闭合
+func jsonIncomplete(text string) bool {
+	depth := 0
+	inString := false
+	escaped := false
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			}
+			continue
+		}
+		switch ch {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+		}
+	}
+	return inString || depth > 0
+}
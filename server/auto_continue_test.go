@@ -0,0 +1,224 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withAutoContinue 替换全局自动续写策略，测试结束后恢复
+func withAutoContinue(t *testing.T, policy *AutoContinuePolicy) {
+	t.Helper()
+	original := autoContinue
+	autoContinue = policy
+	t.Cleanup(func() { autoContinue = original })
+}
+
+// newTruncatingUpstream 按调用顺序返回responses中的文本，超出后重复最后一个；返回已收到的请求体
+func newTruncatingUpstream(t *testing.T, responses ...string) func() []string {
+	var mu sync.Mutex
+	var bodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		text := responses[min(len(bodies), len(responses))-1]
+		mu.Unlock()
+
+		payload, _ := json.Marshal(map[string]string{"content": text})
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encodeTestEventStreamFrame(string(payload)))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), bodies...)
+	}
+}
+
+func runAutoContinueRequest(t *testing.T, req types.AnthropicRequest) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	handleNonStreamRequest(newTestScope(c, req))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return w, resp
+}
+
+func responseText(t *testing.T, resp map[string]any) string {
+	t.Helper()
+	content, _ := resp["content"].([]any)
+	require.Len(t, content, 1)
+	block := content[0].(map[string]any)
+	require.Equal(t, "text", block["type"])
+	return block["text"].(string)
+}
+
+func TestAutoContinue_StitchesTruncatedJSON(t *testing.T) {
+	withAutoContinue(t, &AutoContinuePolicy{MaxContinues: 2})
+	// 第一次在JSON中间截断；续写重复了最后几个字符，拼接时应去重
+	bodies := newTruncatingUpstream(t,
+		`{"name": "Alice", "tags": ["a`,
+		`"tags": ["admin", "ops"], "age": 30}`,
+	)
+
+	req := newStopTestRequest(false)
+	req.MaxTokens = 1000
+	w, resp := runAutoContinueRequest(t, req)
+
+	text := responseText(t, resp)
+	assert.Equal(t, `{"name": "Alice", "tags": ["admin", "ops"], "age": 30}`, text)
+	var parsed map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(text), &parsed), "拼接结果应为合法JSON")
+	assert.Equal(t, "1", w.Header().Get(HeaderAutoContinues))
+	assert.Equal(t, "end_turn", resp["stop_reason"])
+
+	// 续写请求携带已输出的部分和继续指令
+	requests := bodies()
+	require.Len(t, requests, 2)
+	assert.NotContains(t, requests[0], autoContinuePrompt)
+	assert.Contains(t, requests[1], autoContinuePrompt)
+	assert.Contains(t, requests[1], `[\"a`)
+
+	// 输入token为两次请求之和
+	estimator := utils.NewTokenEstimator()
+	firstInput := estimator.EstimateTokens(&types.CountTokensRequest{Model: req.Model, Messages: req.Messages})
+	usage := resp["usage"].(map[string]any)
+	assert.Greater(t, usage["input_tokens"].(float64), float64(firstInput))
+	assert.Equal(t, float64(estimator.EstimateTextTokens(text)), usage["output_tokens"])
+}
+
+func TestAutoContinue_RespectsMaxContinues(t *testing.T) {
+	withAutoContinue(t, &AutoContinuePolicy{MaxContinues: 2})
+	bodies := newTruncatingUpstream(t, "The first part of the answer", " keeps going and", " then some more")
+
+	req := newStopTestRequest(false)
+	req.MaxTokens = 1000
+	w, resp := runAutoContinueRequest(t, req)
+
+	assert.Equal(t, "The first part of the answer keeps going and then some more", responseText(t, resp))
+	assert.Equal(t, "2", w.Header().Get(HeaderAutoContinues))
+	assert.Len(t, bodies(), 3)
+}
+
+func TestAutoContinue_SkipsWhenNotTruncated(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    *AutoContinuePolicy
+		text      string
+		maxTokens int
+		header    string
+	}{
+		{"未启用", nil, `{"name": "Al`, 1000, ""},
+		{"完整句子", &AutoContinuePolicy{MaxContinues: 2}, "All done.", 1000, "0"},
+		{"已达到客户端max_tokens", &AutoContinuePolicy{MaxContinues: 2}, "one two three four five six seven eight", 1, "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAutoContinue(t, tt.policy)
+			bodies := newTruncatingUpstream(t, tt.text, "should not be requested")
+
+			req := newStopTestRequest(false)
+			req.MaxTokens = tt.maxTokens
+			w, resp := runAutoContinueRequest(t, req)
+
+			assert.Equal(t, tt.text, responseText(t, resp))
+			assert.Equal(t, tt.header, w.Header().Get(HeaderAutoContinues))
+			assert.Len(t, bodies(), 1)
+		})
+	}
+}
+
+func TestAutoContinue_KeepsPartialOnUpstreamError(t *testing.T) {
+	withAutoContinue(t, &AutoContinuePolicy{MaxContinues: 2})
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"Partial answer that stops"}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+
+	req := newStopTestRequest(false)
+	req.MaxTokens = 1000
+	w, resp := runAutoContinueRequest(t, req)
+
+	assert.Equal(t, "Partial answer that stops", responseText(t, resp))
+	assert.Equal(t, "0", w.Header().Get(HeaderAutoContinues))
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestLooksTruncated(t *testing.T) {
+	for _, text := range []string{
+		`{"name": "Al`,
+		`[1, 2, {"a": "b"}`,
+		`{"text": "brace } inside string`,
+		"Here is the code:\n```go\nfunc main() {",
+		"The answer is that the",
+		"First item,",
+	} {
+		assert.True(t, looksTruncated(text), text)
+	}
+	for _, text := range []string{
+		"",
+		"   ",
+		`{"name": "Alice", "tags": ["a", "b"]}`,
+		"All done.",
+		"真的吗？",
+		"完成。",
+		"```go\nfunc main() {}\n```",
+		"- item one\n- item two\n",
+		"(see above)",
+	} {
+		assert.False(t, looksTruncated(text), text)
+	}
+}
+
+func TestStitchContinuation(t *testing.T) {
+	assert.Equal(t, `{"a": "hello world"}`, stitchContinuation(`{"a": "hello wo`, `"a": "hello world"}`), "重复的开头应去除")
+	assert.Equal(t, "abc def", stitchContinuation("abc", " def"))
+	// 重叠过短时不去重，避免误删
+	assert.Equal(t, "the caat sat", stitchContinuation("the ca", "at sat"))
+	assert.Equal(t, "aaaaaaab", stitchContinuation("aaaa", "aaab"))
+	assert.Equal(t, "你好，世界和平与发展", stitchContinuation("你好，世界和平与", "世界和平与发展"), "按字节去重不应破坏多字节字符")
+}
+
+func TestNewAutoContinuePolicyFromEnv(t *testing.T) {
+	t.Setenv("AUTO_CONTINUE", "")
+	assert.Nil(t, NewAutoContinuePolicyFromEnv())
+
+	t.Setenv("AUTO_CONTINUE", "true")
+	t.Setenv("MAX_CONTINUES", "")
+	assert.Equal(t, &AutoContinuePolicy{MaxContinues: 2}, NewAutoContinuePolicyFromEnv())
+
+	t.Setenv("MAX_CONTINUES", "3")
+	assert.Equal(t, &AutoContinuePolicy{MaxContinues: 3}, NewAutoContinuePolicyFromEnv())
+
+	t.Setenv("MAX_CONTINUES", "100")
+	assert.Equal(t, &AutoContinuePolicy{MaxContinues: maxMaxContinues}, NewAutoContinuePolicyFromEnv())
+
+	t.Setenv("MAX_CONTINUES", "0")
+	assert.Equal(t, &AutoContinuePolicy{MaxContinues: 2}, NewAutoContinuePolicyFromEnv())
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderTimeoutMs 客户端指定的服务端等待时长（毫秒），超过服务端上限时按上限处理
+// 非流式请求：整个请求的截止时间，超时返回408
+// 流式请求：等待首个上游字节的时长，超时发送错误事件后结束；之后不再限制
+// 超时会取消上游请求，避免客户端放弃后上游仍在生成并消耗额度
+const HeaderTimeoutMs = "X-Kiro-Timeout-Ms"
+
+// 客户端超时的作用范围
+const (
+	clientTimeoutScopeOverall    = "overall"     // 非流式：整个请求
+	clientTimeoutScopeFirstToken = "first_token" // 流式：首个上游字节之前
+)
+
+// clientTimeoutKey gin上下文中本次请求的客户端超时
+const clientTimeoutKey = "client_timeout"
+
+// clientTimeoutMessage 超时时返回给客户端的错误信息
+const clientTimeoutMessage = "请求超过客户端指定的超时时间（X-Kiro-Timeout-Ms），已取消上游请求"
+
+// ErrClientTimeout 请求超过客户端通过X-Kiro-Timeout-Ms指定的超时
+var ErrClientTimeout = errors.New("request exceeded the client supplied timeout")
+
+// maxClientTimeout X-Kiro-Timeout-Ms的上限（测试可替换）
+var maxClientTimeout = config.DefaultMaxClientTimeout
+
+// NewMaxClientTimeoutFromEnv MAX_CLIENT_TIMEOUT: 客户端超时上限（Go duration格式或秒数，默认10m）
+func NewMaxClientTimeoutFromEnv() time.Duration {
+	value := strings.TrimSpace(os.Getenv("MAX_CLIENT_TIMEOUT"))
+	if value == "" {
+		return config.DefaultMaxClientTimeout
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+		return parsed
+	}
+	logger.Warn("MAX_CLIENT_TIMEOUT无效，使用默认值",
+		logger.String("value", value),
+		logger.Duration("default", config.DefaultMaxClientTimeout))
+	return config.DefaultMaxClientTimeout
+}
+
+// clientTimeout 本次请求生效的客户端超时
+type clientTimeout struct {
+	RequestedMs int64         // 请求头中的毫秒数
+	Applied     time.Duration // 按服务端上限截断后的值
+
+	timer *time.Timer // 流式请求的首字节计时器
+}
+
+// parseClientTimeout 解析X-Kiro-Timeout-Ms并记录到请求上下文，未指定时不做任何处理
+// 值不是正整数时返回400并返回false
+func parseClientTimeout(c *gin.Context) bool {
+	value := strings.TrimSpace(c.GetHeader(HeaderTimeoutMs))
+	if value == "" {
+		return true
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms <= 0 {
+		respondError(c, http.StatusBadRequest, "%s 必须是正整数（毫秒），收到: %q", HeaderTimeoutMs, value)
+		return false
+	}
+
+	applied := min(ms, maxClientTimeout.Milliseconds())
+	timeout := &clientTimeout{RequestedMs: ms, Applied: time.Duration(applied) * time.Millisecond}
+	if applied < ms {
+		logger.Debug("X-Kiro-Timeout-Ms超过服务端上限，按上限处理",
+			addReqFields(c, logger.Int64("requested_ms", ms), logger.Duration("max", maxClientTimeout))...)
+	}
+	c.Set(clientTimeoutKey, timeout)
+	return true
+}
+
+// requestClientTimeout 返回本次请求的客户端超时，未指定时返回nil
+func requestClientTimeout(c *gin.Context) *clientTimeout {
+	if value, exists := c.Get(clientTimeoutKey); exists {
+		if timeout, ok := value.(*clientTimeout); ok {
+			return timeout
+		}
+	}
+	return nil
+}
+
+// beginClientTimeout 为上游请求context设置客户端超时，返回释放函数
+// 非流式请求设置截止时间；流式请求启动首字节计时器，由clientTimeoutReader在收到首个字节时停止
+func beginClientTimeout(c *gin.Context, isStream bool) func() {
+	timeout := requestClientTimeout(c)
+	if timeout == nil {
+		return func() {}
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if isStream {
+		var cancelCause context.CancelCauseFunc
+		ctx, cancelCause = context.WithCancelCause(upstreamContext(c))
+		timeout.timer = time.AfterFunc(timeout.Applied, func() {
+			logger.Info("等待首个上游字节超时，取消上游请求",
+				addReqFields(c, logger.Duration("timeout", timeout.Applied))...)
+			cancelCause(ErrClientTimeout)
+		})
+		cancel = func() {
+			timeout.timer.Stop()
+			cancelCause(nil)
+		}
+	} else {
+		ctx, cancel = context.WithTimeoutCause(upstreamContext(c), timeout.Applied, ErrClientTimeout)
+	}
+	c.Set(upstreamContextKey, ctx)
+	return cancel
+}
+
+// clientTimeoutReader 包装流式上游响应体：收到首个字节后停止首字节计时器
+func clientTimeoutReader(c *gin.Context, body io.Reader) io.Reader {
+	timeout := requestClientTimeout(c)
+	if timeout == nil || timeout.timer == nil {
+		return body
+	}
+	return &firstByteReader{Reader: body, onFirstByte: func() { timeout.timer.Stop() }}
+}
+
+// firstByteReader 首次读到数据时调用onFirstByte
+type firstByteReader struct {
+	io.Reader
+	onFirstByte func()
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.onFirstByte != nil {
+		r.onFirstByte()
+		r.onFirstByte = nil
+	}
+	return n, err
+}
+
+// clientTimedOut 上游请求是否因客户端超时被取消
+func clientTimedOut(c *gin.Context) bool {
+	return errors.Is(context.Cause(upstreamContext(c)), ErrClientTimeout)
+}
+
+// respondClientTimeout 非流式请求超时，返回408
+func respondClientTimeout(c *gin.Context) {
+	logger.Info("请求超过客户端指定的超时", addReqFields(c, clientTimeoutFields(c)...)...)
+	respondErrorWithCode(c, http.StatusRequestTimeout, "timeout_error", "%s", clientTimeoutMessage)
+}
+
+// sendClientTimeout 流式请求在首个上游字节之前超时，发送错误事件
+func sendClientTimeout(c *gin.Context, sender StreamEventSender) {
+	logger.Info("流式请求在首个上游字节之前超时", addReqFields(c, clientTimeoutFields(c)...)...)
+	_ = sender.SendError(c, clientTimeoutMessage, ErrClientTimeout)
+}
+
+func clientTimeoutFields(c *gin.Context) []logger.Field {
+	if timeout := requestClientTimeout(c); timeout != nil {
+		return []logger.Field{logger.Duration("timeout", timeout.Applied)}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSlowUpstream 创建先等待firstDelay再返回首个文本增量、之后等待restDelay再返回其余增量的假上游
+// 返回的通道在上游请求的context被取消时收到通知
+func newSlowUpstream(t *testing.T, firstDelay, restDelay time.Duration, deltas ...string) <-chan struct{} {
+	cancelled := make(chan struct{}, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 读完请求体后服务端才能感知连接关闭
+		_, _ = io.Copy(io.Discard, r.Body)
+		wait := func(d time.Duration) bool {
+			select {
+			case <-time.After(d):
+				return true
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+				return false
+			}
+		}
+
+		if !wait(firstDelay) {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		for i, delta := range deltas {
+			if i == 1 && !wait(restDelay) {
+				return
+			}
+			payload, _ := json.Marshal(map[string]string{"content": delta})
+			_, _ = w.Write(encodeTestEventStreamFrame(string(payload)))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	return cancelled
+}
+
+func newClientTimeoutContext(t *testing.T, path, timeoutMs string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", path, nil)
+	if timeoutMs != "" {
+		c.Request.Header.Set(HeaderTimeoutMs, timeoutMs)
+	}
+	require.True(t, parseClientTimeout(c))
+	return c, w
+}
+
+func assertUpstreamCancelled(t *testing.T, cancelled <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("上游请求未被取消")
+	}
+}
+
+func TestParseClientTimeout(t *testing.T) {
+	original := maxClientTimeout
+	maxClientTimeout = 2 * time.Second
+	t.Cleanup(func() { maxClientTimeout = original })
+
+	cases := []struct {
+		header      string
+		wantOK      bool
+		wantApplied time.Duration
+	}{
+		{header: "", wantOK: true},
+		{header: "1500", wantOK: true, wantApplied: 1500 * time.Millisecond},
+		{header: "60000", wantOK: true, wantApplied: 2 * time.Second},
+		{header: "9223372036854775807", wantOK: true, wantApplied: 2 * time.Second},
+		{header: "0", wantOK: false},
+		{header: "-5", wantOK: false},
+		{header: "1.5s", wantOK: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.header, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+			c.Request.Header.Set(HeaderTimeoutMs, tc.header)
+
+			assert.Equal(t, tc.wantOK, parseClientTimeout(c))
+			if !tc.wantOK {
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				return
+			}
+			timeout := requestClientTimeout(c)
+			if tc.wantApplied == 0 {
+				assert.Nil(t, timeout)
+				return
+			}
+			require.NotNil(t, timeout)
+			assert.Equal(t, tc.wantApplied, timeout.Applied)
+		})
+	}
+}
+
+func TestClientTimeout_NonStreamExpiresBeforeFirstByte(t *testing.T) {
+	cancelled := newSlowUpstream(t, time.Second, 0, "hello")
+	c, w := newClientTimeoutContext(t, "/v1/messages", "100")
+
+	handleNonStreamRequest(newTestScope(c, newStopTestRequest(false)))
+
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), "timeout_error")
+	assertUpstreamCancelled(t, cancelled)
+}
+
+func TestClientTimeout_NonStreamExpiresAfterFirstByte(t *testing.T) {
+	// 非流式请求的超时覆盖整个请求：已收到部分响应也返回408
+	cancelled := newSlowUpstream(t, 0, time.Second, "hello", " world")
+	c, w := newClientTimeoutContext(t, "/v1/chat/completions", "100")
+
+	handleOpenAINonStreamRequest(newTestScope(c, newStopTestRequest(false)))
+
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), "timeout_error")
+	assertUpstreamCancelled(t, cancelled)
+}
+
+func TestClientTimeout_NonStreamWithinTimeout(t *testing.T) {
+	newSlowUpstream(t, 0, 0, "hello", " world")
+	c, w := newClientTimeoutContext(t, "/v1/messages", "5000")
+
+	handleNonStreamRequest(newTestScope(c, newStopTestRequest(false)))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "hello world")
+}
+
+func TestClientTimeout_StreamExpiresBeforeFirstByte(t *testing.T) {
+	cancelled := newSlowUpstream(t, time.Second, 0, "hello")
+	c, w := newClientTimeoutContext(t, "/v1/messages", "100")
+
+	handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+	body := w.Body.String()
+	assert.Contains(t, body, "event: error")
+	assert.Contains(t, body, clientTimeoutMessage)
+	assert.NotContains(t, body, "message_stop")
+	assertUpstreamCancelled(t, cancelled)
+}
+
+func TestClientTimeout_StreamNotLimitedAfterFirstByte(t *testing.T) {
+	// 流式请求只限制首字节：收到首个字节后上游再慢也不中止
+	newSlowUpstream(t, 0, 300*time.Millisecond, "hello", " world")
+	c, w := newClientTimeoutContext(t, "/v1/messages", "100")
+
+	handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+	body := w.Body.String()
+	assert.NotContains(t, body, "event: error")
+	assert.Contains(t, body, "world")
+	assert.Contains(t, body, "message_stop")
+}
+
+func TestClientTimeout_OpenAIStreamExpiresBeforeFirstByte(t *testing.T) {
+	cancelled := newSlowUpstream(t, time.Second, 0, "hello")
+	c, w := newClientTimeoutContext(t, "/v1/chat/completions", "100")
+
+	handleOpenAIStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+	assert.Contains(t, w.Body.String(), clientTimeoutMessage)
+	assertUpstreamCancelled(t, cancelled)
+}
+
+func TestClientTimeout_EffectiveParams(t *testing.T) {
+	original := maxClientTimeout
+	maxClientTimeout = time.Second
+	t.Cleanup(func() { maxClientTimeout = original })
+
+	for _, stream := range []bool{false, true} {
+		c, _ := newClientTimeoutContext(t, "/v1/messages", "5000")
+		req := newStopTestRequest(stream)
+		params, err := computeEffectiveParams(c, req)
+		require.NoError(t, err)
+		require.NotNil(t, params.Timeout)
+		assert.Equal(t, int64(5000), params.Timeout.RequestedMs)
+		assert.Equal(t, int64(1000), params.Timeout.AppliedMs)
+		if stream {
+			assert.Equal(t, clientTimeoutScopeFirstToken, params.Timeout.Scope)
+		} else {
+			assert.Equal(t, clientTimeoutScopeOverall, params.Timeout.Scope)
+		}
+	}
+
+	c, _ := newClientTimeoutContext(t, "/v1/messages", "")
+	params, err := computeEffectiveParams(c, newStopTestRequest(false))
+	require.NoError(t, err)
+	assert.Nil(t, params.Timeout)
+}
+
+func TestNewMaxClientTimeoutFromEnv(t *testing.T) {
+	t.Setenv("MAX_CLIENT_TIMEOUT", "")
+	assert.Equal(t, 10*time.Minute, NewMaxClientTimeoutFromEnv())
+
+	t.Setenv("MAX_CLIENT_TIMEOUT", "30")
+	assert.Equal(t, 30*time.Second, NewMaxClientTimeoutFromEnv())
+
+	t.Setenv("MAX_CLIENT_TIMEOUT", "2m")
+	assert.Equal(t, 2*time.Minute, NewMaxClientTimeoutFromEnv())
+
+	t.Setenv("MAX_CLIENT_TIMEOUT", "bogus")
+	assert.Equal(t, 10*time.Minute, NewMaxClientTimeoutFromEnv())
+}
+
+func TestFirstByteReader(t *testing.T) {
+	calls := 0
+	reader := &firstByteReader{Reader: strings.NewReader("abc"), onFirstByte: func() { calls++ }}
+	buf := make([]byte, 1)
+	for i := 0; i < 3; i++ {
+		_, err := reader.Read(buf)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, calls)
+}
@@ -2,11 +2,14 @@ package server
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
+	"kiro2api/auth"
 	"kiro2api/config"
 	"kiro2api/converter"
 	"kiro2api/logger"
@@ -87,24 +90,42 @@ func filterSupportedTools(tools []types.AnthropicTool) []types.AnthropicTool {
 	return filtered
 }
 
-func executeCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) (*http.Response, error) {
-	req, err := buildCodeWhispererRequest(c, anthropicReq, tokenInfo, isStream)
+// executeCodeWhispererRequest 按请求范围发送上游请求，记录上游请求的时间点
+func executeCodeWhispererRequest(scope *RequestScope) (*http.Response, error) {
+	c, tokenInfo := scope.c, scope.TokenInfo()
+	req, err := buildCodeWhispererRequest(c, scope.Request, tokenInfo, scope.Stream)
 	if err != nil {
-		// 检查是否是模型未找到错误，如果是，则响应已经发送，不需要再次处理
-		if _, ok := err.(*types.ModelNotFoundErrorType); ok {
+		// 模型未找到错误由调用方按请求方言和流式状态响应（respondModelNotFound）
+		var modelNotFound *types.ModelNotFoundErrorType
+		if errors.As(err, &modelNotFound) {
 			return nil, err
 		}
 		handleRequestBuildError(c, err)
 		return nil, err
 	}
 
+	scope.UpstreamStartedAt = time.Now()
 	resp, err := utils.DoRequest(req)
 	if err != nil {
+		requestIndex.Complete(GetRequestID(c), 0, err)
+		// 被同一会话的新流取消不是账号问题，由调用方通知客户端
+		if streamSuperseded(c) {
+			return nil, ErrStreamSuperseded
+		}
+		// 客户端指定的超时到期，同样不计入账号健康，由调用方通知客户端
+		if clientTimedOut(c) {
+			return nil, ErrClientTimeout
+		}
+		scope.recordTokenResult(time.Since(scope.UpstreamStartedAt), 0, err)
+		recordGenerateError(tokenInfo, 0, err.Error())
 		handleRequestSendError(c, err)
 		return nil, err
 	}
+	scope.UpstreamRespondedAt = time.Now()
+	requestIndex.Complete(GetRequestID(c), resp.StatusCode, nil)
+	scope.recordTokenResult(scope.UpstreamRespondedAt.Sub(scope.UpstreamStartedAt), resp.StatusCode, nil)
 
-	if handleCodeWhispererError(c, resp) {
+	if handleCodeWhispererError(c, resp, tokenInfo) {
 		resp.Body.Close()
 		return nil, fmt.Errorf("CodeWhisperer API error")
 	}
@@ -126,14 +147,14 @@ var execCWRequest = executeCodeWhispererRequest
 func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) (*http.Request, error) {
 	cwReq, err := converter.BuildCodeWhispererRequest(anthropicReq, c)
 	if err != nil {
-		// 检查是否是模型未找到错误
-		if modelNotFoundErr, ok := err.(*types.ModelNotFoundErrorType); ok {
-			// 直接返回用户期望的JSON格式
-			c.JSON(http.StatusBadRequest, modelNotFoundErr.ErrorData)
+		// 模型未找到错误原样返回，由处理函数响应
+		var modelNotFound *types.ModelNotFoundErrorType
+		if errors.As(err, &modelNotFound) {
 			return nil, err
 		}
 		return nil, fmt.Errorf("构建CodeWhisperer请求失败: %v", err)
 	}
+	cwReq.ProfileArn = resolveProfileArn(tokenInfo)
 
 	cwReqBody, err := utils.SafeMarshal(cwReq)
 	if err != nil {
@@ -156,15 +177,32 @@ func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	logger.Debug("发送给CodeWhisperer的请求",
 		logger.String("direction", "upstream_request"),
 		logger.Int("request_size", len(cwReqBody)),
-		logger.String("request_body", string(cwReqBody)),
+		logContent(c, "request_body", cwReqBody),
 		logger.Int("tools_count", len(cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools)),
 		logger.String("tools_names", toolNamesPreview))
 
-	req, err := http.NewRequest("POST", config.CodeWhispererURL, bytes.NewReader(cwReqBody))
+	req, err := http.NewRequestWithContext(upstreamContext(c), "POST", config.CodeWhispererURL(), bytes.NewReader(cwReqBody))
 	if err != nil {
 		return nil, fmt.Errorf("创建请求失败: %v", err)
 	}
 
+	setCodeWhispererHeaders(req, tokenInfo, isStream)
+	attributeUpstreamRequest(c, req, anthropicReq, tokenInfo, isStream)
+
+	return req, nil
+}
+
+// resolveProfileArn 选择上游请求使用的profile ARN
+// 优先级：认证配置的profileArn（已在token刷新时写入tokenInfo）> 刷新响应返回的ARN > 全局默认值
+func resolveProfileArn(tokenInfo types.TokenInfo) string {
+	if tokenInfo.ProfileArn != "" {
+		return tokenInfo.ProfileArn
+	}
+	return config.CodeWhispererProfileArn()
+}
+
+// setCodeWhispererHeaders 设置上游generateAssistantResponse请求所需的header
+func setCodeWhispererHeaders(req *http.Request, tokenInfo types.TokenInfo, isStream bool) {
 	req.Header.Set("Authorization", "Bearer "+tokenInfo.AccessToken)
 	req.Header.Set("Content-Type", "application/json")
 	if isStream {
@@ -175,18 +213,17 @@ func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	req.Header.Set("x-amzn-kiro-agent-mode", "spec")
 	req.Header.Set("x-amz-user-agent", "aws-sdk-js/1.0.18 KiroIDE-0.2.13-66c23a8c5d15afabec89ef9954ef52a119f10d369df04d548fc6c1eac694b0d1")
 	req.Header.Set("user-agent", "aws-sdk-js/1.0.18 ua/2.1 os/darwin#25.0.0 lang/js md/nodejs#20.16.0 api/codewhispererstreaming#1.0.18 m/E KiroIDE-0.2.13-66c23a8c5d15afabec89ef9954ef52a119f10d369df04d548fc6c1eac694b0d1")
-
-	return req, nil
 }
 
 // handleCodeWhispererError 处理CodeWhisperer API错误响应 (重构后符合SOLID原则)
-func handleCodeWhispererError(c *gin.Context, resp *http.Response) bool {
+func handleCodeWhispererError(c *gin.Context, resp *http.Response, tokenInfo types.TokenInfo) bool {
 	if resp.StatusCode == http.StatusOK {
 		return false
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
+		recordGenerateError(tokenInfo, resp.StatusCode, err.Error())
 		logger.Error("读取错误响应失败",
 			addReqFields(c,
 				logger.String("direction", "upstream_response"),
@@ -196,13 +233,29 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response) bool {
 		return true
 	}
 
-	logger.Error("上游响应错误",
-		addReqFields(c,
-			logger.String("direction", "upstream_response"),
-			logger.Int("status_code", resp.StatusCode),
-			logger.Int("response_len", len(body)),
-			logger.String("response_body", string(body)),
-		)...)
+	if isUpstreamRequestErrorStatus(resp.StatusCode) {
+		// 请求本身被拒绝：原始响应体可能包含用户输入，只写入debug日志
+		logger.Warn("上游拒绝请求",
+			addReqFields(c,
+				logger.String("direction", "upstream_response"),
+				logger.Int("status_code", resp.StatusCode),
+				logger.Int("response_len", len(body)),
+			)...)
+		logger.Debug("上游拒绝请求的原始响应",
+			addReqFields(c,
+				logger.String("direction", "upstream_response"),
+				logContent(c, "response_body", body),
+			)...)
+	} else {
+		logger.Error("上游响应错误",
+			addReqFields(c,
+				logger.String("direction", "upstream_response"),
+				logger.Int("status_code", resp.StatusCode),
+				logger.Int("response_len", len(body)),
+				logContent(c, "response_body", body),
+			)...)
+	}
+	recordGenerateError(tokenInfo, resp.StatusCode, string(body))
 
 	// 特殊处理：403错误表示token失效 (保持向后兼容)
 	if resp.StatusCode == http.StatusForbidden {
@@ -224,6 +277,15 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response) bool {
 				logger.String("claude_stop_reason", "max_tokens"),
 			)...)
 		errorMapper.SendClaudeError(c, claudeError)
+	} else if claudeError.Type == "overloaded_error" {
+		logger.Warn("上游过载，返回overloaded_error",
+			addReqFields(c, logger.Int("upstream_status", resp.StatusCode))...)
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+			c.Header("Retry-After", retryAfter)
+		}
+		respondOverloaded(c, claudeError.Message)
+	} else if claudeError.Type == "invalid_request_error" {
+		respondUpstreamRequestRejected(c, claudeError.Message)
 	} else {
 		// 其他错误使用传统方式处理 (向后兼容)
 		respondErrorWithCode(c, http.StatusInternalServerError, "cw_error", "CodeWhisperer Error: %s", string(body))
@@ -232,6 +294,50 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response) bool {
 	return true
 }
 
+// StatusOverloaded Anthropic用于表示服务过载的非标准HTTP状态码
+const StatusOverloaded = 529
+
+// respondOverloaded 按客户端使用的API方言返回过载错误
+// Anthropic: 529 + overloaded_error；OpenAI: 503 + server_error
+// 流式响应头已发出时只能以SSE错误事件的形式下发
+func respondOverloaded(c *gin.Context, message string) {
+	if isOpenAIRequest(c) {
+		errorResp := map[string]any{
+			"error": map[string]any{
+				"message": message,
+				"type":    "server_error",
+				"code":    "overloaded",
+			},
+		}
+		if c.Writer.Written() {
+			_ = (&OpenAIStreamSender{}).SendEvent(c, errorResp)
+			return
+		}
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.JSON(http.StatusServiceUnavailable, errorResp)
+		return
+	}
+
+	errorResp := map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    "overloaded_error",
+			"message": message,
+		},
+	}
+	if c.Writer.Written() {
+		_ = (&AnthropicStreamSender{}).SendEvent(c, errorResp)
+		return
+	}
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.JSON(StatusOverloaded, errorResp)
+}
+
+// isOpenAIRequest 判断当前请求是否来自OpenAI兼容端点
+func isOpenAIRequest(c *gin.Context) bool {
+	return c.Request != nil && strings.HasPrefix(c.Request.URL.Path, "/v1/chat/completions")
+}
+
 // StreamEventSender 统一的流事件发送接口
 type StreamEventSender interface {
 	SendEvent(c *gin.Context, data any) error
@@ -262,11 +368,10 @@ func (s *AnthropicStreamSender) SendEvent(c *gin.Context, data any) error {
 			// logger.String("direction", "downstream_send"),
 			logger.String("event", eventType),
 			// logger.Int("payload_len", len(json)),
-			logger.String("payload_preview", string(json)),
+			logContent(c, "payload_preview", json),
 		)...)
 
-	fmt.Fprintf(c.Writer, "event: %s\n", eventType)
-	fmt.Fprintf(c.Writer, "data: %s\n\n", string(json))
+	writeSSEFrame(c, eventType, json)
 	c.Writer.Flush()
 	return nil
 }
@@ -299,7 +404,7 @@ func (s *OpenAIStreamSender) SendEvent(c *gin.Context, data any) error {
 			logger.Int("payload_len", len(json)),
 		)...)
 
-	fmt.Fprintf(c.Writer, "data: %s\n\n", string(json))
+	writeSSEFrame(c, "", json)
 	c.Writer.Flush()
 	return nil
 }
@@ -318,7 +423,7 @@ func (s *OpenAIStreamSender) SendError(c *gin.Context, message string, _ error)
 		return err
 	}
 
-	fmt.Fprintf(c.Writer, "data: %s\n\n", string(json))
+	writeSSEFrame(c, "", json)
 	c.Writer.Flush()
 	return nil
 }
@@ -333,67 +438,78 @@ type RequestContext struct {
 	RequestType string // "anthropic" 或 "openai"
 }
 
-// GetTokenAndBody 通用的token获取和请求体读取
-// 返回: tokenInfo, requestBody, error
-func (rc *RequestContext) GetTokenAndBody() (types.TokenInfo, []byte, error) {
-	// 获取token
+// GetToken 获取token，失败时已写入错误响应
+func (rc *RequestContext) GetToken() (types.TokenInfo, error) {
+	if _, override := rc.strategyProvider(); override {
+		// 按请求指定的策略选择（由GetTokenWithUsage校验策略并写入错误响应）
+		tokenWithUsage, err := rc.GetTokenWithUsage()
+		if err != nil {
+			return types.TokenInfo{}, err
+		}
+		return tokenWithUsage.TokenInfo, nil
+	}
+
 	tokenInfo, err := rc.AuthService.GetToken()
 	if err != nil {
 		logger.Error("获取token失败", logger.Err(err))
 		respondError(rc.GinContext, http.StatusInternalServerError, "获取token失败: %v", err)
-		return types.TokenInfo{}, nil, err
+		return types.TokenInfo{}, err
 	}
+	setAccessLogAccount(rc.GinContext, tokenInfo, "")
+	return tokenInfo, nil
+}
 
-	// 读取请求体
-	body, err := rc.GinContext.GetRawData()
+// GetTokenWithUsage 获取token（包含使用信息），失败时已写入错误响应
+func (rc *RequestContext) GetTokenWithUsage() (*types.TokenWithUsage, error) {
+	var tokenWithUsage *types.TokenWithUsage
+	var err error
+	if provider, override := rc.strategyProvider(); override {
+		strategy, parseErr := auth.ParseSelectionStrategy(rc.GinContext.GetHeader(selectionStrategyHeader))
+		if parseErr != nil {
+			respondError(rc.GinContext, http.StatusBadRequest, "%s: %v", selectionStrategyHeader, parseErr)
+			return nil, parseErr
+		}
+		tokenWithUsage, err = provider.GetTokenWithStrategy(strategy)
+	} else {
+		tokenWithUsage, err = rc.AuthService.GetTokenWithUsage()
+	}
 	if err != nil {
-		logger.Error("读取请求体失败", logger.Err(err))
-		respondError(rc.GinContext, http.StatusBadRequest, "读取请求体失败: %v", err)
-		return types.TokenInfo{}, nil, err
+		logger.Error("获取token失败", logger.Err(err))
+		respondError(rc.GinContext, http.StatusInternalServerError, "获取token失败: %v", err)
+		return nil, err
 	}
+	setAccessLogAccount(rc.GinContext, tokenWithUsage.TokenInfo, tokenWithUsage.UserEmail)
 
-	// 记录请求日志
-	logger.Debug(fmt.Sprintf("收到%s请求", rc.RequestType),
+	logger.Debug("已选择token",
 		addReqFields(rc.GinContext,
-			logger.String("direction", "client_request"),
-			logger.String("body", string(body)),
-			logger.Int("body_size", len(body)),
-			logger.String("remote_addr", rc.GinContext.ClientIP()),
-			logger.String("user_agent", rc.GinContext.GetHeader("User-Agent")),
+			logger.Float64("available_count", tokenWithUsage.AvailableCount),
 		)...)
 
-	return tokenInfo, body, nil
+	return tokenWithUsage, nil
 }
 
-// GetTokenWithUsageAndBody 获取token（包含使用信息）和请求体
-// 返回: tokenWithUsage, requestBody, error
-func (rc *RequestContext) GetTokenWithUsageAndBody() (*types.TokenWithUsage, []byte, error) {
-	// 获取token（包含使用信息）
-	tokenWithUsage, err := rc.AuthService.GetTokenWithUsage()
-	if err != nil {
-		logger.Error("获取token失败", logger.Err(err))
-		respondError(rc.GinContext, http.StatusInternalServerError, "获取token失败: %v", err)
-		return nil, nil, err
-	}
+// requestBodyContextKey gin上下文中保存客户端原始请求体的键，用于计算SSE续传的请求摘要
+const requestBodyContextKey = "raw_request_body"
 
-	// 读取请求体
+// ReadBody 读取请求体并记录请求日志，失败时已写入错误响应
+func (rc *RequestContext) ReadBody() ([]byte, error) {
 	body, err := rc.GinContext.GetRawData()
 	if err != nil {
 		logger.Error("读取请求体失败", logger.Err(err))
 		respondError(rc.GinContext, http.StatusBadRequest, "读取请求体失败: %v", err)
-		return nil, nil, err
+		return nil, err
 	}
+	rc.GinContext.Set(requestBodyContextKey, body)
 
 	// 记录请求日志
 	logger.Debug(fmt.Sprintf("收到%s请求", rc.RequestType),
 		addReqFields(rc.GinContext,
 			logger.String("direction", "client_request"),
-			logger.String("body", string(body)),
+			logContent(rc.GinContext, "body", body),
 			logger.Int("body_size", len(body)),
 			logger.String("remote_addr", rc.GinContext.ClientIP()),
 			logger.String("user_agent", rc.GinContext.GetHeader("User-Agent")),
-			logger.Float64("available_count", tokenWithUsage.AvailableCount),
 		)...)
 
-	return tokenWithUsage, body, nil
+	return body, nil
 }
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -99,66 +98,6 @@ func TestRespondError(t *testing.T) {
 	}
 }
 
-func TestRequestContext_GetTokenAndBody(t *testing.T) {
-	tests := []struct {
-		name          string
-		mockToken     types.TokenInfo
-		mockError     error
-		requestBody   string
-		expectError   bool
-		expectedToken types.TokenInfo
-	}{
-		{
-			name: "成功获取token和body",
-			mockToken: types.TokenInfo{
-				AccessToken: "test-token-123",
-			},
-			mockError:     nil,
-			requestBody:   `{"test": "data"}`,
-			expectError:   false,
-			expectedToken: types.TokenInfo{AccessToken: "test-token-123"},
-		},
-		{
-			name:        "获取token失败",
-			mockToken:   types.TokenInfo{},
-			mockError:   assert.AnError,
-			requestBody: `{"test": "data"}`,
-			expectError: true,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			w := httptest.NewRecorder()
-			c, _ := gin.CreateTestContext(w)
-
-			// 设置请求体
-			c.Request = httptest.NewRequest("POST", "/test", bytes.NewBufferString(tt.requestBody))
-
-			mockAuth := &MockAuthService{
-				token: tt.mockToken,
-				err:   tt.mockError,
-			}
-
-			reqCtx := &RequestContext{
-				GinContext:  c,
-				AuthService: mockAuth,
-				RequestType: "test",
-			}
-
-			tokenInfo, body, err := reqCtx.GetTokenAndBody()
-
-			if tt.expectError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-				assert.Equal(t, tt.expectedToken.AccessToken, tokenInfo.AccessToken)
-				assert.NotNil(t, body)
-			}
-		})
-	}
-}
-
 func TestHandleRequestBuildError(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -280,3 +219,128 @@ func TestOpenAIStreamSender_SendEvent(t *testing.T) {
 	body := w.Body.String()
 	assert.Contains(t, body, "data:")
 }
+
+func TestExecuteCodeWhispererRequest_HonorsBaseURLOverride(t *testing.T) {
+	var gotPath, gotAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 100,
+		Messages: []types.AnthropicRequestMessage{
+			{Role: "user", Content: "hello"},
+		},
+	}
+
+	resp, err := executeCodeWhispererRequest(newTestScope(c, req))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, "/generateAssistantResponse", gotPath)
+	assert.Equal(t, "Bearer mock-access-token", gotAuth)
+}
+
+// newOverloadedUpstream 创建返回限流错误的假上游
+func newOverloadedUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"__type":"com.amazon.aws.codewhisperer#ThrottlingException","message":"I am experiencing high traffic, please try again shortly."}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+}
+
+func newOverloadedTestRequest() types.AnthropicRequest {
+	return types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 100,
+		Messages:  []types.AnthropicRequestMessage{{Role: "user", Content: "hello"}},
+	}
+}
+
+func TestUpstreamOverloaded_AnthropicNonStream(t *testing.T) {
+	newOverloadedUpstream(t)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	handleNonStreamRequest(newTestScope(c, newOverloadedTestRequest()))
+
+	assert.Equal(t, StatusOverloaded, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+
+	var resp map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "error", resp["type"])
+	errObj := resp["error"].(map[string]any)
+	assert.Equal(t, "overloaded_error", errObj["type"])
+	assert.Contains(t, errObj["message"], "high traffic")
+}
+
+func TestUpstreamOverloaded_AnthropicStream(t *testing.T) {
+	newOverloadedUpstream(t)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	req := newOverloadedTestRequest()
+	req.Stream = true
+	handleStreamRequest(newTestScope(c, req))
+
+	body := w.Body.String()
+	assert.Contains(t, body, "event: error")
+	assert.Contains(t, body, `"overloaded_error"`)
+	assert.NotContains(t, body, "构建请求失败")
+}
+
+func TestUpstreamOverloaded_OpenAINonStream(t *testing.T) {
+	newOverloadedUpstream(t)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	handleOpenAINonStreamRequest(newTestScope(c, newOverloadedTestRequest()))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var resp map[string]map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "server_error", resp["error"]["type"])
+	assert.Equal(t, "overloaded", resp["error"]["code"])
+}
+
+func TestUpstreamOverloaded_OpenAIStream(t *testing.T) {
+	newOverloadedUpstream(t)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	req := newOverloadedTestRequest()
+	req.Stream = true
+	handleOpenAIStreamRequest(newTestScope(c, req))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+	assert.Contains(t, w.Body.String(), `"overloaded"`)
+}
+
+// newTestScope 用mock token创建请求范围
+func newTestScope(c *gin.Context, req types.AnthropicRequest) *RequestScope {
+	return newRequestScope(c, req, &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "mock-access-token"}})
+}
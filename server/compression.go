@@ -0,0 +1,153 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseCompression 是否对SSE流式响应启用gzip压缩（默认关闭，需客户端同时发送Accept-Encoding: gzip）
+var sseCompression = false
+
+// NewSSECompressionFromEnv 读取 SSE_COMPRESSION 环境变量，"true" 时启用
+func NewSSECompressionFromEnv() bool {
+	return strings.EqualFold(strings.TrimSpace(os.Getenv("SSE_COMPRESSION")), "true")
+}
+
+// CompressionMiddleware 按Accept-Encoding对响应进行gzip压缩
+// 普通响应在客户端接受gzip时压缩；SSE响应还需开启SSE_COMPRESSION。
+// 请求带有X-No-Compression头时一律不压缩（部分代理会缓冲或破坏压缩流）。
+func CompressionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodHead ||
+			c.GetHeader("X-No-Compression") != "" ||
+			!acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		writer := &gzipResponseWriter{ResponseWriter: c.Writer, c: c}
+		c.Writer = writer
+		c.Next()
+		writer.close()
+	}
+}
+
+// acceptsGzip 判断Accept-Encoding是否接受gzip（忽略q=0）
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+	return false
+}
+
+// countingWriter 统计写入底层连接的字节数
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// gzipResponseWriter 在首次写出时根据响应类型决定是否压缩
+// Flush时同步刷新gzip缓冲，保证每个SSE事件立即送达客户端
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+	c *gin.Context
+
+	decided    bool
+	gz         *gzip.Writer
+	compressed *countingWriter
+	rawBytes   int64
+	isSSE      bool
+}
+
+// decide 根据状态码和已设置的响应头决定是否启用压缩，只执行一次
+func (w *gzipResponseWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	header := w.Header()
+	status := w.Status()
+	if header.Get("Content-Encoding") != "" ||
+		status < http.StatusOK || status == http.StatusNoContent ||
+		status == http.StatusPartialContent || status == http.StatusNotModified {
+		return
+	}
+
+	w.isSSE = strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+	if w.isSSE && !sseCompression {
+		return
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	header.Del("Content-Length")
+	w.compressed = &countingWriter{w: w.ResponseWriter}
+	w.gz = gzip.NewWriter(w.compressed)
+}
+
+func (w *gzipResponseWriter) WriteHeaderNow() {
+	w.decide()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	w.decide()
+	if w.gz == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	w.ResponseWriter.WriteHeaderNow()
+	w.rawBytes += int64(len(data))
+	return w.gz.Write(data)
+}
+
+func (w *gzipResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *gzipResponseWriter) Flush() {
+	w.decide()
+	if w.gz != nil {
+		w.ResponseWriter.WriteHeaderNow()
+		_ = w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// close 结束gzip流；SSE响应在debug级别记录压缩率
+func (w *gzipResponseWriter) close() {
+	if w.gz == nil {
+		return
+	}
+	_ = w.gz.Close()
+	w.ResponseWriter.Flush()
+
+	if w.isSSE {
+		ratio := 0.0
+		if w.rawBytes > 0 {
+			ratio = float64(w.compressed.n) / float64(w.rawBytes)
+		}
+		logger.Debug("SSE流压缩统计",
+			addReqFields(w.c,
+				logger.Int64("raw_bytes", w.rawBytes),
+				logger.Int64("compressed_bytes", w.compressed.n),
+				logger.Float64("compression_ratio", ratio))...)
+	}
+}
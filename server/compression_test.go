@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withSSECompression 在测试期间设置SSE压缩开关
+func withSSECompression(t *testing.T, enabled bool) {
+	original := sseCompression
+	sseCompression = enabled
+	t.Cleanup(func() { sseCompression = original })
+}
+
+// newCompressionTestServer 启动带压缩中间件的服务：
+// /stream 每发送一个事件就等待客户端确认后再发下一个，/json 返回普通JSON
+func newCompressionTestServer(t *testing.T, events int, ack chan struct{}) *httptest.Server {
+	router := gin.New()
+	router.Use(CompressionMiddleware())
+	router.GET("/stream", func(c *gin.Context) {
+		require.NoError(t, initializeSSEResponse(c))
+		for i := 1; i <= events; i++ {
+			writeSSEFrame(c, "message", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+			c.Writer.Flush()
+			select {
+			case <-ack:
+			case <-time.After(2 * time.Second):
+				return // 客户端没有及时收到事件
+			}
+		}
+	})
+	router.GET("/json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": strings.Repeat("hello ", 100)})
+	})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// getRaw 发送不自动解压的请求
+func getRaw(t *testing.T, url string, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// readSSEEvent 在超时时间内读取一个完整的SSE事件
+func readSSEEvent(t *testing.T, reader *bufio.Reader) string {
+	result := make(chan string, 1)
+	go func() {
+		var event strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			event.WriteString(line)
+			if err != nil || line == "\n" {
+				result <- event.String()
+				return
+			}
+		}
+	}()
+	select {
+	case event := <-result:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("事件未及时送达，压缩后仍应逐个事件刷新")
+		return ""
+	}
+}
+
+func TestCompression_SSEDeliversEachEventImmediately(t *testing.T) {
+	withSSECompression(t, true)
+	ack := make(chan struct{})
+	server := newCompressionTestServer(t, 3, ack)
+
+	resp := getRaw(t, server.URL+"/stream", map[string]string{"Accept-Encoding": "gzip"})
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/event-stream")
+
+	gz, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	reader := bufio.NewReader(gz)
+
+	// 服务端在客户端确认前不会继续写入，只有每个事件都被立即刷新才能读到
+	for i := 1; i <= 3; i++ {
+		event := readSSEEvent(t, reader)
+		assert.Contains(t, event, "event: message\n")
+		assert.Contains(t, event, fmt.Sprintf(`data: {"n":%d}`, i))
+		ack <- struct{}{}
+	}
+
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err, "gzip流应正常结束")
+	assert.Empty(t, rest)
+}
+
+func TestCompression_SSEDisabledByDefaultAndByHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		headers map[string]string
+	}{
+		{"未开启SSE_COMPRESSION", false, map[string]string{"Accept-Encoding": "gzip"}},
+		{"X-No-Compression", true, map[string]string{"Accept-Encoding": "gzip", "X-No-Compression": "1"}},
+		{"客户端不接受gzip", true, map[string]string{"Accept-Encoding": "br"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSSECompression(t, tt.enabled)
+			ack := make(chan struct{}, 3)
+			for i := 0; i < 3; i++ {
+				ack <- struct{}{}
+			}
+			server := newCompressionTestServer(t, 3, ack)
+
+			resp := getRaw(t, server.URL+"/stream", tt.headers)
+			assert.Empty(t, resp.Header.Get("Content-Encoding"))
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Contains(t, string(body), `data: {"n":3}`)
+		})
+	}
+}
+
+func TestCompression_JSONResponses(t *testing.T) {
+	withSSECompression(t, false)
+	server := newCompressionTestServer(t, 0, nil)
+
+	resp := getRaw(t, server.URL+"/json", map[string]string{"Accept-Encoding": "gzip, deflate"})
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+	gz, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"message":"hello hello`)
+
+	resp = getRaw(t, server.URL+"/json", map[string]string{"Accept-Encoding": "gzip", "X-No-Compression": "true"})
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"message":"hello hello`)
+}
+
+func TestCompression_AnthropicStream(t *testing.T) {
+	withSSECompression(t, true)
+	newCountingTextUpstream(t, "Hello", " world")
+
+	router := gin.New()
+	router.Use(CompressionMiddleware())
+	router.POST("/v1/messages", func(c *gin.Context) {
+		handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/messages", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello world", collectAnthropicStreamText(t, string(body)))
+	assert.Equal(t, 1, strings.Count(string(body), "event: message_stop"))
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	assert.True(t, acceptsGzip("gzip"))
+	assert.True(t, acceptsGzip("br, GZIP;q=0.5"))
+	assert.False(t, acceptsGzip(""))
+	assert.False(t, acceptsGzip("deflate, br"))
+	assert.False(t, acceptsGzip("gzip;q=0"))
+}
+
+func TestNewSSECompressionFromEnv(t *testing.T) {
+	t.Setenv("SSE_COMPRESSION", "")
+	assert.False(t, NewSSECompressionFromEnv())
+
+	t.Setenv("SSE_COMPRESSION", "true")
+	assert.True(t, NewSSECompressionFromEnv())
+}
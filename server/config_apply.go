@@ -0,0 +1,255 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"kiro2api/auth"
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrConfigRevisionMismatch If-Match中的配置版本已过期（其他人先修改了配置）
+var ErrConfigRevisionMismatch = errors.New("config revision mismatch")
+
+// configReloader 配置写入后让认证服务重新加载，由 NewRouter 注入AuthService；为nil时不重新加载
+type configReloader interface {
+	ReloadConfigs() error
+}
+
+var configReload configReloader
+
+// ConfigChange 差异中的单个账号，不包含凭据
+type ConfigChange struct {
+	ID          string   `json:"id"`    // ConfigID（refreshToken哈希）
+	Index       int      `json:"index"` // 新增和更新为应用后的索引，删除为应用前的索引
+	AuthType    string   `json:"auth_type"`
+	DisplayName string   `json:"display_name"`
+	Fields      []string `json:"fields,omitempty"` // 更新时变化的字段
+}
+
+// ConfigDiff 期望配置与当前配置的差异
+type ConfigDiff struct {
+	Added     []ConfigChange `json:"added"`
+	Updated   []ConfigChange `json:"updated"`
+	Removed   []ConfigChange `json:"removed"`
+	Unchanged int            `json:"unchanged"`
+	Reordered bool           `json:"reordered"` // 账号集合未变但顺序变化
+}
+
+// Empty 是否无需写入
+func (d ConfigDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Updated) == 0 && len(d.Removed) == 0 && !d.Reordered
+}
+
+// configHash 配置列表内容的哈希，与修改计数一起组成版本
+func configHash(configs []auth.AuthConfig) uint64 {
+	hash := fnv.New64a()
+	data, _ := json.Marshal(configs)
+	hash.Write(data)
+	return hash.Sum64()
+}
+
+// revisionMatches 判断If-Match是否匹配当前版本，未设置时不做检查
+func revisionMatches(ifMatch, revision string) bool {
+	if strings.TrimSpace(ifMatch) == "" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == revision {
+			return true
+		}
+	}
+	return false
+}
+
+// diffConfigs 按ConfigID匹配期望配置与当前配置，期望列表的顺序即应用后的顺序
+func diffConfigs(current, desired []auth.AuthConfig) ConfigDiff {
+	diff := ConfigDiff{Added: []ConfigChange{}, Updated: []ConfigChange{}, Removed: []ConfigChange{}}
+	currentIndex := make(map[string]int, len(current))
+	for i, cfg := range current {
+		currentIndex[auth.ConfigID(cfg)] = i
+	}
+
+	kept := make(map[string]bool, len(desired))
+	matchedOrder := make([]int, 0, len(desired))
+	for i, cfg := range desired {
+		id := auth.ConfigID(cfg)
+		kept[id] = true
+		change := ConfigChange{ID: id, Index: i, AuthType: cfg.AuthType, DisplayName: cfg.DisplayName}
+		old, exists := currentIndex[id]
+		if !exists {
+			diff.Added = append(diff.Added, change)
+			continue
+		}
+		matchedOrder = append(matchedOrder, old)
+		if fields := changedConfigFields(current[old], cfg); len(fields) > 0 {
+			change.Fields = fields
+			diff.Updated = append(diff.Updated, change)
+			continue
+		}
+		diff.Unchanged++
+	}
+	for i, cfg := range current {
+		if id := auth.ConfigID(cfg); !kept[id] {
+			diff.Removed = append(diff.Removed, ConfigChange{ID: id, Index: i, AuthType: cfg.AuthType, DisplayName: cfg.DisplayName})
+		}
+	}
+	diff.Reordered = !slices.IsSorted(matchedOrder)
+	return diff
+}
+
+// changedConfigFields 列出两个配置中变化的字段（json名），凭据只报告字段名
+func changedConfigFields(a, b auth.AuthConfig) []string {
+	var fields []string
+	if a.AuthType != b.AuthType {
+		fields = append(fields, "auth")
+	}
+	if a.ClientID != b.ClientID {
+		fields = append(fields, "clientId")
+	}
+	if a.ClientSecret != b.ClientSecret {
+		fields = append(fields, "clientSecret")
+	}
+	if a.Disabled != b.Disabled {
+		fields = append(fields, "disabled")
+	}
+	if a.DisplayName != b.DisplayName {
+		fields = append(fields, "displayName")
+	}
+	if a.ProfileArn != b.ProfileArn {
+		fields = append(fields, "profileArn")
+	}
+	if !reflect.DeepEqual(a.Schedule, b.Schedule) {
+		fields = append(fields, "schedule")
+	}
+	return fields
+}
+
+// normalizeDesiredConfigs 按添加接口的规则校验并补全期望配置，同一账号不能出现两次
+func normalizeDesiredConfigs(desired []auth.AuthConfig) error {
+	seen := make(map[string]int, len(desired))
+	for i := range desired {
+		cfg := &desired[i]
+		if cfg.RefreshToken == "" {
+			return fmt.Errorf("第%d个配置的RefreshToken不能为空", i)
+		}
+		if isMaskedSecret(cfg.RefreshToken) || isMaskedSecret(cfg.ClientSecret) {
+			return fmt.Errorf("第%d个配置包含脱敏后的凭据，请使用 GET /api/config?reveal=true 获取完整配置", i)
+		}
+		if cfg.AuthType == "" {
+			cfg.AuthType = auth.AuthMethodSocial
+		}
+		if cfg.AuthType == auth.AuthMethodIdC && (cfg.ClientID == "" || cfg.ClientSecret == "") {
+			return fmt.Errorf("第%d个配置: IdC认证需要ClientID和ClientSecret", i)
+		}
+		if err := auth.ValidateProfileArn(cfg.ProfileArn); err != nil {
+			return fmt.Errorf("第%d个配置: %v", i, err)
+		}
+		if err := cfg.Schedule.Validate(); err != nil {
+			return fmt.Errorf("第%d个配置: %v", i, err)
+		}
+		id := auth.ConfigID(*cfg)
+		if first, exists := seen[id]; exists {
+			return fmt.Errorf("第%d个配置与第%d个配置是同一账号", i, first)
+		}
+		seen[id] = i
+	}
+	return nil
+}
+
+// ApplyConfigs 把配置整体替换为期望列表，返回差异和应用后的版本
+// ifMatch非空且与当前版本不符时返回ErrConfigRevisionMismatch；dryRun只计算差异
+func (cs *ConfigStore) ApplyConfigs(desired []auth.AuthConfig, ifMatch string, dryRun bool) (ConfigDiff, string, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if err := cs.checkRevisionUnlocked(ifMatch); err != nil {
+		return ConfigDiff{}, "", err
+	}
+	diff := diffConfigs(cs.configs, desired)
+	if dryRun || diff.Empty() {
+		return diff, cs.revisionUnlocked(), nil
+	}
+	if cs.readOnly {
+		return ConfigDiff{}, "", ErrConfigStoreReadOnly
+	}
+
+	previous := cs.configs
+	cs.configs = desired
+	if err := cs.commitUnlocked(previous); err != nil {
+		return ConfigDiff{}, "", err
+	}
+	return diff, cs.revisionUnlocked(), nil
+}
+
+// handleApplyConfig PUT /api/config[?dry_run=true]
+// 请求体为完整的期望配置列表，按ConfigID与当前配置比较后一次性写入并重新加载认证服务，返回差异
+// 可携带If-Match（GET /api/config返回的ETag），配置已被修改时返回412
+func handleApplyConfig(c *gin.Context) {
+	if configStore == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "配置存储未初始化"})
+		return
+	}
+
+	var desired []auth.AuthConfig
+	if err := c.ShouldBindJSON(&desired); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据: " + err.Error()})
+		return
+	}
+	if desired == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求体必须是配置数组"})
+		return
+	}
+	if err := normalizeDesiredConfigs(desired); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	dryRun := c.Query("dry_run") == "true"
+	diff, revision, err := configStore.ApplyConfigs(desired, c.GetHeader("If-Match"), dryRun)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrConfigRevisionMismatch):
+			respondConfigRevisionMismatch(c)
+		case errors.Is(err, ErrConfigStoreReadOnly):
+			respondConfigReadOnly(c)
+		default:
+			logger.Error("应用配置失败", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配置失败"})
+		}
+		return
+	}
+
+	if !dryRun && !diff.Empty() {
+		logger.Info("应用期望配置成功",
+			logger.Int("added", len(diff.Added)),
+			logger.Int("updated", len(diff.Updated)),
+			logger.Int("removed", len(diff.Removed)))
+		if configReload != nil {
+			if err := configReload.ReloadConfigs(); err != nil {
+				logger.Warn("配置已保存，但重新加载认证服务失败", logger.Err(err))
+			}
+		}
+		for _, change := range slices.Concat(diff.Added, diff.Updated) {
+			if cfg := desired[change.Index]; !cfg.Disabled {
+				_ = tokenStatusMonitor.Enqueue(cfg) // 异步检查新增和变化的配置
+			}
+		}
+	}
+
+	c.Header("ETag", revision)
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run":  dryRun,
+		"revision": revision,
+		"diff":     diff,
+	})
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kiro2api/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeConfigReloader struct {
+	calls int
+}
+
+func (f *fakeConfigReloader) ReloadConfigs() error {
+	f.calls++
+	return nil
+}
+
+// setupConfigApplyTest 用initial初始化配置文件，替换认证服务重新加载和状态检查队列
+func setupConfigApplyTest(t *testing.T, initial string) (*gin.Engine, string, *fakeConfigReloader, *TokenStatusMonitor) {
+	original, originalReload, originalMonitor := configStore, configReload, tokenStatusMonitor
+	t.Cleanup(func() { configStore, configReload, tokenStatusMonitor = original, originalReload, originalMonitor })
+
+	path := filepath.Join(t.TempDir(), "auth_config.json")
+	require.NoError(t, os.WriteFile(path, []byte(initial), 0600))
+	require.NoError(t, InitConfigStore(path))
+	reloader := &fakeConfigReloader{}
+	configReload = reloader
+	tokenStatusMonitor = NewTokenStatusMonitor(checkTokenStatus) // 不启动，只检查入队
+
+	router := gin.New()
+	router.GET("/api/config", handleGetConfig)
+	router.PUT("/api/config", handleApplyConfig)
+	return router, path, reloader, tokenStatusMonitor
+}
+
+type configApplyResponse struct {
+	DryRun   bool       `json:"dry_run"`
+	Revision string     `json:"revision"`
+	Diff     ConfigDiff `json:"diff"`
+}
+
+func applyConfigs(t *testing.T, router *gin.Engine, query, body string, headers map[string]string) (*httptest.ResponseRecorder, configApplyResponse) {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/api/config"+query, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	router.ServeHTTP(w, req)
+	var resp configApplyResponse
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	}
+	return w, resp
+}
+
+func diffIDs(changes []ConfigChange) []string {
+	ids := make([]string, 0, len(changes))
+	for _, change := range changes {
+		ids = append(ids, change.ID)
+	}
+	return ids
+}
+
+func idOf(refreshToken string) string {
+	return auth.ConfigID(auth.AuthConfig{RefreshToken: refreshToken})
+}
+
+const desiredConfigs = `[
+	{"auth":"Social","refreshToken":"b","displayName":"renamed"},
+	{"refreshToken":"d"},
+	{"auth":"IdC","refreshToken":"a","clientId":"client","clientSecret":"secret"}
+]`
+
+func TestApplyConfig_Converges(t *testing.T) {
+	for _, tt := range []struct {
+		name                    string
+		initial                 string
+		added, updated, removed []string
+		unchanged               int
+		wantReorder             bool
+	}{
+		{
+			name:    "空配置",
+			initial: `[]`,
+			added:   []string{idOf("b"), idOf("d"), idOf("a")},
+		},
+		{
+			name: "增删改并调整顺序",
+			initial: `[
+				{"auth":"IdC","refreshToken":"a","clientId":"client","clientSecret":"secret"},
+				{"auth":"Social","refreshToken":"b"},
+				{"auth":"Social","refreshToken":"c"}
+			]`,
+			added:       []string{idOf("d")},
+			updated:     []string{idOf("b")},
+			removed:     []string{idOf("c")},
+			unchanged:   1,
+			wantReorder: true,
+		},
+		{
+			name:      "已是期望状态",
+			initial:   strings.Replace(desiredConfigs, `{"refreshToken":"d"}`, `{"auth":"Social","refreshToken":"d"}`, 1),
+			unchanged: 3,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			router, path, reloader, monitor := setupConfigApplyTest(t, tt.initial)
+			before, err := os.ReadFile(path)
+			require.NoError(t, err)
+
+			w, resp := applyConfigs(t, router, "", desiredConfigs, nil)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.False(t, resp.DryRun)
+			assert.Equal(t, nonNil(tt.added), diffIDs(resp.Diff.Added))
+			assert.Equal(t, nonNil(tt.updated), diffIDs(resp.Diff.Updated))
+			assert.Equal(t, nonNil(tt.removed), diffIDs(resp.Diff.Removed))
+			assert.Equal(t, tt.unchanged, resp.Diff.Unchanged)
+			assert.Equal(t, tt.wantReorder, resp.Diff.Reordered)
+			assert.Equal(t, w.Header().Get("ETag"), resp.Revision)
+
+			// 收敛到期望列表（默认认证类型已补全）
+			configs := configStore.GetConfigs()
+			require.Len(t, configs, 3)
+			assert.Equal(t, []string{"b", "d", "a"}, []string{configs[0].RefreshToken, configs[1].RefreshToken, configs[2].RefreshToken})
+			assert.Equal(t, auth.AuthMethodSocial, configs[1].AuthType)
+			assert.Equal(t, "renamed", configs[0].DisplayName)
+			assert.Equal(t, configStore.Revision(), resp.Revision)
+
+			changed := len(tt.added)+len(tt.updated)+len(tt.removed) > 0 || tt.wantReorder
+			after, err := os.ReadFile(path)
+			require.NoError(t, err)
+			if changed {
+				assert.Equal(t, 1, reloader.calls, "一次写入后重新加载一次")
+				var saved []auth.AuthConfig
+				require.NoError(t, json.Unmarshal(after, &saved))
+				assert.Equal(t, configs, saved)
+			} else {
+				assert.Zero(t, reloader.calls, "无变化时不写入也不重新加载")
+				assert.Equal(t, before, after)
+			}
+			assert.Len(t, monitor.queue, len(tt.added)+len(tt.updated), "新增和变化的配置加入状态检查")
+
+			// 再次应用同一列表是空操作
+			w, resp = applyConfigs(t, router, "", desiredConfigs, nil)
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Empty(t, resp.Diff.Added)
+			assert.Empty(t, resp.Diff.Updated)
+			assert.Empty(t, resp.Diff.Removed)
+			assert.False(t, resp.Diff.Reordered)
+			assert.Equal(t, 3, resp.Diff.Unchanged)
+			assert.LessOrEqual(t, reloader.calls, 1)
+		})
+	}
+}
+
+func nonNil(ids []string) []string {
+	if ids == nil {
+		return []string{}
+	}
+	return ids
+}
+
+func TestApplyConfig_DryRun(t *testing.T) {
+	initial := `[{"auth":"Social","refreshToken":"c"}]`
+	router, path, reloader, monitor := setupConfigApplyTest(t, initial)
+
+	w, resp := applyConfigs(t, router, "?dry_run=true", desiredConfigs, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, resp.DryRun)
+	assert.Len(t, resp.Diff.Added, 3)
+	assert.Equal(t, []string{idOf("c")}, diffIDs(resp.Diff.Removed))
+	assert.Equal(t, configStore.Revision(), resp.Revision, "版本不变")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, initial, string(data), "dry_run不写入")
+	assert.Len(t, configStore.GetConfigs(), 1)
+	assert.Zero(t, reloader.calls)
+	assert.Empty(t, monitor.queue)
+}
+
+func TestApplyConfig_IfMatch(t *testing.T) {
+	router, _, reloader, _ := setupConfigApplyTest(t, `[{"auth":"Social","refreshToken":"c"}]`)
+
+	get := httptest.NewRecorder()
+	router.ServeHTTP(get, httptest.NewRequest("GET", "/api/config", nil))
+	require.Equal(t, http.StatusOK, get.Code)
+	etag := get.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	// 其他人先修改了配置
+	_, err := configStore.AddConfig(auth.AuthConfig{AuthType: auth.AuthMethodSocial, RefreshToken: "other"}, "")
+	require.NoError(t, err)
+
+	w, _ := applyConfigs(t, router, "", desiredConfigs, map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	current := w.Header().Get("ETag")
+	assert.Equal(t, configStore.Revision(), current, "412响应携带当前版本")
+	assert.Len(t, configStore.GetConfigs(), 2, "版本过期时不应用")
+	assert.Zero(t, reloader.calls)
+
+	w, _ = applyConfigs(t, router, "?dry_run=true", desiredConfigs, map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code, "dry_run同样检查版本")
+
+	w, resp := applyConfigs(t, router, "", desiredConfigs, map[string]string{"If-Match": current})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, resp.Diff.Removed, 2)
+	assert.Equal(t, 1, reloader.calls)
+
+	w, _ = applyConfigs(t, router, "", `[{"refreshToken":"x"}]`, map[string]string{"If-Match": "*"})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestApplyConfig_InvalidInput(t *testing.T) {
+	router, _, reloader, _ := setupConfigApplyTest(t, `[{"auth":"Social","refreshToken":"c"}]`)
+
+	for _, body := range []string{
+		`{"refreshToken":"not-a-list"}`,
+		`null`,
+		`[{"refreshToken":""}]`,
+		`[{"refreshToken":"a"},{"auth":"Social","refreshToken":"a"}]`,
+		`[{"auth":"IdC","refreshToken":"a"}]`,
+	} {
+		w, _ := applyConfigs(t, router, "", body, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+	assert.Len(t, configStore.GetConfigs(), 1)
+	assert.Zero(t, reloader.calls)
+}
@@ -2,10 +2,15 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"kiro2api/auth"
@@ -22,6 +27,7 @@ type ImportAccountInput struct {
 	ClientSecret string `json:"clientSecret"`
 	Region       string `json:"region"`
 	Provider     string `json:"provider"`
+	ProfileArn   string `json:"profileArn"`
 }
 
 // ImportResult 单个账号导入结果
@@ -32,22 +38,79 @@ type ImportResult struct {
 	Message string `json:"message,omitempty"`
 }
 
+// ErrConfigStoreReadOnly 配置文件不可写（例如容器中以只读方式挂载）
+var ErrConfigStoreReadOnly = errors.New("config store is read-only")
+
 // ConfigStore 配置存储管理
+// 初始化后是配置文件的唯一来源（auth.GetConfigs也从这里读取），所有修改在同一把锁下完成
 type ConfigStore struct {
-	configs  []auth.AuthConfig
-	filePath string
-	mutex    sync.RWMutex
+	configs    []auth.AuthConfig
+	filePath   string
+	fileExists bool   // 配置文件存在（加载时存在或已写入过），否则认证配置回退到KIRO_AUTH_TOKEN
+	revision   uint64 // 每次修改成功后递增
+	readOnly   bool
+	mutex      sync.RWMutex
 }
 
 var configStore *ConfigStore
 
+// writeConfigFile 写入配置文件（测试中可替换以模拟写入失败）
+var writeConfigFile = os.WriteFile
+
+// probeConfigWritable 探测配置文件是否可写（测试中可替换以模拟只读挂载）
+var probeConfigWritable = checkConfigWritable
+
 // InitConfigStore 初始化配置存储
+// 配置文件不可写时仍可读取，修改类接口会返回只读错误
 func InitConfigStore(filePath string) error {
 	configStore = &ConfigStore{
 		filePath: filePath,
 		configs:  []auth.AuthConfig{},
 	}
-	return configStore.load()
+	if err := configStore.load(); err != nil {
+		return err
+	}
+	auth.SetConfigFileProvider(storedConfigs)
+
+	if err := probeConfigWritable(filePath); err != nil {
+		configStore.readOnly = true
+		logger.Warn("配置文件不可写，Web管理界面将以只读模式运行",
+			logger.String("path", filePath),
+			logger.Err(err))
+	}
+	return nil
+}
+
+// checkConfigWritable 检查配置文件可写：文件存在时以写方式打开（不截断），
+// 不存在时在所在目录创建并删除一个临时文件
+func checkConfigWritable(filePath string) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+	if err == nil {
+		return file.Close()
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	probe, err := os.CreateTemp(filepath.Dir(filePath), ".kiro2api-write-probe-*")
+	if err != nil {
+		return err
+	}
+	name := probe.Name()
+	probe.Close()
+	return os.Remove(name)
+}
+
+// isReadOnlyError 判断写入错误是否由只读文件系统或权限不足导致
+func isReadOnlyError(err error) bool {
+	return errors.Is(err, syscall.EROFS) || os.IsPermission(err)
+}
+
+// ReadOnly 配置存储是否处于只读模式
+func (cs *ConfigStore) ReadOnly() bool {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	return cs.readOnly
 }
 
 // GetConfigStore 获取配置存储实例
@@ -55,6 +118,51 @@ func GetConfigStore() *ConfigStore {
 	return configStore
 }
 
+// storedConfigs 供auth读取配置文件内容，配置存储未初始化或管理的是其他文件时ok为false
+func storedConfigs(path string) (configs []auth.AuthConfig, exists, ok bool) {
+	store := configStore
+	if store == nil || filepath.Clean(store.filePath) != filepath.Clean(path) {
+		return nil, false, false
+	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return append([]auth.AuthConfig(nil), store.configs...), store.fileExists, true
+}
+
+// Revision 当前配置版本，作为ETag供If-Match使用
+func (cs *ConfigStore) Revision() string {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	return cs.revisionUnlocked()
+}
+
+// revisionUnlocked 版本由修改计数和内容哈希组成：计数保证每次修改都改变版本，哈希避免重启后计数重置导致旧版本误匹配
+// 内部方法：调用者必须持有 cs.mutex
+func (cs *ConfigStore) revisionUnlocked() string {
+	return fmt.Sprintf(`"%d-%x"`, cs.revision, configHash(cs.configs))
+}
+
+// checkRevisionUnlocked ifMatch非空且与当前版本不符时返回ErrConfigRevisionMismatch
+// 内部方法：调用者必须持有 cs.mutex
+func (cs *ConfigStore) checkRevisionUnlocked(ifMatch string) error {
+	if !revisionMatches(ifMatch, cs.revisionUnlocked()) {
+		return ErrConfigRevisionMismatch
+	}
+	return nil
+}
+
+// commitUnlocked 保存修改后的配置：成功时递增版本，失败时恢复为previous
+// 内部方法：调用者必须持有 cs.mutex（写锁）
+func (cs *ConfigStore) commitUnlocked(previous []auth.AuthConfig) error {
+	if err := cs.save(); err != nil {
+		cs.configs = previous
+		return err
+	}
+	cs.fileExists = true
+	cs.revision++
+	return nil
+}
+
 // load 从文件加载配置
 func (cs *ConfigStore) load() error {
 	cs.mutex.Lock()
@@ -64,10 +172,12 @@ func (cs *ConfigStore) load() error {
 	if err != nil {
 		if os.IsNotExist(err) {
 			cs.configs = []auth.AuthConfig{}
+			cs.fileExists = false
 			return nil
 		}
 		return err
 	}
+	cs.fileExists = true
 
 	var configs []auth.AuthConfig
 	if err := json.Unmarshal(data, &configs); err != nil {
@@ -79,12 +189,21 @@ func (cs *ConfigStore) load() error {
 }
 
 // save 保存配置到文件
+// 运行期间文件变为不可写时切换到只读模式并返回ErrConfigStoreReadOnly
 func (cs *ConfigStore) save() error {
 	data, err := json.MarshalIndent(cs.configs, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(cs.filePath, data, 0600)
+	if err := writeConfigFile(cs.filePath, data, 0600); err != nil {
+		if isReadOnlyError(err) {
+			cs.readOnly = true
+			logger.Warn("配置文件写入被拒绝，切换到只读模式", logger.String("path", cs.filePath), logger.Err(err))
+			return ErrConfigStoreReadOnly
+		}
+		return err
+	}
+	return nil
 }
 
 // GetConfigs 获取所有配置
@@ -97,39 +216,130 @@ func (cs *ConfigStore) GetConfigs() []auth.AuthConfig {
 	return result
 }
 
-// AddConfig 添加配置
-func (cs *ConfigStore) AddConfig(config auth.AuthConfig) error {
+// AddConfig 添加配置，返回修改后的版本
+// ifMatch非空且与当前版本不符时返回ErrConfigRevisionMismatch（下同）
+func (cs *ConfigStore) AddConfig(config auth.AuthConfig, ifMatch string) (string, error) {
+	return cs.AddConfigs([]auth.AuthConfig{config}, ifMatch)
+}
+
+// AddConfigs 在一次加锁和一次写入中追加多个配置，返回修改后的版本
+func (cs *ConfigStore) AddConfigs(configs []auth.AuthConfig, ifMatch string) (string, error) {
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
 
-	cs.configs = append(cs.configs, config)
-	return cs.save()
+	if err := cs.checkRevisionUnlocked(ifMatch); err != nil {
+		return "", err
+	}
+	if cs.readOnly {
+		return "", ErrConfigStoreReadOnly
+	}
+
+	previous := cs.configs
+	cs.configs = append(cs.configs[:len(cs.configs):len(cs.configs)], configs...)
+	if err := cs.commitUnlocked(previous); err != nil {
+		return "", err
+	}
+	return cs.revisionUnlocked(), nil
 }
 
-// UpdateConfig 更新配置
-func (cs *ConfigStore) UpdateConfig(index int, config auth.AuthConfig) error {
+// UpdateConfig 更新配置，返回修改后的版本
+// refreshToken/clientSecret留空或为脱敏值时保留原值，保留后仍为空时返回errMissingRefreshToken/errMissingClientSecret
+func (cs *ConfigStore) UpdateConfig(index int, config auth.AuthConfig, ifMatch string) (string, error) {
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
 
+	if err := cs.checkRevisionUnlocked(ifMatch); err != nil {
+		return "", err
+	}
+	if cs.readOnly {
+		return "", ErrConfigStoreReadOnly
+	}
 	if index < 0 || index >= len(cs.configs) {
-		return os.ErrNotExist
+		return "", os.ErrNotExist
 	}
 
+	config, err := keepExistingSecrets(cs.configs[index], config)
+	if err != nil {
+		return "", err
+	}
+
+	previous := cs.configs
+	cs.configs = slices.Clone(cs.configs)
 	cs.configs[index] = config
-	return cs.save()
+	if err := cs.commitUnlocked(previous); err != nil {
+		return "", err
+	}
+	return cs.revisionUnlocked(), nil
+}
+
+// DeleteConfig 删除配置，返回修改后的版本
+// 索引会随其他修改移动，客户端应携带If-Match，避免删除错误的条目
+func (cs *ConfigStore) DeleteConfig(index int, ifMatch string) (string, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if err := cs.checkRevisionUnlocked(ifMatch); err != nil {
+		return "", err
+	}
+	if cs.readOnly {
+		return "", ErrConfigStoreReadOnly
+	}
+	if index < 0 || index >= len(cs.configs) {
+		return "", os.ErrNotExist
+	}
+
+	previous := cs.configs
+	cs.configs = append(append([]auth.AuthConfig{}, cs.configs[:index]...), cs.configs[index+1:]...)
+	if err := cs.commitUnlocked(previous); err != nil {
+		return "", err
+	}
+	return cs.revisionUnlocked(), nil
 }
 
-// DeleteConfig 删除配置
-func (cs *ConfigStore) DeleteConfig(index int) error {
+// CloneConfig 复制指定配置的认证类型、clientId/clientSecret和profileArn（区域）并追加到末尾，返回新配置的索引
+// refreshToken留空，需由操作员通过更新接口填写；在此之前加载配置时会跳过该条目
+func (cs *ConfigStore) CloneConfig(index int, ifMatch string) (int, string, error) {
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
 
+	if err := cs.checkRevisionUnlocked(ifMatch); err != nil {
+		return 0, "", err
+	}
+	if cs.readOnly {
+		return 0, "", ErrConfigStoreReadOnly
+	}
 	if index < 0 || index >= len(cs.configs) {
-		return os.ErrNotExist
+		return 0, "", os.ErrNotExist
 	}
 
-	cs.configs = append(cs.configs[:index], cs.configs[index+1:]...)
-	return cs.save()
+	source := cs.configs[index]
+	clone := auth.AuthConfig{
+		AuthType:     source.AuthType,
+		ClientID:     source.ClientID,
+		ClientSecret: source.ClientSecret,
+		ProfileArn:   source.ProfileArn,
+	}
+	previous := cs.configs
+	cs.configs = append(cs.configs[:len(cs.configs):len(cs.configs)], clone)
+	if err := cs.commitUnlocked(previous); err != nil {
+		return 0, "", err
+	}
+	return len(cs.configs) - 1, cs.revisionUnlocked(), nil
+}
+
+// respondConfigReadOnly 配置存储只读时返回明确的错误，提示如何处理
+func respondConfigReadOnly(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{
+		"error":     ErrConfigStoreReadOnly.Error(),
+		"read_only": true,
+		"message":   "配置文件 " + configStore.filePath + " 不可写（可能以只读方式挂载），请改为可写挂载，或通过 KIRO_AUTH_TOKEN 环境变量管理账号",
+	})
+}
+
+// respondConfigRevisionMismatch If-Match中的版本已过期时返回412，并通过ETag携带当前版本
+func respondConfigRevisionMismatch(c *gin.Context) {
+	c.Header("ETag", configStore.Revision())
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "配置已被修改，请重新获取后再提交"})
 }
 
 // handleGetConfig 获取配置列表
@@ -139,15 +349,33 @@ func handleGetConfig(c *gin.Context) {
 		return
 	}
 
-	configs := configStore.GetConfigs()
-
-	// 返回配置（隐藏敏感信息的完整版本供编辑使用）
+	configStore.mutex.RLock()
+	configs := slices.Clone(configStore.configs)
+	revision := configStore.revisionUnlocked()
+	configStore.mutex.RUnlock()
+
+	// 默认脱敏refreshToken和clientSecret（CONFIG_SECRET_POLICY），?reveal=true且携带管理令牌时返回原值
+	// ETag可用于修改接口的If-Match
+	if c.GetBool(configRevealKey) {
+		c.Header("Cache-Control", "no-store")
+	} else {
+		configs = maskConfigSecrets(configs)
+	}
+	c.Header("ETag", revision)
 	c.JSON(http.StatusOK, gin.H{
-		"configs": configs,
-		"count":   len(configs),
+		"configs":   configs,
+		"count":     len(configs),
+		"read_only": configStore.ReadOnly(),
+		"revision":  revision,
 	})
 }
 
+// handleGetConfigSource 返回当前生效的认证配置来源
+// GET /api/config/source
+func handleGetConfigSource(c *gin.Context) {
+	c.JSON(http.StatusOK, auth.GetConfigSource())
+}
+
 // handleAddConfig 添加配置
 func handleAddConfig(c *gin.Context) {
 	if configStore == nil {
@@ -167,6 +395,11 @@ func handleAddConfig(c *gin.Context) {
 		return
 	}
 
+	if isMaskedSecret(config.RefreshToken) || isMaskedSecret(config.ClientSecret) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "凭据为脱敏值，请填写完整的RefreshToken和ClientSecret"})
+		return
+	}
+
 	// 设置默认认证类型
 	if config.AuthType == "" {
 		config.AuthType = auth.AuthMethodSocial
@@ -180,14 +413,36 @@ func handleAddConfig(c *gin.Context) {
 		}
 	}
 
-	if err := configStore.AddConfig(config); err != nil {
+	if err := auth.ValidateProfileArn(config.ProfileArn); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := config.Schedule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	revision, err := configStore.AddConfig(config, c.GetHeader("If-Match"))
+	if err != nil {
+		if errors.Is(err, ErrConfigRevisionMismatch) {
+			respondConfigRevisionMismatch(c)
+			return
+		}
+		if errors.Is(err, ErrConfigStoreReadOnly) {
+			respondConfigReadOnly(c)
+			return
+		}
 		logger.Error("添加配置失败", logger.Err(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配置失败"})
 		return
 	}
 
 	logger.Info("添加Token配置成功", logger.String("auth_type", config.AuthType))
-	c.JSON(http.StatusOK, gin.H{"message": "配置添加成功"})
+	if !config.Disabled {
+		_ = tokenStatusMonitor.Enqueue(config) // 异步检查新配置的状态
+	}
+	c.Header("ETag", revision)
+	c.JSON(http.StatusOK, gin.H{"message": "配置添加成功", "revision": revision})
 }
 
 // handleUpdateConfig 更新配置
@@ -210,35 +465,53 @@ func handleUpdateConfig(c *gin.Context) {
 		return
 	}
 
-	// 验证必要字段
-	if config.RefreshToken == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "RefreshToken不能为空"})
-		return
-	}
-
+	// refreshToken和clientSecret留空（或提交GET返回的脱敏值）表示保持原值，由UpdateConfig在锁内合并后校验
 	if config.AuthType == "" {
 		config.AuthType = auth.AuthMethodSocial
 	}
 
-	if config.AuthType == auth.AuthMethodIdC {
-		if config.ClientID == "" || config.ClientSecret == "" {
+	if err := auth.ValidateProfileArn(config.ProfileArn); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := config.Schedule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	revision, err := configStore.UpdateConfig(index, config, c.GetHeader("If-Match"))
+	if err != nil {
+		if errors.Is(err, ErrConfigRevisionMismatch) {
+			respondConfigRevisionMismatch(c)
+			return
+		}
+		if errors.Is(err, errMissingRefreshToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "RefreshToken不能为空"})
+			return
+		}
+		if errors.Is(err, errMissingClientSecret) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "IdC认证需要ClientID和ClientSecret"})
 			return
 		}
-	}
-
-	if err := configStore.UpdateConfig(index, config); err != nil {
 		if os.IsNotExist(err) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "配置不存在"})
 			return
 		}
+		if errors.Is(err, ErrConfigStoreReadOnly) {
+			respondConfigReadOnly(c)
+			return
+		}
 		logger.Error("更新配置失败", logger.Err(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新配置失败"})
 		return
 	}
 
 	logger.Info("更新Token配置成功", logger.Int("index", index))
-	c.JSON(http.StatusOK, gin.H{"message": "配置更新成功"})
+	if !config.Disabled {
+		_ = tokenStatusMonitor.Enqueue(config) // 异步检查新配置的状态
+	}
+	c.Header("ETag", revision)
+	c.JSON(http.StatusOK, gin.H{"message": "配置更新成功", "revision": revision})
 }
 
 // handleDeleteConfig 删除配置
@@ -255,27 +528,88 @@ func handleDeleteConfig(c *gin.Context) {
 		return
 	}
 
-	if err := configStore.DeleteConfig(index); err != nil {
+	revision, err := configStore.DeleteConfig(index, c.GetHeader("If-Match"))
+	if err != nil {
+		if errors.Is(err, ErrConfigRevisionMismatch) {
+			respondConfigRevisionMismatch(c)
+			return
+		}
 		if os.IsNotExist(err) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "配置不存在"})
 			return
 		}
+		if errors.Is(err, ErrConfigStoreReadOnly) {
+			respondConfigReadOnly(c)
+			return
+		}
 		logger.Error("删除配置失败", logger.Err(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除配置失败"})
 		return
 	}
 
 	logger.Info("删除Token配置成功", logger.Int("index", index))
-	c.JSON(http.StatusOK, gin.H{"message": "配置删除成功"})
+	c.Header("ETag", revision)
+	c.JSON(http.StatusOK, gin.H{"message": "配置删除成功", "revision": revision})
+}
+
+// handleCloneConfig 复制已有配置的clientId/clientSecret/区域，用于快速添加同一IdC组织下的账号
+func handleCloneConfig(c *gin.Context) {
+	if configStore == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "配置存储未初始化"})
+		return
+	}
+
+	indexStr := c.Param("index")
+	index, err := strconv.Atoi(indexStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的索引"})
+		return
+	}
+
+	newIndex, revision, err := configStore.CloneConfig(index, c.GetHeader("If-Match"))
+	if err != nil {
+		if errors.Is(err, ErrConfigRevisionMismatch) {
+			respondConfigRevisionMismatch(c)
+			return
+		}
+		if os.IsNotExist(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "配置不存在"})
+			return
+		}
+		if errors.Is(err, ErrConfigStoreReadOnly) {
+			respondConfigReadOnly(c)
+			return
+		}
+		logger.Error("克隆配置失败", logger.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配置失败"})
+		return
+	}
+
+	// refreshToken为空，不加入状态检查，等待操作员填写后由更新接口触发
+	logger.Info("克隆Token配置成功", logger.Int("source_index", index), logger.Int("index", newIndex))
+	c.Header("ETag", revision)
+	c.JSON(http.StatusOK, gin.H{"message": "配置克隆成功，请填写refreshToken", "index": newIndex, "revision": revision})
 }
 
 // handleImportConfig 批量导入配置（自动刷新获取完整信息）
+// 所有账号验证完成后一次性写入；携带If-Match时，验证期间配置被修改则全部不导入并返回412
 func handleImportConfig(c *gin.Context) {
 	if configStore == nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "配置存储未初始化"})
 		return
 	}
 
+	// 只读时直接拒绝，避免逐个刷新token后才发现无法保存
+	if configStore.ReadOnly() {
+		respondConfigReadOnly(c)
+		return
+	}
+	ifMatch := c.GetHeader("If-Match")
+	if !revisionMatches(ifMatch, configStore.Revision()) {
+		respondConfigRevisionMismatch(c)
+		return
+	}
+
 	var inputs []ImportAccountInput
 	if err := c.ShouldBindJSON(&inputs); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的JSON数据: " + err.Error()})
@@ -288,7 +622,8 @@ func handleImportConfig(c *gin.Context) {
 	}
 
 	results := make([]ImportResult, 0, len(inputs))
-	successCount := 0
+	var pending []auth.AuthConfig
+	var pendingResults []int // pending中每个配置对应的results位置
 
 	for i, input := range inputs {
 		result := ImportResult{Index: i}
@@ -300,29 +635,15 @@ func handleImportConfig(c *gin.Context) {
 			continue
 		}
 
-		// 判断认证类型：有 clientId 和 clientSecret 则为 IdC
-		isIdC := input.ClientID != "" && input.ClientSecret != ""
-
-		var authConfig auth.AuthConfig
-		var tokenInfo types.TokenInfo
-		var err error
-
-		if isIdC {
-			authConfig = auth.AuthConfig{
-				AuthType:     auth.AuthMethodIdC,
-				RefreshToken: input.RefreshToken,
-				ClientID:     input.ClientID,
-				ClientSecret: input.ClientSecret,
-			}
-			tokenInfo, err = auth.RefreshIdCToken(authConfig)
-		} else {
-			authConfig = auth.AuthConfig{
-				AuthType:     auth.AuthMethodSocial,
-				RefreshToken: input.RefreshToken,
-			}
-			tokenInfo, err = auth.RefreshSocialToken(input.RefreshToken)
+		if err := auth.ValidateProfileArn(input.ProfileArn); err != nil {
+			result.Status = "error"
+			result.Message = err.Error()
+			results = append(results, result)
+			continue
 		}
 
+		authConfig := authConfigFromInput(input)
+		tokenInfo, err := refreshSingleTokenByConfig(authConfig)
 		if err != nil {
 			result.Status = "error"
 			result.Message = "刷新Token失败: " + err.Error()
@@ -366,21 +687,13 @@ func handleImportConfig(c *gin.Context) {
 			authConfig.RefreshToken = tokenInfo.RefreshToken
 		}
 
-		// 保存配置
-		if err := configStore.AddConfig(authConfig); err != nil {
-			result.Status = "error"
-			result.Message = "保存配置失败: " + err.Error()
-			results = append(results, result)
-			logger.Error("导入账号保存失败", logger.Int("index", i), logger.Err(err))
-			continue
-		}
-
 		result.Status = "success"
 		result.Message = "导入成功"
+		pending = append(pending, authConfig)
+		pendingResults = append(pendingResults, len(results))
 		results = append(results, result)
-		successCount++
 
-		logger.Info("导入账号成功",
+		logger.Info("导入账号验证成功",
 			logger.Int("index", i),
 			logger.String("email", email),
 			logger.String("auth_type", authConfig.AuthType),
@@ -392,10 +705,118 @@ func handleImportConfig(c *gin.Context) {
 		}
 	}
 
+	revision := configStore.Revision()
+	if len(pending) > 0 {
+		var err error
+		if revision, err = configStore.AddConfigs(pending, ifMatch); err != nil {
+			switch {
+			case errors.Is(err, ErrConfigRevisionMismatch):
+				respondConfigRevisionMismatch(c)
+			case errors.Is(err, ErrConfigStoreReadOnly):
+				respondConfigReadOnly(c)
+			default:
+				logger.Error("导入账号保存失败", logger.Err(err))
+				for _, pos := range pendingResults {
+					results[pos].Status = "error"
+					results[pos].Message = "保存配置失败: " + err.Error()
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配置失败", "results": results})
+			}
+			return
+		}
+		logger.Info("导入账号已保存", logger.Int("count", len(pending)))
+	}
+
+	c.Header("ETag", revision)
 	c.JSON(http.StatusOK, gin.H{
-		"total":   len(inputs),
-		"success": successCount,
-		"failed":  len(inputs) - successCount,
-		"results": results,
+		"total":    len(inputs),
+		"success":  len(pending),
+		"failed":   len(inputs) - len(pending),
+		"results":  results,
+		"revision": revision,
 	})
 }
+
+// authConfigFromInput 根据输入构造认证配置：有 clientId 和 clientSecret 则为 IdC
+func authConfigFromInput(input ImportAccountInput) auth.AuthConfig {
+	if input.ClientID != "" && input.ClientSecret != "" {
+		return auth.AuthConfig{
+			AuthType:     auth.AuthMethodIdC,
+			RefreshToken: input.RefreshToken,
+			ClientID:     input.ClientID,
+			ClientSecret: input.ClientSecret,
+			ProfileArn:   input.ProfileArn,
+		}
+	}
+	return auth.AuthConfig{
+		AuthType:     auth.AuthMethodSocial,
+		RefreshToken: input.RefreshToken,
+		ProfileArn:   input.ProfileArn,
+	}
+}
+
+// ProbeResult 账号探测结果
+type ProbeResult struct {
+	AuthType  string  `json:"auth_type"`
+	Status    string  `json:"status"` // active, exhausted, banned, error
+	Email     string  `json:"email,omitempty"`
+	Available float64 `json:"available"`
+	Message   string  `json:"message,omitempty"`
+}
+
+// handleProbeConfig 探测单个refreshToken是否可用（刷新+用量检查），不保存任何配置
+// POST /api/config/probe
+func handleProbeConfig(c *gin.Context) {
+	var input ImportAccountInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据: " + err.Error()})
+		return
+	}
+	if input.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "RefreshToken不能为空"})
+		return
+	}
+	if (input.ClientID == "") != (input.ClientSecret == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "IdC认证需要同时提供ClientID和ClientSecret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, probeAccount(authConfigFromInput(input)))
+}
+
+// probeAccount 刷新token并查询用量
+func probeAccount(authConfig auth.AuthConfig) ProbeResult {
+	result := ProbeResult{AuthType: authConfig.AuthType}
+
+	tokenInfo, err := refreshSingleTokenByConfig(authConfig)
+	if err != nil {
+		result.Status = types.AccountStatusError
+		result.Message = "刷新Token失败: " + err.Error()
+		logger.Warn("账号探测刷新Token失败", logger.String("auth_type", authConfig.AuthType), logger.Err(err))
+		return result
+	}
+
+	// 探测是用户的显式操作，需反映账号当前状态
+	usageResult := auth.NewUsageLimitsChecker().ForceCheckUsageLimitsWithStatus(tokenInfo)
+	if usageResult.UsageLimits != nil {
+		result.Email = usageResult.UsageLimits.UserInfo.Email
+	}
+
+	switch {
+	case usageResult.Status == types.AccountStatusBanned:
+		result.Status = types.AccountStatusBanned
+		result.Message = "账号已封禁: " + usageResult.BanReason
+	case usageResult.Error != nil:
+		result.Status = types.AccountStatusError
+		result.Message = "获取用量失败: " + usageResult.Error.Error()
+	default:
+		result.Status = usageResult.Status
+		result.Available = usageResult.Available
+	}
+
+	logger.Info("账号探测完成",
+		logger.String("auth_type", result.AuthType),
+		logger.String("status", result.Status),
+		logger.Float64("available", result.Available))
+	return result
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"kiro2api/auth"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newProbeUpstream 创建同时模拟token刷新和用量查询的上游，返回收到的刷新请求体
+func newProbeUpstream(t *testing.T, usageStatus int, usageBody string) *[]map[string]any {
+	var refreshRequests []map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/refreshToken", "/token":
+			var body map[string]any
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			body["path"] = r.URL.Path
+			refreshRequests = append(refreshRequests, body)
+			_, _ = w.Write([]byte(`{"accessToken":"probe-access-token","expiresIn":3600}`))
+		case "/getUsageLimits":
+			w.WriteHeader(usageStatus)
+			_, _ = w.Write([]byte(usageBody))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("SOCIAL_REFRESH_URL", upstream.URL+"/refreshToken")
+	t.Setenv("IDC_REFRESH_URL", upstream.URL+"/token")
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	return &refreshRequests
+}
+
+const probeUsageBody = `{
+	"usageBreakdownList": [{"resourceType": "CREDIT", "usageLimitWithPrecision": 50, "currentUsageWithPrecision": 20}],
+	"userInfo": {"email": "probe@example.com"}
+}`
+
+func performProbe(t *testing.T, body string) (*httptest.ResponseRecorder, ProbeResult) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/api/config/probe", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	handleProbeConfig(c)
+
+	var result ProbeResult
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	}
+	return w, result
+}
+
+func TestHandleProbeConfig_Social(t *testing.T) {
+	refreshRequests := newProbeUpstream(t, http.StatusOK, probeUsageBody)
+
+	// 探测不应写入配置存储
+	original := configStore
+	t.Cleanup(func() { configStore = original })
+	require.NoError(t, InitConfigStore(filepath.Join(t.TempDir(), "auth_config.json")))
+
+	w, result := performProbe(t, `{"refreshToken":"social-refresh-token"}`)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Social", result.AuthType)
+	assert.Equal(t, types.AccountStatusActive, result.Status)
+	assert.Equal(t, "probe@example.com", result.Email)
+	assert.Equal(t, 30.0, result.Available)
+
+	require.Len(t, *refreshRequests, 1)
+	assert.Equal(t, "/refreshToken", (*refreshRequests)[0]["path"])
+	assert.Equal(t, "social-refresh-token", (*refreshRequests)[0]["refreshToken"])
+	assert.Empty(t, configStore.GetConfigs())
+}
+
+func TestHandleProbeConfig_IdC(t *testing.T) {
+	refreshRequests := newProbeUpstream(t, http.StatusOK, probeUsageBody)
+
+	w, result := performProbe(t, `{"refreshToken":"idc-refresh-token","clientId":"client-1","clientSecret":"secret-1"}`)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "IdC", result.AuthType)
+	assert.Equal(t, types.AccountStatusActive, result.Status)
+
+	require.Len(t, *refreshRequests, 1)
+	assert.Equal(t, "/token", (*refreshRequests)[0]["path"])
+	assert.Equal(t, "client-1", (*refreshRequests)[0]["clientId"])
+	assert.Equal(t, "refresh_token", (*refreshRequests)[0]["grantType"])
+}
+
+func TestHandleProbeConfig_Banned(t *testing.T) {
+	newProbeUpstream(t, http.StatusForbidden, `{"reason":"TEMPORARILY_SUSPENDED","message":"account suspended"}`)
+
+	w, result := performProbe(t, `{"refreshToken":"social-refresh-token"}`)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, types.AccountStatusBanned, result.Status)
+	assert.Contains(t, result.Message, "封禁")
+}
+
+func TestHandleProbeConfig_InvalidInput(t *testing.T) {
+	w, _ := performProbe(t, `{"clientId":"client-1"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w, _ = performProbe(t, `{"refreshToken":"t","clientId":"client-1"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// withReadOnlyConfigStore 初始化一个模拟只读挂载的配置存储（含一条已有配置）
+func withReadOnlyConfigStore(t *testing.T) {
+	original, originalProbe := configStore, probeConfigWritable
+	t.Cleanup(func() { configStore, probeConfigWritable = original, originalProbe })
+
+	path := filepath.Join(t.TempDir(), "auth_config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"auth":"Social","refreshToken":"existing"}]`), 0600))
+	probeConfigWritable = func(string) error { return syscall.EROFS }
+	require.NoError(t, InitConfigStore(path))
+	require.True(t, configStore.ReadOnly())
+}
+
+func TestConfigAPI_ReadOnlyStore(t *testing.T) {
+	withReadOnlyConfigStore(t)
+
+	router := gin.New()
+	router.GET("/api/config", handleGetConfig)
+	router.POST("/api/config", handleAddConfig)
+	router.PUT("/api/config/:index", handleUpdateConfig)
+	router.DELETE("/api/config/:index", handleDeleteConfig)
+	router.POST("/api/config/:index/clone", handleCloneConfig)
+	router.POST("/api/config/import", handleImportConfig)
+	router.PUT("/api/config", handleApplyConfig)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tt := range []struct{ method, path, body string }{
+		{"POST", "/api/config", `{"auth":"Social","refreshToken":"new"}`},
+		{"PUT", "/api/config/0", `{"auth":"Social","refreshToken":"changed"}`},
+		{"DELETE", "/api/config/0", ``},
+		{"POST", "/api/config/0/clone", ``},
+		{"POST", "/api/config/import", `[{"refreshToken":"imported"}]`},
+		{"PUT", "/api/config", `[{"auth":"Social","refreshToken":"replaced"}]`},
+	} {
+		w := send(tt.method, tt.path, tt.body)
+		assert.Equal(t, http.StatusForbidden, w.Code, tt.method+" "+tt.path)
+		var resp map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "config store is read-only", resp["error"])
+		assert.Equal(t, true, resp["read_only"])
+	}
+
+	// 读取接口不受影响，且内存中的配置未被修改
+	w := send("GET", "/api/config", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Configs  []map[string]any `json:"configs"`
+		ReadOnly bool             `json:"read_only"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.ReadOnly)
+	require.Len(t, resp.Configs, 1)
+	assert.Equal(t, maskSecret("existing"), resp.Configs[0]["refreshToken"])
+	assert.Equal(t, "existing", configStore.GetConfigs()[0].RefreshToken)
+}
+
+func TestHandleCloneConfig(t *testing.T) {
+	original := configStore
+	t.Cleanup(func() { configStore = original })
+	path := filepath.Join(t.TempDir(), "auth_config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"auth":"Social","refreshToken":"social"},
+		{"auth":"IdC","refreshToken":"idc","clientId":"client","clientSecret":"secret",
+		 "profileArn":"arn:aws:codewhisperer:eu-central-1:123456789012:profile/ABC",
+		 "displayName":"alice","disabled":true,"schedule":[{"startHour":9,"endHour":18}]}
+	]`), 0600))
+	require.NoError(t, InitConfigStore(path))
+
+	router := gin.New()
+	router.POST("/api/config/:index/clone", handleCloneConfig)
+	clone := func(index string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/config/"+index+"/clone", nil))
+		return w
+	}
+
+	w := clone("1")
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Index int `json:"index"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 2, resp.Index)
+
+	configs := configStore.GetConfigs()
+	require.Len(t, configs, 3)
+	assert.Equal(t, auth.AuthConfig{
+		AuthType:     auth.AuthMethodIdC,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		ProfileArn:   "arn:aws:codewhisperer:eu-central-1:123456789012:profile/ABC",
+	}, configs[2], "只复制凭据与区域，refreshToken、别名、停用状态与计划不复制")
+	assert.Equal(t, "idc", configs[1].RefreshToken, "源配置不受影响")
+
+	// 克隆结果已写入配置文件
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var persisted []auth.AuthConfig
+	require.NoError(t, json.Unmarshal(saved, &persisted))
+	assert.Equal(t, configs, persisted)
+
+	assert.Equal(t, http.StatusNotFound, clone("3").Code)
+	assert.Equal(t, http.StatusNotFound, clone("-1").Code)
+	assert.Equal(t, http.StatusBadRequest, clone("abc").Code)
+	assert.Len(t, configStore.GetConfigs(), 3)
+}
+
+func TestConfigStore_SwitchesToReadOnlyOnWriteFailure(t *testing.T) {
+	original, originalWrite := configStore, writeConfigFile
+	t.Cleanup(func() { configStore, writeConfigFile = original, originalWrite })
+	require.NoError(t, InitConfigStore(filepath.Join(t.TempDir(), "auth_config.json")))
+	require.False(t, configStore.ReadOnly())
+
+	// 模拟运行中被重新挂载为只读
+	writeConfigFile = func(name string, _ []byte, _ os.FileMode) error {
+		return &os.PathError{Op: "open", Path: name, Err: syscall.EROFS}
+	}
+
+	_, err := configStore.AddConfig(auth.AuthConfig{AuthType: auth.AuthMethodSocial, RefreshToken: "t"}, "")
+	assert.ErrorIs(t, err, ErrConfigStoreReadOnly)
+	assert.True(t, configStore.ReadOnly())
+	assert.Empty(t, configStore.GetConfigs(), "写入失败时回滚内存中的修改")
+}
+
+func TestCheckConfigWritable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "auth_config.json")
+	assert.NoError(t, checkConfigWritable(path), "文件不存在时探测目录可写")
+	entries, _ := os.ReadDir(dir)
+	assert.Empty(t, entries, "探测文件应被清理")
+
+	require.NoError(t, os.WriteFile(path, []byte(`[]`), 0600))
+	assert.NoError(t, checkConfigWritable(path))
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, `[]`, string(data), "探测不能截断已有配置")
+
+	assert.Error(t, checkConfigWritable(filepath.Join(dir, "missing", "auth_config.json")))
+}
+
+// 多个处理器并发修改配置：每次修改都基于最新内容，文件与内存一致，批量追加不被拆开
+func TestConfigStore_ConcurrentMutations(t *testing.T) {
+	original := configStore
+	t.Cleanup(func() { configStore = original })
+	path := filepath.Join(t.TempDir(), "auth_config.json")
+	require.NoError(t, InitConfigStore(path))
+
+	const workers, rounds = 4, 25
+	var deleted atomic.Int64
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				_, err := configStore.AddConfig(auth.AuthConfig{AuthType: auth.AuthMethodSocial, RefreshToken: fmt.Sprintf("single-%d-%d", w, i)}, "")
+				assert.NoError(t, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				batch := make([]auth.AuthConfig, 3)
+				for j := range batch {
+					batch[j] = auth.AuthConfig{AuthType: auth.AuthMethodSocial, RefreshToken: fmt.Sprintf("batch-%d-%d-%d", w, i, j)}
+				}
+				_, err := configStore.AddConfigs(batch, "")
+				assert.NoError(t, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				if _, err := configStore.DeleteConfig(0, ""); err == nil {
+					deleted.Add(1)
+				} else {
+					assert.ErrorIs(t, err, os.ErrNotExist)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	configs := configStore.GetConfigs()
+	assert.Len(t, configs, workers*rounds*4-int(deleted.Load()))
+	successful := workers*rounds*2 + int(deleted.Load())
+	assert.True(t, strings.HasPrefix(configStore.Revision(), fmt.Sprintf(`"%d-`, successful)), "每次成功的修改递增一次版本")
+
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var persisted []auth.AuthConfig
+	require.NoError(t, json.Unmarshal(saved, &persisted))
+	assert.Equal(t, configs, persisted, "文件内容与内存一致")
+
+	// 删除只会从开头移除，保留下来的批量成员保持相邻
+	for i, cfg := range configs {
+		var w, r, j int
+		if _, err := fmt.Sscanf(cfg.RefreshToken, "batch-%d-%d-%d", &w, &r, &j); err != nil || j == 0 || i == 0 {
+			continue
+		}
+		if prev := fmt.Sprintf("batch-%d-%d-%d", w, r, j-1); configs[i-1].RefreshToken != prev {
+			assert.Fail(t, "批量追加被拆开", "%s 之前应为 %s", cfg.RefreshToken, prev)
+		}
+	}
+}
+
+func TestConfigAPI_IfMatch(t *testing.T) {
+	original := configStore
+	t.Cleanup(func() { configStore = original })
+	path := filepath.Join(t.TempDir(), "auth_config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"auth":"Social","refreshToken":"a"},{"auth":"Social","refreshToken":"b"}]`), 0600))
+	require.NoError(t, InitConfigStore(path))
+
+	router := gin.New()
+	router.GET("/api/config", handleGetConfig)
+	router.POST("/api/config", handleAddConfig)
+	router.DELETE("/api/config/:index", handleDeleteConfig)
+	send := func(method, path, body, ifMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	stale := send("GET", "/api/config", "", "").Header().Get("ETag")
+	require.NotEmpty(t, stale)
+
+	// 其他人先删除了第一项，索引0现在指向b
+	w := send("DELETE", "/api/config/0", "", stale)
+	require.Equal(t, http.StatusOK, w.Code)
+	current := w.Header().Get("ETag")
+	assert.NotEqual(t, stale, current)
+	assert.Contains(t, w.Body.String(), current[1:len(current)-1])
+
+	w = send("DELETE", "/api/config/0", "", stale)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, current, w.Header().Get("ETag"), "412响应携带当前版本")
+	w = send("POST", "/api/config", `{"auth":"Social","refreshToken":"c"}`, stale)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	configs := configStore.GetConfigs()
+	require.Len(t, configs, 1, "版本过期时不修改")
+	assert.Equal(t, "b", configs[0].RefreshToken)
+
+	w = send("POST", "/api/config", `{"auth":"Social","refreshToken":"c"}`, current)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, configStore.GetConfigs(), 2)
+}
+
+// 配置存储初始化后，auth读取存储中的配置而不是重新读取文件；文件不存在时仍回退到KIRO_AUTH_TOKEN
+func TestConfigStore_IsAuthConfigSource(t *testing.T) {
+	original := configStore
+	t.Cleanup(func() { configStore = original })
+	path := filepath.Join(t.TempDir(), "auth_config.json")
+	t.Setenv("AUTH_CONFIG_FILE", path)
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"from-env"}]`)
+	require.NoError(t, InitConfigStore(path))
+
+	configs, err := auth.GetConfigs()
+	require.NoError(t, err)
+	require.Len(t, configs, 1)
+	assert.Equal(t, "from-env", configs[0].RefreshToken, "配置文件不存在时使用环境变量")
+
+	_, err = configStore.AddConfig(auth.AuthConfig{AuthType: auth.AuthMethodSocial, RefreshToken: "from-store"}, "")
+	require.NoError(t, err)
+	// 绕过存储修改文件不会生效
+	require.NoError(t, os.WriteFile(path, []byte(`[{"auth":"Social","refreshToken":"edited"}]`), 0600))
+
+	configs, err = auth.GetConfigs()
+	require.NoError(t, err)
+	require.Len(t, configs, 1)
+	assert.Equal(t, "from-store", configs[0].RefreshToken)
+	assert.True(t, auth.GetConfigSource().FileExists)
+}
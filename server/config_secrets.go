@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"kiro2api/auth"
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 配置接口返回凭据的方式（CONFIG_SECRET_POLICY）
+const (
+	ConfigSecretsMask   = "mask"   // 默认脱敏，?reveal=true 且携带管理令牌时返回原值
+	ConfigSecretsStrict = "strict" // 始终脱敏，不允许reveal
+	ConfigSecretsOff    = "off"    // 始终返回原值（旧行为）
+)
+
+// secretMask 脱敏值中间的标记，真实的refreshToken/clientSecret不含该标记
+const secretMask = "***"
+
+// configRevealKey gin上下文中本次请求是否返回未脱敏的配置
+const configRevealKey = "config_reveal"
+
+// errMissingRefreshToken / errMissingClientSecret 保留原值后凭据仍为空
+var (
+	errMissingRefreshToken = errors.New("refresh token is required")
+	errMissingClientSecret = errors.New("client id and client secret are required for IdC")
+)
+
+// configSecretPolicy 配置接口的凭据脱敏策略
+var configSecretPolicy = ConfigSecretsMask
+
+// NewConfigSecretPolicyFromEnv CONFIG_SECRET_POLICY: mask（默认）/ strict / off
+func NewConfigSecretPolicyFromEnv() string {
+	switch policy := strings.ToLower(strings.TrimSpace(os.Getenv("CONFIG_SECRET_POLICY"))); policy {
+	case "":
+		return ConfigSecretsMask
+	case ConfigSecretsMask, ConfigSecretsStrict, ConfigSecretsOff:
+		return policy
+	default:
+		logger.Warn("CONFIG_SECRET_POLICY无效，使用mask", logger.String("value", policy))
+		return ConfigSecretsMask
+	}
+}
+
+// maskSecret 脱敏凭据，保留首尾少量字符便于区分账号
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 12 {
+		return secretMask
+	}
+	return secret[:6] + secretMask + secret[len(secret)-4:]
+}
+
+// isMaskedSecret 判断提交的值是否为接口返回的脱敏值
+func isMaskedSecret(value string) bool {
+	return strings.Contains(value, secretMask)
+}
+
+// maskConfigSecrets 返回脱敏refreshToken和clientSecret后的配置副本
+func maskConfigSecrets(configs []auth.AuthConfig) []auth.AuthConfig {
+	masked := make([]auth.AuthConfig, len(configs))
+	for i, cfg := range configs {
+		cfg.RefreshToken = maskSecret(cfg.RefreshToken)
+		cfg.ClientSecret = maskSecret(cfg.ClientSecret)
+		masked[i] = cfg
+	}
+	return masked
+}
+
+// keepExistingSecrets 更新时refreshToken/clientSecret留空或提交脱敏值表示保持原值
+func keepExistingSecrets(existing, updated auth.AuthConfig) (auth.AuthConfig, error) {
+	if updated.RefreshToken == "" || isMaskedSecret(updated.RefreshToken) {
+		updated.RefreshToken = existing.RefreshToken
+	}
+	if updated.ClientSecret == "" || isMaskedSecret(updated.ClientSecret) {
+		updated.ClientSecret = existing.ClientSecret
+	}
+	if updated.RefreshToken == "" {
+		return updated, errMissingRefreshToken
+	}
+	if updated.AuthType == auth.AuthMethodIdC && (updated.ClientID == "" || updated.ClientSecret == "") {
+		return updated, errMissingClientSecret
+	}
+	return updated, nil
+}
+
+// ConfigRevealMiddleware 处理 GET /api/config?reveal=true：需要管理令牌，strict策略下拒绝
+// 其余请求按策略决定是否脱敏
+func ConfigRevealMiddleware(adminToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Query("reveal") != "true" {
+			c.Set(configRevealKey, configSecretPolicy == ConfigSecretsOff)
+			c.Next()
+			return
+		}
+		if configSecretPolicy == ConfigSecretsStrict {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "当前策略不允许查看完整凭据"})
+			return
+		}
+		if !validateAPIKey(c, adminToken) {
+			c.Abort()
+			return
+		}
+		auditLog(c, "config_reveal", logger.String("client_ip", c.ClientIP()))
+		c.Set(configRevealKey, true)
+		c.Next()
+	}
+}
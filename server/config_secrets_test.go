@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kiro2api/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testRefreshToken = "aorAAAAAGexampleRefreshTokenValue1234"
+	testClientSecret = "eyJraWQiOiJleGFtcGxlQ2xpZW50U2VjcmV0"
+)
+
+// setupConfigSecretsTest 初始化含一个IdC配置的存储，返回挂载了配置接口的路由（管理令牌为admin-token）
+func setupConfigSecretsTest(t *testing.T, policy string) *gin.Engine {
+	original, originalPolicy := configStore, configSecretPolicy
+	t.Cleanup(func() { configStore, configSecretPolicy = original, originalPolicy })
+	configSecretPolicy = policy
+
+	path := filepath.Join(t.TempDir(), "auth_config.json")
+	data, err := json.Marshal([]auth.AuthConfig{{
+		AuthType:     auth.AuthMethodIdC,
+		RefreshToken: testRefreshToken,
+		ClientID:     "client-id",
+		ClientSecret: testClientSecret,
+	}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	require.NoError(t, InitConfigStore(path))
+
+	router := gin.New()
+	router.GET("/api/config", ConfigRevealMiddleware("admin-token"), handleGetConfig)
+	router.POST("/api/config", handleAddConfig)
+	router.PUT("/api/config/:index", handleUpdateConfig)
+	router.PUT("/api/config", handleApplyConfig)
+	return router
+}
+
+func getConfigs(t *testing.T, router *gin.Engine, query, token string) (*httptest.ResponseRecorder, []auth.AuthConfig) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/config"+query, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	router.ServeHTTP(w, req)
+	var resp struct {
+		Configs []auth.AuthConfig `json:"configs"`
+	}
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	}
+	return w, resp.Configs
+}
+
+func TestGetConfig_MasksSecretsByDefault(t *testing.T) {
+	router := setupConfigSecretsTest(t, ConfigSecretsMask)
+
+	w, configs := getConfigs(t, router, "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, configs, 1)
+	assert.Equal(t, "aorAAA***1234", configs[0].RefreshToken)
+	assert.Equal(t, "eyJraW***cmV0", configs[0].ClientSecret)
+	assert.Equal(t, "client-id", configs[0].ClientID, "clientId不是凭据")
+	assert.NotContains(t, w.Body.String(), testRefreshToken)
+	assert.NotContains(t, w.Body.String(), testClientSecret)
+
+	// 管理令牌只在reveal时使用，不带reveal仍然脱敏
+	_, configs = getConfigs(t, router, "", "admin-token")
+	assert.True(t, isMaskedSecret(configs[0].RefreshToken))
+}
+
+func TestGetConfig_Reveal(t *testing.T) {
+	router := setupConfigSecretsTest(t, ConfigSecretsMask)
+
+	w, _ := getConfigs(t, router, "?reveal=true", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "reveal需要管理令牌")
+	w, _ = getConfigs(t, router, "?reveal=true", "wrong-token")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w, configs := getConfigs(t, router, "?reveal=true", "admin-token")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, testRefreshToken, configs[0].RefreshToken)
+	assert.Equal(t, testClientSecret, configs[0].ClientSecret)
+}
+
+func TestGetConfig_SecretPolicies(t *testing.T) {
+	router := setupConfigSecretsTest(t, ConfigSecretsStrict)
+	w, _ := getConfigs(t, router, "?reveal=true", "admin-token")
+	assert.Equal(t, http.StatusForbidden, w.Code, "strict策略下不允许reveal")
+
+	configSecretPolicy = ConfigSecretsOff
+	w, configs := getConfigs(t, router, "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, testRefreshToken, configs[0].RefreshToken, "off策略保持旧行为")
+}
+
+func TestUpdateConfig_BlankSecretsKeepExisting(t *testing.T) {
+	router := setupConfigSecretsTest(t, ConfigSecretsMask)
+	put := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("PUT", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 凭据留空：只修改别名
+	w := put("/api/config/0", `{"auth":"IdC","clientId":"client-id","displayName":"alice"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	cfg := configStore.GetConfigs()[0]
+	assert.Equal(t, "alice", cfg.DisplayName)
+	assert.Equal(t, testRefreshToken, cfg.RefreshToken)
+	assert.Equal(t, testClientSecret, cfg.ClientSecret)
+
+	// 原样提交GET返回的脱敏值同样保持原值
+	_, configs := getConfigs(t, router, "", "")
+	body, err := json.Marshal(configs[0])
+	require.NoError(t, err)
+	w = put("/api/config/0", string(body))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, testRefreshToken, configStore.GetConfigs()[0].RefreshToken)
+	assert.Equal(t, testClientSecret, configStore.GetConfigs()[0].ClientSecret)
+
+	// 填写新值时替换
+	w = put("/api/config/0", `{"auth":"IdC","clientId":"client-id","refreshToken":"aorAAAAAGnewRefreshToken"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "aorAAAAAGnewRefreshToken", configStore.GetConfigs()[0].RefreshToken)
+	assert.Equal(t, testClientSecret, configStore.GetConfigs()[0].ClientSecret)
+
+	// 切换为Social时留空的clientSecret同样保持原值
+	w = put("/api/config/0", `{"auth":"Social","refreshToken":"aorAAAAAGnewRefreshToken"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, testClientSecret, configStore.GetConfigs()[0].ClientSecret)
+
+	// 脱敏值不能用于新增和整体替换
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/config", strings.NewReader(`{"auth":"Social","refreshToken":"aorAAA***1234"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = put("/api/config", `[{"auth":"Social","refreshToken":"aorAAA***1234"}]`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "reveal=true")
+	assert.Len(t, configStore.GetConfigs(), 1)
+}
+
+func TestUpdateConfig_RequiresSecretsAfterKeeping(t *testing.T) {
+	original := configStore
+	t.Cleanup(func() { configStore = original })
+	path := filepath.Join(t.TempDir(), "auth_config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"auth":"Social","refreshToken":"aorAAAAAGsocialToken"}]`), 0600))
+	require.NoError(t, InitConfigStore(path))
+
+	_, err := configStore.UpdateConfig(0, auth.AuthConfig{AuthType: auth.AuthMethodIdC, ClientID: "client-id"}, "")
+	assert.ErrorIs(t, err, errMissingClientSecret, "原配置没有clientSecret，切换为IdC时必须填写")
+
+	_, _, err = configStore.CloneConfig(0, "")
+	require.NoError(t, err)
+	_, err = configStore.UpdateConfig(1, auth.AuthConfig{AuthType: auth.AuthMethodSocial, DisplayName: "clone"}, "")
+	assert.ErrorIs(t, err, errMissingRefreshToken, "克隆的配置没有refreshToken可保留")
+}
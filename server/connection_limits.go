@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConnectionLimiter 按客户端IP和客户端令牌限制同时进行的请求数（流式请求在整个流期间占用名额）
+// 防止单个客户端打开大量并发流耗尽token池
+type ConnectionLimiter struct {
+	mutex       sync.Mutex
+	maxPerIP    int // 每个客户端IP的并发上限，0表示不限制
+	maxPerToken int // 每个客户端令牌的并发上限，0表示不限制
+	byIP        map[string]int
+	byToken     map[string]int
+}
+
+// connectionLimiter 为nil时不限制
+var connectionLimiter *ConnectionLimiter
+
+// NewConnectionLimiter 创建并发连接限制，两个上限都<=0时返回nil
+func NewConnectionLimiter(maxPerIP, maxPerToken int) *ConnectionLimiter {
+	if maxPerIP <= 0 && maxPerToken <= 0 {
+		return nil
+	}
+	return &ConnectionLimiter{
+		maxPerIP:    max(maxPerIP, 0),
+		maxPerToken: max(maxPerToken, 0),
+		byIP:        make(map[string]int),
+		byToken:     make(map[string]int),
+	}
+}
+
+// NewConnectionLimiterFromEnv 根据环境变量创建并发连接限制
+// MAX_CONNECTIONS_PER_IP: 每个客户端IP的并发请求上限（默认0，不限制）
+// MAX_CONNECTIONS_PER_TOKEN: 每个客户端令牌（Authorization/x-api-key）的并发请求上限（默认0，不限制）
+func NewConnectionLimiterFromEnv() *ConnectionLimiter {
+	maxPerIP := connectionLimitFromEnv("MAX_CONNECTIONS_PER_IP")
+	maxPerToken := connectionLimitFromEnv("MAX_CONNECTIONS_PER_TOKEN")
+	limiter := NewConnectionLimiter(maxPerIP, maxPerToken)
+	if limiter != nil {
+		logger.Info("已启用客户端并发连接上限",
+			logger.Int("max_per_ip", maxPerIP),
+			logger.Int("max_per_token", maxPerToken))
+	}
+	return limiter
+}
+
+func connectionLimitFromEnv(name string) int {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return 0
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		logger.Warn(name+"无效，不限制并发", logger.String("value", value))
+		return 0
+	}
+	return parsed
+}
+
+// acquire 为客户端占用一个并发名额，超过任一上限时返回false和超限的维度（ip/token）
+func (l *ConnectionLimiter) acquire(ip, token string) (bool, string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.maxPerIP > 0 && l.byIP[ip] >= l.maxPerIP {
+		return false, "ip"
+	}
+	if l.maxPerToken > 0 && token != "" && l.byToken[token] >= l.maxPerToken {
+		return false, "token"
+	}
+	l.byIP[ip]++
+	if token != "" {
+		l.byToken[token]++
+	}
+	return true, ""
+}
+
+// release 释放acquire占用的名额，计数归零时删除条目避免map无限增长
+func (l *ConnectionLimiter) release(ip, token string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+	if token != "" {
+		if l.byToken[token]--; l.byToken[token] <= 0 {
+			delete(l.byToken, token)
+		}
+	}
+}
+
+// ConnectionLimitMiddleware 执行客户端并发连接上限，超过时返回429
+// /metrics、/api/stats 等观测端点不受约束
+func ConnectionLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limiter := connectionLimiter
+		if limiter == nil || inflightExemptPaths[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		ip, token := c.ClientIP(), extractAPIKey(c)
+		if ok, dimension := limiter.acquire(ip, token); !ok {
+			logger.Warn("客户端并发连接数超过上限，拒绝请求",
+				addReqFields(c,
+					logger.String("client_ip", ip),
+					logger.String("limit", dimension))...)
+			respondErrorWithCode(c, http.StatusTooManyRequests, "rate_limited", "%s", "并发连接数超过上限，请稍后重试")
+			c.Abort()
+			return
+		}
+		defer limiter.release(ip, token)
+
+		c.Next()
+	}
+}
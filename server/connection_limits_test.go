@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withConnectionLimiter 替换全局并发连接限制，测试结束后恢复
+func withConnectionLimiter(t *testing.T, maxPerIP, maxPerToken int) {
+	t.Helper()
+	original := connectionLimiter
+	connectionLimiter = NewConnectionLimiter(maxPerIP, maxPerToken)
+	t.Cleanup(func() { connectionLimiter = original })
+}
+
+// newConnectionLimitTestRouter /v1/messages 在release关闭前保持打开，模拟长时间的流式请求
+func newConnectionLimitTestRouter(started chan<- struct{}, release <-chan struct{}) *gin.Engine {
+	r := gin.New()
+	r.Use(ConnectionLimitMiddleware())
+	r.POST("/v1/messages", func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	})
+	r.GET("/metrics", func(c *gin.Context) { c.Status(http.StatusOK) })
+	return r
+}
+
+func serveConnectionLimitRequest(r *gin.Engine, method, path, remoteAddr, apiKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = remoteAddr
+	if apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// openConnections 并发打开n个保持中的请求，返回等待它们结束的函数
+func openConnections(t *testing.T, r *gin.Engine, started <-chan struct{}, n int, remoteAddr, apiKey string) func() []int {
+	t.Helper()
+	codes := make([]int, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = serveConnectionLimitRequest(r, http.MethodPost, "/v1/messages", remoteAddr, apiKey).Code
+		}()
+	}
+	for range n {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("请求未开始")
+		}
+	}
+	return func() []int {
+		wg.Wait()
+		return codes
+	}
+}
+
+func TestConnectionLimit_PerIP(t *testing.T) {
+	withConnectionLimiter(t, 2, 0)
+	started, release := make(chan struct{}, 8), make(chan struct{})
+	r := newConnectionLimitTestRouter(started, release)
+
+	wait := openConnections(t, r, started, 2, "10.0.0.1:1000", "")
+
+	// 同一IP的第三个并发流被拒绝
+	w := serveConnectionLimitRequest(r, http.MethodPost, "/v1/messages", "10.0.0.1:1001", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "rate_limited")
+
+	// 观测端点不受约束
+	assert.Equal(t, http.StatusOK, serveConnectionLimitRequest(r, http.MethodGet, "/metrics", "10.0.0.1:1002", "").Code)
+
+	// 其他IP不受影响
+	otherDone := openConnections(t, r, started, 1, "10.0.0.2:1000", "")
+
+	close(release)
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, wait())
+	assert.Equal(t, []int{http.StatusOK}, otherDone())
+
+	// 名额释放后恢复服务，计数条目被清理
+	assert.Equal(t, http.StatusOK, serveConnectionLimitRequest(r, http.MethodPost, "/v1/messages", "10.0.0.1:1003", "").Code)
+	assert.Empty(t, connectionLimiter.byIP)
+}
+
+func TestConnectionLimit_PerToken(t *testing.T) {
+	withConnectionLimiter(t, 0, 1)
+	started, release := make(chan struct{}, 8), make(chan struct{})
+	r := newConnectionLimitTestRouter(started, release)
+
+	wait := openConnections(t, r, started, 1, "10.0.0.1:1000", "client-a")
+
+	// 同一令牌从其他IP打开的并发流也被拒绝
+	w := serveConnectionLimitRequest(r, http.MethodPost, "/v1/messages", "10.0.0.9:1000", "client-a")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// 其他令牌不受影响
+	otherDone := openConnections(t, r, started, 1, "10.0.0.1:1001", "client-b")
+
+	close(release)
+	assert.Equal(t, []int{http.StatusOK}, wait())
+	assert.Equal(t, []int{http.StatusOK}, otherDone())
+	assert.Empty(t, connectionLimiter.byToken)
+}
+
+func TestNewConnectionLimiterFromEnv(t *testing.T) {
+	t.Setenv("MAX_CONNECTIONS_PER_IP", "")
+	t.Setenv("MAX_CONNECTIONS_PER_TOKEN", "")
+	assert.Nil(t, NewConnectionLimiterFromEnv(), "默认不限制")
+
+	t.Setenv("MAX_CONNECTIONS_PER_IP", "8")
+	t.Setenv("MAX_CONNECTIONS_PER_TOKEN", "invalid")
+	limiter := NewConnectionLimiterFromEnv()
+	require.NotNil(t, limiter)
+	assert.Equal(t, 8, limiter.maxPerIP)
+	assert.Equal(t, 0, limiter.maxPerToken)
+
+	t.Setenv("MAX_CONNECTIONS_PER_IP", "-1")
+	t.Setenv("MAX_CONNECTIONS_PER_TOKEN", "4")
+	limiter = NewConnectionLimiterFromEnv()
+	require.NotNil(t, limiter)
+	assert.Equal(t, 0, limiter.maxPerIP)
+	assert.Equal(t, 4, limiter.maxPerToken)
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderConversationID 客户端声明的会话ID，启用重复流取消时同一会话只保留最新的流
+const HeaderConversationID = "X-Conversation-ID"
+
+// ErrStreamSuperseded 流被同一会话中更新的请求取消
+var ErrStreamSuperseded = errors.New("stream superseded by a newer request in the same conversation")
+
+// streamSupersededMessage 被取消的流收到的错误事件内容
+const streamSupersededMessage = "同一会话已开始新的请求，本次流式响应已取消"
+
+// upstreamContextKey gin上下文中上游请求使用的context
+const upstreamContextKey = "upstream_context"
+
+// ConversationStreams 按会话登记进行中的流式请求
+// 同一会话的新流开始时取消旧流的上游请求，及时释放账号（聊天界面快速编辑重发时常见）
+type ConversationStreams struct {
+	mutex   sync.Mutex
+	streams map[string]*conversationStream
+	nextID  uint64
+}
+
+type conversationStream struct {
+	id     uint64
+	cancel context.CancelCauseFunc
+}
+
+// NewConversationStreams 创建会话流登记表
+func NewConversationStreams() *ConversationStreams {
+	return &ConversationStreams{streams: make(map[string]*conversationStream)}
+}
+
+// NewConversationStreamsFromEnv ABORT_DUPLICATE_STREAMS=true 时启用，否则返回nil
+func NewConversationStreamsFromEnv() *ConversationStreams {
+	if !utils.GetEnvBool("ABORT_DUPLICATE_STREAMS") {
+		return nil
+	}
+	logger.Info("已启用重复流取消：同一X-Conversation-ID的新流会取消仍在进行的旧流")
+	return NewConversationStreams()
+}
+
+// conversationStreams 全局会话流登记表，nil表示未启用（测试可替换）
+var conversationStreams *ConversationStreams
+
+// Begin 登记会话的新流并取消该会话仍在进行的旧流
+// 返回新流的上游context和释放函数；释放只移除自身的登记，不影响之后开始的流
+func (cs *ConversationStreams) Begin(key string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	cs.mutex.Lock()
+	cs.nextID++
+	id := cs.nextID
+	previous := cs.streams[key]
+	cs.streams[key] = &conversationStream{id: id, cancel: cancel}
+	cs.mutex.Unlock()
+
+	if previous != nil {
+		previous.cancel(ErrStreamSuperseded)
+	}
+
+	release := func() {
+		cs.mutex.Lock()
+		if current, exists := cs.streams[key]; exists && current.id == id {
+			delete(cs.streams, key)
+		}
+		cs.mutex.Unlock()
+		cancel(nil)
+	}
+	return ctx, release
+}
+
+// Active 返回进行中的会话流数量
+func (cs *ConversationStreams) Active() int {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return len(cs.streams)
+}
+
+// beginConversationStream 已启用且请求带有X-Conversation-ID时登记当前流，返回释放函数
+// 会话按客户端密钥隔离，不同调用方使用相同会话ID不会互相取消
+func beginConversationStream(c *gin.Context) func() {
+	conversationID := strings.TrimSpace(c.GetHeader(HeaderConversationID))
+	if conversationStreams == nil || conversationID == "" {
+		return func() {}
+	}
+
+	ctx, release := conversationStreams.Begin(extractAPIKey(c) + "\x00" + conversationID)
+	c.Set(upstreamContextKey, ctx)
+	return release
+}
+
+// upstreamContext 上游请求使用的context：登记了会话流时可被同一会话的新流取消
+func upstreamContext(c *gin.Context) context.Context {
+	if value, exists := c.Get(upstreamContextKey); exists {
+		if ctx, ok := value.(context.Context); ok {
+			return ctx
+		}
+	}
+	return context.Background()
+}
+
+// streamSuperseded 当前流是否已被同一会话的新流取消
+func streamSuperseded(c *gin.Context) bool {
+	return errors.Is(context.Cause(upstreamContext(c)), ErrStreamSuperseded)
+}
+
+// sendStreamSuperseded 通知被取消的流的客户端
+func sendStreamSuperseded(c *gin.Context, sender StreamEventSender) {
+	logger.Info("流式响应已被同一会话的新请求取消",
+		addReqFields(c, logger.String("conversation_id", c.GetHeader(HeaderConversationID)))...)
+	_ = sender.SendError(c, streamSupersededMessage, ErrStreamSuperseded)
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withConversationStreams(t *testing.T) *ConversationStreams {
+	original := conversationStreams
+	conversationStreams = NewConversationStreams()
+	t.Cleanup(func() { conversationStreams = original })
+	return conversationStreams
+}
+
+// newBlockingUpstream 第一个请求发出一帧后挂起直到被取消，之后的请求立即完整返回
+func newBlockingUpstream(t *testing.T) (started, canceled <-chan struct{}) {
+	startedCh := make(chan struct{})
+	canceledCh := make(chan struct{})
+	release := make(chan struct{})
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if atomic.AddInt32(&requests, 1) == 1 {
+			_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"first "}`))
+			w.(http.Flusher).Flush()
+			close(startedCh)
+			select {
+			case <-r.Context().Done():
+				close(canceledCh)
+			case <-release:
+			}
+			return
+		}
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"second answer"}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) }) // 先于upstream.Close执行，结束未被取消的请求
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	return startedCh, canceledCh
+}
+
+func newConversationStreamContext(path, conversationID string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", path, nil)
+	c.Request.Header.Set("Authorization", "Bearer client-key")
+	if conversationID != "" {
+		c.Request.Header.Set(HeaderConversationID, conversationID)
+	}
+	return c, w
+}
+
+// waitUpstreamResponded 等待请求收到上游响应头（已越过连接阶段，处于读取事件流阶段）
+func waitUpstreamResponded(t *testing.T, c *gin.Context) {
+	require.Eventually(t, func() bool {
+		entry, exists := requestIndex.Get(c.GetString("request_id"))
+		return exists && entry.StatusCode == http.StatusOK
+	}, 2*time.Second, time.Millisecond)
+}
+
+func TestConversationStreams_BeginCancelsPrevious(t *testing.T) {
+	streams := NewConversationStreams()
+
+	first, releaseFirst := streams.Begin("conv")
+	second, releaseSecond := streams.Begin("conv")
+	other, releaseOther := streams.Begin("other")
+	defer releaseOther()
+
+	assert.ErrorIs(t, context.Cause(first), ErrStreamSuperseded)
+	assert.NoError(t, second.Err())
+	assert.NoError(t, other.Err())
+
+	// 旧流的释放不影响新流的登记
+	releaseFirst()
+	assert.Equal(t, 2, streams.Active())
+
+	releaseSecond()
+	assert.Equal(t, 1, streams.Active())
+	assert.ErrorIs(t, second.Err(), context.Canceled)
+	assert.NotErrorIs(t, context.Cause(second), ErrStreamSuperseded)
+}
+
+func TestNewConversationStreamsFromEnv(t *testing.T) {
+	t.Setenv("ABORT_DUPLICATE_STREAMS", "")
+	assert.Nil(t, NewConversationStreamsFromEnv())
+
+	t.Setenv("ABORT_DUPLICATE_STREAMS", "true")
+	assert.NotNil(t, NewConversationStreamsFromEnv())
+}
+
+func TestAnthropicStream_NewStreamCancelsOlderInSameConversation(t *testing.T) {
+	streams := withConversationStreams(t)
+	started, canceled := newBlockingUpstream(t)
+	token := &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "mock-access-token"}}
+
+	c1, w1 := newConversationStreamContext("/v1/messages", "conv-1")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleStreamRequest(newRequestScope(c1, newStopTestRequest(true), token))
+	}()
+	<-started
+	waitUpstreamResponded(t, c1)
+
+	c2, w2 := newConversationStreamContext("/v1/messages", "conv-1")
+	handleStreamRequest(newRequestScope(c2, newStopTestRequest(true), token))
+
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("旧流的上游请求未被取消")
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("旧流未结束")
+	}
+
+	assert.Contains(t, w1.Body.String(), "message_start")
+	assert.Contains(t, w1.Body.String(), streamSupersededMessage)
+	assert.NotContains(t, w1.Body.String(), "message_stop")
+
+	assert.Contains(t, w2.Body.String(), "second answer")
+	assert.Contains(t, w2.Body.String(), "message_stop")
+	assert.NotContains(t, w2.Body.String(), streamSupersededMessage)
+	assert.Equal(t, 0, streams.Active())
+}
+
+func TestOpenAIStream_NewStreamCancelsOlderInSameConversation(t *testing.T) {
+	withConversationStreams(t)
+	started, canceled := newBlockingUpstream(t)
+	token := &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "mock-access-token"}}
+
+	c1, w1 := newConversationStreamContext("/v1/chat/completions", "conv-1")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleOpenAIStreamRequest(newRequestScope(c1, newStopTestRequest(true), token))
+	}()
+	<-started
+	waitUpstreamResponded(t, c1)
+
+	c2, w2 := newConversationStreamContext("/v1/chat/completions", "conv-1")
+	handleOpenAIStreamRequest(newRequestScope(c2, newStopTestRequest(true), token))
+
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("旧流的上游请求未被取消")
+	}
+	<-done
+
+	assert.Contains(t, w1.Body.String(), streamSupersededMessage)
+	assert.NotContains(t, w1.Body.String(), "[DONE]")
+	assert.Contains(t, w2.Body.String(), "second answer")
+	assert.Contains(t, w2.Body.String(), "[DONE]")
+}
+
+func TestConversationStreams_DifferentConversationOrDisabledNotCanceled(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		enabled  bool
+		secondID string
+	}{
+		{"不同会话", true, "conv-2"},
+		{"未带会话ID", true, ""},
+		{"未启用", false, "conv-1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.enabled {
+				withConversationStreams(t)
+			} else {
+				original := conversationStreams
+				conversationStreams = nil
+				t.Cleanup(func() { conversationStreams = original })
+			}
+			started, canceled := newBlockingUpstream(t)
+			token := &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "mock-access-token"}}
+
+			c1, _ := newConversationStreamContext("/v1/messages", "conv-1")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c1.Request = c1.Request.WithContext(ctx)
+			go handleStreamRequest(newRequestScope(c1, newStopTestRequest(true), token))
+			<-started
+
+			c2, w2 := newConversationStreamContext("/v1/messages", tc.secondID)
+			handleStreamRequest(newRequestScope(c2, newStopTestRequest(true), token))
+			require.Contains(t, w2.Body.String(), "second answer")
+
+			select {
+			case <-canceled:
+				t.Fatal("不应取消其他流")
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultCORSAllowedHeaders 默认允许的请求头，覆盖Anthropic/OpenAI SDK和本服务使用的自定义头
+var defaultCORSAllowedHeaders = []string{
+	"Content-Type",
+	"Authorization",
+	"x-api-key",
+	"anthropic-version",
+	"anthropic-beta",
+	"X-Request-ID",
+	HeaderConversationID,
+	modelOverrideHeader,
+	effectiveParamsHeader,
+	verboseHeader,
+	"Last-Event-ID",
+	"X-No-Compression",
+}
+
+// corsAllowedMethods 允许的请求方法
+const corsAllowedMethods = "GET, POST, PUT, DELETE, OPTIONS"
+
+// defaultCORSMaxAge 预检结果的默认缓存秒数
+const defaultCORSMaxAge = 600
+
+// CORSPolicy 一组路由的跨域策略
+type CORSPolicy struct {
+	AllowedOrigins   []string // 允许的来源（精确匹配），"*" 表示任意来源
+	AllowCredentials bool     // 是否返回 Access-Control-Allow-Credentials: true
+	AllowedHeaders   []string // 预检允许的请求头
+	MaxAge           int      // 预检结果缓存秒数，0表示不返回Access-Control-Max-Age
+}
+
+// CORSConfig 按路由分组的跨域配置
+// /v1 面向SDK，默认允许任意来源；其余端点（/api 管理接口、Dashboard）默认只允许同源访问
+type CORSConfig struct {
+	V1  *CORSPolicy
+	API *CORSPolicy
+}
+
+// NewCORSConfigFromEnv 根据环境变量创建跨域配置
+// CORS_ALLOWED_ORIGINS: /v1 允许的来源，逗号分隔（默认 *）
+// CORS_API_ALLOWED_ORIGINS: /api 等管理端点允许的来源，逗号分隔（默认为空，仅同源）
+// CORS_ALLOW_CREDENTIALS: 是否允许携带凭证（默认 false，对 * 来源不生效）
+// CORS_ALLOWED_HEADERS: 允许的请求头，逗号分隔（默认覆盖 anthropic-version、x-api-key 等常用头）
+// CORS_MAX_AGE: 预检结果缓存秒数（默认 600）
+func NewCORSConfigFromEnv() *CORSConfig {
+	headers := splitCommaList(os.Getenv("CORS_ALLOWED_HEADERS"))
+	if len(headers) == 0 {
+		headers = defaultCORSAllowedHeaders
+	}
+
+	maxAge := defaultCORSMaxAge
+	if value := strings.TrimSpace(os.Getenv("CORS_MAX_AGE")); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			maxAge = parsed
+		} else {
+			logger.Warn("CORS_MAX_AGE无效，使用默认值",
+				logger.String("value", value),
+				logger.Int("default", defaultCORSMaxAge))
+		}
+	}
+
+	credentials := utils.GetEnvBool("CORS_ALLOW_CREDENTIALS")
+
+	v1Origins := []string{"*"}
+	if value, exists := os.LookupEnv("CORS_ALLOWED_ORIGINS"); exists && strings.TrimSpace(value) != "" {
+		v1Origins = splitCommaList(value)
+	}
+
+	cfg := &CORSConfig{
+		V1: &CORSPolicy{
+			AllowedOrigins:   v1Origins,
+			AllowCredentials: credentials,
+			AllowedHeaders:   headers,
+			MaxAge:           maxAge,
+		},
+		API: &CORSPolicy{
+			AllowedOrigins:   splitCommaList(os.Getenv("CORS_API_ALLOWED_ORIGINS")),
+			AllowCredentials: credentials,
+			AllowedHeaders:   headers,
+			MaxAge:           maxAge,
+		},
+	}
+	if credentials && (cfg.V1.allowsAnyOrigin() || cfg.API.allowsAnyOrigin()) {
+		logger.Warn("CORS_ALLOW_CREDENTIALS对 * 来源不生效，需要携带凭证的来源请在允许列表中精确列出")
+	}
+	return cfg
+}
+
+// splitCommaList 拆分逗号分隔的列表，忽略空项
+func splitCommaList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// policyFor 返回路径对应的跨域策略
+func (cfg *CORSConfig) policyFor(path string) *CORSPolicy {
+	if path == "/v1" || strings.HasPrefix(path, "/v1/") {
+		return cfg.V1
+	}
+	return cfg.API
+}
+
+// allowsAnyOrigin 是否允许任意来源
+func (p *CORSPolicy) allowsAnyOrigin() bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsOrigin 来源是否在允许列表中精确列出
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed != "*" && strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORSMiddleware 按路由分组应用跨域策略
+// 精确列出的来源回显为Access-Control-Allow-Origin并附加Vary: Origin，可携带凭证；
+// "*" 来源返回通配符（不携带凭证）；不允许的来源不返回跨域头，预检请求返回403
+func CORSMiddleware(cfg *CORSConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy := cfg.policyFor(c.Request.URL.Path)
+		origin := c.GetHeader("Origin")
+		header := c.Writer.Header()
+		preflight := c.Request.Method == http.MethodOptions
+
+		allowed := true
+		switch {
+		case origin != "" && policy.allowsOrigin(origin):
+			header.Set("Access-Control-Allow-Origin", origin)
+			header.Add("Vary", "Origin")
+			if policy.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+		case policy.allowsAnyOrigin():
+			header.Set("Access-Control-Allow-Origin", "*")
+		default:
+			// 响应随Origin变化，缓存需区分来源
+			header.Add("Vary", "Origin")
+			allowed = origin == ""
+		}
+
+		if !preflight {
+			c.Next()
+			return
+		}
+
+		if !allowed {
+			logger.Debug("拒绝跨域预检请求",
+				logger.String("origin", origin),
+				logger.String("path", c.Request.URL.Path))
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		header.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+		header.Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+		if policy.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+		}
+		c.AbortWithStatus(http.StatusOK)
+	}
+}
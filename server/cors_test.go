@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testDashboardOrigin = "https://dashboard.example.com"
+	testOtherOrigin     = "https://evil.example.com"
+)
+
+// newCORSTestRouter 注册 /v1 和 /api 两组测试路由
+func newCORSTestRouter(cfg *CORSConfig) *gin.Engine {
+	r := gin.New()
+	r.Use(CORSMiddleware(cfg))
+	r.POST("/v1/messages", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.GET("/api/tokens", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	return r
+}
+
+func serveCORSRequest(r *gin.Engine, method, path, origin string, preflight bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if preflight {
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "content-type, x-api-key, anthropic-version")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// clearCORSEnv 清空CORS相关环境变量，使用默认配置
+func clearCORSEnv(t *testing.T) {
+	for _, key := range []string{"CORS_ALLOWED_ORIGINS", "CORS_API_ALLOWED_ORIGINS", "CORS_ALLOW_CREDENTIALS", "CORS_ALLOWED_HEADERS", "CORS_MAX_AGE"} {
+		t.Setenv(key, "")
+	}
+}
+
+func TestCORS_DefaultsKeepV1Open(t *testing.T) {
+	clearCORSEnv(t)
+	r := newCORSTestRouter(NewCORSConfigFromEnv())
+
+	// /v1 保持原有的通配行为，无Origin的请求也返回 *
+	for _, origin := range []string{"", testOtherOrigin} {
+		w := serveCORSRequest(r, http.MethodPost, "/v1/messages", origin, false)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+	}
+
+	w := serveCORSRequest(r, http.MethodOptions, "/v1/messages", testOtherOrigin, true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, corsAllowedMethods, w.Header().Get("Access-Control-Allow-Methods"))
+	allowedHeaders := w.Header().Get("Access-Control-Allow-Headers")
+	for _, h := range []string{"Content-Type", "Authorization", "x-api-key", "anthropic-version", HeaderConversationID} {
+		assert.Contains(t, allowedHeaders, h)
+	}
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+
+	// /api 默认仅同源：跨域请求不返回跨域头，预检被拒绝
+	w = serveCORSRequest(r, http.MethodGet, "/api/tokens", testOtherOrigin, false)
+	assert.Equal(t, http.StatusNoContent, w.Code, "非预检请求照常处理，由浏览器拦截")
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+
+	w = serveCORSRequest(r, http.MethodOptions, "/api/tokens", testOtherOrigin, true)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORS_APIAllowedOriginWithCredentials(t *testing.T) {
+	clearCORSEnv(t)
+	t.Setenv("CORS_API_ALLOWED_ORIGINS", testDashboardOrigin+", https://admin.example.com")
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	t.Setenv("CORS_MAX_AGE", "120")
+	r := newCORSTestRouter(NewCORSConfigFromEnv())
+
+	w := serveCORSRequest(r, http.MethodGet, "/api/tokens", testDashboardOrigin, false)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, testDashboardOrigin, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+
+	w = serveCORSRequest(r, http.MethodOptions, "/api/tokens", testDashboardOrigin, true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, testDashboardOrigin, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "120", w.Header().Get("Access-Control-Max-Age"))
+
+	// 未列出的来源被拒绝
+	w = serveCORSRequest(r, http.MethodGet, "/api/tokens", testOtherOrigin, false)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+	w = serveCORSRequest(r, http.MethodOptions, "/api/tokens", testOtherOrigin, true)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// /v1 仍为 *，通配来源不携带凭证
+	w = serveCORSRequest(r, http.MethodPost, "/v1/messages", testDashboardOrigin, false)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORS_V1RestrictedOrigins(t *testing.T) {
+	clearCORSEnv(t)
+	t.Setenv("CORS_ALLOWED_ORIGINS", testDashboardOrigin)
+	t.Setenv("CORS_ALLOWED_HEADERS", "Content-Type, x-api-key")
+	t.Setenv("CORS_MAX_AGE", "0")
+	r := newCORSTestRouter(NewCORSConfigFromEnv())
+
+	w := serveCORSRequest(r, http.MethodOptions, "/v1/messages", testDashboardOrigin, true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, testDashboardOrigin, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Content-Type, x-api-key", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Empty(t, w.Header().Get("Access-Control-Max-Age"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+
+	w = serveCORSRequest(r, http.MethodOptions, "/v1/messages", testOtherOrigin, true)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = serveCORSRequest(r, http.MethodPost, "/v1/messages", testOtherOrigin, false)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// 没有Origin的请求（服务端SDK）不受影响
+	w = serveCORSRequest(r, http.MethodPost, "/v1/messages", "", false)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
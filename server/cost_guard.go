@@ -0,0 +1,217 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// costWarningHeader WARN_ONLY模式下超出预算时附加的响应头
+const costWarningHeader = "X-Kiro-Cost-Warning"
+
+// 单请求额度预算的处理方式（COST_GUARD_MODE）
+const (
+	CostGuardReject = "reject" // 超出预算返回400（默认）
+	CostGuardWarn   = "warn"   // 只附加响应头并记录警告
+)
+
+// 预算检查结果，写入访问日志
+const (
+	costDecisionOK     = "ok"
+	costDecisionWarn   = "warn"
+	costDecisionReject = "reject"
+)
+
+// 访问日志使用的上下文键
+const (
+	accessLogCostKey     = "access_log_cost_credits"
+	accessLogDecisionKey = "access_log_cost_decision"
+)
+
+// CostGuardPolicy 单请求额度预算：按输入token估算与max_tokens估算本次请求消耗的额度，超出上限时拒绝或告警
+// 估算公式：credits = 输入token/1000 * InputPer1K + max_tokens/1000 * OutputPer1K
+type CostGuardPolicy struct {
+	MaxCredits  float64            // 全局上限，0表示不限制
+	KeyLimits   map[string]float64 // 客户端密钥 -> 上限，优先于全局上限
+	InputPer1K  float64
+	OutputPer1K float64
+	WarnOnly    bool
+}
+
+// CostEstimate 一次请求的额度估算
+type CostEstimate struct {
+	InputTokens  int
+	OutputTokens int
+	Credits      float64
+}
+
+// costGuard 全局额度预算策略，nil表示未启用
+var costGuard *CostGuardPolicy
+
+// NewCostGuardPolicyFromEnv 根据环境变量创建额度预算策略，未设置任何上限时返回nil
+// MAX_CREDITS_PER_REQUEST: 全局单请求额度上限
+// MAX_CREDITS_PER_REQUEST_KEYS: JSON对象，客户端密钥 -> 单请求额度上限
+// COST_GUARD_MODE: reject（默认）/ warn
+// CREDITS_PER_1K_INPUT_TOKENS / CREDITS_PER_1K_OUTPUT_TOKENS: 估算公式的系数
+func NewCostGuardPolicyFromEnv() *CostGuardPolicy {
+	policy := &CostGuardPolicy{
+		MaxCredits:  envNonNegativeFloat("MAX_CREDITS_PER_REQUEST", 0),
+		InputPer1K:  envNonNegativeFloat("CREDITS_PER_1K_INPUT_TOKENS", config.DefaultCreditsPer1KInputTokens),
+		OutputPer1K: envNonNegativeFloat("CREDITS_PER_1K_OUTPUT_TOKENS", config.DefaultCreditsPer1KOutputTokens),
+	}
+
+	if value := strings.TrimSpace(os.Getenv("MAX_CREDITS_PER_REQUEST_KEYS")); value != "" {
+		var limits map[string]float64
+		if err := utils.SafeUnmarshal([]byte(value), &limits); err != nil {
+			logger.Warn("MAX_CREDITS_PER_REQUEST_KEYS无效，忽略", logger.Err(err))
+		} else {
+			for key, limit := range limits {
+				if limit <= 0 {
+					logger.Warn("忽略无效的客户端额度上限",
+						logger.String("client_key", maskClientKey(key)),
+						logger.Float64("limit", limit))
+					delete(limits, key)
+				}
+			}
+			policy.KeyLimits = limits
+		}
+	}
+
+	if policy.MaxCredits == 0 && len(policy.KeyLimits) == 0 {
+		return nil
+	}
+
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("COST_GUARD_MODE"))); mode {
+	case "", CostGuardReject:
+	case CostGuardWarn, "warn_only":
+		policy.WarnOnly = true
+	default:
+		logger.Warn("COST_GUARD_MODE无效，使用reject", logger.String("value", mode))
+	}
+
+	logger.Info("已启用单请求额度预算",
+		logger.Float64("max_credits", policy.MaxCredits),
+		logger.Int("key_limits", len(policy.KeyLimits)),
+		logger.Bool("warn_only", policy.WarnOnly))
+	return policy
+}
+
+// envNonNegativeFloat 读取非负浮点数环境变量，未设置或无效时返回默认值
+func envNonNegativeFloat(key string, defaultValue float64) float64 {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+		logger.Warn("环境变量无效，使用默认值", logger.String("env", key), logger.String("value", value))
+		return defaultValue
+	}
+	return parsed
+}
+
+// Limit 返回客户端密钥对应的额度上限，0表示不限制
+func (p *CostGuardPolicy) Limit(clientKey string) float64 {
+	if limit, ok := p.KeyLimits[clientKey]; ok {
+		return limit
+	}
+	return p.MaxCredits
+}
+
+// Estimate 估算请求消耗的额度；未指定max_tokens时按默认输出上限计算
+func (p *CostGuardPolicy) Estimate(req types.AnthropicRequest) CostEstimate {
+	estimator := utils.NewTokenEstimator()
+	inputTokens := estimator.EstimateTokens(&types.CountTokensRequest{
+		Model:    req.Model,
+		System:   req.System,
+		Messages: req.Messages,
+		Tools:    filterSupportedTools(req.Tools),
+	})
+	outputTokens := req.MaxTokens
+	if outputTokens <= 0 {
+		outputTokens = config.DefaultCostGuardMaxTokens
+	}
+	credits := float64(inputTokens)/1000*p.InputPer1K + float64(outputTokens)/1000*p.OutputPer1K
+	return CostEstimate{
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+		Credits:      math.Round(credits*10000) / 10000,
+	}
+}
+
+// checkCostBudget 检查请求的估算额度是否超出预算，结果写入访问日志
+// 超出预算时：reject模式返回400并返回false；warn模式附加X-Kiro-Cost-Warning响应头后继续
+func checkCostBudget(c *gin.Context, req types.AnthropicRequest) bool {
+	if costGuard == nil {
+		return true
+	}
+	limit := costGuard.Limit(extractAPIKey(c))
+	if limit <= 0 {
+		return true
+	}
+
+	estimate := costGuard.Estimate(req)
+	c.Set(accessLogCostKey, estimate.Credits)
+	if estimate.Credits <= limit {
+		c.Set(accessLogDecisionKey, costDecisionOK)
+		return true
+	}
+
+	message := fmt.Sprintf("请求估算额度 %s 超过单请求上限 %s（输入约 %d tokens，max_tokens %d）",
+		formatCredits(estimate.Credits), formatCredits(limit), estimate.InputTokens, estimate.OutputTokens)
+	fields := addReqFields(c,
+		logger.String("model", req.Model),
+		logger.Float64("estimated_credits", estimate.Credits),
+		logger.Float64("limit", limit),
+		logger.Int("input_tokens", estimate.InputTokens),
+		logger.Int("max_tokens", estimate.OutputTokens),
+		logger.String("client_key", maskClientKey(extractAPIKey(c))))
+
+	if costGuard.WarnOnly {
+		c.Set(accessLogDecisionKey, costDecisionWarn)
+		c.Header(costWarningHeader, fmt.Sprintf("estimated=%s; limit=%s",
+			formatCredits(estimate.Credits), formatCredits(limit)))
+		logger.Warn("请求估算额度超出预算", fields...)
+		return true
+	}
+
+	c.Set(accessLogDecisionKey, costDecisionReject)
+	logger.Warn("请求估算额度超出预算，已拒绝", fields...)
+	respondCostLimitExceeded(c, message)
+	return false
+}
+
+// respondCostLimitExceeded 按请求方言返回400
+func respondCostLimitExceeded(c *gin.Context, message string) {
+	if isOpenAIRequest(c) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": message,
+				"type":    "invalid_request_error",
+				"code":    "cost_limit_exceeded",
+			},
+		})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    "invalid_request_error",
+			"message": message,
+		},
+	})
+}
+
+func formatCredits(credits float64) string {
+	return strconv.FormatFloat(credits, 'f', -1, 64)
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/converter"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withCostGuard 在测试期间替换额度预算策略
+func withCostGuard(t *testing.T, policy *CostGuardPolicy) {
+	t.Helper()
+	original := costGuard
+	costGuard = policy
+	t.Cleanup(func() { costGuard = original })
+}
+
+// newCostGuardRouter 两种方言的端点都在解析请求后执行预算检查
+func newCostGuardRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	r := gin.New()
+	r.Use(AccessLogMiddleware(AccessLogFormatJSON))
+	r.POST("/v1/messages", func(c *gin.Context) {
+		var req types.AnthropicRequest
+		body, _ := c.GetRawData()
+		require.NoError(t, utils.SafeUnmarshal(body, &req))
+		if !checkCostBudget(c, req) {
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	r.POST("/v1/chat/completions", func(c *gin.Context) {
+		var req types.OpenAIRequest
+		body, _ := c.GetRawData()
+		require.NoError(t, utils.SafeUnmarshal(body, &req))
+		if !checkCostBudget(c, converter.ConvertOpenAIToAnthropic(req)) {
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	return r
+}
+
+func postCostGuard(r *gin.Engine, path, apiKey, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+const (
+	costAnthropicBody = `{"model":"claude-sonnet-4-5","max_tokens":4000,"messages":[{"role":"user","content":"hello"}]}`
+	// OpenAI请求未指定max_tokens，按模型默认值（claude-sonnet-4-5为32000）估算
+	costOpenAIBody = `{"model":"claude-sonnet-4-5","messages":[{"role":"user","content":"hello"}]}`
+)
+
+var costDialects = []struct {
+	name string
+	path string
+	body string
+}{
+	{"anthropic", "/v1/messages", costAnthropicBody},
+	{"openai", "/v1/chat/completions", costOpenAIBody},
+}
+
+func TestCostGuard_UnderBudget(t *testing.T) {
+	withCostGuard(t, &CostGuardPolicy{MaxCredits: 100, InputPer1K: 0.1, OutputPer1K: 0.5})
+
+	for _, dialect := range costDialects {
+		t.Run(dialect.name, func(t *testing.T) {
+			entries := captureAccessLog(t)
+			w := postCostGuard(newCostGuardRouter(t), dialect.path, "", dialect.body)
+
+			assert.Equal(t, http.StatusNoContent, w.Code)
+			assert.Empty(t, w.Header().Get(costWarningHeader))
+			logged := entries()
+			require.Len(t, logged, 1)
+			assert.Equal(t, costDecisionOK, logged[0]["cost_decision"])
+			assert.Positive(t, logged[0]["cost_credits"])
+		})
+	}
+}
+
+func TestCostGuard_OverBudgetRejected(t *testing.T) {
+	withCostGuard(t, &CostGuardPolicy{MaxCredits: 1, InputPer1K: 0.1, OutputPer1K: 0.5})
+	r := newCostGuardRouter(t)
+
+	t.Run("anthropic", func(t *testing.T) {
+		entries := captureAccessLog(t)
+		w := postCostGuard(r, "/v1/messages", "", costAnthropicBody)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		var resp map[string]any
+		require.NoError(t, utils.SafeUnmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "error", resp["type"])
+		errObj := resp["error"].(map[string]any)
+		assert.Equal(t, "invalid_request_error", errObj["type"])
+		assert.Contains(t, errObj["message"], "超过单请求上限 1")
+		assert.Contains(t, errObj["message"], "max_tokens 4000")
+
+		logged := entries()
+		require.Len(t, logged, 1)
+		assert.Equal(t, costDecisionReject, logged[0]["cost_decision"])
+		assert.Greater(t, logged[0]["cost_credits"], 1.0)
+	})
+
+	t.Run("openai", func(t *testing.T) {
+		entries := captureAccessLog(t)
+		w := postCostGuard(r, "/v1/chat/completions", "", costOpenAIBody)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		var resp map[string]any
+		require.NoError(t, utils.SafeUnmarshal(w.Body.Bytes(), &resp))
+		errObj := resp["error"].(map[string]any)
+		assert.Equal(t, "invalid_request_error", errObj["type"])
+		assert.Equal(t, "cost_limit_exceeded", errObj["code"])
+		assert.Contains(t, errObj["message"], "max_tokens 32000")
+
+		logged := entries()
+		require.Len(t, logged, 1)
+		assert.Equal(t, costDecisionReject, logged[0]["cost_decision"])
+	})
+}
+
+func TestCostGuard_WarnOnly(t *testing.T) {
+	withCostGuard(t, &CostGuardPolicy{MaxCredits: 1, InputPer1K: 0.1, OutputPer1K: 0.5, WarnOnly: true})
+
+	for _, dialect := range costDialects {
+		t.Run(dialect.name, func(t *testing.T) {
+			entries := captureAccessLog(t)
+			w := postCostGuard(newCostGuardRouter(t), dialect.path, "", dialect.body)
+
+			assert.Equal(t, http.StatusNoContent, w.Code)
+			assert.Contains(t, w.Header().Get(costWarningHeader), "limit=1")
+			logged := entries()
+			require.Len(t, logged, 1)
+			assert.Equal(t, costDecisionWarn, logged[0]["cost_decision"])
+		})
+	}
+}
+
+func TestCostGuard_PerKeyLimit(t *testing.T) {
+	withCostGuard(t, &CostGuardPolicy{
+		KeyLimits:   map[string]float64{"sk-small": 1, "sk-large": 100},
+		InputPer1K:  0.1,
+		OutputPer1K: 0.5,
+	})
+	r := newCostGuardRouter(t)
+
+	assert.Equal(t, http.StatusBadRequest, postCostGuard(r, "/v1/messages", "sk-small", costAnthropicBody).Code)
+	assert.Equal(t, http.StatusNoContent, postCostGuard(r, "/v1/messages", "sk-large", costAnthropicBody).Code)
+
+	// 未配置上限的密钥且无全局上限时不检查，访问日志不记录额度
+	entries := captureAccessLog(t)
+	assert.Equal(t, http.StatusNoContent, postCostGuard(r, "/v1/messages", "sk-other", costAnthropicBody).Code)
+	assert.NotContains(t, entries()[0], "cost_decision")
+}
+
+func TestCostGuardPolicy_Estimate(t *testing.T) {
+	policy := &CostGuardPolicy{InputPer1K: 0, OutputPer1K: 1}
+	estimate := policy.Estimate(types.AnthropicRequest{MaxTokens: 2000})
+	assert.Equal(t, 2000, estimate.OutputTokens)
+	assert.Equal(t, 2.0, estimate.Credits)
+
+	estimate = policy.Estimate(types.AnthropicRequest{})
+	assert.Equal(t, 16384, estimate.OutputTokens, "未指定max_tokens时按默认上限估算")
+}
+
+func TestNewCostGuardPolicyFromEnv(t *testing.T) {
+	t.Setenv("MAX_CREDITS_PER_REQUEST", "")
+	t.Setenv("MAX_CREDITS_PER_REQUEST_KEYS", "")
+	t.Setenv("COST_GUARD_MODE", "")
+	t.Setenv("CREDITS_PER_1K_INPUT_TOKENS", "")
+	t.Setenv("CREDITS_PER_1K_OUTPUT_TOKENS", "")
+	assert.Nil(t, NewCostGuardPolicyFromEnv(), "未设置上限时不启用")
+
+	t.Setenv("MAX_CREDITS_PER_REQUEST", "2.5")
+	t.Setenv("MAX_CREDITS_PER_REQUEST_KEYS", `{"sk-a": 1, "sk-bad": -1}`)
+	t.Setenv("COST_GUARD_MODE", "warn")
+	t.Setenv("CREDITS_PER_1K_INPUT_TOKENS", "0.2")
+	t.Setenv("CREDITS_PER_1K_OUTPUT_TOKENS", "abc")
+	policy := NewCostGuardPolicyFromEnv()
+	require.NotNil(t, policy)
+	assert.Equal(t, 2.5, policy.MaxCredits)
+	assert.Equal(t, map[string]float64{"sk-a": 1}, policy.KeyLimits)
+	assert.True(t, policy.WarnOnly)
+	assert.Equal(t, 0.2, policy.InputPer1K)
+	assert.Equal(t, 0.5, policy.OutputPer1K, "无效系数回退为默认值")
+	assert.Equal(t, 1.0, policy.Limit("sk-a"))
+	assert.Equal(t, 2.5, policy.Limit("sk-other"))
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newToolUseEventUpstream 创建按顺序返回toolUseEvent帧的假上游
+func newToolUseEventUpstream(t *testing.T, payloads ...string) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for _, payload := range payloads {
+			_, _ = w.Write(encodeTestEventStreamFrameWithHeaders([][2]string{
+				{":message-type", "event"},
+				{":event-type", "toolUseEvent"},
+			}, payload))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+}
+
+func TestStream_DanglingToolClosedAtStreamEnd(t *testing.T) {
+	newToolUseEventUpstream(t,
+		`{"name":"get_weather","toolUseId":"tooluse_dangling","input":""}`,
+		`{"name":"get_weather","toolUseId":"tooluse_dangling","input":"{\"city\":"}`,
+	)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	handleStreamRequest(newTestScope(c, newToolTestRequest(true, false)))
+
+	body := w.Body.String()
+	assert.Contains(t, body, `"partial_json":"{\"city\":"`, "已下发的参数片段保留")
+	assert.Contains(t, body, `{"index":1,"type":"content_block_stop"}`)
+	assert.NotContains(t, body, "truncated", "下发的结束事件保持规范格式")
+	assert.Contains(t, body, `"stop_reason":"tool_use"`)
+}
+
+func TestStream_TooManyActiveTools(t *testing.T) {
+	payloads := make([]string, 0, config.MaxActiveTools+1)
+	for i := 0; i <= config.MaxActiveTools; i++ {
+		payloads = append(payloads, fmt.Sprintf(`{"name":"get_weather","toolUseId":"tooluse_%d","input":""}`, i))
+	}
+	newToolUseEventUpstream(t, payloads...)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	handleStreamRequest(newTestScope(c, newToolTestRequest(true, false)))
+
+	body := w.Body.String()
+	assert.Contains(t, body, tooManyActiveToolsMessage)
+	assert.Equal(t, config.MaxActiveTools, strings.Count(body, `"type":"tool_use"`), "超过上限的工具不再下发")
+	assert.NotContains(t, body, "message_stop")
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// applyDefaultMaxTokens 客户端（及提示词配置）未指定max_tokens时按最终模型填入默认值
+// 默认值来自模型能力元数据，可由MODEL_DEFAULT_MAX_TOKENS按模型覆盖；在模型覆盖之后调用，以替换后的模型为准
+func applyDefaultMaxTokens(c *gin.Context, req types.AnthropicRequest, explicit bool) types.AnthropicRequest {
+	if explicit {
+		return req
+	}
+	req.MaxTokens = config.DefaultMaxTokensOf(req.Model)
+	logger.Debug("使用模型默认的max_tokens",
+		addReqFields(c,
+			logger.String("model", req.Model),
+			logger.Int("max_tokens", req.MaxTokens))...)
+	return req
+}
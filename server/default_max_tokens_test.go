@@ -0,0 +1,86 @@
+package server
+
+import (
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withModelDefaultMaxTokens 替换启动时解析的各模型默认max_tokens覆盖值
+func withModelDefaultMaxTokens(t *testing.T, overrides map[string]int) {
+	original := config.ModelDefaultMaxTokensOverrides
+	config.ModelDefaultMaxTokensOverrides = overrides
+	t.Cleanup(func() { config.ModelDefaultMaxTokensOverrides = original })
+}
+
+func TestApplyDefaultMaxTokens_PerModel(t *testing.T) {
+	withModelDefaultMaxTokens(t, nil)
+	c, _ := newProfileTestContext("", "")
+
+	for _, model := range []string{"claude-sonnet-4-20250514", "claude-3-5-haiku-20241022", "unknown-model"} {
+		req := profileTestRequest()
+		req.Model = model
+		req = applyDefaultMaxTokens(c, req, req.MaxTokens > 0)
+		assert.Equal(t, config.DefaultMaxTokensOf(model), req.MaxTokens, model)
+		assert.Positive(t, req.MaxTokens, model)
+	}
+	assert.Greater(t, config.DefaultMaxTokensOf("claude-sonnet-4-20250514"), config.DefaultMaxTokensOf("claude-3-5-haiku-20241022"))
+
+	// 客户端指定的取值不变
+	req := profileTestRequest()
+	req.MaxTokens = 100
+	assert.Equal(t, 100, applyDefaultMaxTokens(c, req, req.MaxTokens > 0).MaxTokens)
+
+	// MODEL_DEFAULT_MAX_TOKENS按模型覆盖
+	withModelDefaultMaxTokens(t, map[string]int{"claude-sonnet-4-20250514": 4096})
+	req = profileTestRequest()
+	assert.Equal(t, 4096, applyDefaultMaxTokens(c, req, false).MaxTokens)
+}
+
+func TestApplyDefaultMaxTokens_ProfileTakesPrecedence(t *testing.T) {
+	withPromptProfiles(t, testPromptProfiles())
+	c, _ := newProfileTestContext("team-cn-key", "")
+	profile, ok := selectPromptProfile(c)
+	assert.True(t, ok)
+
+	req := applyPromptProfile(c, profile, profileTestRequest())
+	req = applyDefaultMaxTokens(c, req, req.MaxTokens > 0)
+	assert.Equal(t, 2048, req.MaxTokens, "提示词配置的默认值优先于模型默认值")
+}
+
+func TestApplyDefaultMaxTokens_OpenAIAfterModelOverride(t *testing.T) {
+	withModelDefaultMaxTokens(t, nil)
+	c, _ := newProfileTestContext("", "")
+	openaiReq := types.OpenAIRequest{
+		Model:    "claude-3-5-haiku-20241022",
+		Messages: []types.OpenAIMessage{{Role: "user", Content: "hi"}},
+	}
+	anthropicReq := converter.ConvertOpenAIToAnthropic(openaiReq)
+	assert.Equal(t, config.DefaultMaxTokensOf("claude-3-5-haiku-20241022"), anthropicReq.MaxTokens)
+
+	// 模型被替换后按新模型取默认值
+	anthropicReq.Model = "claude-sonnet-4-20250514"
+	_, explicit := openaiReq.RequestedMaxTokens()
+	anthropicReq = applyDefaultMaxTokens(c, anthropicReq, explicit)
+	assert.Equal(t, config.DefaultMaxTokensOf("claude-sonnet-4-20250514"), anthropicReq.MaxTokens)
+
+	maxTokens := 512
+	openaiReq.MaxTokens = &maxTokens
+	_, explicit = openaiReq.RequestedMaxTokens()
+	assert.Equal(t, 512, applyDefaultMaxTokens(c, converter.ConvertOpenAIToAnthropic(openaiReq), explicit).MaxTokens)
+}
+
+func TestNewRouter_ParsesModelDefaultMaxTokensOnce(t *testing.T) {
+	withModelDefaultMaxTokens(t, nil)
+	t.Setenv("MODEL_DEFAULT_MAX_TOKENS", `{"claude-sonnet-4-20250514": 4096}`)
+	newTestRouter(t, routerTestToken, nil)
+	assert.Equal(t, 4096, config.DefaultMaxTokensOf("claude-sonnet-4-20250514"))
+
+	// 启动后修改环境变量不影响已解析的配置
+	t.Setenv("MODEL_DEFAULT_MAX_TOKENS", `{"claude-sonnet-4-20250514": 2048}`)
+	assert.Equal(t, 4096, config.DefaultMaxTokensOf("claude-sonnet-4-20250514"))
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 有效参数回显：客户端发送 X-Kiro-Effective-Params: true 时在同名响应头中返回紧凑JSON；
+// 发送 X-Kiro-Verbose: true 时非流式响应体增加顶层 "kiro" 对象（流式响应体无法携带，改用响应头）。
+// 未请求时不产生任何输出。
+const (
+	effectiveParamsHeader = "X-Kiro-Effective-Params"
+	verboseHeader         = "X-Kiro-Verbose"
+)
+
+// 参数未生效的原因/生效方式
+const (
+	paramNoteUpstreamUnsupported = "upstream_unsupported" // 上游没有对应参数，已丢弃
+	paramNoteSystemInstruction   = "system_instruction"   // 以系统提示指令的形式转发
+)
+
+// EffectiveParams 实际发往上游的请求参数摘要
+type EffectiveParams struct {
+	Model       EffectiveModel    `json:"model"`
+	MaxTokens   EffectiveParam    `json:"max_tokens"`
+	Temperature *EffectiveParam   `json:"temperature,omitempty"`
+	TopP        *EffectiveParam   `json:"top_p,omitempty"`
+	Tools       EffectiveTools    `json:"tools"`
+	History     EffectiveHistory  `json:"history"`
+	Timeout     *EffectiveTimeout `json:"timeout,omitempty"`
+	Profile     string            `json:"profile,omitempty"` // 生效的服务端提示词配置（PROFILES_FILE）
+}
+
+// EffectiveModel 模型映射：请求的模型名 -> 别名目标（如有）-> 上游modelId
+type EffectiveModel struct {
+	Requested string `json:"requested"`
+	Alias     string `json:"alias,omitempty"`
+	Upstream  string `json:"upstream"`
+}
+
+// EffectiveParam 单个采样参数是否被上游采用
+type EffectiveParam struct {
+	Requested any    `json:"requested"`
+	Applied   bool   `json:"applied"`
+	Note      string `json:"note,omitempty"`
+}
+
+// EffectiveTools 过滤前后的工具数量
+type EffectiveTools struct {
+	Requested int `json:"requested"`
+	Forwarded int `json:"forwarded"`
+}
+
+// EffectiveTimeout 客户端通过X-Kiro-Timeout-Ms指定的超时
+type EffectiveTimeout struct {
+	RequestedMs int64  `json:"requested_ms"`
+	AppliedMs   int64  `json:"applied_ms"` // 按服务端上限截断后的值
+	Scope       string `json:"scope"`      // overall（非流式整体）/ first_token（流式首字节）
+}
+
+// EffectiveHistory 历史裁剪统计
+type EffectiveHistory struct {
+	OriginalMessages int  `json:"original_messages"`
+	KeptMessages     int  `json:"kept_messages"`
+	Trimmed          bool `json:"trimmed"`
+	UpstreamEntries  int  `json:"upstream_entries"` // 上游history条目数（含系统提示对）
+}
+
+// wantsEffectiveParams 判断客户端是否请求了有效参数回显
+func wantsEffectiveParams(c *gin.Context) (header bool, verbose bool) {
+	header = isTruthyHeader(c.GetHeader(effectiveParamsHeader))
+	verbose = isTruthyHeader(c.GetHeader(verboseHeader))
+	return header, verbose
+}
+
+func isTruthyHeader(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+// attachEffectiveParams 在请求上游前计算有效参数并按需写入响应头
+// 返回值仅在X-Kiro-Verbose时非nil，由非流式处理器写入响应体
+func attachEffectiveParams(c *gin.Context, anthropicReq types.AnthropicRequest, isStream bool) *EffectiveParams {
+	header, verbose := wantsEffectiveParams(c)
+	if !header && !verbose {
+		return nil
+	}
+
+	params, err := computeEffectiveParams(c, anthropicReq)
+	if err != nil {
+		// 转换失败时真实请求会返回同样的错误，这里不重复处理
+		logger.Debug("计算有效参数失败", addReqFields(c, logger.Err(err))...)
+		return nil
+	}
+
+	if header || (verbose && isStream) {
+		if encoded, err := utils.SafeMarshal(params); err == nil {
+			c.Header(effectiveParamsHeader, string(encoded))
+		}
+	}
+	if verbose && !isStream {
+		return params
+	}
+	return nil
+}
+
+// computeEffectiveParams 以与真实请求相同的转换流程试构建上游请求（dry run），据此汇总有效参数
+func computeEffectiveParams(c *gin.Context, anthropicReq types.AnthropicRequest) (*EffectiveParams, error) {
+	cwReq, err := converter.BuildCodeWhispererRequest(anthropicReq, c)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &EffectiveParams{
+		Model: EffectiveModel{
+			Requested: anthropicReq.Model,
+			Upstream:  cwReq.ConversationState.CurrentMessage.UserInputMessage.ModelId,
+		},
+		// CodeWhisperer没有输出长度参数，max_tokens只用于stop_reason判断
+		MaxTokens: EffectiveParam{Requested: anthropicReq.MaxTokens, Note: paramNoteUpstreamUnsupported},
+		Tools: EffectiveTools{
+			Requested: len(anthropicReq.Tools),
+			Forwarded: len(cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools),
+		},
+		History: EffectiveHistory{
+			OriginalMessages: len(anthropicReq.Messages),
+			KeptMessages:     len(anthropicReq.Messages),
+			UpstreamEntries:  len(cwReq.ConversationState.History),
+		},
+	}
+
+	if aliases, _ := config.ModelAliases(); aliases[anthropicReq.Model] != "" {
+		params.Model.Alias = aliases[anthropicReq.Model]
+	}
+
+	if anthropicReq.Temperature != nil {
+		params.Temperature = &EffectiveParam{Requested: *anthropicReq.Temperature, Note: paramNoteUpstreamUnsupported}
+		if anthropicReq.DeterministicSampling() {
+			params.Temperature.Applied = true
+			params.Temperature.Note = paramNoteSystemInstruction
+		}
+	}
+	if anthropicReq.TopP != nil {
+		params.TopP = &EffectiveParam{Requested: *anthropicReq.TopP, Note: paramNoteUpstreamUnsupported}
+	}
+
+	if timeout := requestClientTimeout(c); timeout != nil {
+		params.Timeout = &EffectiveTimeout{
+			RequestedMs: timeout.RequestedMs,
+			AppliedMs:   timeout.Applied.Milliseconds(),
+			Scope:       clientTimeoutScopeOverall,
+		}
+		if anthropicReq.Stream {
+			params.Timeout.Scope = clientTimeoutScopeFirstToken
+		}
+	}
+
+	params.Profile = requestPromptProfile(c)
+
+	if original, ok := c.Get("original_message_count"); ok {
+		params.History.OriginalMessages = original.(int)
+		params.History.Trimmed = params.History.OriginalMessages != params.History.KeptMessages
+	}
+
+	return params, nil
+}
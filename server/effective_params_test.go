@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/converter"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEffectiveParamsTestRequest 构造带采样参数、web_search工具和多轮历史的请求
+func newEffectiveParamsTestRequest(stream bool) types.AnthropicRequest {
+	req := newToolTestRequest(stream, false)
+	temperature, topP := 0.0, 0.9
+	req.Temperature = &temperature
+	req.TopP = &topP
+	req.Tools = append(req.Tools, types.AnthropicTool{Name: "web_search", InputSchema: map[string]any{"type": "object"}})
+	req.Messages = []types.AnthropicRequestMessage{
+		{Role: "user", Content: "first question"},
+		{Role: "assistant", Content: "first answer"},
+		{Role: "user", Content: "second question"},
+		{Role: "assistant", Content: "second answer"},
+		{Role: "user", Content: "third question"},
+	}
+	return req
+}
+
+// upstreamPayload 解析假上游收到的请求体
+type upstreamPayload struct {
+	ConversationState struct {
+		CurrentMessage struct {
+			UserInputMessage struct {
+				ModelId                 string `json:"modelId"`
+				UserInputMessageContext struct {
+					Tools []any `json:"tools"`
+				} `json:"userInputMessageContext"`
+			} `json:"userInputMessage"`
+		} `json:"currentMessage"`
+		History []any `json:"history"`
+	} `json:"conversationState"`
+}
+
+func TestEffectiveParams_MatchesUpstreamRequest(t *testing.T) {
+	lastBody := newTwoToolsUpstream(t)
+	t.Setenv("MODEL_ALIASES", `{"my-model":"claude-sonnet-4-20250514"}`)
+	originalTrimmer := historyTrimmer
+	historyTrimmer = &HistoryTrimmer{Mode: HistoryTrimTurns, MaxTurns: 2}
+	t.Cleanup(func() { historyTrimmer = originalTrimmer })
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	c.Request.Header.Set("X-Kiro-Effective-Params", "true")
+	req := newEffectiveParamsTestRequest(false)
+	req.Model = "my-model"
+	handleNonStreamRequest(newTestScope(c, trimHistory(c, req)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var params EffectiveParams
+	require.NoError(t, json.Unmarshal([]byte(w.Header().Get("X-Kiro-Effective-Params")), &params))
+	var upstream upstreamPayload
+	require.NoError(t, json.Unmarshal([]byte(lastBody()), &upstream))
+
+	assert.Equal(t, "my-model", params.Model.Requested)
+	assert.Equal(t, "claude-sonnet-4-20250514", params.Model.Alias)
+	assert.Equal(t, upstream.ConversationState.CurrentMessage.UserInputMessage.ModelId, params.Model.Upstream)
+
+	assert.Equal(t, 3, params.Tools.Requested)
+	assert.Equal(t, len(upstream.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools), params.Tools.Forwarded)
+	assert.Equal(t, 2, params.Tools.Forwarded, "web_search应被过滤")
+
+	assert.Equal(t, EffectiveHistory{
+		OriginalMessages: 5,
+		KeptMessages:     3,
+		Trimmed:          true,
+		UpstreamEntries:  len(upstream.ConversationState.History),
+	}, params.History)
+
+	require.NotNil(t, params.Temperature)
+	assert.True(t, params.Temperature.Applied)
+	assert.Equal(t, paramNoteSystemInstruction, params.Temperature.Note)
+	assert.Contains(t, lastBody(), converter.DeterministicSamplingInstruction)
+
+	require.NotNil(t, params.TopP)
+	assert.False(t, params.TopP.Applied)
+	assert.Equal(t, paramNoteUpstreamUnsupported, params.TopP.Note)
+	assert.False(t, params.MaxTokens.Applied)
+
+	assert.NotContains(t, w.Body.String(), `"kiro"`, "仅请求响应头时不修改响应体")
+}
+
+func TestEffectiveParams_NotEmittedUnlessRequested(t *testing.T) {
+	lastBody := newTwoToolsUpstream(t)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	req := newEffectiveParamsTestRequest(false)
+	temperature := 0.7
+	req.Temperature = &temperature
+	handleNonStreamRequest(newTestScope(c, req))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Empty(t, w.Header().Get("X-Kiro-Effective-Params"))
+	assert.NotContains(t, w.Body.String(), `"kiro"`)
+	assert.NotContains(t, lastBody(), converter.DeterministicSamplingInstruction, "非0温度不转发确定性提示")
+}
+
+func TestEffectiveParams_Verbose(t *testing.T) {
+	newTwoToolsUpstream(t)
+
+	newVerboseContext := func(path string) (*gin.Context, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", path, nil)
+		c.Request.Header.Set("X-Kiro-Verbose", "true")
+		return c, w
+	}
+	token := types.TokenInfo{AccessToken: "mock-access-token"}
+
+	t.Run("anthropic non-stream", func(t *testing.T) {
+		c, w := newVerboseContext("/v1/messages")
+		handleNonStreamRequest(newRequestScope(c, newEffectiveParamsTestRequest(false), &types.TokenWithUsage{TokenInfo: token}))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			Kiro *EffectiveParams `json:"kiro"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.NotNil(t, resp.Kiro)
+		assert.Equal(t, 2, resp.Kiro.Tools.Forwarded)
+		assert.Empty(t, w.Header().Get("X-Kiro-Effective-Params"))
+	})
+
+	t.Run("openai non-stream", func(t *testing.T) {
+		c, w := newVerboseContext("/v1/chat/completions")
+		handleOpenAINonStreamRequest(newRequestScope(c, newEffectiveParamsTestRequest(false), &types.TokenWithUsage{TokenInfo: token}))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			Kiro *EffectiveParams `json:"kiro"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.NotNil(t, resp.Kiro)
+		assert.Equal(t, "claude-sonnet-4-20250514", resp.Kiro.Model.Requested)
+	})
+
+	t.Run("stream falls back to header", func(t *testing.T) {
+		c, w := newVerboseContext("/v1/messages")
+		handleStreamRequest(newRequestScope(c, newEffectiveParamsTestRequest(true), &types.TokenWithUsage{TokenInfo: token}))
+
+		var params EffectiveParams
+		require.NoError(t, json.Unmarshal([]byte(w.Header().Get("X-Kiro-Effective-Params")), &params))
+		assert.Equal(t, 3, params.Tools.Requested)
+		assert.False(t, strings.Contains(w.Body.String(), `"kiro"`))
+	})
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+)
+
+// emptyStreamRetry 上游流在message_start/ping之后没有产生任何内容时，是否换下一个token重试一次（默认关闭）
+var emptyStreamRetry = false
+
+// NewEmptyStreamRetryFromEnv 读取 EMPTY_STREAM_RETRY 环境变量，"true" 时启用
+func NewEmptyStreamRetryFromEnv() bool {
+	return strings.EqualFold(strings.TrimSpace(os.Getenv("EMPTY_STREAM_RETRY")), "true")
+}
+
+// nextTokenProvider 为同一请求换token重试提供下一个token（*auth.AuthService）
+type nextTokenProvider interface {
+	GetNextToken(current types.TokenInfo) (*types.TokenWithUsage, error)
+}
+
+// nextTokens 由 NewRouter 注入；为nil时不重试
+var nextTokens nextTokenProvider
+
+// isEmptyStream 上游流结束时客户端是否只收到了初始事件
+// initialSize为发送初始事件后的已写出字节数；异常事件、透传的未知块等任何下发都会改变写出字节数
+func (ctx *StreamProcessorContext) isEmptyStream(initialSize int) bool {
+	return ctx.sseStateManager.startedBlocks == 0 && !ctx.boundaryTruncated && ctx.c.Writer.Size() == initialSize
+}
+
+// retryEmptyStream 空流时换下一个token重新请求上游，成功时返回新的响应（调用方负责关闭）
+// 重试失败时上游错误已由executeCodeWhispererRequest写入响应，返回nil
+func retryEmptyStream(ctx *StreamProcessorContext) *http.Response {
+	scope, c := ctx.scope, ctx.c
+	if nextTokens == nil || scope.Token == nil {
+		return nil
+	}
+
+	next, err := nextTokens.GetNextToken(scope.Token.TokenInfo)
+	if err != nil {
+		logger.Warn("空流重试获取token失败", addReqFields(c, logger.Err(err))...)
+		return nil
+	}
+	logger.Warn("上游流没有产生内容，换token重试一次",
+		addReqFields(c, logger.Bool("same_token", next.TokenInfo.AccessToken == scope.Token.TokenInfo.AccessToken))...)
+
+	scope.switchToken(next)
+	setAccessLogAccount(c, next.TokenInfo, next.UserEmail)
+	ctx.outputTokenFactor = outputTokenFactor(next.TokenInfo)
+	ctx.compliantParser.Reset()
+
+	resp, err := execCWRequest(scope)
+	if err != nil {
+		logger.Warn("空流重试请求失败", addReqFields(c, logger.Err(err))...)
+		return nil
+	}
+	return resp
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNextTokens 记录被排除的token并返回固定的下一个token
+type fakeNextTokens struct {
+	excluded []string
+}
+
+func (f *fakeNextTokens) GetNextToken(current types.TokenInfo) (*types.TokenWithUsage, error) {
+	f.excluded = append(f.excluded, current.AccessToken)
+	return &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "next-access-token"}}, nil
+}
+
+// newEmptyThenTextUpstream 第一次请求返回空事件流，之后的请求返回文本；返回每次请求使用的Authorization头
+func newEmptyThenTextUpstream(t *testing.T) func() []string {
+	var mu sync.Mutex
+	var auths []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auths = append(auths, r.Header.Get("Authorization"))
+		first := len(auths) == 1
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+		if first {
+			return
+		}
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"Hello after retry"}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), auths...)
+	}
+}
+
+// withEmptyStreamRetry 开启空流重试并注入下一个token的提供者
+func withEmptyStreamRetry(t *testing.T, enabled bool) *fakeNextTokens {
+	provider := &fakeNextTokens{}
+	prevEnabled, prevTokens := emptyStreamRetry, nextTokens
+	emptyStreamRetry, nextTokens = enabled, provider
+	t.Cleanup(func() { emptyStreamRetry, nextTokens = prevEnabled, prevTokens })
+	return provider
+}
+
+func serveEmptyStreamTest(t *testing.T) string {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+	require.Equal(t, http.StatusOK, w.Code)
+	return w.Body.String()
+}
+
+func TestEmptyStreamRetry_RetriesWithNextToken(t *testing.T) {
+	upstreamAuths := newEmptyThenTextUpstream(t)
+	provider := withEmptyStreamRetry(t, true)
+
+	body := serveEmptyStreamTest(t)
+
+	// 客户端只看到一条完整的消息，内容来自重试
+	assert.Equal(t, 1, strings.Count(body, "event: message_start"), body)
+	assert.Equal(t, 1, strings.Count(body, "event: message_stop"), body)
+	assert.Contains(t, body, "Hello after retry")
+	assert.Contains(t, body, `"stop_reason":"end_turn"`)
+
+	// 重试排除了首次使用的token，换用下一个token请求上游
+	assert.Equal(t, []string{"mock-access-token"}, provider.excluded)
+	auths := upstreamAuths()
+	require.Len(t, auths, 2)
+	assert.Contains(t, auths[0], "mock-access-token")
+	assert.Contains(t, auths[1], "next-access-token")
+}
+
+func TestEmptyStreamRetry_Disabled(t *testing.T) {
+	upstreamAuths := newEmptyThenTextUpstream(t)
+	provider := withEmptyStreamRetry(t, false)
+
+	body := serveEmptyStreamTest(t)
+
+	assert.NotContains(t, body, "Hello after retry")
+	assert.Equal(t, 1, strings.Count(body, "event: message_stop"), body)
+	assert.Empty(t, provider.excluded)
+	assert.Len(t, upstreamAuths(), 1)
+}
+
+func TestEmptyStreamRetry_NotAfterContent(t *testing.T) {
+	newTextDeltaUpstream(t, "Hello")
+	provider := withEmptyStreamRetry(t, true)
+
+	body := serveEmptyStreamTest(t)
+
+	assert.Contains(t, body, "Hello")
+	assert.Empty(t, provider.excluded, "已下发内容的流不重试")
+}
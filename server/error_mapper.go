@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"kiro2api/logger"
@@ -26,6 +27,7 @@ type ClaudeErrorResponse struct {
 type CodeWhispererErrorBody struct {
 	Message string `json:"message"`
 	Reason  string `json:"reason"`
+	Type    string `json:"__type"` // AWS异常类型，如 ThrottlingException
 }
 
 // ContentLengthExceedsStrategy 内容长度超限错误映射策略 (SRP原则)
@@ -57,6 +59,57 @@ func (s *ContentLengthExceedsStrategy) GetErrorType() string {
 	return "content_length_exceeds"
 }
 
+// overloadedReasons 表示上游容量不足的reason值
+var overloadedReasons = map[string]bool{
+	"INSUFFICIENT_MODEL_CAPACITY":   true,
+	"MODEL_TEMPORARILY_UNAVAILABLE": true,
+}
+
+// OverloadedErrorStrategy 上游过载/限流错误映射策略
+// 映射为Anthropic的overloaded_error（529），使客户端退避重试
+type OverloadedErrorStrategy struct{}
+
+func (s *OverloadedErrorStrategy) MapError(statusCode int, responseBody []byte) (*ClaudeErrorResponse, bool) {
+	if !isOverloadedError(statusCode, responseBody) {
+		return nil, false
+	}
+
+	message := "Upstream is overloaded, please retry later"
+	var errorBody CodeWhispererErrorBody
+	if err := json.Unmarshal(responseBody, &errorBody); err == nil && errorBody.Message != "" {
+		message = errorBody.Message
+	}
+
+	return &ClaudeErrorResponse{
+		Type:    "overloaded_error",
+		Message: message,
+	}, true
+}
+
+func (s *OverloadedErrorStrategy) GetErrorType() string {
+	return "overloaded"
+}
+
+// isOverloadedError 判断上游错误是否为过载/限流
+// 503一律视为过载；429只有携带限流标识时才算（额度耗尽同样返回429，但不应退避重试）
+func isOverloadedError(statusCode int, responseBody []byte) bool {
+	if statusCode == http.StatusServiceUnavailable {
+		return true
+	}
+
+	var errorBody CodeWhispererErrorBody
+	if err := json.Unmarshal(responseBody, &errorBody); err == nil && overloadedReasons[errorBody.Reason] {
+		return true
+	}
+
+	if statusCode == http.StatusTooManyRequests {
+		return strings.Contains(errorBody.Type, "ThrottlingException") ||
+			strings.Contains(string(responseBody), "ThrottlingException")
+	}
+
+	return false
+}
+
 // DefaultErrorStrategy 默认错误映射策略 (YAGNI原则)
 type DefaultErrorStrategy struct{}
 
@@ -81,6 +134,8 @@ func NewErrorMapper() *ErrorMapper {
 	return &ErrorMapper{
 		strategies: []ErrorMappingStrategy{
 			&ContentLengthExceedsStrategy{}, // 优先处理特定错误
+			&OverloadedErrorStrategy{},      // 上游过载/限流
+			&UpstreamRequestErrorStrategy{}, // 上游拒绝请求（400类）
 			&DefaultErrorStrategy{},         // 默认处理器
 		},
 	}
@@ -156,11 +156,13 @@ func TestNewErrorMapper(t *testing.T) {
 
 	assert.NotNil(t, mapper)
 	assert.NotNil(t, mapper.strategies)
-	assert.Len(t, mapper.strategies, 2, "应该有2个策略")
+	assert.Len(t, mapper.strategies, 4, "应该有4个策略")
 
 	// 验证策略顺序
 	assert.IsType(t, &ContentLengthExceedsStrategy{}, mapper.strategies[0], "第一个应该是ContentLengthExceedsStrategy")
-	assert.IsType(t, &DefaultErrorStrategy{}, mapper.strategies[1], "第二个应该是DefaultErrorStrategy")
+	assert.IsType(t, &OverloadedErrorStrategy{}, mapper.strategies[1], "第二个应该是OverloadedErrorStrategy")
+	assert.IsType(t, &UpstreamRequestErrorStrategy{}, mapper.strategies[2], "第三个应该是UpstreamRequestErrorStrategy")
+	assert.IsType(t, &DefaultErrorStrategy{}, mapper.strategies[3], "第四个应该是DefaultErrorStrategy")
 }
 
 // TestErrorMapper_MapCodeWhispererError 测试映射CodeWhisperer错误
@@ -195,9 +197,36 @@ func TestErrorMapper_MapCodeWhispererError(t *testing.T) {
 			description:         "应该使用默认策略",
 		},
 		{
-			name:                "未知错误",
+			name:                "上游限流错误",
+			statusCode:          http.StatusTooManyRequests,
+			responseBody:        []byte(`{"__type": "com.amazon.aws.codewhisperer#ThrottlingException", "message": "I am experiencing high traffic"}`),
+			wantType:            "overloaded_error",
+			wantStopReason:      "",
+			wantMessageContains: "high traffic",
+			description:         "限流应该映射为overloaded_error",
+		},
+		{
+			name:                "额度耗尽的429",
+			statusCode:          http.StatusTooManyRequests,
+			responseBody:        []byte(`{"message": "You have reached the limit", "reason": "MONTHLY_REQUEST_COUNT"}`),
+			wantType:            "error",
+			wantStopReason:      "",
+			wantMessageContains: "Upstream error",
+			description:         "额度耗尽不是过载",
+		},
+		{
+			name:                "未知的400错误",
 			statusCode:          http.StatusBadRequest,
 			responseBody:        []byte(`{"reason": "UNKNOWN"}`),
+			wantType:            "invalid_request_error",
+			wantStopReason:      "",
+			wantMessageContains: "Upstream rejected the request: UNKNOWN",
+			description:         "400类错误映射为invalid_request_error",
+		},
+		{
+			name:                "未知状态码",
+			statusCode:          http.StatusBadGateway,
+			responseBody:        []byte(`{"reason": "UNKNOWN"}`),
 			wantType:            "error",
 			wantStopReason:      "",
 			wantMessageContains: "Upstream error",
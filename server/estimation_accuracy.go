@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+
+	"kiro2api/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// estimationSample 一次请求的估算token与上游报告的token，未报告的一项为0
+type estimationSample struct {
+	estimatedInput  int
+	estimatedOutput int
+	reportedInput   int
+	reportedOutput  int
+}
+
+// EstimationErrorStats 估算误差统计，误差为 (估算 - 上游报告) / 上游报告 * 100
+type EstimationErrorStats struct {
+	Samples             int     `json:"samples"`
+	MeanErrorPercent    float64 `json:"mean_error_percent"`     // 带符号，正数表示高估
+	MeanAbsErrorPercent float64 `json:"mean_abs_error_percent"` // 绝对误差的均值
+	P50AbsErrorPercent  float64 `json:"p50_abs_error_percent"`
+	P90AbsErrorPercent  float64 `json:"p90_abs_error_percent"`
+	P99AbsErrorPercent  float64 `json:"p99_abs_error_percent"`
+}
+
+// ModelEstimationAccuracy 单个模型输入和输出token的估算误差
+type ModelEstimationAccuracy struct {
+	Input  EstimationErrorStats `json:"input"`
+	Output EstimationErrorStats `json:"output"`
+}
+
+// EstimationAccuracy 按模型保留最近的估算样本，用于校准TokenEstimator
+type EstimationAccuracy struct {
+	mutex   sync.Mutex
+	size    int
+	samples map[string][]estimationSample
+	next    map[string]int // 样本已满时下一个覆盖的位置
+}
+
+// NewEstimationAccuracy 创建每个模型保留size个样本的统计
+func NewEstimationAccuracy(size int) *EstimationAccuracy {
+	if size <= 0 {
+		size = config.EstimationAccuracySamples
+	}
+	return &EstimationAccuracy{
+		size:    size,
+		samples: make(map[string][]estimationSample),
+		next:    make(map[string]int),
+	}
+}
+
+// estimationAccuracy 全局估算准确度统计
+var estimationAccuracy = NewEstimationAccuracy(config.EstimationAccuracySamples)
+
+// Record 记录一个样本；上游没有报告任何token数时忽略
+func (a *EstimationAccuracy) Record(model string, estimatedInput, estimatedOutput, reportedInput, reportedOutput int) {
+	if reportedInput <= 0 && reportedOutput <= 0 {
+		return
+	}
+	sample := estimationSample{
+		estimatedInput:  estimatedInput,
+		estimatedOutput: estimatedOutput,
+		reportedInput:   max(reportedInput, 0),
+		reportedOutput:  max(reportedOutput, 0),
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if samples := a.samples[model]; len(samples) < a.size {
+		a.samples[model] = append(samples, sample)
+		return
+	}
+	a.samples[model][a.next[model]] = sample
+	a.next[model] = (a.next[model] + 1) % a.size
+}
+
+// Report 按模型统计输入和输出token的估算误差
+func (a *EstimationAccuracy) Report() map[string]ModelEstimationAccuracy {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	report := make(map[string]ModelEstimationAccuracy, len(a.samples))
+	for model, samples := range a.samples {
+		var inputErrors, outputErrors []float64
+		for _, sample := range samples {
+			if sample.reportedInput > 0 {
+				inputErrors = append(inputErrors, errorPercent(sample.estimatedInput, sample.reportedInput))
+			}
+			if sample.reportedOutput > 0 {
+				outputErrors = append(outputErrors, errorPercent(sample.estimatedOutput, sample.reportedOutput))
+			}
+		}
+		report[model] = ModelEstimationAccuracy{
+			Input:  summarizeEstimationErrors(inputErrors),
+			Output: summarizeEstimationErrors(outputErrors),
+		}
+	}
+	return report
+}
+
+// errorPercent 估算值相对上游报告值的误差百分比
+func errorPercent(estimated, reported int) float64 {
+	return float64(estimated-reported) / float64(reported) * 100
+}
+
+// summarizeEstimationErrors 计算误差的均值和绝对误差的分位数（最近秩法）
+func summarizeEstimationErrors(values []float64) EstimationErrorStats {
+	if len(values) == 0 {
+		return EstimationErrorStats{}
+	}
+
+	var sum, absSum float64
+	absErrors := make([]float64, len(values))
+	for i, e := range values {
+		sum += e
+		absErrors[i] = math.Abs(e)
+		absSum += absErrors[i]
+	}
+	sort.Float64s(absErrors)
+
+	n := float64(len(values))
+	return EstimationErrorStats{
+		Samples:             len(values),
+		MeanErrorPercent:    roundPercent(sum / n),
+		MeanAbsErrorPercent: roundPercent(absSum / n),
+		P50AbsErrorPercent:  roundPercent(percentile(absErrors, 50)),
+		P90AbsErrorPercent:  roundPercent(percentile(absErrors, 90)),
+		P99AbsErrorPercent:  roundPercent(percentile(absErrors, 99)),
+	}
+}
+
+// percentile 已排序数据的p分位数（最近秩法）
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+// roundPercent 保留两位小数
+func roundPercent(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// reportedTokenKeys 上游事件中表示token数的字段
+var reportedTokenKeys = struct {
+	input  []string
+	output []string
+}{
+	input:  []string{"inputTokens", "input_tokens"},
+	output: []string{"outputTokens", "output_tokens"},
+}
+
+// reportedTokenUsage 从上游的未知事件（如元数据/计量事件）中提取上游报告的token数
+// 字段可能位于顶层或嵌套在usage、tokenUsage等对象中；没有找到时ok为false
+func reportedTokenUsage(raw any) (inputTokens, outputTokens int, ok bool) {
+	fields, isMap := raw.(map[string]any)
+	if !isMap {
+		return 0, 0, false
+	}
+	inputTokens, foundInput := tokenField(fields, reportedTokenKeys.input)
+	outputTokens, foundOutput := tokenField(fields, reportedTokenKeys.output)
+	if foundInput || foundOutput {
+		return inputTokens, outputTokens, true
+	}
+	for _, value := range fields {
+		if inputTokens, outputTokens, ok = reportedTokenUsage(value); ok {
+			return inputTokens, outputTokens, true
+		}
+	}
+	return 0, 0, false
+}
+
+// tokenField 读取第一个存在的数值字段
+func tokenField(fields map[string]any, keys []string) (int, bool) {
+	for _, key := range keys {
+		switch v := fields[key].(type) {
+		case float64:
+			return int(v), true
+		case int:
+			return v, true
+		case int64:
+			return int(v), true
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				return int(n), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// recordReportedUsage 上游未知事件中带有token数时记入请求范围，请求结束时作为估算准确度样本
+func recordReportedUsage(c *gin.Context, raw any) {
+	scope := requestScopeFrom(c)
+	if scope == nil {
+		return
+	}
+	if inputTokens, outputTokens, ok := reportedTokenUsage(raw); ok {
+		if inputTokens > 0 {
+			scope.ReportedInputTokens = inputTokens
+		}
+		if outputTokens > 0 {
+			scope.ReportedOutputTokens = outputTokens
+		}
+	}
+}
+
+// handleEstimationAccuracy GET /api/tokens/estimation-accuracy
+// 按模型返回估算token相对上游报告值的误差，只统计上游报告了token数的请求
+func handleEstimationAccuracy(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"samples_per_model": estimationAccuracy.size,
+		"models":            estimationAccuracy.Report(),
+	})
+}
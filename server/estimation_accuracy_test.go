@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimationAccuracy_Report(t *testing.T) {
+	a := NewEstimationAccuracy(100)
+	a.Record("claude-sonnet-4", 110, 50, 100, 40) // 输入+10%，输出+25%
+	a.Record("claude-sonnet-4", 90, 30, 100, 0)   // 输入-10%，未报告输出
+	a.Record("claude-sonnet-4", 130, 0, 100, 0)   // 输入+30%
+	a.Record("claude-sonnet-4", 100, 0, 100, 0)   // 输入0%
+	a.Record("claude-sonnet-4", 100, 100, 0, 0)   // 上游没有报告，忽略
+
+	report := a.Report()
+	require.Contains(t, report, "claude-sonnet-4")
+	assert.Equal(t, EstimationErrorStats{
+		Samples:             4,
+		MeanErrorPercent:    7.5,
+		MeanAbsErrorPercent: 12.5,
+		P50AbsErrorPercent:  10,
+		P90AbsErrorPercent:  30,
+		P99AbsErrorPercent:  30,
+	}, report["claude-sonnet-4"].Input)
+	assert.Equal(t, EstimationErrorStats{
+		Samples:             1,
+		MeanErrorPercent:    25,
+		MeanAbsErrorPercent: 25,
+		P50AbsErrorPercent:  25,
+		P90AbsErrorPercent:  25,
+		P99AbsErrorPercent:  25,
+	}, report["claude-sonnet-4"].Output)
+}
+
+func TestEstimationAccuracy_KeepsRecentSamples(t *testing.T) {
+	a := NewEstimationAccuracy(2)
+	a.Record("m", 200, 0, 100, 0) // +100%，被覆盖
+	a.Record("m", 110, 0, 100, 0)
+	a.Record("m", 90, 0, 100, 0)
+
+	input := a.Report()["m"].Input
+	assert.Equal(t, 2, input.Samples)
+	assert.Equal(t, 0.0, input.MeanErrorPercent)
+	assert.Equal(t, 10.0, input.P99AbsErrorPercent)
+}
+
+func TestReportedTokenUsage(t *testing.T) {
+	input, output, ok := reportedTokenUsage(map[string]any{"tokenUsage": map[string]any{"inputTokens": 1200.0, "outputTokens": 80.0}})
+	assert.True(t, ok)
+	assert.Equal(t, 1200, input)
+	assert.Equal(t, 80, output)
+
+	input, output, ok = reportedTokenUsage(map[string]any{"input_tokens": json.Number("42")})
+	assert.True(t, ok)
+	assert.Equal(t, 42, input)
+	assert.Zero(t, output)
+
+	_, _, ok = reportedTokenUsage(map[string]any{"citations": []any{}})
+	assert.False(t, ok)
+	_, _, ok = reportedTokenUsage("not json")
+	assert.False(t, ok)
+}
+
+func TestEstimationAccuracy_FromUpstreamMetadata(t *testing.T) {
+	original := estimationAccuracy
+	estimationAccuracy = NewEstimationAccuracy(10)
+	t.Cleanup(func() { estimationAccuracy = original })
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"Hello world"}`))
+		_, _ = w.Write(encodeTestEventStreamFrameWithHeaders([][2]string{
+			{":message-type", "event"},
+			{":event-type", "metadataEvent"},
+		}, `{"tokenUsage":{"inputTokens":20,"outputTokens":4}}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+
+	// Anthropic与OpenAI端点的流式和非流式响应都计入样本
+	handlers := []struct {
+		path   string
+		stream bool
+		handle func(*RequestScope)
+	}{
+		{"/v1/messages", true, handleStreamRequest},
+		{"/v1/messages", false, handleNonStreamRequest},
+		{"/v1/chat/completions", true, handleOpenAIStreamRequest},
+		{"/v1/chat/completions", false, handleOpenAINonStreamRequest},
+	}
+	for _, h := range handlers {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", h.path, nil)
+		scope := newTestScope(c, newStopTestRequest(h.stream))
+		h.handle(scope)
+		require.Equal(t, http.StatusOK, w.Code, "%s stream=%v", h.path, h.stream)
+		assert.Equal(t, 20, scope.ReportedInputTokens, "%s stream=%v", h.path, h.stream)
+		assert.Equal(t, 4, scope.ReportedOutputTokens, "%s stream=%v", h.path, h.stream)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/api/tokens/estimation-accuracy", nil)
+	handleEstimationAccuracy(c)
+
+	var resp struct {
+		SamplesPerModel int                                `json:"samples_per_model"`
+		Models          map[string]ModelEstimationAccuracy `json:"models"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 10, resp.SamplesPerModel)
+	model := resp.Models["claude-sonnet-4-20250514"]
+	assert.Equal(t, len(handlers), model.Input.Samples)
+	assert.Equal(t, len(handlers), model.Output.Samples)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+
+	"kiro2api/config"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// beginExport 写出导出响应的头部，返回false表示无需写出响应体（HEAD请求）
+// 导出不设置Content-Length，按行编码并分块传输；不支持Range，始终返回完整的200响应，
+// 并声明Accept-Ranges: none，避免下载工具尝试分段续传
+func beginExport(c *gin.Context, contentType, filename string) bool {
+	c.Header("Accept-Ranges", "none")
+	c.Header("Content-Type", contentType)
+	if filename != "" {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	}
+	c.Status(http.StatusOK)
+	if c.Request.Method == http.MethodHead {
+		c.Writer.WriteHeaderNow()
+		return false
+	}
+	return true
+}
+
+// exportFlusher 每ExportFlushRows行Flush一次，buffer为编码器自身的缓冲（如csv.Writer），先于连接Flush
+type exportFlusher struct {
+	w      io.Writer
+	buffer *csv.Writer
+	rows   int
+}
+
+func (f *exportFlusher) row() {
+	f.rows++
+	if f.rows%config.ExportFlushRows == 0 {
+		f.flush()
+	}
+}
+
+func (f *exportFlusher) flush() {
+	if f.buffer != nil {
+		f.buffer.Flush()
+	}
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// streamJSONExport 流式写出 {<meta字段>, "<field>": [rows...]}
+// meta整体编码一次，rows逐个编码，内存占用与导出行数无关
+func streamJSONExport[T any](w io.Writer, meta gin.H, field string, rows iter.Seq[T]) error {
+	head := []byte("{")
+	if len(meta) > 0 {
+		encoded, err := utils.SafeMarshal(meta)
+		if err != nil {
+			return err
+		}
+		head = append(bytes.TrimSuffix(encoded, []byte("}")), ',')
+	}
+	name, _ := utils.SafeMarshal(field)
+	head = append(append(head, name...), ":["...)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+
+	flusher := &exportFlusher{w: w}
+	encoder := json.NewEncoder(w)
+	for row := range rows {
+		if flusher.rows > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+		flusher.row()
+	}
+	if _, err := io.WriteString(w, "]}"); err != nil {
+		return err
+	}
+	flusher.flush()
+	return nil
+}
+
+// streamCSVExport 流式写出CSV，逗号、引号和换行由encoding/csv负责转义
+func streamCSVExport(w io.Writer, columns []string, records iter.Seq[[]string]) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(columns); err != nil {
+		return err
+	}
+
+	flusher := &exportFlusher{w: w, buffer: writer}
+	for record := range records {
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+		flusher.row()
+	}
+	flusher.flush()
+	return writer.Error()
+}
@@ -0,0 +1,391 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrFairQueueTimeout 请求在准入队列中等待超过上限
+var ErrFairQueueTimeout = errors.New("fair queue wait timeout")
+
+// fairQueuePaths 需要经过准入队列的路由（会占用上游token的请求）
+var fairQueuePaths = map[string]bool{
+	"/v1/messages":         true,
+	"/v1/chat/completions": true,
+}
+
+// FairQueue 准入点的加权公平队列：并发名额用完时请求按客户端密钥排队，
+// 名额释放后以差额轮询（deficit round robin）按权重在各密钥之间分配，而不是先到先得，
+// 避免单个密钥的突发请求占满名额、饿死其他调用方
+type FairQueue struct {
+	mutex         sync.Mutex
+	maxConcurrent int
+	timeout       time.Duration      // 排队等待上限
+	weights       map[string]float64 // 客户端密钥 -> 权重，未配置的密钥为1
+	active        int
+	keys          map[string]*fairKey
+	ring          []*fairKey // 有请求排队的密钥，按轮询顺序
+	cursor        int        // ring中当前轮到的密钥
+}
+
+// fairKey 单个客户端密钥的队列与统计，由FairQueue.mutex保护
+type fairKey struct {
+	key      string
+	weight   float64
+	deficit  float64 // 本轮剩余可放行的请求数，未用完的部分留到下一轮
+	waiting  []*fairWaiter
+	active   int
+	admitted int64
+	timedOut int64
+	waits    []time.Duration // 最近的排队等待时间（环形）
+	nextWait int
+}
+
+// fairWaiter 排队中的请求，获得名额时关闭ready
+type fairWaiter struct {
+	ready    chan struct{}
+	enqueued time.Time
+	waited   time.Duration // 关闭ready前写入
+}
+
+// fairQueue 为nil时不排队
+var fairQueue *FairQueue
+
+// NewFairQueue 创建加权公平队列，maxConcurrent<=0时返回nil
+func NewFairQueue(maxConcurrent int, timeout time.Duration, weights map[string]float64) *FairQueue {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = config.DefaultFairQueueTimeout
+	}
+	return &FairQueue{
+		maxConcurrent: maxConcurrent,
+		timeout:       timeout,
+		weights:       weights,
+		keys:          make(map[string]*fairKey),
+	}
+}
+
+// NewFairQueueFromEnv 根据环境变量创建加权公平队列
+// FAIR_QUEUE_MAX_CONCURRENT: 同时转发到上游的请求上限，超出的请求排队（默认0，不排队）
+// FAIR_QUEUE_KEY_WEIGHTS: JSON对象，客户端密钥 -> 权重（默认1），排队时按权重比例放行
+// FAIR_QUEUE_TIMEOUT: 排队等待上限（秒数或Go时长，默认60s），超过后返回503
+func NewFairQueueFromEnv() *FairQueue {
+	maxConcurrent := connectionLimitFromEnv("FAIR_QUEUE_MAX_CONCURRENT")
+	if maxConcurrent <= 0 {
+		return nil
+	}
+
+	timeout := config.DefaultFairQueueTimeout
+	if value := strings.TrimSpace(os.Getenv("FAIR_QUEUE_TIMEOUT")); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			timeout = time.Duration(seconds) * time.Second
+		} else if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			timeout = parsed
+		} else {
+			logger.Warn("FAIR_QUEUE_TIMEOUT无效，使用默认值", logger.String("value", value))
+		}
+	}
+
+	var weights map[string]float64
+	if value := strings.TrimSpace(os.Getenv("FAIR_QUEUE_KEY_WEIGHTS")); value != "" {
+		if err := utils.SafeUnmarshal([]byte(value), &weights); err != nil {
+			logger.Warn("FAIR_QUEUE_KEY_WEIGHTS无效，忽略", logger.Err(err))
+			weights = nil
+		}
+		for key, weight := range weights {
+			if weight <= 0 {
+				logger.Warn("忽略无效的客户端权重",
+					logger.String("client_key", maskClientKey(key)),
+					logger.Float64("weight", weight))
+				delete(weights, key)
+			}
+		}
+	}
+
+	logger.Info("已启用客户端加权公平排队",
+		logger.Int("max_concurrent", maxConcurrent),
+		logger.Duration("timeout", timeout),
+		logger.Int("key_weights", len(weights)))
+	return NewFairQueue(maxConcurrent, timeout, weights)
+}
+
+// Acquire 为客户端密钥占用一个并发名额，名额已满时排队等待
+// 成功时返回释放函数和排队等待时间；ctx结束或等待超过上限时返回错误
+func (q *FairQueue) Acquire(ctx context.Context, key string) (func(), time.Duration, error) {
+	q.mutex.Lock()
+	k := q.keyUnlocked(key)
+	// 已有请求排队时新请求也要排队，不能插队
+	if q.active < q.maxConcurrent && len(q.ring) == 0 {
+		q.admitUnlocked(k, 0)
+		q.mutex.Unlock()
+		return q.releaseFunc(k), 0, nil
+	}
+	waiter := &fairWaiter{ready: make(chan struct{}), enqueued: time.Now()}
+	if len(k.waiting) == 0 {
+		q.ring = append(q.ring, k)
+	}
+	k.waiting = append(k.waiting, waiter)
+	q.mutex.Unlock()
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-waiter.ready:
+		return q.releaseFunc(k), waiter.waited, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = ErrFairQueueTimeout
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	select {
+	case <-waiter.ready:
+		// 放弃等待的同时已分配到名额，按成功处理
+		return q.releaseFunc(k), waiter.waited, nil
+	default:
+	}
+	q.removeWaiterUnlocked(k, waiter)
+	if errors.Is(err, ErrFairQueueTimeout) {
+		k.timedOut++
+	}
+	return nil, 0, err
+}
+
+// keyUnlocked 获取或创建密钥的状态
+// 内部方法：调用者必须持有 q.mutex
+func (q *FairQueue) keyUnlocked(key string) *fairKey {
+	k, ok := q.keys[key]
+	if !ok {
+		weight := 1.0
+		if w, configured := q.weights[key]; configured {
+			weight = w
+		}
+		k = &fairKey{key: key, weight: weight}
+		q.keys[key] = k
+	}
+	return k
+}
+
+// admitUnlocked 占用名额并记录排队等待时间
+// 内部方法：调用者必须持有 q.mutex
+func (q *FairQueue) admitUnlocked(k *fairKey, wait time.Duration) {
+	q.active++
+	k.active++
+	k.admitted++
+	if len(k.waits) < config.FairQueueWaitSamples {
+		k.waits = append(k.waits, wait)
+		return
+	}
+	k.waits[k.nextWait] = wait
+	k.nextWait = (k.nextWait + 1) % len(k.waits)
+}
+
+// releaseFunc 返回只生效一次的释放函数，释放后把名额分配给排队的请求
+func (q *FairQueue) releaseFunc(k *fairKey) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mutex.Lock()
+			defer q.mutex.Unlock()
+			q.active--
+			k.active--
+			q.dispatchUnlocked()
+		})
+	}
+}
+
+// dispatchUnlocked 按差额轮询把空闲名额分配给排队的请求：
+// 轮到某个密钥时补充等于权重的额度，额度每满1放行一个请求，不足1时轮到下一个密钥，
+// 因此各密钥的放行数量与权重成正比，且权重小于1的密钥也会在累积若干轮后得到名额
+// 内部方法：调用者必须持有 q.mutex
+func (q *FairQueue) dispatchUnlocked() {
+	for q.active < q.maxConcurrent && len(q.ring) > 0 {
+		k := q.ring[q.cursor]
+		if k.deficit < 1 {
+			k.deficit += k.weight
+			if k.deficit < 1 {
+				q.cursor = (q.cursor + 1) % len(q.ring)
+				continue
+			}
+		}
+
+		waiter := k.waiting[0]
+		k.waiting = k.waiting[1:]
+		k.deficit--
+		waiter.waited = time.Since(waiter.enqueued)
+		q.admitUnlocked(k, waiter.waited)
+		close(waiter.ready)
+
+		switch {
+		case len(k.waiting) == 0:
+			q.leaveRingUnlocked(q.cursor)
+		case k.deficit < 1:
+			q.cursor = (q.cursor + 1) % len(q.ring)
+		}
+	}
+}
+
+// removeWaiterUnlocked 移除放弃等待的请求，密钥的队列为空时退出轮询
+// 内部方法：调用者必须持有 q.mutex
+func (q *FairQueue) removeWaiterUnlocked(k *fairKey, waiter *fairWaiter) {
+	if i := slices.Index(k.waiting, waiter); i >= 0 {
+		k.waiting = slices.Delete(k.waiting, i, i+1)
+	}
+	if len(k.waiting) > 0 {
+		return
+	}
+	if i := slices.Index(q.ring, k); i >= 0 {
+		if i < q.cursor {
+			q.cursor--
+		}
+		q.leaveRingUnlocked(i)
+	}
+}
+
+// leaveRingUnlocked 把队列已空的密钥移出轮询，未用完的额度不保留（空闲的密钥不能积攒额度）
+// 内部方法：调用者必须持有 q.mutex
+func (q *FairQueue) leaveRingUnlocked(i int) {
+	q.ring[i].deficit = 0
+	q.ring = slices.Delete(q.ring, i, i+1)
+	if q.cursor >= len(q.ring) {
+		q.cursor = 0
+	}
+}
+
+// KeyQueueStats 单个客户端密钥的排队统计（/api/keys/usage）
+type KeyQueueStats struct {
+	Key      string         `json:"key"` // 已脱敏
+	Weight   float64        `json:"weight"`
+	Active   int            `json:"active"`
+	Queued   int            `json:"queued"`
+	Admitted int64          `json:"admitted"`
+	TimedOut int64          `json:"timed_out"`
+	Wait     QueueWaitStats `json:"wait"`
+}
+
+// QueueWaitStats 最近排队等待时间的分位数（毫秒），未排队直接放行的请求计为0
+type QueueWaitStats struct {
+	Samples int     `json:"samples"`
+	MeanMs  float64 `json:"mean_ms"`
+	P50Ms   float64 `json:"p50_ms"`
+	P90Ms   float64 `json:"p90_ms"`
+	P99Ms   float64 `json:"p99_ms"`
+}
+
+// FairQueueSnapshot 准入队列的整体状态（/api/keys/usage）
+type FairQueueSnapshot struct {
+	Enabled        bool            `json:"enabled"`
+	MaxConcurrent  int             `json:"max_concurrent"`
+	Active         int             `json:"active"`
+	Queued         int             `json:"queued"`
+	TimeoutSeconds float64         `json:"timeout_seconds"`
+	Keys           []KeyQueueStats `json:"keys"`
+}
+
+// Snapshot 返回队列状态和各密钥的排队统计，按密钥（脱敏后）排序
+func (q *FairQueue) Snapshot() FairQueueSnapshot {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	snapshot := FairQueueSnapshot{
+		Enabled:        true,
+		MaxConcurrent:  q.maxConcurrent,
+		Active:         q.active,
+		TimeoutSeconds: q.timeout.Seconds(),
+		Keys:           make([]KeyQueueStats, 0, len(q.keys)),
+	}
+	for _, k := range q.keys {
+		snapshot.Queued += len(k.waiting)
+		snapshot.Keys = append(snapshot.Keys, KeyQueueStats{
+			Key:      maskClientKey(k.key),
+			Weight:   k.weight,
+			Active:   k.active,
+			Queued:   len(k.waiting),
+			Admitted: k.admitted,
+			TimedOut: k.timedOut,
+			Wait:     summarizeQueueWaits(k.waits),
+		})
+	}
+	sort.Slice(snapshot.Keys, func(i, j int) bool { return snapshot.Keys[i].Key < snapshot.Keys[j].Key })
+	return snapshot
+}
+
+// summarizeQueueWaits 计算等待时间的均值和分位数（最近秩法）
+func summarizeQueueWaits(waits []time.Duration) QueueWaitStats {
+	if len(waits) == 0 {
+		return QueueWaitStats{}
+	}
+	millis := make([]float64, len(waits))
+	var sum float64
+	for i, wait := range waits {
+		millis[i] = float64(wait) / float64(time.Millisecond)
+		sum += millis[i]
+	}
+	sort.Float64s(millis)
+	return QueueWaitStats{
+		Samples: len(millis),
+		MeanMs:  roundPercent(sum / float64(len(millis))),
+		P50Ms:   roundPercent(percentile(millis, 50)),
+		P90Ms:   roundPercent(percentile(millis, 90)),
+		P99Ms:   roundPercent(percentile(millis, 99)),
+	}
+}
+
+// FairQueueMiddleware 在转发到上游前按客户端密钥公平排队，等待超时返回503
+// 客户端在排队期间断开时直接结束请求
+func FairQueueMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		queue := fairQueue
+		if queue == nil || !fairQueuePaths[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		release, wait, err := queue.Acquire(c.Request.Context(), extractAPIKey(c))
+		if err != nil {
+			if errors.Is(err, ErrFairQueueTimeout) {
+				logger.Warn("请求排队超时，拒绝请求",
+					addReqFields(c, logger.Duration("timeout", queue.timeout))...)
+				respondErrorWithCode(c, http.StatusServiceUnavailable, "overloaded", "%s", "服务器繁忙，请稍后重试")
+			}
+			c.Abort()
+			return
+		}
+		defer release()
+		if wait > 0 {
+			logger.Debug("请求排队后放行", addReqFields(c, logger.Duration("wait", wait))...)
+		}
+
+		c.Next()
+	}
+}
+
+// handleKeysUsage GET /api/keys/usage
+// 返回各客户端密钥的权重、并发、排队数和排队等待时间分位数；未启用公平排队时enabled为false
+func handleKeysUsage(c *gin.Context) {
+	queue := fairQueue
+	if queue == nil {
+		c.JSON(http.StatusOK, FairQueueSnapshot{Keys: []KeyQueueStats{}})
+		return
+	}
+	c.JSON(http.StatusOK, queue.Snapshot())
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withFairQueue 替换全局公平队列
+func withFairQueue(t *testing.T, q *FairQueue) {
+	original := fairQueue
+	fairQueue = q
+	t.Cleanup(func() { fairQueue = original })
+}
+
+// admitBursts 占住全部名额后让各密钥同时提交一批请求，全部排队后放开名额，返回放行顺序
+func admitBursts(t *testing.T, q *FairQueue, bursts map[string]int) []string {
+	t.Helper()
+	var holders []func()
+	for range q.maxConcurrent {
+		release, _, err := q.Acquire(context.Background(), "holder")
+		require.NoError(t, err)
+		holders = append(holders, release)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	total := 0
+	for key, n := range bursts {
+		total += n
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, _, err := q.Acquire(context.Background(), key)
+				if !assert.NoError(t, err) {
+					return
+				}
+				mu.Lock()
+				order = append(order, key)
+				mu.Unlock()
+				release()
+			}()
+		}
+	}
+	require.Eventually(t, func() bool { return q.Snapshot().Queued == total }, 5*time.Second, time.Millisecond)
+
+	for _, release := range holders {
+		release()
+	}
+	wg.Wait()
+	return order
+}
+
+func countKey(order []string, key string) int {
+	n := 0
+	for _, k := range order {
+		if k == key {
+			n++
+		}
+	}
+	return n
+}
+
+func TestFairQueue_DequeuesProportionallyToWeights(t *testing.T) {
+	q := NewFairQueue(1, time.Minute, map[string]float64{"heavy": 3, "light": 1})
+	order := admitBursts(t, q, map[string]int{"heavy": 60, "light": 60})
+	require.Len(t, order, 120)
+
+	// 两个密钥都有请求排队时按3:1放行
+	head := order[:80]
+	assert.InDelta(t, 60, countKey(head, "heavy"), 1, "%v", head)
+	assert.InDelta(t, 20, countKey(head, "light"), 1, "%v", head)
+}
+
+func TestFairQueue_FractionalWeight(t *testing.T) {
+	q := NewFairQueue(1, time.Minute, map[string]float64{"slow": 0.5})
+	order := admitBursts(t, q, map[string]int{"normal": 30, "slow": 30})
+
+	head := order[:30]
+	assert.InDelta(t, 20, countKey(head, "normal"), 1, "%v", head)
+	assert.InDelta(t, 10, countKey(head, "slow"), 1, "%v", head)
+}
+
+func TestFairQueue_BurstDoesNotStarveOtherKeys(t *testing.T) {
+	q := NewFairQueue(1, time.Minute, nil)
+	release, _, err := q.Acquire(context.Background(), "holder")
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	submit := func(key string, n int) {
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, _, err := q.Acquire(context.Background(), key)
+				if !assert.NoError(t, err) {
+					return
+				}
+				mu.Lock()
+				order = append(order, key)
+				mu.Unlock()
+				release()
+			}()
+		}
+	}
+	// 重度调用方先排满50个请求，之后另一个密钥才到达
+	submit("burst", 50)
+	require.Eventually(t, func() bool { return q.Snapshot().Queued == 50 }, 5*time.Second, time.Millisecond)
+	submit("late", 5)
+	require.Eventually(t, func() bool { return q.Snapshot().Queued == 55 }, 5*time.Second, time.Millisecond)
+
+	release()
+	wg.Wait()
+
+	last := 0
+	for i, key := range order {
+		if key == "late" {
+			last = i
+		}
+	}
+	assert.Less(t, last, 12, "后到的密钥与重度调用方轮流放行，而不是排在其全部请求之后: %v", order)
+}
+
+// 两个密钥持续提交请求（闭环压测），完成数之比接近权重之比
+func TestFairQueue_ThroughputSimulation(t *testing.T) {
+	q := NewFairQueue(2, time.Minute, map[string]float64{"gold": 3, "bronze": 1})
+
+	var completed sync.Map
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, key := range []string{"gold", "bronze"} {
+		counter := &atomic.Int64{}
+		completed.Store(key, counter)
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ctx.Err() == nil {
+					release, _, err := q.Acquire(ctx, key)
+					if err != nil {
+						return
+					}
+					time.Sleep(time.Millisecond)
+					counter.Add(1)
+					release()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	gold, _ := completed.Load("gold")
+	bronze, _ := completed.Load("bronze")
+	goldCount, bronzeCount := gold.(*atomic.Int64).Load(), bronze.(*atomic.Int64).Load()
+	require.Positive(t, bronzeCount)
+	assert.InDelta(t, 3.0, float64(goldCount)/float64(bronzeCount), 0.5, "gold=%d bronze=%d", goldCount, bronzeCount)
+
+	snapshot := q.Snapshot()
+	assert.Zero(t, snapshot.Active)
+	assert.Zero(t, snapshot.Queued)
+	for _, key := range snapshot.Keys {
+		assert.Positive(t, key.Wait.P99Ms, key.Key)
+		assert.LessOrEqual(t, key.Wait.P50Ms, key.Wait.P90Ms)
+		assert.LessOrEqual(t, key.Wait.P90Ms, key.Wait.P99Ms)
+	}
+}
+
+func TestFairQueue_TimeoutAndCancel(t *testing.T) {
+	q := NewFairQueue(1, 20*time.Millisecond, nil)
+	release, wait, err := q.Acquire(context.Background(), "holder-key-h")
+	require.NoError(t, err)
+	assert.Zero(t, wait, "有空闲名额时直接放行")
+
+	_, _, err = q.Acquire(context.Background(), "client-key-c")
+	assert.ErrorIs(t, err, ErrFairQueueTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = q.Acquire(ctx, "client-key-c")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	snapshot := q.Snapshot()
+	assert.Zero(t, snapshot.Queued, "放弃等待的请求移出队列")
+	assert.Equal(t, 1, snapshot.Active)
+
+	// 释放函数重复调用只生效一次
+	release()
+	release()
+	release, _, err = q.Acquire(context.Background(), "client-key-c")
+	require.NoError(t, err)
+	release()
+
+	for _, key := range q.Snapshot().Keys {
+		if key.Key == maskClientKey("client-key-c") {
+			assert.EqualValues(t, 1, key.TimedOut)
+			assert.EqualValues(t, 1, key.Admitted)
+		}
+	}
+}
+
+func TestFairQueueMiddleware(t *testing.T) {
+	q := NewFairQueue(1, 20*time.Millisecond, map[string]float64{"client-key-a": 2})
+	withFairQueue(t, q)
+
+	router := gin.New()
+	router.Use(FairQueueMiddleware())
+	router.POST("/v1/messages", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/v1/messages/count_tokens", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/api/keys/usage", handleKeysUsage)
+	send := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("x-api-key", "client-key-a")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, send("POST", "/v1/messages").Code)
+
+	release, _, err := q.Acquire(context.Background(), "client-key-b")
+	require.NoError(t, err)
+	w := send("POST", "/v1/messages")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "overloaded")
+	assert.Equal(t, http.StatusOK, send("POST", "/v1/messages/count_tokens").Code, "不占用上游的端点不排队")
+	release()
+
+	w = send("GET", "/api/keys/usage")
+	require.Equal(t, http.StatusOK, w.Code)
+	var snapshot FairQueueSnapshot
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &snapshot))
+	assert.True(t, snapshot.Enabled)
+	assert.Equal(t, 1, snapshot.MaxConcurrent)
+	require.Len(t, snapshot.Keys, 2)
+	keyA := snapshot.Keys[0]
+	if keyA.Key != maskClientKey("client-key-a") {
+		keyA = snapshot.Keys[1]
+	}
+	assert.Equal(t, maskClientKey("client-key-a"), keyA.Key, "密钥已脱敏")
+	assert.Equal(t, 2.0, keyA.Weight)
+	assert.EqualValues(t, 1, keyA.Admitted)
+	assert.EqualValues(t, 1, keyA.TimedOut)
+	assert.Equal(t, 1, keyA.Wait.Samples)
+
+	withFairQueue(t, nil)
+	w = send("GET", "/api/keys/usage")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &snapshot))
+	assert.False(t, snapshot.Enabled)
+}
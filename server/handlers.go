@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -51,22 +52,31 @@ func extractRelevantHeaders(c *gin.Context) map[string]string {
 
 // handleStreamRequest 处理流式请求
 // handleStreamRequest 处理流式请求
-func handleStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, tokenWithUsage *types.TokenWithUsage) {
-	sender := &AnthropicStreamSender{}
-	handleGenericStreamRequest(c, anthropicReq, tokenWithUsage, sender, createAnthropicStreamEvents)
+func handleStreamRequest(scope *RequestScope) {
+	c := scope.c
+	disableWriteDeadline(c)
+	// 携带Last-Event-ID的重连：只重发尚未送达的事件
+	if resumeSSEStream(c) {
+		return
+	}
+
+	scope.Stream = true
+	scope.EffectiveParams = attachEffectiveParams(c, scope.Request, true)
+
+	// 可选：下发前按Claude流式规范校验每个事件（STRICT_SSE_VALIDATION）
+	sender := newStrictSSESender(&AnthropicStreamSender{}, strictSSEValidation)
+	if strict, ok := sender.(*strictSSESender); ok {
+		defer strict.finish(c)
+	}
+	handleGenericStreamRequest(scope, sender, createAnthropicStreamEvents)
 }
 
 // handleGenericStreamRequest 通用流式请求处理
-func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, token *types.TokenWithUsage, sender StreamEventSender, eventCreator func(string, int, string) []map[string]any) {
+func handleGenericStreamRequest(scope *RequestScope, sender StreamEventSender, eventCreator func(*RequestScope) []map[string]any) {
+	c := scope.c
+	scope.Stream = true
 	// 计算输入tokens（基于实际发送给上游的数据）
-	estimator := utils.NewTokenEstimator()
-	countReq := &types.CountTokensRequest{
-		Model:    anthropicReq.Model,
-		System:   anthropicReq.System,
-		Messages: anthropicReq.Messages,
-		Tools:    filterSupportedTools(anthropicReq.Tools), // 过滤不支持的工具后计算
-	}
-	inputTokens := estimator.EstimateTokens(countReq)
+	scope.estimateInputTokens()
 
 	// 初始化SSE响应
 	if err := initializeSSEResponse(c); err != nil {
@@ -75,37 +85,96 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 	}
 
 	// 生成消息ID并注入上下文
-	messageID := fmt.Sprintf(config.MessageIDFormat, time.Now().Format(config.MessageIDTimeFormat))
-	c.Set("message_id", messageID)
+	scope.MessageID = fmt.Sprintf(config.MessageIDFormat, time.Now().Format(config.MessageIDTimeFormat))
+	c.Set("message_id", scope.MessageID)
+
+	// 登记SSE流，之后的事件都带有单调递增的id
+	stream := beginSSEStream(c)
+	defer stream.finish()
+
+	// 可选：取消同一会话中仍在进行的旧流（ABORT_DUPLICATE_STREAMS）
+	defer beginConversationStream(c)()
+
+	// 可选：客户端指定的首字节超时（X-Kiro-Timeout-Ms）
+	defer beginClientTimeout(c, true)()
+
+	// 下发队列：客户端读取过慢时结束流并取消上游请求（SLOW_CLIENT_GRACE）
+	guard := beginSlowClientGuard(c)
+	defer guard.finish(sender)
 
 	// 执行CodeWhisperer请求
-	resp, err := execCWRequest(c, anthropicReq, token.TokenInfo, true)
+	resp, err := execCWRequest(scope)
 	if err != nil {
-		var modelNotFoundErrorType *types.ModelNotFoundErrorType
-		if errors.As(err, &modelNotFoundErrorType) {
+		if respondModelNotFound(c, err, sender) {
+			return
+		}
+		if errors.Is(err, ErrStreamSuperseded) {
+			sendStreamSuperseded(c, sender)
+			return
+		}
+		if errors.Is(err, ErrClientTimeout) {
+			sendClientTimeout(c, sender)
+			return
+		}
+		// 上游错误已在handleCodeWhispererError中写入响应，不再重复发送
+		if c.Writer.Size() > 0 {
 			return
 		}
 		_ = sender.SendError(c, "构建请求失败", err)
 		return
 	}
 	defer resp.Body.Close()
+	guard.attach()
 
 	// 创建流处理上下文
-	ctx := NewStreamProcessorContext(c, anthropicReq, token, sender, messageID, inputTokens)
+	ctx := NewStreamProcessorContext(scope, sender)
 	defer ctx.Cleanup()
 
 	// 发送初始事件
 	if err := ctx.sendInitialEvents(eventCreator); err != nil {
 		return
 	}
+	initialSize := c.Writer.Size()
 
 	// 处理事件流
 	processor := NewEventStreamProcessor(ctx)
-	if err := processor.ProcessEventStream(resp.Body); err != nil {
+	if err := processor.ProcessEventStream(clientTimeoutReader(c, resp.Body)); err != nil {
+		if slowClientDropped(c) {
+			return
+		}
 		logger.Error("事件流处理失败", logger.Err(err))
 		return
 	}
 
+	// 可选：上游流没有产生任何内容时换下一个token重试一次（EMPTY_STREAM_RETRY）
+	if emptyStreamRetry && ctx.isEmptyStream(initialSize) && !streamSuperseded(c) && !clientTimedOut(c) && !slowClientDropped(c) {
+		retryResp := retryEmptyStream(ctx)
+		if retryResp == nil && c.Writer.Size() != initialSize {
+			return // 重试的上游错误已写入响应
+		}
+		if retryResp != nil {
+			defer retryResp.Body.Close()
+			if err := processor.ProcessEventStream(clientTimeoutReader(c, retryResp.Body)); err != nil {
+				if slowClientDropped(c) {
+					return
+				}
+				logger.Error("事件流处理失败", logger.Err(err))
+				return
+			}
+		}
+	}
+	if streamSuperseded(c) {
+		sendStreamSuperseded(c, sender)
+		return
+	}
+	if clientTimedOut(c) {
+		sendClientTimeout(c, sender)
+		return
+	}
+	if slowClientDropped(c) {
+		return
+	}
+
 	// 发送结束事件
 	if err := ctx.sendFinalEvents(); err != nil {
 		logger.Error("发送结束事件失败", logger.Err(err))
@@ -114,7 +183,7 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 }
 
 // createAnthropicStreamEvents 创建Anthropic流式初始事件
-func createAnthropicStreamEvents(messageId string, inputTokens int, model string) []map[string]any {
+func createAnthropicStreamEvents(scope *RequestScope) []map[string]any {
 	// 创建基础初始事件序列，不包含content_block_start
 	//
 	// 关键修复：移除预先发送的空文本块
@@ -128,17 +197,14 @@ func createAnthropicStreamEvents(messageId string, inputTokens int, model string
 		{
 			"type": "message_start",
 			"message": map[string]any{
-				"id":            messageId,
+				"id":            scope.MessageID,
 				"type":          "message",
 				"role":          "assistant",
 				"content":       []any{},
-				"model":         model,
+				"model":         scope.Request.Model,
 				"stop_reason":   nil,
 				"stop_sequence": nil,
-				"usage": map[string]any{
-					"input_tokens":  inputTokens,
-					"output_tokens": 0, // 初始输出tokens为0，最终在message_delta中更新
-				},
+				"usage":         scope.anthropicUsage(0), // 初始输出tokens为0，最终在message_delta中更新
 			},
 		},
 		{
@@ -149,13 +215,8 @@ func createAnthropicStreamEvents(messageId string, inputTokens int, model string
 }
 
 // createAnthropicFinalEvents 创建Anthropic流式结束事件
-func createAnthropicFinalEvents(outputTokens, inputTokens int, stopReason string) []map[string]any {
-	// 构建符合Claude规范的完整usage信息
-	usage := map[string]any{
-		"output_tokens": outputTokens,
-		"input_tokens":  inputTokens,
-	}
-
+// usage为符合Claude规范的完整usage信息（见RequestScope.anthropicUsage）
+func createAnthropicFinalEvents(usage map[string]any, stopReason string) []map[string]any {
 	// 删除硬编码的content_block_stop，依赖sendFinalEvents的动态保护机制
 	// sendFinalEvents在调用本函数前已经自动关闭所有未关闭的content_block（stream_processor.go:353-365）
 	// 这样避免了重复发送content_block_stop导致的违规错误
@@ -182,19 +243,26 @@ func createAnthropicFinalEvents(outputTokens, inputTokens int, stopReason string
 }
 
 // handleNonStreamRequest 处理非流式请求
-func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) {
+func handleNonStreamRequest(scope *RequestScope) {
+	c, anthropicReq, token := scope.c, scope.Request, scope.TokenInfo()
+	scope.Stream = false
+	scope.EffectiveParams = attachEffectiveParams(c, anthropicReq, false)
+
 	// 计算输入tokens（基于实际发送给上游的数据）
+	scope.estimateInputTokens()
 	estimator := utils.NewTokenEstimator()
-	countReq := &types.CountTokensRequest{
-		Model:    anthropicReq.Model,
-		System:   anthropicReq.System,
-		Messages: anthropicReq.Messages,
-		Tools:    filterSupportedTools(anthropicReq.Tools), // 过滤不支持的工具后计算
-	}
-	inputTokens := estimator.EstimateTokens(countReq)
 
-	resp, err := executeCodeWhispererRequest(c, anthropicReq, token, false)
+	// 可选：客户端指定的整体超时（X-Kiro-Timeout-Ms）
+	defer beginClientTimeout(c, false)()
+
+	resp, err := executeCodeWhispererRequest(scope)
 	if err != nil {
+		if respondModelNotFound(c, err, nil) {
+			return
+		}
+		if errors.Is(err, ErrClientTimeout) {
+			respondClientTimeout(c)
+		}
 		return
 	}
 	defer func(Body io.ReadCloser) {
@@ -204,38 +272,16 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 	// 读取响应体
 	body, err := utils.ReadHTTPResponse(resp.Body)
 	if err != nil {
+		if clientTimedOut(c) {
+			respondClientTimeout(c)
+			return
+		}
 		handleResponseReadError(c, err)
 		return
 	}
 
 	// 使用新的符合AWS规范的解析器，但在非流式模式下增加超时保护
-	compliantParser := parser.NewCompliantEventStreamParser()
-	compliantParser.SetMaxErrors(config.ParserMaxErrors) // 限制最大错误次数以防死循环
-
-	// 为非流式解析添加超时保护
-	result, err := func() (*parser.ParseResult, error) {
-		done := make(chan struct{})
-		var result *parser.ParseResult
-		var err error
-
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					err = fmt.Errorf("解析器panic: %v", r)
-				}
-				close(done)
-			}()
-			result, err = compliantParser.ParseResponse(body)
-		}()
-
-		select {
-		case <-done:
-			return result, err
-		case <-time.After(10 * time.Second): // 10秒超时
-			logger.Error("非流式解析超时")
-			return nil, fmt.Errorf("解析超时")
-		}
-	}()
+	result, partial, err := parseNonStreamResponse(newNonStreamParser(), body, nonStreamParseTimeout)
 
 	if err != nil {
 		logger.Error("非流式解析失败",
@@ -255,6 +301,9 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		if strings.Contains(err.Error(), "解析超时") {
 			statusCode = http.StatusRequestTimeout
 			errorResp["message"] = "请求处理超时，请稍后重试"
+		} else if errors.Is(err, parser.ErrTooManyActiveTools) {
+			statusCode = http.StatusBadGateway
+			errorResp["message"] = tooManyActiveToolsMessage
 		} else if strings.Contains(err.Error(), "格式错误") {
 			statusCode = http.StatusBadRequest
 			errorResp["message"] = "请求格式不正确"
@@ -264,27 +313,39 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		return
 	}
 
+	// 上游在同一响应中返回多条assistant消息时按策略截断或合并
+	result = messageBoundaryPolicy.ApplyToResult(c, result)
+	// 非流式响应只统计未知内容块，不写入响应
+	recordUnknownBlocks(c, result.Events)
+
 	// 转换为Anthropic格式
 	var contexts []map[string]any
 	textAgg := result.GetCompletionText()
 
-	// 先获取工具管理器的所有工具，确保sawToolUse的判断基于实际工具
-	toolManager := compliantParser.GetToolManager()
-	allTools := make([]*parser.ToolExecution, 0)
-
-	// 获取活跃工具
-	for _, tool := range toolManager.GetActiveTools() {
-		allTools = append(allTools, tool)
-	}
+	// 使用新的stop_reason管理器，确保符合Claude官方规范
+	stopReasonManager := NewStopReasonManager(anthropicReq)
 
-	// 获取已完成工具
-	for _, tool := range toolManager.GetCompletedTools() {
-		allTools = append(allTools, tool)
-	}
+	// 工具调用：完整解析时包含活跃和已完成的工具，部分结果只包含已完成的工具
+	// 禁用并行工具调用时只保留第一个
+	allTools := stopReasonManager.LimitToolCalls(result.GetToolCalls())
 
 	// 基于实际工具数量判断是否包含工具调用
 	sawToolUse := len(allTools) > 0
 
+	// 可选：上游在句子或JSON中间提前结束时自动续写（AUTO_CONTINUE）
+	// 工具调用、拒绝和解析超时的响应不续写
+	_, refused := findRefusal(result.Events)
+	if autoContinue != nil {
+		continues := 0
+		if !sawToolUse && !refused && !partial {
+			continued := autoContinue.Continue(c, anthropicReq, token, textAgg)
+			textAgg = continued.Text
+			scope.InputTokens += continued.InputTokens
+			continues = continued.Continues
+		}
+		c.Header(HeaderAutoContinues, strconv.Itoa(continues))
+	}
+
 	// logger.Debug("非流式响应处理完成",
 	// 	addReqFields(c,
 	// 		logger.String("text_content", textAgg[:utils.IntMin(config.LogPreviewMaxLength, len(textAgg))]),
@@ -301,23 +362,12 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 	}
 
 	// 添加工具调用
-	// 工具已经在前面从toolManager获取到allTools中
-	// logger.Debug("从工具生命周期管理器获取工具调用",
-	// 	logger.Int("total_tools", len(allTools)),
-	// 	logger.Int("parse_result_tools", len(result.GetToolCalls())))
-
 	for _, tool := range allTools {
-		// logger.Debug("添加工具调用到响应",
-		// 	logger.String("tool_id", tool.ID),
-		// 	logger.String("tool_name", tool.Name),
-		// 	logger.String("tool_status", tool.Status.String()),
-		// 	logger.Any("tool_arguments", tool.Arguments))
-
 		// 创建标准的tool_use块，确保包含完整的状态信息
 		toolUseBlock := map[string]any{
 			"type":  "tool_use",
 			"id":    tool.ID,
-			"name":  tool.Name,
+			"name":  anthropicReq.OriginalToolName(tool.Name),
 			"input": tool.Arguments,
 		}
 
@@ -326,27 +376,9 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 			toolUseBlock["input"] = map[string]any{}
 		}
 
-		// 添加详细的调试日志，验证tool_use块格式
-		// if toolUseBlockJSON, err := utils.SafeMarshal(toolUseBlock); err == nil {
-		// 	logger.Debug("发送给Claude CLI的tool_use块详细结构",
-		// 		logger.String("tool_id", tool.ID),
-		// 		logger.String("tool_name", tool.Name),
-		// 		logger.String("tool_use_json", string(toolUseBlockJSON)),
-		// 		logger.String("input_type", fmt.Sprintf("%T", tool.Arguments)),
-		// 		logger.Any("arguments_value", tool.Arguments))
-		// }
-
 		contexts = append(contexts, toolUseBlock)
-
-		// 记录工具调用完成状态，帮助客户端识别工具调用已完成
-		// logger.Debug("工具调用已添加到响应",
-		// 	logger.String("tool_id", tool.ID),
-		// 	logger.String("tool_name", tool.Name))
 	}
 
-	// 使用新的stop_reason管理器，确保符合Claude官方规范
-	stopReasonManager := NewStopReasonManager(anthropicReq)
-
 	// *** 关键修复：基于实际发送给客户端的内容计算 token ***
 	// 设计原则：token 计费应该基于实际下发的内容，而不是上游原始数据
 	// 原因：
@@ -378,8 +410,19 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		outputTokens = 1
 	}
 
+	// 估算值计入对账统计，下发值按TOKEN_ACCOUNTING_SOURCE换算
+	scope.OutputTokens = outputTokens
+	scope.recordEstimatedUsage(outputTokens)
+	outputTokens = scaleOutputTokens(outputTokens, outputTokenFactor(token))
+
 	stopReasonManager.UpdateToolCallStatus(sawToolUse, sawToolUse)
 	stopReason := stopReasonManager.DetermineStopReason()
+	if refused {
+		stopReason = "refusal"
+	}
+	if partial {
+		stopReason = "error"
+	}
 
 	// logger.Debug("非流式响应stop_reason决策",
 	// 	logger.String("stop_reason", stopReason),
@@ -394,10 +437,13 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		"stop_reason":   stopReason,
 		"stop_sequence": nil,
 		"type":          "message",
-		"usage": map[string]any{
-			"input_tokens":  inputTokens,
-			"output_tokens": outputTokens,
-		},
+		"usage":         scope.anthropicUsage(outputTokens),
+	}
+	if partial {
+		anthropicResp["warning"] = "响应解析超时，仅返回已解析的部分内容"
+	}
+	if scope.EffectiveParams != nil {
+		anthropicResp["kiro"] = scope.EffectiveParams
 	}
 
 	// logger.Debug("非流式响应最终数据",
@@ -407,23 +453,67 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 	logger.Debug("下发非流式响应",
 		addReqFields(c,
 			logger.String("direction", "downstream_send"),
-			logger.Any("contexts", contexts),
+			logContent(c, "contexts", contexts),
 			logger.Bool("saw_tool_use", sawToolUse),
 			logger.Int("content_count", len(contexts)),
 		)...)
 	c.JSON(http.StatusOK, anthropicResp)
 }
 
-// createTokenPreview 创建token预览显示格式 (***+后10位)
-func createTokenPreview(token string) string {
-	if len(token) <= 10 {
-		// 如果token太短，全部用*代替
-		return strings.Repeat("*", len(token))
+// nonStreamParser 非流式响应解析器，PartialResult 用于超时时取回已解析的部分
+type nonStreamParser interface {
+	ParseResponse(streamData []byte) (*parser.ParseResult, error)
+	PartialResult() *parser.ParseResult
+}
+
+// newNonStreamParser 创建非流式解析器（测试中可替换）
+var newNonStreamParser = func() nonStreamParser {
+	compliantParser := parser.NewCompliantEventStreamParser()
+	compliantParser.SetMaxErrors(config.ParserMaxErrors) // 限制最大错误次数以防死循环
+	return compliantParser
+}
+
+// nonStreamParseTimeout 非流式解析超时时间（测试中可缩短）
+var nonStreamParseTimeout = config.NonStreamParseTimeout
+
+// parseNonStreamResponse 带超时保护地解析非流式响应
+// 超时时若解析器已产出文本或已完成的工具调用，返回部分结果且partial为true
+func parseNonStreamResponse(p nonStreamParser, body []byte, timeout time.Duration) (*parser.ParseResult, bool, error) {
+	done := make(chan struct{})
+	var result *parser.ParseResult
+	var err error
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("解析器panic: %v", r)
+			}
+			close(done)
+		}()
+		result, err = p.ParseResponse(body)
+	}()
+
+	select {
+	case <-done:
+		return result, false, err
+	case <-time.After(timeout):
+	}
+
+	partial := p.PartialResult()
+	if partial == nil || (partial.GetCompletionText() == "" && len(partial.GetToolCalls()) == 0) {
+		logger.Error("非流式解析超时")
+		return nil, false, fmt.Errorf("解析超时")
 	}
 
-	// 3个*号 + 后10位
-	suffix := token[len(token)-10:]
-	return "***" + suffix
+	logger.Warn("非流式解析超时，返回部分结果",
+		logger.Int("event_count", len(partial.Events)),
+		logger.Int("tool_count", len(partial.GetToolCalls())))
+	return partial, true, nil
+}
+
+// createTokenPreview 创建token预览显示格式 (***+后N位，与types.TokenPreview一致)
+func createTokenPreview(token string) string {
+	return types.TokenPreview(token)
 }
 
 // maskEmail 对邮箱进行脱敏处理
@@ -487,7 +577,20 @@ func maskEmail(email string) string {
 	return maskedUsername + "@" + maskedDomain
 }
 
-// handleTokenPoolAPI 处理Token池API请求 - 恢复多token显示
+// resolveDisplayName 解析账号在Dashboard中的显示名称
+// 配置了DisplayName时优先使用别名，否则回退到传入的（已脱敏的）邮箱或状态文本
+func resolveDisplayName(authConfig auth.AuthConfig, fallback string) string {
+	if name := strings.TrimSpace(authConfig.DisplayName); name != "" {
+		return name
+	}
+	return fallback
+}
+
+// tokenPoolNow 判断计划停用时段使用的时钟（测试可替换）
+var tokenPoolNow = time.Now
+
+// handleTokenPoolAPI 处理Token池API请求
+// 纯读取后台检查结果，尚未检查的配置返回 "pending" 状态
 func handleTokenPoolAPI(c *gin.Context) {
 	var tokenList []any
 	var activeCount int
@@ -522,6 +625,7 @@ func handleTokenPoolAPI(c *gin.Context) {
 			tokenData := map[string]any{
 				"index":           i,
 				"user_email":      "已禁用",
+				"display_name":    resolveDisplayName(authConfig, "已禁用"),
 				"token_preview":   "***已禁用",
 				"auth_type":       strings.ToLower(authConfig.AuthType),
 				"remaining_usage": 0,
@@ -535,12 +639,31 @@ func handleTokenPoolAPI(c *gin.Context) {
 			continue
 		}
 
-		// 尝试获取token信息
-		tokenInfo, err := refreshSingleTokenByConfig(authConfig)
-		if err != nil {
+		// 只读取后台检查结果，不在此处发起任何上游请求
+		entry, checked := tokenStatusMonitor.Get(authConfig)
+		if !checked {
+			tokenData := map[string]any{
+				"index":           i,
+				"user_email":      "待检查",
+				"display_name":    resolveDisplayName(authConfig, "待检查"),
+				"token_preview":   createTokenPreview(authConfig.RefreshToken),
+				"auth_type":       strings.ToLower(authConfig.AuthType),
+				"remaining_usage": 0,
+				"expires_at":      "",
+				"last_used":       "未知",
+				"status":          types.AccountStatusPending,
+				"status_text":     "待检查",
+				"queued":          tokenStatusMonitor.IsQueued(authConfig),
+			}
+			tokenList = append(tokenList, tokenData)
+			continue
+		}
+
+		if entry.Err != nil {
 			tokenData := map[string]any{
 				"index":           i,
 				"user_email":      "获取失败",
+				"display_name":    resolveDisplayName(authConfig, "获取失败"),
 				"token_preview":   createTokenPreview(authConfig.RefreshToken),
 				"auth_type":       strings.ToLower(authConfig.AuthType),
 				"remaining_usage": 0,
@@ -548,17 +671,28 @@ func handleTokenPoolAPI(c *gin.Context) {
 				"last_used":       "未知",
 				"status":          types.AccountStatusError,
 				"status_text":     "错误",
-				"error":           err.Error(),
+				"error":           entry.Err.Error(),
+				"checked_at":      entry.CheckedAt.Format(time.RFC3339),
+			}
+			// 共享ClientID的组被身份提供方限流：不是账号本身的错误，等待退避结束后自动重试
+			var throttled *auth.RefreshThrottledError
+			if errors.As(entry.Err, &throttled) {
+				tokenData["status"] = types.AccountStatusRefreshThrottled
+				tokenData["status_text"] = "刷新限流"
+				tokenData["retry_at"] = throttled.RetryAt.Format(time.RFC3339)
 			}
 			tokenList = append(tokenList, tokenData)
 			continue
 		}
 
-		// 检查token是否过期
-		if tokenInfo.IsExpired() {
+		tokenInfo := entry.TokenInfo
+
+		// 检查token是否过期（封禁期内不刷新的账号没有有效token，按封禁显示）
+		if entry.Usage == nil || (tokenInfo.IsExpired() && entry.Usage.Status != types.AccountStatusBanned) {
 			tokenData := map[string]any{
 				"index":           i,
 				"user_email":      "已过期",
+				"display_name":    resolveDisplayName(authConfig, "已过期"),
 				"token_preview":   createTokenPreview(tokenInfo.AccessToken),
 				"auth_type":       strings.ToLower(authConfig.AuthType),
 				"remaining_usage": 0,
@@ -567,14 +701,13 @@ func handleTokenPoolAPI(c *gin.Context) {
 				"status":          types.AccountStatusExpired,
 				"status_text":     "已过期",
 				"error":           "Token已过期",
+				"checked_at":      entry.CheckedAt.Format(time.RFC3339),
 			}
 			tokenList = append(tokenList, tokenData)
 			continue
 		}
 
-		// 使用新的用量检查方法
-		checker := auth.NewUsageLimitsChecker()
-		usageResult := checker.CheckUsageLimitsWithStatus(tokenInfo)
+		usageResult := entry.Usage
 
 		// 提取用户邮箱
 		var userEmail = "未知用户"
@@ -583,15 +716,18 @@ func handleTokenPoolAPI(c *gin.Context) {
 		}
 
 		// 构建token数据
+		maskedEmail := maskEmail(userEmail)
 		tokenData := map[string]any{
 			"index":           i,
-			"user_email":      maskEmail(userEmail),
+			"user_email":      maskedEmail,
+			"display_name":    resolveDisplayName(authConfig, maskedEmail),
 			"token_preview":   createTokenPreview(tokenInfo.AccessToken),
 			"auth_type":       strings.ToLower(authConfig.AuthType),
 			"remaining_usage": usageResult.Available,
 			"expires_at":      tokenInfo.ExpiresAt.Format(time.RFC3339),
-			"last_used":       time.Now().Format(time.RFC3339),
+			"last_used":       entry.CheckedAt.Format(time.RFC3339),
 			"status":          usageResult.Status,
+			"checked_at":      entry.CheckedAt.Format(time.RFC3339),
 		}
 
 		// 根据状态设置状态文本和错误信息
@@ -645,6 +781,72 @@ func handleTokenPoolAPI(c *gin.Context) {
 		tokenList = append(tokenList, tokenData)
 	}
 
+	// 计划停用时段内的可用账号显示为scheduled_off，并给出下次可用时间
+	now := tokenPoolNow()
+	for _, item := range tokenList {
+		tokenData := item.(map[string]any)
+		off, availableAt := configs[tokenData["index"].(int)].Schedule.Off(now)
+		if !off {
+			continue
+		}
+		if !availableAt.IsZero() {
+			tokenData["available_at"] = availableAt.Format(time.RFC3339)
+		}
+		if tokenData["status"] == types.AccountStatusActive {
+			tokenData["status"] = types.AccountStatusScheduledOff
+			tokenData["status_text"] = "计划停用"
+			activeCount--
+		}
+	}
+
+	// 附加profile ARN简写，便于核对各账号使用的profile；附加最近一次失败记录，完整记录见 /api/tokens/:index/errors
+	for _, item := range tokenList {
+		tokenData := item.(map[string]any)
+		if arn := configs[tokenData["index"].(int)].ProfileArn; arn != "" {
+			tokenData["profile_arn"] = auth.ShortenProfileArn(arn)
+		}
+		if lastError, exists := auth.LatestTokenError(auth.ConfigID(configs[tokenData["index"].(int)])); exists {
+			tokenData["last_error"] = lastError
+		}
+	}
+
+	// 附加数据年龄（秒）：超过用量硬TTL的条目标记为stale
+	hardTTL := auth.UsageHardTTL()
+	for _, item := range tokenList {
+		tokenData := item.(map[string]any)
+		if tokenData["status"] == types.AccountStatusDisabled {
+			continue
+		}
+		if entry, checked := tokenStatusMonitor.Get(configs[tokenData["index"].(int)]); checked {
+			age := time.Since(entry.CheckedAt)
+			tokenData["age"] = int64(age.Seconds())
+			tokenData["stale"] = age > hardTTL
+		}
+	}
+
+	// 附加最近一次刷新耗时（毫秒）
+	for _, item := range tokenList {
+		tokenData := item.(map[string]any)
+		if duration, exists := auth.Metrics().LastRefreshDuration(configs[tokenData["index"].(int)]); exists {
+			tokenData["last_refresh_duration_ms"] = duration.Milliseconds()
+		}
+	}
+
+	// 附加健康评分（评分越高越优先被选择）
+	if tokenHealth != nil {
+		scores := tokenHealth.HealthScores()
+		for _, item := range tokenList {
+			tokenData := item.(map[string]any)
+			if score, exists := scores[fmt.Sprintf(config.TokenCacheKeyFormat, tokenData["index"])]; exists {
+				tokenData["health"] = score
+				// 选择器已不信任该token的用量数据时同样标记为stale
+				if score.UsageStaleness == auth.UsageHardStale {
+					tokenData["stale"] = true
+				}
+			}
+		}
+	}
+
 	// 返回多token数据
 	c.JSON(http.StatusOK, gin.H{
 		"timestamp":     time.Now().Format(time.RFC3339),
@@ -655,19 +857,44 @@ func handleTokenPoolAPI(c *gin.Context) {
 			"total_tokens":  len(configs),
 			"active_tokens": activeCount,
 		},
+		"idc_refresh_groups": auth.IdCRefreshGroupStates(),
 	})
 }
 
+// handleRefreshTokenStatus 将单个token配置加入检查队列，刷新token并查询最新用量
+// POST /api/tokens/:index/refresh
+func handleRefreshTokenStatus(c *gin.Context) {
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的索引"})
+		return
+	}
+
+	configs, err := auth.GetConfigs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "加载配置失败: " + err.Error()})
+		return
+	}
+	if index < 0 || index >= len(configs) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "配置不存在"})
+		return
+	}
+	if configs[index].Disabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "配置已禁用"})
+		return
+	}
+
+	if err := tokenStatusMonitor.Enqueue(configs[index]); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "已加入检查队列", "index": index})
+}
+
 // refreshSingleTokenByConfig 根据配置刷新单个token
 func refreshSingleTokenByConfig(config auth.AuthConfig) (types.TokenInfo, error) {
-	switch config.AuthType {
-	case auth.AuthMethodSocial:
-		return auth.RefreshSocialToken(config.RefreshToken)
-	case auth.AuthMethodIdC:
-		return auth.RefreshIdCToken(config)
-	default:
-		return types.TokenInfo{}, fmt.Errorf("不支持的认证类型: %s", config.AuthType)
-	}
+	return auth.RefreshToken(config)
 }
 
 // 已移除复杂的token数据收集函数，现在使用简单的内存数据读取
@@ -1,11 +1,20 @@
 package server
 
 import (
+	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/config"
+	"kiro2api/parser"
+	"kiro2api/types"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func init() {
@@ -207,6 +216,38 @@ func TestCreateTokenPreview_EdgeCases(t *testing.T) {
 	}
 }
 
+func TestCreateTokenPreview_ConfiguredSuffixLen(t *testing.T) {
+	original := config.TokenPreviewSuffixLen
+	t.Cleanup(func() { config.TokenPreviewSuffixLen = original })
+
+	token := "1234567890abcdefghijklmnopqrstuvwxyz"
+	tests := []struct {
+		name      string
+		suffixLen int
+		token     string
+		expected  string
+	}{
+		{"后4位", 4, token, "***wxyz"},
+		{"后16位", 16, token, "***klmnopqrstuvwxyz"},
+		{"不保留明文", 0, token, "***"},
+		{"负数按0处理", -5, token, "***"},
+		{"超过上限按32处理", 100, token, "***" + token[len(token)-32:]},
+		{"短token全部用*代替", 16, "short-token", "***********"},
+		{"恰好等于后缀长度", 4, "abcd", "****"},
+		{"空token", 4, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.TokenPreviewSuffixLen = tt.suffixLen
+
+			assert.Equal(t, tt.expected, createTokenPreview(tt.token))
+			tokenInfo := &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: tt.token}}
+			assert.Equal(t, tt.expected, tokenInfo.GenerateTokenPreview(), "server与types的预览应保持一致")
+		})
+	}
+}
+
 // TestMaskEmail 测试邮箱脱敏功能
 func TestMaskEmail(t *testing.T) {
 	tests := []struct {
@@ -344,3 +385,122 @@ func TestMaskEmail_SecurityProperties(t *testing.T) {
 	assert.Contains(t, masked, "ve", "应保留用户名后2位")
 	assert.Contains(t, masked, ".com", "应保留顶级域名")
 }
+
+// TestResolveDisplayName 测试账号显示名称优先于脱敏邮箱
+func TestResolveDisplayName(t *testing.T) {
+	masked := maskEmail("caidaoli@gmail.com")
+
+	tests := []struct {
+		name     string
+		config   auth.AuthConfig
+		expected string
+	}{
+		{
+			name:     "配置了别名时优先使用别名",
+			config:   auth.AuthConfig{DisplayName: "Team A - Primary"},
+			expected: "Team A - Primary",
+		},
+		{
+			name:     "未配置别名时回退到脱敏邮箱",
+			config:   auth.AuthConfig{},
+			expected: masked,
+		},
+		{
+			name:     "空白别名视为未配置",
+			config:   auth.AuthConfig{DisplayName: "   "},
+			expected: masked,
+		},
+		{
+			name:     "别名首尾空白被去除",
+			config:   auth.AuthConfig{DisplayName: "  Team B  "},
+			expected: "Team B",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, resolveDisplayName(tt.config, masked))
+		})
+	}
+}
+
+// stallingParser 产出部分内容后卡住的解析器
+type stallingParser struct {
+	partial *parser.ParseResult
+	release chan struct{}
+}
+
+func (p *stallingParser) ParseResponse(_ []byte) (*parser.ParseResult, error) {
+	<-p.release
+	return nil, nil
+}
+
+func (p *stallingParser) PartialResult() *parser.ParseResult {
+	return p.partial
+}
+
+func runNonStreamWithStallingParser(t *testing.T, partial *parser.ParseResult) *httptest.ResponseRecorder {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("binary-event-stream"))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+
+	stalling := &stallingParser{partial: partial, release: make(chan struct{})}
+	t.Cleanup(func() { close(stalling.release) })
+
+	originalParser, originalTimeout := newNonStreamParser, nonStreamParseTimeout
+	newNonStreamParser = func() nonStreamParser { return stalling }
+	nonStreamParseTimeout = 50 * time.Millisecond
+	t.Cleanup(func() {
+		newNonStreamParser, nonStreamParseTimeout = originalParser, originalTimeout
+	})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 100,
+		Messages:  []types.AnthropicRequestMessage{{Role: "user", Content: "hello"}},
+	}
+	handleNonStreamRequest(newTestScope(c, req))
+	return w
+}
+
+func TestHandleNonStreamRequest_ParseTimeoutReturnsPartialResult(t *testing.T) {
+	partial := &parser.ParseResult{
+		Events: []parser.SSEEvent{
+			{Event: "content_block_delta", Data: map[string]any{
+				"delta": map[string]any{"type": "text_delta", "text": "已解析的部分"},
+			}},
+		},
+		ToolExecutions: map[string]*parser.ToolExecution{
+			"tooluse_1": {ID: "tooluse_1", Name: "read_file", Arguments: map[string]any{"path": "a.go"}},
+		},
+	}
+
+	w := runNonStreamWithStallingParser(t, partial)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		StopReason string           `json:"stop_reason"`
+		Warning    string           `json:"warning"`
+		Content    []map[string]any `json:"content"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	assert.Equal(t, "error", resp.StopReason)
+	assert.NotEmpty(t, resp.Warning)
+	require.Len(t, resp.Content, 2)
+	assert.Equal(t, "已解析的部分", resp.Content[0]["text"])
+	assert.Equal(t, "tool_use", resp.Content[1]["type"])
+	assert.Equal(t, "read_file", resp.Content[1]["name"])
+}
+
+func TestHandleNonStreamRequest_ParseTimeoutWithoutProgress(t *testing.T) {
+	w := runNonStreamWithStallingParser(t, nil)
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 流式响应的心跳形式（HEARTBEAT_STYLE）
+const (
+	HeartbeatStylePing    = "ping"    // Anthropic ping事件（默认）
+	HeartbeatStyleComment = "comment" // SSE注释行，解析器会忽略
+)
+
+// heartbeatComment SSE注释形式的心跳，整帧写出，不会落在事件中间
+const heartbeatComment = ": keepalive\n\n"
+
+// heartbeatStyle 当前的心跳形式（测试可替换）
+var heartbeatStyle = HeartbeatStylePing
+
+// NewHeartbeatStyleFromEnv 读取 HEARTBEAT_STYLE，无效值回退为ping
+func NewHeartbeatStyleFromEnv() string {
+	style := strings.ToLower(strings.TrimSpace(os.Getenv("HEARTBEAT_STYLE")))
+	switch style {
+	case "", HeartbeatStylePing:
+		return HeartbeatStylePing
+	case HeartbeatStyleComment:
+		return HeartbeatStyleComment
+	default:
+		logger.Warn("HEARTBEAT_STYLE无效，使用ping", logger.String("value", style))
+		return HeartbeatStylePing
+	}
+}
+
+// isHeartbeatEvent 是否为ping心跳事件
+func isHeartbeatEvent(event map[string]any) bool {
+	eventType, _ := event["type"].(string)
+	return eventType == "ping"
+}
+
+// sendHeartbeat 按配置的形式发送心跳
+// comment形式不经过状态管理器，也不登记为可续传事件（不带事件ID）
+func (ctx *StreamProcessorContext) sendHeartbeat(event map[string]any) error {
+	if heartbeatStyle == HeartbeatStyleComment {
+		return writeSSEComment(ctx.c)
+	}
+	return ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event)
+}
+
+// writeSSEComment 在事件边界之间写出一条注释心跳
+func writeSSEComment(c *gin.Context) error {
+	if _, err := io.WriteString(c.Writer, heartbeatComment); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
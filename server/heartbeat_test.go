@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withHeartbeatStyle 在测试期间设置心跳形式
+func withHeartbeatStyle(t *testing.T, style string) {
+	t.Helper()
+	original := heartbeatStyle
+	heartbeatStyle = style
+	t.Cleanup(func() { heartbeatStyle = original })
+}
+
+func runHeartbeatStream(t *testing.T) string {
+	t.Helper()
+	withStrictSSEValidation(t, StrictSSEAbort)
+	newSlowUpstream(t, 0, 0, "hello", " world")
+	c, w := newClientTimeoutContext(t, "/v1/messages", "")
+	handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+	return w.Body.String()
+}
+
+// sseFrames 按空行拆分SSE帧，并校验每一帧要么是完整的注释，要么是完整的事件
+func sseFrames(t *testing.T, body string) (comments int, eventTypes []string) {
+	t.Helper()
+	require.True(t, strings.HasSuffix(body, "\n\n"), "响应应以完整的帧结束")
+	for _, frame := range strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n") {
+		if strings.HasPrefix(frame, ":") {
+			assert.NotContains(t, frame, "\n", "注释帧不应与事件行混在一起")
+			comments++
+			continue
+		}
+		var eventType, data string
+		for _, line := range strings.Split(frame, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				eventType = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "id: "):
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			default:
+				t.Fatalf("帧中出现意外的行: %q", line)
+			}
+		}
+		var payload map[string]any
+		require.NoError(t, json.Unmarshal([]byte(data), &payload), frame)
+		assert.Equal(t, eventType, payload["type"])
+		eventTypes = append(eventTypes, eventType)
+	}
+	return comments, eventTypes
+}
+
+func TestHeartbeat_PingEventByDefault(t *testing.T) {
+	withHeartbeatStyle(t, HeartbeatStylePing)
+
+	body := runHeartbeatStream(t)
+
+	comments, events := sseFrames(t, body)
+	assert.Zero(t, comments)
+	require.GreaterOrEqual(t, len(events), 2)
+	assert.Equal(t, []string{"message_start", "ping"}, events[:2])
+	assert.Equal(t, "message_stop", events[len(events)-1])
+}
+
+func TestHeartbeat_CommentStyle(t *testing.T) {
+	withHeartbeatStyle(t, HeartbeatStyleComment)
+
+	body := runHeartbeatStream(t)
+
+	assert.Contains(t, body, "\n\n"+heartbeatComment, "注释心跳紧跟在完整事件之后")
+	comments, events := sseFrames(t, body)
+	assert.Equal(t, 1, comments)
+	assert.NotContains(t, events, "ping")
+	assert.Equal(t, "message_start", events[0])
+	assert.Contains(t, events, "content_block_delta")
+	assert.Equal(t, "message_stop", events[len(events)-1])
+}
+
+func TestNewHeartbeatStyleFromEnv(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":        HeartbeatStylePing,
+		"ping":    HeartbeatStylePing,
+		"Comment": HeartbeatStyleComment,
+		"bogus":   HeartbeatStylePing,
+	} {
+		t.Setenv("HEARTBEAT_STYLE", value)
+		assert.Equal(t, expected, NewHeartbeatStyleFromEnv(), value)
+	}
+}
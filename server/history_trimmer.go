@@ -0,0 +1,179 @@
+package server
+
+import (
+	"os"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 对话历史裁剪模式
+const (
+	HistoryTrimOff    = ""       // 不裁剪（默认）
+	HistoryTrimTurns  = "turns"  // 保留最近N轮对话
+	HistoryTrimTokens = "tokens" // 保留在token预算内的最近对话
+)
+
+// HistoryTrimmer 在转发上游前裁剪过长的对话历史
+// system和tools始终保留；裁剪只发生在"轮"的边界上（不含tool_result的user消息），
+// 保证tool_use/tool_result不会被拆开，且最后一轮始终保留
+type HistoryTrimmer struct {
+	Mode      string
+	MaxTurns  int
+	MaxTokens int
+}
+
+// historyTrimmer 全局裁剪器，nil表示未启用
+var historyTrimmer *HistoryTrimmer
+
+// NewHistoryTrimmerFromEnv 根据环境变量创建裁剪器，未启用时返回nil
+// HISTORY_TRIM_MODE: turns / tokens
+// HISTORY_MAX_TURNS: turns模式保留的轮数（默认20）
+// HISTORY_MAX_TOKENS: tokens模式的token预算（默认150000）
+func NewHistoryTrimmerFromEnv() *HistoryTrimmer {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("HISTORY_TRIM_MODE")))
+	switch mode {
+	case HistoryTrimTurns, HistoryTrimTokens:
+	case HistoryTrimOff:
+		return nil
+	default:
+		logger.Warn("未知的HISTORY_TRIM_MODE，已禁用历史裁剪", logger.String("mode", mode))
+		return nil
+	}
+
+	return &HistoryTrimmer{
+		Mode:      mode,
+		MaxTurns:  utils.GetEnvIntWithDefault("HISTORY_MAX_TURNS", 20),
+		MaxTokens: utils.GetEnvIntWithDefault("HISTORY_MAX_TOKENS", 150000),
+	}
+}
+
+// Trim 返回裁剪后的请求，不修改原请求；第二个返回值表示是否发生了裁剪
+func (ht *HistoryTrimmer) Trim(req types.AnthropicRequest) (types.AnthropicRequest, bool) {
+	cut, _ := ht.trim(req)
+	if cut == 0 {
+		return req, false
+	}
+
+	trimmed := req
+	trimmed.Messages = req.Messages[cut:]
+	return trimmed, true
+}
+
+// trim 返回保留消息的起始下标（0表示不裁剪），以及裁剪时按消息估算的token数（供日志使用）
+func (ht *HistoryTrimmer) trim(req types.AnthropicRequest) (int, historyTokens) {
+	if ht == nil {
+		return 0, historyTokens{}
+	}
+
+	starts := turnStartIndexes(req.Messages)
+	if len(starts) <= 1 {
+		return 0, historyTokens{}
+	}
+
+	switch ht.Mode {
+	case HistoryTrimTurns:
+		if ht.MaxTurns > 0 && len(starts) > ht.MaxTurns {
+			cut := starts[len(starts)-ht.MaxTurns]
+			return cut, estimateHistoryTokens(req)
+		}
+	case HistoryTrimTokens:
+		tokens := estimateHistoryTokens(req)
+		if tokens.from(0) <= ht.MaxTokens {
+			return 0, historyTokens{}
+		}
+		// 从最早的轮次开始尝试，找到第一个满足预算的起点；都不满足时只保留最后一轮
+		for _, start := range starts[1:] {
+			if tokens.from(start) <= ht.MaxTokens {
+				return start, tokens
+			}
+		}
+		return starts[len(starts)-1], tokens
+	}
+	return 0, historyTokens{}
+}
+
+// turnStartIndexes 返回每一轮对话起始消息的下标
+// 一轮以不含tool_result的user消息开始，从这里截断不会留下孤立的tool_result
+func turnStartIndexes(messages []types.AnthropicRequestMessage) []int {
+	var starts []int
+	for i, msg := range messages {
+		if msg.Role == "user" && !hasToolResult(msg.Content) {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
+
+// hasToolResult 检查消息内容中是否包含tool_result块
+func hasToolResult(content any) bool {
+	blocks, ok := content.([]any)
+	if !ok {
+		return false
+	}
+	for _, block := range blocks {
+		if blockMap, ok := block.(map[string]any); ok && blockMap["type"] == "tool_result" {
+			return true
+		}
+	}
+	return false
+}
+
+// historyTokens 按消息分别估算的请求输入token数，每条消息只估算一次
+// 估算器对system、tools和各条消息逐项累加，保留任意后缀时的token数等于固定部分加上后缀各消息之和
+type historyTokens struct {
+	base   int   // system、tools和请求固定开销
+	suffix []int // suffix[i]为第i条及之后消息的token数之和
+}
+
+// estimateHistoryTokens 估算请求的固定部分和每条消息的token数
+func estimateHistoryTokens(req types.AnthropicRequest) historyTokens {
+	estimator := utils.NewTokenEstimator()
+	empty := estimator.EstimateTokens(&types.CountTokensRequest{Model: req.Model})
+	tokens := historyTokens{
+		base: estimator.EstimateTokens(&types.CountTokensRequest{
+			Model:  req.Model,
+			System: req.System,
+			Tools:  req.Tools,
+		}),
+		suffix: make([]int, len(req.Messages)+1),
+	}
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		message := estimator.EstimateTokens(&types.CountTokensRequest{
+			Model:    req.Model,
+			Messages: req.Messages[i : i+1],
+		}) - empty
+		tokens.suffix[i] = tokens.suffix[i+1] + message
+	}
+	return tokens
+}
+
+// from 从第start条消息开始保留时请求的token数
+func (t historyTokens) from(start int) int {
+	return t.base + t.suffix[start]
+}
+
+// trimHistory 对请求应用全局裁剪策略并记录日志
+func trimHistory(c *gin.Context, req types.AnthropicRequest) types.AnthropicRequest {
+	cut, tokens := historyTrimmer.trim(req)
+	if cut == 0 {
+		return req
+	}
+	trimmed := req
+	trimmed.Messages = req.Messages[cut:]
+	c.Set("original_message_count", len(req.Messages))
+
+	logger.Info("对话历史已裁剪",
+		addReqFields(c,
+			logger.String("mode", historyTrimmer.Mode),
+			logger.Int("original_messages", len(req.Messages)),
+			logger.Int("kept_messages", len(trimmed.Messages)),
+			logger.Int("estimated_tokens_before", tokens.from(0)),
+			logger.Int("estimated_tokens_after", tokens.from(cut)),
+		)...)
+	return trimmed
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildConversation 构造n轮 user/assistant 对话，每条消息约含 words 个单词
+func buildConversation(turns, words int) []types.AnthropicRequestMessage {
+	var messages []types.AnthropicRequestMessage
+	for i := 0; i < turns; i++ {
+		filler := strings.Repeat("word ", words)
+		messages = append(messages,
+			types.AnthropicRequestMessage{Role: "user", Content: fmt.Sprintf("question %d %s", i, filler)},
+			types.AnthropicRequestMessage{Role: "assistant", Content: fmt.Sprintf("answer %d %s", i, filler)},
+		)
+	}
+	return messages
+}
+
+func newTrimTestRequest(messages []types.AnthropicRequestMessage) types.AnthropicRequest {
+	return types.AnthropicRequest{
+		Model:    "claude-sonnet-4-20250514",
+		System:   []types.AnthropicSystemMessage{{Type: "text", Text: "You are a helpful assistant."}},
+		Messages: messages,
+	}
+}
+
+// estimateRequestTokens 整体估算使用指定消息列表时请求的输入token数，作为按消息累加结果的参照
+func estimateRequestTokens(req types.AnthropicRequest, messages []types.AnthropicRequestMessage) int {
+	return utils.NewTokenEstimator().EstimateTokens(&types.CountTokensRequest{
+		Model:    req.Model,
+		System:   req.System,
+		Messages: messages,
+		Tools:    req.Tools,
+	})
+}
+
+func TestEstimateHistoryTokens_MatchesWholeRequestEstimate(t *testing.T) {
+	messages := append(buildConversation(3, 20), types.AnthropicRequestMessage{Role: "user", Content: []any{
+		map[string]any{"type": "text", "text": "use the tool"},
+		map[string]any{"type": "tool_result", "tool_use_id": "tooluse_1", "content": "file content"},
+	}})
+	req := newTrimTestRequest(messages)
+	req.Tools = []types.AnthropicTool{{
+		Name:        "read_file",
+		Description: "Read a file",
+		InputSchema: map[string]any{"type": "object", "properties": map[string]any{"path": map[string]any{"type": "string"}}},
+	}}
+
+	tokens := estimateHistoryTokens(req)
+	for start := 0; start <= len(req.Messages); start++ {
+		assert.Equal(t, estimateRequestTokens(req, req.Messages[start:]), tokens.from(start), "start=%d", start)
+	}
+}
+
+func TestHistoryTrimmer_Nil(t *testing.T) {
+	var ht *HistoryTrimmer
+	req := newTrimTestRequest(buildConversation(5, 1))
+	trimmed, changed := ht.Trim(req)
+	assert.False(t, changed)
+	assert.Len(t, trimmed.Messages, 10)
+}
+
+func TestHistoryTrimmer_KeepsLastNTurns(t *testing.T) {
+	ht := &HistoryTrimmer{Mode: HistoryTrimTurns, MaxTurns: 2}
+	req := newTrimTestRequest(append(buildConversation(5, 1),
+		types.AnthropicRequestMessage{Role: "user", Content: "final question"}))
+
+	trimmed, changed := ht.Trim(req)
+
+	require.True(t, changed)
+	require.Len(t, trimmed.Messages, 3)
+	assert.Contains(t, trimmed.Messages[0].Content, "question 4")
+	assert.Equal(t, "final question", trimmed.Messages[2].Content)
+	assert.Equal(t, req.System, trimmed.System, "system应始终保留")
+	assert.Len(t, req.Messages, 11, "原请求不应被修改")
+}
+
+func TestHistoryTrimmer_DoesNotSplitToolResult(t *testing.T) {
+	ht := &HistoryTrimmer{Mode: HistoryTrimTurns, MaxTurns: 1}
+	messages := []types.AnthropicRequestMessage{
+		{Role: "user", Content: "old question"},
+		{Role: "assistant", Content: "old answer"},
+		{Role: "user", Content: "read the file"},
+		{Role: "assistant", Content: []any{
+			map[string]any{"type": "tool_use", "id": "tooluse_1", "name": "read_file", "input": map[string]any{}},
+		}},
+		{Role: "user", Content: []any{
+			map[string]any{"type": "tool_result", "tool_use_id": "tooluse_1", "content": "file content"},
+		}},
+	}
+
+	trimmed, changed := ht.Trim(newTrimTestRequest(messages))
+
+	require.True(t, changed)
+	require.Len(t, trimmed.Messages, 3, "tool_result所在轮次应从对应的user提问开始保留")
+	assert.Equal(t, "read the file", trimmed.Messages[0].Content)
+}
+
+func TestHistoryTrimmer_RespectsTokenBudget(t *testing.T) {
+	req := newTrimTestRequest(buildConversation(10, 200))
+	total := estimateRequestTokens(req, req.Messages)
+
+	budget := total / 3
+	ht := &HistoryTrimmer{Mode: HistoryTrimTokens, MaxTokens: budget}
+	trimmed, changed := ht.Trim(req)
+
+	require.True(t, changed)
+	assert.LessOrEqual(t, estimateRequestTokens(trimmed, trimmed.Messages), budget)
+	assert.Equal(t, "user", trimmed.Messages[0].Role)
+	assert.Equal(t, req.Messages[len(req.Messages)-1], trimmed.Messages[len(trimmed.Messages)-1], "最近的消息应保留")
+
+	// 多保留一轮就会超出预算，说明保留的是预算内尽可能多的历史
+	kept := len(trimmed.Messages)
+	withOneMore := req.Messages[len(req.Messages)-kept-2:]
+	assert.Greater(t, estimateRequestTokens(req, withOneMore), budget)
+}
+
+func TestHistoryTrimmer_TokenBudgetWithinLimit(t *testing.T) {
+	req := newTrimTestRequest(buildConversation(3, 1))
+	ht := &HistoryTrimmer{Mode: HistoryTrimTokens, MaxTokens: 100000}
+
+	trimmed, changed := ht.Trim(req)
+	assert.False(t, changed)
+	assert.Len(t, trimmed.Messages, 6)
+}
+
+func TestHistoryTrimmer_TokenBudgetKeepsLastTurnWhenExceeded(t *testing.T) {
+	req := newTrimTestRequest(buildConversation(3, 200))
+	ht := &HistoryTrimmer{Mode: HistoryTrimTokens, MaxTokens: 1}
+
+	trimmed, changed := ht.Trim(req)
+	require.True(t, changed)
+	assert.Len(t, trimmed.Messages, 2, "预算过小时至少保留最后一轮")
+}
+
+func TestNewHistoryTrimmerFromEnv(t *testing.T) {
+	t.Setenv("HISTORY_TRIM_MODE", "")
+	assert.Nil(t, NewHistoryTrimmerFromEnv(), "默认关闭")
+
+	t.Setenv("HISTORY_TRIM_MODE", "turns")
+	t.Setenv("HISTORY_MAX_TURNS", "8")
+	ht := NewHistoryTrimmerFromEnv()
+	require.NotNil(t, ht)
+	assert.Equal(t, HistoryTrimTurns, ht.Mode)
+	assert.Equal(t, 8, ht.MaxTurns)
+
+	t.Setenv("HISTORY_TRIM_MODE", "bogus")
+	assert.Nil(t, NewHistoryTrimmerFromEnv())
+}
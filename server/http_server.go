@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HTTPServerConfig HTTP服务器的连接超时与协议设置
+type HTTPServerConfig struct {
+	ReadHeaderTimeout time.Duration // 读取请求头的上限，0表示不限制
+	WriteTimeout      time.Duration // 非流式响应的写出上限，流式响应开始时清除；0表示不限制
+	IdleTimeout       time.Duration // keep-alive空闲连接的回收时间，0表示不限制
+
+	H2C         bool   // 明文端口同时接受HTTP/2（h2c，prior knowledge）
+	TLSCertFile string // 同时设置证书和私钥时使用HTTPS，自动协商HTTP/2
+	TLSKeyFile  string
+}
+
+// NewHTTPServerConfigFromEnv 根据环境变量创建服务器配置
+// SERVER_READ_HEADER_TIMEOUT（默认10s）、SERVER_WRITE_TIMEOUT（默认15m）、SERVER_IDLE_TIMEOUT（默认120s）：
+// Go duration格式或秒数，0表示不限制
+// SERVER_H2C: "true"时明文端口接受HTTP/2；TLS_CERT_FILE / TLS_KEY_FILE: 启用HTTPS
+func NewHTTPServerConfigFromEnv() HTTPServerConfig {
+	return HTTPServerConfig{
+		ReadHeaderTimeout: serverTimeoutFromEnv("SERVER_READ_HEADER_TIMEOUT", config.DefaultServerReadHeaderTimeout),
+		WriteTimeout:      serverTimeoutFromEnv("SERVER_WRITE_TIMEOUT", config.DefaultServerWriteTimeout),
+		IdleTimeout:       serverTimeoutFromEnv("SERVER_IDLE_TIMEOUT", config.DefaultServerIdleTimeout),
+		H2C:               strings.EqualFold(strings.TrimSpace(os.Getenv("SERVER_H2C")), "true"),
+		TLSCertFile:       strings.TrimSpace(os.Getenv("TLS_CERT_FILE")),
+		TLSKeyFile:        strings.TrimSpace(os.Getenv("TLS_KEY_FILE")),
+	}
+}
+
+// serverTimeoutFromEnv 读取非负时长（Go duration格式或秒数），无效时使用默认值
+func serverTimeoutFromEnv(name string, defaultValue time.Duration) time.Duration {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return defaultValue
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if parsed, err := time.ParseDuration(value); err == nil && parsed >= 0 {
+		return parsed
+	}
+	logger.Warn(name+"无效，使用默认值",
+		logger.String("value", value),
+		logger.Duration("default", defaultValue))
+	return defaultValue
+}
+
+// TLSEnabled 是否同时配置了证书和私钥
+func (cfg HTTPServerConfig) TLSEnabled() bool {
+	return cfg.TLSCertFile != "" && cfg.TLSKeyFile != ""
+}
+
+// NewHTTPServer 按配置创建HTTP服务器
+// HTTPS下HTTP/2由TLS协商自动启用；明文端口只有SERVER_H2C=true时才接受HTTP/2
+func NewHTTPServer(addr string, handler http.Handler, cfg HTTPServerConfig) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	if cfg.H2C {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return server
+}
+
+// serveHTTP 按配置以HTTP或HTTPS启动服务器
+func serveHTTP(server *http.Server, cfg HTTPServerConfig) error {
+	if cfg.TLSEnabled() {
+		return server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// disableWriteDeadline 清除连接的写超时，流式响应的时长由客户端超时和上游决定，不受SERVER_WRITE_TIMEOUT限制
+func disableWriteDeadline(c *gin.Context) {
+	err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Warn("清除流式响应的写超时失败", addReqFields(c, logger.Err(err))...)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTTPServerConfigFromEnv(t *testing.T) {
+	for _, name := range []string{"SERVER_READ_HEADER_TIMEOUT", "SERVER_WRITE_TIMEOUT", "SERVER_IDLE_TIMEOUT", "SERVER_H2C", "TLS_CERT_FILE", "TLS_KEY_FILE"} {
+		t.Setenv(name, "")
+	}
+	cfg := NewHTTPServerConfigFromEnv()
+	assert.Equal(t, HTTPServerConfig{
+		ReadHeaderTimeout: config.DefaultServerReadHeaderTimeout,
+		WriteTimeout:      config.DefaultServerWriteTimeout,
+		IdleTimeout:       config.DefaultServerIdleTimeout,
+	}, cfg)
+	assert.False(t, cfg.TLSEnabled())
+
+	t.Setenv("SERVER_READ_HEADER_TIMEOUT", "5")
+	t.Setenv("SERVER_WRITE_TIMEOUT", "0")
+	t.Setenv("SERVER_IDLE_TIMEOUT", "90s")
+	t.Setenv("SERVER_H2C", "TRUE")
+	t.Setenv("TLS_CERT_FILE", "/etc/kiro2api/cert.pem")
+	cfg = NewHTTPServerConfigFromEnv()
+	assert.Equal(t, 5*time.Second, cfg.ReadHeaderTimeout)
+	assert.Zero(t, cfg.WriteTimeout, "0表示不限制")
+	assert.Equal(t, 90*time.Second, cfg.IdleTimeout)
+	assert.True(t, cfg.H2C)
+	assert.False(t, cfg.TLSEnabled(), "证书和私钥都设置时才启用HTTPS")
+
+	t.Setenv("SERVER_IDLE_TIMEOUT", "-1s")
+	assert.Equal(t, config.DefaultServerIdleTimeout, NewHTTPServerConfigFromEnv().IdleTimeout, "无效值使用默认值")
+}
+
+func TestNewHTTPServer_AppliesTimeouts(t *testing.T) {
+	cfg := HTTPServerConfig{ReadHeaderTimeout: time.Second, WriteTimeout: 2 * time.Second, IdleTimeout: 3 * time.Second}
+	server := NewHTTPServer(":8080", http.NotFoundHandler(), cfg)
+	assert.Equal(t, ":8080", server.Addr)
+	assert.Equal(t, time.Second, server.ReadHeaderTimeout)
+	assert.Equal(t, 2*time.Second, server.WriteTimeout)
+	assert.Equal(t, 3*time.Second, server.IdleTimeout)
+	assert.Nil(t, server.Protocols, "未启用h2c时使用默认协议（HTTPS下自动协商HTTP/2）")
+
+	cfg.H2C = true
+	server = NewHTTPServer(":8080", http.NotFoundHandler(), cfg)
+	require.NotNil(t, server.Protocols)
+	assert.True(t, server.Protocols.HTTP1())
+	assert.True(t, server.Protocols.UnencryptedHTTP2())
+}
+
+// startTimeoutTestServer 用真实连接启动服务器，流式与非流式端点都经由上游代理
+func startTimeoutTestServer(t *testing.T, cfg HTTPServerConfig) *httptest.Server {
+	router := gin.New()
+	router.POST("/v1/messages", func(c *gin.Context) {
+		req := newStopTestRequest(c.Query("stream") == "true")
+		if req.Stream {
+			handleStreamRequest(newTestScope(c, req))
+			return
+		}
+		handleNonStreamRequest(newTestScope(c, req))
+	})
+	router.POST("/v1/chat/completions", func(c *gin.Context) {
+		handleOpenAIStreamRequest(newTestScope(c, newStopTestRequest(true)))
+	})
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = NewHTTPServer("", router, cfg)
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestHTTPServer_WriteTimeoutSparesStreaming(t *testing.T) {
+	// 上游在首个增量后停顿，总时长超过写超时
+	newSlowUpstream(t, 0, 400*time.Millisecond, "hello", " world")
+	ts := startTimeoutTestServer(t, HTTPServerConfig{ReadHeaderTimeout: time.Second, WriteTimeout: 150 * time.Millisecond})
+
+	for _, path := range []string{"/v1/messages?stream=true", "/v1/chat/completions"} {
+		resp, err := http.Post(ts.URL+path, "application/json", nil)
+		require.NoError(t, err, path)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err, "流式响应不受写超时限制: %s", path)
+		assert.Contains(t, string(body), "world", path)
+	}
+
+	// 非流式响应超过写超时后连接被中断
+	resp, err := http.Post(ts.URL+"/v1/messages", "application/json", nil)
+	if err == nil {
+		body, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.True(t, readErr != nil || !strings.Contains(string(body), "world"), "非流式响应应被写超时截断: %s", body)
+	}
+}
+
+func TestHTTPServer_H2CStreaming(t *testing.T) {
+	newSlowUpstream(t, 0, 0, "hello", " world")
+	ts := startTimeoutTestServer(t, HTTPServerConfig{ReadHeaderTimeout: time.Second, WriteTimeout: time.Minute, H2C: true})
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	resp, err := client.Post(ts.URL+"/v1/messages?stream=true", "application/json", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor, "明文端口通过h2c使用HTTP/2")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "message_stop")
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+
+	"kiro2api/logger"
+	"kiro2api/utils"
+)
+
+// invalidJSONStreamMessage JSON校验失败时发送给客户端的错误信息
+const invalidJSONStreamMessage = "上游输出不是合法的JSON对象，已中止流式响应"
+
+// streamJSONValidation 是否对json_object模式的流式输出做增量结构校验（测试可替换）
+var streamJSONValidation bool
+
+// NewStreamJSONValidationFromEnv STREAM_JSON_VALIDATION=true 时启用（默认关闭）
+func NewStreamJSONValidationFromEnv() bool {
+	enabled := utils.GetEnvBool("STREAM_JSON_VALIDATION")
+	if enabled {
+		logger.Info("已启用json_object流式输出的JSON结构校验")
+	}
+	return enabled
+}
+
+// StreamingJSONValidator 增量检查流式输出的JSON结构
+// 只跟踪括号配对、字符串和转义状态，发现明确无法修复的结构错误时返回错误；
+// 不校验字面量和数字，未闭合的结构视为尚未输出完毕
+type StreamingJSONValidator struct {
+	closers  []byte // 尚未闭合的括号期望的闭合字符
+	started  bool   // 已出现顶层值的起始字符
+	finished bool   // 顶层对象已闭合
+	inString bool
+	escaped  bool
+	offset   int // 已校验的字节数，用于错误定位
+}
+
+// NewStreamingJSONValidator 创建JSON对象校验器
+func NewStreamingJSONValidator() *StreamingJSONValidator {
+	return &StreamingJSONValidator{}
+}
+
+// Feed 校验下一段文本，结构已损坏时返回错误（之后的结果无意义）
+func (v *StreamingJSONValidator) Feed(text string) error {
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		position := v.offset + i
+
+		if v.inString {
+			switch {
+			case v.escaped:
+				v.escaped = false
+			case ch == '\\':
+				v.escaped = true
+			case ch == '"':
+				v.inString = false
+			}
+			continue
+		}
+
+		if isJSONWhitespace(ch) {
+			continue
+		}
+		if v.finished {
+			return fmt.Errorf("JSON对象结束后出现多余内容 %q（位置 %d）", ch, position)
+		}
+		if !v.started {
+			// json_object模式要求顶层为对象
+			if ch != '{' {
+				return fmt.Errorf("JSON对象应以 '{' 开头，实际为 %q（位置 %d）", ch, position)
+			}
+			v.started = true
+		}
+
+		switch ch {
+		case '"':
+			v.inString = true
+		case '{':
+			v.closers = append(v.closers, '}')
+		case '[':
+			v.closers = append(v.closers, ']')
+		case '}', ']':
+			if len(v.closers) == 0 {
+				return fmt.Errorf("多余的闭合括号 %q（位置 %d）", ch, position)
+			}
+			expected := v.closers[len(v.closers)-1]
+			if ch != expected {
+				return fmt.Errorf("括号不匹配：期望 %q，实际为 %q（位置 %d）", expected, ch, position)
+			}
+			v.closers = v.closers[:len(v.closers)-1]
+			if len(v.closers) == 0 {
+				v.finished = true
+			}
+		}
+	}
+	v.offset += len(text)
+	return nil
+}
+
+// Complete 顶层对象是否已闭合
+func (v *StreamingJSONValidator) Complete() bool {
+	return v.finished
+}
+
+func isJSONWhitespace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withStreamJSONValidation 替换全局JSON校验开关，测试结束后恢复
+func withStreamJSONValidation(t *testing.T, enabled bool) {
+	t.Helper()
+	original := streamJSONValidation
+	streamJSONValidation = enabled
+	t.Cleanup(func() { streamJSONValidation = original })
+}
+
+func TestStreamingJSONValidator(t *testing.T) {
+	valid := [][]string{
+		{`{"a": 1}`},
+		{`  {"a"`, `: [1, {"b": "}]"}`, `]}`, "\n"},
+		{`{"text": "escaped \"`, `}\" quote"}`},
+		{`{"unfinished": [1, 2`},
+	}
+	for _, chunks := range valid {
+		v := NewStreamingJSONValidator()
+		for _, chunk := range chunks {
+			assert.NoError(t, v.Feed(chunk), strings.Join(chunks, ""))
+		}
+	}
+
+	invalid := map[string][]string{
+		"多余的闭合括号":  {`{"a": 1}`, `}`},
+		"括号不匹配":    {`{"a": [1`, `}`},
+		"不以对象开头":   {`Sure! {"a": 1}`},
+		"数组不是对象":   {`[1, 2]`},
+		"对象后有多余内容": {`{"a": 1}`, "\n\nHope this helps"},
+	}
+	for name, chunks := range invalid {
+		v := NewStreamingJSONValidator()
+		var err error
+		for _, chunk := range chunks {
+			if err = v.Feed(chunk); err != nil {
+				break
+			}
+		}
+		assert.Error(t, err, name)
+	}
+
+	v := NewStreamingJSONValidator()
+	require.NoError(t, v.Feed(`{"a": {`))
+	assert.False(t, v.Complete())
+	require.NoError(t, v.Feed(`}}`))
+	assert.True(t, v.Complete())
+}
+
+// runJSONObjectStream 以json_object模式执行OpenAI流式请求，返回下发的文本、是否收到错误事件和[DONE]
+func runJSONObjectStream(t *testing.T) (string, bool, bool) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	req := newStopTestRequest(true)
+	req.ResponseFormat = types.ResponseFormatJSONObject
+	handleOpenAIStreamRequest(newTestScope(c, req))
+
+	var content strings.Builder
+	sawError, sawDone := false, false
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			sawDone = true
+			continue
+		}
+		var chunk struct {
+			Error   *struct{ Message string } `json:"error"`
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		require.NoError(t, utils.SafeUnmarshal([]byte(data), &chunk))
+		if chunk.Error != nil {
+			assert.Equal(t, invalidJSONStreamMessage, chunk.Error.Message)
+			sawError = true
+		}
+		for _, choice := range chunk.Choices {
+			content.WriteString(choice.Delta.Content)
+		}
+	}
+	return content.String(), sawError, sawDone
+}
+
+func TestOpenAIStream_JSONValidationAbortsEarly(t *testing.T) {
+	withStreamJSONValidation(t, true)
+	newTextDeltaUpstream(t, `{"name": "Alice", `, `"tags": ["a"}`, `, "more": "should not appear"}`)
+
+	content, sawError, sawDone := runJSONObjectStream(t)
+
+	// 损坏的delta及之后的内容都不下发
+	assert.Equal(t, `{"name": "Alice", `, content)
+	assert.True(t, sawError, "应发送错误事件")
+	assert.False(t, sawDone, "提前中止时不发送[DONE]")
+}
+
+func TestOpenAIStream_JSONValidationPassthrough(t *testing.T) {
+	deltas := []string{`{"name": "Alice", `, `"tags": ["a"}`, `, "more": 1}`}
+
+	t.Run("未启用", func(t *testing.T) {
+		withStreamJSONValidation(t, false)
+		newTextDeltaUpstream(t, deltas...)
+
+		content, sawError, sawDone := runJSONObjectStream(t)
+		assert.Equal(t, strings.Join(deltas, ""), content)
+		assert.False(t, sawError)
+		assert.True(t, sawDone)
+	})
+
+	t.Run("合法JSON", func(t *testing.T) {
+		withStreamJSONValidation(t, true)
+		newTextDeltaUpstream(t, `{"name": "Alice", `, `"tags": ["a"]}`)
+
+		content, sawError, sawDone := runJSONObjectStream(t)
+		assert.Equal(t, `{"name": "Alice", "tags": ["a"]}`, content)
+		assert.False(t, sawError)
+		assert.True(t, sawDone)
+	})
+}
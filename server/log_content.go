@@ -0,0 +1,49 @@
+package server
+
+import (
+	"crypto/subtle"
+
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderLogContent 管理员为单个请求覆盖内容记录策略（none/truncated/hashed/full），用于排查问题
+const HeaderLogContent = "X-Kiro-Log-Content"
+
+// logContentPolicyKey gin上下文中本次请求覆盖后的内容记录策略
+const logContentPolicyKey = "log_content_policy"
+
+// LogContentOverrideMiddleware 只有携带管理令牌的请求可以通过 X-Kiro-Log-Content 覆盖 LOG_CONTENT_POLICY，
+// 其余请求忽略该头，按全局策略记录内容
+func LogContentOverrideMiddleware(adminToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw := c.GetHeader(HeaderLogContent)
+		if raw == "" {
+			c.Next()
+			return
+		}
+		policy, ok := logger.ParseContentPolicy(raw)
+		if !ok || adminToken == "" || subtle.ConstantTimeCompare([]byte(extractAPIKey(c)), []byte(adminToken)) != 1 {
+			logger.Warn("忽略内容记录策略覆盖：取值无效或未携带管理令牌",
+				addReqFields(c, logger.String("value", raw))...)
+			c.Next()
+			return
+		}
+		auditLog(c, "log_content_override",
+			logger.String("policy", policy),
+			logger.String("path", c.Request.URL.Path))
+		c.Set(logContentPolicyKey, policy)
+		c.Next()
+	}
+}
+
+// logContent 记录请求/响应内容，优先使用管理员为本次请求设置的策略
+func logContent(c *gin.Context, key string, val any) logger.Field {
+	if c != nil {
+		if policy := c.GetString(logContentPolicyKey); policy != "" {
+			return logger.ContentAs(policy, key, val)
+		}
+	}
+	return logger.Content(key, val)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLogs 将日志写入临时文件并使用指定的内容记录策略，返回读取日志的函数
+func captureLogs(t *testing.T, policy string) func() string {
+	t.Cleanup(logger.Reinitialize) // 在恢复环境变量之后执行
+	path := filepath.Join(t.TempDir(), "kiro2api.log")
+	t.Setenv("LOG_FILE", path)
+	t.Setenv("LOG_CONSOLE", "false")
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("LOG_CONTENT_POLICY", policy)
+	logger.Reinitialize()
+	return func() string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(data)
+	}
+}
+
+func TestLogContentOverrideMiddleware(t *testing.T) {
+	var seen string
+	router := gin.New()
+	router.Use(LogContentOverrideMiddleware("admin-token"))
+	router.POST("/v1/messages", func(c *gin.Context) {
+		seen = c.GetString(logContentPolicyKey)
+		c.Status(http.StatusOK)
+	})
+	send := func(token, policy string) string {
+		seen = ""
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/messages", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(HeaderLogContent, policy)
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, "覆盖头不影响请求本身")
+		return seen
+	}
+
+	assert.Equal(t, logger.ContentFull, send("admin-token", "FULL"))
+	assert.Empty(t, send("client-token", "full"), "普通客户端不能覆盖策略")
+	assert.Empty(t, send("admin-token", "everything"))
+	assert.Empty(t, send("admin-token", ""))
+}
+
+func TestLogContent_UsesRequestOverride(t *testing.T) {
+	captureLogs(t, logger.ContentHashed)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	assert.Equal(t, logger.ContentAs(logger.ContentHashed, "body", "hello"), logContent(c, "body", "hello"))
+
+	c.Set(logContentPolicyKey, logger.ContentFull)
+	assert.Equal(t, "hello", logContent(c, "body", []byte("hello")).Value)
+	assert.Equal(t, logger.ContentAs(logger.ContentHashed, "body", "hello"), logContent(nil, "body", "hello"))
+}
+
+// 完整的非流式请求链路（请求体、上游请求、下发内容）在hashed策略下不输出原始提示词
+func TestHashedLogContent_NoRawPromptInRequestLogs(t *testing.T) {
+	readLogs := captureLogs(t, logger.ContentHashed)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"Atlantis could not be found; Paris is 25°C."}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+
+	body, err := normalizeAnthropicRequestBody([]byte(errorToolResultRequest))
+	require.NoError(t, err)
+	var req types.AnthropicRequest
+	require.NoError(t, utils.SafeUnmarshal(body, &req))
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	req, ok := normalizeConversation(c, req)
+	require.True(t, ok)
+	handleNonStreamRequest(newTestScope(c, req))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), "Paris is 25°C")
+
+	logs := readLogs()
+	require.Contains(t, logs, `"request_body":{"sha256":"`)
+	require.Contains(t, logs, `"contexts":{"sha256":"`)
+	for _, raw := range []string{"weather in Atlantis", "city not found", "Paris is 25°C"} {
+		assert.NotContains(t, logs, raw)
+	}
+}
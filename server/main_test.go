@@ -0,0 +1,17 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	// 块生命周期不变量被破坏说明状态管理器有缺陷，测试中直接失败而不只是记录日志
+	sseInvariantViolation = func(_ *gin.Context, message string) {
+		panic(fmt.Sprintf("SSE块生命周期不变量被破坏: %s", message))
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"kiro2api/logger"
+	"kiro2api/parser"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上游在同一响应中返回多条assistant消息时的处理策略
+const (
+	MessageBoundaryTruncate = "truncate" // 在第一条消息结束处截断，丢弃后续内容（默认）
+	MessageBoundaryMerge    = "merge"    // 用分隔符拼接为一条消息
+)
+
+// defaultMessageBoundarySeparator merge策略的默认分隔符
+const defaultMessageBoundarySeparator = "\n\n"
+
+// MessageBoundaryPolicy 消息边界处理策略
+type MessageBoundaryPolicy struct {
+	Mode      string
+	Separator string
+}
+
+// messageBoundaryPolicy 全局消息边界策略
+var messageBoundaryPolicy = &MessageBoundaryPolicy{
+	Mode:      MessageBoundaryTruncate,
+	Separator: defaultMessageBoundarySeparator,
+}
+
+// NewMessageBoundaryPolicyFromEnv 根据环境变量创建消息边界策略
+// MESSAGE_BOUNDARY_POLICY: truncate / merge（默认truncate）
+// MESSAGE_BOUNDARY_SEPARATOR: merge模式的分隔符（默认两个换行）
+func NewMessageBoundaryPolicyFromEnv() *MessageBoundaryPolicy {
+	policy := &MessageBoundaryPolicy{
+		Mode:      MessageBoundaryTruncate,
+		Separator: defaultMessageBoundarySeparator,
+	}
+
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("MESSAGE_BOUNDARY_POLICY"))); mode {
+	case "", MessageBoundaryTruncate:
+	case MessageBoundaryMerge:
+		policy.Mode = MessageBoundaryMerge
+	default:
+		logger.Warn("未知的MESSAGE_BOUNDARY_POLICY，使用truncate", logger.String("policy", mode))
+	}
+
+	if separator, ok := os.LookupEnv("MESSAGE_BOUNDARY_SEPARATOR"); ok {
+		policy.Separator = separator
+	}
+	return policy
+}
+
+// StreamStats 上游响应流的统计计数
+type StreamStats struct {
+	MessageBoundaries atomic.Int64 // 检测到的多消息响应次数
+	MergedMessages    atomic.Int64 // 按merge策略拼接的消息数
+	DiscardedMessages atomic.Int64 // 按truncate策略丢弃的消息数
+	UnknownBlocks     atomic.Int64 // 收到的未知内容块数
+
+	mutex             sync.Mutex
+	unknownBlockTypes map[string]int64 // 按类型统计的未知内容块数，便于发现上游新特性
+}
+
+// RecordUnknownBlock 记录一个未知内容块
+func (s *StreamStats) RecordUnknownBlock(blockType string) {
+	s.UnknownBlocks.Add(1)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.unknownBlockTypes == nil {
+		s.unknownBlockTypes = make(map[string]int64)
+	}
+	s.unknownBlockTypes[blockType]++
+}
+
+// UnknownBlockTypes 返回按类型统计的未知内容块数副本
+func (s *StreamStats) UnknownBlockTypes() map[string]int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	counts := make(map[string]int64, len(s.unknownBlockTypes))
+	for blockType, count := range s.unknownBlockTypes {
+		counts[blockType] = count
+	}
+	return counts
+}
+
+// streamStats 全局流统计
+var streamStats = &StreamStats{}
+
+// recordBoundary 记录一次消息边界并返回是否应截断
+func (p *MessageBoundaryPolicy) recordBoundary(c *gin.Context, dataMap map[string]any) bool {
+	streamStats.MessageBoundaries.Add(1)
+
+	previous, _ := dataMap["previous_message_id"].(string)
+	current, _ := dataMap["message_id"].(string)
+	fields := addReqFields(c,
+		logger.String("policy", p.Mode),
+		logger.String("previous_message_id", previous),
+		logger.String("message_id", current))
+
+	if p.Mode == MessageBoundaryMerge {
+		streamStats.MergedMessages.Add(1)
+		logger.Warn("上游响应包含多条assistant消息，已合并", fields...)
+		return false
+	}
+
+	streamStats.DiscardedMessages.Add(1)
+	logger.Warn("上游响应包含多条assistant消息，已在第一条消息结束处截断", fields...)
+	return true
+}
+
+// separatorEvent 构造merge策略下插入的分隔符文本增量，index为当前打开的文本块或下一个块索引
+func (p *MessageBoundaryPolicy) separatorEvent(index int) map[string]any {
+	return map[string]any{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]any{
+			"type": "text_delta",
+			"text": p.Separator,
+		},
+	}
+}
+
+// ApplyToResult 对非流式解析结果应用边界策略，返回处理后的结果
+// truncate: 只保留第一条消息的事件和在其中开始的工具调用
+// merge: 把边界事件替换为分隔符文本
+func (p *MessageBoundaryPolicy) ApplyToResult(c *gin.Context, result *parser.ParseResult) *parser.ParseResult {
+	boundaryIndex := -1
+	for i, event := range result.Events {
+		if event.Event == parser.EventTypes.MESSAGE_BOUNDARY {
+			boundaryIndex = i
+			break
+		}
+	}
+	if boundaryIndex < 0 {
+		return result
+	}
+
+	applied := *result
+
+	if p.Mode == MessageBoundaryMerge {
+		applied.Events = make([]parser.SSEEvent, 0, len(result.Events))
+		blocks := &textBlockTracker{open: make(map[int]bool), closed: make(map[int]bool)}
+		for _, event := range result.Events {
+			if event.Event == parser.EventTypes.MESSAGE_BOUNDARY {
+				dataMap, _ := event.Data.(map[string]any)
+				p.recordBoundary(c, dataMap)
+				event = parser.SSEEvent{Event: "content_block_delta", Data: p.separatorEvent(blocks.textBlockIndex())}
+			}
+			blocks.track(event)
+			applied.Events = append(applied.Events, event)
+		}
+		return &applied
+	}
+
+	dataMap, _ := result.Events[boundaryIndex].Data.(map[string]any)
+	p.recordBoundary(c, dataMap)
+	applied.Events = result.Events[:boundaryIndex]
+
+	// 只保留在第一条消息内开始的工具调用
+	keep := make(map[string]bool)
+	for _, event := range applied.Events {
+		if event.Event != "content_block_start" {
+			continue
+		}
+		if data, ok := event.Data.(map[string]any); ok {
+			if block, ok := data["content_block"].(map[string]any); ok {
+				if id, ok := block["id"].(string); ok {
+					keep[id] = true
+				}
+			}
+		}
+	}
+	applied.ToolExecutions = filterToolExecutions(result.ToolExecutions, keep)
+	applied.ActiveTools = filterToolExecutions(result.ActiveTools, keep)
+	return &applied
+}
+
+// textBlockTracker 按事件顺序跟踪非流式解析结果中的块状态，规则与SSEStateManager.TextBlockIndex一致
+type textBlockTracker struct {
+	open   map[int]bool // 未结束的文本块
+	closed map[int]bool
+	next   int
+}
+
+func (t *textBlockTracker) track(event parser.SSEEvent) {
+	data, ok := event.Data.(map[string]any)
+	if !ok {
+		return
+	}
+	index, ok := data["index"].(int)
+	if !ok {
+		indexFloat, isFloat := data["index"].(float64)
+		if !isFloat {
+			return
+		}
+		index = int(indexFloat)
+	}
+
+	switch event.Event {
+	case "content_block_start":
+		block, _ := data["content_block"].(map[string]any)
+		if blockType, _ := block["type"].(string); blockType == "text" {
+			t.open[index] = true
+		}
+	case "content_block_delta":
+		// 与状态管理器一样，未开始的块收到文本增量时自动开始
+		delta, _ := data["delta"].(map[string]any)
+		if deltaType, _ := delta["type"].(string); deltaType != "text_delta" || t.closed[index] {
+			return
+		}
+		t.open[index] = true
+	case "content_block_stop":
+		delete(t.open, index)
+		t.closed[index] = true
+	default:
+		return
+	}
+	t.next = max(t.next, index+1)
+}
+
+// textBlockIndex 分隔符使用的块索引：最新的未结束文本块，没有时为下一个块索引
+func (t *textBlockTracker) textBlockIndex() int {
+	index := -1
+	for i := range t.open {
+		index = max(index, i)
+	}
+	if index >= 0 {
+		return index
+	}
+	return t.next
+}
+
+// filterToolExecutions 按工具ID过滤工具执行记录
+func filterToolExecutions(tools map[string]*parser.ToolExecution, keep map[string]bool) map[string]*parser.ToolExecution {
+	filtered := make(map[string]*parser.ToolExecution)
+	for id, tool := range tools {
+		if keep[id] {
+			filtered[id] = tool
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/parser"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// doubleMessageFixture 上游连续返回两条assistant消息（第二条重复了第一条的内容）
+var doubleMessageFixture = []string{
+	`{"conversationId":"conv-1","messageId":"msg-1","content":"Hello"}`,
+	`{"conversationId":"conv-1","messageId":"msg-1","content":" world"}`,
+	`{"conversationId":"conv-1","messageId":"msg-2","content":"Hello"}`,
+	`{"conversationId":"conv-1","messageId":"msg-2","content":" world"}`,
+}
+
+// newDoubleMessageUpstream 创建返回双消息事件流的假上游
+func newDoubleMessageUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for _, payload := range doubleMessageFixture {
+			_, _ = w.Write(encodeTestEventStreamFrame(payload))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+}
+
+// withMessageBoundaryPolicy 在测试期间替换全局策略与统计
+func withMessageBoundaryPolicy(t *testing.T, mode string) {
+	originalPolicy, originalStats := messageBoundaryPolicy, streamStats
+	messageBoundaryPolicy = &MessageBoundaryPolicy{Mode: mode, Separator: "\n---\n"}
+	streamStats = &StreamStats{}
+	t.Cleanup(func() {
+		messageBoundaryPolicy, streamStats = originalPolicy, originalStats
+	})
+}
+
+// collectAnthropicStreamText 拼接Anthropic SSE响应中的全部文本增量
+func collectAnthropicStreamText(t *testing.T, body string) string {
+	var text strings.Builder
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var event struct {
+			Type  string `json:"type"`
+			Delta struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"delta"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(data), &event))
+		if event.Type == "content_block_delta" && event.Delta.Type == "text_delta" {
+			text.WriteString(event.Delta.Text)
+		}
+	}
+	return text.String()
+}
+
+// collectOpenAIStreamText 拼接OpenAI SSE响应中的全部文本增量
+func collectOpenAIStreamText(t *testing.T, body string) string {
+	var text strings.Builder
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		for _, choice := range chunk.Choices {
+			text.WriteString(choice.Delta.Content)
+		}
+	}
+	return text.String()
+}
+
+func TestMessageBoundary_AnthropicStream(t *testing.T) {
+	tests := []struct {
+		mode      string
+		want      string
+		merged    int64
+		discarded int64
+	}{
+		{MessageBoundaryTruncate, "Hello world", 0, 1},
+		{MessageBoundaryMerge, "Hello world\n---\nHello world", 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			newDoubleMessageUpstream(t)
+			withMessageBoundaryPolicy(t, tt.mode)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+			handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+			body := w.Body.String()
+			assert.Equal(t, tt.want, collectAnthropicStreamText(t, body))
+			assert.NotContains(t, body, "message_boundary", "边界事件不应下发给客户端")
+			assert.Equal(t, 1, strings.Count(body, "event: message_stop"))
+			assert.Equal(t, int64(1), streamStats.MessageBoundaries.Load())
+			assert.Equal(t, tt.merged, streamStats.MergedMessages.Load())
+			assert.Equal(t, tt.discarded, streamStats.DiscardedMessages.Load())
+		})
+	}
+}
+
+func TestMessageBoundary_MergeSeparatorAfterToolBlock(t *testing.T) {
+	// 第一条消息以工具调用结束：文本块已在工具块开始前关闭，分隔符不能再写入index 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"conversationId":"conv-1","messageId":"msg-1","content":"Hello"}`))
+		for _, payload := range []string{
+			`{"name":"get_weather","toolUseId":"tooluse_1","input":"{}"}`,
+			`{"name":"get_weather","toolUseId":"tooluse_1","input":"","stop":true}`,
+		} {
+			_, _ = w.Write(encodeTestEventStreamFrameWithHeaders([][2]string{
+				{":message-type", "event"},
+				{":event-type", "toolUseEvent"},
+			}, payload))
+		}
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"conversationId":"conv-1","messageId":"msg-2","content":"Again"}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	withMessageBoundaryPolicy(t, MessageBoundaryMerge)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	handleStreamRequest(newTestScope(c, newToolTestRequest(true, false)))
+
+	body := w.Body.String()
+	assert.Contains(t, collectAnthropicStreamText(t, body), "Hello\n---\n", "分隔符不能因写入已关闭的块而丢失")
+	assert.Contains(t, body, `{"content_block":{"text":"","type":"text"},"index":2,"type":"content_block_start"}`, "分隔符在下一个索引开始新的文本块")
+	assert.Contains(t, body, `{"delta":{"text":"\n---\n","type":"text_delta"},"index":2,"type":"content_block_delta"}`)
+	assert.Equal(t, 1, strings.Count(body, "event: message_stop"))
+}
+
+func TestTextBlockIndex(t *testing.T) {
+	delta := func(index int, deltaType string) parser.SSEEvent {
+		return parser.SSEEvent{Event: "content_block_delta", Data: map[string]any{
+			"type": "content_block_delta", "index": index, "delta": map[string]any{"type": deltaType},
+		}}
+	}
+	stop := func(index int) parser.SSEEvent {
+		return parser.SSEEvent{Event: "content_block_stop", Data: map[string]any{"type": "content_block_stop", "index": index}}
+	}
+	toolStart := parser.SSEEvent{Event: "content_block_start", Data: map[string]any{
+		"type": "content_block_start", "index": 1, "content_block": map[string]any{"type": "tool_use"},
+	}}
+
+	tracker := &textBlockTracker{open: make(map[int]bool), closed: make(map[int]bool)}
+	assert.Equal(t, 0, tracker.textBlockIndex())
+	tracker.track(delta(0, "text_delta"))
+	assert.Equal(t, 0, tracker.textBlockIndex(), "写入打开的文本块")
+	for _, event := range []parser.SSEEvent{stop(0), toolStart, delta(1, "input_json_delta"), stop(1), delta(0, "text_delta")} {
+		tracker.track(event)
+	}
+	assert.Equal(t, 2, tracker.textBlockIndex(), "没有打开的文本块时使用下一个索引")
+
+	ssm := NewSSEStateManager(false)
+	assert.Equal(t, 0, ssm.TextBlockIndex())
+	ssm.activeBlocks[0] = &BlockState{Index: 0, Type: "text", Started: true}
+	ssm.activeBlocks[1] = &BlockState{Index: 1, Type: "tool_use", Started: true}
+	ssm.nextBlockIndex = 2
+	assert.Equal(t, 0, ssm.TextBlockIndex())
+	delete(ssm.activeBlocks, 0)
+	assert.Equal(t, 2, ssm.TextBlockIndex())
+}
+
+func TestMessageBoundary_AnthropicNonStream(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{MessageBoundaryTruncate, "Hello world"},
+		{MessageBoundaryMerge, "Hello world\n---\nHello world"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			newDoubleMessageUpstream(t)
+			withMessageBoundaryPolicy(t, tt.mode)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+			handleNonStreamRequest(newTestScope(c, newStopTestRequest(false)))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var resp struct {
+				Content []struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				} `json:"content"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			require.Len(t, resp.Content, 1)
+			assert.Equal(t, tt.want, resp.Content[0].Text)
+			assert.Equal(t, int64(1), streamStats.MessageBoundaries.Load())
+		})
+	}
+}
+
+func TestMessageBoundary_OpenAI(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{MessageBoundaryTruncate, "Hello world"},
+		{MessageBoundaryMerge, "Hello world\n---\nHello world"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+"/stream", func(t *testing.T) {
+			newDoubleMessageUpstream(t)
+			withMessageBoundaryPolicy(t, tt.mode)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+			handleOpenAIStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+			assert.Equal(t, tt.want, collectOpenAIStreamText(t, w.Body.String()))
+			assert.Contains(t, w.Body.String(), `"finish_reason":"stop"`)
+		})
+
+		t.Run(tt.mode+"/non-stream", func(t *testing.T) {
+			newDoubleMessageUpstream(t)
+			withMessageBoundaryPolicy(t, tt.mode)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+			handleOpenAINonStreamRequest(newTestScope(c, newStopTestRequest(false)))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var resp types.OpenAIResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			require.Len(t, resp.Choices, 1)
+			assert.Equal(t, tt.want, resp.Choices[0].Message.Content)
+		})
+	}
+}
+
+func TestNewMessageBoundaryPolicyFromEnv(t *testing.T) {
+	t.Setenv("MESSAGE_BOUNDARY_POLICY", "")
+	policy := NewMessageBoundaryPolicyFromEnv()
+	assert.Equal(t, MessageBoundaryTruncate, policy.Mode)
+	assert.Equal(t, "\n\n", policy.Separator)
+
+	t.Setenv("MESSAGE_BOUNDARY_POLICY", "merge")
+	t.Setenv("MESSAGE_BOUNDARY_SEPARATOR", " | ")
+	policy = NewMessageBoundaryPolicyFromEnv()
+	assert.Equal(t, MessageBoundaryMerge, policy.Mode)
+	assert.Equal(t, " | ", policy.Separator)
+}
+
+func TestHandleStreamStatsAPI(t *testing.T) {
+	withMessageBoundaryPolicy(t, MessageBoundaryMerge)
+	streamStats.MessageBoundaries.Add(2)
+	streamStats.MergedMessages.Add(2)
+	streamStats.RecordUnknownBlock("citationEvent")
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/api/stats", nil)
+	handleStreamStatsAPI(c)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, MessageBoundaryMerge, resp["message_boundary_policy"])
+	assert.Equal(t, float64(2), resp["message_boundaries"])
+	assert.Equal(t, float64(2), resp["merged_messages"])
+	assert.Equal(t, float64(0), resp["discarded_messages"])
+	assert.Equal(t, float64(1), resp["unknown_blocks"])
+	assert.Equal(t, map[string]any{"citationEvent": float64(1)}, resp["unknown_block_types"])
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"net/http"
+	"os"
 	"strings"
 
 	"kiro2api/logger"
@@ -31,6 +32,25 @@ func PathBasedAuthMiddleware(authToken string, protectedPrefixes []string) gin.H
 	}
 }
 
+// AdminAuthMiddleware 保护调试类管理端点：Authorization或x-api-key必须与管理令牌一致
+func AdminAuthMiddleware(adminToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !validateAPIKey(c, adminToken) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// NewAdminTokenFromEnv ADMIN_TOKEN: 管理令牌，未设置时与客户端令牌（KIRO_CLIENT_TOKEN）相同
+func NewAdminTokenFromEnv(authToken string) string {
+	if token := strings.TrimSpace(os.Getenv("ADMIN_TOKEN")); token != "" {
+		return token
+	}
+	return authToken
+}
+
 // RequestIDMiddleware 为每个请求注入 request_id 并通过响应头返回
 // - 优先使用客户端的 X-Request-ID
 // - 若无则生成一个UUID（utils.GenerateUUID）
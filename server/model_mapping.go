@@ -0,0 +1,58 @@
+package server
+
+import (
+	"kiro2api/config"
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestedModelKey gin上下文中客户端原始请求的模型（仅在X-Override-Model替换模型时写入）
+const requestedModelKey = "requested_model"
+
+// modelMappingSink 输出一条模型映射决策日志（测试可替换）
+var modelMappingSink = func(fields []logger.Field) {
+	logger.Debug("模型映射决策", fields...)
+}
+
+// ModelMappingDecision 一次请求从客户端模型到上游模型ID的完整映射过程
+type ModelMappingDecision struct {
+	RequestedModel string // 客户端请求的模型
+	OverrideModel  string // X-Override-Model 替换后的模型，未替换时为空
+	CanonicalModel string // 别名解析后的Claude模型名
+	UpstreamModel  string // 发送给上游的模型ID
+	Source         string // 映射来源：builtin / alias / unknown
+	Account        string // 选中的账号（脱敏邮箱或token指纹）
+}
+
+// resolveModelMapping 汇总本次请求的模型映射决策
+// model为模型覆盖之后实际使用的模型，账号取自访问日志记录的脱敏值
+func resolveModelMapping(c *gin.Context, model string) ModelMappingDecision {
+	decision := ModelMappingDecision{
+		RequestedModel: model,
+		Account:        c.GetString(accessLogAccountKey),
+	}
+	if requested := c.GetString(requestedModelKey); requested != "" && requested != model {
+		decision.RequestedModel = requested
+		decision.OverrideModel = model
+	}
+
+	resolution := config.ResolveModel(model)
+	decision.CanonicalModel = resolution.Canonical
+	decision.UpstreamModel = resolution.ModelID
+	decision.Source = resolution.Source
+	return decision
+}
+
+// logModelMapping 每个请求在选定账号后输出一行模型映射决策日志
+func logModelMapping(c *gin.Context, model string) {
+	decision := resolveModelMapping(c, model)
+	modelMappingSink(addReqFields(c,
+		logger.String("requested_model", decision.RequestedModel),
+		logger.String("override_model", decision.OverrideModel),
+		logger.String("canonical_model", decision.CanonicalModel),
+		logger.String("upstream_model", decision.UpstreamModel),
+		logger.String("mapping_source", decision.Source),
+		logger.String("account", decision.Account),
+	))
+}
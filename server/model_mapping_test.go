@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureModelMapping 替换模型映射日志输出，返回已记录的日志字段
+func captureModelMapping(t *testing.T) func() []map[string]any {
+	var mutex sync.Mutex
+	var entries []map[string]any
+
+	original := modelMappingSink
+	modelMappingSink = func(fields []logger.Field) {
+		entry := make(map[string]any, len(fields))
+		for _, f := range fields {
+			entry[f.Key] = f.Value
+		}
+		mutex.Lock()
+		entries = append(entries, entry)
+		mutex.Unlock()
+	}
+	t.Cleanup(func() { modelMappingSink = original })
+
+	return func() []map[string]any {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]map[string]any(nil), entries...)
+	}
+}
+
+// newModelMappingRouter 按 /v1/messages 的顺序执行模型覆盖、选择账号和映射日志
+func newModelMappingRouter(auth *MockAuthService) *gin.Engine {
+	r := gin.New()
+	r.Use(RequestIDMiddleware())
+	r.POST("/v1/messages", func(c *gin.Context) {
+		reqCtx := &RequestContext{GinContext: c, AuthService: auth, RequestType: "Anthropic"}
+		req := applyModelOverride(c, types.AnthropicRequest{Model: c.Query("model")})
+		if _, err := reqCtx.GetTokenWithUsage(); err != nil {
+			return
+		}
+		logModelMapping(c, req.Model)
+		c.Status(http.StatusNoContent)
+	})
+	return r
+}
+
+func TestLogModelMapping_Stages(t *testing.T) {
+	t.Setenv("MODEL_ALIASES", `{"gpt-4o": "claude-sonnet-4-5"}`)
+	withModelOverride(t, &ModelOverridePolicy{Allowlist: map[string]bool{}})
+	auth := &MockAuthService{tokenUsage: &types.TokenWithUsage{
+		TokenInfo: types.TokenInfo{AccessToken: "secret-access-token"},
+		UserEmail: "caidaoli@gmail.com",
+	}}
+
+	tests := []struct {
+		name     string
+		model    string
+		override string
+		expected map[string]any
+	}{
+		{
+			name:  "内置映射",
+			model: "claude-sonnet-4-20250514",
+			expected: map[string]any{
+				"requested_model": "claude-sonnet-4-20250514",
+				"override_model":  "",
+				"canonical_model": "claude-sonnet-4-20250514",
+				"upstream_model":  config.ModelMap["claude-sonnet-4-20250514"],
+				"mapping_source":  config.ModelSourceBuiltin,
+			},
+		},
+		{
+			name:  "自定义别名",
+			model: "gpt-4o",
+			expected: map[string]any{
+				"requested_model": "gpt-4o",
+				"override_model":  "",
+				"canonical_model": "claude-sonnet-4-5",
+				"upstream_model":  config.ModelMap["claude-sonnet-4-5"],
+				"mapping_source":  config.ModelSourceAlias,
+			},
+		},
+		{
+			name:     "模型覆盖后经别名解析",
+			model:    "claude-sonnet-4-20250514",
+			override: "gpt-4o",
+			expected: map[string]any{
+				"requested_model": "claude-sonnet-4-20250514",
+				"override_model":  "gpt-4o",
+				"canonical_model": "claude-sonnet-4-5",
+				"upstream_model":  config.ModelMap["claude-sonnet-4-5"],
+				"mapping_source":  config.ModelSourceAlias,
+			},
+		},
+		{
+			name:  "未知模型",
+			model: "no-such-model",
+			expected: map[string]any{
+				"requested_model": "no-such-model",
+				"override_model":  "",
+				"canonical_model": "no-such-model",
+				"upstream_model":  "",
+				"mapping_source":  config.ModelSourceUnknown,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := captureModelMapping(t)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/v1/messages?model="+tt.model, strings.NewReader("{}"))
+			if tt.override != "" {
+				req.Header.Set(modelOverrideHeader, tt.override)
+			}
+			newModelMappingRouter(auth).ServeHTTP(w, req)
+			require.Equal(t, http.StatusNoContent, w.Code)
+
+			logged := entries()
+			require.Len(t, logged, 1, "每个请求只输出一行映射日志")
+			entry := logged[0]
+			for key, value := range tt.expected {
+				assert.Equal(t, value, entry[key], key)
+			}
+			assert.Equal(t, maskEmail("caidaoli@gmail.com"), entry["account"])
+			assert.NotEmpty(t, entry["request_id"])
+		})
+	}
+}
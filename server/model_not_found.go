@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// modelNotFoundMessage 模型不存在的错误消息，有相近的已配置模型时附带推荐
+func modelNotFoundMessage(model string) string {
+	message := fmt.Sprintf("model: %s not found", model)
+	if suggestion := config.SuggestModel(model); suggestion != "" {
+		message += fmt.Sprintf(". Did you mean %q?", suggestion)
+	}
+	return message
+}
+
+// respondModelNotFound err为模型未找到错误时按请求方言返回404并返回true
+// Anthropic: not_found_error；OpenAI: invalid_request_error + model_not_found
+// 流式响应头已发出时通过sender以SSE错误事件的形式下发，sender为nil时使用对应方言的默认发送器
+func respondModelNotFound(c *gin.Context, err error, sender StreamEventSender) bool {
+	var modelNotFound *types.ModelNotFoundErrorType
+	if !errors.As(err, &modelNotFound) {
+		return false
+	}
+
+	message := modelNotFoundMessage(modelNotFound.Model)
+	logger.Warn("请求的模型不存在", addReqFields(c,
+		logger.String("requested_model", modelNotFound.Model),
+		logger.String("message", message))...)
+
+	var errorResp map[string]any
+	if isOpenAIRequest(c) {
+		errorResp = map[string]any{
+			"error": map[string]any{
+				"message": message,
+				"type":    "invalid_request_error",
+				"param":   "model",
+				"code":    "model_not_found",
+			},
+		}
+		if sender == nil {
+			sender = &OpenAIStreamSender{}
+		}
+	} else {
+		errorResp = map[string]any{
+			"type": "error",
+			"error": map[string]any{
+				"type":    "not_found_error",
+				"message": message,
+			},
+		}
+		if sender == nil {
+			sender = &AnthropicStreamSender{}
+		}
+	}
+
+	if c.Writer.Written() {
+		_ = sender.SendEvent(c, errorResp)
+		return true
+	}
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.JSON(http.StatusNotFound, errorResp)
+	return true
+}
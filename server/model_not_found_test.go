@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveModelNotFound 用拼错的模型名调用处理函数，返回状态码和错误对象（流式时解析SSE中的错误事件）
+func serveModelNotFound(t *testing.T, path string, stream bool) (int, map[string]any, map[string]any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", path, nil)
+
+	req := newOverloadedTestRequest()
+	req.Model = "claude-sonet-4-20250514"
+	req.Stream = stream
+	scope := newTestScope(c, req)
+	switch {
+	case path == "/v1/messages" && stream:
+		handleStreamRequest(scope)
+	case path == "/v1/messages":
+		handleNonStreamRequest(scope)
+	case stream:
+		handleOpenAIStreamRequest(scope)
+	default:
+		handleOpenAINonStreamRequest(scope)
+	}
+
+	body := w.Body.String()
+	if strings.Contains(body, "data: ") {
+		for _, line := range strings.Split(body, "\n") {
+			if data, ok := strings.CutPrefix(line, "data: "); ok && strings.Contains(data, "not found") {
+				body = data
+				break
+			}
+		}
+	}
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal([]byte(body), &resp), w.Body.String())
+	errObj, ok := resp["error"].(map[string]any)
+	require.True(t, ok, w.Body.String())
+	return w.Code, resp, errObj
+}
+
+func TestModelNotFound_Anthropic(t *testing.T) {
+	const wantMessage = `model: claude-sonet-4-20250514 not found. Did you mean "claude-sonnet-4-20250514"?`
+
+	status, resp, errObj := serveModelNotFound(t, "/v1/messages", false)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, "error", resp["type"])
+	assert.Equal(t, map[string]any{"type": "not_found_error", "message": wantMessage}, errObj)
+
+	// 流式响应头已发出，以SSE错误事件下发，错误对象与非流式一致
+	status, resp, errObj = serveModelNotFound(t, "/v1/messages", true)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "error", resp["type"])
+	assert.Equal(t, map[string]any{"type": "not_found_error", "message": wantMessage}, errObj)
+}
+
+func TestModelNotFound_OpenAI(t *testing.T) {
+	want := map[string]any{
+		"message": `model: claude-sonet-4-20250514 not found. Did you mean "claude-sonnet-4-20250514"?`,
+		"type":    "invalid_request_error",
+		"param":   "model",
+		"code":    "model_not_found",
+	}
+
+	for _, stream := range []bool{false, true} {
+		status, _, errObj := serveModelNotFound(t, "/v1/chat/completions", stream)
+		assert.Equal(t, http.StatusNotFound, status, "stream=%v", stream)
+		assert.Equal(t, want, errObj, "stream=%v", stream)
+	}
+}
+
+func TestModelNotFoundMessage_NoSuggestion(t *testing.T) {
+	assert.Equal(t, "model: llama-3-70b not found", modelNotFoundMessage("llama-3-70b"))
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"os"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// modelOverrideHeader 请求级模型覆盖头，用于A/B测试时在服务端替换请求的模型
+const modelOverrideHeader = "X-Override-Model"
+
+// ModelOverridePolicy 请求级模型覆盖策略
+// Allowlist为空时允许任何可解析的模型（内置模型或MODEL_ALIASES别名）
+type ModelOverridePolicy struct {
+	Allowlist map[string]bool
+}
+
+// modelOverride 全局模型覆盖策略，nil表示未启用（忽略X-Override-Model）
+var modelOverride *ModelOverridePolicy
+
+// NewModelOverridePolicyFromEnv 根据环境变量创建模型覆盖策略，未启用时返回nil
+// MODEL_OVERRIDE_ENABLED: "true" 时启用
+// MODEL_OVERRIDE_ALLOWLIST: 逗号分隔的允许覆盖为的模型名
+func NewModelOverridePolicyFromEnv() *ModelOverridePolicy {
+	if !strings.EqualFold(strings.TrimSpace(os.Getenv("MODEL_OVERRIDE_ENABLED")), "true") {
+		return nil
+	}
+
+	policy := &ModelOverridePolicy{Allowlist: make(map[string]bool)}
+	for _, model := range strings.Split(os.Getenv("MODEL_OVERRIDE_ALLOWLIST"), ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			policy.Allowlist[model] = true
+		}
+	}
+	return policy
+}
+
+// Allowed 判断模型是否允许作为覆盖目标
+func (p *ModelOverridePolicy) Allowed(model string) bool {
+	if config.ResolveModelID(model) == "" {
+		return false
+	}
+	return len(p.Allowlist) == 0 || p.Allowlist[model]
+}
+
+// applyModelOverride 按X-Override-Model替换请求的模型
+// 未启用、未携带头或目标模型不在允许范围内时保持原模型
+func applyModelOverride(c *gin.Context, req types.AnthropicRequest) types.AnthropicRequest {
+	if modelOverride == nil {
+		return req
+	}
+	override := strings.TrimSpace(c.GetHeader(modelOverrideHeader))
+	if override == "" || override == req.Model {
+		return req
+	}
+
+	if !modelOverride.Allowed(override) {
+		logger.Warn("模型覆盖被拒绝：目标模型不在允许范围内",
+			addReqFields(c,
+				logger.String("requested_model", req.Model),
+				logger.String("override_model", override))...)
+		return req
+	}
+
+	logger.Info("已应用请求级模型覆盖",
+		addReqFields(c,
+			logger.String("requested_model", req.Model),
+			logger.String("override_model", override))...)
+	c.Set(requestedModelKey, req.Model)
+	req.Model = override
+	return req
+}
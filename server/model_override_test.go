@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// withModelOverride 在测试期间设置模型覆盖策略
+func withModelOverride(t *testing.T, policy *ModelOverridePolicy) {
+	original := modelOverride
+	modelOverride = policy
+	t.Cleanup(func() { modelOverride = original })
+}
+
+func overrideModel(override string) string {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	if override != "" {
+		c.Request.Header.Set("X-Override-Model", override)
+	}
+	return applyModelOverride(c, types.AnthropicRequest{Model: "claude-sonnet-4-20250514"}).Model
+}
+
+func TestApplyModelOverride(t *testing.T) {
+	t.Setenv("MODEL_ALIASES", `{"ab-test":"claude-3-7-sonnet-20250219"}`)
+
+	t.Run("未启用时忽略", func(t *testing.T) {
+		withModelOverride(t, nil)
+		assert.Equal(t, "claude-sonnet-4-20250514", overrideModel("claude-sonnet-4-5"))
+	})
+
+	t.Run("无允许列表时接受任何已知模型", func(t *testing.T) {
+		withModelOverride(t, &ModelOverridePolicy{})
+		assert.Equal(t, "claude-sonnet-4-5", overrideModel("claude-sonnet-4-5"))
+		assert.Equal(t, "ab-test", overrideModel("ab-test"), "别名也可作为覆盖目标")
+		assert.Equal(t, "claude-sonnet-4-20250514", overrideModel("gpt-unknown"), "未知模型不覆盖")
+		assert.Equal(t, "claude-sonnet-4-20250514", overrideModel(""))
+	})
+
+	t.Run("限制在允许列表内", func(t *testing.T) {
+		withModelOverride(t, &ModelOverridePolicy{Allowlist: map[string]bool{"claude-sonnet-4-5": true}})
+		assert.Equal(t, "claude-sonnet-4-5", overrideModel("claude-sonnet-4-5"))
+		assert.Equal(t, "claude-sonnet-4-20250514", overrideModel("ab-test"))
+	})
+}
+
+func TestModelOverride_AppliedUpstream(t *testing.T) {
+	lastBody := newTwoToolsUpstream(t)
+	withModelOverride(t, &ModelOverridePolicy{})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	c.Request.Header.Set("X-Override-Model", "claude-3-7-sonnet-20250219")
+	handleOpenAINonStreamRequest(newTestScope(c, applyModelOverride(c, newStopTestRequest(false))))
+
+	assert.Contains(t, lastBody(), `"modelId":"CLAUDE_3_7_SONNET_20250219_V1_0"`)
+	assert.Contains(t, w.Body.String(), `"model":"claude-3-7-sonnet-20250219"`)
+}
+
+func TestNewModelOverridePolicyFromEnv(t *testing.T) {
+	t.Setenv("MODEL_OVERRIDE_ENABLED", "")
+	assert.Nil(t, NewModelOverridePolicyFromEnv())
+
+	t.Setenv("MODEL_OVERRIDE_ENABLED", "true")
+	t.Setenv("MODEL_OVERRIDE_ALLOWLIST", " claude-sonnet-4-5, ,claude-haiku-4-5-20251001 ")
+	policy := NewModelOverridePolicyFromEnv()
+	assert.Equal(t, map[string]bool{"claude-sonnet-4-5": true, "claude-haiku-4-5-20251001": true}, policy.Allowlist)
+}
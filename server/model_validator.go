@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 模型映射校验状态
+const (
+	ModelStatusAvailable   = "available"   // 上游接受该模型ID
+	ModelStatusUnavailable = "unavailable" // 上游拒绝该模型ID（映射可能有误）
+	ModelStatusUnknown     = "unknown"     // 校验未能得出结论（网络错误、5xx等）
+)
+
+// ModelValidationResult 单个模型映射的校验结果
+type ModelValidationResult struct {
+	Model      string    `json:"model"`
+	ModelID    string    `json:"model_id"`
+	Status     string    `json:"status"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// ModelValidator 通过最小化的真实请求校验静态ModelMap中的映射是否被上游接受
+// 结果按TTL缓存，避免重复消耗额度
+type ModelValidator struct {
+	endpoint      string
+	httpClient    *http.Client
+	ttl           time.Duration
+	forceInterval time.Duration // 两次强制校验之间的最小间隔
+	mutex         sync.RWMutex
+	results       map[string]ModelValidationResult // key: anthropic模型名
+	validatedAt   time.Time
+	lastForcedAt  time.Time
+}
+
+// probeTokenProvider 提供探测请求使用的token，不占用客户端请求的额度预算（*auth.AuthService）
+type probeTokenProvider interface {
+	GetProbeToken() (types.TokenInfo, error)
+}
+
+var modelValidator = NewModelValidator("", config.ModelValidationCacheTTL)
+
+// NewModelValidator 创建模型映射校验器
+// endpoint为空时在每次探测时使用config.CodeWhispererURL()
+func NewModelValidator(endpoint string, ttl time.Duration) *ModelValidator {
+	return &ModelValidator{
+		endpoint:      endpoint,
+		httpClient:    utils.SharedHTTPClient,
+		ttl:           ttl,
+		forceInterval: config.ModelValidationForceInterval,
+		results:       make(map[string]ModelValidationResult),
+	}
+}
+
+// reserveForce 记录一次强制校验；距上次强制校验不足forceInterval时返回需要等待的时间，不记录
+func (mv *ModelValidator) reserveForce(now time.Time) time.Duration {
+	mv.mutex.Lock()
+	defer mv.mutex.Unlock()
+	if !mv.lastForcedAt.IsZero() {
+		if wait := mv.forceInterval - now.Sub(mv.lastForcedAt); wait > 0 {
+			return wait
+		}
+	}
+	mv.lastForcedAt = now
+	return 0
+}
+
+// IsFresh 检查缓存的校验结果是否仍在TTL内
+func (mv *ModelValidator) IsFresh() bool {
+	mv.mutex.RLock()
+	defer mv.mutex.RUnlock()
+	return !mv.validatedAt.IsZero() && time.Since(mv.validatedAt) < mv.ttl
+}
+
+// Results 返回按模型名排序的缓存校验结果
+func (mv *ModelValidator) Results() []ModelValidationResult {
+	mv.mutex.RLock()
+	defer mv.mutex.RUnlock()
+
+	results := make([]ModelValidationResult, 0, len(mv.results))
+	for _, r := range mv.results {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Model < results[j].Model })
+	return results
+}
+
+// StatusOf 返回指定模型的校验状态，未校验时返回空串
+func (mv *ModelValidator) StatusOf(model string) string {
+	mv.mutex.RLock()
+	defer mv.mutex.RUnlock()
+	return mv.results[model].Status
+}
+
+// Validate 校验modelMap中的所有映射
+// 缓存未过期且未强制时直接返回缓存结果；相同的上游模型ID只探测一次
+func (mv *ModelValidator) Validate(token types.TokenInfo, modelMap map[string]string, force bool) []ModelValidationResult {
+	if !force && mv.IsFresh() {
+		return mv.Results()
+	}
+
+	probed := make(map[string]ModelValidationResult) // key: 上游模型ID
+	results := make(map[string]ModelValidationResult, len(modelMap))
+
+	for model, modelID := range modelMap {
+		probe, exists := probed[modelID]
+		if !exists {
+			probe = mv.probe(token, model, modelID)
+			probed[modelID] = probe
+		}
+
+		result := probe
+		result.Model = model
+		results[model] = result
+
+		if result.Status == ModelStatusUnavailable {
+			logger.Error("模型映射校验失败，上游拒绝该模型ID",
+				logger.String("model", model),
+				logger.String("model_id", modelID),
+				logger.Int("status_code", result.StatusCode),
+				logger.String("error", result.Error))
+		}
+	}
+
+	mv.mutex.Lock()
+	mv.results = results
+	mv.validatedAt = time.Now()
+	mv.mutex.Unlock()
+
+	logger.Info("模型映射校验完成",
+		logger.Int("model_count", len(results)),
+		logger.Int("probe_count", len(probed)))
+
+	return mv.Results()
+}
+
+// probe 对单个上游模型ID发起最小化的生成请求
+func (mv *ModelValidator) probe(token types.TokenInfo, model, modelID string) ModelValidationResult {
+	result := ModelValidationResult{
+		Model:     model,
+		ModelID:   modelID,
+		Status:    ModelStatusUnknown,
+		CheckedAt: time.Now(),
+	}
+
+	body, err := utils.SafeMarshal(buildModelProbeRequest(modelID, resolveProfileArn(token)))
+	if err != nil {
+		result.Error = fmt.Sprintf("序列化请求失败: %v", err)
+		return result
+	}
+
+	endpoint := mv.endpoint
+	if endpoint == "" {
+		endpoint = config.CodeWhispererURL()
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		result.Error = fmt.Sprintf("创建请求失败: %v", err)
+		return result
+	}
+	setCodeWhispererHeaders(req, token, false)
+
+	resp, err := mv.httpClient.Do(req)
+	if err != nil {
+		result.Error = fmt.Sprintf("请求失败: %v", err)
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		_, _ = io.Copy(io.Discard, resp.Body)
+		result.Status = ModelStatusAvailable
+	case resp.StatusCode == http.StatusBadRequest:
+		// 400 表示上游不接受该请求，通常是模型ID错误
+		respBody, _ := io.ReadAll(resp.Body)
+		result.Status = ModelStatusUnavailable
+		result.Error = string(respBody)
+	default:
+		// 403/429/5xx 等与模型ID无关，不据此判定映射有误
+		respBody, _ := io.ReadAll(resp.Body)
+		result.Error = fmt.Sprintf("状态码 %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return result
+}
+
+// buildModelProbeRequest 构建最小化的探测请求
+// 直接使用上游模型ID，不经过ModelMap查找；profileArn与正常请求相同，按token所属账号选择
+func buildModelProbeRequest(modelID, profileArn string) types.CodeWhispererRequest {
+	cwReq := types.CodeWhispererRequest{ProfileArn: profileArn}
+	cwReq.ConversationState.AgentContinuationId = utils.GenerateUUID()
+	cwReq.ConversationState.AgentTaskType = "vibe"
+	cwReq.ConversationState.ChatTriggerType = "MANUAL"
+	cwReq.ConversationState.ConversationId = utils.GenerateUUID()
+	cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = "Reply with OK."
+	cwReq.ConversationState.CurrentMessage.UserInputMessage.ModelId = modelID
+	cwReq.ConversationState.CurrentMessage.UserInputMessage.Origin = "AI_EDITOR"
+	cwReq.ConversationState.CurrentMessage.UserInputMessage.Images = []types.CodeWhispererImage{}
+	return cwReq
+}
+
+// validateModelMapOnStartup 启动时在后台执行模型映射校验（VALIDATE_MODEL_MAP=true）
+func validateModelMapOnStartup(authService probeTokenProvider) {
+	if !utils.GetEnvBool("VALIDATE_MODEL_MAP") {
+		return
+	}
+
+	go func() {
+		token, err := authService.GetProbeToken()
+		if err != nil {
+			logger.Warn("启动时模型映射校验跳过：无可用token", logger.Err(err))
+			return
+		}
+		modelValidator.Validate(token, config.ModelMap, false)
+	}()
+}
+
+// handleValidateModels 手动触发模型映射校验
+// POST /api/models/validate[?force=true]，force两次之间至少间隔ModelValidationForceInterval
+func handleValidateModels(authService probeTokenProvider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		force := c.Query("force") == "true"
+		if force {
+			if wait := modelValidator.reserveForce(time.Now()); wait > 0 {
+				seconds := int(math.Ceil(wait.Seconds()))
+				c.Header("Retry-After", strconv.Itoa(seconds))
+				respondError(c, http.StatusTooManyRequests, "强制校验过于频繁，请%d秒后重试", seconds)
+				return
+			}
+		}
+		cached := !force && modelValidator.IsFresh()
+
+		var results []ModelValidationResult
+		if cached {
+			results = modelValidator.Results()
+		} else {
+			token, err := authService.GetProbeToken()
+			if err != nil {
+				respondError(c, http.StatusServiceUnavailable, "获取token失败: %v", err)
+				return
+			}
+			results = modelValidator.Validate(token, config.ModelMap, force)
+		}
+
+		unavailable := 0
+		for _, r := range results {
+			if r.Status == ModelStatusUnavailable {
+				unavailable++
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"cached":      cached,
+			"total":       len(results),
+			"unavailable": unavailable,
+			"results":     results,
+		})
+	}
+}
+
+// buildModelList 构建/v1/models的模型列表，附带已缓存的校验状态
+// MODEL_ALIASES中的自定义别名一并列出，状态取自目标模型
+func buildModelList() []types.Model {
+	aliases, _ := config.ModelAliases()
+	models := make([]types.Model, 0, len(config.ModelMap)+len(aliases))
+	for anthropicModel := range config.ModelMap {
+		if _, overridden := aliases[anthropicModel]; overridden {
+			continue
+		}
+		models = append(models, newModelListEntry(anthropicModel, anthropicModel, "anthropic"))
+	}
+	for alias, target := range aliases {
+		models = append(models, newModelListEntry(alias, target, "kiro2api"))
+	}
+	return models
+}
+
+// newModelListEntry 构建单个模型条目，target为实际使用的ModelMap模型名，能力元数据取自target
+func newModelListEntry(id, target, ownedBy string) types.Model {
+	capability := config.CapabilityOf(target)
+	return types.Model{
+		ID:          id,
+		Object:      "model",
+		Created:     1234567890,
+		OwnedBy:     ownedBy,
+		DisplayName: id,
+		Type:        "text",
+		MaxTokens:   capability.ContextWindow,
+		Status:      modelValidator.StatusOf(target),
+
+		SupportsTools:    capability.SupportsTools,
+		SupportsVision:   capability.SupportsVision,
+		SupportsThinking: capability.SupportsThinking,
+		MaxOutputTokens:  capability.MaxOutputTokens,
+		ContextWindow:    capability.ContextWindow,
+	}
+}
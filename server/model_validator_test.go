@@ -0,0 +1,308 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeModelUpstream 创建只接受指定模型ID的假上游
+func newFakeModelUpstream(t *testing.T, accepted map[string]bool, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		var cwReq types.CodeWhispererRequest
+		require.NoError(t, json.Unmarshal(body, &cwReq))
+		assert.Equal(t, "Bearer test-access-token", r.Header.Get("Authorization"))
+
+		modelID := cwReq.ConversationState.CurrentMessage.UserInputMessage.ModelId
+		if accepted[modelID] {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"message":"Invalid model. Please select a different model to continue."}`))
+	}))
+}
+
+type fakeTokenProvider struct {
+	err error
+}
+
+func (p *fakeTokenProvider) GetProbeToken() (types.TokenInfo, error) {
+	if p.err != nil {
+		return types.TokenInfo{}, p.err
+	}
+	return types.TokenInfo{AccessToken: "test-access-token", ExpiresAt: time.Now().Add(time.Hour)}, nil
+}
+
+func TestModelValidator_MarksRejectedMappings(t *testing.T) {
+	var hits int32
+	upstream := newFakeModelUpstream(t, map[string]bool{"GOOD_MODEL_V1": true}, &hits)
+	defer upstream.Close()
+
+	mv := NewModelValidator(upstream.URL, time.Hour)
+	modelMap := map[string]string{
+		"claude-good":       "GOOD_MODEL_V1",
+		"claude-good-alias": "GOOD_MODEL_V1",
+		"claude-typo":       "GOOD_MODLE_V1",
+	}
+
+	token, _ := (&fakeTokenProvider{}).GetProbeToken()
+	results := mv.Validate(token, modelMap, false)
+
+	require.Len(t, results, 3)
+	assert.Equal(t, ModelStatusAvailable, mv.StatusOf("claude-good"))
+	assert.Equal(t, ModelStatusAvailable, mv.StatusOf("claude-good-alias"))
+	assert.Equal(t, ModelStatusUnavailable, mv.StatusOf("claude-typo"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits), "相同的上游模型ID只应探测一次")
+
+	for _, r := range results {
+		if r.Model == "claude-typo" {
+			assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+			assert.Contains(t, r.Error, "Invalid model")
+		}
+	}
+}
+
+func TestModelValidator_CachesWithinTTL(t *testing.T) {
+	var hits int32
+	upstream := newFakeModelUpstream(t, map[string]bool{"GOOD_MODEL_V1": true}, &hits)
+	defer upstream.Close()
+
+	mv := NewModelValidator(upstream.URL, time.Hour)
+	modelMap := map[string]string{"claude-good": "GOOD_MODEL_V1"}
+	token, _ := (&fakeTokenProvider{}).GetProbeToken()
+
+	mv.Validate(token, modelMap, false)
+	mv.Validate(token, modelMap, false)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "TTL内不应重复探测")
+
+	mv.Validate(token, modelMap, true)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits), "强制校验应绕过缓存")
+}
+
+func TestModelValidator_ServerErrorIsInconclusive(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	mv := NewModelValidator(upstream.URL, time.Hour)
+	token, _ := (&fakeTokenProvider{}).GetProbeToken()
+	mv.Validate(token, map[string]string{"claude-good": "GOOD_MODEL_V1"}, false)
+
+	assert.Equal(t, ModelStatusUnknown, mv.StatusOf("claude-good"), "5xx不应判定映射错误")
+}
+
+func TestHandleValidateModels_MarksModelsList(t *testing.T) {
+	var hits int32
+	upstream := newFakeModelUpstream(t, map[string]bool{}, &hits)
+	defer upstream.Close()
+
+	original := modelValidator
+	modelValidator = NewModelValidator(upstream.URL, time.Hour)
+	defer func() { modelValidator = original }()
+
+	router := gin.New()
+	router.POST("/api/models/validate", handleValidateModels(&fakeTokenProvider{}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/models/validate", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Cached      bool                    `json:"cached"`
+		Total       int                     `json:"total"`
+		Unavailable int                     `json:"unavailable"`
+		Results     []ModelValidationResult `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.Cached)
+	assert.Equal(t, resp.Total, resp.Unavailable, "假上游拒绝所有模型")
+
+	for _, model := range buildModelList() {
+		assert.Equal(t, ModelStatusUnavailable, model.Status, "模型 %s 应被标记为不可用", model.ID)
+	}
+
+	// 第二次调用命中缓存
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/models/validate", nil))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.Cached)
+}
+
+func TestModelValidator_ProbeUsesAccountProfileArn(t *testing.T) {
+	const otherProfileArn = "arn:aws:codewhisperer:eu-central-1:210987654321:profile/ZYXWVUTSRQPO"
+	t.Setenv("CODEWHISPERER_PROFILE_ARN", "")
+
+	// 只有testProfileArn所属的profile开通了该模型
+	var mutex sync.Mutex
+	var seen []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cwReq types.CodeWhispererRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&cwReq))
+		mutex.Lock()
+		seen = append(seen, cwReq.ProfileArn)
+		mutex.Unlock()
+		if cwReq.ProfileArn == testProfileArn {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"message":"Invalid model. Please select a different model to continue."}`))
+	}))
+	defer upstream.Close()
+
+	// 两个配置的profileArn在token刷新时写入各自的TokenInfo
+	configs := []auth.AuthConfig{
+		{AuthType: auth.AuthMethodSocial, RefreshToken: "refresh-a", ProfileArn: testProfileArn},
+		{AuthType: auth.AuthMethodSocial, RefreshToken: "refresh-b", ProfileArn: otherProfileArn},
+	}
+	modelMap := map[string]string{"claude-sonnet-4-5": "CLAUDE_SONNET_4_5_20250929_V1_0"}
+	validator := NewModelValidator(upstream.URL, time.Hour)
+
+	expected := []string{ModelStatusAvailable, ModelStatusUnavailable}
+	for i, cfg := range configs {
+		token := types.TokenInfo{AccessToken: "test-access-token", ProfileArn: cfg.ProfileArn, ExpiresAt: time.Now().Add(time.Hour)}
+		results := validator.Validate(token, modelMap, true)
+		require.Len(t, results, 1)
+		assert.Equal(t, expected[i], results[0].Status, cfg.ProfileArn)
+	}
+	assert.Equal(t, []string{testProfileArn, otherProfileArn}, seen, "探测请求携带token所属账号的ARN")
+}
+
+func TestHandleValidateModels_RateLimitsForce(t *testing.T) {
+	var hits int32
+	upstream := newFakeModelUpstream(t, map[string]bool{}, &hits)
+	defer upstream.Close()
+
+	original := modelValidator
+	modelValidator = NewModelValidator(upstream.URL, time.Hour)
+	defer func() { modelValidator = original }()
+
+	router := gin.New()
+	router.POST("/api/models/validate", handleValidateModels(&fakeTokenProvider{}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/models/validate?force=true", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	probes := atomic.LoadInt32(&hits)
+
+	// 间隔内再次强制校验被拒绝，不发送上游请求
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/models/validate?force=true", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, probes, atomic.LoadInt32(&hits))
+
+	// 不带force仍返回缓存结果
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/models/validate", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// 间隔过后允许再次强制校验
+	assert.Zero(t, modelValidator.reserveForce(time.Now().Add(config.ModelValidationForceInterval)))
+}
+
+func TestRouter_ValidateModelsRequiresAdminToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-token")
+	assert.Equal(t, http.StatusUnauthorized, serveRouter(t, http.MethodPost, "/api/models/validate", "", false).Code)
+	assert.Equal(t, http.StatusUnauthorized, serveRouter(t, http.MethodPost, "/api/models/validate", "", true).Code, "客户端令牌不能触发校验")
+}
+
+func TestBuildModelList_NoStatusBeforeValidation(t *testing.T) {
+	original := modelValidator
+	modelValidator = NewModelValidator("http://127.0.0.1:0", time.Hour)
+	defer func() { modelValidator = original }()
+
+	for _, model := range buildModelList() {
+		assert.Empty(t, model.Status)
+	}
+}
+
+func TestBuildModelList_IncludesCustomAliases(t *testing.T) {
+	t.Setenv("MODEL_ALIASES", `{"gpt-4o": "claude-sonnet-4-5"}`)
+
+	models := make(map[string]types.Model)
+	for _, model := range buildModelList() {
+		models[model.ID] = model
+	}
+	require.Contains(t, models, "gpt-4o")
+	assert.Equal(t, "kiro2api", models["gpt-4o"].OwnedBy)
+	assert.Contains(t, models, "claude-sonnet-4-5")
+	assert.Len(t, models, len(config.ModelMap)+1)
+}
+
+func TestModelsEndpoint_ReturnsCapabilities(t *testing.T) {
+	t.Setenv("MODEL_ALIASES", `{"fast": "claude-3-5-haiku-20241022"}`)
+
+	w := httptest.NewRecorder()
+	router := gin.New()
+	router.GET("/v1/models", func(c *gin.Context) {
+		c.JSON(http.StatusOK, types.ModelsResponse{Object: "list", Data: buildModelList()})
+	})
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Data []map[string]any `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	models := make(map[string]map[string]any)
+	for _, model := range resp.Data {
+		models[model["id"].(string)] = model
+	}
+
+	tests := []struct {
+		id        string
+		thinking  bool
+		maxOutput float64
+	}{
+		{"claude-sonnet-4-5", true, 64000},
+		{"claude-sonnet-4-20250514", true, 64000},
+		{"claude-3-7-sonnet-20250219", true, 64000},
+		{"claude-3-5-haiku-20241022", false, 8192},
+		{"claude-haiku-4-5-20251001", true, 64000},
+		{"fast", false, 8192}, // 别名取目标模型的能力
+	}
+	for _, tt := range tests {
+		model := models[tt.id]
+		require.NotNil(t, model, tt.id)
+		assert.Equal(t, true, model["supports_tools"], tt.id)
+		assert.Equal(t, true, model["supports_vision"], tt.id)
+		assert.Equal(t, tt.thinking, model["supports_thinking"], tt.id)
+		assert.Equal(t, tt.maxOutput, model["max_output_tokens"], tt.id)
+		assert.Equal(t, float64(200000), model["context_window"], tt.id)
+	}
+}
+
+func TestCustomModelAlias_ResolvesUpstream(t *testing.T) {
+	t.Setenv("MODEL_ALIASES", `{"gpt-4o": "claude-sonnet-4-5"}`)
+
+	req := newStopTestRequest(false)
+	req.Model = "gpt-4o"
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	httpReq, err := buildCodeWhispererRequest(c, req, types.TokenInfo{AccessToken: "a"}, false)
+	require.NoError(t, err)
+
+	body, _ := io.ReadAll(httpReq.Body)
+	assert.Contains(t, string(body), `"modelId":"CLAUDE_SONNET_4_5_20250929_V1_0"`)
+}
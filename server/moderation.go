@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RuleModerationUnavailable 审核服务不可用且配置为fail-closed时使用的规则ID
+const RuleModerationUnavailable = "moderation_unavailable"
+
+// ModerationRequest 提交给审核器的请求摘要
+type ModerationRequest struct {
+	RequestType  string `json:"request_type"` // Anthropic / OpenAI
+	Model        string `json:"model"`
+	ClientKey    string `json:"client_key"` // 已脱敏
+	MessageCount int    `json:"message_count"`
+	UserContent  string `json:"user_content"` // 所有用户消息拼接后的文本
+}
+
+// ModerationDecision 审核结果
+type ModerationDecision struct {
+	Allowed bool   `json:"allow"`
+	RuleID  string `json:"rule_id,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Moderator 请求转发上游前的内容审核接口
+// 在请求标准化之后、选择token之前调用，拒绝的请求不会消耗任何token额度
+type Moderator interface {
+	Name() string
+	Check(ctx context.Context, req ModerationRequest) ModerationDecision
+}
+
+// contentModerator 全局审核器，未配置任何规则时为nil
+var contentModerator Moderator
+
+// InitModeration 根据环境变量初始化内容审核器
+func InitModeration() error {
+	moderator, err := NewModeratorFromEnv()
+	if err != nil {
+		return err
+	}
+	contentModerator = moderator
+	if moderator != nil {
+		logger.Info("内容审核已启用", logger.String("moderator", moderator.Name()))
+	}
+	return nil
+}
+
+// NewModeratorFromEnv 根据环境变量构建审核器
+// MODERATION_BLOCKLIST: 正则黑名单，JSON数组或JSON文件路径
+// MODERATION_WEBHOOK_URL: 外部审核webhook
+// 两者都配置时先执行正则黑名单，再调用webhook；都未配置时返回nil
+func NewModeratorFromEnv() (Moderator, error) {
+	var chain ModeratorChain
+
+	if blocklist := strings.TrimSpace(os.Getenv("MODERATION_BLOCKLIST")); blocklist != "" {
+		rules, err := loadModerationRules(blocklist)
+		if err != nil {
+			return nil, err
+		}
+		regexModerator, err := NewRegexModerator(rules)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, regexModerator)
+	}
+
+	if webhookURL := strings.TrimSpace(os.Getenv("MODERATION_WEBHOOK_URL")); webhookURL != "" {
+		timeout := time.Duration(utils.GetEnvIntWithDefault("MODERATION_WEBHOOK_TIMEOUT_MS",
+			int(config.ModerationWebhookTimeout/time.Millisecond))) * time.Millisecond
+		failOpen := utils.GetEnvBoolWithDefault("MODERATION_FAIL_OPEN", true)
+		chain = append(chain, NewWebhookModerator(webhookURL, timeout, failOpen))
+	}
+
+	switch len(chain) {
+	case 0:
+		return nil, nil
+	case 1:
+		return chain[0], nil
+	default:
+		return chain, nil
+	}
+}
+
+// ModeratorChain 按顺序执行多个审核器，第一个拒绝结果生效
+type ModeratorChain []Moderator
+
+func (mc ModeratorChain) Name() string {
+	names := make([]string, 0, len(mc))
+	for _, m := range mc {
+		names = append(names, m.Name())
+	}
+	return strings.Join(names, "+")
+}
+
+func (mc ModeratorChain) Check(ctx context.Context, req ModerationRequest) ModerationDecision {
+	for _, m := range mc {
+		if decision := m.Check(ctx, req); !decision.Allowed {
+			return decision
+		}
+	}
+	return ModerationDecision{Allowed: true}
+}
+
+// ModerationRule 正则黑名单规则
+type ModerationRule struct {
+	ID      string `json:"id"`
+	Pattern string `json:"pattern"`
+}
+
+// loadModerationRules 解析黑名单配置，优先检查是否为文件路径（与KIRO_AUTH_TOKEN一致）
+func loadModerationRules(value string) ([]ModerationRule, error) {
+	data := []byte(value)
+	if fileInfo, err := os.Stat(value); err == nil && !fileInfo.IsDir() {
+		content, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("读取审核规则文件失败: %w", err)
+		}
+		data = content
+	}
+
+	var rules []ModerationRule
+	if err := utils.SafeUnmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("解析MODERATION_BLOCKLIST失败: %w", err)
+	}
+	return rules, nil
+}
+
+type compiledModerationRule struct {
+	id      string
+	pattern *regexp.Regexp
+}
+
+// RegexModerator 内置的正则黑名单审核器
+type RegexModerator struct {
+	rules []compiledModerationRule
+}
+
+// NewRegexModerator 编译规则并创建正则审核器
+func NewRegexModerator(rules []ModerationRule) (*RegexModerator, error) {
+	compiled := make([]compiledModerationRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.ID == "" {
+			return nil, fmt.Errorf("审核规则 %d 缺少id", i)
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("审核规则 %s 正则无效: %w", rule.ID, err)
+		}
+		compiled = append(compiled, compiledModerationRule{id: rule.ID, pattern: pattern})
+	}
+	return &RegexModerator{rules: compiled}, nil
+}
+
+func (rm *RegexModerator) Name() string { return "regex" }
+
+func (rm *RegexModerator) Check(_ context.Context, req ModerationRequest) ModerationDecision {
+	for _, rule := range rm.rules {
+		if rule.pattern.MatchString(req.UserContent) {
+			return ModerationDecision{Allowed: false, RuleID: rule.id}
+		}
+	}
+	return ModerationDecision{Allowed: true}
+}
+
+// WebhookModerator 将请求摘要POST到外部服务，由其返回 allow/deny
+// 期望响应: {"allow": bool, "rule_id": "...", "reason": "..."}
+type WebhookModerator struct {
+	url        string
+	timeout    time.Duration
+	failOpen   bool // webhook超时或出错时是否放行
+	httpClient *http.Client
+}
+
+// NewWebhookModerator 创建webhook审核器
+func NewWebhookModerator(url string, timeout time.Duration, failOpen bool) *WebhookModerator {
+	return &WebhookModerator{
+		url:        url,
+		timeout:    timeout,
+		failOpen:   failOpen,
+		httpClient: utils.SharedHTTPClient,
+	}
+}
+
+func (wm *WebhookModerator) Name() string { return "webhook" }
+
+func (wm *WebhookModerator) Check(ctx context.Context, req ModerationRequest) ModerationDecision {
+	decision, err := wm.call(ctx, req)
+	if err == nil {
+		return decision
+	}
+
+	logger.Warn("内容审核webhook调用失败",
+		logger.Err(err),
+		logger.Bool("fail_open", wm.failOpen))
+	if wm.failOpen {
+		return ModerationDecision{Allowed: true, Reason: "webhook不可用，按fail-open放行"}
+	}
+	return ModerationDecision{Allowed: false, RuleID: RuleModerationUnavailable, Reason: err.Error()}
+}
+
+func (wm *WebhookModerator) call(ctx context.Context, req ModerationRequest) (ModerationDecision, error) {
+	ctx, cancel := context.WithTimeout(ctx, wm.timeout)
+	defer cancel()
+
+	body, err := utils.SafeMarshal(req)
+	if err != nil {
+		return ModerationDecision{}, fmt.Errorf("序列化审核请求失败: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", wm.url, bytes.NewReader(body))
+	if err != nil {
+		return ModerationDecision{}, fmt.Errorf("创建审核请求失败: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := wm.httpClient.Do(httpReq)
+	if err != nil {
+		return ModerationDecision{}, fmt.Errorf("审核请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ModerationDecision{}, fmt.Errorf("读取审核响应失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ModerationDecision{}, fmt.Errorf("审核服务返回状态码 %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var decision ModerationDecision
+	if err := utils.SafeUnmarshal(respBody, &decision); err != nil {
+		return ModerationDecision{}, fmt.Errorf("解析审核响应失败: %w", err)
+	}
+	return decision, nil
+}
+
+// buildModerationRequest 从标准化后的请求构建审核摘要
+func buildModerationRequest(c *gin.Context, requestType string, anthropicReq types.AnthropicRequest) ModerationRequest {
+	var parts []string
+	for _, msg := range anthropicReq.Messages {
+		if msg.Role != "user" {
+			continue
+		}
+		content, err := utils.GetMessageContent(msg.Content)
+		if err != nil || content == "" {
+			continue
+		}
+		parts = append(parts, content)
+	}
+
+	return ModerationRequest{
+		RequestType:  requestType,
+		Model:        anthropicReq.Model,
+		ClientKey:    maskClientKey(extractAPIKey(c)),
+		MessageCount: len(anthropicReq.Messages),
+		UserContent:  strings.Join(parts, "\n"),
+	}
+}
+
+// moderateRequest 执行内容审核并记录审计日志
+// 返回false表示请求被拒绝，错误响应已写入
+func moderateRequest(c *gin.Context, requestType string, anthropicReq types.AnthropicRequest) bool {
+	if contentModerator == nil {
+		return true
+	}
+
+	decision := contentModerator.Check(c.Request.Context(), buildModerationRequest(c, requestType, anthropicReq))
+
+	auditLog(c, "moderation",
+		logger.String("moderator", contentModerator.Name()),
+		logger.Bool("allowed", decision.Allowed),
+		logger.String("rule_id", decision.RuleID),
+		logger.String("reason", decision.Reason),
+		logger.String("model", anthropicReq.Model))
+
+	if decision.Allowed {
+		return true
+	}
+
+	// 只返回规则ID，不暴露具体正则
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": gin.H{
+			"message": fmt.Sprintf("请求内容违反使用策略 (rule: %s)", decision.RuleID),
+			"code":    "policy_violation",
+			"rule_id": decision.RuleID,
+		},
+	})
+	return false
+}
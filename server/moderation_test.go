@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRegexModerator(t *testing.T) *RegexModerator {
+	rm, err := NewRegexModerator([]ModerationRule{
+		{ID: "no-secrets", Pattern: `(?i)aws_secret_access_key`},
+	})
+	require.NoError(t, err)
+	return rm
+}
+
+func TestRegexModerator_Allow(t *testing.T) {
+	rm := newTestRegexModerator(t)
+	decision := rm.Check(context.Background(), ModerationRequest{UserContent: "帮我写一个排序函数"})
+	assert.True(t, decision.Allowed)
+	assert.Empty(t, decision.RuleID)
+}
+
+func TestRegexModerator_Deny(t *testing.T) {
+	rm := newTestRegexModerator(t)
+	decision := rm.Check(context.Background(), ModerationRequest{UserContent: "my AWS_SECRET_ACCESS_KEY is ..."})
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "no-secrets", decision.RuleID)
+}
+
+func TestNewRegexModerator_InvalidPattern(t *testing.T) {
+	_, err := NewRegexModerator([]ModerationRule{{ID: "bad", Pattern: "("}})
+	assert.Error(t, err)
+}
+
+func TestWebhookModerator_Deny(t *testing.T) {
+	var received ModerationRequest
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		_, _ = w.Write([]byte(`{"allow":false,"rule_id":"ext-42","reason":"blocked"}`))
+	}))
+	defer webhook.Close()
+
+	wm := NewWebhookModerator(webhook.URL, time.Second, true)
+	decision := wm.Check(context.Background(), ModerationRequest{Model: "claude-sonnet-4-20250514", UserContent: "hello"})
+
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "ext-42", decision.RuleID)
+	assert.Equal(t, "hello", received.UserContent)
+	assert.Equal(t, "claude-sonnet-4-20250514", received.Model)
+}
+
+func TestWebhookModerator_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer webhook.Close()
+	defer close(release)
+
+	t.Run("fail-open", func(t *testing.T) {
+		wm := NewWebhookModerator(webhook.URL, 50*time.Millisecond, true)
+		decision := wm.Check(context.Background(), ModerationRequest{UserContent: "hello"})
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("fail-closed", func(t *testing.T) {
+		wm := NewWebhookModerator(webhook.URL, 50*time.Millisecond, false)
+		decision := wm.Check(context.Background(), ModerationRequest{UserContent: "hello"})
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, RuleModerationUnavailable, decision.RuleID)
+	})
+}
+
+func TestModerateRequest_DenyDoesNotLeakPattern(t *testing.T) {
+	original := contentModerator
+	contentModerator = newTestRegexModerator(t)
+	defer func() { contentModerator = original }()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	c.Request.Header.Set("x-api-key", "client-key-123456")
+
+	req := types.AnthropicRequest{
+		Model: "claude-sonnet-4-20250514",
+		Messages: []types.AnthropicRequestMessage{
+			{Role: "user", Content: "first message"},
+			{Role: "assistant", Content: "aws_secret_access_key in assistant text is ignored"},
+			{Role: "user", Content: "here is aws_secret_access_key=abc"},
+		},
+	}
+
+	assert.False(t, moderateRequest(c, "Anthropic", req))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp map[string]map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "policy_violation", resp["error"]["code"])
+	assert.Equal(t, "no-secrets", resp["error"]["rule_id"])
+	assert.NotContains(t, w.Body.String(), "aws_secret_access_key")
+}
+
+func TestModerateRequest_NoModeratorAllows(t *testing.T) {
+	original := contentModerator
+	contentModerator = nil
+	defer func() { contentModerator = original }()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	assert.True(t, moderateRequest(c, "Anthropic", types.AnthropicRequest{}))
+}
+
+func TestNewModeratorFromEnv(t *testing.T) {
+	t.Setenv("MODERATION_BLOCKLIST", "")
+	t.Setenv("MODERATION_WEBHOOK_URL", "")
+	m, err := NewModeratorFromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, m)
+
+	t.Setenv("MODERATION_BLOCKLIST", `[{"id":"r1","pattern":"foo"}]`)
+	t.Setenv("MODERATION_WEBHOOK_URL", "http://127.0.0.1:0")
+	m, err = NewModeratorFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, "regex+webhook", m.Name())
+
+	t.Setenv("MODERATION_BLOCKLIST", `[{"id":"r1","pattern":"("}]`)
+	_, err = NewModeratorFromEnv()
+	assert.Error(t, err)
+}
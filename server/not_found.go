@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registerFallbackHandlers 注册未知路径和方法不匹配时的处理
+// /v1 下按API方言返回标准错误结构，SDK据此识别为不可重试的客户端错误；其余路径保持原有的404响应
+func registerFallbackHandlers(r *gin.Engine) {
+	// 路径存在但方法不匹配时由gin设置Allow头并调用NoMethod
+	r.HandleMethodNotAllowed = true
+	r.NoRoute(handleNoRoute)
+	r.NoMethod(handleNoMethod)
+}
+
+// handleNoRoute 未知路径
+func handleNoRoute(c *gin.Context) {
+	logger.Warn("访问未知端点",
+		logger.String("path", c.Request.URL.Path),
+		logger.String("method", c.Request.Method))
+
+	if !isV1Path(c.Request.URL.Path) {
+		respondError(c, http.StatusNotFound, "%s", "404 未找到")
+		return
+	}
+	respondV1Error(c, http.StatusNotFound,
+		fmt.Sprintf("Not found: %s %s", c.Request.Method, c.Request.URL.Path))
+}
+
+// handleNoMethod 路径存在但方法不匹配
+func handleNoMethod(c *gin.Context) {
+	allowed := c.Writer.Header().Get("Allow")
+	logger.Warn("请求方法不匹配",
+		logger.String("path", c.Request.URL.Path),
+		logger.String("method", c.Request.Method),
+		logger.String("allow", allowed))
+
+	if !isV1Path(c.Request.URL.Path) {
+		c.Writer.Header().Del("Allow")
+		respondError(c, http.StatusNotFound, "%s", "404 未找到")
+		return
+	}
+	respondV1Error(c, http.StatusMethodNotAllowed,
+		fmt.Sprintf("Method %s not allowed for %s (allowed: %s)", c.Request.Method, c.Request.URL.Path, allowed))
+}
+
+// respondV1Error 按路径对应的API方言返回404/405错误
+// Anthropic: not_found_error / invalid_request_error；OpenAI: invalid_request_error + code
+func respondV1Error(c *gin.Context, statusCode int, message string) {
+	if isOpenAIPath(c.Request.URL.Path) {
+		code := "unknown_url"
+		if statusCode == http.StatusMethodNotAllowed {
+			code = "method_not_allowed"
+		}
+		c.JSON(statusCode, gin.H{
+			"error": gin.H{
+				"message": message,
+				"type":    "invalid_request_error",
+				"param":   nil,
+				"code":    code,
+			},
+		})
+		return
+	}
+
+	errorType := "not_found_error"
+	if statusCode == http.StatusMethodNotAllowed {
+		errorType = "invalid_request_error"
+	}
+	c.JSON(statusCode, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errorType,
+			"message": message,
+		},
+	})
+}
+
+// isV1Path 是否为 /v1 下的API路径
+func isV1Path(path string) bool {
+	return path == "/v1" || strings.HasPrefix(path, "/v1/")
+}
+
+// isOpenAIPath 是否为OpenAI兼容端点的路径（/v1/chat、/v1/completions）
+func isOpenAIPath(path string) bool {
+	for _, prefix := range []string{"/v1/chat", "/v1/completions"} {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
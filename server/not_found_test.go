@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFallbackTestRouter() *gin.Engine {
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	r.GET("/v1/models", ok)
+	r.POST("/v1/messages", ok)
+	r.POST("/v1/chat/completions", ok)
+	r.POST("/api/config", ok)
+	registerFallbackHandlers(r)
+	return r
+}
+
+func serveFallback(method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	newFallbackTestRouter().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+// anthropicError 解析Anthropic错误结构
+func anthropicError(t *testing.T, w *httptest.ResponseRecorder) (string, string) {
+	t.Helper()
+	var resp struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+	assert.Equal(t, "error", resp.Type)
+	return resp.Error.Type, resp.Error.Message
+}
+
+func TestFallback_TypoPathUnderV1(t *testing.T) {
+	w := serveFallback(http.MethodPost, "/v1/message")
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	errorType, message := anthropicError(t, w)
+	assert.Equal(t, "not_found_error", errorType)
+	assert.Contains(t, message, "/v1/message")
+	assert.Empty(t, w.Header().Get("Allow"))
+}
+
+func TestFallback_WrongMethod(t *testing.T) {
+	w := serveFallback(http.MethodGet, "/v1/messages")
+
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, http.MethodPost, w.Header().Get("Allow"))
+	errorType, message := anthropicError(t, w)
+	assert.Equal(t, "invalid_request_error", errorType)
+	assert.Contains(t, message, "GET")
+	assert.Contains(t, message, "/v1/messages")
+}
+
+func TestFallback_HeadRequest(t *testing.T) {
+	w := serveFallback(http.MethodHead, "/v1/models")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, http.MethodGet, w.Header().Get("Allow"))
+
+	w = serveFallback(http.MethodHead, "/v1/unknown")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("Allow"))
+}
+
+func TestFallback_OpenAIEnvelope(t *testing.T) {
+	cases := []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{http.MethodPost, "/v1/chat/completion", http.StatusNotFound, "unknown_url"},
+		{http.MethodPost, "/v1/completions", http.StatusNotFound, "unknown_url"},
+		{http.MethodGet, "/v1/chat/completions", http.StatusMethodNotAllowed, "method_not_allowed"},
+	}
+	for _, tc := range cases {
+		w := serveFallback(tc.method, tc.path)
+		require.Equal(t, tc.status, w.Code, tc.path)
+
+		var resp struct {
+			Error struct {
+				Type    string `json:"type"`
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "invalid_request_error", resp.Error.Type, tc.path)
+		assert.Equal(t, tc.code, resp.Error.Code, tc.path)
+		assert.Contains(t, resp.Error.Message, tc.path)
+	}
+}
+
+func TestFallback_NonV1PathsKeepLegacyResponse(t *testing.T) {
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodGet, "/unknown"},
+		{http.MethodGet, "/v1x/messages"},
+		{http.MethodGet, "/api/config"},
+	} {
+		w := serveFallback(tc.method, tc.path)
+		assert.Equal(t, http.StatusNotFound, w.Code, tc.path)
+		assert.Empty(t, w.Header().Get("Allow"), tc.path)
+		assert.JSONEq(t, `{"error":{"message":"404 未找到","code":"not_found"}}`, w.Body.String(), tc.path)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,16 +11,28 @@ import (
 	"kiro2api/converter"
 	"kiro2api/logger"
 	"kiro2api/parser"
-	"kiro2api/types"
 	"kiro2api/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
 // handleOpenAINonStreamRequest 处理OpenAI非流式请求
-func handleOpenAINonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) {
-	resp, err := executeCodeWhispererRequest(c, anthropicReq, token, false)
+func handleOpenAINonStreamRequest(scope *RequestScope) {
+	c, anthropicReq := scope.c, scope.Request
+	scope.Stream = false
+	scope.EffectiveParams = attachEffectiveParams(c, anthropicReq, false)
+
+	// 可选：客户端指定的整体超时（X-Kiro-Timeout-Ms）
+	defer beginClientTimeout(c, false)()
+
+	resp, err := executeCodeWhispererRequest(scope)
 	if err != nil {
+		if respondModelNotFound(c, err, nil) {
+			return
+		}
+		if errors.Is(err, ErrClientTimeout) {
+			respondClientTimeout(c)
+		}
 		return
 	}
 	defer resp.Body.Close()
@@ -27,6 +40,10 @@ func handleOpenAINonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRe
 	// 读取响应体
 	body, err := utils.ReadHTTPResponse(resp.Body)
 	if err != nil {
+		if clientTimedOut(c) {
+			respondClientTimeout(c)
+			return
+		}
 		handleResponseReadError(c, err)
 		return
 	}
@@ -34,15 +51,38 @@ func handleOpenAINonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRe
 	// 使用新的符合AWS规范的解析器
 	compliantParser := parser.NewCompliantEventStreamParser()
 	result, err := compliantParser.ParseResponse(body)
+	if errors.Is(err, parser.ErrTooManyActiveTools) {
+		logger.Error("同时进行的工具调用过多", addReqFields(c, logger.Err(err))...)
+		c.JSON(http.StatusBadGateway, gin.H{"error": tooManyActiveToolsMessage})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "响应解析失败"})
 		return
 	}
+	result = messageBoundaryPolicy.ApplyToResult(c, result)
+	// 非流式响应只统计未知内容块，不写入响应
+	recordUnknownBlocks(c, result.Events)
 
 	// 转换为Anthropic格式
 	contexts := []map[string]any{}
 	allContent := result.GetCompletionText()
-	sawToolUse := len(result.GetToolCalls()) > 0
+	toolCalls := NewStopReasonManager(anthropicReq).LimitToolCalls(result.GetToolCalls())
+
+	// 客户端侧停止序列：命中后截断文本，之后的工具调用也一并丢弃
+	stopMatcher := NewStopSequenceMatcher(anthropicReq.StopSequences)
+	if text, stopped := stopMatcher.Feed(allContent); stopped {
+		allContent = text
+		toolCalls = nil
+	} else {
+		allContent = text + stopMatcher.Flush()
+	}
+	// 上游拒绝/安全拦截：保留已生成的文本，丢弃工具调用
+	refusalMessage, refused := findRefusal(result.Events)
+	if refused {
+		toolCalls = nil
+	}
+	sawToolUse := len(toolCalls) > 0
 
 	// 添加文本内容
 	if allContent != "" {
@@ -53,18 +93,25 @@ func handleOpenAINonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRe
 	}
 
 	// 添加工具调用
-	for _, tool := range result.GetToolCalls() {
+	for _, tool := range toolCalls {
 		contexts = append(contexts, map[string]any{
 			"type":  "tool_use",
 			"id":    tool.ID,
-			"name":  tool.Name,
+			"name":  anthropicReq.OriginalToolName(tool.Name),
 			"input": tool.Arguments,
 		})
 	}
 
+	// 对账统计使用与Anthropic端点相同的token估算
+	scope.estimateInputTokens()
+	scope.OutputTokens = utils.NewTokenEstimator().EstimateTextTokens(allContent)
+	scope.recordEstimatedUsage(scope.OutputTokens)
+
 	// 构建Anthropic响应
-	inputContent, _ := utils.GetMessageContent(anthropicReq.Messages[0].Content)
 	stopReason := func() string {
+		if refused {
+			return "refusal"
+		}
 		if sawToolUse {
 			return "tool_use"
 		}
@@ -78,14 +125,20 @@ func handleOpenAINonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRe
 		"stop_sequence": nil,
 		"type":          "message",
 		"usage": map[string]any{
-			"input_tokens":  len(inputContent),
-			"output_tokens": len(allContent),
+			"input_tokens":  scope.InputTokens,
+			"output_tokens": scaleOutputTokens(scope.OutputTokens, outputTokenFactor(scope.TokenInfo())),
 		},
 	}
+	if refused {
+		anthropicResp["refusal"] = refusalMessage
+	}
 
 	// 转换为OpenAI格式
 	openaiMessageId := fmt.Sprintf("chatcmpl-%s", time.Now().Format(config.MessageIDTimeFormat))
 	openaiResp := converter.ConvertAnthropicToOpenAI(anthropicResp, anthropicReq.Model, openaiMessageId)
+	if scope.EffectiveParams != nil {
+		openaiResp.Kiro = scope.EffectiveParams
+	}
 
 	// 下发OpenAI兼容非流式响应
 	logger.Debug("下发OpenAI非流式响应",
@@ -97,26 +150,61 @@ func handleOpenAINonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRe
 }
 
 // handleOpenAIStreamRequest 处理OpenAI流式请求
-func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) {
+func handleOpenAIStreamRequest(scope *RequestScope) {
+	c, anthropicReq := scope.c, scope.Request
+	disableWriteDeadline(c)
+	// 携带Last-Event-ID的重连：只重发尚未送达的事件
+	if resumeSSEStream(c) {
+		return
+	}
+	scope.Stream = true
+	scope.EffectiveParams = attachEffectiveParams(c, anthropicReq, true)
+	// 计算输入tokens（基于实际发送给上游的数据）
+	scope.estimateInputTokens()
+
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 	c.Header("X-Accel-Buffering", "no") // 禁用nginx缓冲
 
-	messageId := fmt.Sprintf("chatcmpl-%s", time.Now().Format(config.MessageIDTimeFormat))
+	scope.MessageID = fmt.Sprintf("chatcmpl-%s", time.Now().Format(config.MessageIDTimeFormat))
+	messageId := scope.MessageID
 	// 注入 message_id，便于统一日志会话标识
 	c.Set("message_id", messageId)
 
-	resp, err := executeCodeWhispererRequest(c, anthropicReq, token, true)
+	// 登记SSE流，之后的事件都带有单调递增的id
+	stream := beginSSEStream(c)
+	defer stream.finish()
+
+	// 可选：取消同一会话中仍在进行的旧流（ABORT_DUPLICATE_STREAMS）
+	defer beginConversationStream(c)()
+
+	// 可选：客户端指定的首字节超时（X-Kiro-Timeout-Ms）
+	defer beginClientTimeout(c, true)()
+
+	// 下发队列：客户端读取过慢时结束流并取消上游请求（SLOW_CLIENT_GRACE）
+	sender := &OpenAIStreamSender{}
+	guard := beginSlowClientGuard(c)
+	defer guard.finish(sender)
+
+	resp, err := executeCodeWhispererRequest(scope)
 	if err != nil {
+		if respondModelNotFound(c, err, nil) {
+			return
+		}
+		if errors.Is(err, ErrStreamSuperseded) {
+			sendStreamSuperseded(c, &OpenAIStreamSender{})
+		}
+		if errors.Is(err, ErrClientTimeout) {
+			sendClientTimeout(c, &OpenAIStreamSender{})
+		}
 		return
 	}
 	defer resp.Body.Close()
 
 	// 立即刷新响应头
 	c.Writer.Flush()
-
-	sender := &OpenAIStreamSender{}
+	guard.attach()
 
 	// 发送初始OpenAI事件
 	initialEvent := map[string]any{
@@ -136,16 +224,116 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	}
 	sender.SendEvent(c, initialEvent)
 
+	// 可选：json_object模式下增量校验JSON结构（STREAM_JSON_VALIDATION）
+	var jsonValidator *StreamingJSONValidator
+	if streamJSONValidation && anthropicReq.JSONObjectMode() {
+		jsonValidator = NewStreamingJSONValidator()
+	}
+	invalidJSON := false
+	var invalidJSONErr error
+	tokenEstimator := utils.NewTokenEstimator()
+
+	// 发送文本增量
+	sendTextDelta := func(text string) {
+		if text == "" || invalidJSON {
+			return
+		}
+		if jsonValidator != nil {
+			if err := jsonValidator.Feed(text); err != nil {
+				// 结构已损坏，不再下发这段文本
+				invalidJSON = true
+				invalidJSONErr = err
+				return
+			}
+		}
+		contentEvent := map[string]any{
+			"id":      messageId,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   anthropicReq.Model,
+			"choices": []map[string]any{
+				{
+					"index": 0,
+					"delta": map[string]any{
+						"content": text,
+					},
+					"finish_reason": nil,
+				},
+			},
+		}
+		sender.SendEvent(c, contentEvent)
+		scope.OutputTokens += tokenEstimator.EstimateTextTokens(text)
+	}
+
+	// 客户端侧停止序列检测（跨delta）
+	stopMatcher := NewStopSequenceMatcher(anthropicReq.StopSequences)
+	stopped := false
+	refused := false
+	truncated := false // 在消息边界处截断
+
 	// 创建符合AWS规范的流式解析器
 	compliantParser := parser.NewCompliantEventStreamParser()
 
 	// OpenAI 工具调用增量状态
 	toolIndexByToolUseId := make(map[string]int)  // tool_use_id -> tool_calls 数组索引
 	toolUseIdByBlockIndex := make(map[int]string) // 内容块 index -> tool_use_id
+	argumentsSent := make(map[int]bool)           // tool_calls 索引 -> 已下发过参数
+	argumentsComplete := make(map[int]bool)       // tool_calls 索引 -> 参数已随开始块完整下发
+	argumentBytes := make(map[int]int)            // tool_calls 索引 -> 已下发参数的字节数
 	nextToolIndex := 0
 	sawToolUse := false
+	stopReasonManager := NewStopReasonManager(anthropicReq)
 	sentFinal := false
 
+	// 发送工具调用参数片段（首个增量只带id和name，参数由之后的增量下发）
+	sendToolArguments := func(toolIdx int, arguments string) {
+		argumentsSent[toolIdx] = true
+		argumentBytes[toolIdx] += len(arguments)
+		toolDelta := map[string]any{
+			"id":      messageId,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   anthropicReq.Model,
+			"choices": []map[string]any{
+				{
+					"index": 0,
+					"delta": map[string]any{
+						"tool_calls": []map[string]any{
+							{
+								"index": toolIdx,
+								"type":  "function",
+								"function": map[string]any{
+									"arguments": arguments,
+								},
+							},
+						},
+					},
+					"finish_reason": nil,
+				},
+			},
+		}
+		sender.SendEvent(c, toolDelta)
+	}
+
+	// 上游没有下发任何参数的工具调用（无参数工具，或一次性下发且未携带参数增量）补发"{}"
+	// 保证客户端拼接得到的arguments是合法JSON
+	completeToolArguments := func() {
+		for toolIdx := range nextToolIndex {
+			if !argumentsSent[toolIdx] {
+				sendToolArguments(toolIdx, "{}")
+			}
+		}
+	}
+
+	// 按已下发的内容记录输出token，流被中止（被新流取代、客户端超时、慢客户端、解析错误等）时同样计入
+	// 工具参数按字节累加后统一换算，避免分段整除的精度损失
+	defer func() {
+		for _, n := range argumentBytes {
+			scope.OutputTokens += (n + 3) / 4
+		}
+		scope.recordEstimatedUsage(scope.OutputTokens)
+	}()
+
 	// 添加完整性跟踪
 	totalBytesRead := 0
 	messageCount := 0
@@ -155,13 +343,20 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 
 	// 使用更大的缓冲区避免数据丢失
 	buf := make([]byte, 8192) // 增加到8KB
+	upstream := clientTimeoutReader(c, resp.Body)
 	for hasMoreData {
-		n, err := resp.Body.Read(buf)
+		n, err := upstream.Read(buf)
 		if n > 0 {
 			totalBytesRead += n
 			consecutiveErrors = 0 // 重置错误计数
 
 			events, parseErr := compliantParser.ParseStream(buf[:n])
+			if errors.Is(parseErr, parser.ErrTooManyActiveTools) {
+				logger.Error("同时进行的工具调用过多，中止OpenAI流式响应", addReqFields(c, logger.Err(parseErr))...)
+				_ = sender.SendError(c, tooManyActiveToolsMessage, parseErr)
+				c.Writer.Flush()
+				return
+			}
 			if parseErr != nil {
 				// 在宽松模式下继续处理
 				continue
@@ -176,24 +371,11 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 								if deltaMap, ok := delta.(map[string]any); ok {
 									switch deltaMap["type"] {
 									case "text_delta":
-										if text, ok := deltaMap["text"]; ok {
-											// 发送文本内容的增量
-											contentEvent := map[string]any{
-												"id":      messageId,
-												"object":  "chat.completion.chunk",
-												"created": time.Now().Unix(),
-												"model":   anthropicReq.Model,
-												"choices": []map[string]any{
-													{
-														"index": 0,
-														"delta": map[string]any{
-															"content": text.(string),
-														},
-														"finish_reason": nil,
-													},
-												},
-											}
-											sender.SendEvent(c, contentEvent)
+										if text, ok := deltaMap["text"].(string); ok {
+											// 发送文本内容的增量（命中停止序列时截断）
+											safeText, hit := stopMatcher.Feed(text)
+											sendTextDelta(safeText)
+											stopped = hit
 										}
 									case "input_json_delta":
 										// 工具调用参数增量
@@ -224,31 +406,8 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 														}
 													}
 												}
-												if partial != "" {
-													toolDelta := map[string]any{
-														"id":      messageId,
-														"object":  "chat.completion.chunk",
-														"created": time.Now().Unix(),
-														"model":   anthropicReq.Model,
-														"choices": []map[string]any{
-															{
-																"index": 0,
-																"delta": map[string]any{
-																	"tool_calls": []map[string]any{
-																		{
-																			"index": toolIdx,
-																			"type":  "function",
-																			"function": map[string]any{
-																				"arguments": partial,
-																			},
-																		},
-																	},
-																},
-																"finish_reason": nil,
-															},
-														},
-													}
-													sender.SendEvent(c, toolDelta)
+												if partial != "" && !argumentsComplete[toolIdx] {
+													sendToolArguments(toolIdx, partial)
 												}
 											}
 										}
@@ -259,8 +418,11 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 							if contentBlock, ok := dataMap["content_block"]; ok {
 								if blockMap, ok := contentBlock.(map[string]any); ok {
 									if blockType, _ := blockMap["type"].(string); blockType == "tool_use" {
+										// 工具调用开始前先下发暂缓的文本，保持顺序
+										sendTextDelta(stopMatcher.Flush())
 										toolUseId, _ := blockMap["id"].(string)
 										toolName, _ := blockMap["name"].(string)
+										toolName = anthropicReq.OriginalToolName(toolName)
 										// 获取内容块索引
 										toolBlockIndex := 0
 										if idxAny, ok := dataMap["index"]; ok {
@@ -275,7 +437,9 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 												toolBlockIndex = int(v)
 											}
 										}
-										if toolUseId != "" {
+										// 禁用并行工具调用时忽略后续工具块，其增量因找不到对应索引而被丢弃
+										_, knownTool := toolIndexByToolUseId[toolUseId]
+										if toolUseId != "" && (knownTool || stopReasonManager.AcceptToolUse(nextToolIndex)) {
 											if _, exists := toolIndexByToolUseId[toolUseId]; !exists {
 												toolIndexByToolUseId[toolUseId] = nextToolIndex
 												nextToolIndex++
@@ -310,6 +474,15 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 												},
 											}
 											sender.SendEvent(c, toolStart)
+											// 工具调用结构字段（type、id、name）的固定开销加工具名称
+											scope.OutputTokens += 12 + tokenEstimator.EstimateTextTokens(toolName)
+											// 开始块已携带完整参数（上游一次性下发）时，作为参数片段补发
+											if input, ok := blockMap["input"].(map[string]any); ok && len(input) > 0 && !argumentsSent[toolIdx] {
+												if arguments, err := utils.SafeMarshal(input); err == nil {
+													sendToolArguments(toolIdx, string(arguments))
+													argumentsComplete[toolIdx] = true
+												}
+											}
 										}
 									}
 								}
@@ -319,6 +492,7 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 							if sawToolUse && !sentFinal {
 								if delta, ok := dataMap["delta"].(map[string]any); ok {
 									if sr, ok := delta["stop_reason"].(string); ok && sr == "tool_use" {
+										completeToolArguments()
 										endEvent := map[string]any{
 											"id":      messageId,
 											"object":  "chat.completion.chunk",
@@ -339,15 +513,102 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 							}
 						case "content_block_stop":
 							// 忽略，最终结束由message_delta驱动
+						case parser.EventTypes.MESSAGE_BOUNDARY:
+							// 上游开始了新的assistant消息：截断或以分隔符合并
+							if messageBoundaryPolicy.recordBoundary(c, dataMap) {
+								truncated = true
+							} else {
+								safeText, hit := stopMatcher.Feed(messageBoundaryPolicy.Separator)
+								sendTextDelta(safeText)
+								stopped = hit
+							}
+						case parser.EventTypes.UNKNOWN_BLOCK:
+							// OpenAI格式没有对应的结构，只计数并跳过
+							recordUnknownBlock(c, dataMap)
+						case parser.EventTypes.UPSTREAM_METADATA:
+							recordUpstreamMetadata(c, dataMap)
+						case "exception", "error":
+							// 上游拒绝/安全拦截：下发refusal增量并以content_filter结束
+							if message, ok := refusalFromEvent(dataMap); ok && !sentFinal {
+								refusalEvent := map[string]any{
+									"id":      messageId,
+									"object":  "chat.completion.chunk",
+									"created": time.Now().Unix(),
+									"model":   anthropicReq.Model,
+									"choices": []map[string]any{
+										{
+											"index": 0,
+											"delta": map[string]any{
+												"refusal": message,
+											},
+											"finish_reason": nil,
+										},
+									},
+								}
+								sender.SendEvent(c, refusalEvent)
+								endEvent := map[string]any{
+									"id":      messageId,
+									"object":  "chat.completion.chunk",
+									"created": time.Now().Unix(),
+									"model":   anthropicReq.Model,
+									"choices": []map[string]any{
+										{
+											"index":         0,
+											"delta":         map[string]any{},
+											"finish_reason": "content_filter",
+										},
+									},
+								}
+								sender.SendEvent(c, endEvent)
+								sentFinal = true
+								refused = true
+							}
 						}
 					}
 				}
 				c.Writer.Flush()
+				if stopped || refused || truncated || invalidJSON {
+					break
+				}
+			}
+
+			// JSON结构已损坏，不再读取上游
+			if invalidJSON {
+				break
+			}
+
+			// 已在消息边界处截断，不再读取上游
+			if truncated {
+				break
+			}
+
+			// 上游拒绝响应，不再读取上游
+			if refused {
+				logger.Info("上游拒绝响应，以content_filter结束OpenAI流式响应", addReqFields(c)...)
+				break
+			}
+
+			// 命中停止序列，不再读取上游
+			if stopped {
+				logger.Debug("命中停止序列，结束OpenAI流式响应",
+					addReqFields(c, logger.String("stop_sequence", stopMatcher.Matched()))...)
+				break
 			}
 		}
 
 		// 错误处理
 		if err != nil {
+			if streamSuperseded(c) {
+				sendStreamSuperseded(c, sender)
+				return
+			}
+			if clientTimedOut(c) {
+				sendClientTimeout(c, sender)
+				return
+			}
+			if slowClientDropped(c) {
+				return
+			}
 			if err == io.EOF {
 				// 正常结束
 				hasMoreData = false
@@ -379,11 +640,25 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 		}
 	}
 
+	// 下发停止序列检测暂缓的尾部文本
+	if !stopped && !refused {
+		sendTextDelta(stopMatcher.Flush())
+	}
+
+	if invalidJSON {
+		logger.Warn("json_object模式的流式输出不是合法JSON，提前中止",
+			addReqFields(c, logger.Err(invalidJSONErr))...)
+		_ = sender.SendError(c, invalidJSONStreamMessage, invalidJSONErr)
+		c.Writer.Flush()
+		return
+	}
+
 	// 确保发送了结束原因（如果还没有发送）
 	if !sentFinal && messageCount > 0 {
 		finishReason := "stop"
-		if sawToolUse {
+		if sawToolUse && !stopped {
 			finishReason = "tool_calls"
+			completeToolArguments()
 		}
 
 		finalEvent := map[string]any{
@@ -404,6 +679,6 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	}
 
 	// 发送结束标记
-	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	writeSSEFrame(c, "", []byte("[DONE]"))
 	c.Writer.Flush()
 }
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxTokensWarningHeader max_completion_tokens与max_tokens取值冲突时附加的响应头，说明实际使用的取值
+const maxTokensWarningHeader = "X-Kiro-Max-Tokens-Warning"
+
+// checkOpenAIMaxTokens 校验OpenAI请求显式指定的输出上限（max_completion_tokens优先于max_tokens）
+// 不超过模型的输出上限，返回false表示已响应400；未指定时使用默认值，不做校验
+func checkOpenAIMaxTokens(c *gin.Context, openaiReq types.OpenAIRequest, anthropicReq types.AnthropicRequest) bool {
+	field := "max_tokens"
+	if openaiReq.MaxCompletionTokens != nil {
+		field = "max_completion_tokens"
+	}
+	if openaiReq.MaxTokensConflict() {
+		warning := fmt.Sprintf("max_completion_tokens=%d overrides max_tokens=%d", *openaiReq.MaxCompletionTokens, *openaiReq.MaxTokens)
+		c.Header(maxTokensWarningHeader, warning)
+		logger.Warn("max_completion_tokens与max_tokens冲突，使用max_completion_tokens",
+			addReqFields(c,
+				logger.Int("max_completion_tokens", *openaiReq.MaxCompletionTokens),
+				logger.Int("max_tokens", *openaiReq.MaxTokens))...)
+	}
+
+	maxTokens, explicit := openaiReq.RequestedMaxTokens()
+	if !explicit {
+		return true
+	}
+	if maxTokens < 1 {
+		respondError(c, http.StatusBadRequest, "%s 必须大于0", field)
+		return false
+	}
+	if ceiling := config.CapabilityOf(anthropicReq.Model).MaxOutputTokens; maxTokens > ceiling {
+		respondError(c, http.StatusBadRequest, "%s %d 超过模型 %s 的输出上限 %d", field, maxTokens, anthropicReq.Model, ceiling)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckOpenAIMaxTokens(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	const model = "claude-sonnet-4-20250514"
+	ceiling := config.CapabilityOf(model).MaxOutputTokens
+
+	check := func(maxTokens, maxCompletionTokens *int) (*httptest.ResponseRecorder, bool) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		openaiReq := types.OpenAIRequest{
+			Model:               model,
+			Messages:            []types.OpenAIMessage{{Role: "user", Content: "hi"}},
+			MaxTokens:           maxTokens,
+			MaxCompletionTokens: maxCompletionTokens,
+		}
+		return w, checkOpenAIMaxTokens(c, openaiReq, converter.ConvertOpenAIToAnthropic(openaiReq))
+	}
+
+	w, ok := check(nil, nil)
+	assert.True(t, ok, "未指定时使用默认值")
+	assert.Empty(t, w.Header().Get(maxTokensWarningHeader))
+
+	w, ok = check(intPtr(1000), intPtr(2000))
+	assert.True(t, ok)
+	assert.Equal(t, "max_completion_tokens=2000 overrides max_tokens=1000", w.Header().Get(maxTokensWarningHeader))
+
+	w, ok = check(intPtr(2000), intPtr(2000))
+	assert.True(t, ok)
+	assert.Empty(t, w.Header().Get(maxTokensWarningHeader), "取值相同不告警")
+
+	w, ok = check(nil, intPtr(ceiling+1))
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "max_completion_tokens")
+
+	// 冲突时按实际使用的max_completion_tokens校验
+	_, ok = check(intPtr(ceiling+1), intPtr(ceiling))
+	assert.True(t, ok)
+	w, ok = check(intPtr(ceiling+1), nil)
+	assert.False(t, ok)
+	assert.Contains(t, w.Body.String(), "max_tokens")
+
+	w, ok = check(intPtr(0), nil)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type openAIToolCallChunk struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      *string `json:"name"`
+		Arguments string  `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			ToolCalls []openAIToolCallChunk `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+}
+
+// parseOpenAIStreamChunks 解析SSE中的data行，返回所有块以及是否以[DONE]结束
+func parseOpenAIStreamChunks(t *testing.T, body string) ([]openAIStreamChunk, bool) {
+	var chunks []openAIStreamChunk
+	done := false
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		require.False(t, done, "[DONE]之后不应再有数据")
+		if data == "[DONE]" {
+			done = true
+			continue
+		}
+		var chunk openAIStreamChunk
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk), data)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, done
+}
+
+func TestOpenAIStream_NonIncrementalToolUse(t *testing.T) {
+	// 上游一次性下发完整的工具调用（参数与stop在同一帧），第二个工具没有参数
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"name":"get_weather","toolUseId":"tooluse_weather","input":{"city":"Paris","days":3},"stop":true}`))
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"name":"get_time","toolUseId":"tooluse_time","stop":true}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	handleOpenAIStreamRequest(newTestScope(c, newToolTestRequest(true, false)))
+
+	chunks, done := parseOpenAIStreamChunks(t, w.Body.String())
+	assert.True(t, done, "以[DONE]结束")
+
+	type toolCall struct {
+		id, name, arguments string
+		chunks              int
+	}
+	var calls []*toolCall
+	var finishReasons []string
+	for _, chunk := range chunks {
+		require.Len(t, chunk.Choices, 1)
+		choice := chunk.Choices[0]
+		if choice.FinishReason != nil {
+			finishReasons = append(finishReasons, *choice.FinishReason)
+		}
+		for _, tc := range choice.Delta.ToolCalls {
+			assert.Equal(t, "function", tc.Type)
+			if tc.Index == len(calls) {
+				// 首个增量：带id和name，参数为空
+				require.NotEmpty(t, tc.ID, "首个增量必须带id")
+				require.NotNil(t, tc.Function.Name, "首个增量必须带name")
+				assert.Empty(t, tc.Function.Arguments)
+				calls = append(calls, &toolCall{id: tc.ID, name: *tc.Function.Name})
+				continue
+			}
+			require.Less(t, tc.Index, len(calls), "参数增量必须在首个增量之后")
+			assert.Empty(t, tc.ID, "后续增量只带参数片段")
+			assert.Nil(t, tc.Function.Name)
+			calls[tc.Index].arguments += tc.Function.Arguments
+			calls[tc.Index].chunks++
+		}
+	}
+
+	require.Len(t, calls, 2)
+	assert.Equal(t, "tooluse_weather", calls[0].id)
+	assert.Equal(t, "get_weather", calls[0].name)
+	assert.JSONEq(t, `{"city":"Paris","days":3}`, calls[0].arguments)
+	assert.Equal(t, 1, calls[0].chunks, "参数只下发一次")
+
+	assert.Equal(t, "tooluse_time", calls[1].id)
+	assert.Equal(t, "get_time", calls[1].name)
+	assert.Equal(t, "{}", calls[1].arguments, "无参数工具补发空对象")
+
+	assert.Equal(t, []string{"tool_calls"}, finishReasons)
+	last := chunks[len(chunks)-1]
+	require.NotNil(t, last.Choices[0].FinishReason, "finish_reason在最后一个块")
+}
@@ -0,0 +1,608 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPIVersion 管理API文档的OpenAPI版本
+const openAPIVersion = "3.0.3"
+
+// 管理API的认证要求
+const (
+	apiAuthNone  = ""      // 无需认证
+	apiAuthAdmin = "admin" // 管理令牌（ADMIN_TOKEN，未设置时为KIRO_CLIENT_TOKEN）
+)
+
+// 错误响应的schema名称（components/schemas）
+const (
+	errorSchemaSimple = "Error"           // {"error": "..."}
+	errorSchemaCoded  = "StructuredError" // {"error": {"message": "...", "code": "..."}}，见respondError
+)
+
+// jsonSchema 手写的JSON schema片段
+// properties和items中的值可以是Go类型的零值，生成文档时按反射展开
+type jsonSchema map[string]any
+
+// objectSchema 包含指定属性的对象schema，属性值为Go类型零值或jsonSchema
+func objectSchema(properties map[string]any) jsonSchema {
+	return jsonSchema{"type": "object", "properties": properties}
+}
+
+// apiParam 查询参数或请求头
+type apiParam struct {
+	name        string
+	in          string // query 或 header
+	kind        string // JSON schema类型
+	description string
+}
+
+// managementOperation 管理API的一个操作（方法+路由模板），用于生成OpenAPI文档
+type managementOperation struct {
+	method      string
+	path        string // gin路由模板，如 /api/config/:index
+	tag         string
+	summary     string
+	auth        string // apiAuth*
+	ipAllowlist bool   // 受ADMIN_IP_ALLOWLIST限制
+	params      []apiParam
+	request     any // 请求体：Go类型零值或jsonSchema，nil表示无请求体
+	response    any // 成功响应体：Go类型零值或jsonSchema
+	status      int // 成功状态码，默认200
+	contentType string
+	errors      map[int]string // 错误状态码 -> 错误schema名称
+}
+
+// configErrors /api/config 下按索引操作的常见错误
+var configErrors = map[int]string{
+	http.StatusBadRequest:          errorSchemaSimple,
+	http.StatusForbidden:           errorSchemaSimple,
+	http.StatusNotFound:            errorSchemaSimple,
+	http.StatusPreconditionFailed:  errorSchemaSimple,
+	http.StatusInternalServerError: errorSchemaSimple,
+}
+
+// configIfMatch 修改配置的接口共用的If-Match头
+var configIfMatch = apiParam{name: "If-Match", in: "header", kind: "string", description: "GET /api/config返回的ETag，配置已被修改时返回412"}
+
+// managementOperations 管理API目录，路由注册见 NewRouter；新增管理路由时需同时登记（由测试保证）
+var managementOperations = []managementOperation{
+	{
+		method: http.MethodGet, path: "/api/openapi.json", tag: "meta",
+		summary:  "本文档（管理API的OpenAPI描述）",
+		response: jsonSchema{"type": "object"},
+	},
+	{
+		method: http.MethodGet, path: "/api/tokens", tag: "tokens",
+		summary: "token池状态（后台检查的缓存结果）",
+		response: objectSchema(map[string]any{
+			"timestamp":     "",
+			"total_tokens":  0,
+			"active_tokens": 0,
+			"tokens":        []map[string]any{},
+			"pool_stats":    map[string]any{},
+		}),
+		errors: map[int]string{http.StatusInternalServerError: errorSchemaSimple},
+	},
+	{
+		method: http.MethodGet, path: "/api/tokens/summary", tag: "tokens",
+		summary:  "token池总额度、消耗速率、剩余时长和额度告警（POOL_MIN_CREDITS / POOL_MIN_RUNWAY_HOURS）",
+		response: PoolSummary{},
+	},
+	{
+		method: http.MethodGet, path: "/api/tokens/export", tag: "tokens",
+		summary: "导出token池快照（JSON或CSV，支持ETag/Last-Modified）",
+		params: []apiParam{
+			{name: "format", in: "query", kind: "string", description: "json（默认）或 csv"},
+		},
+		response: []TokenExportRow{},
+		errors:   map[int]string{http.StatusBadRequest: errorSchemaSimple, http.StatusInternalServerError: errorSchemaSimple},
+	},
+	{
+		method: http.MethodHead, path: "/api/tokens/export", tag: "tokens",
+		summary: "只返回导出快照的头部（ETag/Last-Modified）",
+		params: []apiParam{
+			{name: "format", in: "query", kind: "string", description: "json（默认）或 csv"},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/tokens/:index/refresh", tag: "tokens", ipAllowlist: true, auth: apiAuthAdmin,
+		summary:  "将单个账号加入检查队列（刷新token并查询用量）",
+		response: objectSchema(map[string]any{"message": "", "index": 0}),
+		status:   http.StatusAccepted,
+		errors: map[int]string{
+			http.StatusBadRequest:          errorSchemaSimple,
+			http.StatusUnauthorized:        errorSchemaSimple,
+			http.StatusForbidden:           errorSchemaSimple,
+			http.StatusNotFound:            errorSchemaSimple,
+			http.StatusInternalServerError: errorSchemaSimple,
+			http.StatusServiceUnavailable:  errorSchemaSimple,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/tokens/:index/errors", tag: "tokens",
+		summary:  "账号最近的失败记录",
+		response: objectSchema(map[string]any{"config_id": "", "errors": []auth.TokenErrorRecord{}}),
+		errors:   map[int]string{http.StatusNotFound: errorSchemaCoded, http.StatusInternalServerError: errorSchemaCoded},
+	},
+	{
+		method: http.MethodGet, path: "/api/tokens/estimation-accuracy", tag: "tokens",
+		summary:  "按模型统计估算token相对上游报告值的误差",
+		response: objectSchema(map[string]any{"samples_per_model": 0, "models": map[string]ModelEstimationAccuracy{}}),
+	},
+	{
+		method: http.MethodGet, path: "/api/requests/:request_id", tag: "diagnostics",
+		summary:  "请求发往上游时的归属信息",
+		response: RequestAttribution{},
+		errors:   map[int]string{http.StatusNotFound: errorSchemaSimple},
+	},
+	{
+		method: http.MethodGet, path: "/api/stats", tag: "diagnostics",
+		summary: "上游响应流与各路由的统计",
+		response: objectSchema(map[string]any{
+			"message_boundary_policy": "",
+			"message_boundaries":      int64(0),
+			"merged_messages":         int64(0),
+			"discarded_messages":      int64(0),
+			"unknown_blocks":          int64(0),
+			"unknown_block_types":     map[string]int64{},
+			"passthrough_unknown":     false,
+			"routes":                  map[string]any{},
+			"inflight":                objectSchema(map[string]any{"current": int64(0), "limit": 0, "rejected": int64(0)}),
+			"auth":                    map[string]any{},
+			"usage_cache":             map[string]any{},
+			"shadow":                  map[string]any{},
+			"downstream_queue":        map[string]any{},
+		}),
+	},
+	{
+		method: http.MethodGet, path: "/api/status", tag: "diagnostics",
+		summary: "服务版本、运行时长、goroutine数、账号池大小和token选择策略",
+		response: objectSchema(map[string]any{
+			"version":                     "",
+			"commit":                      "",
+			"go_version":                  "",
+			"started_at":                  "",
+			"uptime_seconds":              int64(0),
+			"uptime":                      "",
+			"goroutines":                  0,
+			"pool":                        objectSchema(map[string]any{"total": 0, "enabled": 0}),
+			"selection_strategy":          "",
+			"selection_strategy_override": false,
+		}),
+	},
+	{
+		method: http.MethodGet, path: "/api/keys/usage", tag: "diagnostics",
+		summary:  "各客户端密钥的公平排队统计（权重、并发、排队等待时间分位数）",
+		response: FairQueueSnapshot{},
+	},
+	{
+		method: http.MethodGet, path: "/api/reports/reconciliation", tag: "diagnostics",
+		summary: "每日对账报告；带day时即时计算该天的报告",
+		params: []apiParam{
+			{name: "day", in: "query", kind: "string", description: "YYYY-MM-DD"},
+		},
+		response: jsonSchema{"oneOf": []any{
+			objectSchema(map[string]any{"source": "", "reports": []ReconciliationReport{}}),
+			ReconciliationReport{},
+		}},
+		errors: map[int]string{http.StatusBadRequest: errorSchemaCoded, http.StatusServiceUnavailable: errorSchemaCoded},
+	},
+	{
+		method: http.MethodGet, path: "/metrics", tag: "diagnostics",
+		summary:     "Prometheus指标",
+		response:    jsonSchema{"type": "string"},
+		contentType: "text/plain; version=0.0.4",
+	},
+	{
+		method: http.MethodGet, path: "/api/config", tag: "config", ipAllowlist: true,
+		summary: "账号配置列表，refreshToken和clientSecret默认脱敏（ETag可用于修改接口的If-Match）",
+		params: []apiParam{
+			{name: "reveal", in: "query", kind: "boolean", description: "true时返回完整凭据，需要管理令牌（CONFIG_SECRET_POLICY=strict时不允许）"},
+		},
+		response: objectSchema(map[string]any{
+			"configs":   []auth.AuthConfig{},
+			"count":     0,
+			"read_only": false,
+			"revision":  "",
+		}),
+		errors: map[int]string{
+			http.StatusUnauthorized:        errorSchemaSimple,
+			http.StatusForbidden:           errorSchemaSimple,
+			http.StatusInternalServerError: errorSchemaSimple,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/config/source", tag: "config", ipAllowlist: true,
+		summary:  "当前生效的认证配置来源",
+		response: auth.ConfigSourceReport{},
+		errors:   map[int]string{http.StatusForbidden: errorSchemaSimple},
+	},
+	{
+		method: http.MethodPost, path: "/api/config", tag: "config", ipAllowlist: true,
+		summary:  "添加账号配置",
+		params:   []apiParam{configIfMatch},
+		request:  auth.AuthConfig{},
+		response: objectSchema(map[string]any{"message": "", "revision": ""}),
+		errors: map[int]string{
+			http.StatusBadRequest:          errorSchemaSimple,
+			http.StatusForbidden:           errorSchemaSimple,
+			http.StatusPreconditionFailed:  errorSchemaSimple,
+			http.StatusInternalServerError: errorSchemaSimple,
+		},
+	},
+	{
+		method: http.MethodPut, path: "/api/config", tag: "config", ipAllowlist: true, auth: apiAuthAdmin,
+		summary: "整体替换为期望的配置列表，返回差异",
+		params: []apiParam{
+			{name: "dry_run", in: "query", kind: "boolean", description: "true时只返回差异，不写入"},
+			configIfMatch,
+		},
+		request:  []auth.AuthConfig{},
+		response: objectSchema(map[string]any{"dry_run": false, "revision": "", "diff": ConfigDiff{}}),
+		errors: map[int]string{
+			http.StatusBadRequest:          errorSchemaSimple,
+			http.StatusUnauthorized:        errorSchemaSimple,
+			http.StatusForbidden:           errorSchemaSimple,
+			http.StatusPreconditionFailed:  errorSchemaSimple,
+			http.StatusInternalServerError: errorSchemaSimple,
+		},
+	},
+	{
+		method: http.MethodPut, path: "/api/config/:index", tag: "config", ipAllowlist: true,
+		summary:  "更新账号配置（refreshToken/clientSecret留空或为脱敏值时保持原值）",
+		params:   []apiParam{configIfMatch},
+		request:  auth.AuthConfig{},
+		response: objectSchema(map[string]any{"message": "", "revision": ""}),
+		errors:   configErrors,
+	},
+	{
+		method: http.MethodDelete, path: "/api/config/:index", tag: "config", ipAllowlist: true,
+		summary:  "删除账号配置",
+		params:   []apiParam{configIfMatch},
+		response: objectSchema(map[string]any{"message": "", "revision": ""}),
+		errors:   configErrors,
+	},
+	{
+		method: http.MethodPost, path: "/api/config/:index/clone", tag: "config", ipAllowlist: true,
+		summary:  "复制账号配置（不含refreshToken）",
+		params:   []apiParam{configIfMatch},
+		response: objectSchema(map[string]any{"message": "", "index": 0, "revision": ""}),
+		errors:   configErrors,
+	},
+	{
+		method: http.MethodPost, path: "/api/config/import", tag: "config", ipAllowlist: true,
+		summary:  "批量导入账号（验证完成后一次性写入）",
+		params:   []apiParam{configIfMatch},
+		request:  []ImportAccountInput{},
+		response: objectSchema(map[string]any{"total": 0, "success": 0, "failed": 0, "results": []ImportResult{}, "revision": ""}),
+		errors: map[int]string{
+			http.StatusBadRequest:          errorSchemaSimple,
+			http.StatusForbidden:           errorSchemaSimple,
+			http.StatusPreconditionFailed:  errorSchemaSimple,
+			http.StatusInternalServerError: errorSchemaSimple,
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/config/probe", tag: "config", ipAllowlist: true,
+		summary:  "探测refreshToken是否可用，不保存配置",
+		request:  ImportAccountInput{},
+		response: ProbeResult{},
+		errors:   map[int]string{http.StatusBadRequest: errorSchemaSimple, http.StatusForbidden: errorSchemaSimple},
+	},
+	{
+		method: http.MethodGet, path: "/api/config/:index/errors", tag: "config", ipAllowlist: true,
+		summary:  "账号最近的失败记录（刷新、用量检查、生成请求），从新到旧",
+		response: objectSchema(map[string]any{"config_id": "", "errors": []auth.TokenErrorRecord{}}),
+		errors:   map[int]string{http.StatusNotFound: errorSchemaCoded, http.StatusInternalServerError: errorSchemaCoded},
+	},
+	{
+		method: http.MethodGet, path: "/api/config/:index/usage/raw", tag: "config", ipAllowlist: true, auth: apiAuthAdmin,
+		summary: "上游原始用量响应（已移除凭据）",
+		response: objectSchema(map[string]any{
+			"index":       0,
+			"endpoint":    "",
+			"status_code": 0,
+			"body":        jsonSchema{},
+		}),
+		errors: map[int]string{
+			http.StatusBadRequest:          errorSchemaSimple,
+			http.StatusUnauthorized:        errorSchemaSimple,
+			http.StatusForbidden:           errorSchemaSimple,
+			http.StatusNotFound:            errorSchemaSimple,
+			http.StatusInternalServerError: errorSchemaSimple,
+			http.StatusBadGateway:          errorSchemaSimple,
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/models/validate", tag: "models", auth: apiAuthAdmin,
+		summary: "校验模型映射是否被上游接受（结果按TTL缓存）",
+		params: []apiParam{
+			{name: "force", in: "query", kind: "boolean", description: "true时忽略缓存重新校验，两次之间至少间隔1分钟"},
+		},
+		response: objectSchema(map[string]any{
+			"cached":      false,
+			"total":       0,
+			"unavailable": 0,
+			"results":     []ModelValidationResult{},
+		}),
+		errors: map[int]string{
+			http.StatusUnauthorized:       errorSchemaSimple,
+			http.StatusTooManyRequests:    errorSchemaCoded,
+			http.StatusServiceUnavailable: errorSchemaCoded,
+		},
+	},
+}
+
+// externalEndpoints 兼容Anthropic/OpenAI协议的代理端点，schema以上游协议文档为准，不在本文档中展开
+var externalEndpoints = []map[string]string{
+	{"method": http.MethodGet, "path": "/v1/models", "compatible_with": "anthropic,openai"},
+	{"method": http.MethodPost, "path": "/v1/messages", "compatible_with": "anthropic"},
+	{"method": http.MethodPost, "path": "/v1/messages/count_tokens", "compatible_with": "anthropic"},
+	{"method": http.MethodPost, "path": "/v1/chat/completions", "compatible_with": "openai"},
+}
+
+// isManagementPath 是否为需要登记在OpenAPI文档中的管理路由
+func isManagementPath(path string) bool {
+	return strings.HasPrefix(path, "/api/") || path == "/metrics"
+}
+
+// openAPIPath gin路由模板转换为OpenAPI路径：/api/config/:index -> /api/config/{index}
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// openAPISpec 管理API的OpenAPI文档，首次请求时生成
+var openAPISpec = sync.OnceValue(func() []byte {
+	spec, _ := json.Marshal(buildOpenAPISpec())
+	return spec
+})
+
+// handleOpenAPISpec GET /api/openapi.json
+func handleOpenAPISpec(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openAPISpec())
+}
+
+// buildOpenAPISpec 由managementOperations和请求/响应类型生成OpenAPI文档
+func buildOpenAPISpec() map[string]any {
+	b := &openAPIBuilder{schemas: map[string]any{
+		errorSchemaSimple: objectSchema(map[string]any{"error": jsonSchema{"type": "string"}}),
+		errorSchemaCoded: objectSchema(map[string]any{
+			"error": objectSchema(map[string]any{"message": jsonSchema{"type": "string"}, "code": jsonSchema{"type": "string"}}),
+		}),
+	}}
+
+	paths := make(map[string]any)
+	for _, op := range managementOperations {
+		path := openAPIPath(op.path)
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = make(map[string]any)
+			paths[path] = item
+		}
+		item[strings.ToLower(op.method)] = b.operation(op)
+	}
+
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":       "kiro2api management API",
+			"version":     "1",
+			"description": "管理端点（/api、/metrics）。/v1 代理端点兼容Anthropic/OpenAI协议，见 x-external-endpoints，不在本文档中展开。",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]any{
+				"adminBearer": map[string]any{"type": "http", "scheme": "bearer"},
+				"adminApiKey": map[string]any{"type": "apiKey", "in": "header", "name": "x-api-key"},
+			},
+		},
+		"x-external-endpoints": externalEndpoints,
+	}
+}
+
+// openAPIBuilder 生成文档时收集命名结构体的schema（components/schemas）
+type openAPIBuilder struct {
+	schemas map[string]any
+}
+
+// operation 单个操作的OpenAPI描述
+func (b *openAPIBuilder) operation(op managementOperation) map[string]any {
+	operation := map[string]any{
+		"summary": op.summary,
+		"tags":    []string{op.tag},
+	}
+
+	var parameters []any
+	for _, segment := range strings.Split(op.path, "/") {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			kind := "string"
+			if name == "index" {
+				kind = "integer"
+			}
+			parameters = append(parameters, map[string]any{"name": name, "in": "path", "required": true, "schema": jsonSchema{"type": kind}})
+		}
+	}
+	for _, param := range op.params {
+		parameters = append(parameters, map[string]any{
+			"name":        param.name,
+			"in":          param.in,
+			"description": param.description,
+			"schema":      jsonSchema{"type": param.kind},
+		})
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	if op.request != nil {
+		operation["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": b.schema(op.request)}},
+		}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	if op.response != nil {
+		contentType := op.contentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		success["content"] = map[string]any{contentType: map[string]any{"schema": b.schema(op.response)}}
+	}
+	responses := map[string]any{strconv.Itoa(status): success}
+	for code, schemaName := range op.errors {
+		responses[strconv.Itoa(code)] = map[string]any{
+			"description": http.StatusText(code),
+			"content": map[string]any{"application/json": map[string]any{
+				"schema": jsonSchema{"$ref": "#/components/schemas/" + schemaName},
+			}},
+		}
+	}
+	operation["responses"] = responses
+
+	// 未设置管理令牌的操作显式声明无需认证
+	security := []any{}
+	if op.auth == apiAuthAdmin {
+		security = []any{map[string]any{"adminBearer": []string{}}, map[string]any{"adminApiKey": []string{}}}
+	}
+	operation["security"] = security
+	if op.ipAllowlist {
+		operation["x-admin-ip-allowlist"] = true
+	}
+	return operation
+}
+
+// schema 值为jsonSchema时展开其中的属性和元素，否则按值的Go类型反射生成
+func (b *openAPIBuilder) schema(value any) any {
+	if s, ok := value.(jsonSchema); ok {
+		out := make(jsonSchema, len(s))
+		for key, v := range s {
+			switch key {
+			case "properties":
+				properties := make(map[string]any)
+				for name, property := range v.(map[string]any) {
+					properties[name] = b.schema(property)
+				}
+				out[key] = properties
+			case "items":
+				out[key] = b.schema(v)
+			case "oneOf":
+				var variants []any
+				for _, variant := range v.([]any) {
+					variants = append(variants, b.schema(variant))
+				}
+				out[key] = variants
+			default:
+				out[key] = v
+			}
+		}
+		return out
+	}
+	return b.typeSchema(reflect.TypeOf(value))
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// typeSchema 按encoding/json的序列化规则生成Go类型的schema，命名结构体登记到components并返回引用
+func (b *openAPIBuilder) typeSchema(t reflect.Type) any {
+	if t == nil {
+		return jsonSchema{}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return jsonSchema{"type": "string", "format": "date-time"}
+	}
+	if t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType) {
+		return jsonSchema{} // 自定义序列化，结构不固定
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return jsonSchema{"type": "array", "items": b.typeSchema(t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": b.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, exists := b.schemas[t.Name()]; !exists {
+			b.schemas[t.Name()] = jsonSchema{} // 占位，防止递归类型无限展开
+			b.schemas[t.Name()] = b.structSchema(t)
+		}
+		return jsonSchema{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return jsonSchema{}
+}
+
+// structSchema 结构体的对象schema：按json标签命名，跳过"-"和未导出字段，展开匿名嵌入的结构体
+func (b *openAPIBuilder) structSchema(t reflect.Type) jsonSchema {
+	properties := make(map[string]any)
+	var required []string
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				collect(field.Type)
+				continue
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = b.typeSchema(field.Type)
+			if !strings.Contains(options, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	collect(t)
+
+	schema := jsonSchema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
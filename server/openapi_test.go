@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fetchOpenAPISpec 通过路由获取 /api/openapi.json
+func fetchOpenAPISpec(t *testing.T) (map[string]any, []string) {
+	t.Helper()
+	r := newTestRouter(t, "test-token", nil)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var spec map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &spec))
+
+	var routes []string
+	for _, route := range r.Routes() {
+		routes = append(routes, route.Method+" "+route.Path)
+	}
+	return spec, routes
+}
+
+// 遍历gin路由表：每个管理路由都必须登记在文档中，文档中也不能有不存在的路由
+func TestOpenAPISpec_CoversManagementRoutes(t *testing.T) {
+	spec, routes := fetchOpenAPISpec(t)
+	paths := spec["paths"].(map[string]any)
+
+	registered := make(map[string]bool)
+	for _, route := range routes {
+		method, path, _ := strings.Cut(route, " ")
+		if !isManagementPath(path) {
+			continue
+		}
+		registered[route] = true
+		item, ok := paths[openAPIPath(path)].(map[string]any)
+		if assert.True(t, ok, "管理路由未登记在OpenAPI文档中: %s", route) {
+			assert.Contains(t, item, strings.ToLower(method), "管理路由未登记在OpenAPI文档中: %s", route)
+		}
+	}
+	assert.NotEmpty(t, registered)
+
+	for _, op := range managementOperations {
+		assert.True(t, registered[op.method+" "+op.path], "OpenAPI文档中的路由不存在: %s %s", op.method, op.path)
+	}
+
+	// /v1 代理端点只列为外部兼容端点
+	for path := range paths {
+		assert.False(t, strings.HasPrefix(path, "/v1"), path)
+	}
+	for _, route := range routes {
+		if _, path, _ := strings.Cut(route, " "); strings.HasPrefix(path, "/v1") {
+			assert.Contains(t, string(mustJSON(t, spec["x-external-endpoints"])), `"path":"`+path+`"`, route)
+		}
+	}
+}
+
+func TestOpenAPISpec_AuthAndErrorSchemas(t *testing.T) {
+	spec, _ := fetchOpenAPISpec(t)
+	assert.Equal(t, openAPIVersion, spec["openapi"])
+	paths := spec["paths"].(map[string]any)
+
+	apply := paths["/api/config"].(map[string]any)["put"].(map[string]any)
+	assert.Len(t, apply["security"], 2, "整体替换配置需要管理令牌")
+	assert.Equal(t, true, apply["x-admin-ip-allowlist"])
+	assert.Contains(t, apply["responses"], "412")
+
+	tokens := paths["/api/tokens"].(map[string]any)["get"].(map[string]any)
+	assert.Empty(t, tokens["security"])
+
+	refresh := paths["/api/tokens/{index}/refresh"].(map[string]any)["post"].(map[string]any)
+	assert.Contains(t, refresh["responses"], "202")
+	assert.Equal(t, "index", refresh["parameters"].([]any)[0].(map[string]any)["name"])
+
+	// 所有引用都指向已定义的schema
+	schemas := spec["components"].(map[string]any)["schemas"].(map[string]any)
+	assert.Contains(t, schemas, "AuthConfig")
+	assert.Contains(t, schemas, "Error")
+	assert.Contains(t, schemas, "StructuredError")
+	body := string(mustJSON(t, spec))
+	for _, ref := range strings.Split(body, `"$ref":"#/components/schemas/`)[1:] {
+		name, _, _ := strings.Cut(ref, `"`)
+		assert.Contains(t, schemas, name)
+	}
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return data
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"kiro2api/converter"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTwoToolsUpstream 创建返回两个工具调用的假上游（模拟上游未遵守单工具指令），返回收到的请求体
+func newTwoToolsUpstream(t *testing.T) func() string {
+	var mu sync.Mutex
+	var lastBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		lastBody = string(body)
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"Checking."}`))
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"name":"get_weather","toolUseId":"tooluse_first","input":"{\"city\":\"Paris\"}"}`))
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"name":"get_weather","toolUseId":"tooluse_first","stop":true}`))
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"name":"get_time","toolUseId":"tooluse_second","input":"{\"tz\":\"CET\"}"}`))
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"name":"get_time","toolUseId":"tooluse_second","stop":true}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return lastBody
+	}
+}
+
+// newToolTestRequest 创建带两个工具的请求，disableParallel对应tool_choice.disable_parallel_tool_use
+func newToolTestRequest(stream, disableParallel bool) types.AnthropicRequest {
+	req := newStopTestRequest(stream)
+	schema := map[string]any{"type": "object", "properties": map[string]any{}}
+	req.Tools = []types.AnthropicTool{
+		{Name: "get_weather", Description: "Get weather", InputSchema: schema},
+		{Name: "get_time", Description: "Get time", InputSchema: schema},
+	}
+	// 与/v1/messages标准化后的形态一致：tool_choice为map
+	req.ToolChoice = map[string]any{"type": "auto", "disable_parallel_tool_use": disableParallel}
+	return req
+}
+
+func TestDisableParallelToolUse_ForwardedUpstream(t *testing.T) {
+	lastBody := newTwoToolsUpstream(t)
+
+	for _, disabled := range []bool{true, false} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+		handleNonStreamRequest(newTestScope(c, newToolTestRequest(false, disabled)))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, disabled, strings.Contains(lastBody(), converter.DisableParallelToolUseInstruction))
+	}
+}
+
+func TestDisableParallelToolUse_AnthropicNonStream(t *testing.T) {
+	newTwoToolsUpstream(t)
+
+	toolNames := func(disabled bool) ([]string, string) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+		handleNonStreamRequest(newTestScope(c, newToolTestRequest(false, disabled)))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			Content []struct {
+				Type string `json:"type"`
+				Name string `json:"name"`
+			} `json:"content"`
+			StopReason string `json:"stop_reason"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		var names []string
+		for _, block := range resp.Content {
+			if block.Type == "tool_use" {
+				names = append(names, block.Name)
+			}
+		}
+		return names, resp.StopReason
+	}
+
+	names, stopReason := toolNames(true)
+	assert.Equal(t, []string{"get_weather"}, names)
+	assert.Equal(t, "tool_use", stopReason)
+
+	names, stopReason = toolNames(false)
+	assert.Len(t, names, 2)
+	assert.Equal(t, "tool_use", stopReason)
+}
+
+func TestDisableParallelToolUse_AnthropicStream(t *testing.T) {
+	newTwoToolsUpstream(t)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	handleStreamRequest(newTestScope(c, newToolTestRequest(true, true)))
+
+	body := w.Body.String()
+	assert.Contains(t, body, `"tooluse_first"`)
+	assert.NotContains(t, body, "tooluse_second")
+	assert.NotContains(t, body, "CET", "被丢弃工具的参数增量不应下发")
+	assert.Equal(t, 1, strings.Count(body, `"type":"tool_use"`))
+	assert.Contains(t, body, `"stop_reason":"tool_use"`)
+	assert.Equal(t, "Checking.", collectAnthropicStreamText(t, body))
+}
+
+func TestDisableParallelToolUse_OpenAI(t *testing.T) {
+	newTwoToolsUpstream(t)
+
+	t.Run("stream", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		handleOpenAIStreamRequest(newTestScope(c, newToolTestRequest(true, true)))
+
+		body := w.Body.String()
+		assert.Contains(t, body, "tooluse_first")
+		assert.NotContains(t, body, "tooluse_second")
+		assert.NotContains(t, body, "CET")
+		assert.Contains(t, body, `"finish_reason":"tool_calls"`)
+	})
+
+	t.Run("non-stream", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		handleOpenAINonStreamRequest(newTestScope(c, newToolTestRequest(false, true)))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp types.OpenAIResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Choices, 1)
+		require.Len(t, resp.Choices[0].Message.ToolCalls, 1)
+		assert.Equal(t, "get_weather", resp.Choices[0].Message.ToolCalls[0].Function.Name)
+		assert.Equal(t, "tool_calls", resp.Choices[0].FinishReason)
+	})
+}
+
+// 从OpenAI请求出发：parallel_tool_calls=false 经转换后只返回一个工具调用
+func TestParallelToolCallsFalse_OpenAIRequest(t *testing.T) {
+	newTwoToolsUpstream(t)
+
+	toolCalls := func(parallel bool) []types.OpenAIToolCall {
+		openaiReq := types.OpenAIRequest{
+			Model:             "claude-sonnet-4-20250514",
+			Messages:          []types.OpenAIMessage{{Role: "user", Content: "Weather and time in Paris?"}},
+			ParallelToolCalls: &parallel,
+		}
+		for _, name := range []string{"get_weather", "get_time"} {
+			openaiReq.Tools = append(openaiReq.Tools, types.OpenAITool{
+				Type:     "function",
+				Function: types.OpenAIFunction{Name: name, Parameters: map[string]any{"type": "object", "properties": map[string]any{}}},
+			})
+		}
+		anthropicReq := converter.ConvertOpenAIToAnthropic(openaiReq)
+		require.Equal(t, !parallel, anthropicReq.ParallelToolUseDisabled())
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		handleOpenAINonStreamRequest(newTestScope(c, anthropicReq))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp types.OpenAIResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Choices, 1)
+		return resp.Choices[0].Message.ToolCalls
+	}
+
+	calls := toolCalls(false)
+	require.Len(t, calls, 1)
+	assert.Equal(t, "get_weather", calls[0].Function.Name)
+	assert.Len(t, toolCalls(true), 2)
+}
+
+func TestStopReasonManager_AcceptToolUse(t *testing.T) {
+	parallel := NewStopReasonManager(newToolTestRequest(false, false))
+	assert.True(t, parallel.AcceptToolUse(0))
+	assert.True(t, parallel.AcceptToolUse(3))
+
+	single := NewStopReasonManager(newToolTestRequest(false, true))
+	assert.True(t, single.AcceptToolUse(0))
+	assert.False(t, single.AcceptToolUse(1))
+}
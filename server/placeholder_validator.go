@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/utils"
+)
+
+var (
+	// ErrEmptyMessageContent 最后一条消息没有任何实际内容
+	ErrEmptyMessageContent = errors.New("消息内容不能为空")
+	// ErrPlaceholderContent 最后一条消息只有客户端填充的占位文本
+	ErrPlaceholderContent = errors.New("消息内容为占位文本")
+)
+
+// PlaceholderPolicy 占位文本判定规则
+// 客户端在没有真实输入时会填充占位文本（如"answer for user question"，不同语言的客户端各不相同），
+// 整条消息（忽略首尾空白、连续空白和大小写）等于其中之一或完整匹配Pattern时拒绝请求
+type PlaceholderPolicy struct {
+	Phrases []string
+	Pattern *regexp.Regexp
+}
+
+// placeholderPolicy 全局占位文本规则
+var placeholderPolicy = DefaultPlaceholderPolicy()
+
+// DefaultPlaceholderPolicy 默认只识别英文占位文本
+func DefaultPlaceholderPolicy() *PlaceholderPolicy {
+	return &PlaceholderPolicy{Phrases: []string{utils.EmptyContentPlaceholder}}
+}
+
+// NewPlaceholderPolicyFromEnv 根据环境变量创建占位文本规则
+// PLACEHOLDER_PHRASES: 逗号分隔的占位文本列表（未设置时使用默认值，设置为空表示不按列表拒绝）
+// PLACEHOLDER_PATTERN: 额外的正则表达式，需完整匹配整条消息；无效时忽略
+func NewPlaceholderPolicyFromEnv() *PlaceholderPolicy {
+	policy := DefaultPlaceholderPolicy()
+
+	if value, ok := os.LookupEnv("PLACEHOLDER_PHRASES"); ok {
+		policy.Phrases = nil
+		for _, phrase := range strings.Split(value, ",") {
+			if phrase = normalizePlaceholderText(phrase); phrase != "" {
+				policy.Phrases = append(policy.Phrases, phrase)
+			}
+		}
+	}
+
+	if value := strings.TrimSpace(os.Getenv("PLACEHOLDER_PATTERN")); value != "" {
+		pattern, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			logger.Warn("PLACEHOLDER_PATTERN无效，已忽略",
+				logger.String("pattern", value),
+				logger.Err(err))
+		} else {
+			policy.Pattern = pattern
+		}
+	}
+	return policy
+}
+
+// Matches 文本是否为占位文本
+func (p *PlaceholderPolicy) Matches(text string) bool {
+	if p == nil {
+		return false
+	}
+	normalized := normalizePlaceholderText(text)
+	if normalized == "" {
+		return false
+	}
+	for _, phrase := range p.Phrases {
+		if strings.EqualFold(normalized, normalizePlaceholderText(phrase)) {
+			return true
+		}
+	}
+	return p.Pattern != nil && p.Pattern.MatchString(strings.TrimSpace(text))
+}
+
+// normalizePlaceholderText 去除首尾空白并把连续空白合并为一个空格
+func normalizePlaceholderText(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// validateMessageContent 校验消息内容不为空且不是占位文本
+// 返回ErrEmptyMessageContent、ErrPlaceholderContent或内容提取失败的错误
+func validateMessageContent(content any, policy *PlaceholderPolicy) error {
+	text, err := utils.GetMessageContent(content)
+	if err != nil {
+		return fmt.Errorf("获取消息内容失败: %w", err)
+	}
+	// 按结构判断是否为空，GetMessageContent为空消息填充的占位文本不参与列表匹配
+	if utils.MessageContentEmpty(content) {
+		return ErrEmptyMessageContent
+	}
+	if policy.Matches(text) {
+		return ErrPlaceholderContent
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlaceholderPolicy_Matches(t *testing.T) {
+	policy := &PlaceholderPolicy{Phrases: []string{"answer for user question", "回答用户问题"}}
+
+	cases := map[string]bool{
+		"answer for user question":          true,
+		"  Answer For User Question \n":     true,
+		"answer   for\tuser question":       true,
+		"回答用户问题":                            true,
+		" 回答用户问题 ":                          true,
+		"answer for user question, please":  false,
+		"Can you answer for user question?": false,
+		"":                                  false,
+		"   ":                               false,
+	}
+	for text, expected := range cases {
+		assert.Equal(t, expected, policy.Matches(text), "%q", text)
+	}
+
+	var disabled *PlaceholderPolicy
+	assert.False(t, disabled.Matches("answer for user question"))
+}
+
+func TestPlaceholderPolicy_Pattern(t *testing.T) {
+	t.Setenv("PLACEHOLDER_PHRASES", "")
+	t.Setenv("PLACEHOLDER_PATTERN", `(?i)(answer|respond) (for|to) (the )?user('s)? question\.?`)
+	policy := NewPlaceholderPolicyFromEnv()
+
+	assert.Empty(t, policy.Phrases)
+	assert.True(t, policy.Matches("Respond to the user's question."))
+	assert.True(t, policy.Matches("answer for user question"))
+	// 完整匹配整条消息，正文中包含占位文本不会被拒绝
+	assert.False(t, policy.Matches("please answer for user question in French"))
+}
+
+func TestNewPlaceholderPolicyFromEnv(t *testing.T) {
+	t.Run("未设置时使用默认值", func(t *testing.T) {
+		policy := NewPlaceholderPolicyFromEnv()
+		assert.Equal(t, []string{"answer for user question"}, policy.Phrases)
+		assert.Nil(t, policy.Pattern)
+	})
+
+	t.Run("逗号分隔的列表", func(t *testing.T) {
+		t.Setenv("PLACEHOLDER_PHRASES", "answer for user question, 回答用户问题 ,,Réponds à la question")
+		policy := NewPlaceholderPolicyFromEnv()
+		assert.Equal(t, []string{"answer for user question", "回答用户问题", "Réponds à la question"}, policy.Phrases)
+		assert.True(t, policy.Matches("réponds à la question"))
+	})
+
+	t.Run("设置为空时不按列表拒绝", func(t *testing.T) {
+		t.Setenv("PLACEHOLDER_PHRASES", "")
+		assert.False(t, NewPlaceholderPolicyFromEnv().Matches("answer for user question"))
+	})
+
+	t.Run("无效正则被忽略", func(t *testing.T) {
+		t.Setenv("PLACEHOLDER_PATTERN", "([")
+		policy := NewPlaceholderPolicyFromEnv()
+		assert.Nil(t, policy.Pattern)
+		assert.True(t, policy.Matches("answer for user question"))
+	})
+}
+
+func TestValidateMessageContent(t *testing.T) {
+	policy := &PlaceholderPolicy{Phrases: []string{"answer for user question", "回答用户问题"}}
+
+	cases := []struct {
+		name    string
+		content any
+		want    error
+	}{
+		{"正常文本", "hello", nil},
+		{"空字符串", "", ErrEmptyMessageContent},
+		{"只有空白", " \n\t", ErrEmptyMessageContent},
+		{"空内容块列表", []any{}, ErrEmptyMessageContent},
+		{"只有空文本块", []any{map[string]any{"type": "text", "text": "  "}}, ErrEmptyMessageContent},
+		{"英文占位文本", "Answer for user question", ErrPlaceholderContent},
+		{"中文占位文本", []any{map[string]any{"type": "text", "text": "回答用户问题"}}, ErrPlaceholderContent},
+		{"包含占位文本的正常内容", "What does \"answer for user question\" mean?", nil},
+		{"只有图片", []types.ContentBlock{{Type: "image", Source: &types.ImageSource{Type: "base64", MediaType: "image/png", Data: "iVBORw0KGgo="}}}, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.ErrorIs(t, validateMessageContent(tc.content, policy), tc.want)
+		})
+	}
+
+	t.Run("不支持的内容类型", func(t *testing.T) {
+		err := validateMessageContent(42, policy)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrEmptyMessageContent)
+		assert.Contains(t, err.Error(), "获取消息内容失败")
+	})
+
+	t.Run("列表为空时占位文本可以通过，空消息仍被拒绝", func(t *testing.T) {
+		assert.NoError(t, validateMessageContent("answer for user question", &PlaceholderPolicy{}))
+		assert.ErrorIs(t, validateMessageContent("", &PlaceholderPolicy{}), ErrEmptyMessageContent)
+	})
+}
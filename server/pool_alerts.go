@@ -0,0 +1,247 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 账号池额度告警类型
+const (
+	PoolAlertMinCredits = "pool_min_credits" // 总可用额度低于POOL_MIN_CREDITS
+	PoolAlertMinRunway  = "pool_min_runway"  // 按当前消耗速率剩余小时数低于POOL_MIN_RUNWAY_HOURS
+)
+
+// 账号池告警webhook的事件类型
+const (
+	poolAlertFired    = "fired"
+	poolAlertResolved = "resolved"
+)
+
+// PoolSnapshot 某一时刻账号池的总可用额度
+type PoolSnapshot struct {
+	At               time.Time
+	Accounts         int     // 未禁用的账号数
+	CheckedAccounts  int     // 已有检查结果的账号数
+	AvailableCredits float64 // 已检查账号的可用额度之和
+}
+
+// PoolAlert 正在生效的账号池告警
+type PoolAlert struct {
+	Type      string  `json:"type"`
+	Threshold float64 `json:"threshold"`
+	Value     float64 `json:"value"` // 当前总额度或剩余小时数
+	Since     string  `json:"since"`
+}
+
+// PoolSummary 最近一次评估得到的账号池汇总，供 /api/tokens/summary 返回
+type PoolSummary struct {
+	EvaluatedAt      string      `json:"evaluated_at,omitempty"`
+	Accounts         int         `json:"accounts"`
+	CheckedAccounts  int         `json:"checked_accounts"`
+	AvailableCredits float64     `json:"available_credits"`
+	BurnRatePerHour  float64     `json:"burn_rate_per_hour"`
+	RunwayHours      *float64    `json:"runway_hours"` // 消耗速率未知或为0时为null
+	MinCredits       float64     `json:"min_credits"`
+	MinRunwayHours   float64     `json:"min_runway_hours"`
+	Alerts           []PoolAlert `json:"alerts"`
+}
+
+// PoolAlertPolicy 按账号池总额度和剩余可用时长告警，只在状态变化时记录日志和发送webhook
+type PoolAlertPolicy struct {
+	MinCredits       float64       // 0表示不检查总额度
+	MinRunwayHours   float64       // 0表示不检查剩余时长
+	BurnRateWindow   time.Duration // 计算消耗速率的时间窗口
+	WebhookURL       string        // 告警webhook，为空时只记录日志
+	WebhookTimeout   time.Duration
+	webhookTransport *http.Client
+
+	mutex   sync.Mutex
+	samples []PoolSnapshot       // 窗口内的快照，按时间排序
+	active  map[string]PoolAlert // 告警类型 -> 正在生效的告警
+	summary PoolSummary
+}
+
+// NewPoolAlertPolicyFromEnv 根据环境变量创建账号池额度告警
+// POOL_MIN_CREDITS: 总可用额度低于该值时告警（默认0，不检查）
+// POOL_MIN_RUNWAY_HOURS: 按最近一小时的消耗速率剩余小时数低于该值时告警（默认0，不检查）
+// POOL_ALERT_WEBHOOK_URL: 告警和解除时POST的webhook（默认不发送）
+func NewPoolAlertPolicyFromEnv() *PoolAlertPolicy {
+	return &PoolAlertPolicy{
+		MinCredits:       envNonNegativeFloat("POOL_MIN_CREDITS", 0),
+		MinRunwayHours:   envNonNegativeFloat("POOL_MIN_RUNWAY_HOURS", 0),
+		BurnRateWindow:   config.PoolBurnRateWindow,
+		WebhookURL:       strings.TrimSpace(os.Getenv("POOL_ALERT_WEBHOOK_URL")),
+		WebhookTimeout:   config.PoolAlertWebhookTimeout,
+		webhookTransport: utils.SharedHTTPClient,
+	}
+}
+
+var poolAlerts = NewPoolAlertPolicyFromEnv()
+
+// evaluatePoolAlerts 每轮周期同步前调用，按上一轮的结果评估账号池告警
+func evaluatePoolAlerts(configs []auth.AuthConfig) {
+	poolAlerts.Evaluate(tokenStatusMonitor.PoolSnapshot(configs, time.Now()))
+}
+
+// Evaluate 记录快照并重新计算消耗速率和告警状态
+// 尚无任何检查结果时跳过，避免启动时把0额度误判为告警
+func (p *PoolAlertPolicy) Evaluate(snapshot PoolSnapshot) {
+	if snapshot.CheckedAccounts == 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	p.addSampleLocked(snapshot)
+	summary := p.summarizeLocked(snapshot)
+
+	var fired, resolved []PoolAlert
+	since := snapshot.At.Format(time.RFC3339)
+	breached := map[string]PoolAlert{}
+	if p.MinCredits > 0 && snapshot.AvailableCredits < p.MinCredits {
+		breached[PoolAlertMinCredits] = PoolAlert{Type: PoolAlertMinCredits, Threshold: p.MinCredits, Value: snapshot.AvailableCredits, Since: since}
+	}
+	if p.MinRunwayHours > 0 && summary.RunwayHours != nil && *summary.RunwayHours < p.MinRunwayHours {
+		breached[PoolAlertMinRunway] = PoolAlert{Type: PoolAlertMinRunway, Threshold: p.MinRunwayHours, Value: *summary.RunwayHours, Since: since}
+	}
+	if p.active == nil {
+		p.active = make(map[string]PoolAlert)
+	}
+	for alertType, alert := range breached {
+		if existing, exists := p.active[alertType]; exists {
+			alert.Since = existing.Since
+		} else {
+			fired = append(fired, alert)
+		}
+		p.active[alertType] = alert
+	}
+	for alertType, alert := range p.active {
+		if _, exists := breached[alertType]; !exists {
+			delete(p.active, alertType)
+			resolved = append(resolved, alert)
+		}
+	}
+
+	summary.Alerts = make([]PoolAlert, 0, len(p.active))
+	for _, alert := range p.active {
+		summary.Alerts = append(summary.Alerts, alert)
+	}
+	sortPoolAlerts(summary.Alerts)
+	sortPoolAlerts(fired)
+	sortPoolAlerts(resolved)
+	p.summary = summary
+	p.mutex.Unlock()
+
+	for _, alert := range fired {
+		logger.Warn("账号池额度告警",
+			logger.String("type", alert.Type),
+			logger.Float64("value", alert.Value),
+			logger.Float64("threshold", alert.Threshold),
+			logger.Float64("available_credits", summary.AvailableCredits),
+			logger.Float64("burn_rate_per_hour", summary.BurnRatePerHour))
+		p.notify(poolAlertFired, alert, summary)
+	}
+	for _, alert := range resolved {
+		logger.Info("账号池额度告警已解除",
+			logger.String("type", alert.Type),
+			logger.Float64("threshold", alert.Threshold),
+			logger.Float64("available_credits", summary.AvailableCredits))
+		p.notify(poolAlertResolved, alert, summary)
+	}
+}
+
+// addSampleLocked 加入快照并丢弃窗口外的旧快照
+// 额度增加（配额重置、新增账号）或账号数变化时之前的快照不再可比，重新开始计算消耗速率
+func (p *PoolAlertPolicy) addSampleLocked(snapshot PoolSnapshot) {
+	if n := len(p.samples); n > 0 {
+		last := p.samples[n-1]
+		if snapshot.AvailableCredits > last.AvailableCredits || snapshot.Accounts != last.Accounts {
+			p.samples = p.samples[:0]
+		}
+	}
+	p.samples = append(p.samples, snapshot)
+
+	cutoff := snapshot.At.Add(-p.BurnRateWindow)
+	trimmed := 0
+	for trimmed < len(p.samples)-1 && p.samples[trimmed].At.Before(cutoff) {
+		trimmed++
+	}
+	p.samples = p.samples[trimmed:]
+}
+
+// summarizeLocked 按窗口内最早和最新的快照计算每小时消耗速率和剩余小时数
+func (p *PoolAlertPolicy) summarizeLocked(snapshot PoolSnapshot) PoolSummary {
+	summary := PoolSummary{
+		EvaluatedAt:      snapshot.At.Format(time.RFC3339),
+		Accounts:         snapshot.Accounts,
+		CheckedAccounts:  snapshot.CheckedAccounts,
+		AvailableCredits: roundTo(snapshot.AvailableCredits, 2),
+		MinCredits:       p.MinCredits,
+		MinRunwayHours:   p.MinRunwayHours,
+	}
+	oldest := p.samples[0]
+	hours := snapshot.At.Sub(oldest.At).Hours()
+	if hours <= 0 {
+		return summary
+	}
+	if burned := oldest.AvailableCredits - snapshot.AvailableCredits; burned > 0 {
+		summary.BurnRatePerHour = roundTo(burned/hours, 2)
+		runway := roundTo(snapshot.AvailableCredits/(burned/hours), 2)
+		summary.RunwayHours = &runway
+	}
+	return summary
+}
+
+// notify 发送告警或解除事件的webhook（已配置时）
+func (p *PoolAlertPolicy) notify(event string, alert PoolAlert, summary PoolSummary) {
+	if p.WebhookURL == "" {
+		return
+	}
+	err := postWebhook(p.webhookTransport, p.WebhookURL, p.WebhookTimeout, map[string]any{
+		"type":               "pool_credit_alert",
+		"event":              event,
+		"alert":              alert.Type,
+		"threshold":          alert.Threshold,
+		"value":              alert.Value,
+		"accounts":           summary.Accounts,
+		"available_credits":  summary.AvailableCredits,
+		"burn_rate_per_hour": summary.BurnRatePerHour,
+		"runway_hours":       summary.RunwayHours,
+	})
+	if err != nil {
+		logger.Warn("发送账号池额度告警webhook失败",
+			logger.String("event", event),
+			logger.String("type", alert.Type),
+			logger.Err(err))
+	}
+}
+
+// Summary 返回最近一次评估的账号池汇总，alerts始终为数组
+func (p *PoolAlertPolicy) Summary() PoolSummary {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	summary := p.summary
+	summary.MinCredits, summary.MinRunwayHours = p.MinCredits, p.MinRunwayHours
+	summary.Alerts = append([]PoolAlert{}, summary.Alerts...)
+	return summary
+}
+
+func sortPoolAlerts(alerts []PoolAlert) {
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Type < alerts[j].Type })
+}
+
+// handleTokenPoolSummary 返回账号池总额度、消耗速率、剩余时长和正在生效的告警
+// GET /api/tokens/summary，数据来自每轮周期同步的评估结果
+func handleTokenPoolSummary(c *gin.Context) {
+	c.JSON(http.StatusOK, poolAlerts.Summary())
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type poolAlertEvent struct {
+	Event string `json:"event"`
+	Alert string `json:"alert"`
+}
+
+// newTestPoolAlertPolicy 创建总额度低于100或剩余不足10小时告警的策略，webhook收到的事件按顺序记录
+func newTestPoolAlertPolicy(t *testing.T) (*PoolAlertPolicy, func() []poolAlertEvent) {
+	var mutex sync.Mutex
+	var events []poolAlertEvent
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		assert.Equal(t, "pool_credit_alert", payload["type"])
+		assert.Contains(t, payload, "available_credits")
+		assert.Contains(t, payload, "runway_hours")
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, poolAlertEvent{Event: payload["event"].(string), Alert: payload["alert"].(string)})
+	}))
+	t.Cleanup(webhook.Close)
+
+	policy := &PoolAlertPolicy{
+		MinCredits:       100,
+		MinRunwayHours:   10,
+		BurnRateWindow:   time.Hour,
+		WebhookURL:       webhook.URL,
+		WebhookTimeout:   time.Second,
+		webhookTransport: http.DefaultClient,
+	}
+	return policy, func() []poolAlertEvent {
+		mutex.Lock()
+		defer mutex.Unlock()
+		drained := events
+		events = nil
+		return drained
+	}
+}
+
+func poolSnapshotAt(start time.Time, minutes int, credits float64) PoolSnapshot {
+	return PoolSnapshot{At: start.Add(time.Duration(minutes) * time.Minute), Accounts: 3, CheckedAccounts: 3, AvailableCredits: credits}
+}
+
+func alertTypes(summary PoolSummary) []string {
+	names := []string{}
+	for _, alert := range summary.Alerts {
+		names = append(names, alert.Type)
+	}
+	return names
+}
+
+func TestPoolAlertPolicy_FiresOncePerTransition(t *testing.T) {
+	policy, drain := newTestPoolAlertPolicy(t)
+	start := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+
+	policy.Evaluate(poolSnapshotAt(start, 0, 500))
+	assert.Empty(t, drain(), "消耗速率未知且额度充足")
+	assert.Nil(t, policy.Summary().RunwayHours)
+
+	// 每小时消耗50，剩余9小时
+	policy.Evaluate(poolSnapshotAt(start, 60, 450))
+	assert.Equal(t, []poolAlertEvent{{poolAlertFired, PoolAlertMinRunway}}, drain())
+	summary := policy.Summary()
+	assert.Equal(t, 50.0, summary.BurnRatePerHour)
+	require.NotNil(t, summary.RunwayHours)
+	assert.Equal(t, 9.0, *summary.RunwayHours)
+	assert.Equal(t, []string{PoolAlertMinRunway}, alertTypes(summary))
+
+	// 仍低于阈值，不重复告警
+	policy.Evaluate(poolSnapshotAt(start, 90, 410))
+	assert.Empty(t, drain())
+
+	// 窗口内每小时消耗10，剩余40小时，解除
+	policy.Evaluate(poolSnapshotAt(start, 150, 400))
+	assert.Equal(t, []poolAlertEvent{{poolAlertResolved, PoolAlertMinRunway}}, drain())
+	assert.Empty(t, policy.Summary().Alerts)
+
+	// 额度跌破100，同时剩余时长不足
+	policy.Evaluate(poolSnapshotAt(start, 180, 90))
+	assert.Equal(t, []poolAlertEvent{{poolAlertFired, PoolAlertMinCredits}, {poolAlertFired, PoolAlertMinRunway}}, drain())
+	policy.Evaluate(poolSnapshotAt(start, 200, 80))
+	assert.Empty(t, drain())
+	assert.Equal(t, []string{PoolAlertMinCredits, PoolAlertMinRunway}, alertTypes(policy.Summary()))
+	assert.Equal(t, start.Add(180*time.Minute).Format(time.RFC3339), policy.Summary().Alerts[0].Since, "持续告警保留首次触发时间")
+
+	// 配额重置后额度回升，消耗速率重新计算
+	policy.Evaluate(poolSnapshotAt(start, 240, 1000))
+	assert.Equal(t, []poolAlertEvent{{poolAlertResolved, PoolAlertMinCredits}, {poolAlertResolved, PoolAlertMinRunway}}, drain())
+	summary = policy.Summary()
+	assert.Empty(t, summary.Alerts)
+	assert.Zero(t, summary.BurnRatePerHour)
+	assert.Nil(t, summary.RunwayHours)
+}
+
+func TestPoolAlertPolicy_SkipsWithoutCheckResults(t *testing.T) {
+	policy, drain := newTestPoolAlertPolicy(t)
+	policy.Evaluate(PoolSnapshot{At: time.Now(), Accounts: 2})
+	assert.Empty(t, drain(), "启动时尚无检查结果，不把0额度当作告警")
+	assert.Empty(t, policy.Summary().EvaluatedAt)
+	assert.NotNil(t, policy.Summary().Alerts)
+}
+
+func TestTokenStatusMonitor_PoolSnapshot(t *testing.T) {
+	monitor := NewTokenStatusMonitor(func(auth.AuthConfig) tokenStatusEntry { return tokenStatusEntry{} })
+	valid := types.TokenInfo{ExpiresAt: time.Now().Add(time.Hour)}
+	monitor.entries["a"] = tokenStatusEntry{TokenInfo: valid, Usage: &auth.UsageCheckResult{Available: 30}}
+	monitor.entries["b"] = tokenStatusEntry{TokenInfo: valid, Usage: &auth.UsageCheckResult{Available: 12.5}}
+	monitor.entries["c"] = tokenStatusEntry{Err: assert.AnError}
+	monitor.entries["disabled"] = tokenStatusEntry{TokenInfo: valid, Usage: &auth.UsageCheckResult{Available: 100}}
+
+	configs := []auth.AuthConfig{
+		{RefreshToken: "a"}, {RefreshToken: "b"}, {RefreshToken: "c"}, {RefreshToken: "pending"},
+		{RefreshToken: "disabled", Disabled: true},
+	}
+	snapshot := monitor.PoolSnapshot(configs, time.Now())
+	assert.Equal(t, 4, snapshot.Accounts)
+	assert.Equal(t, 3, snapshot.CheckedAccounts)
+	assert.Equal(t, 42.5, snapshot.AvailableCredits)
+
+	// 每轮周期同步前调用回调
+	var hooked []auth.AuthConfig
+	monitor.SetRefreshHook(func(configs []auth.AuthConfig) { hooked = configs })
+	monitor.syncAll(func() ([]auth.AuthConfig, error) { return configs, nil })
+	assert.Equal(t, configs, hooked)
+}
+
+func TestRouter_TokenPoolSummary(t *testing.T) {
+	original := poolAlerts
+	t.Cleanup(func() { poolAlerts = original })
+	t.Setenv("POOL_MIN_CREDITS", "100")
+
+	w := serveRouter(t, http.MethodGet, "/api/tokens/summary", "", false)
+	require.Equal(t, http.StatusOK, w.Code)
+	var summary map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &summary))
+	assert.Equal(t, []any{}, summary["alerts"], "没有告警时返回空数组")
+	assert.Equal(t, float64(100), summary["min_credits"])
+	assert.Contains(t, summary, "runway_hours")
+}
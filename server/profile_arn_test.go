@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testProfileArn = "arn:aws:codewhisperer:us-east-1:123456789012:profile/ABCDEFGHIJKL"
+
+func TestBuildCodeWhispererRequest_ProfileArn(t *testing.T) {
+	build := func(tokenInfo types.TokenInfo) map[string]any {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+		req, err := buildCodeWhispererRequest(c, newStopTestRequest(false), tokenInfo, false)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(req.Body)
+		var payload map[string]any
+		require.NoError(t, json.Unmarshal(body, &payload))
+		return payload
+	}
+
+	t.Setenv("CODEWHISPERER_PROFILE_ARN", "")
+	assert.NotContains(t, build(types.TokenInfo{AccessToken: "a"}), "profileArn", "未配置时不发送ARN")
+
+	t.Setenv("CODEWHISPERER_PROFILE_ARN", "arn:aws:codewhisperer:us-east-1:000000000000:profile/GLOBAL")
+	assert.Equal(t, "arn:aws:codewhisperer:us-east-1:000000000000:profile/GLOBAL",
+		build(types.TokenInfo{AccessToken: "a"})["profileArn"])
+	assert.Equal(t, testProfileArn,
+		build(types.TokenInfo{AccessToken: "a", ProfileArn: testProfileArn})["profileArn"], "账号ARN优先于全局默认值")
+}
+
+func TestConfigAPI_RejectsMalformedProfileArn(t *testing.T) {
+	original := configStore
+	t.Cleanup(func() { configStore = original })
+	require.NoError(t, InitConfigStore(filepath.Join(t.TempDir(), "auth_config.json")))
+
+	router := gin.New()
+	router.POST("/api/config", handleAddConfig)
+	router.PUT("/api/config/:index", handleUpdateConfig)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/api/config", `{"auth":"Social","refreshToken":"t","profileArn":"arn:aws:codewhisperer:bad"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "profileArn")
+	assert.Empty(t, configStore.GetConfigs())
+
+	w = send("POST", "/api/config", `{"auth":"Social","refreshToken":"t","disabled":true,"profileArn":"`+testProfileArn+`"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, configStore.GetConfigs(), 1)
+	assert.Equal(t, testProfileArn, configStore.GetConfigs()[0].ProfileArn)
+
+	w = send("PUT", "/api/config/0", `{"auth":"Social","refreshToken":"t","disabled":true,"profileArn":"profile/ABC"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, testProfileArn, configStore.GetConfigs()[0].ProfileArn)
+}
+
+func TestHandleImportConfig_ProfileArn(t *testing.T) {
+	newProbeUpstream(t, http.StatusOK, probeUsageBody)
+	original := configStore
+	t.Cleanup(func() { configStore = original })
+	require.NoError(t, InitConfigStore(filepath.Join(t.TempDir(), "auth_config.json")))
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/api/config/import", strings.NewReader(
+		`[{"refreshToken":"a","clientId":"id","clientSecret":"secret","profileArn":"`+testProfileArn+`"},`+
+			`{"refreshToken":"b","profileArn":"not-an-arn"}]`))
+	c.Request.Header.Set("Content-Type", "application/json")
+	handleImportConfig(c)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Success int            `json:"success"`
+		Results []ImportResult `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.Success)
+	assert.Equal(t, "error", resp.Results[1].Status)
+	assert.Contains(t, resp.Results[1].Message, "profileArn")
+
+	configs := configStore.GetConfigs()
+	require.Len(t, configs, 1)
+	assert.Equal(t, auth.AuthMethodIdC, configs[0].AuthType)
+	assert.Equal(t, testProfileArn, configs[0].ProfileArn)
+}
+
+func TestHandleTokenPoolAPI_ShowsShortProfileArn(t *testing.T) {
+	router, monitor, _ := setupTokenStatusTest(t)
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"refresh-token-aaaaaaaa","profileArn":"`+testProfileArn+`"},{"auth":"Social","refreshToken":"refresh-token-bbbbbbbb"}]`)
+
+	configs, err := auth.GetConfigs()
+	require.NoError(t, err)
+	checkAllTokens(t, monitor, configs)
+	assert.Eventually(t, func() bool {
+		_, checked := monitor.Get(configs[1])
+		return checked
+	}, time.Second, 10*time.Millisecond)
+
+	resp := getTokenPool(t, router)
+	require.Len(t, resp.Tokens, 2)
+	assert.Equal(t, "us-east-1:123456789012:...EFGHIJKL", resp.Tokens[0]["profile_arn"])
+	assert.NotContains(t, resp.Tokens[1], "profile_arn")
+}
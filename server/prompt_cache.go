@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// PromptCacheEstimator 按请求中的cache_control断点估算提示词缓存token
+// 上游不返回缓存用量，这里模拟Anthropic的提示词缓存：最后一个断点之前的前缀在有效期内首次出现计为缓存写入，
+// 再次出现计为缓存读取并刷新有效期，供客户端按cache_creation_input_tokens/cache_read_input_tokens统计费用
+type PromptCacheEstimator struct {
+	mutex      sync.Mutex
+	entries    map[[sha256.Size]byte]time.Time // 前缀哈希 -> 过期时间
+	ttl        time.Duration
+	minTokens  int
+	maxEntries int
+	now        func() time.Time
+}
+
+// promptCacheEstimator 为nil时不估算，usage中的缓存token始终为0
+var promptCacheEstimator *PromptCacheEstimator
+
+// NewPromptCacheEstimator 创建提示词缓存估算器
+func NewPromptCacheEstimator(ttl time.Duration, minTokens, maxEntries int) *PromptCacheEstimator {
+	return &PromptCacheEstimator{
+		entries:    make(map[[sha256.Size]byte]time.Time),
+		ttl:        ttl,
+		minTokens:  minTokens,
+		maxEntries: maxEntries,
+		now:        time.Now,
+	}
+}
+
+// NewPromptCacheEstimatorFromEnv 读取 PROMPT_CACHE_ESTIMATION 环境变量，"true" 时启用，否则返回nil
+func NewPromptCacheEstimatorFromEnv() *PromptCacheEstimator {
+	if !strings.EqualFold(strings.TrimSpace(os.Getenv("PROMPT_CACHE_ESTIMATION")), "true") {
+		return nil
+	}
+	return NewPromptCacheEstimator(config.PromptCacheTTL, config.PromptCacheMinTokens, config.PromptCacheMaxEntries)
+}
+
+// Estimate 返回缓存写入和读取的token数（至多其一非0），不超过totalInputTokens
+// 请求中没有cache_control断点或前缀过短时都为0
+func (e *PromptCacheEstimator) Estimate(req types.AnthropicRequest, totalInputTokens int) (creation, read int) {
+	if e == nil {
+		return 0, 0
+	}
+	prefix, ok := cachedPrefix(req)
+	if !ok {
+		return 0, 0
+	}
+	tokens := min(utils.NewTokenEstimator().EstimateTokens(prefix), totalInputTokens)
+	if tokens < e.minTokens {
+		return 0, 0
+	}
+	data, err := json.Marshal(prefix)
+	if err != nil {
+		return 0, 0
+	}
+	if e.touch(sha256.Sum256(data)) {
+		return 0, tokens
+	}
+	return tokens, 0
+}
+
+// touch 记录前缀并刷新有效期，返回前缀此前是否仍在缓存中
+func (e *PromptCacheEstimator) touch(key [sha256.Size]byte) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	now := e.now()
+	expiresAt, exists := e.entries[key]
+	hit := exists && now.Before(expiresAt)
+	if !exists && len(e.entries) >= e.maxEntries {
+		for k, expiresAt := range e.entries {
+			if !now.Before(expiresAt) {
+				delete(e.entries, k)
+			}
+		}
+		// 仍然已满时随机淘汰一个
+		for k := range e.entries {
+			if len(e.entries) < e.maxEntries {
+				break
+			}
+			delete(e.entries, k)
+		}
+	}
+	e.entries[key] = now.Add(e.ttl)
+	return hit
+}
+
+// cachedPrefix 按tools、system、messages的顺序截取到最后一个cache_control断点（含）的前缀
+// tools在标准化时只保留name、description、input_schema，工具上的断点不会被识别，但工具总在前缀中
+func cachedPrefix(req types.AnthropicRequest) (*types.CountTokensRequest, bool) {
+	prefix := &types.CountTokensRequest{Model: req.Model, Tools: filterSupportedTools(req.Tools)}
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		blocks, ok := req.Messages[i].Content.([]any)
+		if !ok {
+			continue
+		}
+		for j := len(blocks) - 1; j >= 0; j-- {
+			if !hasCacheControl(blocks[j]) {
+				continue
+			}
+			prefix.System = req.System
+			prefix.Messages = append(slices.Clone(req.Messages[:i]), types.AnthropicRequestMessage{
+				Role:    req.Messages[i].Role,
+				Content: blocks[:j+1],
+			})
+			return prefix, true
+		}
+	}
+	for i := len(req.System) - 1; i >= 0; i-- {
+		if req.System[i].CacheControl != nil {
+			prefix.System = req.System[:i+1]
+			return prefix, true
+		}
+	}
+	return nil, false
+}
+
+// hasCacheControl 内容块是否设置了cache_control
+func hasCacheControl(block any) bool {
+	fields, ok := block.(map[string]any)
+	if !ok {
+		return false
+	}
+	cacheControl, ok := fields["cache_control"].(map[string]any)
+	return ok && cacheControl != nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withPromptCacheEstimator 在测试期间启用提示词缓存估算，返回可调整的时钟
+func withPromptCacheEstimator(t *testing.T) *time.Time {
+	t.Helper()
+	original := promptCacheEstimator
+	t.Cleanup(func() { promptCacheEstimator = original })
+	clock := time.Now()
+	promptCacheEstimator = NewPromptCacheEstimator(5*time.Minute, 1024, 100)
+	promptCacheEstimator.now = func() time.Time { return clock }
+	return &clock
+}
+
+var longPrompt = strings.Repeat("You are a careful assistant. ", 400)
+
+// newCacheTestRequest system带缓存断点，最后一条用户消息的第一个块也带断点
+func newCacheTestRequest(stream bool, question string) types.AnthropicRequest {
+	req := newStopTestRequest(stream)
+	req.System = []types.AnthropicSystemMessage{{Type: "text", Text: longPrompt, CacheControl: map[string]any{"type": "ephemeral"}}}
+	req.Messages = []types.AnthropicRequestMessage{{
+		Role: "user",
+		Content: []any{
+			map[string]any{"type": "text", "text": longPrompt, "cache_control": map[string]any{"type": "ephemeral"}},
+			map[string]any{"type": "text", "text": question},
+		},
+	}}
+	return req
+}
+
+func TestPromptCacheEstimator_CreationThenRead(t *testing.T) {
+	clock := withPromptCacheEstimator(t)
+	estimate := func(req types.AnthropicRequest) (int, int) {
+		return promptCacheEstimator.Estimate(req, 100000)
+	}
+
+	creation, read := estimate(newCacheTestRequest(false, "first question"))
+	assert.Greater(t, creation, 1024)
+	assert.Zero(t, read)
+
+	// 断点之后的内容不同仍命中同一前缀
+	creation2, read2 := estimate(newCacheTestRequest(false, "second question"))
+	assert.Zero(t, creation2)
+	assert.Equal(t, creation, read2)
+
+	// 命中刷新有效期；超过有效期后重新写入
+	*clock = clock.Add(4 * time.Minute)
+	_, read = estimate(newCacheTestRequest(false, "third"))
+	assert.Equal(t, creation, read)
+	*clock = clock.Add(6 * time.Minute)
+	creation3, read3 := estimate(newCacheTestRequest(false, "fourth"))
+	assert.Equal(t, creation, creation3)
+	assert.Zero(t, read3)
+}
+
+func TestPromptCacheEstimator_NoBreakpoint(t *testing.T) {
+	withPromptCacheEstimator(t)
+
+	// 没有断点
+	req := newStopTestRequest(false)
+	req.System = []types.AnthropicSystemMessage{{Type: "text", Text: longPrompt}}
+	creation, read := promptCacheEstimator.Estimate(req, 100000)
+	assert.Zero(t, creation+read)
+
+	// 前缀过短
+	req.System[0] = types.AnthropicSystemMessage{Type: "text", Text: "short", CacheControl: map[string]any{"type": "ephemeral"}}
+	creation, read = promptCacheEstimator.Estimate(req, 100000)
+	assert.Zero(t, creation+read)
+
+	// 只有system断点时前缀不含消息
+	req.System[0].Text = longPrompt
+	prefix, ok := cachedPrefix(req)
+	require.True(t, ok)
+	assert.Len(t, prefix.System, 1)
+	assert.Empty(t, prefix.Messages)
+
+	var disabled *PromptCacheEstimator
+	creation, read = disabled.Estimate(newCacheTestRequest(false, "q"), 100000)
+	assert.Zero(t, creation+read)
+}
+
+func TestPromptCacheUsage_AnthropicNonStream(t *testing.T) {
+	withPromptCacheEstimator(t)
+
+	var usages []map[string]any
+	for _, question := range []string{"first", "second"} {
+		newTextDeltaUpstream(t, "Hello")
+		c, w := newScopeTestContext("/v1/messages")
+		scope := newTestScope(c, newCacheTestRequest(false, question))
+		handleNonStreamRequest(scope)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		usage := resp["usage"].(map[string]any)
+		assert.Equal(t, float64(scope.InputTokens), usage["input_tokens"])
+		usages = append(usages, usage)
+	}
+
+	require.Contains(t, usages[0], "cache_creation_input_tokens")
+	require.Contains(t, usages[0], "cache_read_input_tokens")
+	assert.Greater(t, usages[0]["cache_creation_input_tokens"], 0.0)
+	assert.Equal(t, 0.0, usages[0]["cache_read_input_tokens"])
+	assert.Equal(t, 0.0, usages[1]["cache_creation_input_tokens"])
+	assert.Equal(t, usages[0]["cache_creation_input_tokens"], usages[1]["cache_read_input_tokens"])
+	assert.Less(t, usages[0]["input_tokens"], usages[0]["cache_creation_input_tokens"], "缓存前缀从input_tokens中拆出")
+}
+
+func TestPromptCacheUsage_AnthropicStream(t *testing.T) {
+	withPromptCacheEstimator(t)
+	newTextDeltaUpstream(t, "Hello", " world")
+	c, w := newScopeTestContext("/v1/messages")
+
+	scope := newTestScope(c, newCacheTestRequest(true, "question"))
+	handleStreamRequest(scope)
+	require.Positive(t, scope.CacheCreationInputTokens)
+
+	var usages []map[string]any
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var event map[string]any
+		require.NoError(t, json.Unmarshal([]byte(data), &event))
+		switch event["type"] {
+		case "message_start":
+			usages = append(usages, event["message"].(map[string]any)["usage"].(map[string]any))
+		case "message_delta":
+			usages = append(usages, event["usage"].(map[string]any))
+		}
+	}
+	require.Len(t, usages, 2)
+	for _, usage := range usages {
+		assert.Equal(t, float64(scope.CacheCreationInputTokens), usage["cache_creation_input_tokens"])
+		assert.Equal(t, 0.0, usage["cache_read_input_tokens"])
+		assert.Equal(t, float64(scope.InputTokens), usage["input_tokens"])
+	}
+}
+
+func TestPromptCacheUsage_DisabledKeepsFormat(t *testing.T) {
+	original := promptCacheEstimator
+	t.Cleanup(func() { promptCacheEstimator = original })
+	promptCacheEstimator = nil
+
+	newTextDeltaUpstream(t, "Hello")
+	c, w := newScopeTestContext("/v1/messages")
+	handleNonStreamRequest(newTestScope(c, newCacheTestRequest(false, "q")))
+
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.NotContains(t, resp["usage"], "cache_creation_input_tokens")
+	assert.NotContains(t, resp["usage"], "cache_read_input_tokens")
+}
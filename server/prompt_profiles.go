@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// profileHeader 请求级选择提示词配置的请求头，优先于客户端密钥的默认配置
+const profileHeader = "X-Kiro-Profile"
+
+// promptProfileKey gin上下文中本次请求生效的提示词配置名称
+const promptProfileKey = "prompt_profile"
+
+// 配置的system文本与客户端system提示的合并位置
+const (
+	ProfilePlacementPrepend = "prepend" // 放在客户端system之前（默认）
+	ProfilePlacementAppend  = "append"  // 放在客户端system之后
+)
+
+// PromptProfile 服务端提示词配置：向system提示注入固定文本，并为未指定的采样参数提供默认值
+// 用于在不修改客户端的情况下统一输出语言或追加免责声明等
+type PromptProfile struct {
+	System      string   `json:"system"`
+	Placement   string   `json:"placement,omitempty"` // prepend（默认）/ append
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+}
+
+// PromptProfiles PROFILES_FILE的内容
+type PromptProfiles struct {
+	Profiles map[string]PromptProfile `json:"profiles"`
+	Keys     map[string]string        `json:"keys,omitempty"` // 客户端密钥 -> 默认配置名称
+}
+
+// promptProfiles 全局提示词配置，nil表示未启用（忽略X-Kiro-Profile）
+var promptProfiles *PromptProfiles
+
+// InitPromptProfiles 根据环境变量加载提示词配置
+func InitPromptProfiles() error {
+	profiles, err := NewPromptProfilesFromEnv()
+	if err != nil {
+		return err
+	}
+	promptProfiles = profiles
+	if profiles != nil {
+		logger.Info("提示词配置已启用",
+			logger.Int("profiles", len(profiles.Profiles)),
+			logger.Int("keys", len(profiles.Keys)))
+	}
+	return nil
+}
+
+// NewPromptProfilesFromEnv 读取PROFILES_FILE指向的JSON文件，未配置时返回nil
+func NewPromptProfilesFromEnv() (*PromptProfiles, error) {
+	path := strings.TrimSpace(os.Getenv("PROFILES_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取PROFILES_FILE失败: %w", err)
+	}
+	var profiles PromptProfiles
+	if err := utils.SafeUnmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("解析PROFILES_FILE失败: %w", err)
+	}
+	if err := profiles.validate(); err != nil {
+		return nil, fmt.Errorf("PROFILES_FILE无效: %w", err)
+	}
+	return &profiles, nil
+}
+
+func (p *PromptProfiles) validate() error {
+	for name, profile := range p.Profiles {
+		switch profile.Placement {
+		case "", ProfilePlacementPrepend, ProfilePlacementAppend:
+		default:
+			return fmt.Errorf("配置 %q 的placement必须是prepend或append，收到: %q", name, profile.Placement)
+		}
+	}
+	for key, name := range p.Keys {
+		if _, exists := p.Profiles[name]; !exists {
+			return fmt.Errorf("客户端密钥 %s 引用了不存在的配置 %q", maskClientKey(key), name)
+		}
+	}
+	return nil
+}
+
+// resolvePromptProfile 返回本次请求的配置名称：X-Kiro-Profile优先，其次是客户端密钥的默认配置
+// 未启用或未选择时返回空字符串；请求头指定的配置不存在时返回400并返回false
+func resolvePromptProfile(c *gin.Context) (string, bool) {
+	if promptProfiles == nil {
+		return "", true
+	}
+	if name := strings.TrimSpace(c.GetHeader(profileHeader)); name != "" {
+		if _, exists := promptProfiles.Profiles[name]; !exists {
+			respondError(c, http.StatusBadRequest, "%s 指定的配置不存在: %q", profileHeader, name)
+			return "", false
+		}
+		return name, true
+	}
+	return promptProfiles.Keys[extractAPIKey(c)], true
+}
+
+// selectPromptProfile 解析并记录本次请求的配置，返回nil表示不使用配置
+func selectPromptProfile(c *gin.Context) (*PromptProfile, bool) {
+	name, ok := resolvePromptProfile(c)
+	if !ok || name == "" {
+		return nil, ok
+	}
+	profile := promptProfiles.Profiles[name]
+	c.Set(promptProfileKey, name)
+	return &profile, true
+}
+
+// requestPromptProfile 返回本次请求生效的配置名称，未使用配置时返回空字符串
+func requestPromptProfile(c *gin.Context) string {
+	return c.GetString(promptProfileKey)
+}
+
+// applyPromptProfile 将配置的system文本与客户端system提示合并，并填充客户端未指定的采样参数
+// OpenAI请求的system消息仍保留在对话中，配置文本作为独立的system提示位于对话之前
+func applyPromptProfile(c *gin.Context, profile *PromptProfile, req types.AnthropicRequest) types.AnthropicRequest {
+	if profile == nil {
+		return req
+	}
+
+	if profile.System != "" {
+		block := types.AnthropicSystemMessage{Type: "text", Text: profile.System}
+		system := make([]types.AnthropicSystemMessage, 0, len(req.System)+1)
+		if profile.Placement == ProfilePlacementAppend {
+			system = append(append(system, req.System...), block)
+		} else {
+			system = append(append(system, block), req.System...)
+		}
+		req.System = system
+	}
+	if req.MaxTokens == 0 && profile.MaxTokens > 0 {
+		req.MaxTokens = profile.MaxTokens
+	}
+	if req.Temperature == nil && profile.Temperature != nil {
+		req.Temperature = profile.Temperature
+	}
+	if req.TopP == nil && profile.TopP != nil {
+		req.TopP = profile.TopP
+	}
+
+	logger.Debug("已应用提示词配置", addReqFields(c, logger.String("profile", requestPromptProfile(c)))...)
+	return req
+}
+
+// applyPromptProfileOpenAIDefaults OpenAI请求未指定max_completion_tokens和max_tokens时使用配置的默认值（转换时会填入固定默认值，需提前处理）
+func applyPromptProfileOpenAIDefaults(profile *PromptProfile, req types.OpenAIRequest) types.OpenAIRequest {
+	if _, explicit := req.RequestedMaxTokens(); profile != nil && !explicit && profile.MaxTokens > 0 {
+		maxTokens := profile.MaxTokens
+		req.MaxTokens = &maxTokens
+	}
+	return req
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withPromptProfiles(t *testing.T, profiles *PromptProfiles) {
+	t.Helper()
+	original := promptProfiles
+	promptProfiles = profiles
+	t.Cleanup(func() { promptProfiles = original })
+}
+
+func newProfileTestContext(apiKey, profile string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	if apiKey != "" {
+		c.Request.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	if profile != "" {
+		c.Request.Header.Set(profileHeader, profile)
+	}
+	return c, w
+}
+
+func testPromptProfiles() *PromptProfiles {
+	temperature := 0.3
+	return &PromptProfiles{
+		Profiles: map[string]PromptProfile{
+			"chinese":    {System: "请始终使用中文回答。", MaxTokens: 2048, Temperature: &temperature},
+			"disclaimer": {System: "回答末尾附上免责声明。", Placement: ProfilePlacementAppend},
+		},
+		Keys: map[string]string{"team-cn-key": "chinese"},
+	}
+}
+
+func profileTestRequest() types.AnthropicRequest {
+	return types.AnthropicRequest{
+		Model:    "claude-sonnet-4-20250514",
+		System:   []types.AnthropicSystemMessage{{Type: "text", Text: "client system"}},
+		Messages: []types.AnthropicRequestMessage{{Role: "user", Content: "hi"}},
+	}
+}
+
+func systemTexts(req types.AnthropicRequest) []string {
+	texts := make([]string, len(req.System))
+	for i, block := range req.System {
+		texts[i] = block.Text
+	}
+	return texts
+}
+
+func TestPromptProfile_MergeOrder(t *testing.T) {
+	withPromptProfiles(t, testPromptProfiles())
+
+	c, _ := newProfileTestContext("", "chinese")
+	profile, ok := selectPromptProfile(c)
+	require.True(t, ok)
+	req := applyPromptProfile(c, profile, profileTestRequest())
+	assert.Equal(t, []string{"请始终使用中文回答。", "client system"}, systemTexts(req))
+
+	c, _ = newProfileTestContext("", "disclaimer")
+	profile, ok = selectPromptProfile(c)
+	require.True(t, ok)
+	req = applyPromptProfile(c, profile, profileTestRequest())
+	assert.Equal(t, []string{"client system", "回答末尾附上免责声明。"}, systemTexts(req))
+}
+
+func TestPromptProfile_DefaultsOnlyFillUnsetParams(t *testing.T) {
+	withPromptProfiles(t, testPromptProfiles())
+	c, _ := newProfileTestContext("", "chinese")
+	profile, _ := selectPromptProfile(c)
+
+	req := applyPromptProfile(c, profile, profileTestRequest())
+	assert.Equal(t, 2048, req.MaxTokens)
+	require.NotNil(t, req.Temperature)
+	assert.Equal(t, 0.3, *req.Temperature)
+
+	explicit := profileTestRequest()
+	explicit.MaxTokens = 100
+	temperature := 1.0
+	explicit.Temperature = &temperature
+	req = applyPromptProfile(c, profile, explicit)
+	assert.Equal(t, 100, req.MaxTokens)
+	assert.Equal(t, 1.0, *req.Temperature)
+
+	// OpenAI请求在转换前填充max_tokens
+	openaiReq := applyPromptProfileOpenAIDefaults(profile, types.OpenAIRequest{})
+	require.NotNil(t, openaiReq.MaxTokens)
+	assert.Equal(t, 2048, *openaiReq.MaxTokens)
+}
+
+func TestPromptProfile_PerKeyDefaultAndHeaderOverride(t *testing.T) {
+	withPromptProfiles(t, testPromptProfiles())
+
+	c, _ := newProfileTestContext("team-cn-key", "")
+	profile, ok := selectPromptProfile(c)
+	require.True(t, ok)
+	require.NotNil(t, profile)
+	assert.Equal(t, "chinese", requestPromptProfile(c))
+
+	c, _ = newProfileTestContext("team-cn-key", "disclaimer")
+	_, ok = selectPromptProfile(c)
+	require.True(t, ok)
+	assert.Equal(t, "disclaimer", requestPromptProfile(c))
+
+	c, _ = newProfileTestContext("other-key", "")
+	profile, ok = selectPromptProfile(c)
+	require.True(t, ok)
+	assert.Nil(t, profile)
+	assert.Empty(t, requestPromptProfile(c))
+}
+
+func TestPromptProfile_UnknownHeaderProfile(t *testing.T) {
+	withPromptProfiles(t, testPromptProfiles())
+
+	c, w := newProfileTestContext("", "missing")
+	_, ok := selectPromptProfile(c)
+
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "missing")
+}
+
+func TestPromptProfile_RequestsWithoutProfileUntouched(t *testing.T) {
+	// 未启用时忽略请求头
+	withPromptProfiles(t, nil)
+	c, _ := newProfileTestContext("team-cn-key", "chinese")
+	profile, ok := selectPromptProfile(c)
+	require.True(t, ok)
+	assert.Nil(t, profile)
+
+	original := profileTestRequest()
+	assert.Equal(t, original, applyPromptProfile(c, profile, profileTestRequest()))
+}
+
+func TestPromptProfile_EffectiveParamsAndAccessLog(t *testing.T) {
+	withPromptProfiles(t, testPromptProfiles())
+	entries := captureAccessLog(t)
+
+	r := gin.New()
+	r.Use(AccessLogMiddleware(AccessLogFormatJSON))
+	var params *EffectiveParams
+	r.POST("/v1/messages", func(c *gin.Context) {
+		profile, ok := selectPromptProfile(c)
+		require.True(t, ok)
+		req := applyPromptProfile(c, profile, profileTestRequest())
+		var err error
+		params, err = computeEffectiveParams(c, req)
+		require.NoError(t, err)
+		c.Status(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req.Header.Set("x-api-key", "team-cn-key")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotNil(t, params)
+	assert.Equal(t, "chinese", params.Profile)
+	logged := entries()
+	require.Len(t, logged, 1)
+	assert.Equal(t, "chinese", logged[0]["profile"])
+}
+
+func TestNewPromptProfilesFromEnv(t *testing.T) {
+	t.Setenv("PROFILES_FILE", "")
+	profiles, err := NewPromptProfilesFromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, profiles)
+
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "profiles.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+
+	t.Setenv("PROFILES_FILE", write(`{"profiles":{"zh":{"system":"用中文","placement":"append"}},"keys":{"k":"zh"}}`))
+	profiles, err = NewPromptProfilesFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, ProfilePlacementAppend, profiles.Profiles["zh"].Placement)
+	assert.Equal(t, "zh", profiles.Keys["k"])
+
+	t.Setenv("PROFILES_FILE", write(`{"profiles":{"zh":{"system":"用中文","placement":"middle"}}}`))
+	_, err = NewPromptProfilesFromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("PROFILES_FILE", write(`{"profiles":{},"keys":{"k":"zh"}}`))
+	_, err = NewPromptProfilesFromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("PROFILES_FILE", filepath.Join(dir, "missing.json"))
+	_, err = NewPromptProfilesFromEnv()
+	assert.Error(t, err)
+}
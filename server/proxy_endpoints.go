@@ -0,0 +1,225 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"kiro2api/auth"
+	"kiro2api/converter"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleModels GET /v1/models 模型列表（含自定义别名和能力元数据）
+func handleModels(c *gin.Context) {
+	response := types.ModelsResponse{
+		Object: "list",
+		Data:   buildModelList(),
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// handleMessages POST /v1/messages Anthropic API代理
+func handleMessages(authService *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 使用RequestContext统一处理请求体读取和token获取
+		// 先读取并审核请求，审核通过后再选择token
+		reqCtx := &RequestContext{
+			GinContext:  c,
+			AuthService: authService,
+			RequestType: "Anthropic",
+		}
+
+		body, err := reqCtx.ReadBody()
+		if err != nil {
+			return // 错误已在ReadBody中处理
+		}
+		if !checkRequestFields(c, body, anthropicKnownFields) {
+			return
+		}
+		// 服务端提示词配置（PROFILES_FILE）：X-Kiro-Profile或客户端密钥的默认配置
+		profile, ok := selectPromptProfile(c)
+		if !ok {
+			return
+		}
+
+		// 标准化工具格式：只改写tools数组，其余字段原样保留
+		normalizedBody, err := normalizeAnthropicRequestBody(body)
+		if err != nil {
+			logger.Error("解析请求体失败", logger.Err(err))
+			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+			return
+		}
+
+		var anthropicReq types.AnthropicRequest
+		if err := utils.SafeUnmarshal(normalizedBody, &anthropicReq); err != nil {
+			logger.Error("解析标准化请求体失败", logger.Err(err))
+			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+			return
+		}
+
+		// 验证请求的有效性
+		if len(anthropicReq.Messages) == 0 {
+			logger.Error("请求中没有消息")
+			respondError(c, http.StatusBadRequest, "%s", "messages 数组不能为空")
+			return
+		}
+
+		// 验证最后一条消息有有效内容
+		lastMsg := anthropicReq.Messages[len(anthropicReq.Messages)-1]
+		if err := validateMessageContent(lastMsg.Content, placeholderPolicy); err != nil {
+			switch {
+			case errors.Is(err, ErrEmptyMessageContent), errors.Is(err, ErrPlaceholderContent):
+				logger.Error("消息内容为空或无效",
+					logger.Err(err),
+					logContent(c, "raw_content", lastMsg.Content))
+				respondError(c, http.StatusBadRequest, "%s", "消息内容不能为空")
+			default:
+				logger.Error("获取消息内容失败",
+					logger.Err(err),
+					logContent(c, "raw_content", lastMsg.Content))
+				respondError(c, http.StatusBadRequest, "%v", err)
+			}
+			return
+		}
+
+		// 可选：按X-Override-Model替换模型（MODEL_OVERRIDE_ENABLED）
+		anthropicReq = applyModelOverride(c, anthropicReq)
+		setAccessLogModel(c, anthropicReq.Model)
+
+		if !moderateRequest(c, reqCtx.RequestType, anthropicReq) {
+			return
+		}
+
+		anthropicReq = applyPromptProfile(c, profile, anthropicReq)
+		anthropicReq = applyDefaultMaxTokens(c, anthropicReq, anthropicReq.MaxTokens > 0)
+
+		// 整理消息角色顺序：合并连续同角色消息、保证以user消息开头、校验tool_result顺序
+		anthropicReq, ok = normalizeConversation(c, anthropicReq)
+		if !ok {
+			return
+		}
+		if !parseClientTimeout(c) {
+			return
+		}
+		anthropicReq = converter.SanitizeToolNames(anthropicReq)
+
+		// 可选：裁剪过长的对话历史（HISTORY_TRIM_MODE）
+		anthropicReq = trimHistory(c, anthropicReq)
+
+		// 可选：单请求额度预算（MAX_CREDITS_PER_REQUEST）
+		if !checkCostBudget(c, anthropicReq) {
+			return
+		}
+
+		tokenWithUsage, err := reqCtx.GetTokenWithUsage()
+		if err != nil {
+			return // 错误已在GetTokenWithUsage中处理
+		}
+		logModelMapping(c, anthropicReq.Model)
+		scope := newRequestScope(c, anthropicReq, tokenWithUsage)
+		// 上游请求未发出或被取消时，结束前释放token的进行中计数
+		defer scope.releaseToken()
+
+		if anthropicReq.Stream {
+			handleStreamRequest(scope)
+			return
+		}
+
+		// 可选：抽样镜像到影子实例（SHADOW_URL），主响应写出后异步发送
+		if mirror := shadowTraffic.Wrap(c, body); mirror != nil {
+			defer mirror()
+		}
+
+		handleNonStreamRequest(scope)
+	}
+}
+
+// handleChatCompletions POST /v1/chat/completions OpenAI兼容代理，转换为Anthropic请求后转发
+func handleChatCompletions(authService *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 使用RequestContext统一处理请求体读取和token获取
+		reqCtx := &RequestContext{
+			GinContext:  c,
+			AuthService: authService,
+			RequestType: "OpenAI",
+		}
+
+		body, err := reqCtx.ReadBody()
+		if err != nil {
+			return // 错误已在ReadBody中处理
+		}
+		if !checkRequestFields(c, body, openAIKnownFields) {
+			return
+		}
+		profile, ok := selectPromptProfile(c)
+		if !ok {
+			return
+		}
+
+		var openaiReq types.OpenAIRequest
+		if err := utils.SafeUnmarshal(body, &openaiReq); err != nil {
+			logger.Error("解析OpenAI请求体失败", logger.Err(err))
+			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+			return
+		}
+		openaiReq = applyPromptProfileOpenAIDefaults(profile, openaiReq)
+
+		logger.Debug("OpenAI请求解析成功",
+			logger.String("model", openaiReq.Model),
+			logger.Bool("stream", openaiReq.Stream != nil && *openaiReq.Stream),
+			logger.Int("max_tokens", func() int {
+				maxTokens, _ := openaiReq.RequestedMaxTokens()
+				return maxTokens
+			}()))
+
+		// 转换为Anthropic格式
+		anthropicReq := converter.ConvertOpenAIToAnthropic(openaiReq)
+		anthropicReq = applyModelOverride(c, anthropicReq)
+		setAccessLogModel(c, anthropicReq.Model)
+		// 转换时按原模型填入默认值，模型被覆盖后需重新取默认值
+		_, explicitMaxTokens := openaiReq.RequestedMaxTokens()
+		anthropicReq = applyDefaultMaxTokens(c, anthropicReq, explicitMaxTokens)
+		if !checkOpenAIMaxTokens(c, openaiReq, anthropicReq) {
+			return
+		}
+
+		if !moderateRequest(c, reqCtx.RequestType, anthropicReq) {
+			return
+		}
+		anthropicReq = applyPromptProfile(c, profile, anthropicReq)
+
+		anthropicReq, ok = normalizeConversation(c, anthropicReq)
+		if !ok {
+			return
+		}
+		if !parseClientTimeout(c) {
+			return
+		}
+		anthropicReq = converter.SanitizeToolNames(anthropicReq)
+
+		anthropicReq = trimHistory(c, anthropicReq)
+
+		if !checkCostBudget(c, anthropicReq) {
+			return
+		}
+
+		tokenInfo, err := reqCtx.GetToken()
+		if err != nil {
+			return // 错误已在GetToken中处理
+		}
+		logModelMapping(c, anthropicReq.Model)
+		scope := newRequestScope(c, anthropicReq, &types.TokenWithUsage{TokenInfo: tokenInfo})
+		defer scope.releaseToken()
+
+		if anthropicReq.Stream {
+			handleOpenAIStreamRequest(scope)
+			return
+		}
+		handleOpenAINonStreamRequest(scope)
+	}
+}
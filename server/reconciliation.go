@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReconciliationPolicy 对账参数
+// 估算额度 = 输入token/1000 * InputPer1K + 输出token/1000 * OutputPer1K（与单请求额度预算使用相同的系数）
+type ReconciliationPolicy struct {
+	InputPer1K       float64
+	OutputPer1K      float64
+	AlertPercent     float64 // 实际消耗与估算相差超过该百分比时告警
+	MinRequests      int64   // 当天请求数少于该值的账号不告警
+	WebhookURL       string  // 告警webhook，为空时只记录日志
+	WebhookTimeout   time.Duration
+	webhookTransport *http.Client
+}
+
+// ReconciliationEntry 单个账号一天的对账结果
+type ReconciliationEntry struct {
+	Account string `json:"account"` // ConfigID
+	auth.AccountingFigures
+	ExpectedCredits    float64 `json:"expected_credits"`
+	DiscrepancyPercent float64 `json:"discrepancy_percent"` // (实际 - 估算) / 估算 * 100
+	Factor             float64 `json:"factor,omitempty"`    // 实际 / 估算，用于reconciled模式
+	Alert              bool    `json:"alert"`
+}
+
+// ReconciliationReport 一天的对账报告
+type ReconciliationReport struct {
+	Day              string                `json:"day"`
+	GeneratedAt      string                `json:"generated_at"`
+	AlertPercent     float64               `json:"alert_percent"`
+	Alerts           int                   `json:"alerts"`
+	Entries          []ReconciliationEntry `json:"entries"`
+	EstimatedCredits float64               `json:"expected_credits"`
+	ObservedCredits  float64               `json:"observed_credits"`
+}
+
+// NewReconciliationPolicyFromEnv 根据环境变量创建对账参数
+// RECONCILIATION_ALERT_PERCENT: 告警阈值百分比（默认25）
+// RECONCILIATION_WEBHOOK_URL: 告警webhook（默认不发送）
+// CREDITS_PER_1K_INPUT_TOKENS / CREDITS_PER_1K_OUTPUT_TOKENS: 估算额度的系数
+func NewReconciliationPolicyFromEnv() *ReconciliationPolicy {
+	return &ReconciliationPolicy{
+		InputPer1K:       envNonNegativeFloat("CREDITS_PER_1K_INPUT_TOKENS", config.DefaultCreditsPer1KInputTokens),
+		OutputPer1K:      envNonNegativeFloat("CREDITS_PER_1K_OUTPUT_TOKENS", config.DefaultCreditsPer1KOutputTokens),
+		AlertPercent:     envNonNegativeFloat("RECONCILIATION_ALERT_PERCENT", config.ReconciliationAlertPercent),
+		MinRequests:      config.ReconciliationMinRequests,
+		WebhookURL:       strings.TrimSpace(os.Getenv("RECONCILIATION_WEBHOOK_URL")),
+		WebhookTimeout:   config.ReconciliationWebhookTimeout,
+		webhookTransport: utils.SharedHTTPClient,
+	}
+}
+
+// Reconcile 根据一天的估算与观测数据生成对账报告
+func (p *ReconciliationPolicy) Reconcile(day string, figures map[string]auth.AccountingFigures, now time.Time) ReconciliationReport {
+	report := ReconciliationReport{
+		Day:          day,
+		GeneratedAt:  now.Format(time.RFC3339),
+		AlertPercent: p.AlertPercent,
+		Entries:      make([]ReconciliationEntry, 0, len(figures)),
+	}
+	for account, f := range figures {
+		entry := ReconciliationEntry{
+			Account:           account,
+			AccountingFigures: f,
+			ExpectedCredits: roundTo(float64(f.InputTokens)/1000*p.InputPer1K+
+				float64(f.OutputTokens)/1000*p.OutputPer1K, 4),
+		}
+		if entry.ExpectedCredits > 0 {
+			entry.DiscrepancyPercent = roundTo((f.ObservedCredits-entry.ExpectedCredits)/entry.ExpectedCredits*100, 2)
+			if f.ObservedCredits > 0 {
+				entry.Factor = roundTo(f.ObservedCredits/entry.ExpectedCredits, 4)
+			}
+			entry.Alert = f.Requests >= p.MinRequests && math.Abs(entry.DiscrepancyPercent) > p.AlertPercent
+		}
+		if entry.Alert {
+			report.Alerts++
+		}
+		report.EstimatedCredits += entry.ExpectedCredits
+		report.ObservedCredits += f.ObservedCredits
+		report.Entries = append(report.Entries, entry)
+	}
+	report.EstimatedCredits = roundTo(report.EstimatedCredits, 4)
+	report.ObservedCredits = roundTo(report.ObservedCredits, 4)
+	sort.Slice(report.Entries, func(i, j int) bool { return report.Entries[i].Account < report.Entries[j].Account })
+	return report
+}
+
+func roundTo(value float64, digits int) float64 {
+	scale := math.Pow(10, float64(digits))
+	return math.Round(value*scale) / scale
+}
+
+// Alert 对超出阈值的账号记录警告日志，并发送webhook（已配置时）
+func (p *ReconciliationPolicy) Alert(report ReconciliationReport) {
+	if report.Alerts == 0 {
+		return
+	}
+	var alerts []ReconciliationEntry
+	for _, entry := range report.Entries {
+		if !entry.Alert {
+			continue
+		}
+		alerts = append(alerts, entry)
+		logger.Warn("token估算与实际额度消耗偏差过大",
+			logger.String("day", report.Day),
+			logger.String("account", entry.Account),
+			logger.Int64("requests", entry.Requests),
+			logger.Float64("expected_credits", entry.ExpectedCredits),
+			logger.Float64("observed_credits", entry.ObservedCredits),
+			logger.Float64("discrepancy_percent", entry.DiscrepancyPercent),
+			logger.Float64("alert_percent", report.AlertPercent))
+	}
+	if p.WebhookURL == "" {
+		return
+	}
+	if err := p.sendWebhook(report, alerts); err != nil {
+		logger.Warn("发送对账告警webhook失败", logger.String("day", report.Day), logger.Err(err))
+	}
+}
+
+func (p *ReconciliationPolicy) sendWebhook(report ReconciliationReport, alerts []ReconciliationEntry) error {
+	return postWebhook(p.webhookTransport, p.WebhookURL, p.WebhookTimeout, map[string]any{
+		"type":          "token_reconciliation",
+		"day":           report.Day,
+		"alert_percent": report.AlertPercent,
+		"alerts":        alerts,
+	})
+}
+
+// postWebhook 以JSON POST告警内容，4xx/5xx视为失败
+func postWebhook(client *http.Client, url string, timeout time.Duration, payload any) error {
+	body, err := utils.SafeMarshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook返回状态码 %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ReconciliationStore 保存最近的每日对账报告，并提供reconciled模式使用的各账号比例
+type ReconciliationStore struct {
+	mutex   sync.RWMutex
+	reports map[string]ReconciliationReport // 日期 -> 报告
+	factors map[string]float64              // ConfigID -> 最近一份报告中的实际/估算比例
+}
+
+// reconciliationStore 全局对账报告存储（测试可替换）
+var reconciliationStore = NewReconciliationStore()
+
+// NewReconciliationStore 创建空的报告存储
+func NewReconciliationStore() *ReconciliationStore {
+	return &ReconciliationStore{
+		reports: make(map[string]ReconciliationReport),
+		factors: make(map[string]float64),
+	}
+}
+
+// Save 保存报告，同一天的报告被替换；超出保留数量时淘汰最早的报告
+// 比例按日期顺序更新，只有不早于已有报告的日期才会覆盖账号的比例
+func (s *ReconciliationStore) Save(report ReconciliationReport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reports[report.Day] = report
+
+	days := s.daysLocked()
+	for len(days) > config.ReconciliationReportDays {
+		delete(s.reports, days[0])
+		days = days[1:]
+	}
+	s.factors = make(map[string]float64)
+	for _, day := range days {
+		for _, entry := range s.reports[day].Entries {
+			if entry.Factor > 0 {
+				s.factors[entry.Account] = entry.Factor
+			}
+		}
+	}
+}
+
+// Reports 按日期从新到旧返回所有报告
+func (s *ReconciliationStore) Reports() []ReconciliationReport {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	days := s.daysLocked()
+	reports := make([]ReconciliationReport, 0, len(days))
+	for i := len(days) - 1; i >= 0; i-- {
+		reports = append(reports, s.reports[days[i]])
+	}
+	return reports
+}
+
+// Factor 账号最近一次对账的实际/估算比例，没有对账结果时为1
+func (s *ReconciliationStore) Factor(account string) float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if factor, exists := s.factors[account]; exists {
+		return factor
+	}
+	return 1
+}
+
+func (s *ReconciliationStore) daysLocked() []string {
+	days := make([]string, 0, len(s.reports))
+	for day := range s.reports {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days
+}
+
+// reconciliationPolicy 对账参数（测试可替换）
+var reconciliationPolicy = NewReconciliationPolicyFromEnv()
+
+// runReconciliation 生成某天的对账报告并保存，超出阈值时告警
+func runReconciliation(day string, now time.Time) ReconciliationReport {
+	report := reconciliationPolicy.Reconcile(day, tokenAccounting.AccountingDay(day), now)
+	reconciliationStore.Save(report)
+	logger.Info("已生成token对账报告",
+		logger.String("day", day),
+		logger.Int("accounts", len(report.Entries)),
+		logger.Float64("expected_credits", report.EstimatedCredits),
+		logger.Float64("observed_credits", report.ObservedCredits),
+		logger.Int("alerts", report.Alerts))
+	reconciliationPolicy.Alert(report)
+	return report
+}
+
+// StartReconciliationJob 每天零点之后生成前一天的对账报告，未注入对账数据时不启动
+func StartReconciliationJob() {
+	if tokenAccounting == nil {
+		return
+	}
+	go func() {
+		for {
+			now := time.Now()
+			midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+			next := midnight.Add(config.ReconciliationRunOffset)
+			if !next.After(now) {
+				next = midnight.AddDate(0, 0, 1).Add(config.ReconciliationRunOffset)
+			}
+			time.Sleep(time.Until(next))
+			yesterday := next.AddDate(0, 0, -1).Format(auth.AccountingDayFormat)
+			runReconciliation(yesterday, time.Now())
+		}
+	}()
+}
+
+// handleReconciliationReports GET /api/reports/reconciliation
+// 返回已保存的每日报告；带 ?day=YYYY-MM-DD 时按当前数据即时计算该天的报告（不保存、不告警）
+func handleReconciliationReports(c *gin.Context) {
+	if day := strings.TrimSpace(c.Query("day")); day != "" {
+		if _, err := time.ParseInLocation(auth.AccountingDayFormat, day, time.Local); err != nil {
+			respondError(c, http.StatusBadRequest, "day格式应为YYYY-MM-DD: %q", day)
+			return
+		}
+		if tokenAccounting == nil {
+			respondError(c, http.StatusServiceUnavailable, "%s", "对账统计未启用")
+			return
+		}
+		c.JSON(http.StatusOK, reconciliationPolicy.Reconcile(day, tokenAccounting.AccountingDay(day), time.Now()))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"source":  tokenAccountingSource,
+		"reports": reconciliationStore.Reports(),
+	})
+}
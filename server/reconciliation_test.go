@@ -0,0 +1,340 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedTokens struct {
+	account      string
+	inputTokens  int
+	outputTokens int
+}
+
+// fakeTokenAccounting 用合成数据代替TokenManager的对账统计
+type fakeTokenAccounting struct {
+	mutex    sync.Mutex
+	accounts map[string]string // access token -> ConfigID
+	days     map[string]map[string]auth.AccountingFigures
+	recorded []recordedTokens
+}
+
+func (f *fakeTokenAccounting) AccountID(accessToken string) string {
+	return f.accounts[accessToken]
+}
+
+func (f *fakeTokenAccounting) RecordEstimatedTokens(accessToken string, inputTokens, outputTokens int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.recorded = append(f.recorded, recordedTokens{f.accounts[accessToken], inputTokens, outputTokens})
+}
+
+func (f *fakeTokenAccounting) AccountingDay(day string) map[string]auth.AccountingFigures {
+	return f.days[day]
+}
+
+// withFakeTokenAccounting 注入假的对账统计，并使用空的报告存储和固定系数的对账参数
+func withFakeTokenAccounting(t *testing.T, source string) *fakeTokenAccounting {
+	fake := &fakeTokenAccounting{
+		accounts: map[string]string{"access": "account-a"},
+		days:     make(map[string]map[string]auth.AccountingFigures),
+	}
+	originalLedger, originalSource := tokenAccounting, tokenAccountingSource
+	originalStore, originalPolicy := reconciliationStore, reconciliationPolicy
+	tokenAccounting = fake
+	tokenAccountingSource = source
+	reconciliationStore = NewReconciliationStore()
+	reconciliationPolicy = newTestReconciliationPolicy("")
+	t.Cleanup(func() {
+		tokenAccounting, tokenAccountingSource = originalLedger, originalSource
+		reconciliationStore, reconciliationPolicy = originalStore, originalPolicy
+	})
+	return fake
+}
+
+func newTestReconciliationPolicy(webhookURL string) *ReconciliationPolicy {
+	return &ReconciliationPolicy{
+		InputPer1K:       0.1,
+		OutputPer1K:      0.5,
+		AlertPercent:     25,
+		MinRequests:      20,
+		WebhookURL:       webhookURL,
+		WebhookTimeout:   time.Second,
+		webhookTransport: http.DefaultClient,
+	}
+}
+
+// syntheticFigures 估算额度：a=20 b=20 c=10 d=20
+func syntheticFigures() map[string]auth.AccountingFigures {
+	return map[string]auth.AccountingFigures{
+		"a": {Requests: 100, InputTokens: 100000, OutputTokens: 20000, ObservedCredits: 30}, // +50%，告警
+		"b": {Requests: 50, InputTokens: 200000, ObservedCredits: 18},                       // -10%
+		"c": {Requests: 5, InputTokens: 100000},                                             // -100%，请求数不足不告警
+		"d": {Requests: 20, InputTokens: 100000, OutputTokens: 20000, ObservedCredits: 25},  // 恰好等于阈值不告警
+	}
+}
+
+func TestReconciliationPolicy_Reconcile(t *testing.T) {
+	now := time.Date(2026, 10, 18, 0, 10, 0, 0, time.UTC)
+	report := newTestReconciliationPolicy("").Reconcile("2026-10-17", syntheticFigures(), now)
+
+	assert.Equal(t, "2026-10-17", report.Day)
+	assert.Equal(t, now.Format(time.RFC3339), report.GeneratedAt)
+	assert.Equal(t, 70.0, report.EstimatedCredits)
+	assert.Equal(t, 73.0, report.ObservedCredits)
+	assert.Equal(t, 1, report.Alerts)
+	require.Len(t, report.Entries, 4)
+
+	byAccount := map[string]ReconciliationEntry{}
+	for _, entry := range report.Entries {
+		byAccount[entry.Account] = entry
+	}
+	assert.Equal(t, ReconciliationEntry{
+		Account:            "a",
+		AccountingFigures:  syntheticFigures()["a"],
+		ExpectedCredits:    20,
+		DiscrepancyPercent: 50,
+		Factor:             1.5,
+		Alert:              true,
+	}, byAccount["a"])
+	assert.Equal(t, -10.0, byAccount["b"].DiscrepancyPercent)
+	assert.Equal(t, 0.9, byAccount["b"].Factor)
+	assert.False(t, byAccount["b"].Alert)
+
+	assert.Equal(t, -100.0, byAccount["c"].DiscrepancyPercent)
+	assert.Zero(t, byAccount["c"].Factor, "没有观测到消耗时不产生比例")
+	assert.False(t, byAccount["c"].Alert, "请求数少于最小值时不告警")
+
+	assert.Equal(t, 25.0, byAccount["d"].DiscrepancyPercent)
+	assert.False(t, byAccount["d"].Alert, "只有超过阈值才告警")
+}
+
+func TestReconciliationPolicy_NoEstimate(t *testing.T) {
+	report := newTestReconciliationPolicy("").Reconcile("2026-10-17", map[string]auth.AccountingFigures{
+		"idle": {ObservedCredits: 3},
+	}, time.Now())
+	require.Len(t, report.Entries, 1)
+	assert.Zero(t, report.Entries[0].DiscrepancyPercent, "估算为0时无法计算偏差")
+	assert.False(t, report.Entries[0].Alert)
+}
+
+func TestRunReconciliation_AlertWebhook(t *testing.T) {
+	var payload struct {
+		Type         string                `json:"type"`
+		Day          string                `json:"day"`
+		AlertPercent float64               `json:"alert_percent"`
+		Alerts       []ReconciliationEntry `json:"alerts"`
+	}
+	calls := 0
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+	}))
+	defer webhook.Close()
+
+	fake := withFakeTokenAccounting(t, TokenAccountingEstimator)
+	reconciliationPolicy = newTestReconciliationPolicy(webhook.URL)
+	fake.days["2026-10-17"] = syntheticFigures()
+
+	report := runReconciliation("2026-10-17", time.Now())
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "token_reconciliation", payload.Type)
+	assert.Equal(t, "2026-10-17", payload.Day)
+	assert.Equal(t, 25.0, payload.AlertPercent)
+	require.Len(t, payload.Alerts, 1)
+	assert.Equal(t, "a", payload.Alerts[0].Account)
+	assert.Equal(t, 50.0, payload.Alerts[0].DiscrepancyPercent)
+
+	assert.Equal(t, []ReconciliationReport{report}, reconciliationStore.Reports(), "报告写入存储")
+
+	// 没有超出阈值的账号时不发送webhook
+	fake.days["2026-10-16"] = map[string]auth.AccountingFigures{"b": syntheticFigures()["b"]}
+	runReconciliation("2026-10-16", time.Now())
+	assert.Equal(t, 1, calls)
+}
+
+func TestReconciliationStore_FactorAndRetention(t *testing.T) {
+	store := NewReconciliationStore()
+	assert.Equal(t, 1.0, store.Factor("a"), "没有对账结果时比例为1")
+
+	store.Save(ReconciliationReport{Day: "2026-10-16", Entries: []ReconciliationEntry{
+		{Account: "a", Factor: 1.2},
+		{Account: "b", Factor: 0.8},
+	}})
+	store.Save(ReconciliationReport{Day: "2026-10-17", Entries: []ReconciliationEntry{
+		{Account: "a", Factor: 1.5},
+		{Account: "b"}, // 当天没有观测到消耗
+	}})
+	// 补生成更早日期的报告不覆盖较新的比例
+	store.Save(ReconciliationReport{Day: "2026-10-01", Entries: []ReconciliationEntry{{Account: "a", Factor: 3}}})
+
+	assert.Equal(t, 1.5, store.Factor("a"))
+	assert.Equal(t, 0.8, store.Factor("b"), "沿用最近一份有比例的报告")
+
+	base := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 40 {
+		store.Save(ReconciliationReport{Day: base.AddDate(0, 0, i).Format("2006-01-02")})
+	}
+	reports := store.Reports()
+	require.Len(t, reports, 30)
+	assert.Equal(t, "2026-12-10", reports[0].Day, "按日期从新到旧")
+	assert.Equal(t, "2026-11-11", reports[29].Day)
+	assert.Equal(t, 1.0, store.Factor("a"), "报告淘汰后比例一并失效")
+}
+
+func TestOutputTokenFactor(t *testing.T) {
+	withFakeTokenAccounting(t, TokenAccountingEstimator)
+	reconciliationStore.Save(ReconciliationReport{Day: "2026-10-17", Entries: []ReconciliationEntry{{Account: "account-a", Factor: 1.5}}})
+	token := types.TokenInfo{AccessToken: "access"}
+
+	assert.Equal(t, 1.0, outputTokenFactor(token), "estimator模式不换算")
+
+	tokenAccountingSource = TokenAccountingReconciled
+	assert.Equal(t, 1.5, outputTokenFactor(token))
+	assert.Equal(t, 1.0, outputTokenFactor(types.TokenInfo{AccessToken: "unknown"}))
+
+	assert.Equal(t, 15, scaleOutputTokens(10, 1.5))
+	assert.Equal(t, 1, scaleOutputTokens(1, 0.1), "估算值为正时至少为1")
+	assert.Zero(t, scaleOutputTokens(0, 1.5))
+}
+
+func TestNewTokenAccountingSourceFromEnv(t *testing.T) {
+	t.Setenv("TOKEN_ACCOUNTING_SOURCE", "")
+	assert.Equal(t, TokenAccountingEstimator, NewTokenAccountingSourceFromEnv())
+	t.Setenv("TOKEN_ACCOUNTING_SOURCE", " Reconciled ")
+	assert.Equal(t, TokenAccountingReconciled, NewTokenAccountingSourceFromEnv())
+	t.Setenv("TOKEN_ACCOUNTING_SOURCE", "upstream")
+	assert.Equal(t, TokenAccountingEstimator, NewTokenAccountingSourceFromEnv())
+}
+
+func TestNonStream_ReconciledUsage(t *testing.T) {
+	newTextDeltaUpstream(t, "Hello world, this is a reply")
+	fake := withFakeTokenAccounting(t, TokenAccountingReconciled)
+	reconciliationStore.Save(ReconciliationReport{Day: "2026-10-17", Entries: []ReconciliationEntry{{Account: "account-a", Factor: 2}}})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	handleNonStreamRequest(newRequestScope(c, newStopTestRequest(false), &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "access"}}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, fake.recorded, 1)
+	recorded := fake.recorded[0]
+	assert.Equal(t, "account-a", recorded.account)
+	assert.Positive(t, recorded.outputTokens)
+	assert.Equal(t, resp.Usage.InputTokens, recorded.inputTokens)
+	assert.Equal(t, recorded.outputTokens*2, resp.Usage.OutputTokens, "下发值按对账比例换算，对账统计记录估算值")
+}
+
+func TestOpenAINonStream_ReconciledUsage(t *testing.T) {
+	newTextDeltaUpstream(t, "Hello world, this is a reply")
+	fake := withFakeTokenAccounting(t, TokenAccountingReconciled)
+	reconciliationStore.Save(ReconciliationReport{Day: "2026-10-17", Entries: []ReconciliationEntry{{Account: "account-a", Factor: 2}}})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	handleOpenAINonStreamRequest(newRequestScope(c, newStopTestRequest(false), &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "access"}}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Usage types.Usage `json:"usage"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, fake.recorded, 1)
+	recorded := fake.recorded[0]
+	assert.Positive(t, recorded.outputTokens)
+	assert.Equal(t, recorded.inputTokens, resp.Usage.PromptTokens, "usage是估算token数而不是字符数")
+	assert.Equal(t, recorded.outputTokens*2, resp.Usage.CompletionTokens, "下发值按对账比例换算，对账统计记录估算值")
+}
+
+func TestStream_ReconciledUsageRecordedOnce(t *testing.T) {
+	newTextDeltaUpstream(t, "Hello world, ", "this is a reply")
+	fake := withFakeTokenAccounting(t, TokenAccountingReconciled)
+	reconciliationStore.Save(ReconciliationReport{Day: "2026-10-17", Entries: []ReconciliationEntry{{Account: "account-a", Factor: 2}}})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	handleStreamRequest(newRequestScope(c, newStopTestRequest(true), &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "access"}}))
+
+	finalOutput := -1
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var event struct {
+			Type  string `json:"type"`
+			Usage struct {
+				OutputTokens int `json:"output_tokens"`
+			} `json:"usage"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(data), &event))
+		if event.Type == "message_delta" {
+			finalOutput = event.Usage.OutputTokens
+		}
+	}
+
+	require.Len(t, fake.recorded, 1, "每个流只记录一次")
+	assert.Positive(t, fake.recorded[0].outputTokens)
+	assert.Equal(t, fake.recorded[0].outputTokens*2, finalOutput)
+}
+
+func TestHandleReconciliationReports(t *testing.T) {
+	fake := withFakeTokenAccounting(t, TokenAccountingReconciled)
+	fake.days["2026-10-17"] = syntheticFigures()
+	runReconciliation("2026-10-17", time.Now())
+	// 当天的数据尚未生成报告，可通过day参数即时计算
+	fake.days["2026-10-18"] = map[string]auth.AccountingFigures{"a": syntheticFigures()["a"]}
+
+	router := gin.New()
+	router.GET("/api/reports/reconciliation", handleReconciliationReports)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := get("/api/reports/reconciliation")
+	require.Equal(t, http.StatusOK, w.Code)
+	var stored struct {
+		Source  string                 `json:"source"`
+		Reports []ReconciliationReport `json:"reports"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stored))
+	assert.Equal(t, TokenAccountingReconciled, stored.Source)
+	require.Len(t, stored.Reports, 1)
+	assert.Equal(t, "2026-10-17", stored.Reports[0].Day)
+	assert.Equal(t, 1, stored.Reports[0].Alerts)
+
+	w = get("/api/reports/reconciliation?day=2026-10-18")
+	require.Equal(t, http.StatusOK, w.Code)
+	var onDemand ReconciliationReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &onDemand))
+	assert.Equal(t, "2026-10-18", onDemand.Day)
+	assert.Equal(t, 20.0, onDemand.EstimatedCredits)
+	assert.Len(t, reconciliationStore.Reports(), 1, "即时计算的报告不保存")
+
+	assert.Equal(t, http.StatusBadRequest, get("/api/reports/reconciliation?day=yesterday").Code)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"strings"
+
+	"kiro2api/parser"
+)
+
+// defaultRefusalMessage 上游未给出说明时使用的拒绝文本
+const defaultRefusalMessage = "The model declined to respond to this request."
+
+// refusalMarkers 上游异常类型/原因中表示内容安全拦截的关键字（小写匹配）
+var refusalMarkers = []string{
+	"contentpolicy",
+	"content_policy",
+	"guardrail",
+	"safety",
+	"sensitive_content",
+}
+
+// refusalFromEvent 检查解析器产生的error/exception事件是否为上游的拒绝/安全拦截
+// 命中时返回拒绝说明文本
+func refusalFromEvent(dataMap map[string]any) (string, bool) {
+	var kind, message string
+	switch dataMap["type"] {
+	case "exception":
+		kind, _ = dataMap["exception_type"].(string)
+		message, _ = dataMap["exception_message"].(string)
+	case "error":
+		kind, _ = dataMap["error_code"].(string)
+		message, _ = dataMap["error_message"].(string)
+	default:
+		return "", false
+	}
+
+	// 部分异常把具体原因放在reason字段
+	if raw, ok := dataMap["raw_data"].(map[string]any); ok {
+		if reason, ok := raw["reason"].(string); ok {
+			kind += " " + reason
+		}
+	}
+
+	kind = strings.ToLower(kind)
+	for _, marker := range refusalMarkers {
+		if strings.Contains(kind, marker) {
+			if message == "" {
+				message = defaultRefusalMessage
+			}
+			return message, true
+		}
+	}
+	return "", false
+}
+
+// findRefusal 在完整解析结果中查找拒绝事件（非流式）
+func findRefusal(events []parser.SSEEvent) (string, bool) {
+	for _, event := range events {
+		if dataMap, ok := event.Data.(map[string]any); ok {
+			if message, refused := refusalFromEvent(dataMap); refused {
+				return message, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeTestEventStreamFrameWithHeaders 构造带字符串头部的AWS事件流帧
+func encodeTestEventStreamFrameWithHeaders(headers [][2]string, payload string) []byte {
+	var headerBytes []byte
+	for _, h := range headers {
+		headerBytes = append(headerBytes, byte(len(h[0])))
+		headerBytes = append(headerBytes, h[0]...)
+		headerBytes = append(headerBytes, 7) // string类型
+		headerBytes = binary.BigEndian.AppendUint16(headerBytes, uint16(len(h[1])))
+		headerBytes = append(headerBytes, h[1]...)
+	}
+
+	totalLength := 16 + len(headerBytes) + len(payload)
+	frame := make([]byte, totalLength)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(totalLength))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(headerBytes)))
+	copy(frame[12:], headerBytes)
+	copy(frame[12+len(headerBytes):], payload)
+	return frame
+}
+
+const testRefusalPayload = `{"__type":"com.amazon.aws.codewhisperer#ContentPolicyViolationException","message":"Request blocked by content policy"}`
+
+// newRefusalUpstream 创建先输出部分文本、再返回安全拦截异常的假上游
+func newRefusalUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"I can"}`))
+		_, _ = w.Write(encodeTestEventStreamFrameWithHeaders([][2]string{
+			{":message-type", "exception"},
+			{":exception-type", "ContentPolicyViolationException"},
+		}, testRefusalPayload))
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"not"}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+}
+
+func TestRefusalFromEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]any
+		want    string
+		refused bool
+	}{
+		{
+			name:    "内容策略异常",
+			data:    map[string]any{"type": "exception", "exception_type": "ContentPolicyViolationException", "exception_message": "blocked"},
+			want:    "blocked",
+			refused: true,
+		},
+		{
+			name:    "reason字段中的安全拦截",
+			data:    map[string]any{"type": "error", "error_code": "ValidationException", "raw_data": map[string]any{"reason": "GUARDRAIL_INTERVENED"}},
+			want:    defaultRefusalMessage,
+			refused: true,
+		},
+		{
+			name: "内容长度超限不是拒绝",
+			data: map[string]any{"type": "exception", "exception_type": "ContentLengthExceededException"},
+		},
+		{
+			name: "普通文本事件",
+			data: map[string]any{"type": "content_block_delta"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, refused := refusalFromEvent(tt.data)
+			assert.Equal(t, tt.refused, refused)
+			assert.Equal(t, tt.want, message)
+		})
+	}
+}
+
+func TestOpenAINonStream_Refusal(t *testing.T) {
+	newRefusalUpstream(t)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	handleOpenAINonStreamRequest(newTestScope(c, newStopTestRequest(false)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp types.OpenAIResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Choices, 1)
+	assert.Equal(t, "content_filter", resp.Choices[0].FinishReason)
+	assert.Equal(t, "Request blocked by content policy", resp.Choices[0].Message.Refusal)
+	assert.Empty(t, resp.Choices[0].Message.ToolCalls)
+}
+
+func TestOpenAIStream_Refusal(t *testing.T) {
+	newRefusalUpstream(t)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	handleOpenAIStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+	var refusal strings.Builder
+	var content strings.Builder
+	var finishReasons []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+					Refusal string `json:"refusal"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		for _, choice := range chunk.Choices {
+			content.WriteString(choice.Delta.Content)
+			refusal.WriteString(choice.Delta.Refusal)
+			if choice.FinishReason != nil {
+				finishReasons = append(finishReasons, *choice.FinishReason)
+			}
+		}
+	}
+
+	assert.Equal(t, "I can", content.String(), "拒绝之后的上游内容不应下发")
+	assert.Equal(t, "Request blocked by content policy", refusal.String())
+	assert.Equal(t, []string{"content_filter"}, finishReasons)
+	assert.Contains(t, w.Body.String(), "data: [DONE]")
+}
+
+func TestAnthropicNonStream_Refusal(t *testing.T) {
+	newRefusalUpstream(t)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	handleNonStreamRequest(newTestScope(c, newStopTestRequest(false)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "refusal", resp["stop_reason"])
+	assert.NotContains(t, resp, "refusal", "Anthropic响应中不应出现OpenAI字段")
+}
+
+func TestAnthropicStream_Refusal(t *testing.T) {
+	newRefusalUpstream(t)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+	body := w.Body.String()
+	assert.Contains(t, body, `"stop_reason":"refusal"`)
+	assert.Equal(t, 1, strings.Count(body, "event: message_stop"))
+	assert.Equal(t, 1, strings.Count(body, "event: message_delta"))
+	assert.NotContains(t, body, "ContentPolicyViolationException", "原始异常不应直接转发")
+}
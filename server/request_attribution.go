@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上游请求归属header
+// 值均为确定性的非敏感信息，便于向上游排查问题时对应到具体请求
+const (
+	HeaderInvocationID = "amz-sdk-invocation-id" // 取值为request_id
+	HeaderInstance     = "x-kiro2api-instance"   // 取值为实例名（KIRO2API_INSTANCE_NAME，默认主机名）
+)
+
+// RequestAttribution 单个请求发往上游时的归属信息
+type RequestAttribution struct {
+	RequestID   string            `json:"request_id"`
+	Path        string            `json:"path"`
+	Model       string            `json:"model"`
+	Stream      bool              `json:"stream"`
+	Token       string            `json:"token"` // access token指纹，不含原文
+	Headers     map[string]string `json:"headers"`
+	StartedAt   time.Time         `json:"started_at"`
+	RespondedAt *time.Time        `json:"responded_at,omitempty"`
+	StatusCode  int               `json:"status_code,omitempty"`
+	Status      string            `json:"status"` // pending, success, error
+	Error       string            `json:"error,omitempty"`
+}
+
+// RequestIndex 最近N个请求归属信息的内存索引
+type RequestIndex struct {
+	mutex   sync.RWMutex
+	entries map[string]*RequestAttribution
+	order   []string // 按写入顺序排列的request_id，用于淘汰最旧记录
+	size    int
+}
+
+// NewRequestIndex 创建容量为size的请求索引
+func NewRequestIndex(size int) *RequestIndex {
+	if size <= 0 {
+		size = config.RequestIndexSize
+	}
+	return &RequestIndex{
+		entries: make(map[string]*RequestAttribution),
+		size:    size,
+	}
+}
+
+// requestIndex 全局请求归属索引
+var requestIndex = NewRequestIndex(config.RequestIndexSize)
+
+// Record 写入一条记录，超出容量时淘汰最旧的记录
+func (ri *RequestIndex) Record(entry RequestAttribution) {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	if _, exists := ri.entries[entry.RequestID]; !exists {
+		ri.order = append(ri.order, entry.RequestID)
+		if len(ri.order) > ri.size {
+			delete(ri.entries, ri.order[0])
+			ri.order = ri.order[1:]
+		}
+	}
+	ri.entries[entry.RequestID] = &entry
+}
+
+// Complete 记录上游响应结果
+func (ri *RequestIndex) Complete(requestID string, statusCode int, err error) {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	entry, exists := ri.entries[requestID]
+	if !exists {
+		return
+	}
+
+	now := time.Now()
+	entry.RespondedAt = &now
+	entry.StatusCode = statusCode
+	if err == nil && statusCode == http.StatusOK {
+		entry.Status = "success"
+		return
+	}
+	entry.Status = "error"
+	if err != nil {
+		entry.Error = err.Error()
+	}
+}
+
+// Get 按request_id查询记录
+func (ri *RequestIndex) Get(requestID string) (RequestAttribution, bool) {
+	ri.mutex.RLock()
+	defer ri.mutex.RUnlock()
+
+	entry, exists := ri.entries[requestID]
+	if !exists {
+		return RequestAttribution{}, false
+	}
+	result := *entry
+	return result, true
+}
+
+// instanceName 返回当前实例名，未配置时使用主机名
+func instanceName() string {
+	if name := strings.TrimSpace(os.Getenv("KIRO2API_INSTANCE_NAME")); name != "" {
+		return name
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "kiro2api"
+}
+
+// tokenFingerprint 返回access token的短指纹，用于区分账号而不泄露token
+func tokenFingerprint(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:6])
+}
+
+// attributeUpstreamRequest 为上游请求设置归属header，并记录实际发送的值
+func attributeUpstreamRequest(c *gin.Context, req *http.Request, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) {
+	requestID := GetRequestID(c)
+	if requestID == "" {
+		requestID = "req_" + utils.GenerateUUID()
+		c.Set("request_id", requestID)
+	}
+
+	req.Header.Set(HeaderInvocationID, requestID)
+	req.Header.Set(HeaderInstance, instanceName())
+
+	// 从请求中读回，保证记录的就是实际发送的值
+	headers := map[string]string{
+		HeaderInvocationID: req.Header.Get(HeaderInvocationID),
+		HeaderInstance:     req.Header.Get(HeaderInstance),
+	}
+
+	entry := RequestAttribution{
+		RequestID: requestID,
+		Model:     anthropicReq.Model,
+		Stream:    isStream,
+		Token:     tokenFingerprint(tokenInfo.AccessToken),
+		Headers:   headers,
+		StartedAt: time.Now(),
+		Status:    "pending",
+	}
+	if c.Request != nil {
+		entry.Path = c.Request.URL.Path
+	}
+	requestIndex.Record(entry)
+
+	logger.Info("上游请求归属",
+		addReqFields(c,
+			logger.String("direction", "upstream_request"),
+			logger.String(HeaderInvocationID, headers[HeaderInvocationID]),
+			logger.String(HeaderInstance, headers[HeaderInstance]),
+			logger.String("token", entry.Token),
+		)...)
+}
+
+// handleGetRequestAttribution 查询请求的归属信息
+// GET /api/requests/:request_id
+func handleGetRequestAttribution(c *gin.Context) {
+	entry, exists := requestIndex.Get(c.Param("request_id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "请求记录不存在或已被淘汰"})
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecuteCodeWhispererRequest_AttributionHeaders(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	t.Setenv("KIRO2API_INSTANCE_NAME", "test-instance")
+
+	original := requestIndex
+	requestIndex = NewRequestIndex(10)
+	t.Cleanup(func() { requestIndex = original })
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	c.Set("request_id", "req_attribution_1")
+
+	resp, err := executeCodeWhispererRequest(newTestScope(c, newStopTestRequest(false)))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "req_attribution_1", received.Get(HeaderInvocationID))
+	assert.Equal(t, "test-instance", received.Get(HeaderInstance))
+
+	// 通过API按request_id查询，记录的值应与实际发送的一致
+	router := gin.New()
+	router.GET("/api/requests/:request_id", handleGetRequestAttribution)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/requests/req_attribution_1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var entry RequestAttribution
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entry))
+	assert.Equal(t, "req_attribution_1", entry.RequestID)
+	assert.Equal(t, "/v1/messages", entry.Path)
+	assert.Equal(t, received.Get(HeaderInvocationID), entry.Headers[HeaderInvocationID])
+	assert.Equal(t, received.Get(HeaderInstance), entry.Headers[HeaderInstance])
+	assert.Equal(t, tokenFingerprint("mock-access-token"), entry.Token)
+	assert.NotContains(t, w.Body.String(), "mock-access-token")
+	assert.Equal(t, "success", entry.Status)
+	assert.Equal(t, http.StatusOK, entry.StatusCode)
+	require.NotNil(t, entry.RespondedAt)
+}
+
+func TestHandleGetRequestAttribution_NotFound(t *testing.T) {
+	router := gin.New()
+	router.GET("/api/requests/:request_id", handleGetRequestAttribution)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/requests/req_missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRequestIndex_EvictsOldest(t *testing.T) {
+	index := NewRequestIndex(3)
+	for i := 0; i < 5; i++ {
+		index.Record(RequestAttribution{RequestID: fmt.Sprintf("req_%d", i), Status: "pending"})
+	}
+
+	_, exists := index.Get("req_1")
+	assert.False(t, exists)
+	for i := 2; i < 5; i++ {
+		_, exists := index.Get(fmt.Sprintf("req_%d", i))
+		assert.True(t, exists)
+	}
+
+	index.Complete("req_4", http.StatusTooManyRequests, nil)
+	entry, _ := index.Get("req_4")
+	assert.Equal(t, "error", entry.Status)
+	assert.Equal(t, http.StatusTooManyRequests, entry.StatusCode)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// simplifiedToolKeys 简化工具格式的字段，按此顺序输出
+var simplifiedToolKeys = []string{"name", "description", "input_schema"}
+
+// normalizeAnthropicRequestBody 标准化请求体中的工具定义
+// 只在确有工具需要转换时重写tools数组，其余字段（包括结构体未定义的字段）与未转换的工具保持原始字节不变
+func normalizeAnthropicRequestBody(body []byte) ([]byte, error) {
+	start, end, err := findTopLevelValue(body, "tools")
+	if err != nil || start < 0 {
+		return body, err
+	}
+
+	tools, changed := normalizeTools(body[start:end])
+	if !changed {
+		return body, nil
+	}
+
+	normalized := make([]byte, 0, len(body)-(end-start)+len(tools))
+	normalized = append(normalized, body[:start]...)
+	normalized = append(normalized, tools...)
+	normalized = append(normalized, body[end:]...)
+	return normalized, nil
+}
+
+// normalizeTools 标准化tools数组，返回新的数组JSON及是否有改动
+// - 同时包含name、description、input_schema的工具只保留这三个字段
+// - 非对象的条目被丢弃
+// - 其余工具保持原样
+func normalizeTools(raw []byte) ([]byte, bool) {
+	var items []json.RawMessage
+	if err := utils.SafeUnmarshal(raw, &items); err != nil {
+		return raw, false // 不是数组，保持原样
+	}
+
+	changed := false
+	kept := make([][]byte, 0, len(items))
+	for _, item := range items {
+		var fields map[string]json.RawMessage
+		if err := utils.SafeUnmarshal(item, &fields); err != nil || fields == nil {
+			changed = true
+			continue
+		}
+
+		if rewritten, ok := rewriteSimplifiedTool(fields); ok {
+			kept = append(kept, rewritten)
+			changed = true
+			continue
+		}
+		kept = append(kept, item)
+	}
+
+	if !changed {
+		return raw, false
+	}
+	return append(append([]byte{'['}, bytes.Join(kept, []byte{','})...), ']'), true
+}
+
+// rewriteSimplifiedTool 简化格式且含有多余字段的工具只保留标准字段；无需改动时返回false
+func rewriteSimplifiedTool(fields map[string]json.RawMessage) ([]byte, bool) {
+	for _, key := range simplifiedToolKeys {
+		if _, exists := fields[key]; !exists {
+			return nil, false
+		}
+	}
+	if len(fields) == len(simplifiedToolKeys) {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range simplifiedToolKeys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(fields[key])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), true
+}
+
+// findTopLevelValue 返回顶层JSON对象中指定字段值的字节范围，字段不存在时start为-1
+// 字段重复时与JSON解析一致，取最后一次出现的值
+func findTopLevelValue(body []byte, key string) (int, int, error) {
+	start, end := -1, -1
+	err := types.ScanTopLevelFields(body, func(name string, valueStart, valueEnd int) {
+		if name == key {
+			start, end = valueStart, valueEnd
+		}
+	})
+	if err != nil {
+		return -1, -1, err
+	}
+	return start, end, nil
+}
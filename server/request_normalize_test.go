@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"kiro2api/converter"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unknownFieldsBody 含有多个AnthropicRequest未定义字段的请求，字段顺序和空白刻意保持非规范形式
+const unknownFieldsBody = `{"model":"claude-sonnet-4-20250514",  "max_tokens":1024,
+	"thinking":{"type":"enabled","budget_tokens":2048},
+	"context_management":{"edits":[{"type":"clear_tool_uses_20250919"}]},
+	"service_tier":"auto",
+	"metadata":{"user_id":"u-1"},
+	"tool_choice":{"type":"auto"},
+	"tools":[{"name":"get_weather","description":"Get weather","input_schema":{"type":"object","properties":{}}}],
+	"messages":[{"role":"user","content":"hello"}],
+	"big_number":12345678901234567890}`
+
+func TestNormalizeAnthropicRequestBody_PreservesBodyWhenToolsUnchanged(t *testing.T) {
+	normalized, err := normalizeAnthropicRequestBody([]byte(unknownFieldsBody))
+	require.NoError(t, err)
+	assert.Equal(t, unknownFieldsBody, string(normalized), "无需转换时请求体应逐字节保持不变")
+
+	normalized, err = normalizeAnthropicRequestBody([]byte(`{"messages":[]}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"messages":[]}`, string(normalized))
+}
+
+func TestNormalizeAnthropicRequestBody_RewritesOnlyTools(t *testing.T) {
+	tools := `[{"name":"a","description":"A","input_schema":{"type":"object"},"cache_control":{"type":"ephemeral"}}, "bogus", {"type":"web_search_20250305","name":"web_search","max_uses":5}]`
+	body := strings.Replace(unknownFieldsBody,
+		`[{"name":"get_weather","description":"Get weather","input_schema":{"type":"object","properties":{}}}]`, tools, 1)
+
+	normalized, err := normalizeAnthropicRequestBody([]byte(body))
+	require.NoError(t, err)
+
+	expectedTools := `[{"name":"a","description":"A","input_schema":{"type":"object"}},{"type":"web_search_20250305","name":"web_search","max_uses":5}]`
+	assert.Equal(t, strings.Replace(body, tools, expectedTools, 1), string(normalized), "tools之外的字节应保持不变")
+}
+
+func TestNormalizeAnthropicRequestBody_Invalid(t *testing.T) {
+	for _, body := range []string{``, `[]`, `"text"`, `{"tools":`} {
+		_, err := normalizeAnthropicRequestBody([]byte(body))
+		assert.Error(t, err, body)
+	}
+}
+
+func TestAnthropicRequest_UnknownFieldsSurviveNormalization(t *testing.T) {
+	normalized, err := normalizeAnthropicRequestBody([]byte(unknownFieldsBody))
+	require.NoError(t, err)
+
+	var req types.AnthropicRequest
+	require.NoError(t, utils.SafeUnmarshal(normalized, &req))
+
+	// 未定义字段按原始JSON保留
+	require.Len(t, req.Extra, 4)
+	assert.JSONEq(t, `{"type":"enabled","budget_tokens":2048}`, string(req.Extra["thinking"]))
+	assert.JSONEq(t, `{"edits":[{"type":"clear_tool_uses_20250919"}]}`, string(req.Extra["context_management"]))
+	assert.Equal(t, `"auto"`, string(req.Extra["service_tier"]))
+	assert.Equal(t, `12345678901234567890`, string(req.Extra["big_number"]), "大整数不应因经过float64而丢失精度")
+
+	// 已定义字段照常解析
+	assert.Equal(t, map[string]any{"user_id": "u-1"}, req.Metadata)
+	assert.Equal(t, map[string]any{"type": "auto"}, req.ToolChoice)
+	require.Len(t, req.Tools, 1)
+
+	// 再次序列化时写回未定义字段
+	data, err := utils.SafeMarshal(req)
+	require.NoError(t, err)
+	var roundTrip map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &roundTrip))
+	for name, value := range req.Extra {
+		assert.JSONEq(t, string(value), string(roundTrip[name]), name)
+	}
+}
+
+func TestAnthropicRequest_UnknownFieldsDoNotChangeUpstreamRequest(t *testing.T) {
+	normalized, err := normalizeAnthropicRequestBody([]byte(unknownFieldsBody))
+	require.NoError(t, err)
+	var withUnknown types.AnthropicRequest
+	require.NoError(t, utils.SafeUnmarshal(normalized, &withUnknown))
+
+	// 对照组：去掉未定义字段、不经过标准化直接解析
+	var plain types.AnthropicRequest
+	require.NoError(t, utils.SafeUnmarshal([]byte(`{"model":"claude-sonnet-4-20250514","max_tokens":1024,
+		"metadata":{"user_id":"u-1"},"tool_choice":{"type":"auto"},
+		"tools":[{"name":"get_weather","description":"Get weather","input_schema":{"type":"object","properties":{}}}],
+		"messages":[{"role":"user","content":"hello"}]}`), &plain))
+	assert.Empty(t, plain.Extra)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	expected, err := converter.BuildCodeWhispererRequest(plain, c)
+	require.NoError(t, err)
+	actual, err := converter.BuildCodeWhispererRequest(withUnknown, c)
+	require.NoError(t, err)
+
+	expectedJSON, _ := utils.SafeMarshal(expected)
+	actualJSON, _ := utils.SafeMarshal(actual)
+	assert.JSONEq(t, string(expectedJSON), string(actualJSON))
+}
+
+// largeRequestSize 大请求体基准的目标大小（长对话的Claude Code请求可达数MB）
+const largeRequestSize = 5 << 20
+
+// largeAnthropicRequestBody 生成不小于size字节的请求体：多轮对话（含工具调用与结果）、
+// 需要标准化的工具定义，以及结构体未定义的顶层字段
+func largeAnthropicRequestBody(tb testing.TB, size int) []byte {
+	tb.Helper()
+	text := strings.Repeat(`代码片段 func main() { fmt.Println("hello {world} [1,2]") } \ 路径 C:\tmp `, 20)
+	var messages []map[string]any
+	for length := 0; length < size; {
+		i := len(messages)
+		messages = append(messages,
+			map[string]any{"role": "user", "content": []map[string]any{
+				{"type": "text", "text": fmt.Sprintf("第%d轮：%s", i, text)},
+				{"type": "tool_result", "tool_use_id": fmt.Sprintf("toolu_%d", i), "content": text},
+			}},
+			map[string]any{"role": "assistant", "content": []map[string]any{
+				{"type": "text", "text": text},
+				{"type": "tool_use", "id": fmt.Sprintf("toolu_%d", i+1), "name": "read_file",
+					"input": map[string]any{"path": "/src/main.go", "limit": 200, "nested": []any{1.5, true, nil}}},
+			}},
+		)
+		length += 4 * len(text)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"model":      "claude-sonnet-4-20250514",
+		"max_tokens": 8192,
+		"stream":     true,
+		"system":     []map[string]any{{"type": "text", "text": "You are a coding assistant."}},
+		"messages":   messages,
+		"tools": []map[string]any{
+			{"name": "read_file", "description": "Read a file", "input_schema": map[string]any{"type": "object"},
+				"cache_control": map[string]any{"type": "ephemeral"}},
+			{"name": "write_file", "description": "Write a file", "input_schema": map[string]any{"type": "object"}},
+		},
+		"thinking":   map[string]any{"type": "enabled", "budget_tokens": 2048},
+		"big_number": json.Number("12345678901234567890"),
+	})
+	require.NoError(tb, err)
+	return body
+}
+
+// differentialRequestBodies 快速路径与原实现对比的请求体，覆盖转义、嵌套括号和重复字段
+func differentialRequestBodies(tb testing.TB) map[string][]byte {
+	return map[string][]byte{
+		"large":          largeAnthropicRequestBody(tb, 256<<10),
+		"unknown_fields": []byte(unknownFieldsBody),
+		"escaped_key":    []byte(`{"model":"m","messages":[],"\u0074ools":[{"name":"a","description":"A","input_schema":{},"x":1}]}`),
+		"duplicate_tools": []byte(`{"model":"m","messages":[],"tools":[],` +
+			`"tools":[{"name":"a","description":"A","input_schema":{},"x":1}]}`),
+		"brackets_in_strings": []byte(` { "messages" : [{"role":"user","content":"}]\"{["}] ,` +
+			`"system":[{"type":"text","text":"\\\"}"}], "stop_sequences":["]"],"temperature":0.5 } `),
+		"empty": []byte(`{}`),
+	}
+}
+
+// legacyFindTopLevelValue 原实现：用encoding/json的Decoder逐个解码顶层字段
+func legacyFindTopLevelValue(body []byte, key string) (int, int, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	token, err := dec.Token()
+	if err != nil {
+		return -1, -1, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return -1, -1, errors.New("请求体必须是JSON对象")
+	}
+	start, end := -1, -1
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return -1, -1, err
+		}
+		name, _ := token.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return -1, -1, err
+		}
+		if name == key {
+			end = int(dec.InputOffset())
+			start = end - len(value)
+		}
+	}
+	if _, err := dec.Token(); err != nil && err != io.EOF {
+		return -1, -1, err
+	}
+	return start, end, nil
+}
+
+// legacyParseAnthropicRequest 原实现：Decoder定位tools，encoding/json解析两遍（结构体和全部顶层字段）
+func legacyParseAnthropicRequest(body []byte) (types.AnthropicRequest, error) {
+	start, end, err := legacyFindTopLevelValue(body, "tools")
+	if err != nil {
+		return types.AnthropicRequest{}, err
+	}
+	if start >= 0 {
+		if tools, changed := normalizeTools(body[start:end]); changed {
+			body = append(append(append([]byte{}, body[:start]...), tools...), body[end:]...)
+		}
+	}
+
+	type plain types.AnthropicRequest
+	var decoded plain
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return types.AnthropicRequest{}, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return types.AnthropicRequest{}, err
+	}
+	known := make(map[string]bool)
+	requestType := reflect.TypeOf(types.AnthropicRequest{})
+	for i := 0; i < requestType.NumField(); i++ {
+		name, _, _ := strings.Cut(requestType.Field(i).Tag.Get("json"), ",")
+		known[name] = true
+	}
+	for name := range fields {
+		if known[name] {
+			delete(fields, name)
+		}
+	}
+	if len(fields) > 0 {
+		decoded.Extra = fields
+	}
+	return types.AnthropicRequest(decoded), nil
+}
+
+// parseAnthropicRequest 与/v1/messages相同的解析路径：标准化工具后解析为结构体
+func parseAnthropicRequest(body []byte) (types.AnthropicRequest, error) {
+	normalized, err := normalizeAnthropicRequestBody(body)
+	if err != nil {
+		return types.AnthropicRequest{}, err
+	}
+	var req types.AnthropicRequest
+	err = utils.SafeUnmarshal(normalized, &req)
+	return req, err
+}
+
+func TestParseAnthropicRequest_MatchesLegacyImplementation(t *testing.T) {
+	for name, body := range differentialRequestBodies(t) {
+		start, end, err := findTopLevelValue(body, "tools")
+		require.NoError(t, err, name)
+		legacyStart, legacyEnd, err := legacyFindTopLevelValue(body, "tools")
+		require.NoError(t, err, name)
+		assert.Equal(t, [2]int{legacyStart, legacyEnd}, [2]int{start, end}, name)
+
+		expected, err := legacyParseAnthropicRequest(body)
+		require.NoError(t, err, name)
+		actual, err := parseAnthropicRequest(body)
+		require.NoError(t, err, name)
+		assert.True(t, reflect.DeepEqual(expected, actual), "%s: 解析结果应与原实现一致", name)
+	}
+}
+
+func TestFindTopLevelValue_InvalidJSON(t *testing.T) {
+	for _, body := range []string{
+		`{"tools"}`, `{"tools":[1,2}`, `{"a":1 "tools":[]}`, `{"a":"unterminated}`,
+		`{"a":1,}`, `{"a":}`, `{"a":1}x`, `{a:1}`,
+	} {
+		_, _, err := findTopLevelValue([]byte(body), "tools")
+		assert.Error(t, err, body)
+	}
+}
+
+func BenchmarkParseAnthropicRequest5MB(b *testing.B) {
+	body := largeAnthropicRequestBody(b, largeRequestSize)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseAnthropicRequest(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseAnthropicRequest5MB_Legacy(b *testing.B) {
+	body := largeAnthropicRequestBody(b, largeRequestSize)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := legacyParseAnthropicRequest(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"time"
+
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestScopeKey gin上下文中保存RequestScope的键
+const requestScopeKey = "request_scope"
+
+// RequestScope 单个请求的处理范围：选定token后创建一次，贯穿流式/非流式处理管线和事件发送
+// 新的按请求功能在这里读写状态，无需再修改各处理函数的签名
+type RequestScope struct {
+	c *gin.Context
+
+	Request   types.AnthropicRequest // 经过标准化、裁剪等处理后实际发送给上游的请求
+	Token     *types.TokenWithUsage  // 选定的token（可能为nil，仅测试中出现）
+	RequestID string
+	MessageID string // 流式请求生成的消息ID，非流式为空
+	Stream    bool   // 按流式管线处理
+
+	// 时间点
+	StartedAt           time.Time // 创建scope（token已选定）
+	UpstreamStartedAt   time.Time // 发出上游请求
+	UpstreamRespondedAt time.Time // 收到上游响应头
+
+	EffectiveParams *EffectiveParams // 请求了有效参数回显时非nil
+
+	// 估算token统计
+	InputTokens              int  // 不含缓存前缀的输入token数
+	CacheCreationInputTokens int  // 估算的提示词缓存写入token数（PROMPT_CACHE_ESTIMATION）
+	CacheReadInputTokens     int  // 估算的提示词缓存读取token数
+	OutputTokens             int  // 已下发内容的估算输出token数（不含未结束工具块）
+	ReportedInputTokens      int  // 上游事件中报告的输入token数，未报告时为0
+	ReportedOutputTokens     int  // 上游事件中报告的输出token数，未报告时为0
+	accountingRecorded       bool // 估算token已计入对账统计
+	tokenReleased            bool // 当前token的进行中计数已释放（请求结束或换用其他token）
+}
+
+// newRequestScope 创建请求范围并保存到gin上下文
+func newRequestScope(c *gin.Context, req types.AnthropicRequest, token *types.TokenWithUsage) *RequestScope {
+	scope := &RequestScope{
+		c:         c,
+		Request:   req,
+		Token:     token,
+		RequestID: GetRequestID(c),
+		StartedAt: time.Now(),
+	}
+	c.Set(requestScopeKey, scope)
+	return scope
+}
+
+// requestScopeFrom 读取请求范围，尚未创建时返回nil
+func requestScopeFrom(c *gin.Context) *RequestScope {
+	if v, ok := c.Get(requestScopeKey); ok {
+		if scope, ok := v.(*RequestScope); ok {
+			return scope
+		}
+	}
+	return nil
+}
+
+// TokenInfo 选定token的信息，未选定时返回零值
+func (s *RequestScope) TokenInfo() types.TokenInfo {
+	if s.Token == nil {
+		return types.TokenInfo{}
+	}
+	return s.Token.TokenInfo
+}
+
+// estimateInputTokens 按实际发送给上游的数据估算输入token数并记录
+// 启用提示词缓存估算时，缓存前缀的token按Anthropic的口径从input_tokens中拆出
+func (s *RequestScope) estimateInputTokens() int {
+	total := utils.NewTokenEstimator().EstimateTokens(&types.CountTokensRequest{
+		Model:    s.Request.Model,
+		System:   s.Request.System,
+		Messages: s.Request.Messages,
+		Tools:    filterSupportedTools(s.Request.Tools), // 过滤不支持的工具后计算
+	})
+	s.CacheCreationInputTokens, s.CacheReadInputTokens = promptCacheEstimator.Estimate(s.Request, total)
+	s.InputTokens = total - s.CacheCreationInputTokens - s.CacheReadInputTokens
+	return s.InputTokens
+}
+
+// totalInputTokens 包含缓存前缀的输入token数（上游没有缓存，实际按全部输入计费）
+func (s *RequestScope) totalInputTokens() int {
+	return s.InputTokens + s.CacheCreationInputTokens + s.CacheReadInputTokens
+}
+
+// anthropicUsage Anthropic格式的usage，outputTokens为下发给客户端的值
+// 启用提示词缓存估算时总是包含缓存token字段（未命中断点时为0），否则保持原有格式
+func (s *RequestScope) anthropicUsage(outputTokens int) map[string]any {
+	usage := map[string]any{
+		"input_tokens":  s.InputTokens,
+		"output_tokens": outputTokens,
+	}
+	if promptCacheEstimator != nil {
+		usage["cache_creation_input_tokens"] = s.CacheCreationInputTokens
+		usage["cache_read_input_tokens"] = s.CacheReadInputTokens
+	}
+	return usage
+}
+
+// recordEstimatedUsage 把本次请求的估算token计入所用账号的对账统计和估算准确度样本，每个请求只记录一次
+func (s *RequestScope) recordEstimatedUsage(outputTokens int) {
+	if s.accountingRecorded || s.Token == nil {
+		return
+	}
+	s.accountingRecorded = true
+	recordEstimatedTokens(s.Token.TokenInfo, s.totalInputTokens(), outputTokens)
+	estimationAccuracy.Record(s.Request.Model, s.totalInputTokens(), outputTokens, s.ReportedInputTokens, s.ReportedOutputTokens)
+}
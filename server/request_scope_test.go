@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newScopeTestContext(path string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", path, nil)
+	c.Set("request_id", "req-scope")
+	return c, w
+}
+
+// assertUpstreamTiming 时间点按请求生命周期顺序记录
+func assertUpstreamTiming(t *testing.T, scope *RequestScope) {
+	t.Helper()
+	require.False(t, scope.UpstreamStartedAt.IsZero())
+	require.False(t, scope.UpstreamRespondedAt.IsZero())
+	assert.False(t, scope.UpstreamStartedAt.Before(scope.StartedAt))
+	assert.False(t, scope.UpstreamRespondedAt.Before(scope.UpstreamStartedAt))
+}
+
+func TestRequestScope_AnthropicStream(t *testing.T) {
+	newTextDeltaUpstream(t, "Hello", " world")
+	c, w := newScopeTestContext("/v1/messages")
+
+	scope := newTestScope(c, newStopTestRequest(true))
+	handleStreamRequest(scope)
+
+	assert.Same(t, scope, requestScopeFrom(c))
+	assert.Equal(t, "req-scope", scope.RequestID)
+	assert.True(t, scope.Stream)
+	require.NotEmpty(t, scope.MessageID)
+	assert.Equal(t, scope.MessageID, GetMessageID(c))
+	assert.Positive(t, scope.InputTokens)
+	assert.Positive(t, scope.OutputTokens)
+	assertUpstreamTiming(t, scope)
+
+	// 下发的事件与scope中的值一致
+	var start, final map[string]any
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var event map[string]any
+		require.NoError(t, json.Unmarshal([]byte(data), &event))
+		switch event["type"] {
+		case "message_start":
+			start = event
+		case "message_delta":
+			final = event
+		}
+	}
+	require.NotNil(t, start)
+	require.NotNil(t, final)
+	message := start["message"].(map[string]any)
+	assert.Equal(t, scope.MessageID, message["id"])
+	assert.Equal(t, float64(scope.InputTokens), message["usage"].(map[string]any)["input_tokens"])
+	assert.Equal(t, float64(scope.OutputTokens), final["usage"].(map[string]any)["output_tokens"])
+}
+
+func TestRequestScope_AnthropicNonStream(t *testing.T) {
+	newTextDeltaUpstream(t, "Hello", " world")
+	c, w := newScopeTestContext("/v1/messages")
+
+	scope := newTestScope(c, newStopTestRequest(false))
+	handleNonStreamRequest(scope)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.False(t, scope.Stream)
+	assert.Empty(t, scope.MessageID)
+	assertUpstreamTiming(t, scope)
+
+	var resp struct {
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, scope.InputTokens, resp.Usage.InputTokens)
+	assert.Equal(t, scope.OutputTokens, resp.Usage.OutputTokens)
+	assert.Positive(t, scope.OutputTokens)
+}
+
+func TestRequestScope_OpenAI(t *testing.T) {
+	newTextDeltaUpstream(t, "Hello", " world")
+
+	c, w := newScopeTestContext("/v1/chat/completions")
+	scope := newTestScope(c, newStopTestRequest(false))
+	handleOpenAINonStreamRequest(scope)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, scope.Stream)
+	assert.Positive(t, scope.InputTokens)
+	assert.Positive(t, scope.OutputTokens)
+	assertUpstreamTiming(t, scope)
+
+	c, w = newScopeTestContext("/v1/chat/completions")
+	scope = newTestScope(c, newStopTestRequest(true))
+	handleOpenAIStreamRequest(scope)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, scope.Stream)
+	require.NotEmpty(t, scope.MessageID)
+	assert.Contains(t, w.Body.String(), `"id":"`+scope.MessageID+`"`)
+	assertUpstreamTiming(t, scope)
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderNormalized 响应头：请求的消息顺序被重新整理时返回，值为改动的种类（逗号分隔）
+const HeaderNormalized = "X-Kiro-Normalized"
+
+// 开头的assistant消息的处理方式
+const (
+	LeadingAssistantPrepend = "prepend" // 在前面插入一条占位user消息（默认）
+	LeadingAssistantSystem  = "system"  // 将其文本并入system提示
+)
+
+// 消息整理的改动种类
+const (
+	normalizeMergedUser        = "merged_user"
+	normalizeMergedAssistant   = "merged_assistant"
+	normalizePrependedUser     = "prepended_user"
+	normalizeFoldedToSystem    = "folded_assistant_to_system"
+	leadingUserPlaceholderText = "(conversation continued)"
+	foldedAssistantSystemTitle = "Earlier assistant message:\n"
+)
+
+// leadingAssistantMode 开头为assistant消息时的处理方式（测试可替换）
+var leadingAssistantMode = LeadingAssistantPrepend
+
+// NewLeadingAssistantModeFromEnv LEADING_ASSISTANT_MODE: prepend（默认）/ system
+func NewLeadingAssistantModeFromEnv() string {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("LEADING_ASSISTANT_MODE")))
+	switch mode {
+	case "":
+		return LeadingAssistantPrepend
+	case LeadingAssistantPrepend, LeadingAssistantSystem:
+		return mode
+	default:
+		logger.Warn("未知的LEADING_ASSISTANT_MODE，使用prepend", logger.String("mode", mode))
+		return LeadingAssistantPrepend
+	}
+}
+
+// normalizeMessageRoles 整理消息的角色交替顺序，返回整理后的请求和改动种类；不修改原请求
+// - 连续的同角色消息合并为一条：都是纯文本时以换行拼接，否则拼接内容块
+// - 以assistant消息开头时按mode插入占位user消息，或将其文本并入system（含非文本块或没有后续消息时仍插入占位消息）
+// - 校验每条含tool_result的user消息紧跟在包含对应tool_use的assistant消息之后
+// 消息中出现user/assistant以外的角色时（如未转换的OpenAI system/tool消息）不做整理
+func normalizeMessageRoles(req types.AnthropicRequest, mode string) (types.AnthropicRequest, []string, error) {
+	for _, msg := range req.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return req, nil, nil
+		}
+	}
+
+	var changes []string
+	addChange := func(change string) {
+		for _, existing := range changes {
+			if existing == change {
+				return
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	messages := make([]types.AnthropicRequestMessage, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		if n := len(messages); n > 0 && messages[n-1].Role == msg.Role {
+			messages[n-1].Content = mergeMessageContent(messages[n-1].Content, msg.Content)
+			if msg.Role == "user" {
+				addChange(normalizeMergedUser)
+			} else {
+				addChange(normalizeMergedAssistant)
+			}
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	normalized := req
+	if len(messages) > 0 && messages[0].Role == "assistant" {
+		text, textOnly := messageText(messages[0].Content)
+		// 只有这一条消息时无法并入system，仍插入占位消息
+		if mode == LeadingAssistantSystem && textOnly && len(messages) > 1 {
+			system := make([]types.AnthropicSystemMessage, 0, len(req.System)+1)
+			system = append(system, req.System...)
+			if strings.TrimSpace(text) != "" {
+				system = append(system, types.AnthropicSystemMessage{Type: "text", Text: foldedAssistantSystemTitle + text})
+			}
+			normalized.System = system
+			messages = messages[1:]
+			addChange(normalizeFoldedToSystem)
+		} else {
+			messages = append([]types.AnthropicRequestMessage{{Role: "user", Content: leadingUserPlaceholderText}}, messages...)
+			addChange(normalizePrependedUser)
+		}
+	}
+
+	if err := validateToolResultOrder(messages); err != nil {
+		return req, nil, err
+	}
+
+	if len(changes) == 0 {
+		return req, nil, nil
+	}
+	normalized.Messages = messages
+	return normalized, changes, nil
+}
+
+// mergeMessageContent 合并两条同角色消息的内容
+func mergeMessageContent(first, second any) any {
+	firstText, firstIsString := first.(string)
+	secondText, secondIsString := second.(string)
+	if firstIsString && secondIsString {
+		switch {
+		case firstText == "":
+			return secondText
+		case secondText == "":
+			return firstText
+		}
+		return firstText + "\n" + secondText
+	}
+
+	return append(contentBlocks(first), contentBlocks(second)...)
+}
+
+// contentBlocks 将消息内容转换为内容块数组（map形式），空文本不产生内容块
+func contentBlocks(content any) []any {
+	switch value := content.(type) {
+	case nil:
+		return nil
+	case string:
+		if value == "" {
+			return nil
+		}
+		return []any{map[string]any{"type": "text", "text": value}}
+	case []any:
+		return append([]any(nil), value...)
+	default:
+		// 类型化的内容块（如[]types.ContentBlock）经JSON转换为map形式
+		data, err := utils.SafeMarshal(value)
+		if err != nil {
+			return []any{value}
+		}
+		var blocks []any
+		if err := utils.SafeUnmarshal(data, &blocks); err != nil {
+			return []any{value}
+		}
+		return blocks
+	}
+}
+
+// messageText 提取消息的文本内容，第二个返回值表示内容是否只包含文本
+func messageText(content any) (string, bool) {
+	if text, ok := content.(string); ok {
+		return text, true
+	}
+	var parts []string
+	for _, block := range contentBlocks(content) {
+		blockMap, ok := block.(map[string]any)
+		if !ok || blockMap["type"] != "text" {
+			return "", false
+		}
+		text, _ := blockMap["text"].(string)
+		parts = append(parts, text)
+	}
+	return strings.Join(parts, "\n"), true
+}
+
+// validateToolResultOrder 校验tool_result都紧跟在发出对应tool_use的assistant消息之后
+func validateToolResultOrder(messages []types.AnthropicRequestMessage) error {
+	for i, msg := range messages {
+		if msg.Role != "user" {
+			continue
+		}
+		resultIDs := blockIDs(msg.Content, "tool_result", "tool_use_id")
+		if len(resultIDs) == 0 {
+			continue
+		}
+
+		var toolUseIDs []string
+		if i > 0 && messages[i-1].Role == "assistant" {
+			toolUseIDs = blockIDs(messages[i-1].Content, "tool_use", "id")
+		}
+		for _, id := range resultIDs {
+			if !containsString(toolUseIDs, id) {
+				return fmt.Errorf("messages[%d] 中的 tool_result (tool_use_id=%s) 没有紧跟在对应的 tool_use 之后", i, id)
+			}
+		}
+	}
+	return nil
+}
+
+// blockIDs 返回指定类型内容块的ID字段
+func blockIDs(content any, blockType, idField string) []string {
+	if _, isString := content.(string); isString {
+		return nil
+	}
+	var ids []string
+	for _, block := range contentBlocks(content) {
+		blockMap, ok := block.(map[string]any)
+		if !ok || blockMap["type"] != blockType {
+			continue
+		}
+		id, _ := blockMap[idField].(string)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeConversation 整理请求的消息顺序，发生改动时记录日志并设置X-Kiro-Normalized响应头
+// tool_result顺序无效时返回400并返回false
+func normalizeConversation(c *gin.Context, req types.AnthropicRequest) (types.AnthropicRequest, bool) {
+	normalized, changes, err := normalizeMessageRoles(req, leadingAssistantMode)
+	if err != nil {
+		logger.Warn("消息顺序无效", addReqFields(c, logger.Err(err))...)
+		respondError(c, http.StatusBadRequest, "%v", err)
+		return req, false
+	}
+	if len(changes) == 0 {
+		return req, true
+	}
+
+	c.Header(HeaderNormalized, strings.Join(changes, ","))
+	logger.Debug("已整理消息角色顺序",
+		addReqFields(c,
+			logger.String("changes", strings.Join(changes, ",")),
+			logger.Int("original_messages", len(req.Messages)),
+			logger.Int("normalized_messages", len(normalized.Messages)))...)
+	return normalized, true
+}
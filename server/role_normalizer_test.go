@@ -0,0 +1,244 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func msg(role string, content any) types.AnthropicRequestMessage {
+	return types.AnthropicRequestMessage{Role: role, Content: content}
+}
+
+func textBlock(text string) map[string]any {
+	return map[string]any{"type": "text", "text": text}
+}
+
+func toolUseBlock(id string) map[string]any {
+	return map[string]any{"type": "tool_use", "id": id, "name": "get_weather", "input": map[string]any{}}
+}
+
+func toolResultBlock(id string) map[string]any {
+	return map[string]any{"type": "tool_result", "tool_use_id": id, "content": "sunny"}
+}
+
+func TestNormalizeMessageRoles(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		system   []types.AnthropicSystemMessage
+		messages []types.AnthropicRequestMessage
+		want     []types.AnthropicRequestMessage
+		system2  []types.AnthropicSystemMessage // 期望的system，nil表示与输入相同
+		changes  []string
+	}{
+		{
+			name:     "已交替的对话保持不变",
+			messages: []types.AnthropicRequestMessage{msg("user", "hi"), msg("assistant", "hello"), msg("user", "bye")},
+			want:     []types.AnthropicRequestMessage{msg("user", "hi"), msg("assistant", "hello"), msg("user", "bye")},
+		},
+		{
+			name:     "连续两条纯文本user消息以换行拼接",
+			messages: []types.AnthropicRequestMessage{msg("user", "first"), msg("user", "second")},
+			want:     []types.AnthropicRequestMessage{msg("user", "first\nsecond")},
+			changes:  []string{normalizeMergedUser},
+		},
+		{
+			name:     "三条连续user消息合并为一条",
+			messages: []types.AnthropicRequestMessage{msg("user", "a"), msg("user", "b"), msg("user", "c")},
+			want:     []types.AnthropicRequestMessage{msg("user", "a\nb\nc")},
+			changes:  []string{normalizeMergedUser},
+		},
+		{
+			name:     "空文本消息合并时不产生多余换行",
+			messages: []types.AnthropicRequestMessage{msg("user", ""), msg("user", "only")},
+			want:     []types.AnthropicRequestMessage{msg("user", "only")},
+			changes:  []string{normalizeMergedUser},
+		},
+		{
+			name:     "文本与内容块混合时拼接内容块",
+			messages: []types.AnthropicRequestMessage{msg("user", "look"), msg("user", []any{textBlock("at this")})},
+			want:     []types.AnthropicRequestMessage{msg("user", []any{textBlock("look"), textBlock("at this")})},
+			changes:  []string{normalizeMergedUser},
+		},
+		{
+			name: "连续assistant消息合并，tool_use保留",
+			messages: []types.AnthropicRequestMessage{
+				msg("user", "weather?"),
+				msg("assistant", "Let me check."),
+				msg("assistant", []any{toolUseBlock("tu_1")}),
+				msg("user", []any{toolResultBlock("tu_1")}),
+			},
+			want: []types.AnthropicRequestMessage{
+				msg("user", "weather?"),
+				msg("assistant", []any{textBlock("Let me check."), toolUseBlock("tu_1")}),
+				msg("user", []any{toolResultBlock("tu_1")}),
+			},
+			changes: []string{normalizeMergedAssistant},
+		},
+		{
+			name: "tool_result后紧跟的user文本并入同一条消息",
+			messages: []types.AnthropicRequestMessage{
+				msg("user", "weather?"),
+				msg("assistant", []any{toolUseBlock("tu_1")}),
+				msg("user", []any{toolResultBlock("tu_1")}),
+				msg("user", "and tomorrow?"),
+			},
+			want: []types.AnthropicRequestMessage{
+				msg("user", "weather?"),
+				msg("assistant", []any{toolUseBlock("tu_1")}),
+				msg("user", []any{toolResultBlock("tu_1"), textBlock("and tomorrow?")}),
+			},
+			changes: []string{normalizeMergedUser},
+		},
+		{
+			name:     "以assistant开头时插入占位user消息",
+			messages: []types.AnthropicRequestMessage{msg("assistant", "How can I help?"), msg("user", "hi")},
+			want:     []types.AnthropicRequestMessage{msg("user", leadingUserPlaceholderText), msg("assistant", "How can I help?"), msg("user", "hi")},
+			changes:  []string{normalizePrependedUser},
+		},
+		{
+			name:     "system模式下开头的assistant文本并入system",
+			mode:     LeadingAssistantSystem,
+			system:   []types.AnthropicSystemMessage{{Type: "text", Text: "Be brief."}},
+			messages: []types.AnthropicRequestMessage{msg("assistant", "How can I help?"), msg("user", "hi")},
+			want:     []types.AnthropicRequestMessage{msg("user", "hi")},
+			system2: []types.AnthropicSystemMessage{
+				{Type: "text", Text: "Be brief."},
+				{Type: "text", Text: foldedAssistantSystemTitle + "How can I help?"},
+			},
+			changes: []string{normalizeFoldedToSystem},
+		},
+		{
+			name:     "system模式下开头的assistant含tool_use时仍插入占位消息",
+			mode:     LeadingAssistantSystem,
+			messages: []types.AnthropicRequestMessage{msg("assistant", []any{toolUseBlock("tu_1")}), msg("user", []any{toolResultBlock("tu_1")})},
+			want: []types.AnthropicRequestMessage{
+				msg("user", leadingUserPlaceholderText),
+				msg("assistant", []any{toolUseBlock("tu_1")}),
+				msg("user", []any{toolResultBlock("tu_1")}),
+			},
+			changes: []string{normalizePrependedUser},
+		},
+		{
+			name:     "system模式下只有一条assistant消息时插入占位消息",
+			mode:     LeadingAssistantSystem,
+			messages: []types.AnthropicRequestMessage{msg("assistant", "partial")},
+			want:     []types.AnthropicRequestMessage{msg("user", leadingUserPlaceholderText), msg("assistant", "partial")},
+			changes:  []string{normalizePrependedUser},
+		},
+		{
+			name: "开头连续assistant先合并再插入占位消息",
+			messages: []types.AnthropicRequestMessage{
+				msg("assistant", "one"), msg("assistant", "two"), msg("user", "hi"), msg("user", "there"),
+			},
+			want:    []types.AnthropicRequestMessage{msg("user", leadingUserPlaceholderText), msg("assistant", "one\ntwo"), msg("user", "hi\nthere")},
+			changes: []string{normalizeMergedAssistant, normalizeMergedUser, normalizePrependedUser},
+		},
+		{
+			name:     "类型化内容块合并后转换为map形式",
+			messages: []types.AnthropicRequestMessage{msg("user", []types.ContentBlock{{Type: "text", Text: ptr("typed")}}), msg("user", "plain")},
+			want:     []types.AnthropicRequestMessage{msg("user", []any{textBlock("typed"), textBlock("plain")})},
+			changes:  []string{normalizeMergedUser},
+		},
+		{
+			name:     "含其他角色的消息不做整理",
+			messages: []types.AnthropicRequestMessage{msg("system", "rules"), msg("user", "a"), msg("user", "b")},
+			want:     []types.AnthropicRequestMessage{msg("system", "rules"), msg("user", "a"), msg("user", "b")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode := tt.mode
+			if mode == "" {
+				mode = LeadingAssistantPrepend
+			}
+			req := types.AnthropicRequest{Model: "claude-sonnet-4-20250514", System: tt.system, Messages: tt.messages}
+			original := append([]types.AnthropicRequestMessage(nil), tt.messages...)
+
+			got, changes, err := normalizeMessageRoles(req, mode)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.Messages)
+			assert.Equal(t, tt.changes, changes)
+			if tt.system2 != nil {
+				assert.Equal(t, tt.system2, got.System)
+			} else {
+				assert.Equal(t, tt.system, got.System)
+			}
+			assert.Equal(t, original, req.Messages, "不应修改原请求")
+		})
+	}
+}
+
+func ptr(s string) *string { return &s }
+
+func TestNormalizeMessageRoles_InvalidToolResultOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []types.AnthropicRequestMessage
+	}{
+		{"没有对应的tool_use", []types.AnthropicRequestMessage{
+			msg("user", "hi"), msg("assistant", "hello"), msg("user", []any{toolResultBlock("tu_1")}),
+		}},
+		{"tool_use_id不匹配", []types.AnthropicRequestMessage{
+			msg("user", "hi"), msg("assistant", []any{toolUseBlock("tu_1")}), msg("user", []any{toolResultBlock("tu_2")}),
+		}},
+		{"tool_result不是紧跟在tool_use之后", []types.AnthropicRequestMessage{
+			msg("user", "hi"), msg("assistant", []any{toolUseBlock("tu_1")}),
+			msg("user", "wait"), msg("assistant", "ok"), msg("user", []any{toolResultBlock("tu_1")}),
+		}},
+		{"以tool_result开头", []types.AnthropicRequestMessage{
+			msg("user", []any{toolResultBlock("tu_1")}),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := normalizeMessageRoles(types.AnthropicRequest{Messages: tt.messages}, LeadingAssistantPrepend)
+			assert.ErrorContains(t, err, "tool_result")
+		})
+	}
+}
+
+func TestNormalizeConversation_HeaderAndError(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	req := types.AnthropicRequest{Messages: []types.AnthropicRequestMessage{msg("assistant", "hi"), msg("user", "a"), msg("user", "b")}}
+	normalized, ok := normalizeConversation(c, req)
+	require.True(t, ok)
+	assert.Len(t, normalized.Messages, 3)
+	assert.Equal(t, "merged_user,prepended_user", w.Header().Get(HeaderNormalized))
+
+	// 无改动时不设置响应头
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	_, ok = normalizeConversation(c, types.AnthropicRequest{Messages: []types.AnthropicRequestMessage{msg("user", "hi")}})
+	require.True(t, ok)
+	assert.Empty(t, w.Header().Get(HeaderNormalized))
+
+	// tool_result顺序无效时返回400
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	_, ok = normalizeConversation(c, types.AnthropicRequest{Messages: []types.AnthropicRequestMessage{msg("user", []any{toolResultBlock("tu_1")})}})
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "tool_use_id=tu_1")
+}
+
+func TestNewLeadingAssistantModeFromEnv(t *testing.T) {
+	t.Setenv("LEADING_ASSISTANT_MODE", "")
+	assert.Equal(t, LeadingAssistantPrepend, NewLeadingAssistantModeFromEnv())
+	t.Setenv("LEADING_ASSISTANT_MODE", "System")
+	assert.Equal(t, LeadingAssistantSystem, NewLeadingAssistantModeFromEnv())
+	t.Setenv("LEADING_ASSISTANT_MODE", "drop")
+	assert.Equal(t, LeadingAssistantPrepend, NewLeadingAssistantModeFromEnv())
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unmatchedRouteLabel 未匹配任何已注册路由的请求统一使用的标签，避免原始路径造成标签基数爆炸
+const unmatchedRouteLabel = "unmatched"
+
+// 请求耗时直方图按响应是否为SSE流区分
+const (
+	routeModeStream    = "stream"
+	routeModeNonStream = "non_stream"
+)
+
+// routeDurationBuckets 请求耗时直方图的桶上界（秒），流式请求通常持续数十秒
+var routeDurationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// inflightExemptPaths 不受并发上限约束的路由，保证过载时仍可观测
+var inflightExemptPaths = map[string]bool{
+	"/metrics":   true,
+	"/api/stats": true,
+}
+
+// RouteMetrics 按路由模板统计并发、请求数、错误数和耗时分布，并执行全局并发上限
+type RouteMetrics struct {
+	mutex  sync.Mutex
+	routes map[routeKey]*routeStats
+
+	maxInflight int64 // 全局并发上限，0表示不限制
+	inflight    atomic.Int64
+	rejected    atomic.Int64 // 因超过并发上限返回503的请求数（不计入各路由统计）
+}
+
+// routeKey 路由统计的标签组合
+type routeKey struct {
+	Method string
+	Route  string
+}
+
+// routeStats 单个路由的统计数据，由RouteMetrics.mutex保护
+type routeStats struct {
+	inflight  int64
+	total     int64
+	errors    int64
+	durations map[string]*durationHistogram
+}
+
+// durationHistogram 累积直方图，counts[i]为耗时不超过routeDurationBuckets[i]的请求数
+type durationHistogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// RouteStatsSnapshot 单个路由统计的快照（/api/stats）
+type RouteStatsSnapshot struct {
+	Method    string                      `json:"method"`
+	Route     string                      `json:"route"`
+	InFlight  int64                       `json:"in_flight"`
+	Total     int64                       `json:"total"`
+	Errors    int64                       `json:"errors"`
+	ErrorRate float64                     `json:"error_rate"`
+	Durations map[string]DurationSnapshot `json:"durations"`
+}
+
+// DurationSnapshot 耗时直方图快照，Buckets的键为桶上界（秒）
+type DurationSnapshot struct {
+	Count      int64            `json:"count"`
+	SumSeconds float64          `json:"sum_seconds"`
+	Buckets    map[string]int64 `json:"buckets"`
+}
+
+// NewRouteMetrics 创建路由统计，maxInflight<=0表示不限制并发
+func NewRouteMetrics(maxInflight int) *RouteMetrics {
+	return &RouteMetrics{
+		routes:      make(map[routeKey]*routeStats),
+		maxInflight: int64(max(maxInflight, 0)),
+	}
+}
+
+// NewRouteMetricsFromEnv 根据环境变量创建路由统计
+// MAX_INFLIGHT: 全局并发请求上限（默认0，不限制），超过时返回503
+func NewRouteMetricsFromEnv() *RouteMetrics {
+	maxInflight := 0
+	if value := strings.TrimSpace(os.Getenv("MAX_INFLIGHT")); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			maxInflight = parsed
+		} else {
+			logger.Warn("MAX_INFLIGHT无效，不限制并发", logger.String("value", value))
+		}
+	}
+	if maxInflight > 0 {
+		logger.Info("已启用全局并发上限", logger.Int("max_inflight", maxInflight))
+	}
+	return NewRouteMetrics(maxInflight)
+}
+
+// routeMetrics 全局路由统计（测试可替换）
+var routeMetrics = NewRouteMetrics(0)
+
+// RouteMetricsMiddleware 统计每个路由的请求并执行全局并发上限
+// 路由标签使用注册时的模板（如 /api/config/:index），而不是原始路径
+func RouteMetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		metrics := routeMetrics
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRouteLabel
+		}
+
+		limited := !inflightExemptPaths[route]
+		if limited && !metrics.acquire() {
+			metrics.rejected.Add(1)
+			logger.Warn("并发请求数超过上限，拒绝请求",
+				addReqFields(c,
+					logger.String("route", route),
+					logger.Int64("max_inflight", metrics.maxInflight))...)
+			respondErrorWithCode(c, http.StatusServiceUnavailable, "overloaded", "%s", "服务器繁忙，请稍后重试")
+			c.Abort()
+			return
+		}
+		if limited {
+			defer metrics.inflight.Add(-1)
+		}
+
+		key := routeKey{Method: c.Request.Method, Route: route}
+		metrics.begin(key)
+		start := time.Now()
+
+		c.Next()
+
+		mode := routeModeNonStream
+		if strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream") {
+			mode = routeModeStream
+		}
+		metrics.end(key, mode, c.Writer.Status(), time.Since(start))
+	}
+}
+
+// acquire 占用一个全局并发名额，超过上限时返回false
+func (m *RouteMetrics) acquire() bool {
+	current := m.inflight.Add(1)
+	if m.maxInflight > 0 && current > m.maxInflight {
+		m.inflight.Add(-1)
+		return false
+	}
+	return true
+}
+
+// statsLocked 返回路由的统计数据，不存在时创建
+func (m *RouteMetrics) statsLocked(key routeKey) *routeStats {
+	stats, exists := m.routes[key]
+	if !exists {
+		stats = &routeStats{durations: make(map[string]*durationHistogram)}
+		m.routes[key] = stats
+	}
+	return stats
+}
+
+func (m *RouteMetrics) begin(key routeKey) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.statsLocked(key).inflight++
+}
+
+// end 记录请求结束，状态码>=400计为错误
+func (m *RouteMetrics) end(key routeKey, mode string, status int, duration time.Duration) {
+	seconds := duration.Seconds()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stats := m.statsLocked(key)
+	stats.inflight--
+	stats.total++
+	if status >= http.StatusBadRequest {
+		stats.errors++
+	}
+
+	histogram, exists := stats.durations[mode]
+	if !exists {
+		histogram = &durationHistogram{counts: make([]int64, len(routeDurationBuckets))}
+		stats.durations[mode] = histogram
+	}
+	histogram.count++
+	histogram.sum += seconds
+	for i, bound := range routeDurationBuckets {
+		if seconds <= bound {
+			histogram.counts[i]++
+		}
+	}
+}
+
+// InFlight 当前全局并发请求数（不含豁免路由）
+func (m *RouteMetrics) InFlight() int64 {
+	return m.inflight.Load()
+}
+
+// Rejected 因超过并发上限被拒绝的请求数
+func (m *RouteMetrics) Rejected() int64 {
+	return m.rejected.Load()
+}
+
+// Snapshot 返回按路由、方法排序的统计快照
+func (m *RouteMetrics) Snapshot() []RouteStatsSnapshot {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	snapshots := make([]RouteStatsSnapshot, 0, len(m.routes))
+	for key, stats := range m.routes {
+		snapshot := RouteStatsSnapshot{
+			Method:    key.Method,
+			Route:     key.Route,
+			InFlight:  stats.inflight,
+			Total:     stats.total,
+			Errors:    stats.errors,
+			Durations: make(map[string]DurationSnapshot, len(stats.durations)),
+		}
+		if stats.total > 0 {
+			snapshot.ErrorRate = float64(stats.errors) / float64(stats.total)
+		}
+		for mode, histogram := range stats.durations {
+			buckets := make(map[string]int64, len(routeDurationBuckets))
+			for i, bound := range routeDurationBuckets {
+				buckets[formatBucketBound(bound)] = histogram.counts[i]
+			}
+			snapshot.Durations[mode] = DurationSnapshot{
+				Count:      histogram.count,
+				SumSeconds: histogram.sum,
+				Buckets:    buckets,
+			}
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].Route != snapshots[j].Route {
+			return snapshots[i].Route < snapshots[j].Route
+		}
+		return snapshots[i].Method < snapshots[j].Method
+	})
+	return snapshots
+}
+
+// WritePrometheus 以Prometheus文本格式输出统计
+func (m *RouteMetrics) WritePrometheus(b *strings.Builder) {
+	snapshots := m.Snapshot()
+
+	b.WriteString("# HELP kiro2api_http_requests_in_flight Requests currently being served, by route template.\n")
+	b.WriteString("# TYPE kiro2api_http_requests_in_flight gauge\n")
+	for _, s := range snapshots {
+		fmt.Fprintf(b, "kiro2api_http_requests_in_flight{%s} %d\n", routeLabels(s), s.InFlight)
+	}
+
+	b.WriteString("# HELP kiro2api_http_requests_total Requests served, by route template.\n")
+	b.WriteString("# TYPE kiro2api_http_requests_total counter\n")
+	for _, s := range snapshots {
+		fmt.Fprintf(b, "kiro2api_http_requests_total{%s} %d\n", routeLabels(s), s.Total)
+	}
+
+	b.WriteString("# HELP kiro2api_http_request_errors_total Requests answered with status >= 400, by route template.\n")
+	b.WriteString("# TYPE kiro2api_http_request_errors_total counter\n")
+	for _, s := range snapshots {
+		fmt.Fprintf(b, "kiro2api_http_request_errors_total{%s} %d\n", routeLabels(s), s.Errors)
+	}
+
+	b.WriteString("# HELP kiro2api_http_request_duration_seconds Request duration, by route template and stream mode.\n")
+	b.WriteString("# TYPE kiro2api_http_request_duration_seconds histogram\n")
+	for _, s := range snapshots {
+		modes := make([]string, 0, len(s.Durations))
+		for mode := range s.Durations {
+			modes = append(modes, mode)
+		}
+		sort.Strings(modes)
+		for _, mode := range modes {
+			histogram := s.Durations[mode]
+			labels := fmt.Sprintf("%s,mode=%q", routeLabels(s), mode)
+			for _, bound := range routeDurationBuckets {
+				le := formatBucketBound(bound)
+				fmt.Fprintf(b, "kiro2api_http_request_duration_seconds_bucket{%s,le=%q} %d\n", labels, le, histogram.Buckets[le])
+			}
+			fmt.Fprintf(b, "kiro2api_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, histogram.Count)
+			fmt.Fprintf(b, "kiro2api_http_request_duration_seconds_sum{%s} %g\n", labels, histogram.SumSeconds)
+			fmt.Fprintf(b, "kiro2api_http_request_duration_seconds_count{%s} %d\n", labels, histogram.Count)
+		}
+	}
+
+	b.WriteString("# HELP kiro2api_inflight_limit Global in-flight request limit (0 means unlimited).\n")
+	b.WriteString("# TYPE kiro2api_inflight_limit gauge\n")
+	fmt.Fprintf(b, "kiro2api_inflight_limit %d\n", m.maxInflight)
+
+	b.WriteString("# HELP kiro2api_inflight_rejected_total Requests rejected with 503 because the in-flight limit was reached.\n")
+	b.WriteString("# TYPE kiro2api_inflight_rejected_total counter\n")
+	fmt.Fprintf(b, "kiro2api_inflight_rejected_total %d\n", m.Rejected())
+}
+
+// routeLabels 格式化method和route标签
+func routeLabels(s RouteStatsSnapshot) string {
+	return fmt.Sprintf("method=%q,route=%q", s.Method, s.Route)
+}
+
+// formatBucketBound 格式化直方图桶上界
+func formatBucketBound(bound float64) string {
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+// handleMetrics 以Prometheus文本格式输出路由统计、认证统计和下发队列统计
+// GET /metrics
+func handleMetrics(c *gin.Context) {
+	var b strings.Builder
+	routeMetrics.WritePrometheus(&b)
+	auth.Metrics().WritePrometheus(&b)
+	auth.SharedUsageCache().WritePrometheus(&b)
+	downstreamQueueStats.WritePrometheus(&b)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withRouteMetrics 替换全局路由统计，测试结束后恢复
+func withRouteMetrics(t *testing.T, maxInflight int) *RouteMetrics {
+	t.Helper()
+	original := routeMetrics
+	routeMetrics = NewRouteMetrics(maxInflight)
+	t.Cleanup(func() { routeMetrics = original })
+	return routeMetrics
+}
+
+// newRouteMetricsTestRouter 注册带路由统计中间件的测试路由
+func newRouteMetricsTestRouter(handlers map[string]gin.HandlerFunc) *gin.Engine {
+	r := gin.New()
+	r.Use(RouteMetricsMiddleware())
+	for route, handler := range handlers {
+		r.Handle(http.MethodPost, route, handler)
+	}
+	r.GET("/metrics", handleMetrics)
+	r.GET("/api/stats", handleStreamStatsAPI)
+	return r
+}
+
+func serveRouteMetricsRequest(r *gin.Engine, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestRouteMetrics_UsesRouteTemplateLabels(t *testing.T) {
+	metrics := withRouteMetrics(t, 0)
+	r := newRouteMetricsTestRouter(map[string]gin.HandlerFunc{
+		"/api/config/:index": func(c *gin.Context) {
+			if c.Param("index") == "9" {
+				respondError(c, http.StatusNotFound, "%s", "配置不存在")
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"ok": true})
+		},
+		"/v1/messages": func(c *gin.Context) {
+			c.Header("Content-Type", "text/event-stream")
+			c.String(http.StatusOK, "data: {}\n\n")
+		},
+	})
+
+	serveRouteMetricsRequest(r, http.MethodPost, "/api/config/1")
+	serveRouteMetricsRequest(r, http.MethodPost, "/api/config/2")
+	serveRouteMetricsRequest(r, http.MethodPost, "/api/config/9")
+	serveRouteMetricsRequest(r, http.MethodPost, "/v1/messages")
+	serveRouteMetricsRequest(r, http.MethodPost, "/no/such/path/123")
+	serveRouteMetricsRequest(r, http.MethodPost, "/no/such/path/456")
+
+	snapshots := metrics.Snapshot()
+	byRoute := make(map[string]RouteStatsSnapshot)
+	for _, s := range snapshots {
+		byRoute[s.Route] = s
+	}
+	require.Len(t, byRoute, 3, "原始路径不应成为标签")
+
+	config := byRoute["/api/config/:index"]
+	assert.Equal(t, http.MethodPost, config.Method)
+	assert.Equal(t, int64(3), config.Total)
+	assert.Equal(t, int64(1), config.Errors)
+	assert.InDelta(t, 1.0/3, config.ErrorRate, 1e-9)
+	assert.Equal(t, int64(0), config.InFlight)
+	assert.Equal(t, int64(3), config.Durations[routeModeNonStream].Count)
+	assert.NotContains(t, config.Durations, routeModeStream)
+
+	messages := byRoute["/v1/messages"]
+	assert.Equal(t, int64(1), messages.Total)
+	assert.Equal(t, int64(1), messages.Durations[routeModeStream].Count)
+	assert.Equal(t, int64(1), messages.Durations[routeModeStream].Buckets["0.1"])
+
+	unmatched := byRoute[unmatchedRouteLabel]
+	assert.Equal(t, int64(2), unmatched.Total)
+	assert.Equal(t, int64(2), unmatched.Errors)
+
+	w := serveRouteMetricsRequest(r, http.MethodGet, "/metrics")
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `kiro2api_http_requests_total{method="POST",route="/api/config/:index"} 3`)
+	assert.Contains(t, body, `kiro2api_http_request_errors_total{method="POST",route="/api/config/:index"} 1`)
+	assert.Contains(t, body, `kiro2api_http_requests_in_flight{method="POST",route="/v1/messages"} 0`)
+	assert.Contains(t, body, `kiro2api_http_request_duration_seconds_count{method="POST",route="/v1/messages",mode="stream"} 1`)
+	assert.Contains(t, body, `kiro2api_http_request_duration_seconds_bucket{method="POST",route="/api/config/:index",mode="non_stream",le="+Inf"} 3`)
+	assert.Contains(t, body, `route="unmatched"`)
+	assert.NotContains(t, body, "/api/config/1")
+	assert.NotContains(t, body, "/no/such/path")
+	// 同一端点还输出认证统计
+	assert.Contains(t, body, "# TYPE kiro2api_auth_duration_seconds histogram")
+	assert.Contains(t, body, "# TYPE kiro2api_token_refreshes_total counter")
+}
+
+func TestRouteMetrics_InflightLimit(t *testing.T) {
+	metrics := withRouteMetrics(t, 1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	r := newRouteMetricsTestRouter(map[string]gin.HandlerFunc{
+		"/v1/messages": func(c *gin.Context) {
+			close(started)
+			<-release
+			c.JSON(http.StatusOK, gin.H{"ok": true})
+		},
+		"/v1/chat/completions": func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"ok": true})
+		},
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serveRouteMetricsRequest(r, http.MethodPost, "/v1/messages") }()
+	<-started
+
+	// 名额已被占满，其他路由的请求也被拒绝
+	w := serveRouteMetricsRequest(r, http.MethodPost, "/v1/chat/completions")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "overloaded")
+	assert.Equal(t, int64(1), metrics.Rejected())
+	assert.Equal(t, int64(1), metrics.InFlight())
+
+	// 观测端点不受上限约束
+	w = serveRouteMetricsRequest(r, http.MethodGet, "/api/stats")
+	require.Equal(t, http.StatusOK, w.Code)
+	var stats map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, map[string]any{"current": float64(1), "limit": float64(1), "rejected": float64(1)}, stats["inflight"])
+
+	w = serveRouteMetricsRequest(r, http.MethodGet, "/metrics")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `kiro2api_http_requests_in_flight{method="POST",route="/v1/messages"} 1`)
+	assert.Contains(t, w.Body.String(), "kiro2api_inflight_rejected_total 1")
+	assert.Contains(t, w.Body.String(), "kiro2api_inflight_limit 1")
+
+	close(release)
+	select {
+	case first := <-done:
+		assert.Equal(t, http.StatusOK, first.Code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("第一个请求未完成")
+	}
+
+	// 名额释放后恢复服务；被拒绝的请求不计入路由统计
+	assert.Equal(t, http.StatusOK, serveRouteMetricsRequest(r, http.MethodPost, "/v1/chat/completions").Code)
+	assert.Equal(t, int64(0), metrics.InFlight())
+	for _, s := range metrics.Snapshot() {
+		if s.Route == "/v1/chat/completions" {
+			assert.Equal(t, int64(1), s.Total)
+			assert.Equal(t, int64(0), s.Errors)
+		}
+	}
+}
+
+func TestNewRouteMetricsFromEnv(t *testing.T) {
+	t.Setenv("MAX_INFLIGHT", "64")
+	assert.Equal(t, int64(64), NewRouteMetricsFromEnv().maxInflight)
+
+	t.Setenv("MAX_INFLIGHT", "-1")
+	assert.Equal(t, int64(0), NewRouteMetricsFromEnv().maxInflight)
+
+	t.Setenv("MAX_INFLIGHT", "")
+	assert.Equal(t, int64(0), NewRouteMetricsFromEnv().maxInflight)
+}
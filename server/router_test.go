@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/auth"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const routerTestToken = "router-test-token"
+
+// serveRouter 通过NewRouter注册的完整路由和中间件处理请求
+func serveRouter(t *testing.T, method, path, body string, authorized bool) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if authorized {
+		req.Header.Set("Authorization", "Bearer "+routerTestToken)
+	}
+	w := httptest.NewRecorder()
+	newTestRouter(t, routerTestToken, nil).ServeHTTP(w, req)
+	return w
+}
+
+// newTestRouter 创建路由；同一进程只支持一个路由，测试中每次创建前后都重置
+func newTestRouter(t *testing.T, authToken string, authService *auth.AuthService) *gin.Engine {
+	t.Helper()
+	ResetRouter()
+	t.Cleanup(ResetRouter)
+	router, err := NewRouter(authToken, authService)
+	require.NoError(t, err)
+	return router
+}
+
+func TestRouter_Models(t *testing.T) {
+	w := serveRouter(t, http.MethodGet, "/v1/models", "", true)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp types.ModelsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "list", resp.Object)
+	assert.NotEmpty(t, resp.Data)
+}
+
+func TestRouter_AuthRequiredForV1(t *testing.T) {
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/v1/models"},
+		{http.MethodPost, "/v1/messages"},
+		{http.MethodPost, "/v1/chat/completions"},
+	} {
+		w := serveRouter(t, route.method, route.path, "{}", false)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, route.path)
+	}
+}
+
+func TestRouter_UnknownV1Path(t *testing.T) {
+	w := serveRouter(t, http.MethodPost, "/v1/message", "{}", true)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	errorType, message := anthropicError(t, w)
+	assert.Equal(t, "not_found_error", errorType)
+	assert.Contains(t, message, "/v1/message")
+}
+
+func TestRouter_InvalidJSON(t *testing.T) {
+	for _, path := range []string{"/v1/messages", "/v1/chat/completions"} {
+		w := serveRouter(t, http.MethodPost, path, "{not json", true)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "%s: %s", path, w.Body.String())
+	}
+}
+
+func TestNewRouter_OnlyOncePerProcess(t *testing.T) {
+	newTestRouter(t, routerTestToken, nil)
+
+	_, err := NewRouter(routerTestToken, nil)
+	assert.ErrorIs(t, err, ErrRouterExists, "再次创建会覆盖正在使用的策略")
+
+	ResetRouter()
+	_, err = NewRouter(routerTestToken, nil)
+	assert.NoError(t, err)
+}
+
+func TestNewServer_NotStarted(t *testing.T) {
+	t.Setenv("SERVER_WRITE_TIMEOUT", "30s")
+	ResetRouter()
+	t.Cleanup(ResetRouter)
+	server, httpConfig, err := NewServer("18080", routerTestToken, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, ":18080", server.Addr)
+	assert.Equal(t, httpConfig.WriteTimeout, server.WriteTimeout)
+	require.NotNil(t, server.Handler)
+
+	// 未启动的服务器可直接关闭，供调用方实现优雅关闭
+	assert.NoError(t, server.Close())
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"os"
+	"strings"
+
+	"kiro2api/types"
+)
+
+// selectionStrategyHeader 按请求覆盖token选择策略的请求头，取值见 auth.SelectionStrategy*
+const selectionStrategyHeader = "X-Selection-Strategy"
+
+// selectionStrategyOverride 是否允许请求通过X-Selection-Strategy头覆盖token选择策略（默认关闭，关闭时忽略该请求头）
+var selectionStrategyOverride = false
+
+// NewSelectionStrategyOverrideFromEnv 读取 SELECTION_STRATEGY_OVERRIDE 环境变量，"true" 时启用
+func NewSelectionStrategyOverrideFromEnv() bool {
+	return strings.EqualFold(strings.TrimSpace(os.Getenv("SELECTION_STRATEGY_OVERRIDE")), "true")
+}
+
+// strategyTokenProvider 支持按指定策略选择token的认证服务（*auth.AuthService）
+type strategyTokenProvider interface {
+	GetTokenWithStrategy(strategy string) (*types.TokenWithUsage, error)
+}
+
+// strategyProvider 本次请求是否按X-Selection-Strategy头选择token
+// 需开启SELECTION_STRATEGY_OVERRIDE、请求携带该头且认证服务支持按策略选择
+func (rc *RequestContext) strategyProvider() (strategyTokenProvider, bool) {
+	if !selectionStrategyOverride || rc.GinContext.GetHeader(selectionStrategyHeader) == "" {
+		return nil, false
+	}
+	provider, ok := rc.AuthService.(strategyTokenProvider)
+	return provider, ok
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// strategyAuthService 记录按策略选择时收到的策略
+type strategyAuthService struct {
+	MockAuthService
+	strategies []string
+}
+
+func (s *strategyAuthService) GetTokenWithStrategy(strategy string) (*types.TokenWithUsage, error) {
+	s.strategies = append(s.strategies, strategy)
+	return &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "strategy-" + strategy}}, nil
+}
+
+func TestRequestContext_SelectionStrategyHeader(t *testing.T) {
+	tests := []struct {
+		name           string
+		enabled        bool
+		header         string
+		wantStatus     int
+		wantToken      string
+		wantStrategies []string
+	}{
+		{name: "未开启时忽略请求头", header: "least-used", wantToken: "default"},
+		{name: "开启但未携带请求头", enabled: true, wantToken: "default"},
+		{name: "开启且策略有效", enabled: true, header: "Least-Used", wantToken: "strategy-least-used", wantStrategies: []string{"least-used"}},
+		{name: "开启且策略未知", enabled: true, header: "random", wantStatus: http.StatusBadRequest},
+		{name: "未开启时未知策略也忽略", header: "random", wantToken: "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := selectionStrategyOverride
+			t.Cleanup(func() { selectionStrategyOverride = original })
+			selectionStrategyOverride = tt.enabled
+
+			for _, withUsage := range []bool{true, false} {
+				w := httptest.NewRecorder()
+				c, _ := gin.CreateTestContext(w)
+				c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+				if tt.header != "" {
+					c.Request.Header.Set(selectionStrategyHeader, tt.header)
+				}
+				service := &strategyAuthService{MockAuthService: MockAuthService{
+					token:      types.TokenInfo{AccessToken: "default"},
+					tokenUsage: &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "default"}},
+				}}
+				rc := &RequestContext{GinContext: c, AuthService: service}
+
+				var token types.TokenInfo
+				var err error
+				if withUsage {
+					var tokenWithUsage *types.TokenWithUsage
+					if tokenWithUsage, err = rc.GetTokenWithUsage(); err == nil {
+						token = tokenWithUsage.TokenInfo
+					}
+				} else {
+					token, err = rc.GetToken()
+				}
+
+				if tt.wantStatus != 0 {
+					require.Error(t, err)
+					assert.Equal(t, tt.wantStatus, w.Code)
+					assert.Empty(t, service.strategies)
+					continue
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantToken, token.AccessToken)
+				assert.Equal(t, tt.wantStrategies, service.strategies)
+			}
+		})
+	}
+}
+
+func TestNewSelectionStrategyOverrideFromEnv(t *testing.T) {
+	t.Setenv("SELECTION_STRATEGY_OVERRIDE", "")
+	assert.False(t, NewSelectionStrategyOverrideFromEnv())
+	t.Setenv("SELECTION_STRATEGY_OVERRIDE", " TRUE ")
+	assert.True(t, NewSelectionStrategyOverrideFromEnv())
+}
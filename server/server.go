@@ -1,17 +1,14 @@
 package server
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
 	"os"
-	"strings"
+	"sync/atomic"
 
 	"kiro2api/auth"
 	"kiro2api/config"
-	"kiro2api/converter"
 	"kiro2api/logger"
-	"kiro2api/types"
-	"kiro2api/utils"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,6 +17,103 @@ import (
 
 // StartServer 启动HTTP代理服务器
 func StartServer(port string, authToken string, authService *auth.AuthService) {
+	server, httpConfig, err := NewServer(port, authToken, authService)
+	if err != nil {
+		logger.Error("创建服务器失败", logger.Err(err))
+		os.Exit(1)
+	}
+
+	logger.Info("启动Anthropic API代理服务器",
+		logger.String("port", port),
+		logger.String("version", config.Version),
+		logger.String("commit", config.Commit),
+		logger.String("auth_token", "***"))
+	logger.Info("AuthToken 验证已启用")
+	logger.Info("可用端点:")
+	logger.Info("  GET  /                          - 重定向到静态Dashboard")
+	logger.Info("  GET  /static/*                  - 静态资源服务")
+	logger.Info("  GET  /api/tokens                - Token池状态API")
+	logger.Info("  GET  /api/tokens/summary        - Token池总额度、消耗速率与额度告警")
+	logger.Info("  GET  /api/tokens/export         - 导出Token池快照（json/csv，流式，支持HEAD）")
+	logger.Info("  POST /api/tokens/:index/refresh - 重新检查单个Token状态（需管理令牌）")
+	logger.Info("  GET  /api/tokens/:index/errors  - 账号最近的失败记录")
+	logger.Info("  GET  /api/requests/:request_id  - 查询上游请求归属信息")
+	logger.Info("  GET  /api/stats                 - 上游响应流与路由统计")
+	logger.Info("  GET  /api/status                - 版本、运行时长与账号池大小")
+	logger.Info("  GET  /api/reports/reconciliation - 每日token对账报告")
+	logger.Info("  GET  /metrics                   - Prometheus指标")
+	logger.Info("  POST /api/models/validate       - 模型映射校验")
+	logger.Info("  GET  /api/config/source         - 认证配置来源诊断")
+	logger.Info("  POST /api/config/probe          - 探测refreshToken（不保存）")
+	logger.Info("  PUT  /api/config                - 整体应用期望配置列表（需管理令牌，支持If-Match和dry_run）")
+	logger.Info("  POST /api/config/:index/clone   - 复制配置的clientId/clientSecret/区域（refreshToken留空）")
+	logger.Info("  GET  /api/config/:index/usage/raw - 账号的原始用量响应（需管理令牌）")
+	logger.Info("  GET  /v1/models                 - 模型列表")
+	logger.Info("  POST /v1/messages               - Anthropic API代理")
+	logger.Info("  POST /v1/messages/count_tokens  - Token计数接口")
+	logger.Info("  POST /v1/chat/completions       - OpenAI API代理")
+	logger.Info("按Ctrl+C停止服务器")
+
+	// 可选：启动时校验模型映射（VALIDATE_MODEL_MAP=true）
+	validateModelMapOnStartup(authService)
+
+	// Dashboard的token状态周期性地从token管理器缓存同步，只有显式刷新才请求上游
+	tokenStatusMonitor.SetWorkers(NewTokenStatusWorkersFromEnv())
+	if authService != nil {
+		tokenStatusMonitor.SetCachedSource(cachedTokenStatus(authService.GetTokenManager()))
+	}
+	// 每轮同步前按上一轮结果评估账号池额度告警
+	tokenStatusMonitor.SetRefreshHook(evaluatePoolAlerts)
+	tokenStatusMonitor.Start(auth.GetConfigs, config.TokenStatusSyncInterval)
+
+	// 每天生成前一天的token对账报告，偏差超过RECONCILIATION_ALERT_PERCENT时告警
+	StartReconciliationJob()
+
+	logger.Info("启动HTTP服务器",
+		logger.String("port", port),
+		logger.Bool("tls", httpConfig.TLSEnabled()),
+		logger.Bool("h2c", httpConfig.H2C),
+		logger.Duration("read_header_timeout", httpConfig.ReadHeaderTimeout),
+		logger.Duration("write_timeout", httpConfig.WriteTimeout),
+		logger.Duration("idle_timeout", httpConfig.IdleTimeout))
+
+	if err := serveHTTP(server, httpConfig); err != nil && err != http.ErrServerClosed {
+		logger.Error("启动服务器失败", logger.Err(err), logger.String("port", port))
+		os.Exit(1)
+	}
+}
+
+// NewServer 创建监听指定端口的HTTP服务器但不启动，调用方可自行Shutdown实现优雅关闭
+// 连接超时（SERVER_*_TIMEOUT）、h2c（SERVER_H2C）、HTTPS（TLS_CERT_FILE/TLS_KEY_FILE）由环境变量配置
+func NewServer(port string, authToken string, authService *auth.AuthService) (*http.Server, HTTPServerConfig, error) {
+	httpConfig := NewHTTPServerConfigFromEnv()
+	router, err := NewRouter(authToken, authService)
+	if err != nil {
+		return nil, httpConfig, err
+	}
+	return NewHTTPServer(":"+port, router, httpConfig), httpConfig, nil
+}
+
+// ErrRouterExists 当前进程已创建过路由
+var ErrRouterExists = errors.New("同一进程只支持一个路由：NewRouter会覆盖处理函数共用的包级策略和状态")
+
+// routerCreated 当前进程是否已创建路由
+var routerCreated atomic.Bool
+
+// ResetRouter 允许再次调用NewRouter，调用方需确保之前创建的路由不再处理请求
+// 用于测试和进程内工具（如重放）依次创建路由
+func ResetRouter() {
+	routerCreated.Store(false)
+}
+
+// NewRouter 根据环境变量初始化各项策略并注册所有路由
+// 各项策略和共享状态（历史裁剪、续传缓存、并发限制、token健康统计等）保存在包级变量中，由处理函数直接读取，
+// 因此同一进程只支持一个路由：再次调用返回ErrRouterExists，不会覆盖正在使用的路由的策略
+func NewRouter(authToken string, authService *auth.AuthService) (*gin.Engine, error) {
+	if !routerCreated.CompareAndSwap(false, true) {
+		return nil, ErrRouterExists
+	}
+
 	// 设置 gin 模式
 	ginMode := os.Getenv("GIN_MODE")
 	if ginMode == "" {
@@ -27,16 +121,154 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 	}
 	gin.SetMode(ginMode)
 
+	// 对话历史裁剪（默认关闭）
+	historyTrimmer = NewHistoryTrimmerFromEnv()
+	if historyTrimmer != nil {
+		logger.Info("对话历史裁剪已启用",
+			logger.String("mode", historyTrimmer.Mode),
+			logger.Int("max_turns", historyTrimmer.MaxTurns),
+			logger.Int("max_tokens", historyTrimmer.MaxTokens))
+	}
+
+	// 自定义模型别名（MODEL_ALIASES）
+	if aliases, err := config.ModelAliases(); err != nil {
+		logger.Warn("自定义模型别名配置有误", logger.Err(err))
+	} else if len(aliases) > 0 {
+		logger.Info("已加载自定义模型别名", logger.Int("count", len(aliases)))
+	}
+
+	// 各模型的默认max_tokens（MODEL_DEFAULT_MAX_TOKENS），在别名之后解析，别名键按目标模型登记
+	overrides, err := config.ModelDefaultMaxTokensFromEnv()
+	if err != nil {
+		logger.Warn("模型默认max_tokens配置有误", logger.Err(err))
+	} else if len(overrides) > 0 {
+		logger.Info("已加载模型默认max_tokens", logger.Int("count", len(overrides)))
+	}
+	config.ModelDefaultMaxTokensOverrides = overrides
+
+	// 请求级模型覆盖（X-Override-Model，默认关闭）
+	modelOverride = NewModelOverridePolicyFromEnv()
+	if modelOverride != nil {
+		logger.Info("请求级模型覆盖已启用", logger.Int("allowlist_size", len(modelOverride.Allowlist)))
+	}
+
+	// 初始化多消息响应的处理策略
+	messageBoundaryPolicy = NewMessageBoundaryPolicyFromEnv()
+
+	// 上游未知内容块默认跳过，可配置为透传
+	passthroughUnknownBlocks = NewPassthroughUnknownBlocksFromEnv()
+
+	// SSE断线续传缓存（Last-Event-ID）
+	sseResumeStore = NewSSEResumeStoreFromEnv()
+
+	// SSE响应的gzip压缩（默认关闭）
+	sseCompression = NewSSECompressionFromEnv()
+
+	// 非流式响应被上游提前截断时自动续写（默认关闭）
+	autoContinue = NewAutoContinuePolicyFromEnv()
+
+	// json_object模式流式输出的JSON结构校验（默认关闭）
+	streamJSONValidation = NewStreamJSONValidationFromEnv()
+
+	// 非流式 /v1/messages 请求的影子镜像（SHADOW_URL，默认关闭）
+	shadowTraffic = NewShadowPolicyFromEnv()
+
+	// 开头为assistant消息时的处理方式（LEADING_ASSISTANT_MODE）
+	leadingAssistantMode = NewLeadingAssistantModeFromEnv()
+
+	// Anthropic流式响应的规范校验（STRICT_SSE_VALIDATION，默认关闭）
+	strictSSEValidation = NewStrictSSEValidationFromEnv()
+
+	// 拒绝含未知顶层字段的请求（STRICT_REQUEST_FIELDS，默认关闭）
+	strictRequestFields = NewStrictRequestFieldsFromEnv()
+
+	// 客户端通过X-Kiro-Timeout-Ms指定超时的上限（MAX_CLIENT_TIMEOUT）
+	maxClientTimeout = NewMaxClientTimeoutFromEnv()
+
+	// 同一会话的新流取消旧流（默认关闭）
+	conversationStreams = NewConversationStreamsFromEnv()
+
+	// 客户端填充的占位文本（PLACEHOLDER_PHRASES / PLACEHOLDER_PATTERN）
+	placeholderPolicy = NewPlaceholderPolicyFromEnv()
+
+	// 流式响应中按间隔下发中间usage（STREAM_USAGE_INTERVAL，默认关闭）
+	streamUsageInterval = NewStreamUsageIntervalFromEnv()
+
+	// 流式响应的心跳形式：ping事件或SSE注释（HEARTBEAT_STYLE，默认ping）
+	heartbeatStyle = NewHeartbeatStyleFromEnv()
+
+	// 流式响应的下发队列与慢客户端判定（SLOW_CLIENT_GRACE）
+	slowClientGrace = NewSlowClientGraceFromEnv()
+
+	// 单请求额度预算（MAX_CREDITS_PER_REQUEST / COST_GUARD_MODE，默认关闭）
+	costGuard = NewCostGuardPolicyFromEnv()
+
+	// 按路由统计并发与耗时，可选全局并发上限（MAX_INFLIGHT）
+	routeMetrics = NewRouteMetricsFromEnv()
+
+	// 每个客户端IP/令牌的并发连接上限（MAX_CONNECTIONS_PER_IP / MAX_CONNECTIONS_PER_TOKEN，默认不限制）
+	connectionLimiter = NewConnectionLimiterFromEnv()
+
+	// 并发名额用完时按客户端密钥加权公平排队（FAIR_QUEUE_MAX_CONCURRENT / FAIR_QUEUE_KEY_WEIGHTS，默认关闭）
+	fairQueue = NewFairQueueFromEnv()
+
+	// 客户端可见usage中output_tokens的来源（TOKEN_ACCOUNTING_SOURCE，默认estimator）
+	tokenAccountingSource = NewTokenAccountingSourceFromEnv()
+	reconciliationPolicy = NewReconciliationPolicyFromEnv()
+
+	// 账号池总额度和剩余可用时长告警（POOL_MIN_CREDITS / POOL_MIN_RUNWAY_HOURS，默认关闭）
+	poolAlerts = NewPoolAlertPolicyFromEnv()
+
+	// 按cache_control断点估算usage中的提示词缓存token（PROMPT_CACHE_ESTIMATION，默认关闭）
+	promptCacheEstimator = NewPromptCacheEstimatorFromEnv()
+
+	// 是否允许请求通过X-Selection-Strategy头覆盖token选择策略（SELECTION_STRATEGY_OVERRIDE，默认关闭）
+	selectionStrategyOverride = NewSelectionStrategyOverrideFromEnv()
+
+	// 配置接口返回凭据的方式（CONFIG_SECRET_POLICY，默认脱敏）
+	configSecretPolicy = NewConfigSecretPolicyFromEnv()
+
+	// 上游流没有产生任何内容时是否换下一个token重试一次（EMPTY_STREAM_RETRY，默认关闭）
+	emptyStreamRetry = NewEmptyStreamRetryFromEnv()
+
+	// 上游请求结果计入token健康评分，用于选择token；估算token按账号计入对账统计；失败计入账号错误记录；空流重试从中获取下一个token
+	if authService != nil {
+		tokenHealth = authService.GetTokenManager()
+		tokenAccounting = authService.GetTokenManager()
+		tokenErrors = authService.GetTokenManager()
+		nextTokens = authService
+		// PUT /api/config 整体应用配置后重新加载，无需重启
+		configReload = authService
+		// GET /api/status 统计账号池大小
+		statusPool = authService
+	}
+
 	r := gin.New()
+	// 可信反向代理（TRUSTED_PROXIES），默认不信任任何代理，c.ClientIP()返回直连地址
+	configureTrustedProxies(r, NewTrustedProxiesFromEnv())
 
 	// 添加中间件
-	r.Use(gin.Logger())
+	// 访问日志：默认每个请求一行结构化JSON，ACCESS_LOG_FORMAT=text 使用gin默认格式
+	if accessLog := AccessLogMiddleware(AccessLogFormatFromEnv()); accessLog != nil {
+		r.Use(accessLog)
+	}
 	r.Use(gin.Recovery())
 	// 注入请求ID，便于日志追踪
 	r.Use(RequestIDMiddleware())
-	r.Use(corsMiddleware())
+	// 按路由模板统计请求，超过MAX_INFLIGHT时返回503
+	r.Use(RouteMetricsMiddleware())
+	// 按Accept-Encoding压缩响应（SSE需额外开启SSE_COMPRESSION）
+	r.Use(CompressionMiddleware())
+	// 跨域策略：/v1 默认允许任意来源，/api 等管理端点默认仅同源（CORS_*）
+	r.Use(CORSMiddleware(NewCORSConfigFromEnv()))
 	// 只对 /v1 开头的端点进行认证
 	r.Use(PathBasedAuthMiddleware(authToken, []string{"/v1"}))
+	// 携带管理令牌的请求可通过 X-Kiro-Log-Content 覆盖 LOG_CONTENT_POLICY
+	r.Use(LogContentOverrideMiddleware(NewAdminTokenFromEnv(authToken)))
+	// 认证之后按客户端IP和令牌限制并发连接，超过时返回429
+	r.Use(ConnectionLimitMiddleware())
+	// 转发到上游前按客户端密钥加权公平排队，排队超时返回503
+	r.Use(FairQueueMiddleware())
 
 	// 静态资源服务 - 前后端完全分离
 	r.Static("/static", "./static")
@@ -49,230 +281,56 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 
 	// API端点 - 纯数据服务
 	r.GET("/api/tokens", handleTokenPoolAPI)
-
-	// 配置管理API端点
-	r.GET("/api/config", handleGetConfig)
-	r.POST("/api/config", handleAddConfig)
-	r.PUT("/api/config/:index", handleUpdateConfig)
-	r.DELETE("/api/config/:index", handleDeleteConfig)
-	r.POST("/api/config/import", handleImportConfig)
+	r.GET("/api/tokens/summary", handleTokenPoolSummary)
+	r.GET("/api/tokens/export", handleTokenExport)
+	r.HEAD("/api/tokens/export", handleTokenExport)
+	// 显式刷新会请求上游，与配置管理API相同：可限制客户端IP（ADMIN_IP_ALLOWLIST），需要管理令牌（ADMIN_TOKEN）
+	r.POST("/api/tokens/:index/refresh", AdminIPAllowlistMiddleware(NewAdminIPAllowlistFromEnv()), AdminAuthMiddleware(NewAdminTokenFromEnv(authToken)), handleRefreshTokenStatus)
+	r.GET("/api/tokens/:index/errors", handleTokenErrors)
+	r.GET("/api/tokens/estimation-accuracy", handleEstimationAccuracy)
+	r.GET("/api/requests/:request_id", handleGetRequestAttribution)
+	r.GET("/api/stats", handleStreamStatsAPI)
+	r.GET("/api/status", handleStatusAPI)
+	r.GET("/api/reports/reconciliation", handleReconciliationReports)
+	r.GET("/api/keys/usage", handleKeysUsage)
+	r.GET("/metrics", handleMetrics)
+	// 管理API的OpenAPI文档，路由登记见 managementOperations
+	r.GET("/api/openapi.json", handleOpenAPISpec)
+
+	// 配置管理API端点：读写凭据，可限制客户端IP（ADMIN_IP_ALLOWLIST）
+	configAPI := r.Group("/api/config", AdminIPAllowlistMiddleware(NewAdminIPAllowlistFromEnv()))
+	// 凭据默认脱敏（CONFIG_SECRET_POLICY），?reveal=true需要管理令牌
+	configAPI.GET("", ConfigRevealMiddleware(NewAdminTokenFromEnv(authToken)), handleGetConfig)
+	configAPI.GET("/source", handleGetConfigSource)
+	configAPI.POST("", handleAddConfig)
+	configAPI.PUT("/:index", handleUpdateConfig)
+	// 整体替换为期望配置列表，需要管理令牌（ADMIN_TOKEN）
+	configAPI.PUT("", AdminAuthMiddleware(NewAdminTokenFromEnv(authToken)), handleApplyConfig)
+	configAPI.DELETE("/:index", handleDeleteConfig)
+	configAPI.POST("/:index/clone", handleCloneConfig)
+	configAPI.POST("/import", handleImportConfig)
+	configAPI.POST("/probe", handleProbeConfig)
+	// 原始用量响应含账号信息，需要管理令牌（ADMIN_TOKEN）
+	configAPI.GET("/:index/usage/raw", AdminAuthMiddleware(NewAdminTokenFromEnv(authToken)), handleRawUsageLimits)
+	// 账号最近的失败记录，与 /api/tokens/:index/errors 相同，便于在配置页决定是否禁用账号
+	configAPI.GET("/:index/errors", handleTokenErrors)
+
+	// 模型映射校验API端点：每次校验都向上游发送真实请求，需要管理令牌（ADMIN_TOKEN）
+	r.POST("/api/models/validate", AdminAuthMiddleware(NewAdminTokenFromEnv(authToken)), handleValidateModels(authService))
 
 	// GET /v1/models 端点
-	r.GET("/v1/models", func(c *gin.Context) {
-		// 构建模型列表
-		models := []types.Model{}
-		for anthropicModel := range config.ModelMap {
-			model := types.Model{
-				ID:          anthropicModel,
-				Object:      "model",
-				Created:     1234567890,
-				OwnedBy:     "anthropic",
-				DisplayName: anthropicModel,
-				Type:        "text",
-				MaxTokens:   200000,
-			}
-			models = append(models, model)
-		}
-
-		response := types.ModelsResponse{
-			Object: "list",
-			Data:   models,
-		}
-
-		c.JSON(http.StatusOK, response)
-	})
+	r.GET("/v1/models", handleModels)
 
-	r.POST("/v1/messages", func(c *gin.Context) {
-		// 使用RequestContext统一处理token获取和请求体读取
-		reqCtx := &RequestContext{
-			GinContext:  c,
-			AuthService: authService,
-			RequestType: "Anthropic",
-		}
-
-		tokenWithUsage, body, err := reqCtx.GetTokenWithUsageAndBody()
-		if err != nil {
-			return // 错误已在GetTokenWithUsageAndBody中处理
-		}
-
-		// 先解析为通用map以便处理工具格式
-		var rawReq map[string]any
-		if err := utils.SafeUnmarshal(body, &rawReq); err != nil {
-			logger.Error("解析请求体失败", logger.Err(err))
-			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
-			return
-		}
-
-		// 标准化工具格式处理
-		if tools, exists := rawReq["tools"]; exists && tools != nil {
-			if toolsArray, ok := tools.([]any); ok {
-				normalizedTools := make([]map[string]any, 0, len(toolsArray))
-				for _, tool := range toolsArray {
-					if toolMap, ok := tool.(map[string]any); ok {
-						// 检查是否是简化的工具格式（直接包含name, description, input_schema）
-						if name, hasName := toolMap["name"]; hasName {
-							if description, hasDesc := toolMap["description"]; hasDesc {
-								if inputSchema, hasSchema := toolMap["input_schema"]; hasSchema {
-									// 转换为标准Anthropic工具格式
-									normalizedTool := map[string]any{
-										"name":         name,
-										"description":  description,
-										"input_schema": inputSchema,
-									}
-									normalizedTools = append(normalizedTools, normalizedTool)
-									continue
-								}
-							}
-						}
-						// 如果不是简化格式，保持原样
-						normalizedTools = append(normalizedTools, toolMap)
-					}
-				}
-				rawReq["tools"] = normalizedTools
-			}
-		}
-
-		// 重新序列化并解析为AnthropicRequest
-		normalizedBody, err := utils.SafeMarshal(rawReq)
-		if err != nil {
-			logger.Error("重新序列化请求失败", logger.Err(err))
-			respondError(c, http.StatusBadRequest, "处理请求格式失败: %v", err)
-			return
-		}
-
-		var anthropicReq types.AnthropicRequest
-		if err := utils.SafeUnmarshal(normalizedBody, &anthropicReq); err != nil {
-			logger.Error("解析标准化请求体失败", logger.Err(err))
-			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
-			return
-		}
-
-		// 验证请求的有效性
-		if len(anthropicReq.Messages) == 0 {
-			logger.Error("请求中没有消息")
-			respondError(c, http.StatusBadRequest, "%s", "messages 数组不能为空")
-			return
-		}
-
-		// 验证最后一条消息有有效内容
-		lastMsg := anthropicReq.Messages[len(anthropicReq.Messages)-1]
-		content, err := utils.GetMessageContent(lastMsg.Content)
-		if err != nil {
-			logger.Error("获取消息内容失败",
-				logger.Err(err),
-				logger.String("raw_content", fmt.Sprintf("%v", lastMsg.Content)))
-			respondError(c, http.StatusBadRequest, "获取消息内容失败: %v", err)
-			return
-		}
-
-		trimmedContent := strings.TrimSpace(content)
-		if trimmedContent == "" || trimmedContent == "answer for user question" {
-			logger.Error("消息内容为空或无效",
-				logger.String("content", content),
-				logger.String("trimmed_content", trimmedContent))
-			respondError(c, http.StatusBadRequest, "%s", "消息内容不能为空")
-			return
-		}
-
-		if anthropicReq.Stream {
-			handleStreamRequest(c, anthropicReq, tokenWithUsage)
-			return
-		}
-
-		handleNonStreamRequest(c, anthropicReq, tokenWithUsage.TokenInfo)
-	})
+	r.POST("/v1/messages", handleMessages(authService))
 
 	// Token计数端点
 	r.POST("/v1/messages/count_tokens", handleCountTokens)
 
 	// 新增：OpenAI兼容的 /v1/chat/completions 端点
-	r.POST("/v1/chat/completions", func(c *gin.Context) {
-		// 使用RequestContext统一处理token获取和请求体读取
-		reqCtx := &RequestContext{
-			GinContext:  c,
-			AuthService: authService,
-			RequestType: "OpenAI",
-		}
-
-		tokenInfo, body, err := reqCtx.GetTokenAndBody()
-		if err != nil {
-			return // 错误已在GetTokenAndBody中处理
-		}
-
-		var openaiReq types.OpenAIRequest
-		if err := utils.SafeUnmarshal(body, &openaiReq); err != nil {
-			logger.Error("解析OpenAI请求体失败", logger.Err(err))
-			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
-			return
-		}
-
-		logger.Debug("OpenAI请求解析成功",
-			logger.String("model", openaiReq.Model),
-			logger.Bool("stream", openaiReq.Stream != nil && *openaiReq.Stream),
-			logger.Int("max_tokens", func() int {
-				if openaiReq.MaxTokens != nil {
-					return *openaiReq.MaxTokens
-				}
-				return 16384
-			}()))
-
-		// 转换为Anthropic格式
-		anthropicReq := converter.ConvertOpenAIToAnthropic(openaiReq)
-
-		if anthropicReq.Stream {
-			handleOpenAIStreamRequest(c, anthropicReq, tokenInfo)
-			return
-		}
-		handleOpenAINonStreamRequest(c, anthropicReq, tokenInfo)
-	})
+	r.POST("/v1/chat/completions", handleChatCompletions(authService))
 
-	r.NoRoute(func(c *gin.Context) {
-		logger.Warn("访问未知端点",
-			logger.String("path", c.Request.URL.Path),
-			logger.String("method", c.Request.Method))
-		respondError(c, http.StatusNotFound, "%s", "404 未找到")
-	})
-
-	logger.Info("启动Anthropic API代理服务器",
-		logger.String("port", port),
-		logger.String("auth_token", "***"))
-	logger.Info("AuthToken 验证已启用")
-	logger.Info("可用端点:")
-	logger.Info("  GET  /                          - 重定向到静态Dashboard")
-	logger.Info("  GET  /static/*                  - 静态资源服务")
-	logger.Info("  GET  /api/tokens                - Token池状态API")
-	logger.Info("  GET  /v1/models                 - 模型列表")
-	logger.Info("  POST /v1/messages               - Anthropic API代理")
-	logger.Info("  POST /v1/messages/count_tokens  - Token计数接口")
-	logger.Info("  POST /v1/chat/completions       - OpenAI API代理")
-	logger.Info("按Ctrl+C停止服务器")
-
-	// 创建自定义HTTP服务器以支持长时间请求
-	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: r,
-	}
+	// 未知路径和方法不匹配：/v1 下返回Anthropic/OpenAI格式的404/405
+	registerFallbackHandlers(r)
 
-	logger.Info("启动HTTP服务器", logger.String("port", port))
-
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		logger.Error("启动服务器失败", logger.Err(err), logger.String("port", port))
-		os.Exit(1)
-	}
-}
-
-// corsMiddleware CORS中间件
-func corsMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, x-api-key")
-
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(http.StatusOK)
-			return
-		}
-
-		c.Next()
-	}
+	return r, nil
 }
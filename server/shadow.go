@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 影子请求携带的请求头
+const (
+	HeaderShadow   = "X-Kiro-Shadow"    // 固定为 "true"，目标实例据此识别影子流量
+	HeaderShadowOf = "X-Kiro-Shadow-Of" // 主请求的请求ID，便于离线对照
+)
+
+const (
+	defaultShadowSampleRate = 0.1
+	defaultShadowTimeout    = 2 * time.Minute
+	// defaultShadowMaxInflight 同时进行的影子请求上限，超出时丢弃本次采样，避免堆积影响主服务
+	defaultShadowMaxInflight = 16
+	// shadowMaxResponseBytes 读取影子响应的上限
+	shadowMaxResponseBytes = 8 << 20
+)
+
+// shadowStrippedBodyFields 影子副本中移除的请求体字段（客户端身份）
+var shadowStrippedBodyFields = []string{"metadata"}
+
+// ShadowPolicy 将抽样的非流式 /v1/messages 请求异步镜像到影子实例，并对比两边的响应
+type ShadowPolicy struct {
+	URL        string        // 影子实例的完整地址（如 https://staging.example.com/v1/messages）
+	SampleRate float64       // 抽样比例（0~1]
+	APIKey     string        // 发往影子实例时使用的密钥，不转发客户端的密钥
+	Timeout    time.Duration // 单个影子请求的超时
+
+	client   *http.Client
+	random   func() float64 // [0,1)随机数源（测试可替换）
+	slots    chan struct{}  // 并发名额
+	inflight atomic.Int64   // 进行中的影子请求数
+
+	stats ShadowStats
+}
+
+// ShadowStats 影子请求统计
+type ShadowStats struct {
+	Sampled        atomic.Int64 // 抽中并发出的影子请求
+	Dropped        atomic.Int64 // 抽中但因并发上限被丢弃
+	Failed         atomic.Int64 // 网络错误或超时
+	Completed      atomic.Int64 // 收到影子响应
+	StatusMismatch atomic.Int64 // 状态码不一致
+	StopMismatch   atomic.Int64 // stop_reason不一致
+}
+
+// shadowTraffic 全局影子请求策略，nil表示未启用（测试可替换）
+var shadowTraffic *ShadowPolicy
+
+// shadowLogSink 输出一条影子请求对比日志（测试可替换）
+var shadowLogSink = func(fields []logger.Field) {
+	logger.Info("影子请求对比结果", fields...)
+}
+
+// NewShadowPolicy 创建影子请求策略
+func NewShadowPolicy(url string, sampleRate float64, apiKey string, timeout time.Duration) *ShadowPolicy {
+	return &ShadowPolicy{
+		URL:        url,
+		SampleRate: sampleRate,
+		APIKey:     apiKey,
+		Timeout:    timeout,
+		client:     &http.Client{Timeout: timeout},
+		random:     rand.Float64,
+		slots:      make(chan struct{}, defaultShadowMaxInflight),
+	}
+}
+
+// NewShadowPolicyFromEnv SHADOW_URL 非空时启用，否则返回nil
+// SHADOW_SAMPLE_RATE: 抽样比例（默认0.1，范围(0,1]）
+// SHADOW_API_KEY: 发往影子实例的密钥（可选）
+// SHADOW_TIMEOUT: 影子请求超时（Go duration格式或秒数，默认2m）
+func NewShadowPolicyFromEnv() *ShadowPolicy {
+	url := strings.TrimSpace(os.Getenv("SHADOW_URL"))
+	if url == "" {
+		return nil
+	}
+
+	sampleRate := defaultShadowSampleRate
+	if value := strings.TrimSpace(os.Getenv("SHADOW_SAMPLE_RATE")); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed > 0 && parsed <= 1 {
+			sampleRate = parsed
+		} else {
+			logger.Warn("SHADOW_SAMPLE_RATE无效，使用默认值",
+				logger.String("value", value),
+				logger.Float64("default", defaultShadowSampleRate))
+		}
+	}
+
+	timeout := defaultShadowTimeout
+	if value := strings.TrimSpace(os.Getenv("SHADOW_TIMEOUT")); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			timeout = time.Duration(seconds) * time.Second
+		} else if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			timeout = parsed
+		} else {
+			logger.Warn("SHADOW_TIMEOUT无效，使用默认值", logger.String("value", value))
+		}
+	}
+
+	logger.Info("已启用影子请求",
+		logger.String("url", url),
+		logger.Float64("sample_rate", sampleRate),
+		logger.Duration("timeout", timeout))
+	return NewShadowPolicy(url, sampleRate, strings.TrimSpace(os.Getenv("SHADOW_API_KEY")), timeout)
+}
+
+// shadowCaptureWriter 记录主响应的响应体，供影子请求对比
+type shadowCaptureWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *shadowCaptureWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *shadowCaptureWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Wrap 按抽样比例决定是否镜像本次请求；抽中时记录主响应并返回在主响应写出后调用的函数，否则返回nil
+func (p *ShadowPolicy) Wrap(c *gin.Context, body []byte) func() {
+	if p == nil || p.random() >= p.SampleRate {
+		return nil
+	}
+
+	capture := &shadowCaptureWriter{ResponseWriter: c.Writer}
+	c.Writer = capture
+	requestID := GetRequestID(c)
+	anthropicVersion := c.GetHeader("anthropic-version")
+
+	return func() {
+		c.Writer = capture.ResponseWriter
+		primary := shadowResponse{Status: capture.Status()}
+		primary.parse(capture.body.Bytes())
+
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			p.stats.Dropped.Add(1)
+			logger.Debug("影子请求并发已满，丢弃本次采样", logger.String("request_id", requestID))
+			return
+		}
+		p.stats.Sampled.Add(1)
+		p.inflight.Add(1)
+		go func() {
+			defer func() {
+				<-p.slots
+				p.inflight.Add(-1)
+			}()
+			p.mirror(requestID, anthropicVersion, body, primary)
+		}()
+	}
+}
+
+// shadowResponse 用于对比的响应摘要
+type shadowResponse struct {
+	Status        int
+	StopReason    string
+	ContentLength int // 文本块和工具输入的总长度
+}
+
+// parse 从Anthropic响应体提取stop_reason和内容长度，无法解析时保持零值
+func (r *shadowResponse) parse(body []byte) {
+	var resp struct {
+		StopReason string `json:"stop_reason"`
+		Content    []struct {
+			Text  string          `json:"text"`
+			Input json.RawMessage `json:"input"`
+		} `json:"content"`
+	}
+	if err := utils.SafeUnmarshal(body, &resp); err != nil {
+		return
+	}
+	r.StopReason = resp.StopReason
+	for _, block := range resp.Content {
+		r.ContentLength += len(block.Text) + len(block.Input)
+	}
+}
+
+// mirror 发送影子请求并记录与主响应的差异
+func (p *ShadowPolicy) mirror(requestID, anthropicVersion string, body []byte, primary shadowResponse) {
+	fields := []logger.Field{
+		logger.String("request_id", requestID),
+		logger.String("shadow_url", p.URL),
+		logger.Int("primary_status", primary.Status),
+		logger.String("primary_stop_reason", primary.StopReason),
+	}
+
+	shadowBody, err := buildShadowBody(body)
+	if err != nil {
+		p.stats.Failed.Add(1)
+		shadowLogSink(append(fields, logger.Err(err)))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(shadowBody))
+	if err != nil {
+		p.stats.Failed.Add(1)
+		shadowLogSink(append(fields, logger.Err(err)))
+		return
+	}
+	// 只设置必要的请求头：不转发客户端的密钥、IP和其他身份信息
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderShadow, "true")
+	if requestID != "" {
+		req.Header.Set(HeaderShadowOf, requestID)
+	}
+	if anthropicVersion != "" {
+		req.Header.Set("anthropic-version", anthropicVersion)
+	}
+	if p.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+
+	startedAt := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.stats.Failed.Add(1)
+		shadowLogSink(append(fields, logger.Duration("latency", time.Since(startedAt)), logger.Err(err)))
+		return
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, shadowMaxResponseBytes))
+	p.stats.Completed.Add(1)
+
+	shadow := shadowResponse{Status: resp.StatusCode}
+	shadow.parse(respBody)
+
+	statusMatch := shadow.Status == primary.Status
+	stopMatch := shadow.StopReason == primary.StopReason
+	if !statusMatch {
+		p.stats.StatusMismatch.Add(1)
+	}
+	if !stopMatch {
+		p.stats.StopMismatch.Add(1)
+	}
+
+	shadowLogSink(append(fields,
+		logger.Int("shadow_status", shadow.Status),
+		logger.Bool("status_match", statusMatch),
+		logger.String("shadow_stop_reason", shadow.StopReason),
+		logger.Bool("stop_reason_match", stopMatch),
+		logger.Int("primary_content_length", primary.ContentLength),
+		logger.Int("shadow_content_length", shadow.ContentLength),
+		logger.Int("content_length_delta", shadow.ContentLength-primary.ContentLength),
+		logger.Duration("latency", time.Since(startedAt))))
+}
+
+// buildShadowBody 复制请求体，移除客户端身份字段
+func buildShadowBody(body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := utils.SafeUnmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	for _, name := range shadowStrippedBodyFields {
+		delete(fields, name)
+	}
+	return utils.SafeMarshal(fields)
+}
+
+// Stats 返回影子请求统计快照（/api/stats），未启用时返回nil
+func (p *ShadowPolicy) Stats() gin.H {
+	if p == nil {
+		return nil
+	}
+	return gin.H{
+		"url":             p.URL,
+		"sample_rate":     p.SampleRate,
+		"sampled":         p.stats.Sampled.Load(),
+		"dropped":         p.stats.Dropped.Load(),
+		"failed":          p.stats.Failed.Load(),
+		"completed":       p.stats.Completed.Load(),
+		"status_mismatch": p.stats.StatusMismatch.Load(),
+		"stop_mismatch":   p.stats.StopMismatch.Load(),
+		"in_flight":       p.inflight.Load(),
+	}
+}
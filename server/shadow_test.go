@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shadowTargetRequest 影子目标收到的请求
+type shadowTargetRequest struct {
+	Header http.Header
+	Body   map[string]any
+}
+
+// newShadowTarget 模拟影子实例：等待release关闭后返回response，收到的请求写入received
+func newShadowTarget(t *testing.T, status int, response string) (url string, received chan shadowTargetRequest, release chan struct{}) {
+	t.Helper()
+	received = make(chan shadowTargetRequest, 4)
+	release = make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var parsed map[string]any
+		_ = json.Unmarshal(body, &parsed)
+		received <- shadowTargetRequest{Header: r.Header.Clone(), Body: parsed}
+		<-release
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(target.Close)
+	return target.URL + "/v1/messages", received, release
+}
+
+// captureShadowLogs 收集影子对比日志
+func captureShadowLogs(t *testing.T) chan map[string]any {
+	t.Helper()
+	entries := make(chan map[string]any, 4)
+	original := shadowLogSink
+	shadowLogSink = func(fields []logger.Field) {
+		entry := make(map[string]any, len(fields))
+		for _, f := range fields {
+			entry[f.Key] = f.Value
+		}
+		entries <- entry
+	}
+	t.Cleanup(func() { shadowLogSink = original })
+	return entries
+}
+
+func newShadowTestPolicy(url string, sampleRate, draw float64) *ShadowPolicy {
+	policy := NewShadowPolicy(url, sampleRate, "shadow-key", 5*time.Second)
+	policy.random = func() float64 { return draw }
+	return policy
+}
+
+const shadowClientBody = `{"model":"claude-sonnet-4-20250514","max_tokens":100,"metadata":{"user_id":"client-user-42"},"messages":[{"role":"user","content":"hello"}]}`
+
+func TestShadow_MirrorsSampledRequestAsyncAndLogsDiff(t *testing.T) {
+	newTextDeltaUpstream(t, "Hello from primary.")
+	url, received, release := newShadowTarget(t, http.StatusOK,
+		`{"type":"message","stop_reason":"max_tokens","content":[{"type":"text","text":"Hello"}]}`)
+	logs := captureShadowLogs(t)
+	policy := newShadowTestPolicy(url, 0.5, 0.2)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", strings.NewReader(shadowClientBody))
+	c.Request.Header.Set("x-api-key", "client-secret")
+	c.Request.Header.Set("Authorization", "Bearer client-secret")
+	c.Request.Header.Set("X-Forwarded-For", "203.0.113.7")
+	c.Request.Header.Set("anthropic-version", "2023-06-01")
+	c.Set("request_id", "req_primary")
+
+	mirror := policy.Wrap(c, []byte(shadowClientBody))
+	require.NotNil(t, mirror, "抽中时应返回镜像函数")
+	handleNonStreamRequest(newTestScope(c, newStopTestRequest(false)))
+
+	// 影子目标仍未响应，主请求不受影响
+	done := make(chan struct{})
+	go func() {
+		mirror()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("镜像函数不应等待影子请求完成")
+	}
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Hello from primary.")
+
+	var shadowReq shadowTargetRequest
+	select {
+	case shadowReq = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("影子目标未收到请求")
+	}
+	assert.Equal(t, "true", shadowReq.Header.Get(HeaderShadow))
+	assert.Equal(t, "req_primary", shadowReq.Header.Get(HeaderShadowOf))
+	assert.Equal(t, "Bearer shadow-key", shadowReq.Header.Get("Authorization"), "客户端密钥应被替换")
+	assert.Empty(t, shadowReq.Header.Get("x-api-key"))
+	assert.Empty(t, shadowReq.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "2023-06-01", shadowReq.Header.Get("anthropic-version"))
+	assert.NotContains(t, shadowReq.Body, "metadata", "客户端身份字段应被移除")
+	assert.Equal(t, "claude-sonnet-4-20250514", shadowReq.Body["model"])
+
+	assert.Equal(t, int64(1), policy.inflight.Load())
+	close(release)
+
+	var entry map[string]any
+	select {
+	case entry = <-logs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("未记录影子对比日志")
+	}
+	assert.Equal(t, "req_primary", entry["request_id"])
+	assert.Equal(t, http.StatusOK, entry["primary_status"])
+	assert.Equal(t, http.StatusOK, entry["shadow_status"])
+	assert.Equal(t, true, entry["status_match"])
+	assert.Equal(t, "end_turn", entry["primary_stop_reason"])
+	assert.Equal(t, "max_tokens", entry["shadow_stop_reason"])
+	assert.Equal(t, false, entry["stop_reason_match"])
+	assert.Equal(t, len("Hello from primary."), entry["primary_content_length"])
+	assert.Equal(t, len("Hello")-len("Hello from primary."), entry["content_length_delta"])
+
+	assert.Eventually(t, func() bool { return policy.inflight.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+	stats := policy.Stats()
+	assert.Equal(t, int64(1), stats["sampled"])
+	assert.Equal(t, int64(1), stats["completed"])
+	assert.Equal(t, int64(0), stats["status_mismatch"])
+	assert.Equal(t, int64(1), stats["stop_mismatch"])
+}
+
+func TestShadow_Sampling(t *testing.T) {
+	var nilPolicy *ShadowPolicy
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	assert.Nil(t, nilPolicy.Wrap(c, []byte(shadowClientBody)), "未启用时不镜像")
+	assert.Nil(t, nilPolicy.Stats())
+
+	assert.Nil(t, newShadowTestPolicy("http://127.0.0.1:1", 0.5, 0.7).Wrap(c, []byte(shadowClientBody)), "未抽中")
+	assert.NotNil(t, newShadowTestPolicy("http://127.0.0.1:1", 0.5, 0.3).Wrap(c, []byte(shadowClientBody)), "抽中")
+	assert.NotNil(t, newShadowTestPolicy("http://127.0.0.1:1", 1, 0.999).Wrap(c, []byte(shadowClientBody)), "比例为1时全部抽中")
+}
+
+func TestShadow_CountsFailures(t *testing.T) {
+	logs := captureShadowLogs(t)
+	policy := newShadowTestPolicy("http://127.0.0.1:1/v1/messages", 1, 0)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	mirror := policy.Wrap(c, []byte(shadowClientBody))
+	require.NotNil(t, mirror)
+	c.JSON(http.StatusOK, gin.H{"stop_reason": "end_turn"})
+	mirror()
+
+	select {
+	case entry := <-logs:
+		assert.Contains(t, entry, "error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("未记录影子请求失败")
+	}
+	assert.Eventually(t, func() bool { return policy.Stats()["failed"] == int64(1) }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNewShadowPolicyFromEnv(t *testing.T) {
+	t.Setenv("SHADOW_URL", "")
+	assert.Nil(t, NewShadowPolicyFromEnv())
+
+	t.Setenv("SHADOW_URL", "http://staging:8080/v1/messages")
+	t.Setenv("SHADOW_SAMPLE_RATE", "")
+	t.Setenv("SHADOW_TIMEOUT", "")
+	policy := NewShadowPolicyFromEnv()
+	require.NotNil(t, policy)
+	assert.Equal(t, defaultShadowSampleRate, policy.SampleRate)
+	assert.Equal(t, defaultShadowTimeout, policy.Timeout)
+
+	t.Setenv("SHADOW_SAMPLE_RATE", "0.25")
+	t.Setenv("SHADOW_TIMEOUT", "30")
+	policy = NewShadowPolicyFromEnv()
+	assert.Equal(t, 0.25, policy.SampleRate)
+	assert.Equal(t, 30*time.Second, policy.Timeout)
+
+	t.Setenv("SHADOW_SAMPLE_RATE", "2")
+	assert.Equal(t, defaultShadowSampleRate, NewShadowPolicyFromEnv().SampleRate)
+}
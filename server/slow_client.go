@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrSlowClient 客户端读取过慢，下发队列持续写满超过SLOW_CLIENT_GRACE
+var ErrSlowClient = errors.New("client is reading the stream too slowly")
+
+// slowClientMessage 判定为慢客户端时发送的错误事件内容
+const slowClientMessage = "客户端读取过慢，下发队列持续写满，已结束流式响应并取消上游请求"
+
+// slowClientGrace 下发队列持续写满的容忍时长，<=0表示不使用下发队列（测试可替换）
+var slowClientGrace = config.DefaultSlowClientGrace
+
+// downstreamQueueSize 每个流的下发队列容量（测试可替换）
+var downstreamQueueSize = config.DownstreamQueueSize
+
+// NewSlowClientGraceFromEnv SLOW_CLIENT_GRACE: 慢客户端判定时长（Go duration格式或秒数，默认30s，0表示关闭下发队列）
+func NewSlowClientGraceFromEnv() time.Duration {
+	value := strings.TrimSpace(os.Getenv("SLOW_CLIENT_GRACE"))
+	if value == "" {
+		return config.DefaultSlowClientGrace
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if parsed, err := time.ParseDuration(value); err == nil && parsed >= 0 {
+		return parsed
+	}
+	logger.Warn("SLOW_CLIENT_GRACE无效，使用默认值",
+		logger.String("value", value),
+		logger.Duration("default", config.DefaultSlowClientGrace))
+	return config.DefaultSlowClientGrace
+}
+
+// DownstreamQueueStats 下发队列的全局统计
+type DownstreamQueueStats struct {
+	depth atomic.Int64 // 所有流的下发队列中尚未写出的块数
+	drops atomic.Int64 // 判定为慢客户端而结束的流数
+}
+
+// DownstreamQueueSnapshot 下发队列统计快照
+type DownstreamQueueSnapshot struct {
+	Depth           int64  `json:"depth"`
+	SlowClientDrops int64  `json:"slow_client_drops"`
+	Grace           string `json:"slow_client_grace"`
+}
+
+// downstreamQueueStats 全局下发队列统计
+var downstreamQueueStats = &DownstreamQueueStats{}
+
+// Snapshot 返回当前统计
+func (s *DownstreamQueueStats) Snapshot() DownstreamQueueSnapshot {
+	return DownstreamQueueSnapshot{
+		Depth:           s.depth.Load(),
+		SlowClientDrops: s.drops.Load(),
+		Grace:           slowClientGrace.String(),
+	}
+}
+
+// WritePrometheus 以Prometheus文本格式输出统计
+func (s *DownstreamQueueStats) WritePrometheus(b *strings.Builder) {
+	b.WriteString("# HELP kiro2api_downstream_queue_depth Chunks queued for stream clients but not yet written.\n")
+	b.WriteString("# TYPE kiro2api_downstream_queue_depth gauge\n")
+	fmt.Fprintf(b, "kiro2api_downstream_queue_depth %d\n", s.depth.Load())
+
+	b.WriteString("# HELP kiro2api_slow_client_drops_total Streams terminated because the client could not keep up.\n")
+	b.WriteString("# TYPE kiro2api_slow_client_drops_total counter\n")
+	fmt.Fprintf(b, "kiro2api_slow_client_drops_total %d\n", s.drops.Load())
+}
+
+// slowClientGuard 流式响应的慢客户端保护
+// 上游读取方只把数据放入有界队列，由独立的goroutine写给客户端；队列持续写满超过容忍时长时
+// 取消上游请求并以错误事件结束流，避免慢客户端长期占用上游连接和账号
+type slowClientGuard struct {
+	c      *gin.Context
+	grace  time.Duration
+	cancel context.CancelCauseFunc
+	writer *queuedResponseWriter
+}
+
+// beginSlowClientGuard 为上游请求context增加慢客户端取消，需在发起上游请求之前调用
+// 未启用时返回的guard不做任何处理
+func beginSlowClientGuard(c *gin.Context) *slowClientGuard {
+	if slowClientGrace <= 0 {
+		return &slowClientGuard{}
+	}
+	ctx, cancel := context.WithCancelCause(upstreamContext(c))
+	c.Set(upstreamContextKey, ctx)
+	return &slowClientGuard{c: c, grace: slowClientGrace, cancel: cancel}
+}
+
+// attach 响应头写出后接管c.Writer，之后的写入经由下发队列
+func (g *slowClientGuard) attach() {
+	if g.cancel == nil || g.writer != nil {
+		return
+	}
+	g.writer = newQueuedResponseWriter(g.c.Writer, downstreamQueueSize, g.grace, g.onDrop)
+	g.c.Writer = g.writer
+}
+
+// onDrop 队列持续写满：取消上游请求，并限制后续写出的等待时间
+func (g *slowClientGuard) onDrop() {
+	downstreamQueueStats.drops.Add(1)
+	logger.Warn("客户端读取过慢，结束流式响应（slow-client drop）",
+		addReqFields(g.c,
+			logger.Duration("grace", g.grace),
+			logger.Int("queue_size", cap(g.writer.queue)))...)
+	g.cancel(ErrSlowClient)
+	// 底层连接支持时设置写超时，避免卡住的写入一直阻塞
+	_ = http.NewResponseController(g.writer.ResponseWriter).SetWriteDeadline(time.Now().Add(g.grace))
+}
+
+// finish 等待队列写完并恢复c.Writer；判定为慢客户端时发送错误事件
+// 写出超过容忍时长仍未完成同样按慢客户端处理
+func (g *slowClientGuard) finish(sender StreamEventSender) {
+	if g.cancel == nil {
+		return
+	}
+	defer g.cancel(nil)
+
+	w := g.writer
+	if w == nil {
+		return
+	}
+	w.close()
+	if !w.wait(g.grace) {
+		w.drop()
+		if !w.wait(g.grace) {
+			logger.Warn("慢客户端的写入仍未返回，放弃发送错误事件", addReqFields(g.c)...)
+			return
+		}
+	}
+	g.c.Writer = w.ResponseWriter
+	if w.dropped.Load() {
+		_ = sender.SendError(g.c, slowClientMessage, ErrSlowClient)
+	}
+}
+
+// slowClientDropped 上游请求是否因慢客户端被取消
+func slowClientDropped(c *gin.Context) bool {
+	return errors.Is(context.Cause(upstreamContext(c)), ErrSlowClient)
+}
+
+// queuedResponseWriter 经由有界队列写出的ResponseWriter
+// Write只在队列已满时等待，最多等待grace；写出和刷新由run goroutine完成
+type queuedResponseWriter struct {
+	gin.ResponseWriter
+
+	queue  chan []byte
+	grace  time.Duration
+	onDrop func()
+	done   chan struct{}
+
+	base     int          // 接管前已写出的字节数
+	accepted atomic.Int64 // 接管后放入队列的字节数
+	closed   bool         // 只由写入方goroutine访问
+	dropped  atomic.Bool
+
+	mutex    sync.Mutex
+	writeErr error // 写给客户端失败的错误
+}
+
+func newQueuedResponseWriter(w gin.ResponseWriter, size int, grace time.Duration, onDrop func()) *queuedResponseWriter {
+	qw := &queuedResponseWriter{
+		ResponseWriter: w,
+		queue:          make(chan []byte, size),
+		grace:          grace,
+		onDrop:         onDrop,
+		done:           make(chan struct{}),
+		base:           max(w.Size(), 0),
+	}
+	go qw.run()
+	return qw
+}
+
+func (w *queuedResponseWriter) run() {
+	defer close(w.done)
+	for chunk := range w.queue {
+		downstreamQueueStats.depth.Add(-1)
+		if w.dropped.Load() || w.err() != nil {
+			continue
+		}
+		if _, err := w.ResponseWriter.Write(chunk); err != nil {
+			w.mutex.Lock()
+			w.writeErr = err
+			w.mutex.Unlock()
+			continue
+		}
+		// 队列已空时刷新，积压时合并多次写入
+		if len(w.queue) == 0 {
+			w.ResponseWriter.Flush()
+		}
+	}
+}
+
+func (w *queuedResponseWriter) err() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writeErr
+}
+
+func (w *queuedResponseWriter) Write(p []byte) (int, error) {
+	if w.closed || w.dropped.Load() {
+		return 0, ErrSlowClient
+	}
+	if err := w.err(); err != nil {
+		return 0, err
+	}
+
+	chunk := append([]byte(nil), p...)
+	downstreamQueueStats.depth.Add(1)
+	select {
+	case w.queue <- chunk:
+	default:
+		timer := time.NewTimer(w.grace)
+		defer timer.Stop()
+		select {
+		case w.queue <- chunk:
+		case <-timer.C:
+			downstreamQueueStats.depth.Add(-1)
+			w.drop()
+			return 0, ErrSlowClient
+		}
+	}
+	w.accepted.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func (w *queuedResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush 由run goroutine在队列清空时刷新
+func (w *queuedResponseWriter) Flush() {}
+
+// 接管时响应头已经写出，之后的设置无效
+func (w *queuedResponseWriter) WriteHeader(int) {}
+func (w *queuedResponseWriter) WriteHeaderNow() {}
+func (w *queuedResponseWriter) Written() bool   { return true }
+
+func (w *queuedResponseWriter) Size() int {
+	return w.base + int(w.accepted.Load())
+}
+
+// drop 判定为慢客户端：丢弃队列中尚未写出的数据
+func (w *queuedResponseWriter) drop() {
+	if w.dropped.CompareAndSwap(false, true) {
+		w.onDrop()
+	}
+}
+
+// close 停止接收写入，run goroutine写完剩余数据后退出
+func (w *queuedResponseWriter) close() {
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+}
+
+// wait 等待run goroutine退出，超时返回false
+func (w *queuedResponseWriter) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
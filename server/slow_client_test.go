@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withSlowClientGrace 替换慢客户端判定时长和队列容量，测试结束后恢复
+func withSlowClientGrace(t *testing.T, grace time.Duration, queueSize int) {
+	t.Helper()
+	originalGrace, originalSize := slowClientGrace, downstreamQueueSize
+	slowClientGrace, downstreamQueueSize = grace, queueSize
+	t.Cleanup(func() { slowClientGrace, downstreamQueueSize = originalGrace, originalSize })
+}
+
+// slowResponseWriter 模拟读取极慢的客户端：release关闭之前所有写入都会阻塞
+type slowResponseWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func newSlowResponseWriter() *slowResponseWriter {
+	return &slowResponseWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+}
+
+func (w *slowResponseWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+func (w *slowResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// runWithSlowClient 在后台执行handler，上游被取消后放行客户端写入，返回响应体
+func runWithSlowClient(t *testing.T, cancelled <-chan struct{}, path string, handler func(*gin.Context)) string {
+	t.Helper()
+	w := newSlowResponseWriter()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", path, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler(c)
+	}()
+
+	assertUpstreamCancelled(t, cancelled)
+	close(w.release)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler未结束")
+	}
+	return w.Body.String()
+}
+
+func TestSlowClient_StreamDroppedAndUpstreamCancelled(t *testing.T) {
+	withSlowClientGrace(t, 200*time.Millisecond, 2)
+	drops := downstreamQueueStats.drops.Load()
+	cancelled := newSlowUpstream(t, 0, 5*time.Second, "hello", " world")
+
+	body := runWithSlowClient(t, cancelled, "/v1/messages", func(c *gin.Context) {
+		handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+	})
+
+	assert.Contains(t, body, "event: error")
+	assert.Contains(t, body, slowClientMessage)
+	assert.NotContains(t, body, "message_stop")
+	assert.Equal(t, drops+1, downstreamQueueStats.drops.Load())
+	assert.Zero(t, downstreamQueueStats.depth.Load())
+}
+
+func TestSlowClient_OpenAIStreamDroppedAndUpstreamCancelled(t *testing.T) {
+	// OpenAI流在首个文本增量之前只有一个事件，使用无缓冲队列使第二次写入即开始等待
+	withSlowClientGrace(t, 200*time.Millisecond, 0)
+	cancelled := newSlowUpstream(t, 0, 5*time.Second, "hello", " world")
+
+	body := runWithSlowClient(t, cancelled, "/v1/chat/completions", func(c *gin.Context) {
+		handleOpenAIStreamRequest(newTestScope(c, newStopTestRequest(true)))
+	})
+
+	assert.Contains(t, body, slowClientMessage)
+	assert.NotContains(t, body, "[DONE]")
+}
+
+func TestSlowClient_FastClientReceivesWholeStream(t *testing.T) {
+	withSlowClientGrace(t, time.Second, 2)
+	newSlowUpstream(t, 0, 0, "hello", " world")
+	c, w := newClientTimeoutContext(t, "/v1/messages", "")
+
+	handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+	body := w.Body.String()
+	assert.NotContains(t, body, "event: error")
+	assert.Contains(t, body, "world")
+	assert.Contains(t, body, "message_stop")
+	assert.Zero(t, downstreamQueueStats.depth.Load())
+	// 结束后恢复原始Writer
+	_, queued := c.Writer.(*queuedResponseWriter)
+	assert.False(t, queued)
+}
+
+func TestSlowClient_DisabledWritesDirectly(t *testing.T) {
+	withSlowClientGrace(t, 0, 2)
+	c, _ := newClientTimeoutContext(t, "/v1/messages", "")
+
+	guard := beginSlowClientGuard(c)
+	guard.attach()
+	_, queued := c.Writer.(*queuedResponseWriter)
+	assert.False(t, queued)
+	guard.finish(discardSender{})
+}
+
+func TestSlowClient_Metrics(t *testing.T) {
+	var b strings.Builder
+	downstreamQueueStats.WritePrometheus(&b)
+	assert.Contains(t, b.String(), "kiro2api_downstream_queue_depth ")
+	assert.Contains(t, b.String(), "kiro2api_slow_client_drops_total ")
+}
+
+func TestNewSlowClientGraceFromEnv(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":      30 * time.Second,
+		"5":     5 * time.Second,
+		"500ms": 500 * time.Millisecond,
+		"0":     0,
+		"-1s":   30 * time.Second,
+		"abc":   30 * time.Second,
+	}
+	for value, expected := range cases {
+		t.Setenv("SLOW_CLIENT_GRACE", value)
+		require.Equal(t, expected, NewSlowClientGraceFromEnv(), value)
+	}
+}
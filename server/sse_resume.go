@@ -0,0 +1,381 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseStreamContextKey gin上下文中保存当前SSE流的键
+const sseStreamContextKey = "sse_stream"
+
+// sseStream 一次流式响应已发送的SSE帧
+// 事件ID格式为 "<流ID>:<序号>"，序号从1开始单调递增
+type sseStream struct {
+	id          string
+	fingerprint string          // 请求路径+原始请求体的摘要，续传时必须一致
+	store       *SSEResumeStore // 登记到的续传缓存，续传关闭时为nil
+
+	mutex        sync.Mutex
+	seq          int           // 已分配的最大序号
+	frames       []string      // 第i帧的序号为i+1，保存包含id行的完整帧文本
+	size         int64         // frames的总字节数
+	dropped      bool          // 不再保存帧：续传关闭，或已被淘汰（frames已释放）
+	done         bool          // 原始响应是否已写完
+	notify       chan struct{} // 有新帧或结束时关闭并替换，用于唤醒续传方
+	lastActivity time.Time
+}
+
+// emit 分配下一个事件ID并写出一帧
+// 写入客户端失败（如连接已断开）时帧仍被记录，供续传使用
+func (s *sseStream) emit(c *gin.Context, eventType string, data []byte) {
+	s.mutex.Lock()
+	s.seq++
+	var frame strings.Builder
+	fmt.Fprintf(&frame, "id: %s:%d\n", s.id, s.seq)
+	if eventType != "" {
+		fmt.Fprintf(&frame, "event: %s\n", eventType)
+	}
+	fmt.Fprintf(&frame, "data: %s\n\n", data)
+	text := frame.String()
+	recorded := !s.dropped
+	if recorded {
+		s.frames = append(s.frames, text)
+		s.size += int64(len(text))
+	}
+	s.lastActivity = time.Now()
+	close(s.notify)
+	s.notify = make(chan struct{})
+	s.mutex.Unlock()
+
+	// 计入续传缓存的字节数，超过上限时淘汰（在流的锁之外调用，锁顺序为先缓存后流）
+	if recorded && s.store != nil {
+		s.store.account(s, int64(len(text)))
+	}
+	_, _ = c.Writer.WriteString(text)
+}
+
+// drop 释放已保存的帧并停止保存新帧，唤醒续传方；返回释放的字节数
+func (s *sseStream) drop() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	size := s.size
+	s.frames, s.size, s.dropped = nil, 0, true
+	close(s.notify)
+	s.notify = make(chan struct{})
+	return size
+}
+
+// finish 标记原始响应已写完
+func (s *sseStream) finish() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	s.lastActivity = time.Now()
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// replay 向客户端重发序号大于after的帧；原始响应尚未结束时继续跟随，直到结束或客户端断开
+func (s *sseStream) replay(c *gin.Context, after int) int {
+	cursor := after
+	replayed := 0
+	for {
+		s.mutex.Lock()
+		var pending []string
+		if cursor < len(s.frames) {
+			pending = s.frames[cursor:]
+		}
+		done, notify := s.done || s.dropped, s.notify
+		s.mutex.Unlock()
+
+		for _, frame := range pending {
+			_, _ = c.Writer.WriteString(frame)
+		}
+		cursor += len(pending)
+		replayed += len(pending)
+		c.Writer.Flush()
+
+		if done {
+			return replayed
+		}
+		select {
+		case <-notify:
+		case <-c.Request.Context().Done():
+			return replayed
+		}
+	}
+}
+
+// SSEResumeStore 最近SSE流的短期缓存，支持客户端携带Last-Event-ID重连时续传
+// 缓存的帧按单个流和全部流分别限制字节数：超限的流被淘汰，之后的续传请求返回错误，不做不完整的重放
+type SSEResumeStore struct {
+	mutex          sync.Mutex
+	streams        map[string]*sseStream
+	evicted        map[string]evictedSSEStream // 因超出字节上限被淘汰的流ID，在窗口内拒绝续传
+	window         time.Duration               // 流最后一次活动后保留的时长，0表示不缓存
+	maxStreams     int
+	maxStreamBytes int64 // 单个流缓存的帧字节数上限
+	maxTotalBytes  int64 // 所有流缓存的帧字节数上限
+	totalBytes     int64
+}
+
+// evictedSSEStream 被淘汰流的请求摘要和淘汰时间
+type evictedSSEStream struct {
+	fingerprint string
+	at          time.Time
+}
+
+// sseResumeStore 全局SSE续传缓存
+var sseResumeStore = NewSSEResumeStore(config.SSEResumeWindow)
+
+// NewSSEResumeStore 创建保留window时长的续传缓存
+func NewSSEResumeStore(window time.Duration) *SSEResumeStore {
+	return &SSEResumeStore{
+		streams:        make(map[string]*sseStream),
+		evicted:        make(map[string]evictedSSEStream),
+		window:         window,
+		maxStreams:     config.SSEResumeMaxStreams,
+		maxStreamBytes: config.SSEResumeMaxStreamBytes,
+		maxTotalBytes:  config.SSEResumeMaxTotalBytes,
+	}
+}
+
+// NewSSEResumeStoreFromEnv 根据环境变量创建续传缓存
+// SSE_RESUME_WINDOW_SECONDS: 流结束后可续传的秒数（默认60，0表示关闭续传，事件仍带id）
+func NewSSEResumeStoreFromEnv() *SSEResumeStore {
+	window := config.SSEResumeWindow
+	if value := strings.TrimSpace(os.Getenv("SSE_RESUME_WINDOW_SECONDS")); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			window = time.Duration(seconds) * time.Second
+		} else {
+			logger.Warn("SSE_RESUME_WINDOW_SECONDS无效，使用默认值",
+				logger.String("value", value),
+				logger.Duration("default", config.SSEResumeWindow))
+		}
+	}
+	return NewSSEResumeStore(window)
+}
+
+// Register 为新的流式响应分配流ID并登记
+func (s *SSEResumeStore) Register(fingerprint string) *sseStream {
+	stream := &sseStream{
+		id:           "sse_" + strings.ReplaceAll(utils.GenerateUUID(), "-", ""),
+		fingerprint:  fingerprint,
+		notify:       make(chan struct{}),
+		lastActivity: time.Now(),
+	}
+	if s.window <= 0 {
+		stream.dropped = true
+		return stream
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pruneLocked()
+	stream.store = s
+	s.streams[stream.id] = stream
+	return stream
+}
+
+// account 记录流新保存的帧字节数；单个流超过上限时淘汰该流，总量超过上限时依次淘汰最久未活动的流
+func (s *SSEResumeStore) account(stream *sseStream, n int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.streams[stream.id] != stream {
+		return // 已被淘汰，字节数已在淘汰时扣除
+	}
+	s.totalBytes += n
+
+	stream.mutex.Lock()
+	size := stream.size
+	stream.mutex.Unlock()
+	if s.maxStreamBytes > 0 && size > s.maxStreamBytes {
+		s.evictLocked(stream, "单个流超出续传缓存上限")
+	}
+	for s.maxTotalBytes > 0 && s.totalBytes > s.maxTotalBytes {
+		oldest := s.oldestLocked()
+		if oldest == nil {
+			break
+		}
+		s.evictLocked(oldest, "续传缓存总量超出上限")
+	}
+}
+
+// evictLocked 因字节数超限淘汰流，窗口内的续传请求返回错误
+func (s *SSEResumeStore) evictLocked(stream *sseStream, reason string) {
+	s.removeLocked(stream)
+	s.evicted[stream.id] = evictedSSEStream{fingerprint: stream.fingerprint, at: time.Now()}
+	logger.Warn("SSE流已从续传缓存淘汰",
+		logger.String("stream_id", stream.id),
+		logger.String("reason", reason),
+		logger.Int64("total_bytes", s.totalBytes))
+}
+
+// removeLocked 移除流并释放其保存的帧
+func (s *SSEResumeStore) removeLocked(stream *sseStream) {
+	delete(s.streams, stream.id)
+	s.totalBytes -= stream.drop()
+}
+
+// oldestLocked 返回最久未活动的流
+func (s *SSEResumeStore) oldestLocked() *sseStream {
+	var oldest *sseStream
+	var oldestActivity time.Time
+	for _, stream := range s.streams {
+		stream.mutex.Lock()
+		lastActivity := stream.lastActivity
+		stream.mutex.Unlock()
+		if oldest == nil || lastActivity.Before(oldestActivity) {
+			oldest, oldestActivity = stream, lastActivity
+		}
+	}
+	return oldest
+}
+
+// Evicted 检查流是否因超出字节上限被淘汰，返回其请求摘要
+func (s *SSEResumeStore) Evicted(id string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pruneLocked()
+	evicted, exists := s.evicted[id]
+	return evicted.fingerprint, exists
+}
+
+// Get 按流ID查找仍在续传窗口内的流
+func (s *SSEResumeStore) Get(id string) (*sseStream, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pruneLocked()
+	stream, exists := s.streams[id]
+	return stream, exists
+}
+
+// pruneLocked 淘汰超出窗口的流；数量超限时淘汰最久未活动的流
+func (s *SSEResumeStore) pruneLocked() {
+	now := time.Now()
+	var oldest *sseStream
+	var oldestActivity time.Time
+	for _, stream := range s.streams {
+		stream.mutex.Lock()
+		lastActivity := stream.lastActivity
+		stream.mutex.Unlock()
+
+		if now.Sub(lastActivity) > s.window {
+			s.removeLocked(stream)
+			continue
+		}
+		if oldest == nil || lastActivity.Before(oldestActivity) {
+			oldest, oldestActivity = stream, lastActivity
+		}
+	}
+	if s.maxStreams > 0 && len(s.streams) >= s.maxStreams && oldest != nil {
+		s.removeLocked(oldest)
+	}
+	for id, evicted := range s.evicted {
+		if now.Sub(evicted.at) > s.window {
+			delete(s.evicted, id)
+		}
+	}
+}
+
+// sseRequestFingerprint 按请求路径和客户端发送的原始请求体计算摘要，保证只有相同的请求才能续传
+func sseRequestFingerprint(c *gin.Context) string {
+	body, _ := c.Get(requestBodyContextKey)
+	raw, _ := body.([]byte)
+	sum := sha256.Sum256(append([]byte(c.Request.URL.Path+"\n"), raw...))
+	return hex.EncodeToString(sum[:])
+}
+
+// beginSSEStream 为当前请求登记SSE流，之后经writeSSEFrame发送的事件都会带上id
+func beginSSEStream(c *gin.Context) *sseStream {
+	stream := sseResumeStore.Register(sseRequestFingerprint(c))
+	c.Set(sseStreamContextKey, stream)
+	return stream
+}
+
+// writeSSEFrame 写出一帧SSE事件；当前请求已登记SSE流时附带事件ID
+func writeSSEFrame(c *gin.Context, eventType string, data []byte) {
+	if value, exists := c.Get(sseStreamContextKey); exists {
+		if stream, ok := value.(*sseStream); ok {
+			stream.emit(c, eventType, data)
+			return
+		}
+	}
+
+	if eventType != "" {
+		fmt.Fprintf(c.Writer, "event: %s\n", eventType)
+	}
+	fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+}
+
+// parseSSEEventID 解析 "<流ID>:<序号>" 格式的事件ID
+func parseSSEEventID(eventID string) (string, int, bool) {
+	idx := strings.LastIndex(eventID, ":")
+	if idx <= 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.Atoi(eventID[idx+1:])
+	if err != nil || seq < 0 {
+		return "", 0, false
+	}
+	return eventID[:idx], seq, true
+}
+
+// resumeSSEStream 处理携带Last-Event-ID的重连请求
+// 流仍在续传窗口内且请求一致时，只重发客户端尚未收到的事件并返回true；
+// 流因超出缓存上限被淘汰时返回410错误并返回true；否则返回false，由调用方按新请求处理
+func resumeSSEStream(c *gin.Context) bool {
+	lastEventID := strings.TrimSpace(c.GetHeader("Last-Event-ID"))
+	if lastEventID == "" {
+		return false
+	}
+
+	streamID, seq, ok := parseSSEEventID(lastEventID)
+	if !ok {
+		logger.Debug("无法解析Last-Event-ID，按新请求处理",
+			addReqFields(c, logger.String("last_event_id", lastEventID))...)
+		return false
+	}
+
+	fingerprint := sseRequestFingerprint(c)
+	if evicted, exists := sseResumeStore.Evicted(streamID); exists && evicted == fingerprint {
+		logger.Warn("SSE流已超出续传缓存上限，拒绝续传",
+			addReqFields(c, logger.String("last_event_id", lastEventID))...)
+		respondErrorWithCode(c, http.StatusGone, "resume_unavailable", "SSE流超出续传缓存上限，无法续传，请重新发起请求")
+		return true
+	}
+
+	stream, exists := sseResumeStore.Get(streamID)
+	if !exists || stream.fingerprint != fingerprint {
+		logger.Info("SSE流不可续传（已过期或请求不一致），按新请求处理",
+			addReqFields(c, logger.String("last_event_id", lastEventID))...)
+		return false
+	}
+
+	if err := initializeSSEResponse(c); err != nil {
+		return false
+	}
+
+	replayed := stream.replay(c, seq)
+	logger.Info("SSE重连续传完成",
+		addReqFields(c,
+			logger.String("last_event_id", lastEventID),
+			logger.Int("replayed_events", replayed))...)
+	return true
+}
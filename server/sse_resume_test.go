@@ -0,0 +1,304 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCountingTextUpstream 创建返回文本增量并统计调用次数的假上游
+func newCountingTextUpstream(t *testing.T, deltas ...string) *atomic.Int32 {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusOK)
+		for _, delta := range deltas {
+			_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"` + delta + `"}`))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	return &calls
+}
+
+// withSSEResumeStore 在测试期间使用独立的续传缓存
+func withSSEResumeStore(t *testing.T, window time.Duration) {
+	original := sseResumeStore
+	sseResumeStore = NewSSEResumeStore(window)
+	t.Cleanup(func() { sseResumeStore = original })
+}
+
+// setRawRequestBody 模拟ReadBody保存客户端原始请求体
+func setRawRequestBody(c *gin.Context, body string) {
+	c.Set(requestBodyContextKey, []byte(body))
+}
+
+// splitSSEFrames 按空行拆分SSE帧
+func splitSSEFrames(body string) []string {
+	var frames []string
+	for _, frame := range strings.SplitAfter(body, "\n\n") {
+		if strings.TrimSpace(frame) != "" {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+// sseFrameID 返回帧的id行取值
+func sseFrameID(frame string) string {
+	for _, line := range strings.Split(frame, "\n") {
+		if id, ok := strings.CutPrefix(line, "id: "); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+func TestSSEEventIDs_Monotonic(t *testing.T) {
+	tests := []struct {
+		path   string
+		handle func(c *gin.Context)
+	}{
+		{"/v1/messages", func(c *gin.Context) {
+			handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+		}},
+		{"/v1/chat/completions", func(c *gin.Context) {
+			handleOpenAIStreamRequest(newTestScope(c, newStopTestRequest(true)))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			newCountingTextUpstream(t, "Hello", " world")
+			withSSEResumeStore(t, time.Minute)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", tt.path, nil)
+			tt.handle(c)
+
+			frames := splitSSEFrames(w.Body.String())
+			require.NotEmpty(t, frames)
+
+			var streamID string
+			for i, frame := range frames {
+				id, seq, ok := parseSSEEventID(sseFrameID(frame))
+				require.True(t, ok, "每个事件都应带有id: %q", frame)
+				if i == 0 {
+					streamID = id
+				}
+				assert.Equal(t, streamID, id)
+				assert.Equal(t, i+1, seq)
+			}
+		})
+	}
+}
+
+func TestSSEResume_DoesNotReplayDeliveredContent(t *testing.T) {
+	tests := []struct {
+		path   string
+		handle func(c *gin.Context)
+	}{
+		{"/v1/messages", func(c *gin.Context) {
+			handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+		}},
+		{"/v1/chat/completions", func(c *gin.Context) {
+			handleOpenAIStreamRequest(newTestScope(c, newStopTestRequest(true)))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			calls := newCountingTextUpstream(t, "Hello", " world")
+			withSSEResumeStore(t, time.Minute)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", tt.path, nil)
+			tt.handle(c)
+
+			// 模拟客户端只收到了包含"Hello"的事件就断线
+			frames := splitSSEFrames(w.Body.String())
+			cut := -1
+			for i, frame := range frames {
+				if strings.Contains(frame, `"Hello"`) {
+					cut = i
+					break
+				}
+			}
+			require.GreaterOrEqual(t, cut, 0)
+
+			w = httptest.NewRecorder()
+			c, _ = gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", tt.path, nil)
+			c.Request.Header.Set("Last-Event-ID", sseFrameID(frames[cut]))
+			tt.handle(c)
+
+			assert.Equal(t, int32(1), calls.Load(), "续传不应再次请求上游")
+			assert.Equal(t, strings.Join(frames[cut+1:], ""), w.Body.String())
+			assert.NotContains(t, w.Body.String(), `"Hello"`)
+			assert.Contains(t, w.Body.String(), `" world"`)
+		})
+	}
+}
+
+func TestSSEResume_FallsBackToNewRequest(t *testing.T) {
+	calls := newCountingTextUpstream(t, "Hello")
+	withSSEResumeStore(t, time.Minute)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	setRawRequestBody(c, `{"messages":[{"role":"user","content":"hi"}],"stream":true}`)
+	handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+	lastEventID := sseFrameID(splitSSEFrames(w.Body.String())[0])
+
+	// 原始请求体不同，不能续传其他请求的流（即使处理后的请求相同）
+	for _, lastID := range []string{lastEventID, "sse_unknown:3", "garbage"} {
+		w = httptest.NewRecorder()
+		c, _ = gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+		c.Request.Header.Set("Last-Event-ID", lastID)
+		setRawRequestBody(c, `{"messages":[{"role":"user","content":"something else"}],"stream":true}`)
+		handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+		assert.Contains(t, w.Body.String(), "event: message_start", "无法续传时应按新请求完整响应")
+		assert.NotContains(t, w.Body.String(), lastEventID)
+	}
+	assert.Equal(t, int32(4), calls.Load())
+}
+
+func TestSSEResume_FollowsLiveStream(t *testing.T) {
+	withSSEResumeStore(t, time.Minute)
+	stream := sseResumeStore.Register("fingerprint")
+
+	original, _ := gin.CreateTestContext(httptest.NewRecorder())
+	stream.emit(original, "ping", []byte(`{"type":"ping"}`))
+	stream.emit(original, "first", []byte(`{"n":1}`))
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	replayed := make(chan int)
+	go func() { replayed <- stream.replay(c, 1) }()
+
+	stream.emit(original, "second", []byte(`{"n":2}`))
+	stream.finish()
+
+	select {
+	case n := <-replayed:
+		assert.Equal(t, 2, n)
+	case <-time.After(time.Second):
+		t.Fatal("续传未在原始流结束后返回")
+	}
+	assert.Equal(t, stream.id+":2", sseFrameID(splitSSEFrames(w.Body.String())[0]))
+	assert.Contains(t, w.Body.String(), "event: second\n")
+	assert.NotContains(t, w.Body.String(), "event: ping\n")
+}
+
+func TestSSEResumeStore_WindowAndLimit(t *testing.T) {
+	disabled := NewSSEResumeStore(0)
+	stream := disabled.Register("fingerprint")
+	_, exists := disabled.Get(stream.id)
+	assert.False(t, exists, "窗口为0时不缓存")
+
+	store := NewSSEResumeStore(time.Minute)
+	store.maxStreams = 2
+	first := store.Register("a")
+	first.lastActivity = time.Now().Add(-time.Second)
+	store.Register("b")
+	store.Register("c")
+	_, exists = store.Get(first.id)
+	assert.False(t, exists, "超出数量上限时淘汰最久未活动的流")
+
+	expired := store.Register("d")
+	expired.lastActivity = time.Now().Add(-2 * time.Minute)
+	_, exists = store.Get(expired.id)
+	assert.False(t, exists, "超出窗口的流应被淘汰")
+}
+
+func TestSSEResume_EvictedStreamReturnsError(t *testing.T) {
+	calls := newCountingTextUpstream(t, "Hello", " world")
+	withSSEResumeStore(t, time.Minute)
+	sseResumeStore.maxStreamBytes = 200 // 容纳不下完整响应
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+	frames := splitSSEFrames(w.Body.String())
+	require.Greater(t, len(frames), 2)
+	assert.Contains(t, w.Body.String(), "event: message_stop", "淘汰不影响原始响应")
+	assert.Zero(t, sseResumeStore.totalBytes, "淘汰后释放缓存的帧")
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	c.Request.Header.Set("Last-Event-ID", sseFrameID(frames[0]))
+	handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Contains(t, w.Body.String(), "resume_unavailable")
+	assert.NotContains(t, w.Body.String(), "event:", "不做不完整的重放")
+	assert.Equal(t, int32(1), calls.Load(), "续传失败不应请求上游")
+}
+
+func TestSSEResumeStore_TotalBytesEvictsOldest(t *testing.T) {
+	store := NewSSEResumeStore(time.Minute)
+	store.maxTotalBytes = 400 // 每帧约150字节
+	sink, _ := gin.CreateTestContext(httptest.NewRecorder())
+	payload := []byte(strings.Repeat("x", 100))
+
+	first := store.Register("a")
+	first.emit(sink, "", payload)
+	first.lastActivity = time.Now().Add(-time.Second)
+	second := store.Register("b")
+	second.emit(sink, "", payload)
+	second.emit(sink, "", payload)
+
+	_, exists := store.Get(first.id)
+	assert.False(t, exists, "总量超限时淘汰最久未活动的流")
+	fingerprint, evicted := store.Evicted(first.id)
+	assert.True(t, evicted)
+	assert.Equal(t, "a", fingerprint)
+	_, exists = store.Get(second.id)
+	assert.True(t, exists)
+	assert.Equal(t, second.size, store.totalBytes)
+	assert.LessOrEqual(t, store.totalBytes, store.maxTotalBytes)
+
+	// 淘汰后继续发送的帧不再保存，序号仍然递增
+	first.emit(sink, "", payload)
+	assert.Empty(t, first.frames)
+	assert.Equal(t, 2, first.seq)
+}
+
+func TestParseSSEEventID(t *testing.T) {
+	id, seq, ok := parseSSEEventID("sse_abc:12")
+	assert.True(t, ok)
+	assert.Equal(t, "sse_abc", id)
+	assert.Equal(t, 12, seq)
+
+	for _, invalid := range []string{"", "sse_abc", ":3", "sse_abc:x", "sse_abc:-1"} {
+		_, _, ok := parseSSEEventID(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestNewSSEResumeStoreFromEnv(t *testing.T) {
+	t.Setenv("SSE_RESUME_WINDOW_SECONDS", "0")
+	assert.Equal(t, time.Duration(0), NewSSEResumeStoreFromEnv().window)
+
+	t.Setenv("SSE_RESUME_WINDOW_SECONDS", "120")
+	assert.Equal(t, 120*time.Second, NewSSEResumeStoreFromEnv().window)
+
+	t.Setenv("SSE_RESUME_WINDOW_SECONDS", "invalid")
+	assert.Equal(t, 60*time.Second, NewSSEResumeStoreFromEnv().window)
+}
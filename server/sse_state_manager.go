@@ -3,11 +3,21 @@ package server
 import (
 	"errors"
 	"fmt"
+	"kiro2api/config"
 	"kiro2api/logger"
 
 	"github.com/gin-gonic/gin"
 )
 
+// ErrTooManyOpenBlocks 上游同时打开的内容块超过上限，流无法继续
+var ErrTooManyOpenBlocks = errors.New("同时打开的content_block过多")
+
+// sseInvariantViolation 状态管理器自身发出的事件违反块生命周期不变量时调用
+// 生产环境记录错误日志；测试中替换为直接失败（见main_test.go）
+var sseInvariantViolation = func(c *gin.Context, message string) {
+	logger.Error("SSE块生命周期不变量被破坏", addReqFields(c, logger.String("violation", message))...)
+}
+
 // BlockState 内容块状态
 type BlockState struct {
 	Index     int    `json:"index"`
@@ -18,10 +28,15 @@ type BlockState struct {
 }
 
 // SSEStateManager SSE事件状态管理器，确保事件序列符合Claude规范
+// 只保存已开始且未结束的块，块结束时即释放，长时间、工具调用密集的流占用的内存不随块数增长
 type SSEStateManager struct {
 	messageStarted   bool
-	messageDeltaSent bool // 新增：跟踪message_delta是否已发送
-	activeBlocks     map[int]*BlockState
+	messageDeltaSent bool                // 新增：跟踪message_delta是否已发送
+	activeBlocks     map[int]*BlockState // 已开始且未结束的块
+	closedBlocks     indexRanges         // 已结束块的索引，用于识别重复的stop和结束后的delta
+	startedBlocks    int
+	stoppedBlocks    int
+	maxOpenBlocks    int // 同时打开的块数上限
 	messageEnded     bool
 	nextBlockIndex   int
 	strictMode       bool
@@ -30,8 +45,9 @@ type SSEStateManager struct {
 // NewSSEStateManager 创建SSE状态管理器
 func NewSSEStateManager(strictMode bool) *SSEStateManager {
 	return &SSEStateManager{
-		activeBlocks: make(map[int]*BlockState),
-		strictMode:   strictMode,
+		activeBlocks:  make(map[int]*BlockState),
+		maxOpenBlocks: config.MaxOpenContentBlocks,
+		strictMode:    strictMode,
 	}
 }
 
@@ -41,9 +57,19 @@ func (ssm *SSEStateManager) Reset() {
 	ssm.messageDeltaSent = false // 重置message_delta发送状态
 	ssm.messageEnded = false
 	ssm.activeBlocks = make(map[int]*BlockState)
+	ssm.closedBlocks = nil
+	ssm.startedBlocks = 0
+	ssm.stoppedBlocks = 0
 	ssm.nextBlockIndex = 0
 }
 
+// closeBlock 记录块已结束并释放其状态
+func (ssm *SSEStateManager) closeBlock(index int) {
+	delete(ssm.activeBlocks, index)
+	ssm.closedBlocks.add(index)
+	ssm.stoppedBlocks++
+}
+
 // SendEvent 受控的事件发送，确保符合Claude规范
 func (ssm *SSEStateManager) SendEvent(c *gin.Context, sender StreamEventSender, eventData map[string]any) error {
 	eventType, ok := eventData["type"].(string)
@@ -116,7 +142,7 @@ func (ssm *SSEStateManager) handleContentBlockStart(c *gin.Context, sender Strea
 	}
 
 	// 检查是否重复启动同一块
-	if block, exists := ssm.activeBlocks[index]; exists && block.Started && !block.Stopped {
+	if _, exists := ssm.activeBlocks[index]; exists {
 		errMsg := fmt.Sprintf("违规：索引%d的content_block已经started但未stopped", index)
 		logger.Error(errMsg, logger.Int("block_index", index))
 		if ssm.strictMode {
@@ -124,6 +150,14 @@ func (ssm *SSEStateManager) handleContentBlockStart(c *gin.Context, sender Strea
 		}
 		return nil // 跳过重复的start
 	}
+	if ssm.closedBlocks.contains(index) {
+		errMsg := fmt.Sprintf("违规：索引%d的content_block已结束，不能再次start", index)
+		logger.Error(errMsg, logger.Int("block_index", index))
+		if ssm.strictMode {
+			return errors.New(errMsg)
+		}
+		return nil
+	}
 
 	// 确定块类型
 	blockType := "text"
@@ -162,7 +196,7 @@ func (ssm *SSEStateManager) handleContentBlockStart(c *gin.Context, sender Strea
 					logger.Error("自动关闭文本块失败", logger.Err(err), logger.Int("index", blockIndex))
 				} else {
 					// 标记文本块已关闭
-					block.Stopped = true
+					ssm.closeBlock(blockIndex)
 					logger.Debug("文本块已自动关闭", logger.Int("index", blockIndex))
 				}
 			}
@@ -179,6 +213,13 @@ func (ssm *SSEStateManager) handleContentBlockStart(c *gin.Context, sender Strea
 		}
 	}
 
+	// 上游异常时（如不断开始新块却从不结束）中止流，避免状态无限增长
+	if len(ssm.activeBlocks) >= ssm.maxOpenBlocks {
+		logger.Error("同时打开的content_block超过上限",
+			addReqFields(c, logger.Int("block_index", index), logger.Int("max_open_blocks", ssm.maxOpenBlocks))...)
+		return fmt.Errorf("%w（上限%d）", ErrTooManyOpenBlocks, ssm.maxOpenBlocks)
+	}
+
 	ssm.activeBlocks[index] = &BlockState{
 		Index:     index,
 		Type:      blockType,
@@ -186,6 +227,7 @@ func (ssm *SSEStateManager) handleContentBlockStart(c *gin.Context, sender Strea
 		Stopped:   false,
 		ToolUseID: toolUseID,
 	}
+	ssm.startedBlocks++
 
 	if index >= ssm.nextBlockIndex {
 		ssm.nextBlockIndex = index + 1
@@ -215,9 +257,17 @@ func (ssm *SSEStateManager) handleContentBlockDelta(c *gin.Context, sender Strea
 		}
 	}
 
+	if ssm.closedBlocks.contains(index) {
+		errMsg := fmt.Sprintf("违规：索引%d的content_block已停止，不能发送delta", index)
+		logger.Error(errMsg, logger.Int("block_index", index), logger.Content("eventData", eventData))
+		if ssm.strictMode {
+			return errors.New(errMsg)
+		}
+		return nil
+	}
+
 	// 检查块是否已启动，如果没有则自动启动（遵循Claude规范的动态启动）
-	block, exists := ssm.activeBlocks[index]
-	if !exists || !block.Started {
+	if _, exists := ssm.activeBlocks[index]; !exists {
 		logger.Debug("检测到content_block_delta但块未启动，自动生成content_block_start",
 			logger.Int("block_index", index))
 
@@ -254,18 +304,6 @@ func (ssm *SSEStateManager) handleContentBlockDelta(c *gin.Context, sender Strea
 		if err := ssm.handleContentBlockStart(c, sender, startEvent); err != nil {
 			return err
 		}
-
-		// 重新获取更新后的block状态
-		block = ssm.activeBlocks[index]
-	}
-
-	if block != nil && block.Stopped {
-		errMsg := fmt.Sprintf("违规：索引%d的content_block已停止，不能发送delta", index)
-		logger.Error(errMsg, logger.Int("block_index", index), logger.Any("eventData", eventData))
-		if ssm.strictMode {
-			return errors.New(errMsg)
-		}
-		return nil
 	}
 
 	return sender.SendEvent(c, eventData)
@@ -288,18 +326,11 @@ func (ssm *SSEStateManager) handleContentBlockStop(c *gin.Context, sender Stream
 	}
 
 	// 验证块状态
-	block, exists := ssm.activeBlocks[index]
-	if !exists || !block.Started {
+	if _, exists := ssm.activeBlocks[index]; !exists {
 		errMsg := fmt.Sprintf("违规：索引%d的content_block未启动就发送stop", index)
-		logger.Error(errMsg, logger.Int("block_index", index))
-		if ssm.strictMode {
-			return errors.New(errMsg)
+		if ssm.closedBlocks.contains(index) {
+			errMsg = fmt.Sprintf("违规：索引%d的content_block重复停止", index)
 		}
-		return nil
-	}
-
-	if block.Stopped {
-		errMsg := fmt.Sprintf("违规：索引%d的content_block重复停止", index)
 		logger.Error(errMsg, logger.Int("block_index", index))
 		if ssm.strictMode {
 			return errors.New(errMsg)
@@ -307,8 +338,8 @@ func (ssm *SSEStateManager) handleContentBlockStop(c *gin.Context, sender Stream
 		return nil
 	}
 
-	// 标记为已停止
-	block.Stopped = true
+	// 标记为已停止并释放块状态
+	ssm.closeBlock(index)
 
 	return sender.SendEvent(c, eventData)
 }
@@ -323,6 +354,14 @@ func (ssm *SSEStateManager) handleMessageDelta(c *gin.Context, sender StreamEven
 		}
 	}
 
+	// 只携带中间usage的message_delta（STREAM_USAGE_INTERVAL）不结束消息，可以出现在内容块之间或块内
+	if isInterimMessageDelta(eventData) {
+		if !ssm.messageStarted || ssm.messageDeltaSent || ssm.messageEnded {
+			return nil
+		}
+		return sender.SendEvent(c, eventData)
+	}
+
 	// *** 关键修复：防止重复的message_delta事件 ***
 	// 根据Claude规范，message_delta在一次消息中只能出现一次
 	if ssm.messageDeltaSent {
@@ -341,29 +380,33 @@ func (ssm *SSEStateManager) handleMessageDelta(c *gin.Context, sender StreamEven
 	// *** 关键修复：在发送message_delta之前，确保所有content_block都已关闭 ***
 	// 根据Claude规范，message_delta必须在所有content_block_stop之后发送
 	var unclosedBlocks []int
-	for index, block := range ssm.activeBlocks {
-		if block.Started && !block.Stopped {
-			unclosedBlocks = append(unclosedBlocks, index)
-		}
+	for index := range ssm.activeBlocks {
+		unclosedBlocks = append(unclosedBlocks, index)
 	}
 
 	if len(unclosedBlocks) > 0 {
 		logger.Debug("message_delta前自动关闭未关闭的content_block",
 			logger.Any("unclosed_blocks", unclosedBlocks))
+		if ssm.strictMode {
+			return fmt.Errorf("违规：message_delta之前仍有%d个content_block未关闭", len(unclosedBlocks))
+		}
 		// 在非严格模式下，自动关闭未关闭的块
-		if !ssm.strictMode {
-			for _, index := range unclosedBlocks {
-				stopEvent := map[string]any{
-					"type":  "content_block_stop",
-					"index": index,
-				}
-				sender.SendEvent(c, stopEvent)
-				ssm.activeBlocks[index].Stopped = true
-				logger.Debug("自动关闭未关闭的content_block（message_delta前）", logger.Int("index", index))
+		for _, index := range unclosedBlocks {
+			stopEvent := map[string]any{
+				"type":  "content_block_stop",
+				"index": index,
 			}
+			sender.SendEvent(c, stopEvent)
+			ssm.closeBlock(index)
+			logger.Debug("自动关闭未关闭的content_block（message_delta前）", logger.Int("index", index))
 		}
 	}
 
+	// 不变量：message_delta之前所有块都已关闭
+	if len(ssm.activeBlocks) > 0 {
+		sseInvariantViolation(c, fmt.Sprintf("message_delta之前仍有%d个content_block未关闭", len(ssm.activeBlocks)))
+	}
+
 	// 标记message_delta已发送，防止后续重复发送
 	ssm.messageDeltaSent = true
 
@@ -392,11 +435,17 @@ func (ssm *SSEStateManager) handleMessageStop(c *gin.Context, sender StreamEvent
 	// 注意：未关闭的content_block检查已移至handleMessageDelta中
 	// 确保符合Claude规范：所有content_block_stop必须在message_delta之前发送
 
+	// 不变量：每个开始的块恰好结束一次
+	if ssm.startedBlocks != ssm.stoppedBlocks || len(ssm.activeBlocks) > 0 {
+		sseInvariantViolation(c, fmt.Sprintf("message_stop时开始了%d个content_block，结束了%d个，仍打开%d个",
+			ssm.startedBlocks, ssm.stoppedBlocks, len(ssm.activeBlocks)))
+	}
+
 	ssm.messageEnded = true
 	return sender.SendEvent(c, eventData)
 }
 
-// GetActiveBlocks 获取所有活跃块
+// GetActiveBlocks 获取所有已开始且未结束的块
 func (ssm *SSEStateManager) GetActiveBlocks() map[int]*BlockState {
 	return ssm.activeBlocks
 }
@@ -415,3 +464,70 @@ func (ssm *SSEStateManager) IsMessageEnded() bool {
 func (ssm *SSEStateManager) IsMessageDeltaSent() bool {
 	return ssm.messageDeltaSent
 }
+
+// OpenBlockCount 返回已开始且未结束的块数
+func (ssm *SSEStateManager) OpenBlockCount() int {
+	return len(ssm.activeBlocks)
+}
+
+// TextBlockIndex 追加文本时使用的块索引
+// 有未结束的文本块时返回其索引（多个时取最新的），否则返回下一个块索引，发送delta时自动开始新的文本块
+func (ssm *SSEStateManager) TextBlockIndex() int {
+	index := -1
+	for i, block := range ssm.activeBlocks {
+		if block.Type == "text" && i > index {
+			index = i
+		}
+	}
+	if index >= 0 {
+		return index
+	}
+	return ssm.nextBlockIndex
+}
+
+// indexRanges 按升序保存的不相交闭区间集合
+// 块索引通常单调递增，已结束的块会合并为一个区间，内存占用与块数无关
+type indexRanges [][2]int
+
+// contains 判断索引是否在集合中
+func (r indexRanges) contains(index int) bool {
+	for i := len(r) - 1; i >= 0; i-- {
+		if index > r[i][1] {
+			return false
+		}
+		if index >= r[i][0] {
+			return true
+		}
+	}
+	return false
+}
+
+// add 加入一个索引，与相邻区间合并
+func (r *indexRanges) add(index int) {
+	ranges := *r
+	// 从末尾找到第一个起点不大于index的区间（常见情况是最后一个）
+	i := len(ranges)
+	for i > 0 && ranges[i-1][0] > index {
+		i--
+	}
+	if i > 0 && index <= ranges[i-1][1] {
+		return // 已存在
+	}
+
+	mergePrev := i > 0 && ranges[i-1][1] == index-1
+	mergeNext := i < len(ranges) && ranges[i][0] == index+1
+	switch {
+	case mergePrev && mergeNext:
+		ranges[i-1][1] = ranges[i][1]
+		ranges = append(ranges[:i], ranges[i+1:]...)
+	case mergePrev:
+		ranges[i-1][1] = index
+	case mergeNext:
+		ranges[i][0] = index
+	default:
+		ranges = append(ranges, [2]int{})
+		copy(ranges[i+1:], ranges[i:])
+		ranges[i] = [2]int{index, index}
+	}
+	*r = ranges
+}
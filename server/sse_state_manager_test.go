@@ -0,0 +1,224 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"kiro2api/parser"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func toolBlockStart(index int) map[string]any {
+	return map[string]any{
+		"type":  "content_block_start",
+		"index": index,
+		"content_block": map[string]any{
+			"type":  "tool_use",
+			"id":    fmt.Sprintf("tooluse_%d", index),
+			"name":  "lookup",
+			"input": map[string]any{},
+		},
+	}
+}
+
+func toolBlockDelta(index int) map[string]any {
+	return map[string]any{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]any{"type": "input_json_delta", "partial_json": `{"q":"x"}`},
+	}
+}
+
+func TestIndexRanges(t *testing.T) {
+	var ranges indexRanges
+	for _, index := range []int{0, 1, 2, 5, 4, 9, 3} {
+		ranges.add(index)
+	}
+	assert.Equal(t, indexRanges{{0, 5}, {9, 9}}, ranges)
+
+	ranges.add(7)
+	ranges.add(8)
+	ranges.add(8)
+	assert.Equal(t, indexRanges{{0, 5}, {7, 9}}, ranges)
+
+	for _, index := range []int{0, 3, 5, 7, 9} {
+		assert.True(t, ranges.contains(index), index)
+	}
+	for _, index := range []int{-1, 6, 10} {
+		assert.False(t, ranges.contains(index), index)
+	}
+}
+
+func TestSSEStateManager_ReleasesStoppedBlocks(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	sender := &recordingSender{}
+	ssm := NewSSEStateManager(true)
+
+	require.NoError(t, ssm.SendEvent(c, sender, sseEvent("message_start")))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, ssm.SendEvent(c, sender, toolBlockStart(i)))
+		require.NoError(t, ssm.SendEvent(c, sender, toolBlockDelta(i)))
+		require.NoError(t, ssm.SendEvent(c, sender, sseEvent("content_block_stop", i)))
+		assert.Equal(t, 0, ssm.OpenBlockCount())
+	}
+	assert.Empty(t, ssm.GetActiveBlocks())
+
+	// 释放后仍能识别已结束的块
+	assert.ErrorContains(t, ssm.SendEvent(c, sender, sseEvent("content_block_stop", 1)), "重复停止")
+	assert.ErrorContains(t, ssm.SendEvent(c, sender, toolBlockDelta(1)), "已停止")
+	assert.ErrorContains(t, ssm.SendEvent(c, sender, toolBlockStart(2)), "已结束")
+	assert.ErrorContains(t, ssm.SendEvent(c, sender, sseEvent("content_block_stop", 7)), "未启动")
+
+	require.NoError(t, ssm.SendEvent(c, sender, sseEvent("message_delta")))
+	require.NoError(t, ssm.SendEvent(c, sender, sseEvent("message_stop")))
+}
+
+func TestSSEStateManager_AutoClosedBlocksAreReleased(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	sender := &recordingSender{}
+	ssm := NewSSEStateManager(false)
+
+	require.NoError(t, ssm.SendEvent(c, sender, sseEvent("message_start")))
+	require.NoError(t, ssm.SendEvent(c, sender, map[string]any{
+		"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "text_delta", "text": "hi"},
+	}))
+	// 工具块开始前自动关闭文本块，message_delta前自动关闭工具块
+	require.NoError(t, ssm.SendEvent(c, sender, toolBlockStart(1)))
+	assert.Equal(t, 1, ssm.OpenBlockCount())
+	require.NoError(t, ssm.SendEvent(c, sender, sseEvent("message_delta")))
+	require.NoError(t, ssm.SendEvent(c, sender, sseEvent("message_stop")))
+
+	assert.Equal(t, 0, ssm.OpenBlockCount())
+	assert.Equal(t, []string{
+		"message_start",
+		"content_block_start", "content_block_delta",
+		"content_block_stop", "content_block_start",
+		"content_block_stop", "message_delta", "message_stop",
+	}, sender.events)
+}
+
+func TestSSEStateManager_StrictModeRejectsMessageDeltaWithOpenBlocks(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	sender := &recordingSender{}
+	ssm := NewSSEStateManager(true)
+
+	require.NoError(t, ssm.SendEvent(c, sender, sseEvent("message_start")))
+	require.NoError(t, ssm.SendEvent(c, sender, toolBlockStart(0)))
+	assert.Error(t, ssm.SendEvent(c, sender, sseEvent("message_delta")))
+	assert.NotContains(t, sender.events, "message_delta")
+}
+
+func TestSSEStateManager_OpenBlockLimit(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	sender := &recordingSender{}
+	ssm := NewSSEStateManager(false)
+	ssm.maxOpenBlocks = 2
+
+	require.NoError(t, ssm.SendEvent(c, sender, sseEvent("message_start")))
+	require.NoError(t, ssm.SendEvent(c, sender, toolBlockStart(0)))
+	require.NoError(t, ssm.SendEvent(c, sender, toolBlockStart(1)))
+	err := ssm.SendEvent(c, sender, toolBlockStart(2))
+	assert.True(t, errors.Is(err, ErrTooManyOpenBlocks), "非严格模式下同样中止: %v", err)
+
+	// 关闭一个后可以继续开始新块
+	require.NoError(t, ssm.SendEvent(c, sender, sseEvent("content_block_stop", 0)))
+	assert.NoError(t, ssm.SendEvent(c, sender, toolBlockStart(2)))
+}
+
+func TestSSEStateManager_InvariantViolationReported(t *testing.T) {
+	var violations []string
+	original := sseInvariantViolation
+	sseInvariantViolation = func(_ *gin.Context, message string) { violations = append(violations, message) }
+	t.Cleanup(func() { sseInvariantViolation = original })
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ssm := NewSSEStateManager(false)
+	require.NoError(t, ssm.SendEvent(c, &recordingSender{}, sseEvent("message_start")))
+	ssm.startedBlocks++ // 模拟状态管理器漏记了一次stop
+	require.NoError(t, ssm.SendEvent(c, &recordingSender{}, sseEvent("message_stop")))
+
+	require.Len(t, violations, 1)
+	assert.Contains(t, violations[0], "开始了1个content_block，结束了0个")
+}
+
+func TestEventStreamProcessor_TooManyOpenBlocksEndsStream(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	sender := &recordingSender{}
+	scope := newRequestScope(c, types.AnthropicRequest{Model: "claude-sonnet-4-20250514"}, &types.TokenWithUsage{})
+	scope.MessageID, scope.InputTokens = "msg_test", 1
+	ctx := NewStreamProcessorContext(scope, sender)
+	ctx.sseStateManager.maxOpenBlocks = 1
+	processor := NewEventStreamProcessor(ctx)
+
+	require.NoError(t, processor.processEvent(parser.SSEEvent{Data: sseEvent("message_start")}))
+	require.NoError(t, processor.processEvent(parser.SSEEvent{Data: toolBlockStart(0)}))
+	err := processor.processEvent(parser.SSEEvent{Data: toolBlockStart(1)})
+
+	assert.True(t, errors.Is(err, ErrTooManyOpenBlocks))
+	assert.Equal(t, []string{tooManyOpenBlocksMessage}, sender.errors)
+}
+
+// discardSender 丢弃所有事件，用于长流测试
+type discardSender struct{}
+
+func (discardSender) SendEvent(*gin.Context, any) error           { return nil }
+func (discardSender) SendError(*gin.Context, string, error) error { return nil }
+
+func heapInUse() uint64 {
+	runtime.GC()
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func TestEventStreamProcessor_SoakManyBlocksSteadyMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("长流测试")
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	scope := newRequestScope(c, types.AnthropicRequest{Model: "claude-sonnet-4-20250514"}, &types.TokenWithUsage{})
+	scope.MessageID, scope.InputTokens = "msg_test", 1
+	ctx := NewStreamProcessorContext(scope, discardSender{})
+	processor := NewEventStreamProcessor(ctx)
+	require.NoError(t, processor.processEvent(parser.SSEEvent{Data: sseEvent("message_start")}))
+
+	streamBlocks := func(from, to int) {
+		for i := from; i < to; i++ {
+			if i%2 == 0 {
+				require.NoError(t, processor.processEvent(parser.SSEEvent{Data: map[string]any{
+					"type": "content_block_delta", "index": i, "delta": map[string]any{"type": "text_delta", "text": "thinking about it"},
+				}}))
+			} else {
+				require.NoError(t, processor.processEvent(parser.SSEEvent{Data: toolBlockStart(i)}))
+				require.NoError(t, processor.processEvent(parser.SSEEvent{Data: toolBlockDelta(i)}))
+			}
+			require.NoError(t, processor.processEvent(parser.SSEEvent{Data: sseEvent("content_block_stop", i)}))
+		}
+	}
+
+	// 预热后记录基线，之后的9000个块不应使堆明显增长
+	streamBlocks(0, 1000)
+	baseline := heapInUse()
+	streamBlocks(1000, 10000)
+	after := heapInUse()
+
+	const allowedGrowth = 256 << 10
+	assert.Less(t, int64(after)-int64(baseline), int64(allowedGrowth),
+		"堆从%d增长到%d字节", baseline, after)
+	assert.Equal(t, 0, ctx.sseStateManager.OpenBlockCount())
+	assert.Len(t, ctx.sseStateManager.closedBlocks, 1, "连续的索引应合并为一个区间")
+	assert.Empty(t, ctx.toolUseIdByBlockIndex)
+	assert.Empty(t, ctx.jsonBytesByBlockIndex)
+	assert.Equal(t, 5000, ctx.completedToolUses)
+
+	require.NoError(t, ctx.sendFinalEvents())
+	assert.True(t, ctx.sseStateManager.IsMessageEnded())
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// STRICT_SSE_VALIDATION 的取值
+const (
+	StrictSSEOff   = ""      // 不校验（默认）
+	StrictSSELog   = "log"   // 违规时记录错误日志，事件照常下发
+	StrictSSEAbort = "abort" // 违规时不下发该事件，发送错误事件后中止流
+)
+
+// strictSSEAbortMessage 校验失败中止流时发送给客户端的错误信息
+const strictSSEAbortMessage = "SSE事件序列违反规范，已中止流式响应"
+
+// errStrictSSEAborted 流已因规范校验失败中止，之后的事件不再下发
+var errStrictSSEAborted = errors.New("SSE流已因规范校验失败中止")
+
+// strictSSEValidation Anthropic流式响应的规范校验模式（测试可替换）
+var strictSSEValidation = StrictSSEOff
+
+// NewStrictSSEValidationFromEnv STRICT_SSE_VALIDATION: log（true同义）/ abort，默认不校验
+func NewStrictSSEValidationFromEnv() string {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("STRICT_SSE_VALIDATION")))
+	switch mode {
+	case "", "false", "0", "off":
+		return StrictSSEOff
+	case "true", "1", StrictSSELog:
+		logger.Info("已启用SSE规范校验", logger.String("mode", StrictSSELog))
+		return StrictSSELog
+	case StrictSSEAbort:
+		logger.Info("已启用SSE规范校验", logger.String("mode", StrictSSEAbort))
+		return StrictSSEAbort
+	default:
+		logger.Warn("未知的STRICT_SSE_VALIDATION，不启用校验", logger.String("value", mode))
+		return StrictSSEOff
+	}
+}
+
+// SSESpecValidator 按Claude流式规范校验下发的事件序列
+// - message_start 必须是第一个事件且只出现一次
+// - content_block_start/stop 成对出现，索引不能复用，delta只能出现在已开始且未结束的块中
+// - 带stop_reason的message_delta最多一次，且在所有内容块结束之后；只携带中间usage的message_delta可以出现多次
+// - message_delta中的output_tokens不能减少
+// - message_stop 恰好一次，之后不能再有事件
+// error事件可以出现在任何位置，出现后不再要求message_stop
+type SSESpecValidator struct {
+	events       int
+	started      bool
+	deltaSent    bool
+	stopped      bool
+	errored      bool
+	openBlocks   map[int]bool
+	usedIndexes  map[int]bool
+	lastEvent    string // 最近一个事件的类型，用于错误描述
+	outputTokens int    // 最近一个message_delta中的output_tokens
+}
+
+// NewSSESpecValidator 创建规范校验器
+func NewSSESpecValidator() *SSESpecValidator {
+	return &SSESpecValidator{openBlocks: make(map[int]bool), usedIndexes: make(map[int]bool)}
+}
+
+// Validate 校验下一个事件，违规时返回错误（违规事件不计入状态）
+func (v *SSESpecValidator) Validate(event map[string]any) error {
+	eventType, _ := event["type"].(string)
+	if err := v.check(eventType, event); err != nil {
+		return fmt.Errorf("第%d个事件 %s（上一个事件 %s）: %w", v.events+1, eventType, v.lastEvent, err)
+	}
+	v.events++
+	v.lastEvent = eventType
+	return nil
+}
+
+func (v *SSESpecValidator) check(eventType string, event map[string]any) error {
+	if eventType == "error" {
+		v.errored = true
+		return nil
+	}
+	if v.stopped {
+		return errors.New("message_stop之后不能再有事件")
+	}
+	if eventType == "message_start" {
+		if v.started {
+			return errors.New("message_start只能出现一次")
+		}
+		v.started = true
+		return nil
+	}
+	if !v.started {
+		return errors.New("第一个事件必须是message_start")
+	}
+
+	switch eventType {
+	case "content_block_start":
+		index := extractIndex(event)
+		switch {
+		case index < 0:
+			return errors.New("缺少index")
+		case v.deltaSent:
+			return errors.New("message_delta之后不能开始新的内容块")
+		case v.openBlocks[index]:
+			return fmt.Errorf("索引%d的内容块已开始且未结束", index)
+		case v.usedIndexes[index]:
+			return fmt.Errorf("索引%d已被之前的内容块使用", index)
+		}
+		v.openBlocks[index] = true
+		v.usedIndexes[index] = true
+
+	case "content_block_delta":
+		index := extractIndex(event)
+		if !v.openBlocks[index] {
+			if v.usedIndexes[index] {
+				return fmt.Errorf("索引%d的内容块已结束", index)
+			}
+			return fmt.Errorf("索引%d的内容块尚未开始", index)
+		}
+
+	case "content_block_stop":
+		index := extractIndex(event)
+		if !v.openBlocks[index] {
+			return fmt.Errorf("索引%d的内容块未开始或已结束", index)
+		}
+		delete(v.openBlocks, index)
+
+	case "message_delta":
+		interim := isInterimMessageDelta(event)
+		switch {
+		case interim && v.deltaSent:
+			return errors.New("中间usage不能出现在最终message_delta之后")
+		case !interim && v.deltaSent:
+			return errors.New("message_delta只能出现一次")
+		case !interim && len(v.openBlocks) > 0:
+			return fmt.Errorf("仍有%d个内容块未结束", len(v.openBlocks))
+		}
+		tokens, ok := usageOutputTokens(event)
+		if ok && tokens < v.outputTokens {
+			return fmt.Errorf("output_tokens从%d减少为%d", v.outputTokens, tokens)
+		}
+		if ok {
+			v.outputTokens = tokens
+		}
+		v.deltaSent = !interim
+
+	case "message_stop":
+		if len(v.openBlocks) > 0 {
+			return fmt.Errorf("仍有%d个内容块未结束", len(v.openBlocks))
+		}
+		v.stopped = true
+	}
+	return nil
+}
+
+// usageOutputTokens 读取message_delta中的usage.output_tokens
+func usageOutputTokens(event map[string]any) (int, bool) {
+	usage, _ := event["usage"].(map[string]any)
+	switch value := usage["output_tokens"].(type) {
+	case int:
+		return value, true
+	case float64:
+		return int(value), true
+	}
+	return 0, false
+}
+
+// Finish 流结束时校验：已下发事件且未出现error时必须以message_stop结束
+func (v *SSESpecValidator) Finish() error {
+	if v.events == 0 || v.errored || v.stopped {
+		return nil
+	}
+	return fmt.Errorf("流结束时未发送message_stop（共%d个事件，最后一个为 %s）", v.events, v.lastEvent)
+}
+
+// strictSSESender 在下发前校验每个事件的StreamEventSender
+type strictSSESender struct {
+	StreamEventSender
+	mode      string
+	validator *SSESpecValidator
+	aborted   bool
+}
+
+// newStrictSSESender 按模式包装发送器，未启用时原样返回
+func newStrictSSESender(sender StreamEventSender, mode string) StreamEventSender {
+	if mode == StrictSSEOff {
+		return sender
+	}
+	return &strictSSESender{StreamEventSender: sender, mode: mode, validator: NewSSESpecValidator()}
+}
+
+func (s *strictSSESender) SendEvent(c *gin.Context, data any) error {
+	if s.aborted {
+		return errStrictSSEAborted
+	}
+	event, ok := data.(map[string]any)
+	if !ok {
+		return s.StreamEventSender.SendEvent(c, data)
+	}
+	if err := s.validator.Validate(event); err != nil {
+		logger.Error("SSE规范校验失败", addReqFields(c, logger.String("mode", s.mode), logger.Err(err))...)
+		if s.mode == StrictSSEAbort {
+			s.aborted = true
+			_ = s.StreamEventSender.SendError(c, strictSSEAbortMessage, err)
+			return err
+		}
+	}
+	return s.StreamEventSender.SendEvent(c, data)
+}
+
+func (s *strictSSESender) SendError(c *gin.Context, message string, err error) error {
+	if s.aborted {
+		return errStrictSSEAborted
+	}
+	s.validator.errored = true
+	return s.StreamEventSender.SendError(c, message, err)
+}
+
+// finish 流结束时做收尾校验
+func (s *strictSSESender) finish(c *gin.Context) {
+	if s.aborted {
+		return
+	}
+	if err := s.validator.Finish(); err != nil {
+		logger.Error("SSE规范校验失败", addReqFields(c, logger.String("mode", s.mode), logger.Err(err))...)
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sseEvent(eventType string, index ...int) map[string]any {
+	event := map[string]any{"type": eventType}
+	if len(index) > 0 {
+		event["index"] = index[0]
+	}
+	return event
+}
+
+// validSSESequence 一个符合规范的完整事件序列
+func validSSESequence() []map[string]any {
+	return []map[string]any{
+		sseEvent("message_start"),
+		sseEvent("ping"),
+		sseEvent("content_block_start", 0),
+		sseEvent("content_block_delta", 0),
+		sseEvent("content_block_stop", 0),
+		sseEvent("content_block_start", 1),
+		sseEvent("content_block_delta", 1),
+		sseEvent("content_block_stop", 1),
+		sseEvent("message_delta"),
+		sseEvent("message_stop"),
+	}
+}
+
+func TestSSESpecValidator(t *testing.T) {
+	tests := []struct {
+		name      string
+		events    []map[string]any
+		violation int    // 第一个违规事件的下标，-1表示没有违规
+		message   string // 违规描述包含的内容
+	}{
+		{"符合规范", validSSESequence(), -1, ""},
+		{"第一个事件不是message_start", []map[string]any{sseEvent("ping"), sseEvent("message_start")}, 0, "第一个事件必须是message_start"},
+		{"重复的message_start", []map[string]any{sseEvent("message_start"), sseEvent("message_start")}, 1, "只能出现一次"},
+		{"delta在start之前", []map[string]any{sseEvent("message_start"), sseEvent("content_block_delta", 0)}, 1, "尚未开始"},
+		{"delta在stop之后", []map[string]any{
+			sseEvent("message_start"), sseEvent("content_block_start", 0), sseEvent("content_block_stop", 0), sseEvent("content_block_delta", 0),
+		}, 3, "已结束"},
+		{"重复start同一块", []map[string]any{
+			sseEvent("message_start"), sseEvent("content_block_start", 0), sseEvent("content_block_start", 0),
+		}, 2, "已开始且未结束"},
+		{"复用已结束的索引", []map[string]any{
+			sseEvent("message_start"), sseEvent("content_block_start", 0), sseEvent("content_block_stop", 0), sseEvent("content_block_start", 0),
+		}, 3, "已被之前的内容块使用"},
+		{"未开始就stop", []map[string]any{sseEvent("message_start"), sseEvent("content_block_stop", 2)}, 1, "未开始或已结束"},
+		{"重复stop", []map[string]any{
+			sseEvent("message_start"), sseEvent("content_block_start", 0), sseEvent("content_block_stop", 0), sseEvent("content_block_stop", 0),
+		}, 3, "未开始或已结束"},
+		{"内容块未结束就message_delta", []map[string]any{
+			sseEvent("message_start"), sseEvent("content_block_start", 0), sseEvent("message_delta"),
+		}, 2, "未结束"},
+		{"重复message_delta", []map[string]any{sseEvent("message_start"), sseEvent("message_delta"), sseEvent("message_delta")}, 2, "只能出现一次"},
+		{"message_delta之后开始新块", []map[string]any{
+			sseEvent("message_start"), sseEvent("message_delta"), sseEvent("content_block_start", 0),
+		}, 2, "message_delta之后"},
+		{"内容块未结束就message_stop", []map[string]any{
+			sseEvent("message_start"), sseEvent("content_block_start", 0), sseEvent("message_stop"),
+		}, 2, "未结束"},
+		{"重复message_stop", append(validSSESequence(), sseEvent("message_stop")), 10, "message_stop之后"},
+		{"message_stop之后还有事件", append(validSSESequence(), sseEvent("ping")), 10, "message_stop之后"},
+		{"缺少index", []map[string]any{sseEvent("message_start"), sseEvent("content_block_start")}, 1, "缺少index"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewSSESpecValidator()
+			violation := -1
+			var err error
+			for i, event := range tt.events {
+				if err = v.Validate(event); err != nil {
+					violation = i
+					break
+				}
+			}
+			assert.Equal(t, tt.violation, violation)
+			if tt.violation >= 0 {
+				assert.ErrorContains(t, err, tt.message)
+			}
+		})
+	}
+}
+
+func TestSSESpecValidator_Finish(t *testing.T) {
+	v := NewSSESpecValidator()
+	assert.NoError(t, v.Finish(), "没有下发事件时不校验")
+
+	for _, event := range validSSESequence()[:8] {
+		require.NoError(t, v.Validate(event))
+	}
+	assert.ErrorContains(t, v.Finish(), "未发送message_stop")
+
+	require.NoError(t, v.Validate(map[string]any{"type": "error"}))
+	assert.NoError(t, v.Finish(), "以error结束的流不要求message_stop")
+}
+
+// recordingSender 记录下发的事件类型
+type recordingSender struct {
+	events []string
+	errors []string
+}
+
+func (s *recordingSender) SendEvent(_ *gin.Context, data any) error {
+	eventType, _ := data.(map[string]any)["type"].(string)
+	s.events = append(s.events, eventType)
+	return nil
+}
+
+func (s *recordingSender) SendError(_ *gin.Context, message string, _ error) error {
+	s.errors = append(s.errors, message)
+	return nil
+}
+
+func TestStrictSSESender_Modes(t *testing.T) {
+	outOfOrder := []map[string]any{
+		sseEvent("message_start"),
+		sseEvent("content_block_delta", 0),
+		sseEvent("content_block_start", 0),
+		sseEvent("content_block_stop", 0),
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	t.Run("关闭时不包装", func(t *testing.T) {
+		inner := &recordingSender{}
+		assert.Same(t, inner, newStrictSSESender(inner, StrictSSEOff))
+	})
+
+	t.Run("log模式照常下发", func(t *testing.T) {
+		inner := &recordingSender{}
+		sender := newStrictSSESender(inner, StrictSSELog)
+		for _, event := range outOfOrder {
+			assert.NoError(t, sender.SendEvent(c, event))
+		}
+		assert.Equal(t, []string{"message_start", "content_block_delta", "content_block_start", "content_block_stop"}, inner.events)
+		assert.Empty(t, inner.errors)
+	})
+
+	t.Run("abort模式发送错误后中止", func(t *testing.T) {
+		inner := &recordingSender{}
+		sender := newStrictSSESender(inner, StrictSSEAbort)
+		assert.NoError(t, sender.SendEvent(c, outOfOrder[0]))
+		assert.ErrorContains(t, sender.SendEvent(c, outOfOrder[1]), "尚未开始")
+		assert.ErrorIs(t, sender.SendEvent(c, outOfOrder[2]), errStrictSSEAborted)
+		assert.ErrorIs(t, sender.SendError(c, "later", nil), errStrictSSEAborted)
+
+		assert.Equal(t, []string{"message_start"}, inner.events)
+		assert.Equal(t, []string{strictSSEAbortMessage}, inner.errors)
+	})
+}
+
+// withStrictSSEValidation 临时设置规范校验模式
+func withStrictSSEValidation(t *testing.T, mode string) {
+	t.Helper()
+	original := strictSSEValidation
+	strictSSEValidation = mode
+	t.Cleanup(func() { strictSSEValidation = original })
+}
+
+func TestHandleStreamRequest_PassesStrictValidation(t *testing.T) {
+	withStrictSSEValidation(t, StrictSSEAbort)
+
+	run := func(req types.AnthropicRequest) string {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+		handleStreamRequest(newTestScope(c, req))
+		return w.Body.String()
+	}
+
+	t.Run("文本", func(t *testing.T) {
+		newTextDeltaUpstream(t, "Hello", " world")
+		body := run(newStopTestRequest(true))
+		assert.NotContains(t, body, strictSSEAbortMessage)
+		assert.Equal(t, 1, strings.Count(body, "event: message_stop"))
+	})
+
+	t.Run("文本与多个工具调用", func(t *testing.T) {
+		newTwoToolsUpstream(t)
+		body := run(newToolTestRequest(true, false))
+		assert.NotContains(t, body, strictSSEAbortMessage)
+		assert.Equal(t, 1, strings.Count(body, "event: message_stop"))
+		assert.Equal(t, 2, strings.Count(body, `"type":"tool_use"`))
+	})
+}
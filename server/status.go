@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// statusPoolProvider 提供账号配置列表，用于统计账号池大小
+// 由 NewRouter 注入 AuthService；为nil时账号池大小为0
+type statusPoolProvider interface {
+	GetConfigs() []auth.AuthConfig
+}
+
+var statusPool statusPoolProvider
+
+// serverStartTime 进程启动时间，用于计算运行时长
+var serverStartTime = time.Now()
+
+// statusNow 计算运行时长使用的时钟（测试可替换）
+var statusNow = time.Now
+
+// handleStatusAPI 返回服务自身的运行信息，便于确认当前运行的版本和配置
+// GET /api/status
+func handleStatusAPI(c *gin.Context) {
+	var total, enabled int
+	if statusPool != nil {
+		for _, cfg := range statusPool.GetConfigs() {
+			total++
+			if !cfg.Disabled {
+				enabled++
+			}
+		}
+	}
+
+	uptime := statusNow().Sub(serverStartTime)
+	c.JSON(http.StatusOK, gin.H{
+		"version":        config.Version,
+		"commit":         config.Commit,
+		"go_version":     runtime.Version(),
+		"started_at":     serverStartTime.Format(time.RFC3339),
+		"uptime_seconds": int64(uptime.Seconds()),
+		"uptime":         uptime.Truncate(time.Second).String(),
+		"goroutines":     runtime.NumGoroutine(),
+		"pool": gin.H{
+			"total":   total,
+			"enabled": enabled,
+		},
+		"selection_strategy":          auth.SelectionStrategyHealth,
+		"selection_strategy_override": selectionStrategyOverride,
+	})
+}
+
+// handleStreamStatsAPI 返回上游响应流的统计计数和各路由的请求统计
+// GET /api/stats
+func handleStreamStatsAPI(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"message_boundary_policy": messageBoundaryPolicy.Mode,
+		"message_boundaries":      streamStats.MessageBoundaries.Load(),
+		"merged_messages":         streamStats.MergedMessages.Load(),
+		"discarded_messages":      streamStats.DiscardedMessages.Load(),
+		"unknown_blocks":          streamStats.UnknownBlocks.Load(),
+		"unknown_block_types":     streamStats.UnknownBlockTypes(),
+		"passthrough_unknown":     passthroughUnknownBlocks,
+		"routes":                  routeMetrics.Snapshot(),
+		"inflight": gin.H{
+			"current":  routeMetrics.InFlight(),
+			"limit":    routeMetrics.maxInflight,
+			"rejected": routeMetrics.Rejected(),
+		},
+		"auth":             auth.Metrics().Snapshot(),
+		"usage_cache":      auth.SharedUsageCache().Stats(),
+		"shadow":           shadowTraffic.Stats(),
+		"downstream_queue": downstreamQueueStats.Snapshot(),
+	})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeStatusPool []auth.AuthConfig
+
+func (p fakeStatusPool) GetConfigs() []auth.AuthConfig { return p }
+
+// getStatus 经由路由请求 /api/status 并解析响应
+func getStatus(t *testing.T) map[string]any {
+	t.Helper()
+	w := serveRouter(t, http.MethodGet, "/api/status", "", false)
+	require.Equal(t, http.StatusOK, w.Code, "管理端点无需认证")
+	var status map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	return status
+}
+
+func TestStatusAPI(t *testing.T) {
+	originalPool := statusPool
+	statusPool = fakeStatusPool{{RefreshToken: "a"}, {RefreshToken: "b", Disabled: true}, {RefreshToken: "c"}}
+	t.Cleanup(func() { statusPool = originalPool })
+
+	status := getStatus(t)
+	for _, field := range []string{"version", "commit", "go_version", "started_at", "uptime_seconds", "uptime", "goroutines", "pool", "selection_strategy", "selection_strategy_override"} {
+		assert.Contains(t, status, field)
+	}
+	assert.Equal(t, config.Version, status["version"])
+	assert.Equal(t, config.Commit, status["commit"])
+	assert.Equal(t, runtime.Version(), status["go_version"])
+	assert.Greater(t, status["goroutines"], float64(0))
+	assert.Equal(t, map[string]any{"total": float64(3), "enabled": float64(2)}, status["pool"])
+	assert.Equal(t, auth.SelectionStrategyHealth, status["selection_strategy"])
+	assert.Equal(t, false, status["selection_strategy_override"])
+}
+
+func TestStatusAPI_UptimeIncreases(t *testing.T) {
+	now := serverStartTime.Add(90 * time.Second)
+	original := statusNow
+	statusNow = func() time.Time { return now }
+	t.Cleanup(func() { statusNow = original })
+
+	first := getStatus(t)
+	assert.Equal(t, float64(90), first["uptime_seconds"])
+	assert.Equal(t, "1m30s", first["uptime"])
+
+	now = now.Add(time.Hour)
+	second := getStatus(t)
+	assert.Greater(t, second["uptime_seconds"], first["uptime_seconds"])
+	assert.Equal(t, first["started_at"], second["started_at"])
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"kiro2api/logger"
+	"kiro2api/parser"
 	"kiro2api/types"
 )
 
@@ -9,14 +10,43 @@ import (
 type StopReasonManager struct {
 	hasActiveToolCalls bool
 	hasCompletedTools  bool
+
+	// 请求设置了tool_choice.disable_parallel_tool_use，每条消息只保留一个tool_use块
+	disableParallelToolUse bool
 }
 
 // NewStopReasonManager 创建stop_reason管理器
 func NewStopReasonManager(anthropicReq types.AnthropicRequest) *StopReasonManager {
 	return &StopReasonManager{
-		hasActiveToolCalls: false,
-		hasCompletedTools:  false,
+		hasActiveToolCalls:     false,
+		hasCompletedTools:      false,
+		disableParallelToolUse: anthropicReq.ParallelToolUseDisabled(),
+	}
+}
+
+// AcceptToolUse 判断在已有existingTools个工具调用时是否还能接受新的tool_use块
+// 禁用并行工具调用时只保留第一个，上游不遵守指令返回的后续工具调用会被丢弃
+func (srm *StopReasonManager) AcceptToolUse(existingTools int) bool {
+	return !srm.disableParallelToolUse || existingTools == 0
+}
+
+// LimitToolCalls 按并行工具调用设置截取非流式响应中的工具调用
+func (srm *StopReasonManager) LimitToolCalls(tools []*parser.ToolExecution) []*parser.ToolExecution {
+	if len(tools) <= 1 || srm.AcceptToolUse(1) {
+		return tools
+	}
+
+	// 工具调用来自map，按内容块索引保留最先出现的一个
+	first := tools[0]
+	for _, tool := range tools[1:] {
+		if tool.BlockIndex < first.BlockIndex {
+			first = tool
+		}
 	}
+	logger.Debug("禁用并行工具调用，丢弃多余的工具调用",
+		logger.String("kept", first.Name),
+		logger.Int("dropped", len(tools)-1))
+	return []*parser.ToolExecution{first}
 }
 
 // UpdateToolCallStatus 更新工具调用状态
@@ -0,0 +1,75 @@
+package server
+
+import "strings"
+
+// StopSequenceMatcher 客户端侧的停止序列检测
+// 上游不支持stop参数，由代理在下发前截断输出
+// 流式场景下会暂缓可能构成停止序列前缀的尾部文本，因此跨delta的停止序列也能识别
+type StopSequenceMatcher struct {
+	sequences []string
+	pending   string // 暂缓下发的文本（可能是某个停止序列的前缀）
+	matched   string // 命中的停止序列
+}
+
+// NewStopSequenceMatcher 创建停止序列检测器，sequences为空时所有文本原样通过
+func NewStopSequenceMatcher(sequences []string) *StopSequenceMatcher {
+	filtered := make([]string, 0, len(sequences))
+	for _, seq := range sequences {
+		if seq != "" {
+			filtered = append(filtered, seq)
+		}
+	}
+	return &StopSequenceMatcher{sequences: filtered}
+}
+
+// Feed 输入一段增量文本，返回可以安全下发的文本
+// 命中停止序列时stopped为true，停止序列本身及之后的文本被丢弃
+func (m *StopSequenceMatcher) Feed(text string) (string, bool) {
+	if m.matched != "" {
+		return "", true
+	}
+	if len(m.sequences) == 0 {
+		return text, false
+	}
+
+	buf := m.pending + text
+	m.pending = ""
+
+	// 查找最早出现的停止序列
+	matchIndex := -1
+	for _, seq := range m.sequences {
+		if idx := strings.Index(buf, seq); idx >= 0 && (matchIndex < 0 || idx < matchIndex) {
+			matchIndex = idx
+			m.matched = seq
+		}
+	}
+	if matchIndex >= 0 {
+		return buf[:matchIndex], true
+	}
+
+	// 暂缓最长的、可能是停止序列前缀的后缀
+	holdback := 0
+	for _, seq := range m.sequences {
+		for n := len(seq) - 1; n > holdback; n-- {
+			if strings.HasSuffix(buf, seq[:n]) {
+				holdback = n
+				break
+			}
+		}
+	}
+
+	m.pending = buf[len(buf)-holdback:]
+	return buf[:len(buf)-holdback], false
+}
+
+// Flush 上游结束时返回暂缓的文本
+func (m *StopSequenceMatcher) Flush() string {
+	rest := m.pending
+	m.pending = ""
+	return rest
+}
+
+// Matched 返回命中的停止序列，未命中时为空串
+func (m *StopSequenceMatcher) Matched() string {
+	return m.matched
+}
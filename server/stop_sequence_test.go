@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStopSequenceMatcher(t *testing.T) {
+	t.Run("无停止序列原样通过", func(t *testing.T) {
+		m := NewStopSequenceMatcher(nil)
+		out, stopped := m.Feed("hello END")
+		assert.Equal(t, "hello END", out)
+		assert.False(t, stopped)
+	})
+
+	t.Run("单个delta内命中", func(t *testing.T) {
+		m := NewStopSequenceMatcher([]string{"END"})
+		out, stopped := m.Feed("hello END world")
+		assert.Equal(t, "hello ", out)
+		assert.True(t, stopped)
+		assert.Equal(t, "END", m.Matched())
+	})
+
+	t.Run("跨delta命中", func(t *testing.T) {
+		m := NewStopSequenceMatcher([]string{"END"})
+		out1, stopped1 := m.Feed("hello E")
+		out2, stopped2 := m.Feed("ND world")
+		assert.Equal(t, "hello ", out1)
+		assert.False(t, stopped1)
+		assert.Equal(t, "", out2)
+		assert.True(t, stopped2)
+	})
+
+	t.Run("前缀未构成停止序列时补发", func(t *testing.T) {
+		m := NewStopSequenceMatcher([]string{"END"})
+		out1, _ := m.Feed("hello EN")
+		out2, stopped := m.Feed("TRY")
+		assert.Equal(t, "hello ", out1)
+		assert.Equal(t, "ENTRY", out2)
+		assert.False(t, stopped)
+		assert.Equal(t, "", m.Flush())
+	})
+
+	t.Run("结束时下发暂缓文本", func(t *testing.T) {
+		m := NewStopSequenceMatcher([]string{"END"})
+		out, _ := m.Feed("hello E")
+		assert.Equal(t, "hello ", out)
+		assert.Equal(t, "E", m.Flush())
+	})
+
+	t.Run("多个停止序列取最早出现的", func(t *testing.T) {
+		m := NewStopSequenceMatcher([]string{"STOP", "\n\n"})
+		out, stopped := m.Feed("a\n\nb STOP")
+		assert.Equal(t, "a", out)
+		assert.True(t, stopped)
+		assert.Equal(t, "\n\n", m.Matched())
+	})
+}
+
+// encodeTestEventStreamFrame 构造空头部的AWS事件流帧（默认视为assistantResponseEvent）
+func encodeTestEventStreamFrame(payload string) []byte {
+	totalLength := 16 + len(payload)
+	frame := make([]byte, totalLength)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(totalLength))
+	binary.BigEndian.PutUint32(frame[4:8], 0)
+	copy(frame[12:], payload)
+	return frame
+}
+
+// newTextDeltaUpstream 创建按顺序返回文本增量的假上游
+func newTextDeltaUpstream(t *testing.T, deltas ...string) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for _, delta := range deltas {
+			payload, _ := json.Marshal(map[string]string{"content": delta})
+			_, _ = w.Write(encodeTestEventStreamFrame(string(payload)))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+}
+
+func newStopTestRequest(stream bool, stop ...string) types.AnthropicRequest {
+	return types.AnthropicRequest{
+		Model:         "claude-sonnet-4-20250514",
+		MaxTokens:     100,
+		Messages:      []types.AnthropicRequestMessage{{Role: "user", Content: "hello"}},
+		Stream:        stream,
+		StopSequences: stop,
+	}
+}
+
+func TestOpenAIStream_StopSequenceSplitAcrossDeltas(t *testing.T) {
+	newTextDeltaUpstream(t, "Hello wor", "ld EN", "D should not appear")
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	handleOpenAIStreamRequest(newTestScope(c, newStopTestRequest(true, "END")))
+
+	var content strings.Builder
+	var finishReasons []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		for _, choice := range chunk.Choices {
+			content.WriteString(choice.Delta.Content)
+			if choice.FinishReason != nil {
+				finishReasons = append(finishReasons, *choice.FinishReason)
+			}
+		}
+	}
+
+	assert.Equal(t, "Hello world ", content.String())
+	assert.Equal(t, []string{"stop"}, finishReasons)
+	assert.Contains(t, w.Body.String(), "data: [DONE]")
+}
+
+func TestOpenAINonStream_StopSequence(t *testing.T) {
+	newTextDeltaUpstream(t, "first line", "\n\nsecond line")
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	handleOpenAINonStreamRequest(newTestScope(c, newStopTestRequest(false, "\n\n")))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp types.OpenAIResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Choices, 1)
+	assert.Equal(t, "first line", resp.Choices[0].Message.Content)
+	assert.Equal(t, "stop", resp.Choices[0].FinishReason)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnthropicStream_CanceledStreamRecordsEmittedOutputTokens(t *testing.T) {
+	withConversationStreams(t)
+	fake := withFakeTokenAccounting(t, TokenAccountingEstimator)
+	fake.accounts["access-first"] = "account-first"
+	started, canceled := newBlockingUpstream(t)
+
+	// 第一个流下发一段文本后挂起，被同一会话的新流取消
+	c1, w1 := newConversationStreamContext("/v1/messages", "conv-1")
+	first := &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "access-first"}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleStreamRequest(newRequestScope(c1, newStopTestRequest(true), first))
+	}()
+	<-started
+	waitUpstreamResponded(t, c1)
+
+	c2, _ := newConversationStreamContext("/v1/messages", "conv-1")
+	handleStreamRequest(newRequestScope(c2, newStopTestRequest(true), &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "access"}}))
+
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("旧流的上游请求未被取消")
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("旧流未结束")
+	}
+	require.Contains(t, w1.Body.String(), streamSupersededMessage)
+	require.NotContains(t, w1.Body.String(), "message_delta", "被取消的流没有结束事件")
+
+	recorded := map[string]recordedTokens{}
+	for _, entry := range fake.recorded {
+		_, duplicate := recorded[entry.account]
+		assert.False(t, duplicate, "每个请求只记录一次: %s", entry.account)
+		recorded[entry.account] = entry
+	}
+	require.Contains(t, recorded, "account-first", "被取消的流也记录估算token")
+	estimator := utils.NewTokenEstimator()
+	assert.Equal(t, estimator.EstimateTextTokens("first "), recorded["account-first"].outputTokens, "按取消前已下发的内容记录")
+	assert.Positive(t, recorded["account-first"].inputTokens)
+	assert.Equal(t, estimator.EstimateTextTokens("second answer"), recorded["account-a"].outputTokens)
+}
+
+func TestOpenAIStream_RecordsEmittedOutputTokens(t *testing.T) {
+	withConversationStreams(t)
+	fake := withFakeTokenAccounting(t, TokenAccountingEstimator)
+	fake.accounts["access-first"] = "account-first"
+	started, canceled := newBlockingUpstream(t)
+
+	// 第一个流下发一段文本后挂起，被同一会话的新流取消；第二个流正常结束
+	c1, w1 := newConversationStreamContext("/v1/chat/completions", "conv-1")
+	first := &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "access-first"}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleOpenAIStreamRequest(newRequestScope(c1, newStopTestRequest(true), first))
+	}()
+	<-started
+	waitUpstreamResponded(t, c1)
+
+	c2, w2 := newConversationStreamContext("/v1/chat/completions", "conv-1")
+	handleOpenAIStreamRequest(newRequestScope(c2, newStopTestRequest(true), &types.TokenWithUsage{TokenInfo: types.TokenInfo{AccessToken: "access"}}))
+
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("旧流的上游请求未被取消")
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("旧流未结束")
+	}
+	require.Contains(t, w1.Body.String(), streamSupersededMessage)
+	require.Contains(t, w2.Body.String(), "[DONE]")
+
+	recorded := map[string]recordedTokens{}
+	for _, entry := range fake.recorded {
+		_, duplicate := recorded[entry.account]
+		assert.False(t, duplicate, "每个请求只记录一次: %s", entry.account)
+		recorded[entry.account] = entry
+	}
+	require.Contains(t, recorded, "account-first", "被取消的流也记录估算token")
+	require.Contains(t, recorded, "account-a")
+	estimator := utils.NewTokenEstimator()
+	assert.Equal(t, estimator.EstimateTextTokens("first "), recorded["account-first"].outputTokens, "按取消前已下发的内容记录")
+	assert.Positive(t, recorded["account-first"].inputTokens)
+	assert.Equal(t, estimator.EstimateTextTokens("second answer"), recorded["account-a"].outputTokens)
+	assert.Equal(t, recorded["account-first"].inputTokens, recorded["account-a"].inputTokens)
+}
@@ -1,28 +1,31 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"strings"
 
 	"kiro2api/logger"
 	"kiro2api/parser"
-	"kiro2api/types"
 	"kiro2api/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
+// tooManyOpenBlocksMessage 上游同时打开的内容块超过上限时发送给客户端的错误信息
+const tooManyOpenBlocksMessage = "上游同时打开的内容块过多，已中止流式响应"
+
+// tooManyActiveToolsMessage 上游同时进行的工具调用超过上限时发送给客户端的错误信息
+const tooManyActiveToolsMessage = "上游同时进行的工具调用过多，已中止响应"
+
 // StreamProcessorContext 流处理上下文，封装所有流处理状态
 // 遵循单一职责原则：专注于流式数据处理
 type StreamProcessorContext struct {
-	// 请求上下文
-	c           *gin.Context
-	req         types.AnthropicRequest
-	token       *types.TokenWithUsage
-	sender      StreamEventSender
-	messageID   string
-	inputTokens int
+	// 请求上下文（请求、token、消息ID和估算token统计都在scope中）
+	scope  *RequestScope
+	c      *gin.Context
+	sender StreamEventSender
 
 	// 状态管理器
 	sseStateManager   *SSEStateManager
@@ -33,50 +36,61 @@ type StreamProcessorContext struct {
 	compliantParser *parser.CompliantEventStreamParser
 
 	// 统计信息
-	totalOutputTokens    int // 累计发送给客户端的输出 token 数
+	lastUsageDeltaTokens int // 最近一次中间message_delta下发的输出 token 数
+	outputTokenFactor    float64 // 客户端可见output_tokens相对估算值的比例（TOKEN_ACCOUNTING_SOURCE）
 	totalReadBytes       int
 	totalProcessedEvents int
 	lastParseErr         error
 
 	// 工具调用跟踪
 	toolUseIdByBlockIndex map[int]string
-	completedToolUseIds   map[string]bool // 已完成的工具ID集合（用于stop_reason判断）
+	completedToolUses     int // 已完成的工具调用数（用于stop_reason判断），只计数不保留ID，避免长流占用内存持续增长
 	
 	// *** 新增：JSON字节累加器（修复分段整除精度损失） ***
 	// 问题：每个 input_json_delta 单独计算 len(partialJSON)/4 会导致小于4字节的分段被舍弃
 	// 解决：累加每个块的JSON字节数，在 content_block_stop 时一次性计算 token
 	jsonBytesByBlockIndex map[int]int // 每个工具块累积的JSON字节数
+
+	// 上游开始第二条assistant消息且策略为truncate时置位，之后的事件全部丢弃
+	boundaryTruncated bool
+
+	// 禁用并行工具调用时被丢弃、尚未结束的多余工具块索引（结束时移除）
+	droppedBlockIndexes map[int]bool
 }
 
 // NewStreamProcessorContext 创建流处理上下文
-func NewStreamProcessorContext(
-	c *gin.Context,
-	req types.AnthropicRequest,
-	token *types.TokenWithUsage,
-	sender StreamEventSender,
-	messageID string,
-	inputTokens int,
-) *StreamProcessorContext {
+func NewStreamProcessorContext(scope *RequestScope, sender StreamEventSender) *StreamProcessorContext {
+	factor := 1.0
+	if scope.Token != nil {
+		factor = outputTokenFactor(scope.Token.TokenInfo)
+	}
 	return &StreamProcessorContext{
-		c:                     c,
-		req:                   req,
-		token:                 token,
+		scope:                 scope,
+		c:                     scope.c,
 		sender:                sender,
-		messageID:             messageID,
-		inputTokens:           inputTokens,
 		sseStateManager:       NewSSEStateManager(false),
-		stopReasonManager:     NewStopReasonManager(req),
+		stopReasonManager:     NewStopReasonManager(scope.Request),
 		tokenEstimator:        utils.NewTokenEstimator(),
 		compliantParser:       parser.NewCompliantEventStreamParser(),
 		toolUseIdByBlockIndex: make(map[int]string),
-		completedToolUseIds:   make(map[string]bool),
 		jsonBytesByBlockIndex: make(map[int]int), // *** 初始化JSON字节累加器 ***
+		droppedBlockIndexes:   make(map[int]bool),
+		outputTokenFactor:     factor,
 	}
 }
 
 // Cleanup 清理资源
 // 完整清理所有状态，防止内存泄漏
 func (ctx *StreamProcessorContext) Cleanup() {
+	// 流被中止（被新流取代、客户端超时、慢客户端、解析错误等）时没有发送结束事件，
+	// 按已下发的内容记录输出token；正常结束时结束事件已记录，不会重复计入
+	if ctx.scope != nil && !ctx.scope.accountingRecorded {
+		outputTokens := ctx.runningOutputTokens()
+		logger.Info("流式响应未正常结束，按已下发内容记录输出token",
+			addReqFields(ctx.c, logger.Int("output_tokens", outputTokens))...)
+		ctx.scope.recordEstimatedUsage(outputTokens)
+	}
+
 	// 重置解析器状态
 	if ctx.compliantParser != nil {
 		ctx.compliantParser.Reset()
@@ -91,13 +105,8 @@ func (ctx *StreamProcessorContext) Cleanup() {
 		ctx.toolUseIdByBlockIndex = nil
 	}
 
-	// 清理已完成工具集合
-	if ctx.completedToolUseIds != nil {
-		for k := range ctx.completedToolUseIds {
-			delete(ctx.completedToolUseIds, k)
-		}
-		ctx.completedToolUseIds = nil
-	}
+	ctx.jsonBytesByBlockIndex = nil
+	ctx.droppedBlockIndexes = nil
 
 	// 清理管理器引用，帮助GC
 	ctx.sseStateManager = nil
@@ -123,14 +132,22 @@ func initializeSSEResponse(c *gin.Context) error {
 }
 
 // sendInitialEvents 发送初始事件
-func (ctx *StreamProcessorContext) sendInitialEvents(eventCreator func(string, int, string) []map[string]any) error {
+func (ctx *StreamProcessorContext) sendInitialEvents(eventCreator func(*RequestScope) []map[string]any) error {
 	// 直接使用上下文中的 inputTokens（已经通过 TokenEstimator 精确计算）
-	initialEvents := eventCreator(ctx.messageID, ctx.inputTokens, ctx.req.Model)
+	initialEvents := eventCreator(ctx.scope)
 
 	// 注意：初始事件现在只包含 message_start 和 ping
 	// content_block_start 会在收到实际内容时由 sse_state_manager 自动生成
 	// 这避免了发送空内容块（如果上游只返回 tool_use 而没有文本）
 	for _, event := range initialEvents {
+		// ping按HEARTBEAT_STYLE发送（事件或SSE注释）
+		if isHeartbeatEvent(event) {
+			if err := ctx.sendHeartbeat(event); err != nil {
+				logger.Error("心跳发送失败", logger.Err(err))
+				return err
+			}
+			continue
+		}
 		// 使用状态管理器发送事件
 		if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event); err != nil {
 			logger.Error("初始SSE事件发送失败", logger.Err(err))
@@ -168,12 +185,45 @@ func (ctx *StreamProcessorContext) processToolUseStart(dataMap map[string]any) {
 	// 记录索引到tool_use_id的映射
 	ctx.toolUseIdByBlockIndex[idx] = id
 
+	// 还原被改写为上游安全形式的工具名称
+	if name, ok := cb["name"].(string); ok {
+		cb["name"] = ctx.scope.Request.OriginalToolName(name)
+	}
+
 	logger.Debug("转发tool_use开始",
 		logger.String("tool_use_id", id),
 		logger.String("tool_name", getStringField(cb, "name")),
 		logger.Int("index", idx))
 }
 
+// dropExtraToolBlock 判断事件是否属于应丢弃的多余工具块
+// 仅在请求设置了disable_parallel_tool_use时生效：已有工具调用后再开始的tool_use块及其增量、结束事件都不下发
+func (ctx *StreamProcessorContext) dropExtraToolBlock(eventType string, dataMap map[string]any) bool {
+	switch eventType {
+	case "content_block_start":
+		contentBlock, _ := dataMap["content_block"].(map[string]any)
+		if cbType, _ := contentBlock["type"].(string); cbType != "tool_use" {
+			return false
+		}
+		if ctx.stopReasonManager.AcceptToolUse(len(ctx.toolUseIdByBlockIndex) + ctx.completedToolUses) {
+			return false
+		}
+		ctx.droppedBlockIndexes[extractIndex(dataMap)] = true
+		logger.Debug("禁用并行工具调用，丢弃多余的工具块",
+			addReqFields(ctx.c, logger.Int("index", extractIndex(dataMap)))...)
+		return true
+	case "content_block_delta":
+		return ctx.droppedBlockIndexes[extractIndex(dataMap)]
+	case "content_block_stop":
+		index := extractIndex(dataMap)
+		if ctx.droppedBlockIndexes[index] {
+			delete(ctx.droppedBlockIndexes, index)
+			return true
+		}
+	}
+	return false
+}
+
 // processToolUseStop 处理工具使用结束事件
 func (ctx *StreamProcessorContext) processToolUseStop(dataMap map[string]any) {
 	idx := extractIndex(dataMap)
@@ -181,25 +231,34 @@ func (ctx *StreamProcessorContext) processToolUseStop(dataMap map[string]any) {
 		return
 	}
 
+	// 解析器在流结束时补发的结束事件带truncated标记，记录后移除，下发的事件保持规范格式
+	if truncated, _ := dataMap["truncated"].(bool); truncated {
+		delete(dataMap, "truncated")
+		logger.Warn("上游未结束工具调用，已在流结束时关闭",
+			addReqFields(ctx.c,
+				logger.Int("index", idx),
+				logger.String("tool_use_id", ctx.toolUseIdByBlockIndex[idx]))...)
+	}
+
 	// *** 修复：在块结束时计算累加的JSON字节数的token ***
 	// 使用进一法（向上取整）确保不低估token消耗
-	if jsonBytes, exists := ctx.jsonBytesByBlockIndex[idx]; exists && jsonBytes > 0 {
+	if jsonBytes := ctx.jsonBytesByBlockIndex[idx]; jsonBytes > 0 {
 		tokens := (jsonBytes + 3) / 4  // 进一法: ceil(jsonBytes / 4)
-		ctx.totalOutputTokens += tokens
-		delete(ctx.jsonBytesByBlockIndex, idx)
+		ctx.scope.OutputTokens += tokens
 		
 		logger.Debug("content_block_stop计算JSON tokens",
 			logger.Int("block_index", idx),
 			logger.Int("json_bytes", jsonBytes),
 			logger.Int("tokens", tokens))
 	}
+	delete(ctx.jsonBytesByBlockIndex, idx)
 
 	if toolId, exists := ctx.toolUseIdByBlockIndex[idx]; exists && toolId != "" {
 		// *** 关键修复：在删除前先记录到已完成工具集合 ***
 		// 问题：直接删除导致sendFinalEvents()中len(toolUseIdByBlockIndex)==0
 		// 结果：stop_reason错误判断为end_turn而非tool_use
-		// 解决：先添加到completedToolUseIds，保持工具调用的证据
-		ctx.completedToolUseIds[toolId] = true
+		// 解决：先计入completedToolUses，保持工具调用的证据
+		ctx.completedToolUses++
 
 		delete(ctx.toolUseIdByBlockIndex, idx)
 	} else {
@@ -230,27 +289,28 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 	// 更新工具调用状态
 	// 使用已完成工具集合来判断，因为toolUseIdByBlockIndex在stop时已被清空
 	hasActiveTools := len(ctx.toolUseIdByBlockIndex) > 0
-	hasCompletedTools := len(ctx.completedToolUseIds) > 0
+	hasCompletedTools := ctx.completedToolUses > 0
 
 	// logger.Debug("更新工具调用状态",
 	// 	logger.Bool("has_active_tools", hasActiveTools),
 	// 	logger.Bool("has_completed_tools", hasCompletedTools),
 	// 	logger.Int("active_count", len(ctx.toolUseIdByBlockIndex)),
-	// 	logger.Int("completed_count", len(ctx.completedToolUseIds)))
+	// 	logger.Int("completed_count", ctx.completedToolUses))
 
 	ctx.stopReasonManager.UpdateToolCallStatus(hasActiveTools, hasCompletedTools)
 
 	// *** 关键修复：使用累计的实际发送 token 数 ***
 	// 设计原则：token 计费应该基于实际发送给客户端的 SSE 事件内容
-	// totalOutputTokens 在每次发送事件时累计，确保与实际输出内容一致
-	outputTokens := ctx.totalOutputTokens
+	// scope.OutputTokens 在每次发送事件时累计，确保与实际输出内容一致
+	// 包含被强制关闭的工具块已累积的JSON，保证不小于已下发的中间usage
+	outputTokens := ctx.runningOutputTokens()
 
 	// *** 完善的最小 token 保护机制 ***
-	// 问题：某些边缘情况（如只有空格、特殊字符等）可能导致 totalOutputTokens 为 0
+	// 问题：某些边缘情况（如只有空格、特殊字符等）可能导致 scope.OutputTokens 为 0
 	// 保护条件：只要处理了事件或有完成的内容块，output_tokens 就不应该为 0
 	if outputTokens < 1 {
 		// 检查是否有任何内容被发送
-		hasContent := len(ctx.completedToolUseIds) > 0 ||
+		hasContent := ctx.completedToolUses > 0 ||
 		              len(ctx.toolUseIdByBlockIndex) > 0 ||
 		              ctx.totalProcessedEvents > 0
 
@@ -258,11 +318,15 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 			outputTokens = 1  // 最小保护：至少 1 token
 			logger.Debug("触发最小token保护",
 				logger.Int("processed_events", ctx.totalProcessedEvents),
-				logger.Int("completed_tools", len(ctx.completedToolUseIds)),
+				logger.Int("completed_tools", ctx.completedToolUses),
 				logger.Int("active_tools", len(ctx.toolUseIdByBlockIndex)))
 		}
 	}
 
+	// 估算值计入对账统计，下发值按TOKEN_ACCOUNTING_SOURCE换算
+	ctx.scope.recordEstimatedUsage(outputTokens)
+	outputTokens = ctx.reportedOutputTokens(outputTokens)
+
 	// 确定stop_reason
 	stopReason := ctx.stopReasonManager.DetermineStopReason()
 
@@ -272,7 +336,7 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 		logger.Int("output_tokens", outputTokens))
 
 	// 创建并发送结束事件
-	finalEvents := createAnthropicFinalEvents(outputTokens, ctx.inputTokens, stopReason)
+	finalEvents := createAnthropicFinalEvents(ctx.scope.anthropicUsage(outputTokens), stopReason)
 	for _, event := range finalEvents {
 		if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event); err != nil {
 			logger.Error("结束事件发送违规", logger.Err(err))
@@ -346,6 +410,17 @@ func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
 					return err
 				}
 			}
+
+			// 同时进行的工具调用超过上限，流无法继续
+			if errors.Is(parseErr, parser.ErrTooManyActiveTools) {
+				_ = esp.ctx.sender.SendError(esp.ctx.c, tooManyActiveToolsMessage, parseErr)
+				return parseErr
+			}
+
+			// 已在消息边界处截断，不再读取上游
+			if esp.ctx.boundaryTruncated {
+				break
+			}
 		}
 
 		if err != nil {
@@ -366,6 +441,13 @@ func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
 		}
 	}
 
+	// 上游未结束的工具调用：以已下发的参数结束对应的内容块
+	for _, event := range esp.ctx.compliantParser.FinalizeTools() {
+		if err := esp.processEvent(event); err != nil {
+			return err
+		}
+	}
+
 	// 直传模式：无需冲刷剩余文本
 	return nil
 }
@@ -378,10 +460,45 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 		return nil
 	}
 
+	if esp.ctx.boundaryTruncated {
+		return nil
+	}
+
 	eventType, _ := dataMap["type"].(string)
 
+	// 禁用并行工具调用时丢弃第一个之后的工具块
+	if esp.ctx.dropExtraToolBlock(eventType, dataMap) {
+		return nil
+	}
+
 	// 处理不同类型的事件
 	switch eventType {
+	case parser.EventTypes.MESSAGE_BOUNDARY:
+		// 上游开始了新的assistant消息：截断或以分隔符合并，边界事件本身不下发
+		if messageBoundaryPolicy.recordBoundary(esp.ctx.c, dataMap) {
+			esp.ctx.boundaryTruncated = true
+			return nil
+		}
+		// 分隔符写入当前打开的文本块，没有时在下一个索引开始新的文本块
+		return esp.processEvent(parser.SSEEvent{Event: "content_block_delta", Data: messageBoundaryPolicy.separatorEvent(esp.ctx.sseStateManager.TextBlockIndex())})
+
+	case parser.EventTypes.UPSTREAM_METADATA:
+		// 上游元数据事件：只读取报告的token数，从不下发
+		recordUpstreamMetadata(esp.ctx.c, dataMap)
+		return nil
+
+	case parser.EventTypes.UNKNOWN_BLOCK:
+		// 上游未知内容块：计数后默认跳过，开启透传时原样下发，任何情况下都不中断流
+		blockType := recordUnknownBlock(esp.ctx.c, dataMap)
+		if !passthroughUnknownBlocks {
+			return nil
+		}
+		if err := esp.ctx.sender.SendEvent(esp.ctx.c, unknownBlockPassthroughEvent(blockType, dataMap["raw"])); err != nil {
+			logger.Warn("透传未知内容块失败", addReqFields(esp.ctx.c, logger.Err(err))...)
+		}
+		esp.ctx.c.Writer.Flush()
+		return nil
+
 	case "content_block_start":
 		esp.ctx.processToolUseStart(dataMap)
 
@@ -394,8 +511,8 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 
 	case "message_delta":
 
-	case "exception":
-		// 处理上游异常事件，检查是否需要映射为max_tokens
+	case "exception", "error":
+		// 处理上游异常事件，检查是否需要映射为max_tokens或refusal
 		if esp.handleExceptionEvent(dataMap) {
 			return nil // 已转换并发送，不转发原始exception事件
 		}
@@ -403,6 +520,10 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 
 	// 使用状态管理器发送事件（直传）
 	if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, dataMap); err != nil {
+		if errors.Is(err, ErrTooManyOpenBlocks) {
+			_ = esp.ctx.sender.SendError(esp.ctx.c, tooManyOpenBlocksMessage, err)
+			return err
+		}
 		logger.Error("SSE事件发送违规", logger.Err(err))
 		// 非严格模式下，违规事件被跳过但不中断流
 	}
@@ -423,7 +544,7 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 			case "text_delta":
 				// 文本内容增量
 				if text, ok := delta["text"].(string); ok {
-					esp.ctx.totalOutputTokens += esp.ctx.tokenEstimator.EstimateTextTokens(text)
+					esp.ctx.scope.OutputTokens += esp.ctx.tokenEstimator.EstimateTextTokens(text)
 				}
 			
 			case "input_json_delta":
@@ -449,10 +570,10 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 				// - "id": "toolu_xxx" ≈ 8 tokens  
 				// - "name" 关键字 ≈ 1 token
 				// - 工具名称本身的 token（使用 estimateToolName 计算）
-				esp.ctx.totalOutputTokens += 12 // 结构字段固定开销
+				esp.ctx.scope.OutputTokens += 12 // 结构字段固定开销
 				
 				if toolName, ok := contentBlock["name"].(string); ok {
-					esp.ctx.totalOutputTokens += esp.ctx.tokenEstimator.EstimateTextTokens(toolName)
+					esp.ctx.scope.OutputTokens += esp.ctx.tokenEstimator.EstimateTextTokens(toolName)
 				}
 			}
 		}
@@ -461,6 +582,11 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 	// 不包含实际内容，不累计 token
 	}
 
+	// 可选：按间隔下发携带当前usage的中间message_delta（STREAM_USAGE_INTERVAL）
+	if eventType == "content_block_delta" || eventType == "content_block_stop" {
+		esp.ctx.sendUsageDelta()
+	}
+
 	esp.ctx.c.Writer.Flush()
 	return nil
 }
@@ -469,7 +595,7 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 // 返回true表示已处理（聚合），不需要转发原始事件
 // processContentBlockDelta 已废弃（直传模式不再需要）
 
-// handleExceptionEvent 处理上游异常事件，检查是否需要映射为max_tokens
+// handleExceptionEvent 处理上游异常事件，检查是否需要映射为max_tokens或refusal
 // 返回true表示已处理并转换，不需要转发原始exception事件
 func (esp *EventStreamProcessor) handleExceptionEvent(dataMap map[string]any) bool {
 	// 提取异常类型
@@ -484,53 +610,68 @@ func (esp *EventStreamProcessor) handleExceptionEvent(dataMap map[string]any) bo
 				logger.String("exception_type", exceptionType),
 				logger.String("claude_stop_reason", "max_tokens"))...)
 
-		// 关闭所有活跃的content_block
-		activeBlocks := esp.ctx.sseStateManager.GetActiveBlocks()
-		for index, block := range activeBlocks {
-			if block.Started && !block.Stopped {
-				stopEvent := map[string]any{
-					"type":  "content_block_stop",
-					"index": index,
-				}
-				_ = esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent)
-			}
-		}
+		return esp.finishWithStopReason("max_tokens")
+	}
 
-		// 构造符合Claude规范的max_tokens响应
-		maxTokensEvent := map[string]any{
-			"type": "message_delta",
-			"delta": map[string]any{
-				"stop_reason":   "max_tokens",
-				"stop_sequence": nil,
-			},
-			"usage": map[string]any{
-				"input_tokens":  esp.ctx.inputTokens,
-				"output_tokens": esp.ctx.totalOutputTokens,
-			},
-		}
+	// 检查是否为上游拒绝/安全拦截
+	if message, refused := refusalFromEvent(dataMap); refused {
+		logger.Info("检测到上游拒绝响应，映射为refusal stop_reason",
+			addReqFields(esp.ctx.c,
+				logger.String("exception_type", exceptionType),
+				logger.String("message", message),
+				logger.String("claude_stop_reason", "refusal"))...)
 
-		// 发送max_tokens事件
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, maxTokensEvent); err != nil {
-			logger.Error("发送max_tokens响应失败", logger.Err(err))
-			return false
-		}
+		return esp.finishWithStopReason("refusal")
+	}
 
-		// 发送message_stop事件
-		stopEvent := map[string]any{
-			"type": "message_stop",
-		}
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent); err != nil {
-			logger.Error("发送message_stop失败", logger.Err(err))
-			return false
+	// 其他类型的异常，正常转发
+	return false
+}
+
+// finishWithStopReason 关闭所有活跃的content_block，并以指定stop_reason结束消息
+func (esp *EventStreamProcessor) finishWithStopReason(stopReason string) bool {
+	// 关闭所有活跃的content_block
+	activeBlocks := esp.ctx.sseStateManager.GetActiveBlocks()
+	for index, block := range activeBlocks {
+		if block.Started && !block.Stopped {
+			stopEvent := map[string]any{
+				"type":  "content_block_stop",
+				"index": index,
+			}
+			_ = esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent)
 		}
+	}
 
-		esp.ctx.c.Writer.Flush()
+	outputTokens := esp.ctx.runningOutputTokens()
+	esp.ctx.scope.recordEstimatedUsage(outputTokens)
+
+	// 构造符合Claude规范的message_delta
+	deltaEvent := map[string]any{
+		"type": "message_delta",
+		"delta": map[string]any{
+			"stop_reason":   stopReason,
+			"stop_sequence": nil,
+		},
+		"usage": esp.ctx.scope.anthropicUsage(esp.ctx.reportedOutputTokens(outputTokens)),
+	}
 
-		return true // 已转换并发送，不转发原始exception
+	if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, deltaEvent); err != nil {
+		logger.Error("发送stop_reason响应失败", logger.Err(err), logger.String("stop_reason", stopReason))
+		return false
 	}
 
-	// 其他类型的异常，正常转发
-	return false
+	// 发送message_stop事件
+	stopEvent := map[string]any{
+		"type": "message_stop",
+	}
+	if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent); err != nil {
+		logger.Error("发送message_stop失败", logger.Err(err))
+		return false
+	}
+
+	esp.ctx.c.Writer.Flush()
+
+	return true // 已转换并发送，不转发原始exception
 }
 
 // 直传模式：无flush逻辑
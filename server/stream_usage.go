@@ -0,0 +1,80 @@
+package server
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"kiro2api/logger"
+)
+
+// streamUsageInterval 流式响应中每新增多少输出token下发一次中间message_delta，<=0表示只在结束时下发（测试可替换）
+var streamUsageInterval int
+
+// NewStreamUsageIntervalFromEnv STREAM_USAGE_INTERVAL: 中间usage的下发间隔（token数，默认0不下发）
+func NewStreamUsageIntervalFromEnv() int {
+	value := strings.TrimSpace(os.Getenv("STREAM_USAGE_INTERVAL"))
+	if value == "" {
+		return 0
+	}
+	interval, err := strconv.Atoi(value)
+	if err != nil || interval < 0 {
+		logger.Warn("STREAM_USAGE_INTERVAL无效，不下发中间usage", logger.String("value", value))
+		return 0
+	}
+	if interval > 0 {
+		logger.Info("已启用流式中间usage", logger.Int("interval_tokens", interval))
+	}
+	return interval
+}
+
+// isInterimMessageDelta 是否为只携带中间usage的message_delta：delta中显式给出stop_reason为null
+// 最终的message_delta总是带有stop_reason
+func isInterimMessageDelta(event map[string]any) bool {
+	delta, ok := event["delta"].(map[string]any)
+	if !ok {
+		return false
+	}
+	stopReason, exists := delta["stop_reason"]
+	return exists && stopReason == nil
+}
+
+// runningOutputTokens 当前已下发内容的输出token数
+// 包含尚未结束的工具块已累积的JSON字节，块结束时计入scope.OutputTokens的值与此一致，保证计数不减少
+func (ctx *StreamProcessorContext) runningOutputTokens() int {
+	tokens := ctx.scope.OutputTokens
+	for _, jsonBytes := range ctx.jsonBytesByBlockIndex {
+		tokens += (jsonBytes + 3) / 4
+	}
+	return tokens
+}
+
+// reportedOutputTokens 客户端可见的output_tokens，reconciled模式下按账号的对账比例换算
+func (ctx *StreamProcessorContext) reportedOutputTokens(estimated int) int {
+	return scaleOutputTokens(estimated, ctx.outputTokenFactor)
+}
+
+// sendUsageDelta 输出token比上次下发增加达到streamUsageInterval时，下发携带当前usage的message_delta
+// 供客户端实时显示费用；最终message_delta中的usage仍是权威值
+func (ctx *StreamProcessorContext) sendUsageDelta() {
+	if streamUsageInterval <= 0 {
+		return
+	}
+	running := ctx.runningOutputTokens()
+	if running-ctx.lastUsageDeltaTokens < streamUsageInterval {
+		return
+	}
+	ctx.lastUsageDeltaTokens = running
+
+	event := map[string]any{
+		"type": "message_delta",
+		"delta": map[string]any{
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+		},
+		"usage": ctx.scope.anthropicUsage(ctx.reportedOutputTokens(running)),
+	}
+	if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event); err != nil {
+		logger.Debug("发送中间usage失败", addReqFields(ctx.c, logger.Err(err))...)
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withStreamUsageInterval 在测试期间设置中间usage的下发间隔
+func withStreamUsageInterval(t *testing.T, interval int) {
+	t.Helper()
+	original := streamUsageInterval
+	streamUsageInterval = interval
+	t.Cleanup(func() { streamUsageInterval = original })
+}
+
+// messageDeltas 从SSE响应体中提取所有message_delta事件
+func messageDeltas(t *testing.T, body string) []map[string]any {
+	t.Helper()
+	var deltas []map[string]any
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || !strings.Contains(data, `"message_delta"`) {
+			continue
+		}
+		var event map[string]any
+		require.NoError(t, json.Unmarshal([]byte(data), &event))
+		deltas = append(deltas, event)
+	}
+	return deltas
+}
+
+func runUsageStream(t *testing.T, deltas ...string) []map[string]any {
+	t.Helper()
+	newSlowUpstream(t, 0, 0, deltas...)
+	c, w := newClientTimeoutContext(t, "/v1/messages", "")
+	handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+	return messageDeltas(t, w.Body.String())
+}
+
+func TestStreamUsage_RunningUsageIsNonDecreasingAndMatchesFinal(t *testing.T) {
+	withStreamUsageInterval(t, 1)
+	withStrictSSEValidation(t, StrictSSEAbort)
+
+	events := runUsageStream(t, "The quick brown fox", " jumps over", " the lazy dog", " again and again.")
+
+	require.Greater(t, len(events), 2, "每个文本增量之后都应下发中间usage")
+	previous := 0.0
+	for i, event := range events {
+		usage := event["usage"].(map[string]any)
+		tokens := usage["output_tokens"].(float64)
+		assert.GreaterOrEqual(t, tokens, previous, "第%d个message_delta", i)
+		previous = tokens
+
+		stopReason := event["delta"].(map[string]any)["stop_reason"]
+		if i < len(events)-1 {
+			assert.Nil(t, stopReason, "中间usage不带stop_reason")
+		} else {
+			assert.Equal(t, "end_turn", stopReason, "最后一个message_delta是最终结果")
+		}
+	}
+
+	final := events[len(events)-1]["usage"].(map[string]any)["output_tokens"].(float64)
+	last := events[len(events)-2]["usage"].(map[string]any)["output_tokens"].(float64)
+	assert.Equal(t, last, final)
+	assert.Positive(t, final)
+}
+
+func TestStreamUsage_DisabledByDefault(t *testing.T) {
+	withStreamUsageInterval(t, 0)
+
+	events := runUsageStream(t, "hello", " world")
+
+	require.Len(t, events, 1)
+	assert.Equal(t, "end_turn", events[0]["delta"].(map[string]any)["stop_reason"])
+}
+
+func TestStreamUsage_IntervalLimitsDeltaCount(t *testing.T) {
+	withStreamUsageInterval(t, 1000)
+
+	events := runUsageStream(t, "hello", " world")
+
+	// 输出不足间隔，只有最终message_delta
+	require.Len(t, events, 1)
+}
+
+func TestRunningOutputTokens_IncludesPendingToolJSON(t *testing.T) {
+	ctx := &StreamProcessorContext{scope: &RequestScope{OutputTokens: 10}, jsonBytesByBlockIndex: map[int]int{1: 5, 2: 8}}
+	assert.Equal(t, 10+2+2, ctx.runningOutputTokens())
+
+	// 块结束时计入scope.OutputTokens，运行计数不变
+	ctx.processToolUseStop(map[string]any{"index": 1})
+	assert.Equal(t, 10+2+2, ctx.runningOutputTokens())
+}
+
+func TestSSESpecValidator_InterimUsage(t *testing.T) {
+	interim := func(tokens int) map[string]any {
+		return map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{"stop_reason": nil},
+			"usage": map[string]any{"output_tokens": tokens},
+		}
+	}
+	final := func(tokens int) map[string]any {
+		return map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{"stop_reason": "end_turn"},
+			"usage": map[string]any{"output_tokens": tokens},
+		}
+	}
+
+	v := NewSSESpecValidator()
+	for _, event := range []map[string]any{
+		sseEvent("message_start"),
+		sseEvent("content_block_start", 0),
+		sseEvent("content_block_delta", 0),
+		interim(3),
+		interim(3),
+		sseEvent("content_block_stop", 0),
+		interim(5),
+	} {
+		require.NoError(t, v.Validate(event))
+	}
+	assert.ErrorContains(t, v.Validate(interim(4)), "减少")
+	assert.ErrorContains(t, v.Validate(final(4)), "减少")
+	require.NoError(t, v.Validate(final(5)))
+	assert.ErrorContains(t, v.Validate(interim(6)), "最终message_delta之后")
+	require.NoError(t, v.Validate(sseEvent("message_stop")))
+}
+
+func TestNewStreamUsageIntervalFromEnv(t *testing.T) {
+	for value, expected := range map[string]int{"": 0, "0": 0, "50": 50, "-1": 0, "abc": 0} {
+		t.Setenv("STREAM_USAGE_INTERVAL", value)
+		assert.Equal(t, expected, NewStreamUsageIntervalFromEnv(), value)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// strictRequestFields 是否拒绝含未知顶层字段的请求（默认宽松，未知字段被忽略或原样保留）
+var strictRequestFields bool
+
+// NewStrictRequestFieldsFromEnv 读取STRICT_REQUEST_FIELDS环境变量
+func NewStrictRequestFieldsFromEnv() bool {
+	enabled := strings.EqualFold(strings.TrimSpace(os.Getenv("STRICT_REQUEST_FIELDS")), "true")
+	if enabled {
+		logger.Info("已启用请求字段严格校验，未知顶层字段将返回400")
+	}
+	return enabled
+}
+
+// anthropicKnownFields Anthropic Messages API的顶层字段（含代理未使用的字段）
+var anthropicKnownFields = newFieldSet(
+	"model", "messages", "max_tokens", "system", "metadata", "stop_sequences", "stream",
+	"temperature", "top_p", "top_k", "tools", "tool_choice", "thinking", "service_tier",
+	"container", "mcp_servers", "context_management",
+)
+
+// openAIKnownFields OpenAI Chat Completions API的顶层字段（含代理未使用的字段）
+var openAIKnownFields = newFieldSet(
+	"model", "messages", "max_tokens", "max_completion_tokens", "temperature", "top_p", "n",
+	"stream", "stream_options", "stop", "presence_penalty", "frequency_penalty", "logit_bias",
+	"logprobs", "top_logprobs", "user", "tools", "tool_choice", "parallel_tool_calls",
+	"response_format", "seed", "service_tier", "store", "metadata", "reasoning_effort",
+	"modalities", "audio", "prediction", "functions", "function_call", "web_search_options",
+)
+
+func newFieldSet(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// unknownRequestFields 返回body中不在known内的顶层字段（按名称排序）
+func unknownRequestFields(body []byte, known map[string]bool) ([]string, error) {
+	var fields map[string]json.RawMessage
+	if err := utils.SafeUnmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// suggestFieldName 忽略大小写和下划线后与已知字段相同时返回该字段（如 maxTokens -> max_tokens）
+func suggestFieldName(name string, known map[string]bool) string {
+	folded := foldFieldName(name)
+	for candidate := range known {
+		if foldFieldName(candidate) == folded {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func foldFieldName(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+}
+
+// checkRequestFields 严格模式下拒绝含未知顶层字段的请求，返回false表示已响应400
+// 宽松模式或请求体无法解析为JSON对象时不做处理，由后续解析报告错误
+func checkRequestFields(c *gin.Context, body []byte, known map[string]bool) bool {
+	if !strictRequestFields {
+		return true
+	}
+	unknown, err := unknownRequestFields(body, known)
+	if err != nil || len(unknown) == 0 {
+		return true
+	}
+
+	descriptions := make([]string, len(unknown))
+	for i, name := range unknown {
+		descriptions[i] = name
+		if suggestion := suggestFieldName(name, known); suggestion != "" {
+			descriptions[i] = name + "（是否应为 " + suggestion + "？）"
+		}
+	}
+	logger.Warn("请求包含未知顶层字段", addReqFields(c, logger.Any("fields", unknown))...)
+	respondError(c, http.StatusBadRequest, "请求包含未知的顶层字段: %s", strings.Join(descriptions, ", "))
+	return false
+}
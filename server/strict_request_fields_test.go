@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withStrictRequestFields(t *testing.T, enabled bool) {
+	t.Helper()
+	original := strictRequestFields
+	strictRequestFields = enabled
+	t.Cleanup(func() { strictRequestFields = original })
+}
+
+func performCheckRequestFields(body string, known map[string]bool) (bool, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	return checkRequestFields(c, []byte(body), known), w
+}
+
+const typoFieldsBody = `{"model":"claude-sonnet-4-20250514","maxTokens":1024,"messages":[{"role":"user","content":"hi"}],"foo":1}`
+
+func TestCheckRequestFields_StrictRejectsUnknownFields(t *testing.T) {
+	withStrictRequestFields(t, true)
+
+	ok, w := performCheckRequestFields(typoFieldsBody, anthropicKnownFields)
+
+	require.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "foo, maxTokens（是否应为 max_tokens？）")
+}
+
+func TestCheckRequestFields_LenientAllowsUnknownFields(t *testing.T) {
+	withStrictRequestFields(t, false)
+
+	ok, w := performCheckRequestFields(typoFieldsBody, anthropicKnownFields)
+
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestCheckRequestFields_StrictAcceptsKnownFields(t *testing.T) {
+	withStrictRequestFields(t, true)
+
+	// 代理未使用但属于官方schema的字段不算未知
+	ok, _ := performCheckRequestFields(`{"model":"claude-sonnet-4-20250514","max_tokens":1024,"top_k":5,
+		"thinking":{"type":"enabled","budget_tokens":2048},"service_tier":"auto","messages":[]}`, anthropicKnownFields)
+	assert.True(t, ok)
+
+	ok, _ = performCheckRequestFields(`{"model":"gpt-4o","messages":[],"max_completion_tokens":10,"seed":1,"user":"u"}`, openAIKnownFields)
+	assert.True(t, ok)
+
+	// 字段集合按接口区分
+	ok, w := performCheckRequestFields(`{"model":"gpt-4o","messages":[],"top_k":5}`, openAIKnownFields)
+	assert.False(t, ok)
+	assert.Contains(t, w.Body.String(), "top_k")
+}
+
+func TestCheckRequestFields_InvalidJSONLeftToParser(t *testing.T) {
+	withStrictRequestFields(t, true)
+
+	for _, body := range []string{`[]`, `{"model":`} {
+		ok, _ := performCheckRequestFields(body, anthropicKnownFields)
+		assert.True(t, ok, body)
+	}
+}
+
+func TestNewStrictRequestFieldsFromEnv(t *testing.T) {
+	t.Setenv("STRICT_REQUEST_FIELDS", "")
+	assert.False(t, NewStrictRequestFieldsFromEnv())
+
+	t.Setenv("STRICT_REQUEST_FIELDS", "TRUE")
+	assert.True(t, NewStrictRequestFieldsFromEnv())
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"math"
+	"os"
+	"strings"
+
+	"kiro2api/auth"
+	"kiro2api/logger"
+	"kiro2api/types"
+)
+
+// 客户端可见usage中output_tokens的来源（TOKEN_ACCOUNTING_SOURCE）
+const (
+	TokenAccountingEstimator  = "estimator"  // 按下发内容估算（默认）
+	TokenAccountingReconciled = "reconciled" // 估算值乘以账号最近一次对账得出的实际/估算比例
+)
+
+// tokenAccountingSource 当前的output_tokens来源（测试可替换）
+var tokenAccountingSource = TokenAccountingEstimator
+
+// NewTokenAccountingSourceFromEnv 读取 TOKEN_ACCOUNTING_SOURCE，无效值回退为estimator
+// 上游事件流不包含usage帧，因此只提供估算值及其按对账结果校正后的值
+func NewTokenAccountingSourceFromEnv() string {
+	source := strings.ToLower(strings.TrimSpace(os.Getenv("TOKEN_ACCOUNTING_SOURCE")))
+	switch source {
+	case "", TokenAccountingEstimator:
+		return TokenAccountingEstimator
+	case TokenAccountingReconciled:
+		return TokenAccountingReconciled
+	default:
+		logger.Warn("TOKEN_ACCOUNTING_SOURCE无效，使用estimator", logger.String("value", source))
+		return TokenAccountingEstimator
+	}
+}
+
+// tokenAccountingLedger 按账号累计估算token并提供对账数据
+// 由 NewRouter 注入 AuthService 的 TokenManager；为nil时不记录
+type tokenAccountingLedger interface {
+	AccountID(accessToken string) string
+	RecordEstimatedTokens(accessToken string, inputTokens, outputTokens int)
+	AccountingDay(day string) map[string]auth.AccountingFigures
+}
+
+var tokenAccounting tokenAccountingLedger
+
+// recordEstimatedTokens 把一次请求的估算token计入所用账号的对账统计
+func recordEstimatedTokens(token types.TokenInfo, inputTokens, outputTokens int) {
+	if tokenAccounting == nil {
+		return
+	}
+	tokenAccounting.RecordEstimatedTokens(token.AccessToken, inputTokens, outputTokens)
+}
+
+// outputTokenFactor 客户端可见output_tokens相对估算值的比例
+// 仅reconciled模式下、账号已有对账结果时不为1
+func outputTokenFactor(token types.TokenInfo) float64 {
+	if tokenAccountingSource != TokenAccountingReconciled || tokenAccounting == nil {
+		return 1
+	}
+	return reconciliationStore.Factor(tokenAccounting.AccountID(token.AccessToken))
+}
+
+// scaleOutputTokens 按比例换算output_tokens；估算值为正时结果至少为1
+func scaleOutputTokens(outputTokens int, factor float64) int {
+	if factor == 1 || outputTokens <= 0 {
+		return outputTokens
+	}
+	return max(int(math.Round(float64(outputTokens)*factor)), 1)
+}
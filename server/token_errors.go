@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"kiro2api/auth"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenErrorRecorder 记录转发生成请求时的账号失败
+// 由 NewRouter 注入 AuthService 的 TokenManager；为nil时不记录
+type tokenErrorRecorder interface {
+	RecordGenerateError(accessToken string, statusCode int, message string)
+}
+
+var tokenErrors tokenErrorRecorder
+
+// recordGenerateError 把一次失败的生成请求计入所用账号的错误记录，statusCode为0表示网络错误
+func recordGenerateError(tokenInfo types.TokenInfo, statusCode int, message string) {
+	if tokenErrors == nil {
+		return
+	}
+	tokenErrors.RecordGenerateError(tokenInfo.AccessToken, statusCode, message)
+}
+
+// resolveTokenConfig 按 /api/tokens 中的索引或ConfigID查找配置
+func resolveTokenConfig(configs []auth.AuthConfig, id string) (auth.AuthConfig, bool) {
+	if index, err := strconv.Atoi(id); err == nil {
+		if index < 0 || index >= len(configs) {
+			return auth.AuthConfig{}, false
+		}
+		return configs[index], true
+	}
+	for _, cfg := range configs {
+		if auth.ConfigID(cfg) == id {
+			return cfg, true
+		}
+	}
+	return auth.AuthConfig{}, false
+}
+
+// handleTokenErrors GET /api/tokens/:index/errors 和 GET /api/config/:index/errors
+// 返回账号最近的失败记录（刷新、用量检查、生成请求），从新到旧；:index 也可以是ConfigID
+func handleTokenErrors(c *gin.Context) {
+	configs, err := auth.GetConfigs()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "加载配置失败: %v", err)
+		return
+	}
+	cfg, found := resolveTokenConfig(configs, c.Param("index"))
+	if !found {
+		respondError(c, http.StatusNotFound, "%s", "配置不存在")
+		return
+	}
+	configID := auth.ConfigID(cfg)
+	c.JSON(http.StatusOK, gin.H{
+		"config_id": configID,
+		"errors":    auth.TokenErrors(configID),
+	})
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"kiro2api/auth"
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type generateErrorCall struct {
+	accessToken string
+	statusCode  int
+	message     string
+}
+
+type fakeTokenErrors struct {
+	calls []generateErrorCall
+}
+
+func (f *fakeTokenErrors) RecordGenerateError(accessToken string, statusCode int, message string) {
+	f.calls = append(f.calls, generateErrorCall{accessToken, statusCode, message})
+}
+
+func withFakeTokenErrors(t *testing.T) *fakeTokenErrors {
+	fake := &fakeTokenErrors{}
+	original := tokenErrors
+	tokenErrors = fake
+	t.Cleanup(func() { tokenErrors = original })
+	return fake
+}
+
+func TestExecuteCodeWhispererRequest_RecordsGenerateErrors(t *testing.T) {
+	fake := withFakeTokenErrors(t)
+	token := types.TokenInfo{AccessToken: "mock-access-token"}
+
+	newOverloadedUpstream(t)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	_, err := executeCodeWhispererRequest(newRequestScope(c, newOverloadedTestRequest(), &types.TokenWithUsage{TokenInfo: token}))
+	require.Error(t, err)
+
+	// 上游不可达
+	t.Setenv("CODEWHISPERER_BASE_URL", "http://127.0.0.1:1")
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	_, err = executeCodeWhispererRequest(newRequestScope(c, newOverloadedTestRequest(), &types.TokenWithUsage{TokenInfo: token}))
+	require.Error(t, err)
+
+	require.Len(t, fake.calls, 2)
+	assert.Equal(t, "mock-access-token", fake.calls[0].accessToken)
+	assert.Equal(t, http.StatusTooManyRequests, fake.calls[0].statusCode)
+	assert.Contains(t, fake.calls[0].message, "ThrottlingException")
+	assert.Zero(t, fake.calls[1].statusCode)
+	assert.NotEmpty(t, fake.calls[1].message)
+}
+
+func TestTokenErrorsAPI(t *testing.T) {
+	router, _, _ := setupTokenStatusTest(t)
+	router.GET("/api/tokens/:index/errors", handleTokenErrors)
+
+	// 刷新失败经由auth的失败路径写入错误记录
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+	}))
+	defer upstream.Close()
+	t.Setenv("SOCIAL_REFRESH_URL", upstream.URL)
+	cfg := auth.AuthConfig{AuthType: auth.AuthMethodSocial, RefreshToken: "refresh-token-bbbbbbbb"}
+	before := len(auth.TokenErrors(auth.ConfigID(cfg)))
+	for range 2 {
+		_, err := auth.RefreshToken(cfg)
+		require.Error(t, err)
+	}
+
+	pool := getTokenPool(t, router)
+	require.Len(t, pool.Tokens, 2)
+	assert.NotContains(t, pool.Tokens[0], "last_error", "没有失败记录的账号不附加")
+	lastError, ok := pool.Tokens[1]["last_error"].(map[string]any)
+	require.True(t, ok, "行内附加最近一次失败")
+	assert.Equal(t, auth.TokenErrorPhaseRefresh, lastError["phase"])
+	assert.Equal(t, float64(http.StatusUnauthorized), lastError["status"])
+	assert.Equal(t, auth.TokenErrorAuthFailure, lastError["type"])
+	assert.Contains(t, lastError["message"], "invalid_grant")
+
+	getErrors := func(id string) (*httptest.ResponseRecorder, []auth.TokenErrorRecord) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/tokens/"+id+"/errors", nil))
+		var resp struct {
+			ConfigID string                  `json:"config_id"`
+			Errors   []auth.TokenErrorRecord `json:"errors"`
+		}
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, auth.ConfigID(cfg), resp.ConfigID)
+		}
+		return w, resp.Errors
+	}
+
+	w, records := getErrors("1")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, records, before+2)
+	assert.Equal(t, auth.TokenErrorAuthFailure, records[0].Type)
+
+	w, byID := getErrors(auth.ConfigID(cfg))
+	require.Equal(t, http.StatusOK, w.Code, "也可以按ConfigID查询")
+	assert.Equal(t, records, byID)
+
+	w, _ = getErrors("2")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, _ = getErrors("unknown-id")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestConfigErrorsAPI_NewestFirst(t *testing.T) {
+	router, _, _ := setupTokenStatusTest(t)
+	router.GET("/api/config/:index/errors", handleTokenErrors)
+
+	statuses := []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests}
+	var status atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+		_, _ = w.Write([]byte(`{"error":"refresh failed"}`))
+	}))
+	defer upstream.Close()
+	t.Setenv("SOCIAL_REFRESH_URL", upstream.URL)
+
+	cfg := auth.AuthConfig{AuthType: auth.AuthMethodSocial, RefreshToken: "refresh-token-aaaaaaaa"}
+	getErrors := func() []auth.TokenErrorRecord {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/config/0/errors", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			ConfigID string                  `json:"config_id"`
+			Errors   []auth.TokenErrorRecord `json:"errors"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, auth.ConfigID(cfg), resp.ConfigID)
+		return resp.Errors
+	}
+	before := len(getErrors())
+
+	// 每次失败都追加到同一个账号的记录中
+	for i, code := range statuses {
+		status.Store(int32(code))
+		_, err := auth.RefreshToken(cfg)
+		require.Error(t, err)
+		require.Len(t, getErrors(), min(before+i+1, config.TokenErrorHistorySize))
+	}
+
+	records := getErrors()
+	assert.Equal(t, http.StatusTooManyRequests, records[0].Status, "最新的失败排在最前")
+	assert.Equal(t, auth.TokenErrorThrottled, records[0].Type)
+	assert.Equal(t, http.StatusForbidden, records[1].Status)
+	assert.Equal(t, http.StatusUnauthorized, records[2].Status)
+	assert.Equal(t, auth.TokenErrorAuthFailure, records[2].Type)
+	for i := 1; i < len(records); i++ {
+		assert.False(t, records[i].Time.After(records[i-1].Time), "按时间从新到旧")
+	}
+	assert.Equal(t, auth.TokenErrorPhaseRefresh, records[0].Phase)
+	assert.Contains(t, records[0].Message, "refresh failed")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/config/5/errors", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"iter"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TokenExportRow 导出给外部监控系统的单个token快照
+type TokenExportRow struct {
+	ID         string  `json:"id"`
+	Label      string  `json:"label"`
+	Email      string  `json:"email"` // 已脱敏
+	AuthType   string  `json:"auth_type"`
+	Status     string  `json:"status"`
+	Available  float64 `json:"available"`
+	TotalLimit float64 `json:"total_limit"`
+	Used       float64 `json:"used"`
+	NextReset  string  `json:"next_reset"` // RFC3339，未知时为空
+	LastError  string  `json:"last_error"`
+	CheckedAt  string  `json:"checked_at"` // RFC3339，尚未检查时为空
+}
+
+// tokenExportColumns CSV表头，与TokenExportRow的json字段一一对应
+var tokenExportColumns = []string{
+	"id", "label", "email", "auth_type", "status", "available",
+	"total_limit", "used", "next_reset", "last_error", "checked_at",
+}
+
+// handleTokenExport 导出token池快照，供外部监控系统采集
+// GET|HEAD /api/tokens/export?format=json|csv
+// 只读取后台检查的缓存结果；ETag/Last-Modified基于快照版本，未变化时返回304
+// 响应逐行流式写出（分块传输），HEAD只返回头部
+func handleTokenExport(c *gin.Context) {
+	format := strings.ToLower(c.DefaultQuery("format", "json"))
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format只支持json或csv"})
+		return
+	}
+
+	configs, err := auth.GetConfigs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "加载配置失败: " + err.Error()})
+		return
+	}
+
+	revision, updatedAt := tokenStatusMonitor.Revision()
+	etag := tokenExportETag(revision, configs)
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	if !updatedAt.IsZero() {
+		c.Header("Last-Modified", updatedAt.UTC().Format(http.TimeFormat))
+	}
+	if snapshotNotModified(c.Request, etag, updatedAt) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	// 逐行构建并写出，账号很多时也不必把整份导出放在内存中
+	rows := tokenExportRows(configs)
+	if format == "csv" {
+		if !beginExport(c, "text/csv; charset=utf-8", "kiro2api-tokens.csv") {
+			return
+		}
+		err = writeTokenExportCSV(c.Writer, rows)
+	} else {
+		if !beginExport(c, "application/json; charset=utf-8", "") {
+			return
+		}
+		err = streamJSONExport(c.Writer, gin.H{
+			"revision":     etag,
+			"generated_at": time.Now().Format(time.RFC3339),
+		}, "tokens", rows)
+	}
+	if err != nil {
+		// 响应头已发出，只能中断输出并记录
+		logger.Warn("导出token池快照中断", logger.String("format", format), logger.Err(err))
+	}
+}
+
+// tokenExportRows 按配置顺序逐个生成导出行
+func tokenExportRows(configs []auth.AuthConfig) iter.Seq[TokenExportRow] {
+	return func(yield func(TokenExportRow) bool) {
+		for i, authConfig := range configs {
+			if !yield(buildTokenExportRow(i, authConfig)) {
+				return
+			}
+		}
+	}
+}
+
+// buildTokenExportRow 根据配置和后台检查结果构建导出行，状态判断与/api/tokens一致
+func buildTokenExportRow(index int, authConfig auth.AuthConfig) TokenExportRow {
+	row := TokenExportRow{
+		ID:       fmt.Sprintf(config.TokenCacheKeyFormat, index),
+		Label:    strings.TrimSpace(authConfig.DisplayName),
+		AuthType: strings.ToLower(authConfig.AuthType),
+	}
+
+	if authConfig.Disabled {
+		row.Status = types.AccountStatusDisabled
+		return row
+	}
+
+	entry, checked := tokenStatusMonitor.Get(authConfig)
+	if !checked {
+		row.Status = types.AccountStatusPending
+		return row
+	}
+	row.CheckedAt = entry.CheckedAt.Format(time.RFC3339)
+
+	switch {
+	case errors.Is(entry.Err, auth.ErrRefreshThrottled):
+		row.Status = types.AccountStatusRefreshThrottled
+		row.LastError = entry.Err.Error()
+		return row
+	case entry.Err != nil:
+		row.Status = types.AccountStatusError
+		row.LastError = entry.Err.Error()
+		return row
+	case entry.Usage == nil || entry.TokenInfo.IsExpired():
+		row.Status = types.AccountStatusExpired
+		row.LastError = "Token已过期"
+		return row
+	}
+
+	usage := entry.Usage
+	row.Status = usage.Status
+	row.Available = usage.Available
+	row.TotalLimit = usage.TotalLimit
+	row.Used = usage.TotalUsed
+	switch {
+	case usage.Status == types.AccountStatusBanned:
+		row.LastError = usage.BanReason
+	case usage.Error != nil:
+		row.LastError = usage.Error.Error()
+	}
+
+	if usage.UsageLimits != nil {
+		row.Email = maskEmail(usage.UsageLimits.UserInfo.Email)
+		if usage.UsageLimits.NextDateReset > 0 {
+			row.NextReset = time.Unix(int64(usage.UsageLimits.NextDateReset), 0).UTC().Format(time.RFC3339)
+		}
+	}
+	return row
+}
+
+// writeTokenExportCSV 流式写出CSV
+func writeTokenExportCSV(w io.Writer, rows iter.Seq[TokenExportRow]) error {
+	formatFloat := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return streamCSVExport(w, tokenExportColumns, func(yield func([]string) bool) {
+		for row := range rows {
+			record := []string{
+				row.ID, row.Label, row.Email, row.AuthType, row.Status, formatFloat(row.Available),
+				formatFloat(row.TotalLimit), formatFloat(row.Used), row.NextReset, row.LastError, row.CheckedAt,
+			}
+			if !yield(record) {
+				return
+			}
+		}
+	})
+}
+
+// tokenExportETag 由检查结果版本号和配置列表指纹组成，
+// 配置增删或启用状态变化时即使尚未重新检查也会得到新的ETag
+func tokenExportETag(revision uint64, configs []auth.AuthConfig) string {
+	hash := fnv.New64a()
+	for _, cfg := range configs {
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%t\n", cfg.AuthType, cfg.RefreshToken, cfg.DisplayName, cfg.Disabled)
+	}
+	return fmt.Sprintf(`"%d-%x"`, revision, hash.Sum64())
+}
+
+// snapshotNotModified 判断条件请求是否命中：If-None-Match优先，其次If-Modified-Since
+// Last-Modified只反映检查结果的更新时间，需要感知配置变化的客户端应使用ETag
+func snapshotNotModified(r *http.Request, etag string, updatedAt time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if updatedAt.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !updatedAt.Truncate(time.Second).After(since)
+}
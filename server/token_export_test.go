@@ -0,0 +1,285 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupTokenExportTest 两个账号：一个带含逗号和引号的别名且检查成功，一个刷新失败（错误信息含逗号和引号）
+func setupTokenExportTest(t *testing.T) (*gin.Engine, *TokenStatusMonitor, []auth.AuthConfig) {
+	t.Setenv("AUTH_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"refresh-ok","displayName":"Team \"A\", primary"},`+
+		`{"auth":"IdC","refreshToken":"refresh-bad","clientId":"id","clientSecret":"secret"}]`)
+
+	monitor := NewTokenStatusMonitor(func(cfg auth.AuthConfig) tokenStatusEntry {
+		if cfg.RefreshToken == "refresh-bad" {
+			return tokenStatusEntry{Err: errors.New(`invalid_grant, "refresh token revoked"`), CheckedAt: time.Now()}
+		}
+		return tokenStatusEntry{
+			TokenInfo: types.TokenInfo{AccessToken: "access", ExpiresAt: time.Now().Add(time.Hour)},
+			Usage: &auth.UsageCheckResult{
+				Status: types.AccountStatusActive, Available: 30, TotalLimit: 50, TotalUsed: 20,
+				UsageLimits: &types.UsageLimits{
+					UserInfo:      types.UserInfo{Email: "someone@example.com"},
+					NextDateReset: 1767225600, // 2026-01-01T00:00:00Z
+				},
+			},
+			CheckedAt: time.Now(),
+		}
+	})
+	original := tokenStatusMonitor
+	tokenStatusMonitor = monitor
+	t.Cleanup(func() { tokenStatusMonitor = original })
+
+	configs, err := auth.GetConfigs()
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.GET("/api/tokens", handleTokenPoolAPI)
+	router.GET("/api/tokens/export", handleTokenExport)
+	router.POST("/api/tokens/:index/refresh", handleRefreshTokenStatus)
+	return router, monitor, configs
+}
+
+// waitForChecks 启动监控并等待所有配置完成检查
+func waitForChecks(t *testing.T, monitor *TokenStatusMonitor, configs []auth.AuthConfig) {
+	checkAllTokens(t, monitor, configs)
+	require.Eventually(t, func() bool {
+		revision, _ := monitor.Revision()
+		return revision == uint64(len(configs))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func exportTokens(router *gin.Engine, query string, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/tokens/export"+query, nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestTokenExport_JSON(t *testing.T) {
+	router, monitor, configs := setupTokenExportTest(t)
+	waitForChecks(t, monitor, configs)
+
+	w := exportTokens(router, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Revision string           `json:"revision"`
+		Tokens   []TokenExportRow `json:"tokens"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, w.Header().Get("ETag"), resp.Revision)
+	require.Len(t, resp.Tokens, 2)
+
+	ok := resp.Tokens[0]
+	assert.Equal(t, "token_0", ok.ID)
+	assert.Equal(t, `Team "A", primary`, ok.Label)
+	assert.Equal(t, maskEmail("someone@example.com"), ok.Email)
+	assert.NotContains(t, ok.Email, "someone@")
+	assert.Equal(t, types.AccountStatusActive, ok.Status)
+	assert.Equal(t, 30.0, ok.Available)
+	assert.Equal(t, 50.0, ok.TotalLimit)
+	assert.Equal(t, 20.0, ok.Used)
+	assert.Equal(t, "2026-01-01T00:00:00Z", ok.NextReset)
+	assert.NotEmpty(t, ok.CheckedAt)
+
+	bad := resp.Tokens[1]
+	assert.Equal(t, "idc", bad.AuthType)
+	assert.Equal(t, types.AccountStatusError, bad.Status)
+	assert.Equal(t, `invalid_grant, "refresh token revoked"`, bad.LastError)
+}
+
+func TestTokenExport_CSVEscaping(t *testing.T) {
+	router, monitor, configs := setupTokenExportTest(t)
+	waitForChecks(t, monitor, configs)
+
+	w := exportTokens(router, "?format=csv", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "kiro2api-tokens.csv")
+	assert.Contains(t, w.Body.String(), `"Team ""A"", primary"`)
+	assert.Contains(t, w.Body.String(), `"invalid_grant, ""refresh token revoked"""`)
+
+	records, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, tokenExportColumns, records[0])
+	assert.Equal(t, []string{"token_0", `Team "A", primary`, maskEmail("someone@example.com"), "social", "active",
+		"30", "50", "20", "2026-01-01T00:00:00Z", ""}, records[1][:10])
+	assert.Equal(t, `invalid_grant, "refresh token revoked"`, records[2][9])
+
+	assert.Equal(t, http.StatusBadRequest, exportTokens(router, "?format=xml", nil).Code)
+}
+
+func TestTokenExport_ConditionalRequests(t *testing.T) {
+	router, monitor, configs := setupTokenExportTest(t)
+	waitForChecks(t, monitor, configs)
+
+	first := exportTokens(router, "?format=csv", nil)
+	require.Equal(t, http.StatusOK, first.Code)
+	etag := first.Header().Get("ETag")
+	lastModified := first.Header().Get("Last-Modified")
+	require.NotEmpty(t, etag)
+	require.NotEmpty(t, lastModified)
+
+	notModified := exportTokens(router, "?format=csv", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, notModified.Code)
+	assert.Empty(t, notModified.Body.String())
+
+	assert.Equal(t, http.StatusNotModified,
+		exportTokens(router, "", map[string]string{"If-Modified-Since": lastModified}).Code)
+	assert.Equal(t, http.StatusOK,
+		exportTokens(router, "", map[string]string{"If-None-Match": `"stale"`, "If-Modified-Since": lastModified}).Code,
+		"If-None-Match优先于If-Modified-Since")
+
+	assert.Equal(t, http.StatusOK, exportTokens(router, "",
+		map[string]string{"If-Modified-Since": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}).Code)
+
+	// 重新检查后快照版本变化，旧的ETag不再命中
+	require.NoError(t, monitor.Enqueue(configs[1]))
+	require.Eventually(t, func() bool {
+		revision, _ := monitor.Revision()
+		return revision == uint64(len(configs)+1)
+	}, time.Second, 10*time.Millisecond)
+
+	changed := exportTokens(router, "", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, changed.Code)
+	assert.NotEqual(t, etag, changed.Header().Get("ETag"))
+}
+
+func TestTokenExportETag_ChangesWithConfigs(t *testing.T) {
+	configs := []auth.AuthConfig{{AuthType: auth.AuthMethodSocial, RefreshToken: "a"}}
+	etag := tokenExportETag(3, configs)
+	assert.Equal(t, etag, tokenExportETag(3, configs))
+	assert.NotEqual(t, etag, tokenExportETag(4, configs))
+
+	configs[0].Disabled = true
+	assert.NotEqual(t, etag, tokenExportETag(3, configs), "启用状态变化应产生新的ETag")
+}
+
+func TestTokenExport_HeadAndRange(t *testing.T) {
+	router, monitor, configs := setupTokenExportTest(t)
+	router.HEAD("/api/tokens/export", handleTokenExport)
+	waitForChecks(t, monitor, configs)
+
+	for _, query := range []string{"", "?format=csv"} {
+		get := exportTokens(router, query, map[string]string{"Range": "bytes=10-"})
+		require.Equal(t, http.StatusOK, get.Code, "不支持Range，返回完整内容")
+		assert.Equal(t, "none", get.Header().Get("Accept-Ranges"))
+		assert.Empty(t, get.Header().Get("Content-Range"))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("HEAD", "/api/tokens/export"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Body.String(), "HEAD只返回头部")
+		assert.Equal(t, get.Header().Get("Content-Type"), w.Header().Get("Content-Type"))
+		assert.Equal(t, get.Header().Get("ETag"), w.Header().Get("ETag"))
+		assert.Equal(t, "none", w.Header().Get("Accept-Ranges"))
+	}
+}
+
+func TestStreamExport_LargeExport(t *testing.T) {
+	const total = 10000
+	rows := func(yield func(TokenExportRow) bool) {
+		for i := range total {
+			if !yield(TokenExportRow{ID: fmt.Sprintf("token_%d", i), Label: `a, "b"`, Status: types.AccountStatusActive}) {
+				return
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	require.NoError(t, streamJSONExport(w, gin.H{"revision": `"1-2"`}, "tokens", rows))
+	var resp struct {
+		Revision string           `json:"revision"`
+		Tokens   []TokenExportRow `json:"tokens"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, `"1-2"`, resp.Revision)
+	require.Len(t, resp.Tokens, total)
+	assert.Equal(t, "token_9999", resp.Tokens[total-1].ID)
+
+	w = httptest.NewRecorder()
+	require.NoError(t, writeTokenExportCSV(w, rows))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, total+1)
+	assert.Equal(t, `a, "b"`, records[total][1])
+
+	w = httptest.NewRecorder()
+	require.NoError(t, streamJSONExport(w, nil, "tokens", rows))
+	assert.True(t, strings.HasPrefix(w.Body.String(), `{"tokens":[`))
+	assert.True(t, json.Valid(w.Body.Bytes()))
+}
+
+func TestStreamExport_ChunksArriveBeforeHandlerFinishes(t *testing.T) {
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(finished)
+		rows := func(yield func([]string) bool) {
+			for i := range 2 * config.ExportFlushRows {
+				if i == config.ExportFlushRows {
+					<-release // 前一批已Flush，等客户端确认收到后再继续
+				}
+				if !yield([]string{fmt.Sprintf("row-%d", i)}) {
+					return
+				}
+			}
+		}
+		_ = streamCSVExport(w, []string{"id"}, rows)
+	}))
+	defer server.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	reader := csv.NewReader(resp.Body)
+	for i := range config.ExportFlushRows + 1 {
+		record, err := reader.Read()
+		require.NoError(t, err)
+		if i > 0 {
+			assert.Equal(t, fmt.Sprintf("row-%d", i-1), record[0])
+		}
+	}
+	select {
+	case <-finished:
+		t.Fatal("处理函数不应已经结束")
+	default:
+	}
+
+	close(release)
+	rest, err := reader.ReadAll()
+	require.NoError(t, err)
+	assert.Len(t, rest, config.ExportFlushRows)
+	<-finished
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/types"
+)
+
+// tokenHealthTracker 记录上游请求结果并提供token健康评分
+// 由 StartServer 注入 AuthService 的 TokenManager；为nil时不记录
+type tokenHealthTracker interface {
+	RecordResult(accessToken string, latency time.Duration, failed bool)
+	ReleaseToken(accessToken string)
+	HealthScores() map[string]auth.TokenHealthScore
+}
+
+var tokenHealth tokenHealthTracker
+
+// recordTokenHealth 把一次上游请求的结果计入所用token的健康评分
+// 只统计与账号健康相关的结果：成功、网络错误、鉴权失败、限流和上游5xx；
+// 其他4xx通常是请求本身的问题，不影响token评分
+func recordTokenHealth(tokenInfo types.TokenInfo, latency time.Duration, statusCode int, err error) {
+	if tokenHealth == nil {
+		return
+	}
+	if failed, counted := classifyTokenResult(statusCode, err); counted {
+		tokenHealth.RecordResult(tokenInfo.AccessToken, latency, failed)
+	}
+}
+
+// classifyTokenResult 上游请求结果是否计入token评分，以及是否算作失败
+func classifyTokenResult(statusCode int, err error) (failed, counted bool) {
+	switch {
+	case err != nil:
+		return true, true
+	case statusCode == http.StatusOK:
+		return false, true
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden,
+		statusCode == http.StatusTooManyRequests, statusCode >= http.StatusInternalServerError:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// recordTokenResult 把当前token的上游请求结果计入健康评分
+// 收到响应头时即记录，进行中计数保留到请求结束（流式响应仍在占用账号）
+func (s *RequestScope) recordTokenResult(latency time.Duration, statusCode int, err error) {
+	recordTokenHealth(s.TokenInfo(), latency, statusCode, err)
+}
+
+// switchToken 换用新选定的token（如空流重试），先释放之前token的进行中计数
+func (s *RequestScope) switchToken(next *types.TokenWithUsage) {
+	s.releaseToken()
+	s.Token = next
+	s.tokenReleased = false
+}
+
+// releaseToken 请求结束时释放选择token时记录的进行中计数，无论请求成功、出错、被新流取消还是客户端断开
+// 每次选择只释放一次，否则会抵消其他请求的进行中计数
+func (s *RequestScope) releaseToken() {
+	if s.tokenReleased || s.Token == nil {
+		return
+	}
+	s.tokenReleased = true
+	if tokenHealth != nil {
+		tokenHealth.ReleaseToken(s.Token.TokenInfo.AccessToken)
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/fakeupstream"
+	"kiro2api/types"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTokenHealth 记录RecordResult调用的假健康统计
+type fakeTokenHealth struct {
+	results  []bool
+	released int
+	scores   map[string]auth.TokenHealthScore
+}
+
+func (f *fakeTokenHealth) RecordResult(accessToken string, latency time.Duration, failed bool) {
+	f.results = append(f.results, failed)
+}
+
+func (f *fakeTokenHealth) ReleaseToken(accessToken string) {
+	f.released++
+}
+
+func (f *fakeTokenHealth) HealthScores() map[string]auth.TokenHealthScore {
+	return f.scores
+}
+
+func withFakeTokenHealth(t *testing.T, scores map[string]auth.TokenHealthScore) *fakeTokenHealth {
+	fake := &fakeTokenHealth{scores: scores}
+	original := tokenHealth
+	tokenHealth = fake
+	t.Cleanup(func() { tokenHealth = original })
+	return fake
+}
+
+func TestRecordTokenHealth_Classification(t *testing.T) {
+	fake := withFakeTokenHealth(t, nil)
+	token := types.TokenInfo{AccessToken: "access"}
+
+	recordTokenHealth(token, time.Second, http.StatusOK, nil)
+	recordTokenHealth(token, time.Second, 0, errors.New("connection reset"))
+	recordTokenHealth(token, time.Second, http.StatusForbidden, nil)
+	recordTokenHealth(token, time.Second, http.StatusTooManyRequests, nil)
+	recordTokenHealth(token, time.Second, http.StatusBadGateway, nil)
+	recordTokenHealth(token, time.Second, http.StatusBadRequest, nil) // 请求本身的问题，不计入
+
+	assert.Equal(t, []bool{false, true, true, true, true}, fake.results)
+	assert.Zero(t, fake.released, "进行中计数在请求结束时释放，不随结果释放")
+}
+
+func TestHandleTokenPoolAPI_IncludesHealthScores(t *testing.T) {
+	router, monitor, _ := setupTokenStatusTest(t)
+	withFakeTokenHealth(t, map[string]auth.TokenHealthScore{
+		"token_1": {Score: 0.25, ErrorRate: 0.6, Requests: 10, Errors: 6},
+	})
+
+	configs, err := auth.GetConfigs()
+	if assert.NoError(t, err) {
+		checkAllTokens(t, monitor, configs)
+	}
+	assert.Eventually(t, func() bool {
+		_, checked := monitor.Get(configs[1])
+		return checked
+	}, time.Second, 10*time.Millisecond)
+
+	resp := getTokenPool(t, router)
+	assert.NotContains(t, resp.Tokens[0], "health")
+	health := resp.Tokens[1]["health"].(map[string]any)
+	assert.Equal(t, 0.25, health["score"])
+	assert.Equal(t, 0.6, health["error_rate"])
+	assert.Equal(t, float64(6), health["errors"])
+}
+
+// startClusterStack 启动完整路由，token池共享状态写入miniredis，上游由假上游响应
+func startClusterStack(t *testing.T, scenario *fakeupstream.Scenario) (*httptest.Server, *miniredis.Miniredis) {
+	t.Helper()
+	redisServer := miniredis.RunT(t)
+	t.Setenv("AUTH_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"cluster-refresh-token"}]`)
+	t.Setenv("CLUSTER_REDIS_URL", "redis://"+redisServer.Addr())
+	t.Setenv("CLUSTER_REDIS_PREFIX", "test:")
+
+	_, restore := fakeupstream.Install(scenario)
+	t.Cleanup(restore)
+	authService, err := auth.NewAuthService()
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(newTestRouter(t, routerTestToken, authService))
+	t.Cleanup(srv.Close)
+	return srv, redisServer
+}
+
+// clusterCounter 共享状态中某类计数在各账号上的合计
+// 计数减到0时键会被删除，读取期间消失的键按0计
+func clusterCounter(redisServer *miniredis.Miniredis, kind string) int {
+	total := 0
+	for _, key := range redisServer.Keys() {
+		if !strings.HasPrefix(key, "test:"+kind+":") {
+			continue
+		}
+		value, _ := redisServer.Get(key)
+		n, _ := strconv.Atoi(value)
+		total += n
+	}
+	return total
+}
+
+func postClusterMessage(ctx context.Context, srv *httptest.Server, model string, stream bool) (*http.Response, error) {
+	body := fmt.Sprintf(`{"model":%q,"max_tokens":64,"stream":%t,"messages":[{"role":"user","content":"hi"}]}`, model, stream)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/v1/messages", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+routerTestToken)
+	return http.DefaultClient.Do(req)
+}
+
+// clusterAccountIDs 共享状态中已记录选择的账号ID
+func clusterAccountIDs(redisServer *miniredis.Miniredis) []string {
+	var ids []string
+	for _, key := range redisServer.Keys() {
+		if id, ok := strings.CutPrefix(key, "test:used:"); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestClusterInFlight_HeldWhileStreamOpen(t *testing.T) {
+	srv, redisServer := startClusterStack(t, &fakeupstream.Scenario{Name: "slow", ResponseTokens: 20, TokensPerSecond: 20, ChunkText: "ok "})
+	// 另一个副本按同样的环境变量连接共享状态
+	replica := auth.NewClusterStateFromEnv()
+	require.NotNil(t, replica)
+	t.Cleanup(func() { _ = replica.Close() })
+
+	resp, err := postClusterMessage(context.Background(), srv, "claude-sonnet-4-20250514", true)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	// 读到首个事件时上游响应头已到达、结果已计入健康评分，流仍在进行
+	_, err = resp.Body.Read(make([]byte, 1))
+	require.NoError(t, err)
+
+	ids := clusterAccountIDs(redisServer)
+	require.Len(t, ids, 1)
+	assert.Equal(t, int64(1), replica.Snapshot(ids)[ids[0]].InFlight, "流未结束时其他副本应看到进行中的请求")
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	assert.Eventually(t, func() bool {
+		return replica.Snapshot(ids)[ids[0]].InFlight == 0
+	}, 2*time.Second, 10*time.Millisecond, "流结束后进行中计数应释放")
+}
+
+func TestClusterInFlight_ReleasedWhenRequestEnds(t *testing.T) {
+	const model = "claude-sonnet-4-20250514"
+	cases := []struct {
+		name     string
+		scenario fakeupstream.Scenario
+		send     func(t *testing.T, srv *httptest.Server)
+	}{
+		{
+			name:     "success",
+			scenario: fakeupstream.Scenario{Name: "ok", ResponseTokens: 3, ChunkText: "ok "},
+			send: func(t *testing.T, srv *httptest.Server) {
+				for _, stream := range []bool{false, true} {
+					resp, err := postClusterMessage(context.Background(), srv, model, stream)
+					require.NoError(t, err)
+					_, _ = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					assert.Equal(t, http.StatusOK, resp.StatusCode)
+				}
+			},
+		},
+		{
+			name:     "upstream 4xx",
+			scenario: fakeupstream.Scenario{Name: "bad-request", ErrorRate: 1, ErrorStatus: http.StatusBadRequest},
+			send: func(t *testing.T, srv *httptest.Server) {
+				for _, stream := range []bool{false, true} {
+					resp, err := postClusterMessage(context.Background(), srv, model, stream)
+					require.NoError(t, err)
+					_, _ = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			},
+		},
+		{
+			name:     "client disconnect",
+			scenario: fakeupstream.Scenario{Name: "slow", ResponseTokens: 20, TokensPerSecond: 50, ChunkText: "ok "},
+			send: func(t *testing.T, srv *httptest.Server) {
+				ctx, cancel := context.WithCancel(context.Background())
+				resp, err := postClusterMessage(ctx, srv, model, true)
+				require.NoError(t, err)
+				// 读到首个事件后断开
+				_, err = resp.Body.Read(make([]byte, 1))
+				require.NoError(t, err)
+				cancel()
+				resp.Body.Close()
+			},
+		},
+		{
+			name:     "unknown model",
+			scenario: fakeupstream.Scenario{Name: "ok", ResponseTokens: 1, ChunkText: "ok "},
+			send: func(t *testing.T, srv *httptest.Server) {
+				// 上游请求没有发出，token仍需释放
+				resp, err := postClusterMessage(context.Background(), srv, "no-such-model", false)
+				require.NoError(t, err)
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, redisServer := startClusterStack(t, &tc.scenario)
+			usedBefore := clusterCounter(redisServer, "used")
+
+			tc.send(t, srv)
+
+			assert.Greater(t, clusterCounter(redisServer, "used"), usedBefore, "请求应在共享状态中记录选择")
+			assert.Eventually(t, func() bool {
+				return clusterCounter(redisServer, "inflight") == 0
+			}, 2*time.Second, 10*time.Millisecond, "请求结束后进行中计数应回到0")
+		})
+	}
+}
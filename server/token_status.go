@@ -0,0 +1,274 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// tokenStatusEntry 后台检查得到的单个token状态快照
+type tokenStatusEntry struct {
+	TokenInfo types.TokenInfo
+	Usage     *auth.UsageCheckResult // 刷新失败或token已过期时为nil
+	Err       error                  // 刷新token失败的错误
+	CheckedAt time.Time
+}
+
+// TokenStatusMonitor 维护Dashboard的token状态
+// 周期同步只读取token管理器的缓存（token管理器自己负责刷新和用量检查），不发起上游请求；
+// 只有显式入队的配置（POST /api/tokens/:index/refresh）才以有限的并发刷新token并查询用量
+// Dashboard只读取已有的结果，不在HTTP处理中发起任何上游请求
+type TokenStatusMonitor struct {
+	mutex   sync.RWMutex
+	entries map[string]tokenStatusEntry // key: refreshToken
+	queued  map[string]bool
+	queue   chan auth.AuthConfig
+	check   func(auth.AuthConfig) tokenStatusEntry
+	cached  func(auth.AuthConfig) (tokenStatusEntry, bool) // 周期同步读取的缓存状态，未设置时只保留显式检查的结果
+	workers int                                            // 并行检查的协程数
+	started sync.Once
+
+	onRefresh func([]auth.AuthConfig) // 每轮周期同步前调用，可读取上一轮的结果
+
+	revision  uint64    // 每写入一次检查结果加1
+	updatedAt time.Time // 最近一次写入检查结果的时间
+}
+
+var tokenStatusMonitor = NewTokenStatusMonitor(checkTokenStatus)
+
+// NewTokenStatusMonitor 创建token状态监控器，check为单个配置的检查函数
+func NewTokenStatusMonitor(check func(auth.AuthConfig) tokenStatusEntry) *TokenStatusMonitor {
+	return &TokenStatusMonitor{
+		entries: make(map[string]tokenStatusEntry),
+		queued:  make(map[string]bool),
+		queue:   make(chan auth.AuthConfig, config.TokenStatusQueueSize),
+		check:   check,
+		workers: 1,
+	}
+}
+
+// NewTokenStatusWorkersFromEnv TOKEN_STATUS_WORKERS: 并行检查token状态的协程数（默认4，范围1~16）
+func NewTokenStatusWorkersFromEnv() int {
+	workers := utils.GetEnvIntWithDefault("TOKEN_STATUS_WORKERS", config.DefaultTokenStatusWorkers)
+	if workers < 1 || workers > config.MaxTokenStatusWorkers {
+		clamped := min(max(workers, 1), config.MaxTokenStatusWorkers)
+		logger.Warn("TOKEN_STATUS_WORKERS超出范围，已调整",
+			logger.Int("value", workers),
+			logger.Int("applied", clamped))
+		workers = clamped
+	}
+	return workers
+}
+
+// SetWorkers 设置并行检查的协程数，需在Start之前调用
+func (m *TokenStatusMonitor) SetWorkers(workers int) {
+	m.workers = max(workers, 1)
+}
+
+// SetRefreshHook 设置每轮周期同步前的回调，需在Start之前调用
+func (m *TokenStatusMonitor) SetRefreshHook(hook func([]auth.AuthConfig)) {
+	m.onRefresh = hook
+}
+
+// SetCachedSource 设置周期同步读取缓存状态的函数，需在Start之前调用
+func (m *TokenStatusMonitor) SetCachedSource(cached func(auth.AuthConfig) (tokenStatusEntry, bool)) {
+	m.cached = cached
+}
+
+// Start 启动显式检查的协程，并按interval周期性地从缓存同步loadConfigs返回的所有配置
+// 多次调用只会启动一次
+func (m *TokenStatusMonitor) Start(loadConfigs func() ([]auth.AuthConfig, error), interval time.Duration) {
+	m.started.Do(func() {
+		for i := 0; i < m.workers; i++ {
+			go m.run()
+		}
+		go func() {
+			m.syncAll(loadConfigs)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				m.syncAll(loadConfigs)
+			}
+		}()
+	})
+}
+
+// run 消费检查队列；协程数由workers限定，避免同时发起大量刷新请求
+// 同一配置在检查完成前不会再次入队，因此不会被并行检查
+func (m *TokenStatusMonitor) run() {
+	for cfg := range m.queue {
+		entry := m.check(cfg)
+
+		m.mutex.Lock()
+		m.entries[cfg.RefreshToken] = entry
+		delete(m.queued, cfg.RefreshToken)
+		m.revision++
+		m.updatedAt = time.Now()
+		m.mutex.Unlock()
+	}
+}
+
+// syncAll 清理已删除配置的结果，并从缓存同步所有未禁用的配置
+// 缓存中没有的配置（尚未刷新成功）保留之前的结果
+func (m *TokenStatusMonitor) syncAll(loadConfigs func() ([]auth.AuthConfig, error)) {
+	configs, err := loadConfigs()
+	if err != nil {
+		logger.Warn("token状态同步跳过：加载配置失败", logger.Err(err))
+		return
+	}
+	if m.onRefresh != nil {
+		m.onRefresh(configs)
+	}
+
+	current := make(map[string]bool, len(configs))
+	synced := make(map[string]tokenStatusEntry, len(configs))
+	for _, cfg := range configs {
+		current[cfg.RefreshToken] = true
+		if cfg.Disabled || m.cached == nil {
+			continue
+		}
+		if entry, exists := m.cached(cfg); exists {
+			synced[cfg.RefreshToken] = entry
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	changed := false
+	for refreshToken := range m.entries {
+		if !current[refreshToken] {
+			delete(m.entries, refreshToken)
+			changed = true
+		}
+	}
+	for refreshToken := range m.queued {
+		if !current[refreshToken] {
+			delete(m.queued, refreshToken)
+		}
+	}
+	for refreshToken, entry := range synced {
+		// 显式检查的结果比缓存新时保留
+		if existing, exists := m.entries[refreshToken]; exists {
+			if existing.CheckedAt.After(entry.CheckedAt) || sameTokenStatus(existing, entry) {
+				continue
+			}
+		}
+		m.entries[refreshToken] = entry
+		changed = true
+	}
+	if changed {
+		m.revision++
+		m.updatedAt = time.Now()
+	}
+}
+
+// sameTokenStatus 两次结果是否相同，相同时不更新版本号，条件请求仍可返回304
+func sameTokenStatus(a, b tokenStatusEntry) bool {
+	if !a.CheckedAt.Equal(b.CheckedAt) || a.Err != nil || b.Err != nil || (a.Usage == nil) != (b.Usage == nil) {
+		return false
+	}
+	return a.Usage == nil || (a.Usage.Status == b.Usage.Status && a.Usage.Available == b.Usage.Available)
+}
+
+// Enqueue 异步加入检查队列，已在队列中的配置不会重复加入
+func (m *TokenStatusMonitor) Enqueue(cfg auth.AuthConfig) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.queued[cfg.RefreshToken] {
+		return nil
+	}
+
+	select {
+	case m.queue <- cfg:
+		m.queued[cfg.RefreshToken] = true
+		return nil
+	default:
+		return fmt.Errorf("token状态检查队列已满")
+	}
+}
+
+// Get 返回配置的最近一次检查结果
+func (m *TokenStatusMonitor) Get(cfg auth.AuthConfig) (tokenStatusEntry, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry, exists := m.entries[cfg.RefreshToken]
+	return entry, exists
+}
+
+// Revision 返回检查结果快照的版本号和最近更新时间，用于条件请求
+func (m *TokenStatusMonitor) Revision() (uint64, time.Time) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.revision, m.updatedAt
+}
+
+// PoolSnapshot 汇总未禁用配置的最近检查结果，得到账号池的总可用额度
+// 刷新失败或token已过期的账号计为0额度
+func (m *TokenStatusMonitor) PoolSnapshot(configs []auth.AuthConfig, now time.Time) PoolSnapshot {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	snapshot := PoolSnapshot{At: now}
+	for _, cfg := range configs {
+		if cfg.Disabled {
+			continue
+		}
+		snapshot.Accounts++
+		entry, exists := m.entries[cfg.RefreshToken]
+		if !exists {
+			continue
+		}
+		snapshot.CheckedAccounts++
+		if entry.Usage != nil && !entry.TokenInfo.IsExpired() {
+			snapshot.AvailableCredits += entry.Usage.Available
+		}
+	}
+	return snapshot
+}
+
+// IsQueued 检查配置是否正在等待检查
+func (m *TokenStatusMonitor) IsQueued(cfg auth.AuthConfig) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.queued[cfg.RefreshToken]
+}
+
+// cachedTokenStatus 从token管理器的缓存读取状态，不发起上游请求
+func cachedTokenStatus(tm interface {
+	CachedState(auth.AuthConfig) (auth.CachedTokenState, bool)
+}) func(auth.AuthConfig) (tokenStatusEntry, bool) {
+	return func(cfg auth.AuthConfig) (tokenStatusEntry, bool) {
+		state, exists := tm.CachedState(cfg)
+		if !exists {
+			return tokenStatusEntry{}, false
+		}
+		return tokenStatusEntry{TokenInfo: state.Token, Usage: state.Usage, CheckedAt: state.CachedAt}, true
+	}
+}
+
+// checkTokenStatus 刷新token并查询使用限制，只用于显式刷新（POST /api/tokens/:index/refresh）
+func checkTokenStatus(cfg auth.AuthConfig) tokenStatusEntry {
+	entry := tokenStatusEntry{CheckedAt: time.Now()}
+
+	tokenInfo, err := refreshSingleTokenByConfig(cfg)
+	if err != nil {
+		entry.Err = err
+		return entry
+	}
+	entry.TokenInfo = tokenInfo
+
+	if tokenInfo.IsExpired() {
+		return entry
+	}
+
+	// 显式刷新需要最新结果，不使用缓存；新结果写回缓存供其他路径复用
+	entry.Usage = auth.NewUsageLimitsChecker().ForceCheckUsageLimitsWithStatus(tokenInfo)
+	return entry
+}
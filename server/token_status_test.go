@@ -0,0 +1,402 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupTokenStatusTest 配置两个测试token，并用计数的假检查函数替换全局监控器
+func setupTokenStatusTest(t *testing.T) (*gin.Engine, *TokenStatusMonitor, *int32) {
+	t.Setenv("AUTH_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"refresh-token-aaaaaaaa"},{"auth":"Social","refreshToken":"refresh-token-bbbbbbbb"}]`)
+
+	var checks int32
+	monitor := NewTokenStatusMonitor(func(cfg auth.AuthConfig) tokenStatusEntry {
+		atomic.AddInt32(&checks, 1)
+		return tokenStatusEntry{
+			TokenInfo: types.TokenInfo{AccessToken: "access-token-1234567890", ExpiresAt: time.Now().Add(time.Hour)},
+			Usage:     &auth.UsageCheckResult{Status: types.AccountStatusActive, Available: 42},
+			CheckedAt: time.Now(),
+		}
+	})
+
+	original := tokenStatusMonitor
+	tokenStatusMonitor = monitor
+	t.Cleanup(func() { tokenStatusMonitor = original })
+
+	router := gin.New()
+	router.GET("/api/tokens", handleTokenPoolAPI)
+	router.POST("/api/tokens/:index/refresh", handleRefreshTokenStatus)
+	return router, monitor, &checks
+}
+
+// checkAllTokens 启动检查协程并显式检查所有配置（周期同步不发起检查）
+func checkAllTokens(t *testing.T, monitor *TokenStatusMonitor, configs []auth.AuthConfig) {
+	t.Helper()
+	monitor.Start(func() ([]auth.AuthConfig, error) { return configs, nil }, time.Hour)
+	for _, cfg := range configs {
+		require.NoError(t, monitor.Enqueue(cfg))
+	}
+}
+
+type tokenPoolResponse struct {
+	ActiveTokens int              `json:"active_tokens"`
+	Tokens       []map[string]any `json:"tokens"`
+}
+
+func getTokenPool(t *testing.T, router *gin.Engine) tokenPoolResponse {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/tokens", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp tokenPoolResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestHandleTokenPoolAPI_ColdCacheReturnsPendingWithoutUpstreamCalls(t *testing.T) {
+	router, _, checks := setupTokenStatusTest(t)
+
+	upstreamHits := int32(0)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamHits, 1)
+	}))
+	defer upstream.Close()
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+
+	resp := getTokenPool(t, router)
+
+	require.Len(t, resp.Tokens, 2)
+	for _, token := range resp.Tokens {
+		assert.Equal(t, types.AccountStatusPending, token["status"])
+	}
+	assert.Equal(t, 0, resp.ActiveTokens)
+	assert.Equal(t, int32(0), atomic.LoadInt32(checks), "GET不应触发token检查")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&upstreamHits), "GET不应发起上游请求")
+}
+
+func TestHandleRefreshTokenStatus_ChecksAsynchronously(t *testing.T) {
+	router, monitor, checks := setupTokenStatusTest(t)
+	go monitor.run()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/tokens/1/refresh", nil))
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	require.Eventually(t, func() bool {
+		_, checked := monitor.Get(auth.AuthConfig{RefreshToken: "refresh-token-bbbbbbbb"})
+		return checked
+	}, time.Second, 10*time.Millisecond)
+
+	resp := getTokenPool(t, router)
+	require.Len(t, resp.Tokens, 2)
+	assert.Equal(t, types.AccountStatusPending, resp.Tokens[0]["status"])
+	assert.Equal(t, types.AccountStatusActive, resp.Tokens[1]["status"])
+	assert.Equal(t, float64(42), resp.Tokens[1]["remaining_usage"])
+	assert.Equal(t, 1, resp.ActiveTokens)
+	assert.Equal(t, int32(1), atomic.LoadInt32(checks), "只应检查被请求刷新的token")
+}
+
+func TestHandleRefreshTokenStatus_InvalidIndex(t *testing.T) {
+	router, _, _ := setupTokenStatusTest(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/tokens/abc/refresh", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/tokens/5/refresh", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTokenStatusMonitor_EnqueueDeduplicates(t *testing.T) {
+	monitor := NewTokenStatusMonitor(func(auth.AuthConfig) tokenStatusEntry { return tokenStatusEntry{} })
+	cfg := auth.AuthConfig{RefreshToken: "refresh-token"}
+
+	require.NoError(t, monitor.Enqueue(cfg))
+	require.NoError(t, monitor.Enqueue(cfg))
+	assert.True(t, monitor.IsQueued(cfg))
+	assert.Len(t, monitor.queue, 1)
+}
+
+func TestTokenStatusMonitor_SyncReadsCacheWithoutChecks(t *testing.T) {
+	var checks int32
+	monitor := NewTokenStatusMonitor(func(auth.AuthConfig) tokenStatusEntry {
+		atomic.AddInt32(&checks, 1)
+		return tokenStatusEntry{CheckedAt: time.Now()}
+	})
+	cachedAt := time.Now().Add(-time.Minute)
+	available := 42.0
+	monitor.SetCachedSource(func(cfg auth.AuthConfig) (tokenStatusEntry, bool) {
+		if cfg.RefreshToken != "refresh-cached" {
+			return tokenStatusEntry{}, false
+		}
+		return tokenStatusEntry{
+			TokenInfo: types.TokenInfo{AccessToken: "access-token-1234567890", ExpiresAt: time.Now().Add(time.Hour)},
+			Usage:     &auth.UsageCheckResult{Status: types.AccountStatusActive, Available: available},
+			CheckedAt: cachedAt,
+		}, true
+	})
+
+	cached := auth.AuthConfig{RefreshToken: "refresh-cached"}
+	explicit := auth.AuthConfig{RefreshToken: "refresh-explicit"}
+	configs := []auth.AuthConfig{cached, explicit, {RefreshToken: "refresh-pending"}}
+	monitor.entries[explicit.RefreshToken] = tokenStatusEntry{Err: assert.AnError, CheckedAt: time.Now()}
+	// 已删除配置的结果和排队标记被清理
+	monitor.entries["refresh-removed"] = tokenStatusEntry{CheckedAt: time.Now()}
+	monitor.queued["refresh-removed"] = true
+
+	loadConfigs := func() ([]auth.AuthConfig, error) { return configs, nil }
+	monitor.syncAll(loadConfigs)
+	assert.Zero(t, atomic.LoadInt32(&checks), "周期同步不发起检查")
+	entry, exists := monitor.Get(cached)
+	require.True(t, exists)
+	assert.Equal(t, 42.0, entry.Usage.Available)
+	entry, exists = monitor.Get(explicit)
+	require.True(t, exists, "缓存中没有的配置保留显式检查的结果")
+	assert.Error(t, entry.Err)
+	assert.Len(t, monitor.entries, 2)
+	assert.NotContains(t, monitor.queued, "refresh-removed")
+
+	// 缓存未变化时版本号不变
+	revision, _ := monitor.Revision()
+	monitor.syncAll(loadConfigs)
+	unchanged, _ := monitor.Revision()
+	assert.Equal(t, revision, unchanged)
+
+	// 本地扣减后同步新的可用次数
+	available = 41
+	monitor.syncAll(loadConfigs)
+	updated, _ := monitor.Revision()
+	assert.Greater(t, updated, revision)
+	entry, _ = monitor.Get(cached)
+	assert.Equal(t, 41.0, entry.Usage.Available)
+}
+
+func TestRouter_RefreshTokenStatusRequiresAdminToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-token")
+	assert.Equal(t, http.StatusUnauthorized, serveRouter(t, http.MethodPost, "/api/tokens/0/refresh", "", false).Code)
+	assert.Equal(t, http.StatusUnauthorized, serveRouter(t, http.MethodPost, "/api/tokens/0/refresh", "", true).Code, "客户端令牌不能触发上游检查")
+}
+
+func TestHandleTokenPoolAPI_RefreshThrottled(t *testing.T) {
+	t.Setenv("AUTH_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"IdC","refreshToken":"refresh-a","clientId":"shared","clientSecret":"s"}]`)
+	retryAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	monitor := NewTokenStatusMonitor(func(cfg auth.AuthConfig) tokenStatusEntry {
+		return tokenStatusEntry{Err: &auth.RefreshThrottledError{ClientID: "shared", RetryAt: retryAt}, CheckedAt: time.Now()}
+	})
+	original := tokenStatusMonitor
+	tokenStatusMonitor = monitor
+	t.Cleanup(func() { tokenStatusMonitor = original })
+
+	configs, err := auth.GetConfigs()
+	require.NoError(t, err)
+	checkAllTokens(t, monitor, configs)
+	require.Eventually(t, func() bool {
+		_, checked := monitor.Get(configs[0])
+		return checked
+	}, time.Second, 10*time.Millisecond)
+
+	router := gin.New()
+	router.GET("/api/tokens", handleTokenPoolAPI)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/tokens", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Tokens           []map[string]any `json:"tokens"`
+		IdCRefreshGroups []any            `json:"idc_refresh_groups"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Tokens, 1)
+	assert.Equal(t, types.AccountStatusRefreshThrottled, resp.Tokens[0]["status"], "限流不应显示为错误")
+	assert.Equal(t, retryAt.Format(time.RFC3339), resp.Tokens[0]["retry_at"])
+	assert.NotNil(t, resp.IdCRefreshGroups)
+}
+
+func TestHandleTokenPoolAPI_AgeAndStale(t *testing.T) {
+	t.Setenv("AUTH_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"refresh-fresh"},{"auth":"Social","refreshToken":"refresh-old"}]`)
+	t.Setenv("USAGE_HARD_TTL", "30m")
+	monitor := NewTokenStatusMonitor(func(cfg auth.AuthConfig) tokenStatusEntry {
+		checkedAt := time.Now()
+		if cfg.RefreshToken == "refresh-old" {
+			checkedAt = checkedAt.Add(-time.Hour) // 后台检查停滞
+		}
+		return tokenStatusEntry{
+			TokenInfo: types.TokenInfo{AccessToken: "access-token-1234567890", ExpiresAt: time.Now().Add(2 * time.Hour)},
+			Usage:     &auth.UsageCheckResult{Status: types.AccountStatusActive, Available: 42},
+			CheckedAt: checkedAt,
+		}
+	})
+	original := tokenStatusMonitor
+	tokenStatusMonitor = monitor
+	t.Cleanup(func() { tokenStatusMonitor = original })
+
+	configs, err := auth.GetConfigs()
+	require.NoError(t, err)
+	checkAllTokens(t, monitor, configs)
+	require.Eventually(t, func() bool {
+		_, fresh := monitor.Get(configs[0])
+		_, old := monitor.Get(configs[1])
+		return fresh && old
+	}, time.Second, 10*time.Millisecond)
+
+	router := gin.New()
+	router.GET("/api/tokens", handleTokenPoolAPI)
+	resp := getTokenPool(t, router)
+	require.Len(t, resp.Tokens, 2)
+
+	assert.Equal(t, false, resp.Tokens[0]["stale"])
+	assert.Less(t, resp.Tokens[0]["age"], float64(60))
+
+	assert.Equal(t, true, resp.Tokens[1]["stale"])
+	assert.InDelta(t, 3600, resp.Tokens[1]["age"], 60)
+}
+
+func TestTokenStatusMonitor_BoundedParallelism(t *testing.T) {
+	var inflight, peak int32
+	monitor := NewTokenStatusMonitor(func(cfg auth.AuthConfig) tokenStatusEntry {
+		current := atomic.AddInt32(&inflight, 1)
+		for {
+			previous := atomic.LoadInt32(&peak)
+			if current <= previous || atomic.CompareAndSwapInt32(&peak, previous, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+		return tokenStatusEntry{CheckedAt: time.Now()}
+	})
+	monitor.SetWorkers(3)
+
+	configs := make([]auth.AuthConfig, 10)
+	for i := range configs {
+		configs[i] = auth.AuthConfig{AuthType: auth.AuthMethodSocial, RefreshToken: fmt.Sprintf("refresh-token-%02d", i)}
+	}
+	checkAllTokens(t, monitor, configs)
+	require.Eventually(t, func() bool {
+		for _, cfg := range configs {
+			if _, checked := monitor.Get(cfg); !checked {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+
+	assert.LessOrEqual(t, atomic.LoadInt32(&peak), int32(3))
+	assert.Greater(t, atomic.LoadInt32(&peak), int32(1), "应并行检查")
+}
+
+// tokenPoolWithWorkers 以指定协程数检查所有配置后返回 /api/tokens 的token列表
+// 检查耗时与索引成反比，使并行时的完成顺序与配置顺序相反
+// checkedAt 由调用方传入，两次对比使用同一时刻，避免跨秒导致输出不同
+func tokenPoolWithWorkers(t *testing.T, workers int, checkedAt time.Time) []map[string]any {
+	configs, err := auth.GetConfigs()
+	require.NoError(t, err)
+	monitor := NewTokenStatusMonitor(func(cfg auth.AuthConfig) tokenStatusEntry {
+		index := 0
+		for i := range configs {
+			if configs[i].RefreshToken == cfg.RefreshToken {
+				index = i
+			}
+		}
+		time.Sleep(time.Duration(len(configs)-index) * 5 * time.Millisecond)
+		return tokenStatusEntry{
+			TokenInfo: types.TokenInfo{AccessToken: fmt.Sprintf("access-token-%02d-1234567890", index), ExpiresAt: checkedAt.Add(time.Hour)},
+			Usage:     &auth.UsageCheckResult{Status: types.AccountStatusActive, Available: float64(index * 10)},
+			CheckedAt: checkedAt,
+		}
+	})
+	monitor.SetWorkers(workers)
+	original := tokenStatusMonitor
+	tokenStatusMonitor = monitor
+	t.Cleanup(func() { tokenStatusMonitor = original })
+
+	checkAllTokens(t, monitor, configs)
+	require.Eventually(t, func() bool {
+		for _, cfg := range configs {
+			if _, checked := monitor.Get(cfg); !checked {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 5*time.Millisecond)
+
+	router := gin.New()
+	router.GET("/api/tokens", handleTokenPoolAPI)
+	tokens := getTokenPool(t, router).Tokens
+	for _, token := range tokens {
+		delete(token, "age") // 与读取时刻有关
+	}
+	return tokens
+}
+
+func TestHandleTokenPoolAPI_ConcurrentMatchesSerial(t *testing.T) {
+	t.Setenv("AUTH_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	var accounts []string
+	for i := 0; i < 8; i++ {
+		accounts = append(accounts, fmt.Sprintf(`{"auth":"Social","refreshToken":"refresh-token-%02d"}`, i))
+	}
+	t.Setenv("KIRO_AUTH_TOKEN", "["+strings.Join(accounts, ",")+"]")
+
+	checkedAt := time.Now().Truncate(time.Second)
+	serial := tokenPoolWithWorkers(t, 1, checkedAt)
+	concurrent := tokenPoolWithWorkers(t, 4, checkedAt)
+
+	require.Len(t, concurrent, 8)
+	for i, token := range concurrent {
+		assert.Equal(t, float64(i), token["index"], "输出应按配置索引排序")
+	}
+	assert.Equal(t, serial, concurrent)
+}
+
+func TestHandleTokenPoolAPI_ScheduledOff(t *testing.T) {
+	t.Setenv("AUTH_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("KIRO_AUTH_TOKEN", `[
+		{"auth":"Social","refreshToken":"refresh-token-00","schedule":[{"startHour":22,"endHour":6,"tz":"Asia/Shanghai"}]},
+		{"auth":"Social","refreshToken":"refresh-token-01"}]`)
+
+	// 上海 2026-10-19 23:30，处于跨午夜的停用时段
+	now := time.Date(2026, 10, 19, 15, 30, 0, 0, time.UTC)
+	original := tokenPoolNow
+	tokenPoolNow = func() time.Time { return now }
+	t.Cleanup(func() { tokenPoolNow = original })
+
+	tokens := tokenPoolWithWorkers(t, 1, now)
+	require.Len(t, tokens, 2)
+	assert.Equal(t, types.AccountStatusScheduledOff, tokens[0]["status"])
+	assert.Equal(t, "计划停用", tokens[0]["status_text"])
+	assert.Equal(t, "2026-10-20T06:00:00+08:00", tokens[0]["available_at"], "按时段所在时区显示")
+	assert.Equal(t, types.AccountStatusActive, tokens[1]["status"])
+	assert.NotContains(t, tokens[1], "available_at")
+}
+
+func TestNewTokenStatusWorkersFromEnv(t *testing.T) {
+	t.Setenv("TOKEN_STATUS_WORKERS", "")
+	assert.Equal(t, 4, NewTokenStatusWorkersFromEnv())
+
+	t.Setenv("TOKEN_STATUS_WORKERS", "8")
+	assert.Equal(t, 8, NewTokenStatusWorkersFromEnv())
+
+	t.Setenv("TOKEN_STATUS_WORKERS", "0")
+	assert.Equal(t, 1, NewTokenStatusWorkersFromEnv())
+
+	t.Setenv("TOKEN_STATUS_WORKERS", "100")
+	assert.Equal(t, 16, NewTokenStatusWorkersFromEnv())
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"kiro2api/converter"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const originalToolName = "github.create_issue"
+
+// newSanitizedToolUpstream 创建以改写后的工具名称返回工具调用的假上游，返回收到的请求体
+func newSanitizedToolUpstream(t *testing.T) func() string {
+	var mu sync.Mutex
+	var lastBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		lastBody = string(body)
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"name":"github_create_issue","toolUseId":"tooluse_issue","input":"{\"title\":\"bug\"}"}`))
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"name":"github_create_issue","toolUseId":"tooluse_issue","stop":true}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return lastBody
+	}
+}
+
+// newSanitizedToolRequest 按路由的顺序改写工具名称
+func newSanitizedToolRequest(stream bool) types.AnthropicRequest {
+	req := newStopTestRequest(stream)
+	req.Tools = []types.AnthropicTool{{
+		Name:        originalToolName,
+		Description: "Create a GitHub issue",
+		InputSchema: map[string]any{"type": "object", "properties": map[string]any{"title": map[string]any{"type": "string"}}},
+	}}
+	return converter.SanitizeToolNames(req)
+}
+
+func TestSanitizedToolNames_RestoredInResponses(t *testing.T) {
+	lastBody := newSanitizedToolUpstream(t)
+
+	tests := []struct {
+		name    string
+		path    string
+		stream  bool
+		handler func(*gin.Context, types.AnthropicRequest)
+	}{
+		{"Anthropic非流式", "/v1/messages", false, func(c *gin.Context, req types.AnthropicRequest) {
+			handleNonStreamRequest(newTestScope(c, req))
+		}},
+		{"Anthropic流式", "/v1/messages", true, func(c *gin.Context, req types.AnthropicRequest) {
+			handleStreamRequest(newTestScope(c, req))
+		}},
+		{"OpenAI非流式", "/v1/chat/completions", false, func(c *gin.Context, req types.AnthropicRequest) {
+			handleOpenAINonStreamRequest(newTestScope(c, req))
+		}},
+		{"OpenAI流式", "/v1/chat/completions", true, func(c *gin.Context, req types.AnthropicRequest) {
+			handleOpenAIStreamRequest(newTestScope(c, req))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", tt.path, nil)
+
+			tt.handler(c, newSanitizedToolRequest(tt.stream))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			assert.Contains(t, lastBody(), `"github_create_issue"`, "上游收到改写后的名称")
+			assert.NotContains(t, lastBody(), originalToolName)
+			assert.Contains(t, w.Body.String(), `"`+originalToolName+`"`, "客户端收到原始名称")
+			assert.NotContains(t, w.Body.String(), "github_create_issue")
+		})
+	}
+}
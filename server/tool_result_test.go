@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 工具执行失败的tool_result：历史和当前消息中的is_error都转发到上游
+const errorToolResultRequest = `{
+	"model": "claude-sonnet-4-20250514",
+	"max_tokens": 100,
+	"tools": [{"name": "get_weather", "description": "Get weather", "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}}}],
+	"messages": [
+		{"role": "user", "content": "What's the weather in Atlantis and Paris?"},
+		{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_history", "name": "get_weather", "input": {"city": "Atlantis"}}]},
+		{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_history", "is_error": true, "content": "city not found"}]},
+		{"role": "assistant", "content": [
+			{"type": "tool_use", "id": "toolu_failed", "name": "get_weather", "input": {"city": "Atlantis"}},
+			{"type": "tool_use", "id": "toolu_ok", "name": "get_weather", "input": {"city": "Paris"}}
+		]},
+		{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_failed", "is_error": true, "content": [{"type": "text", "text": "timeout"}]}]},
+		{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_ok", "is_error": false, "content": "25°C"}]}
+	]
+}`
+
+// upstreamToolResults 按toolUseId收集上游请求体中的toolResults
+func upstreamToolResults(t *testing.T, body string) map[string]map[string]any {
+	t.Helper()
+	var payload any
+	require.NoError(t, json.Unmarshal([]byte(body), &payload))
+
+	results := make(map[string]map[string]any)
+	var walk func(v any)
+	walk = func(v any) {
+		switch value := v.(type) {
+		case map[string]any:
+			if items, ok := value["toolResults"].([]any); ok {
+				for _, item := range items {
+					result := item.(map[string]any)
+					results[result["toolUseId"].(string)] = result
+				}
+			}
+			for _, child := range value {
+				walk(child)
+			}
+		case []any:
+			for _, child := range value {
+				walk(child)
+			}
+		}
+	}
+	walk(payload)
+	return results
+}
+
+func TestToolResultIsError_ForwardedUpstream(t *testing.T) {
+	var mu sync.Mutex
+	var upstreamBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		upstreamBody = string(body)
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"Atlantis could not be found; Paris is 25°C."}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+
+	// 与/v1/messages相同的标准化流程：tools标准化、解析、整理角色顺序（合并连续的user消息）
+	body, err := normalizeAnthropicRequestBody([]byte(errorToolResultRequest))
+	require.NoError(t, err)
+	var req types.AnthropicRequest
+	require.NoError(t, utils.SafeUnmarshal(body, &req))
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	req, ok := normalizeConversation(c, req)
+	require.True(t, ok)
+
+	handleNonStreamRequest(newTestScope(c, req))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	mu.Lock()
+	defer mu.Unlock()
+	results := upstreamToolResults(t, upstreamBody)
+	require.Len(t, results, 3, upstreamBody)
+
+	for _, id := range []string{"toolu_history", "toolu_failed"} {
+		assert.Equal(t, "error", results[id]["status"], id)
+		assert.Equal(t, true, results[id]["isError"], id)
+	}
+	assert.Equal(t, []any{map[string]any{"type": "text", "text": "timeout"}}, results["toolu_failed"]["content"], "错误内容原样转发")
+
+	assert.Equal(t, "success", results["toolu_ok"]["status"])
+	assert.NotContains(t, results["toolu_ok"], "isError")
+}
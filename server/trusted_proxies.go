@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/netip"
+	"os"
+
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NewTrustedProxiesFromEnv TRUSTED_PROXIES: 逗号分隔的可信反向代理CIDR或IP，未设置时不信任任何代理
+func NewTrustedProxiesFromEnv() []netip.Prefix {
+	return parsePrefixList("TRUSTED_PROXIES", os.Getenv("TRUSTED_PROXIES"))
+}
+
+// configureTrustedProxies 设置gin的可信代理，使c.ClientIP()只在直连地址为可信代理时采信X-Forwarded-For
+// gin默认信任所有代理，任何客户端都能伪造X-Forwarded-For；未配置时改为不信任任何代理，c.ClientIP()返回直连地址
+func configureTrustedProxies(r *gin.Engine, proxies []netip.Prefix) {
+	trusted := make([]string, 0, len(proxies))
+	for _, prefix := range proxies {
+		trusted = append(trusted, prefix.String())
+	}
+	if len(trusted) == 0 {
+		trusted = nil
+	}
+	if err := r.SetTrustedProxies(trusted); err != nil {
+		// 条目已由parsePrefixList校验，理论上不会失败；失败时退回不信任任何代理
+		logger.Warn("设置可信代理失败，不信任任何代理", logger.Err(err))
+		_ = r.SetTrustedProxies(nil)
+		return
+	}
+	if len(trusted) > 0 {
+		logger.Info("已设置可信代理", logger.Any("trusted_proxies", trusted))
+	}
+}
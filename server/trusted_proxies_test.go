@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func clientIPFor(t *testing.T, trustedProxies, remoteAddr, forwardedFor string) string {
+	t.Helper()
+	t.Setenv("TRUSTED_PROXIES", trustedProxies)
+
+	r := gin.New()
+	configureTrustedProxies(r, NewTrustedProxiesFromEnv())
+	r.GET("/ip", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+
+	req := httptest.NewRequest(http.MethodGet, "/ip", nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Body.String()
+}
+
+func TestClientIP_WithoutTrustedProxies(t *testing.T) {
+	// 默认不信任任何代理：伪造的X-Forwarded-For被忽略
+	assert.Equal(t, "203.0.113.9", clientIPFor(t, "", "203.0.113.9:5000", "10.1.2.3"))
+	assert.Equal(t, "172.16.0.2", clientIPFor(t, "", "172.16.0.2:5000", "198.51.100.7"))
+}
+
+func TestClientIP_WithTrustedProxies(t *testing.T) {
+	assert.Equal(t, "198.51.100.7", clientIPFor(t, "172.16.0.0/12", "172.16.0.2:5000", "198.51.100.7"))
+
+	// 多级代理：从右向左跳过可信代理，客户端在最左侧伪造的地址不被采信
+	assert.Equal(t, "198.51.100.7", clientIPFor(t, "172.16.0.0/12", "172.16.0.2:5000", "198.51.100.7, 172.16.0.9"))
+	assert.Equal(t, "203.0.113.9", clientIPFor(t, "172.16.0.0/12", "172.16.0.2:5000", "198.51.100.7, 203.0.113.9"))
+
+	// 直连地址不是可信代理时忽略X-Forwarded-For
+	assert.Equal(t, "203.0.113.9", clientIPFor(t, "172.16.0.0/12", "203.0.113.9:5000", "10.1.2.3"))
+
+	// 单个IP同样可以作为可信代理
+	assert.Equal(t, "198.51.100.7", clientIPFor(t, "192.168.1.5", "192.168.1.5:5000", "198.51.100.7"))
+}
+
+func TestClientIP_InvalidTrustedProxiesIgnored(t *testing.T) {
+	assert.Equal(t, "203.0.113.9", clientIPFor(t, "not-an-ip", "203.0.113.9:5000", "10.1.2.3"))
+	assert.Equal(t, "198.51.100.7", clientIPFor(t, "garbage, 172.16.0.0/12", "172.16.0.2:5000", "198.51.100.7"))
+}
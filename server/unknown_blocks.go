@@ -0,0 +1,71 @@
+package server
+
+import (
+	"os"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/parser"
+
+	"github.com/gin-gonic/gin"
+)
+
+// passthroughUnknownBlocks 是否把上游无法识别的内容块原样透传给Anthropic流式客户端（默认跳过）
+var passthroughUnknownBlocks bool
+
+// NewPassthroughUnknownBlocksFromEnv 读取PASSTHROUGH_UNKNOWN_BLOCKS环境变量
+func NewPassthroughUnknownBlocksFromEnv() bool {
+	return strings.EqualFold(strings.TrimSpace(os.Getenv("PASSTHROUGH_UNKNOWN_BLOCKS")), "true")
+}
+
+// recordUnknownBlock 统计一次未知内容块（其中上游报告的token数记入请求范围），并返回其类型
+func recordUnknownBlock(c *gin.Context, dataMap map[string]any) string {
+	blockType, _ := dataMap["block_type"].(string)
+	streamStats.RecordUnknownBlock(blockType)
+	recordReportedUsage(c, dataMap["raw"])
+
+	logger.Debug("上游返回未知内容块",
+		addReqFields(c,
+			logger.String("block_type", blockType),
+			logger.Bool("passthrough", passthroughUnknownBlocks))...)
+	return blockType
+}
+
+// recordUpstreamMetadata 上游元数据事件（计量、上下文用量等）只读取其中报告的token数，不计数也不下发
+func recordUpstreamMetadata(c *gin.Context, dataMap map[string]any) {
+	recordReportedUsage(c, dataMap["raw"])
+}
+
+// recordUnknownBlocks 统计非流式解析结果中的未知内容块，并读取元数据事件中报告的token数
+func recordUnknownBlocks(c *gin.Context, events []parser.SSEEvent) {
+	for _, event := range events {
+		dataMap, ok := event.Data.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch event.Event {
+		case parser.EventTypes.UNKNOWN_BLOCK:
+			recordUnknownBlock(c, dataMap)
+		case parser.EventTypes.UPSTREAM_METADATA:
+			recordUpstreamMetadata(c, dataMap)
+		}
+	}
+}
+
+// unknownBlockPassthroughEvent 构造透传给客户端的事件
+// 原始载荷为JSON对象时原样下发（缺少type时补上块类型），否则包装在data字段中
+func unknownBlockPassthroughEvent(blockType string, raw any) map[string]any {
+	event := make(map[string]any)
+	if rawMap, ok := raw.(map[string]any); ok {
+		for k, v := range rawMap {
+			event[k] = v
+		}
+	} else {
+		event["data"] = raw
+	}
+
+	if t, _ := event["type"].(string); t == "" {
+		event["type"] = blockType
+	}
+	return event
+}
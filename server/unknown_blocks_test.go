@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUnknownBlocksUpstream 创建在正常文本中混入未知内容块、非JSON事件和元数据事件的假上游
+func newUnknownBlocksUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"content":"Hello"}`))
+		_, _ = w.Write(encodeTestEventStreamFrameWithHeaders([][2]string{
+			{":message-type", "event"},
+			{":event-type", "citationEvent"},
+		}, `{"citations":[{"url":"https://example.com","title":"Example"}]}`))
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"type":"web_search_tool_result","name":"web_search","input":{"query":"go"}}`))
+		_, _ = w.Write(encodeTestEventStreamFrameWithHeaders([][2]string{
+			{":message-type", "event"},
+			{":event-type", "annotationEvent"},
+		}, `not json`))
+		_, _ = w.Write(encodeTestEventStreamFrameWithHeaders([][2]string{
+			{":message-type", "event"},
+			{":event-type", "meteringEvent"},
+		}, `{"unit":"credit","usage":0.02}`))
+		_, _ = w.Write(encodeTestEventStreamFrameWithHeaders([][2]string{
+			{":message-type", "event"},
+			{":event-type", "contextUsageEvent"},
+		}, `{"contextUsagePercentage":12.5}`))
+		_, _ = w.Write(encodeTestEventStreamFrame(`{"content":" world"}`))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+}
+
+// withUnknownBlockPassthrough 在测试期间设置透传开关并使用独立的统计
+func withUnknownBlockPassthrough(t *testing.T, enabled bool) {
+	originalPassthrough, originalStats := passthroughUnknownBlocks, streamStats
+	passthroughUnknownBlocks = enabled
+	streamStats = &StreamStats{}
+	t.Cleanup(func() {
+		passthroughUnknownBlocks, streamStats = originalPassthrough, originalStats
+	})
+}
+
+func TestUnknownBlocks_AnthropicStream(t *testing.T) {
+	t.Run("默认跳过", func(t *testing.T) {
+		newUnknownBlocksUpstream(t)
+		withUnknownBlockPassthrough(t, false)
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+		handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+		body := w.Body.String()
+		assert.Equal(t, "Hello world", collectAnthropicStreamText(t, body))
+		assert.NotContains(t, body, "citations")
+		assert.NotContains(t, body, "unknown_block")
+		assert.NotContains(t, body, `"tool_use"`, "未知块不能被当作工具调用")
+		assert.Contains(t, body, `"stop_reason":"end_turn"`)
+		assert.Equal(t, 1, strings.Count(body, "event: message_stop"))
+
+		// 非JSON事件和元数据事件不计为未知内容块
+		assert.Equal(t, int64(2), streamStats.UnknownBlocks.Load())
+		assert.Equal(t, map[string]int64{
+			"citationEvent":          1,
+			"web_search_tool_result": 1,
+		}, streamStats.UnknownBlockTypes())
+	})
+
+	t.Run("透传", func(t *testing.T) {
+		newUnknownBlocksUpstream(t)
+		withUnknownBlockPassthrough(t, true)
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+		handleStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+		body := w.Body.String()
+		assert.Equal(t, "Hello world", collectAnthropicStreamText(t, body))
+		assert.Contains(t, body, "event: citationEvent\n")
+		assert.Contains(t, body, `"url":"https://example.com"`)
+		assert.Contains(t, body, "event: web_search_tool_result\n")
+		assert.NotContains(t, body, "annotationEvent")
+		assert.NotContains(t, body, "meteringEvent")
+		assert.NotContains(t, body, "contextUsage")
+		assert.NotContains(t, body, "upstream_metadata")
+		assert.NotContains(t, body, "unknown_block")
+		assert.Equal(t, 1, strings.Count(body, "event: message_stop"))
+		assert.Equal(t, int64(2), streamStats.UnknownBlocks.Load())
+	})
+}
+
+func TestUnknownBlocks_AnthropicNonStream(t *testing.T) {
+	newUnknownBlocksUpstream(t)
+	withUnknownBlockPassthrough(t, true)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	handleNonStreamRequest(newTestScope(c, newStopTestRequest(false)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		StopReason string `json:"stop_reason"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Content, 1)
+	assert.Equal(t, "text", resp.Content[0].Type)
+	assert.Equal(t, "Hello world", resp.Content[0].Text)
+	assert.Equal(t, "end_turn", resp.StopReason)
+	assert.Equal(t, int64(2), streamStats.UnknownBlocks.Load())
+}
+
+func TestUnknownBlocks_OpenAI(t *testing.T) {
+	t.Run("stream", func(t *testing.T) {
+		newUnknownBlocksUpstream(t)
+		withUnknownBlockPassthrough(t, true)
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+		handleOpenAIStreamRequest(newTestScope(c, newStopTestRequest(true)))
+
+		body := w.Body.String()
+		assert.Equal(t, "Hello world", collectOpenAIStreamText(t, body))
+		assert.NotContains(t, body, "citations")
+		assert.NotContains(t, body, "tool_calls")
+		assert.Contains(t, body, `"finish_reason":"stop"`)
+		assert.Equal(t, int64(2), streamStats.UnknownBlocks.Load())
+	})
+
+	t.Run("non-stream", func(t *testing.T) {
+		newUnknownBlocksUpstream(t)
+		withUnknownBlockPassthrough(t, false)
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+		handleOpenAINonStreamRequest(newTestScope(c, newStopTestRequest(false)))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp types.OpenAIResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Choices, 1)
+		assert.Equal(t, "Hello world", resp.Choices[0].Message.Content)
+		assert.Equal(t, "stop", resp.Choices[0].FinishReason)
+		assert.Empty(t, resp.Choices[0].Message.ToolCalls)
+	})
+}
+
+func TestUnknownBlockPassthroughEvent(t *testing.T) {
+	event := unknownBlockPassthroughEvent("citationEvent", map[string]any{"citations": []any{}})
+	assert.Equal(t, "citationEvent", event["type"])
+	assert.Contains(t, event, "citations")
+
+	event = unknownBlockPassthroughEvent("unknown", map[string]any{"type": "search_result"})
+	assert.Equal(t, "search_result", event["type"])
+
+	event = unknownBlockPassthroughEvent("annotationEvent", "raw text")
+	assert.Equal(t, map[string]any{"type": "annotationEvent", "data": "raw text"}, event)
+}
+
+func TestNewPassthroughUnknownBlocksFromEnv(t *testing.T) {
+	t.Setenv("PASSTHROUGH_UNKNOWN_BLOCKS", "")
+	assert.False(t, NewPassthroughUnknownBlocksFromEnv())
+
+	t.Setenv("PASSTHROUGH_UNKNOWN_BLOCKS", "TRUE")
+	assert.True(t, NewPassthroughUnknownBlocksFromEnv())
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上游拒绝请求时最可能出问题的请求部分
+const (
+	requestPartTools    = "tools"
+	requestPartMessages = "messages"
+	requestPartSystem   = "system"
+)
+
+// maxUpstreamReasonLength 返回给客户端的上游原因的最大长度（字符）
+const maxUpstreamReasonLength = 200
+
+// upstreamRequestErrorPhrase 已知的上游请求错误短语
+// part为空时按关键字推断出问题的请求部分
+type upstreamRequestErrorPhrase struct {
+	phrase string // 小写，按子串匹配上游的message/reason
+	part   string
+	hint   string
+}
+
+// upstreamRequestErrorPhrases 已知的上游请求错误短语，按顺序匹配，越具体的越靠前
+var upstreamRequestErrorPhrases = []upstreamRequestErrorPhrase{
+	{phrase: "input is too long", part: requestPartMessages, hint: "the conversation exceeds the upstream input limit, shorten the history"},
+	{phrase: "toolspecification", part: requestPartTools, hint: "a tool definition is invalid, check tool names and input_schema"},
+	{phrase: "inputschema", part: requestPartTools, hint: "a tool input_schema is not a valid JSON schema"},
+	{phrase: "tool name", part: requestPartTools, hint: "tool names must be unique and use letters, digits, '_' or '-'"},
+	{phrase: "tooluseid", part: requestPartMessages, hint: "every tool_result must reference a tool_use in the previous assistant message"},
+	{phrase: "invalid character", part: requestPartMessages, hint: "the request contains characters the upstream does not accept"},
+	{phrase: "invalid utf-8", part: requestPartMessages, hint: "the request contains invalid UTF-8"},
+	{phrase: "system prompt", part: requestPartSystem, hint: "the system prompt was rejected"},
+	{phrase: "improperly formed request", hint: "the request structure was rejected (commonly an invalid tool schema, empty message content or unsupported characters)"},
+}
+
+// requestPartKeywords 推断出问题的请求部分的关键字（小写），按顺序匹配
+var requestPartKeywords = []struct {
+	part     string
+	keywords []string
+}{
+	{part: requestPartTools, keywords: []string{"tool", "schema", "function"}},
+	{part: requestPartSystem, keywords: []string{"system"}},
+	{part: requestPartMessages, keywords: []string{"message", "content", "history", "conversation"}},
+}
+
+// upstreamReasonRedactions 返回给客户端前从上游原因中去除的账号相关信息
+var upstreamReasonRedactions = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`arn:aws[\w-]*:[^\s"',;]+`), "<arn>"},
+	{regexp.MustCompile(`(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`), "<id>"},
+}
+
+// UpstreamRequestErrorStrategy 上游拒绝我们构造的请求（400类错误）的映射策略
+// 映射为Anthropic的invalid_request_error（400），消息中包含清理后的上游原因和最可能出问题的请求部分，
+// 帮助用户判断是自己的输入（如工具schema、特殊字符）导致的错误
+type UpstreamRequestErrorStrategy struct{}
+
+func (s *UpstreamRequestErrorStrategy) MapError(statusCode int, responseBody []byte) (*ClaudeErrorResponse, bool) {
+	if !isUpstreamRequestErrorStatus(statusCode) {
+		return nil, false
+	}
+	return &ClaudeErrorResponse{
+		Type:    "invalid_request_error",
+		Message: describeUpstreamRequestError(responseBody),
+	}, true
+}
+
+func (s *UpstreamRequestErrorStrategy) GetErrorType() string {
+	return "upstream_request_error"
+}
+
+// isUpstreamRequestErrorStatus 上游表示请求本身有问题的状态码
+// 401/403（认证）、429（限流/额度）有各自的处理，不在此列
+func isUpstreamRequestErrorStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// describeUpstreamRequestError 生成返回给客户端的错误消息
+func describeUpstreamRequestError(responseBody []byte) string {
+	reason := extractUpstreamReason(responseBody)
+	lower := strings.ToLower(reason)
+
+	var part, hint string
+	for _, known := range upstreamRequestErrorPhrases {
+		if strings.Contains(lower, known.phrase) {
+			part, hint = known.part, known.hint
+			break
+		}
+	}
+	if part == "" {
+		part = inferRequestPart(lower)
+	}
+
+	message := "Upstream rejected the request"
+	if reason != "" {
+		message += ": " + reason
+	}
+	if hint != "" {
+		message += "; " + hint
+	}
+	if part != "" {
+		message += fmt.Sprintf(" (most likely caused by: %s)", part)
+	}
+	return message
+}
+
+// extractUpstreamReason 提取上游错误的主要原因并清理：优先message，其次reason，非JSON时使用原始文本
+func extractUpstreamReason(responseBody []byte) string {
+	reason := string(responseBody)
+	var errorBody CodeWhispererErrorBody
+	if err := json.Unmarshal(responseBody, &errorBody); err == nil {
+		switch {
+		case errorBody.Message != "":
+			reason = errorBody.Message
+		case errorBody.Reason != "":
+			reason = errorBody.Reason
+		default:
+			reason = ""
+		}
+	}
+	return sanitizeUpstreamReason(reason)
+}
+
+// sanitizeUpstreamReason 去除控制字符和账号相关信息，合并空白并截断
+func sanitizeUpstreamReason(reason string) string {
+	reason = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return ' '
+		}
+		return r
+	}, reason)
+	for _, redaction := range upstreamReasonRedactions {
+		reason = redaction.pattern.ReplaceAllString(reason, redaction.replacement)
+	}
+	reason = strings.Join(strings.Fields(reason), " ")
+	if runes := []rune(reason); len(runes) > maxUpstreamReasonLength {
+		reason = string(runes[:maxUpstreamReasonLength]) + "..."
+	}
+	return reason
+}
+
+// inferRequestPart 按关键字推断出问题的请求部分，无法推断时返回空
+func inferRequestPart(lowerReason string) string {
+	for _, candidate := range requestPartKeywords {
+		for _, keyword := range candidate.keywords {
+			if strings.Contains(lowerReason, keyword) {
+				return candidate.part
+			}
+		}
+	}
+	return ""
+}
+
+// respondUpstreamRequestRejected 按请求方言返回400 invalid_request_error
+// 流式响应头已发出时只能以SSE错误事件的形式下发
+func respondUpstreamRequestRejected(c *gin.Context, message string) {
+	if isOpenAIRequest(c) {
+		errorResp := map[string]any{
+			"error": map[string]any{
+				"message": message,
+				"type":    "invalid_request_error",
+				"code":    "upstream_rejected_request",
+			},
+		}
+		if c.Writer.Written() {
+			_ = (&OpenAIStreamSender{}).SendEvent(c, errorResp)
+			return
+		}
+		c.JSON(http.StatusBadRequest, errorResp)
+		return
+	}
+
+	errorResp := map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    "invalid_request_error",
+			"message": message,
+		},
+	}
+	if c.Writer.Written() {
+		_ = (&AnthropicStreamSender{}).SendEvent(c, errorResp)
+		return
+	}
+	c.JSON(http.StatusBadRequest, errorResp)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamRequestErrorStrategy_KnownPhrases(t *testing.T) {
+	strategy := &UpstreamRequestErrorStrategy{}
+
+	tests := []struct {
+		name         string
+		responseBody string
+		wantReason   string
+		wantHint     string
+		wantPart     string
+	}{
+		{
+			name:         "improperly formed request（无关键字）",
+			responseBody: `{"message":"Improperly formed request.","reason":null}`,
+			wantReason:   "Improperly formed request.",
+			wantHint:     "request structure was rejected",
+		},
+		{
+			name:         "improperly formed request（按关键字推断工具）",
+			responseBody: `{"message":"Improperly formed request: tool 'get weather' is invalid"}`,
+			wantHint:     "request structure was rejected",
+			wantPart:     requestPartTools,
+		},
+		{
+			name:         "input is too long",
+			responseBody: `{"message":"Input is too long for requested model."}`,
+			wantHint:     "exceeds the upstream input limit",
+			wantPart:     requestPartMessages,
+		},
+		{
+			name:         "toolSpecification",
+			responseBody: `{"message":"1 validation error detected: Value at 'conversationState.currentMessage.userInputMessage.userInputMessageContext.tools.1.member.toolSpecification.name' failed to satisfy constraint"}`,
+			wantHint:     "tool definition is invalid",
+			wantPart:     requestPartTools,
+		},
+		{
+			name:         "inputSchema",
+			responseBody: `{"message":"Invalid inputSchema: not a valid JSON schema"}`,
+			wantHint:     "input_schema is not a valid JSON schema",
+			wantPart:     requestPartTools,
+		},
+		{
+			name:         "tool name",
+			responseBody: `{"message":"Duplicate tool name found"}`,
+			wantHint:     "tool names must be unique",
+			wantPart:     requestPartTools,
+		},
+		{
+			name:         "toolUseId",
+			responseBody: `{"message":"toolUseId 'tooluse_1' does not match any tool use"}`,
+			wantHint:     "every tool_result must reference a tool_use",
+			wantPart:     requestPartMessages,
+		},
+		{
+			name:         "invalid character",
+			responseBody: `{"message":"Request contains an invalid character"}`,
+			wantHint:     "characters the upstream does not accept",
+			wantPart:     requestPartMessages,
+		},
+		{
+			name:         "invalid utf-8",
+			responseBody: `{"message":"Invalid UTF-8 in request"}`,
+			wantHint:     "invalid UTF-8",
+			wantPart:     requestPartMessages,
+		},
+		{
+			name:         "system prompt",
+			responseBody: `{"message":"System prompt is not allowed to be empty"}`,
+			wantHint:     "system prompt was rejected",
+			wantPart:     requestPartSystem,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, handled := strategy.MapError(http.StatusBadRequest, []byte(tt.responseBody))
+			require.True(t, handled)
+			assert.Equal(t, "invalid_request_error", response.Type)
+			assert.True(t, strings.HasPrefix(response.Message, "Upstream rejected the request: "), response.Message)
+			assert.Contains(t, response.Message, tt.wantReason)
+			assert.Contains(t, response.Message, tt.wantHint)
+			if tt.wantPart != "" {
+				assert.Contains(t, response.Message, "(most likely caused by: "+tt.wantPart+")")
+			} else {
+				assert.NotContains(t, response.Message, "most likely caused by")
+			}
+		})
+	}
+}
+
+func TestUpstreamRequestErrorStrategy_UnknownPhraseFallback(t *testing.T) {
+	strategy := &UpstreamRequestErrorStrategy{}
+
+	// 未知短语：保留清理后的原因，按关键字推断请求部分
+	response, handled := strategy.MapError(http.StatusBadRequest, []byte(`{"message":"Something odd in message content"}`))
+	require.True(t, handled)
+	assert.Equal(t, "Upstream rejected the request: Something odd in message content (most likely caused by: messages)", response.Message)
+
+	// 无法推断时不附带请求部分；非JSON响应使用原始文本
+	response, handled = strategy.MapError(http.StatusUnprocessableEntity, []byte("Bad\x00 request\n\n  body"))
+	require.True(t, handled)
+	assert.Equal(t, "Upstream rejected the request: Bad request body", response.Message)
+
+	// 没有可用的原因
+	response, handled = strategy.MapError(http.StatusRequestEntityTooLarge, []byte(`{}`))
+	require.True(t, handled)
+	assert.Equal(t, "Upstream rejected the request", response.Message)
+
+	// 认证、限流和服务端错误不属于请求错误
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests, http.StatusInternalServerError} {
+		_, handled := strategy.MapError(status, []byte(`{"message":"Improperly formed request."}`))
+		assert.False(t, handled, status)
+	}
+}
+
+func TestSanitizeUpstreamReason(t *testing.T) {
+	reason := sanitizeUpstreamReason("Profile arn:aws:codewhisperer:us-east-1:123456789012:profile/ABC rejected request 0f8fad5b-d9cb-469f-a165-70867728950e\t")
+	assert.Equal(t, "Profile <arn> rejected request <id>", reason)
+
+	long := sanitizeUpstreamReason(strings.Repeat("长", maxUpstreamReasonLength+10))
+	assert.Equal(t, maxUpstreamReasonLength+3, len([]rune(long)))
+	assert.True(t, strings.HasSuffix(long, "..."))
+}
+
+// newRejectingUpstream 创建拒绝请求的假上游
+func newRejectingUpstream(t *testing.T, body string) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("CODEWHISPERER_BASE_URL", upstream.URL)
+}
+
+func TestUpstreamRequestRejected_Anthropic(t *testing.T) {
+	newRejectingUpstream(t, `{"message":"Improperly formed request.","reason":null}`)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	handleNonStreamRequest(newTestScope(c, newOverloadedTestRequest()))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "error", resp["type"])
+	errObj := resp["error"].(map[string]any)
+	assert.Equal(t, "invalid_request_error", errObj["type"])
+	assert.Contains(t, errObj["message"], "Improperly formed request.")
+}
+
+func TestUpstreamRequestRejected_OpenAI(t *testing.T) {
+	newRejectingUpstream(t, `{"message":"Invalid inputSchema for tool get_weather"}`)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	handleOpenAINonStreamRequest(newTestScope(c, newOverloadedTestRequest()))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	errObj := resp["error"].(map[string]any)
+	assert.Equal(t, "invalid_request_error", errObj["type"])
+	assert.Equal(t, "upstream_rejected_request", errObj["code"])
+	assert.Contains(t, errObj["message"], "most likely caused by: tools")
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"kiro2api/auth"
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// redactedValue 替换响应中出现的凭据
+const redactedValue = "[REDACTED]"
+
+// handleRawUsageLimits 返回单个账号未经解析的getUsageLimits响应，用于发现解析器忽略的字段（新的奖励类型、超额字段等）
+// GET /api/config/:index/usage/raw
+// 响应体中的凭据字段和出现的token值会被移除；不经过用量缓存，也不影响账号状态
+func handleRawUsageLimits(c *gin.Context) {
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的索引"})
+		return
+	}
+
+	configs, err := auth.GetConfigs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "加载配置失败: " + err.Error()})
+		return
+	}
+	if index < 0 || index >= len(configs) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "配置不存在"})
+		return
+	}
+	authConfig := configs[index]
+	secrets := []string{authConfig.RefreshToken, authConfig.ClientSecret}
+
+	tokenInfo, err := refreshSingleTokenByConfig(authConfig)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "刷新Token失败: " + redactSecrets(err.Error(), secrets)})
+		return
+	}
+	secrets = append(secrets, tokenInfo.AccessToken, tokenInfo.RefreshToken)
+
+	raw, err := auth.NewUsageLimitsChecker().FetchRawUsageLimits(tokenInfo)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "获取用量失败: " + redactSecrets(err.Error(), secrets)})
+		return
+	}
+
+	logger.Info("查询原始用量响应",
+		logger.Int("index", index),
+		logger.Int("status_code", raw.StatusCode),
+		logger.String("endpoint", raw.Endpoint))
+	c.JSON(http.StatusOK, gin.H{
+		"index":       index,
+		"endpoint":    raw.Endpoint,
+		"status_code": raw.StatusCode,
+		"body":        rawUsageBody(raw.Body, secrets),
+	})
+}
+
+// rawUsageBody 保留原始JSON结构并移除凭据；响应体不是JSON时按字符串返回
+func rawUsageBody(body []byte, secrets []string) any {
+	var parsed any
+	if err := utils.SafeUnmarshal(body, &parsed); err != nil {
+		return redactSecrets(string(body), secrets)
+	}
+	return stripSecretFields(parsed, secrets)
+}
+
+// stripSecretFields 递归移除凭据类字段，并替换字符串中出现的token值
+func stripSecretFields(value any, secrets []string) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			if isSecretFieldName(key) {
+				delete(v, key)
+				continue
+			}
+			v[key] = stripSecretFields(item, secrets)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = stripSecretFields(item, secrets)
+		}
+	case string:
+		return redactSecrets(v, secrets)
+	}
+	return value
+}
+
+// isSecretFieldName 字段名是否表示凭据（accessToken、clientSecret、password等）
+func isSecretFieldName(key string) bool {
+	name := strings.ToLower(key)
+	return strings.HasSuffix(name, "token") ||
+		strings.HasSuffix(name, "secret") ||
+		strings.Contains(name, "password") ||
+		strings.Contains(name, "authorization") ||
+		strings.Contains(name, "credential")
+}
+
+// redactSecrets 替换文本中出现的凭据
+func redactSecrets(text string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			text = strings.ReplaceAll(text, secret, redactedValue)
+		}
+	}
+	return text
+}
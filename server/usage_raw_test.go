@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rawUsageTestBody 含解析器未使用的字段和凭据字段，并回显了access token
+const rawUsageTestBody = `{
+	"usageBreakdownList": [{
+		"resourceType": "CREDIT", "usageLimitWithPrecision": 50, "currentUsageWithPrecision": 20,
+		"bonuses": [{"bonusType": "REFERRAL", "usageLimit": 10, "currentUsage": 1}]
+	}],
+	"overageConfiguration": {"overageStatus": "ENABLED"},
+	"userInfo": {"email": "raw@example.com", "sessionToken": "should-not-leak"},
+	"debug": "Bearer probe-access-token"
+}`
+
+func newRawUsageRouter(t *testing.T, usageStatus int, usageBody string) *gin.Engine {
+	t.Helper()
+	newProbeUpstream(t, usageStatus, usageBody)
+	t.Setenv("USAGE_FALLBACK_REGIONS", "")
+	t.Setenv("AUTH_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"raw-refresh-token"}]`)
+
+	r := gin.New()
+	r.GET("/api/config/:index/usage/raw", AdminAuthMiddleware("admin-secret"), handleRawUsageLimits)
+	return r
+}
+
+func getRawUsage(r *gin.Engine, index, adminToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/config/"+index+"/usage/raw", nil)
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestHandleRawUsageLimits_ReturnsRawJSONWithoutSecrets(t *testing.T) {
+	r := newRawUsageRouter(t, http.StatusOK, rawUsageTestBody)
+
+	w := getRawUsage(r, "0", "admin-secret")
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		StatusCode int            `json:"status_code"`
+		Endpoint   string         `json:"endpoint"`
+		Body       map[string]any `json:"body"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Endpoint, "/getUsageLimits")
+
+	// 解析器忽略的字段原样返回
+	assert.Equal(t, map[string]any{"overageStatus": "ENABLED"}, resp.Body["overageConfiguration"])
+	breakdown := resp.Body["usageBreakdownList"].([]any)[0].(map[string]any)
+	assert.Equal(t, "REFERRAL", breakdown["bonuses"].([]any)[0].(map[string]any)["bonusType"])
+	assert.Equal(t, "raw@example.com", resp.Body["userInfo"].(map[string]any)["email"])
+
+	// 凭据字段和token值不出现在响应中
+	body := w.Body.String()
+	assert.NotContains(t, body, "sessionToken")
+	assert.NotContains(t, body, "should-not-leak")
+	assert.NotContains(t, body, "probe-access-token")
+	assert.NotContains(t, body, "raw-refresh-token")
+	assert.Equal(t, "Bearer "+redactedValue, resp.Body["debug"])
+}
+
+func TestHandleRawUsageLimits_UpstreamErrorBodyIsReturned(t *testing.T) {
+	r := newRawUsageRouter(t, http.StatusForbidden, `{"reason":"TEMPORARILY_SUSPENDED","detail":"probe-access-token"}`)
+
+	w := getRawUsage(r, "0", "admin-secret")
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status_code":403`)
+	assert.Contains(t, w.Body.String(), "TEMPORARILY_SUSPENDED")
+	assert.NotContains(t, w.Body.String(), "probe-access-token")
+}
+
+func TestHandleRawUsageLimits_RequiresAdminToken(t *testing.T) {
+	r := newRawUsageRouter(t, http.StatusOK, rawUsageTestBody)
+
+	assert.Equal(t, http.StatusUnauthorized, getRawUsage(r, "0", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, getRawUsage(r, "0", "wrong").Code)
+	assert.Equal(t, http.StatusNotFound, getRawUsage(r, "5", "admin-secret").Code)
+	assert.Equal(t, http.StatusBadRequest, getRawUsage(r, "abc", "admin-secret").Code)
+}
+
+func TestNewAdminTokenFromEnv(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "")
+	assert.Equal(t, "client-token", NewAdminTokenFromEnv("client-token"))
+
+	t.Setenv("ADMIN_TOKEN", "admin-token")
+	assert.Equal(t, "admin-token", NewAdminTokenFromEnv("client-token"))
+}
@@ -26,6 +26,7 @@ class ConfigManager {
 
             const data = await response.json();
             this.configs = data.configs || [];
+            this.setReadOnly(!!data.read_only);
             this.renderTable();
         } catch (error) {
             console.error('加载配置失败:', error);
@@ -33,6 +34,13 @@ class ConfigManager {
         }
     }
 
+    setReadOnly(readOnly) {
+        document.getElementById('readOnlyNotice').style.display = readOnly ? 'block' : 'none';
+        document.querySelectorAll('.add-btn, .import-btn').forEach(btn => {
+            btn.disabled = readOnly;
+        });
+    }
+
     renderTable() {
         const tbody = document.getElementById('configTableBody');
 
@@ -82,6 +90,9 @@ class ConfigManager {
         document.getElementById('modalTitle').textContent = '添加Token配置';
         document.getElementById('configIndex').value = '-1';
         document.getElementById('configForm').reset();
+        document.getElementById('refreshToken').placeholder = '输入RefreshToken';
+        document.getElementById('refreshToken').required = true;
+        document.getElementById('clientSecret').placeholder = 'IdC认证的ClientSecret';
         document.getElementById('idcFields').style.display = 'none';
         this.showModal('configModal');
     }
@@ -93,9 +104,15 @@ class ConfigManager {
         document.getElementById('modalTitle').textContent = '编辑Token配置';
         document.getElementById('configIndex').value = index;
         document.getElementById('authType').value = config.auth || 'Social';
-        document.getElementById('refreshToken').value = config.refreshToken || '';
+        document.getElementById('displayName').value = config.displayName || '';
+        document.getElementById('profileArn').value = config.profileArn || '';
+        // 接口返回的凭据已脱敏：留空表示保持原值，填写时替换
+        document.getElementById('refreshToken').value = '';
+        document.getElementById('refreshToken').required = false;
+        document.getElementById('refreshToken').placeholder = `留空保持不变（当前：${this.maskToken(config.refreshToken)}）`;
         document.getElementById('clientId').value = config.clientId || '';
-        document.getElementById('clientSecret').value = config.clientSecret || '';
+        document.getElementById('clientSecret').value = '';
+        document.getElementById('clientSecret').placeholder = config.clientSecret ? '留空保持不变' : 'IdC认证的ClientSecret';
         document.getElementById('disabled').checked = config.disabled || false;
 
         this.toggleIdCFields();
@@ -118,17 +135,27 @@ class ConfigManager {
             disabled: document.getElementById('disabled').checked
         };
 
+        const displayName = document.getElementById('displayName').value.trim();
+        if (displayName) {
+            config.displayName = displayName;
+        }
+
+        const profileArn = document.getElementById('profileArn').value.trim();
+        if (profileArn) {
+            config.profileArn = profileArn;
+        }
+
         if (config.auth === 'IdC') {
             config.clientId = document.getElementById('clientId').value.trim();
             config.clientSecret = document.getElementById('clientSecret').value.trim();
 
-            if (!config.clientId || !config.clientSecret) {
+            if (!config.clientId || (index === -1 && !config.clientSecret)) {
                 alert('IdC认证需要填写ClientID和ClientSecret');
                 return false;
             }
         }
 
-        if (!config.refreshToken) {
+        if (index === -1 && !config.refreshToken) {
             alert('RefreshToken不能为空');
             return false;
         }
@@ -54,6 +54,7 @@ class TokenDashboard {
             this.updateTokenTable(data);
             this.updateStatusBar(data);
             this.updateLastUpdateTime();
+            this.refreshPoolAlerts();
             
         } catch (error) {
             console.error('刷新Token数据失败:', error);
@@ -85,17 +86,61 @@ class TokenDashboard {
         
         return `
             <tr>
-                <td>${token.user_email || 'unknown'}</td>
-                <td><span class="token-preview">${token.token_preview || 'N/A'}</span></td>
-                <td>${token.auth_type || 'social'}</td>
-                <td>${token.remaining_usage || 0}</td>
+                <td>${this.escapeHtml(token.display_name || token.user_email || 'unknown')}</td>
+                <td><span class="token-preview">${this.escapeHtml(token.token_preview || 'N/A')}</span></td>
+                <td>${this.escapeHtml(token.auth_type || 'social')}${token.profile_arn ? `<br><small title="Profile ARN">${this.escapeHtml(token.profile_arn)}</small>` : ''}</td>
+                <td>${this.escapeHtml(token.remaining_usage || 0)}</td>
                 <td>${this.formatDateTime(token.expires_at)}</td>
-                <td>${this.formatDateTime(token.last_used)}</td>
-                <td><span class="status-badge ${statusClass}">${statusText}</span></td>
+                <td>${this.formatDateTime(token.last_used)}${token.stale ? ` <span class="status-badge status-stale" title="数据已 ${this.formatAge(token.age)} 未更新">数据过期</span>` : ''}</td>
+                <td><span class="status-badge ${statusClass}">${this.escapeHtml(statusText)}</span></td>
+                <td>
+                    ${token.status === 'disabled' ? '-' : `<button class="row-refresh-btn" onclick="dashboard.refreshTokenStatus(${Number(token.index)})">刷新</button>`}
+                </td>
             </tr>
         `;
     }
 
+    /**
+     * 请求后台重新检查单个Token，不等待检查结果
+     * 检查会请求上游，需要管理令牌（ADMIN_TOKEN）：首次返回401时提示输入，仅保存在当前会话
+     */
+    async refreshTokenStatus(index) {
+        try {
+            let response = await this.postTokenRefresh(index);
+            if (response.status === 401) {
+                sessionStorage.removeItem('adminToken');
+                const adminToken = prompt('请输入管理令牌（ADMIN_TOKEN）');
+                if (!adminToken) {
+                    return;
+                }
+                sessionStorage.setItem('adminToken', adminToken);
+                response = await this.postTokenRefresh(index);
+                if (response.status === 401) {
+                    sessionStorage.removeItem('adminToken');
+                    throw new Error('管理令牌无效');
+                }
+            }
+            if (!response.ok) {
+                const data = await response.json().catch(() => ({}));
+                throw new Error(data.error || `HTTP ${response.status}`);
+            }
+            // 检查在后台异步进行，稍后刷新列表查看结果
+            setTimeout(() => this.refreshTokens(), 3000);
+        } catch (error) {
+            console.error('刷新Token状态失败:', error);
+            alert(`刷新失败: ${error.message}`);
+        }
+    }
+
+    /**
+     * 携带会话中保存的管理令牌请求单个Token的显式检查
+     */
+    postTokenRefresh(index) {
+        const adminToken = sessionStorage.getItem('adminToken');
+        const headers = adminToken ? { 'Authorization': `Bearer ${adminToken}` } : {};
+        return fetch(`${this.apiBaseUrl}/tokens/${index}/refresh`, { method: 'POST', headers });
+    }
+
     /**
      * 更新状态栏 (SRP原则)
      */
@@ -104,6 +149,31 @@ class TokenDashboard {
         this.updateElement('activeTokens', data.active_tokens || 0);
     }
 
+    /**
+     * 获取Token池额度告警（POOL_MIN_CREDITS / POOL_MIN_RUNWAY_HOURS），失败时不影响表格
+     */
+    async refreshPoolAlerts() {
+        const el = document.getElementById('poolAlerts');
+        if (!el) return;
+        try {
+            const response = await fetch(`${this.apiBaseUrl}/tokens/summary`);
+            if (!response.ok) return;
+            const summary = await response.json();
+            const alerts = summary.alerts || [];
+            el.hidden = alerts.length === 0;
+            el.innerHTML = alerts.map(alert => `<div>⚠️ ${this.escapeHtml(this.formatPoolAlert(alert, summary))}</div>`).join('');
+        } catch (error) {
+            console.error('获取Token池告警失败:', error);
+        }
+    }
+
+    formatPoolAlert(alert, summary) {
+        if (alert.type === 'pool_min_runway') {
+            return `按当前消耗速率（${summary.burn_rate_per_hour}/小时）剩余约 ${alert.value} 小时，低于 ${alert.threshold} 小时`;
+        }
+        return `Token池总可用额度 ${alert.value} 低于 ${alert.threshold}`;
+    }
+
     /**
      * 更新最后更新时间
      */
@@ -147,6 +217,16 @@ class TokenDashboard {
         this.isAutoRefreshEnabled = false;
     }
 
+    /**
+     * 工具方法 - 数据年龄（秒）格式化
+     */
+    formatAge(seconds) {
+        if (seconds === undefined || seconds === null) return '未知';
+        if (seconds < 60) return `${seconds}秒`;
+        if (seconds < 3600) return `${Math.floor(seconds / 60)}分钟`;
+        return `${Math.floor(seconds / 3600)}小时`;
+    }
+
     /**
      * 工具方法 - 状态判断 (KISS原则)
      */
@@ -165,6 +245,12 @@ class TokenDashboard {
                 return 'status-disabled';
             case 'error':
                 return 'status-error';
+            case 'pending':
+                return 'status-pending';
+            case 'refresh_throttled':
+                return 'status-throttled';
+            case 'scheduled_off':
+                return 'status-scheduled';
             default:
                 // 兼容旧逻辑
                 if (new Date(token.expires_at) < new Date()) {
@@ -197,6 +283,12 @@ class TokenDashboard {
                 return '已禁用';
             case 'error':
                 return '错误';
+            case 'pending':
+                return '待检查';
+            case 'refresh_throttled':
+                return '刷新限流';
+            case 'scheduled_off':
+                return '计划停用';
             default:
                 // 兼容旧逻辑
                 if (new Date(token.expires_at) < new Date()) {
@@ -240,10 +332,22 @@ class TokenDashboard {
         if (element) element.textContent = content;
     }
 
+    /**
+     * 转义插入innerHTML的文本：账号名称等字段来自配置和上游响应，不可信
+     */
+    escapeHtml(value) {
+        return String(value)
+            .replace(/&/g, '&amp;')
+            .replace(/</g, '&lt;')
+            .replace(/>/g, '&gt;')
+            .replace(/"/g, '&quot;')
+            .replace(/'/g, '&#39;');
+    }
+
     showLoading(container, message) {
         container.innerHTML = `
             <tr>
-                <td colspan="7" class="loading">
+                <td colspan="8" class="loading">
                     <div class="spinner"></div>
                     ${message}
                 </td>
@@ -254,8 +358,8 @@ class TokenDashboard {
     showError(container, message) {
         container.innerHTML = `
             <tr>
-                <td colspan="7" class="error">
-                    ${message}
+                <td colspan="8" class="error">
+                    ${this.escapeHtml(message)}
                 </td>
             </tr>
         `;
@@ -263,6 +367,7 @@ class TokenDashboard {
 }
 
 // DOM加载完成后初始化 (依赖注入原则)
+let dashboard;
 document.addEventListener('DOMContentLoaded', () => {
-    new TokenDashboard();
+    dashboard = new TokenDashboard();
 });
\ No newline at end of file
@@ -1,5 +1,11 @@
 package types
 
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
 // AnthropicTool 表示 Anthropic API 的工具结构
 type AnthropicTool struct {
 	Name        string         `json:"name"`
@@ -9,21 +15,139 @@ type AnthropicTool struct {
 
 // ToolChoice 表示工具选择策略
 type ToolChoice struct {
-	Type string `json:"type"`           // "auto", "any", "tool"
-	Name string `json:"name,omitempty"` // 当type为"tool"时指定的工具名称
+	Type                   string `json:"type"`                                // "auto", "any", "tool"
+	Name                   string `json:"name,omitempty"`                      // 当type为"tool"时指定的工具名称
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"` // 为true时每条消息最多调用一个工具
 }
 
 // AnthropicRequest 表示 Anthropic API 的请求结构
 type AnthropicRequest struct {
-	Model       string                    `json:"model"`
-	MaxTokens   int                       `json:"max_tokens"`
-	Messages    []AnthropicRequestMessage `json:"messages"`
-	System      []AnthropicSystemMessage  `json:"system,omitempty"`
-	Tools       []AnthropicTool           `json:"tools,omitempty"`
-	ToolChoice  any                       `json:"tool_choice,omitempty"` // 可以是string或ToolChoice对象
-	Stream      bool                      `json:"stream"`
-	Temperature *float64                  `json:"temperature,omitempty"`
-	Metadata    map[string]any            `json:"metadata,omitempty"`
+	Model         string                    `json:"model"`
+	MaxTokens     int                       `json:"max_tokens"`
+	Messages      []AnthropicRequestMessage `json:"messages"`
+	System        []AnthropicSystemMessage  `json:"system,omitempty"`
+	Tools         []AnthropicTool           `json:"tools,omitempty"`
+	ToolChoice    any                       `json:"tool_choice,omitempty"` // 可以是string或ToolChoice对象
+	Stream        bool                      `json:"stream"`
+	Temperature   *float64                  `json:"temperature,omitempty"`
+	TopP          *float64                  `json:"top_p,omitempty"` // 上游不支持，仅在有效参数回显中报告
+	Metadata      map[string]any            `json:"metadata,omitempty"`
+	StopSequences []string                  `json:"stop_sequences,omitempty"` // 上游不支持；只有OpenAI端点由代理在下发前截断，/v1/messages忽略
+
+	// ResponseFormat 由OpenAI请求的response_format.type转换而来（如json_object），不参与序列化
+	ResponseFormat string `json:"-"`
+
+	// ToolNames 改写后的上游工具名称到客户端原始名称的映射（仅包含被改写的名称），不参与序列化
+	ToolNames map[string]string `json:"-"`
+
+	// Extra 结构体未定义的顶层字段（如thinking、context_management），保留原始JSON
+	// 解析时自动收集、序列化时原样写回，新增字段不会在标准化或转发中被悄悄丢弃
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// anthropicRequestFields AnthropicRequest已定义字段的JSON名称
+var anthropicRequestFields = jsonFieldNames(reflect.TypeOf(AnthropicRequest{}))
+
+// UnmarshalJSON 解析已定义字段，并将其余顶层字段按原始JSON收集到Extra
+// 请求体可能有数MB（长对话），只完整解析一次；未定义字段通过扫描顶层字段定位，不再解码整个请求体
+func (r *AnthropicRequest) UnmarshalJSON(data []byte) error {
+	type plain AnthropicRequest
+	var decoded plain
+	if err := unmarshalJSON(data, &decoded); err != nil {
+		return err
+	}
+
+	var extra map[string]json.RawMessage
+	err := ScanTopLevelFields(data, func(name string, start, end int) {
+		if anthropicRequestFields[name] {
+			return
+		}
+		if extra == nil {
+			extra = make(map[string]json.RawMessage)
+		}
+		extra[name] = append(json.RawMessage(nil), data[start:end]...)
+	})
+	if err != nil {
+		return err
+	}
+	decoded.Extra = extra
+
+	*r = AnthropicRequest(decoded)
+	return nil
+}
+
+// MarshalJSON 序列化已定义字段，并写回Extra中的字段（已定义字段优先）
+func (r AnthropicRequest) MarshalJSON() ([]byte, error) {
+	type plain AnthropicRequest
+	data, err := json.Marshal(plain(r))
+	if err != nil || len(r.Extra) == 0 {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range r.Extra {
+		if _, exists := fields[name]; !exists {
+			fields[name] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// jsonFieldNames 返回结构体导出字段的JSON名称（忽略json:"-"）
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// ResponseFormatJSONObject OpenAI JSON模式：输出必须是一个JSON对象
+const ResponseFormatJSONObject = "json_object"
+
+// JSONObjectMode 判断请求是否要求输出JSON对象（OpenAI response_format: json_object）
+func (r AnthropicRequest) JSONObjectMode() bool {
+	return r.ResponseFormat == ResponseFormatJSONObject
+}
+
+// OriginalToolName 将上游返回的工具名称还原为客户端请求中的原始名称
+func (r AnthropicRequest) OriginalToolName(name string) string {
+	if original, exists := r.ToolNames[name]; exists {
+		return original
+	}
+	return name
+}
+
+// DeterministicSampling 判断请求是否要求确定性输出（temperature=0）
+func (r AnthropicRequest) DeterministicSampling() bool {
+	return r.Temperature != nil && *r.Temperature == 0
+}
+
+// ParallelToolUseDisabled 判断tool_choice是否设置了disable_parallel_tool_use
+// tool_choice经过标准化后可能是*ToolChoice、ToolChoice或map[string]any
+func (r AnthropicRequest) ParallelToolUseDisabled() bool {
+	switch tc := r.ToolChoice.(type) {
+	case *ToolChoice:
+		return tc != nil && tc.DisableParallelToolUse
+	case ToolChoice:
+		return tc.DisableParallelToolUse
+	case map[string]any:
+		disabled, _ := tc["disable_parallel_tool_use"].(bool)
+		return disabled
+	}
+	return false
 }
 
 // AnthropicStreamResponse 表示 Anthropic 流式响应的结构
@@ -50,8 +174,9 @@ type AnthropicRequestMessage struct {
 }
 
 type AnthropicSystemMessage struct {
-	Type string `json:"type"`
-	Text string `json:"text"` // 可以是 string 或 []ContentBlock
+	Type         string         `json:"type"`
+	Text         string         `json:"text"`                    // 可以是 string 或 []ContentBlock
+	CacheControl map[string]any `json:"cache_control,omitempty"` // 提示词缓存断点，只用于估算缓存token，不发送给上游
 }
 
 // ContentBlock 表示消息内容块的结构
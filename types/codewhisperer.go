@@ -27,6 +27,7 @@ type CodeWhispererRequest struct {
 		ConversationId string `json:"conversationId"`
 		History        []any  `json:"history"`
 	} `json:"conversationState"`
+	ProfileArn string `json:"profileArn,omitempty"` // 账号所属的CodeWhisperer profile，未配置时不发送
 }
 
 // CodeWhispererImage 表示 CodeWhisperer API 的图片结构
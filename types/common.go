@@ -61,6 +61,7 @@ func NewModelNotFoundError(model, requestId string) *ModelNotFoundError {
 
 // ModelNotFoundErrorType 模型未找到错误的类型包装器，用于在错误处理中识别
 type ModelNotFoundErrorType struct {
+	Model     string // 请求的模型名
 	ErrorData *ModelNotFoundError
 }
 
@@ -72,6 +73,7 @@ func (e *ModelNotFoundErrorType) Error() string {
 // NewModelNotFoundErrorType 创建模型未找到错误类型
 func NewModelNotFoundErrorType(model, requestId string) *ModelNotFoundErrorType {
 	return &ModelNotFoundErrorType{
+		Model:     model,
 		ErrorData: NewModelNotFoundError(model, requestId),
 	}
 }
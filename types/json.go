@@ -0,0 +1,11 @@
+//go:build !stdjson
+
+package types
+
+import "github.com/bytedance/sonic"
+
+// unmarshalJSON 大请求体的解析使用sonic；-tags stdjson 时退回encoding/json（见json_std.go）
+// types不能依赖utils（utils依赖types），因此单独提供与utils.SafeUnmarshal一致的实现
+func unmarshalJSON(data []byte, v any) error {
+	return sonic.ConfigStd.Unmarshal(data, v)
+}
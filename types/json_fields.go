@@ -0,0 +1,158 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ScanTopLevelFields 依次回调顶层JSON对象的每个字段名及其值的字节范围 data[start:end]
+// 只扫描字节跳过各字段的值，不解码也不复制，用于在大请求体中定位个别字段；
+// 值本身的合法性不在此校验，由随后的完整解析负责
+func ScanTopLevelFields(data []byte, fn func(name string, start, end int)) error {
+	i := skipJSONSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return errors.New("JSON必须是对象")
+	}
+	i = skipJSONSpace(data, i+1)
+
+	if i < len(data) && data[i] == '}' {
+		i++
+	} else {
+		for {
+			if i >= len(data) || data[i] != '"' {
+				return errJSONSyntax(i)
+			}
+			nameEnd, err := skipJSONString(data, i)
+			if err != nil {
+				return err
+			}
+			name, err := jsonObjectKey(data[i:nameEnd])
+			if err != nil {
+				return err
+			}
+
+			i = skipJSONSpace(data, nameEnd)
+			if i >= len(data) || data[i] != ':' {
+				return errJSONSyntax(i)
+			}
+			i = skipJSONSpace(data, i+1)
+			valueEnd, err := skipJSONValue(data, i)
+			if err != nil {
+				return err
+			}
+			fn(name, i, valueEnd)
+
+			i = skipJSONSpace(data, valueEnd)
+			if i >= len(data) {
+				return io.ErrUnexpectedEOF
+			}
+			if data[i] == '}' {
+				i++
+				break
+			}
+			if data[i] != ',' {
+				return errJSONSyntax(i)
+			}
+			i = skipJSONSpace(data, i+1)
+		}
+	}
+
+	if i = skipJSONSpace(data, i); i < len(data) {
+		return errJSONSyntax(i)
+	}
+	return nil
+}
+
+// errJSONSyntax data在offset处不符合JSON语法
+func errJSONSyntax(offset int) error {
+	return fmt.Errorf("JSON语法错误（位置 %d）", offset)
+}
+
+// jsonObjectKey 返回字段名，含转义字符时按JSON规则解码
+func jsonObjectKey(quoted []byte) (string, error) {
+	if bytes.IndexByte(quoted, '\\') < 0 {
+		return string(quoted[1 : len(quoted)-1]), nil
+	}
+	var name string
+	if err := json.Unmarshal(quoted, &name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// skipJSONSpace 跳过空白，返回下一个非空白字符的位置
+func skipJSONSpace(data []byte, i int) int {
+	for i < len(data) {
+		switch data[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipJSONString 跳过从data[i]（引号）开始的字符串，返回结束引号之后的位置
+func skipJSONString(data []byte, i int) (int, error) {
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return -1, io.ErrUnexpectedEOF
+}
+
+// skipJSONValue 跳过从data[i]开始的一个值，返回值之后的位置
+// 对象和数组只按括号深度跳过（忽略字符串内的括号），不校验内部结构
+func skipJSONValue(data []byte, i int) (int, error) {
+	if i >= len(data) {
+		return -1, io.ErrUnexpectedEOF
+	}
+	switch data[i] {
+	case '"':
+		return skipJSONString(data, i)
+	case '{', '[':
+		depth := 0
+		for i < len(data) {
+			switch data[i] {
+			case '"':
+				next, err := skipJSONString(data, i)
+				if err != nil {
+					return -1, err
+				}
+				i = next
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1, nil
+				}
+			}
+			i++
+		}
+		return -1, io.ErrUnexpectedEOF
+	default:
+		// 数字、true、false、null：到下一个分隔符为止
+		start := i
+		for i < len(data) {
+			switch data[i] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				if i == start {
+					return -1, errJSONSyntax(i)
+				}
+				return i, nil
+			}
+			i++
+		}
+		return i, nil
+	}
+}
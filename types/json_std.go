@@ -0,0 +1,10 @@
+//go:build stdjson
+
+package types
+
+import "encoding/json"
+
+// unmarshalJSON 使用 -tags stdjson 构建时退回encoding/json
+func unmarshalJSON(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
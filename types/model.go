@@ -9,6 +9,14 @@ type Model struct {
 	DisplayName string `json:"display_name"`
 	Type        string `json:"type"`
 	MaxTokens   int    `json:"max_tokens"`
+	Status      string `json:"status,omitempty"` // 模型映射校验状态（仅在校验后出现）
+
+	// 模型能力，供客户端按模型启用或禁用功能
+	SupportsTools    bool `json:"supports_tools"`
+	SupportsVision   bool `json:"supports_vision"`
+	SupportsThinking bool `json:"supports_thinking"`
+	MaxOutputTokens  int  `json:"max_output_tokens"`
+	ContextWindow    int  `json:"context_window"`
 }
 
 // ModelsResponse 表示模型列表响应
@@ -1,10 +1,17 @@
 package types
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
 // OpenAI兼容的数据结构
 type OpenAIMessage struct {
 	Role      string           `json:"role"`
 	Content   any              `json:"content"` // 可以是 string 或 []ContentBlock
 	ToolCalls []OpenAIToolCall `json:"tool_calls,omitempty"`
+	Refusal   string           `json:"refusal,omitempty"` // 模型拒绝回答时的说明
 }
 
 type OpenAIToolCall struct {
@@ -45,9 +52,92 @@ type OpenAIRequest struct {
 	Messages    []OpenAIMessage `json:"messages"`
 	MaxTokens   *int            `json:"max_tokens,omitempty"`
 	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
 	Stream      *bool           `json:"stream,omitempty"`
 	Tools       []OpenAITool    `json:"tools,omitempty"`
 	ToolChoice  any             `json:"tool_choice,omitempty"` // 可以是 "auto", "none", "required" 或 OpenAIToolChoice
+	Stop        OpenAIStop      `json:"stop,omitempty"`
+
+	MaxCompletionTokens *int `json:"max_completion_tokens,omitempty"` // 新版客户端的输出上限字段，与max_tokens同时出现时优先使用
+
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"` // false对应Anthropic的disable_parallel_tool_use
+
+	ResponseFormat *OpenAIResponseFormat `json:"response_format,omitempty"`
+
+	ReasoningEffort string `json:"reasoning_effort,omitempty"` // 推理模型参数，上游不支持，仅接受以免解析失败
+}
+
+// RequestedMaxTokens 返回请求的输出上限：优先max_completion_tokens，其次max_tokens
+// 都未指定时返回0和false，由调用方按模型取默认值（config.DefaultMaxTokensOf）
+func (r OpenAIRequest) RequestedMaxTokens() (int, bool) {
+	switch {
+	case r.MaxCompletionTokens != nil:
+		return *r.MaxCompletionTokens, true
+	case r.MaxTokens != nil:
+		return *r.MaxTokens, true
+	default:
+		return 0, false
+	}
+}
+
+// MaxTokensConflict 判断max_completion_tokens与max_tokens是否同时指定且取值不同
+func (r OpenAIRequest) MaxTokensConflict() bool {
+	return r.MaxCompletionTokens != nil && r.MaxTokens != nil && *r.MaxCompletionTokens != *r.MaxTokens
+}
+
+// OpenAIResponseFormat OpenAI的response_format参数，目前支持 text 和 json_object
+type OpenAIResponseFormat struct {
+	Type string `json:"type"`
+}
+
+// MaxOpenAIStopSequences OpenAI stop参数允许的最大条目数
+const MaxOpenAIStopSequences = 4
+
+// OpenAIStop OpenAI的stop参数，可以是单个字符串或最多4个字符串的数组
+// 统一解析为字符串切片，空字符串会被忽略
+type OpenAIStop []string
+
+func (s *OpenAIStop) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || string(trimmed) == "null" {
+		*s = nil
+		return nil
+	}
+
+	switch trimmed[0] {
+	case '"':
+		var single string
+		if err := json.Unmarshal(trimmed, &single); err != nil {
+			return fmt.Errorf("stop参数无效: %w", err)
+		}
+		*s = nil
+		if single != "" {
+			*s = OpenAIStop{single}
+		}
+		return nil
+	case '[':
+		var items []any
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return fmt.Errorf("stop参数无效: %w", err)
+		}
+		if len(items) > MaxOpenAIStopSequences {
+			return fmt.Errorf("stop参数最多支持%d个字符串，实际%d个", MaxOpenAIStopSequences, len(items))
+		}
+		sequences := make(OpenAIStop, 0, len(items))
+		for i, item := range items {
+			str, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("stop参数第%d项必须是字符串", i)
+			}
+			if str != "" {
+				sequences = append(sequences, str)
+			}
+		}
+		*s = sequences
+		return nil
+	default:
+		return fmt.Errorf("stop参数必须是字符串或字符串数组")
+	}
 }
 
 type OpenAIChoice struct {
@@ -63,4 +153,5 @@ type OpenAIResponse struct {
 	Model   string         `json:"model"`
 	Choices []OpenAIChoice `json:"choices"`
 	Usage   Usage          `json:"usage"`
+	Kiro    any            `json:"kiro,omitempty"` // X-Kiro-Verbose时的有效参数回显
 }
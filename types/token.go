@@ -1,6 +1,7 @@
 package types
 
 import (
+	"kiro2api/config"
 	"time"
 )
 
@@ -25,9 +26,15 @@ func (t *Token) FromRefreshResponse(resp RefreshResponse, originalRefreshToken s
 	t.ExpiresAt = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
 }
 
-// IsExpired 检查token是否已过期
+// IsExpired 检查token是否已过期（含EXPIRY_SKEW提前量）
 func (t *Token) IsExpired() bool {
-	return time.Now().After(t.ExpiresAt)
+	return t.IsExpiredAt(time.Now())
+}
+
+// IsExpiredAt 检查token在指定时刻是否已过期
+// 提前EXPIRY_SKEW视为过期，使本机时钟偏慢时也能在真正失效前刷新
+func (t *Token) IsExpiredAt(now time.Time) bool {
+	return now.After(t.ExpiresAt.Add(-config.ClampExpirySkew(config.ExpirySkew)))
 }
 
 // 兼容性别名 - 逐步迁移时使用
@@ -14,6 +14,10 @@ const (
 	AccountStatusExpired   = "expired"   // 已过期
 	AccountStatusDisabled  = "disabled"  // 已禁用
 	AccountStatusError     = "error"     // 错误
+	AccountStatusPending   = "pending"   // 尚未完成后台检查
+
+	AccountStatusRefreshThrottled = "refresh_throttled" // 刷新被身份提供方限流，所在ClientID组退避中
+	AccountStatusScheduledOff     = "scheduled_off"     // 处于计划停用时段，暂不参与选择
 )
 
 // UsageLimits 使用限制响应结构 (基于token.md中的API规范)
@@ -168,16 +172,22 @@ func (t *TokenWithUsage) NeedsUsageRefresh() bool {
 	return false
 }
 
-// GenerateTokenPreview 生成token预览字符串 (***+后10位)
+// GenerateTokenPreview 生成token预览字符串 (***+后N位，N由TOKEN_PREVIEW_SUFFIX_LEN配置)
 func (t *TokenWithUsage) GenerateTokenPreview() string {
-	if len(t.AccessToken) <= 10 {
+	return TokenPreview(t.AccessToken)
+}
+
+// TokenPreview 生成token预览字符串 (***+后N位)
+// token长度不超过N时全部用*代替，避免短token被完整暴露
+func TokenPreview(token string) string {
+	suffixLen := config.ClampTokenPreviewSuffixLen(config.TokenPreviewSuffixLen)
+	if len(token) <= suffixLen {
 		// 如果token太短，全部用*代替
-		return strings.Repeat("*", len(t.AccessToken))
+		return strings.Repeat("*", len(token))
 	}
 
-	// 3个*号 + 后10位
-	suffix := t.AccessToken[len(t.AccessToken)-10:]
-	return "***" + suffix
+	// 3个*号 + 后N位
+	return "***" + token[len(token)-suffixLen:]
 }
 
 // GetUserEmailDisplay 获取用户邮箱显示名称
@@ -3,29 +3,31 @@ package utils
 import (
 	"bytes"
 	"io"
+	"sync"
 )
 
+// maxPooledBufferSize 超过该容量的缓冲区用完后不放回对象池，避免偶发的超大响应长期占用内存
+const maxPooledBufferSize = 16 << 20
+
+// responseBufferPool 读取响应体的中间缓冲区，复用以减少大响应体读取时的反复扩容
+var responseBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
 // ReadHTTPResponse 通用的HTTP响应体读取函数（使用对象池优化）
+// 读取出错时返回已读到的部分数据和错误
 func ReadHTTPResponse(body io.Reader) ([]byte, error) {
-	// 直接分配缓冲区，Go GC会自动管理
-	buffer := bytes.NewBuffer(nil)
-	buf := make([]byte, 1024)
-
-	for {
-		n, err := body.Read(buf)
-		if n > 0 {
-			buffer.Write(buf[:n])
-		}
-		if err != nil {
-			result := buffer.Bytes()
-			// 确保空body返回空切片而不是nil，保持向后兼容
-			if result == nil {
-				result = []byte{}
-			}
-			if err == io.EOF {
-				return result, nil
-			}
-			return result, err
+	buffer := responseBufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer func() {
+		if buffer.Cap() <= maxPooledBufferSize {
+			responseBufferPool.Put(buffer)
 		}
-	}
+	}()
+
+	_, err := buffer.ReadFrom(body)
+	// 缓冲区会被复用，返回独立的副本；空body返回空切片而不是nil，保持向后兼容
+	result := make([]byte, buffer.Len())
+	copy(result, buffer.Bytes())
+	return result, err
 }
@@ -116,3 +116,23 @@ func TestReadHTTPResponse_ExactlyOneKB(t *testing.T) {
 	assert.Equal(t, 1024, len(result))
 	assert.Equal(t, testData, string(result))
 }
+
+func TestReadHTTPResponse_ResultNotSharedWithPool(t *testing.T) {
+	first, err := ReadHTTPResponse(strings.NewReader("first response"))
+	assert.NoError(t, err)
+	_, err = ReadHTTPResponse(strings.NewReader("second response that is longer"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "first response", string(first), "缓冲区复用不应影响已返回的结果")
+}
+
+func BenchmarkReadHTTPResponse5MB(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), (5<<20)/16)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadHTTPResponse(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,9 +1,13 @@
+//go:build !stdjson
+
 package utils
 
 import (
 	"github.com/bytedance/sonic"
 )
 
+// 默认使用sonic；sonic不支持的平台或排查编码差异时可用 -tags stdjson 切换到encoding/json（见json_std.go）
+
 // 高性能JSON配置
 var (
 	// FastestConfig 最快的JSON配置，用于性能关键路径
@@ -0,0 +1,34 @@
+//go:build stdjson
+
+package utils
+
+import (
+	"encoding/json"
+)
+
+// 使用 -tags stdjson 构建时JSON辅助函数退回encoding/json，行为与sonic的ConfigStd一致
+
+// FastMarshal JSON序列化
+func FastMarshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// FastUnmarshal JSON反序列化
+func FastUnmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// SafeMarshal JSON序列化
+func SafeMarshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// SafeUnmarshal JSON反序列化
+func SafeUnmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// MarshalIndent 带缩进的JSON序列化
+func MarshalIndent(v any, prefix, indent string) ([]byte, error) {
+	return json.MarshalIndent(v, prefix, indent)
+}
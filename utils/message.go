@@ -96,106 +96,99 @@ func ParseToolResultContent(content any) string {
 	}
 }
 
+// EmptyContentPlaceholder 消息没有任何文本内容时GetMessageContent返回的占位文本
+const EmptyContentPlaceholder = "answer for user question"
+
+// imageOnlyContentPrompt 消息只有图片时GetMessageContent返回的提示
+const imageOnlyContentPrompt = "请描述这张图片的内容"
+
 // GetMessageContent 从消息中提取文本内容的辅助函数，支持图片内容
+// 没有任何内容时返回EmptyContentPlaceholder
 func GetMessageContent(content any) (string, error) {
+	text, found, hasImage, err := extractMessageText(content)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case found:
+		return text, nil
+	case hasImage:
+		return imageOnlyContentPrompt, nil
+	default:
+		return EmptyContentPlaceholder, nil
+	}
+}
+
+// MessageContentEmpty 消息是否没有任何实际内容（空字符串、只有空白、没有可用的内容块）
+// 客户端原样发送的占位文本不视为空，由调用方按需另行判断
+func MessageContentEmpty(content any) bool {
+	text, _, hasImage, err := extractMessageText(content)
+	return err == nil && !hasImage && strings.TrimSpace(text) == ""
+}
+
+// extractMessageText 提取消息中的文本，不做占位替换；found表示找到了文本或可用的内容块
+func extractMessageText(content any) (text string, found bool, hasImage bool, err error) {
 	switch v := content.(type) {
 	case types.AnthropicSystemMessage:
-		return v.Text, nil
+		return v.Text, true, false, nil
 	case string:
-		if len(v) == 0 {
-			return "answer for user question", nil
-		}
-		return v, nil
+		return v, v != "", false, nil
 	case []any:
-		var texts []string
-		hasImage := false
+		contentBlocks := make([]types.ContentBlock, 0, len(v))
 		for _, block := range v {
 			if m, ok := block.(map[string]any); ok {
 				var cb types.ContentBlock
 				if data, err := sonic.Marshal(m); err == nil {
 					if err := sonic.Unmarshal(data, &cb); err == nil {
-						switch cb.Type {
-						case "tool_result":
-							if cb.Content != nil {
-								toolResultContent := ParseToolResultContent(cb.Content)
-
-								// 检查是否为错误结果
-								if cb.IsError != nil && *cb.IsError {
-									toolResultContent = "Tool Error: " + toolResultContent
-								}
-
-								// 添加tool_use_id信息以便追踪
-								if cb.ToolUseId != nil && *cb.ToolUseId != "" {
-									toolResultContent = fmt.Sprintf("Tool result for %s: %s", *cb.ToolUseId, toolResultContent)
-								}
-
-								texts = append(texts, toolResultContent)
-							}
-						case "text":
-							if cb.Text != nil {
-								texts = append(texts, *cb.Text)
-							}
-						case "image":
-							hasImage = true
-							if cb.Source != nil {
-								texts = append(texts, fmt.Sprintf("[图片: %s格式]", cb.Source.MediaType))
-							} else {
-								texts = append(texts, "[图片]")
-							}
-						}
+						contentBlocks = append(contentBlocks, cb)
 					}
 				}
 			}
 		}
-		if len(texts) == 0 && hasImage {
-			return "请描述这张图片的内容", nil
-		}
-		if len(texts) == 0 {
-			return "answer for user question", nil
-		}
-		return strings.Join(texts, "\n"), nil
+		texts, hasImage := contentBlocksText(contentBlocks)
+		return strings.Join(texts, "\n"), len(texts) > 0, hasImage, nil
 	case []types.ContentBlock:
-		var texts []string
-		hasImage := false
-		for _, cb := range v {
-			switch cb.Type {
-			case "tool_result":
-				if cb.Content != nil {
-					toolResultContent := ParseToolResultContent(cb.Content)
-
-					// 检查是否为错误结果
-					if cb.IsError != nil && *cb.IsError {
-						toolResultContent = "Tool Error: " + toolResultContent
-					}
-
-					// 添加tool_use_id信息以便追踪
-					if cb.ToolUseId != nil && *cb.ToolUseId != "" {
-						toolResultContent = fmt.Sprintf("Tool result for %s: %s", *cb.ToolUseId, toolResultContent)
-					}
+		texts, hasImage := contentBlocksText(v)
+		return strings.Join(texts, "\n"), len(texts) > 0, hasImage, nil
+	default:
+		return "", false, false, fmt.Errorf("unsupported content type: %T", v)
+	}
+}
 
-					texts = append(texts, toolResultContent)
-				}
-			case "text":
-				if cb.Text != nil {
-					texts = append(texts, *cb.Text)
+// contentBlocksText 提取内容块中的文本、工具结果和图片描述
+func contentBlocksText(blocks []types.ContentBlock) ([]string, bool) {
+	var texts []string
+	hasImage := false
+	for _, cb := range blocks {
+		switch cb.Type {
+		case "tool_result":
+			if cb.Content != nil {
+				toolResultContent := ParseToolResultContent(cb.Content)
+
+				// 检查是否为错误结果
+				if cb.IsError != nil && *cb.IsError {
+					toolResultContent = "Tool Error: " + toolResultContent
 				}
-			case "image":
-				hasImage = true
-				if cb.Source != nil {
-					texts = append(texts, fmt.Sprintf("[图片: %s格式]", cb.Source.MediaType))
-				} else {
-					texts = append(texts, "[图片]")
+
+				// 添加tool_use_id信息以便追踪
+				if cb.ToolUseId != nil && *cb.ToolUseId != "" {
+					toolResultContent = fmt.Sprintf("Tool result for %s: %s", *cb.ToolUseId, toolResultContent)
 				}
+
+				texts = append(texts, toolResultContent)
+			}
+		case "text":
+			if cb.Text != nil {
+				texts = append(texts, *cb.Text)
+			}
+		case "image":
+			hasImage = true
+			if cb.Source != nil {
+				texts = append(texts, fmt.Sprintf("[图片: %s格式]", cb.Source.MediaType))
+			} else {
+				texts = append(texts, "[图片]")
 			}
 		}
-		if len(texts) == 0 && hasImage {
-			return "请描述这张图片的内容", nil
-		}
-		if len(texts) == 0 {
-			return "answer for user question", nil
-		}
-		return strings.Join(texts, "\n"), nil
-	default:
-		return "", fmt.Errorf("unsupported content type: %T", v)
 	}
+	return texts, hasImage
 }